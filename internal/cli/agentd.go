@@ -0,0 +1,124 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdAgentd = &cobra.Command{
+		Use:   "agentd --source=<PATH|URL>",
+		Short: "reconcile the node profile towards a desired state",
+		Long: `Run a long-running agent, periodically reading the desired node state
+(a "torcx-node-state-v0" manifest) from a local file or an HTTP(S) endpoint.
+Missing images are fetched into the user store, written as a user profile
+and selected as next profile, to be applied on the following boot.
+
+The status of the last reconciliation is written to "--status-file", and
+optionally served over HTTP on "/status" and "/healthz".`,
+		RunE: runAgentd,
+	}
+	flagAgentdSource     string
+	flagAgentdInterval   time.Duration
+	flagAgentdTimeout    time.Duration
+	flagAgentdStatusFile string
+	flagAgentdListen     string
+	flagAgentdOnce       bool
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdAgentd)
+	cmdAgentd.Flags().StringVar(&flagAgentdSource, "source", "", "path or URL of the desired node state")
+	cmdAgentd.Flags().DurationVar(&flagAgentdInterval, "interval", time.Minute, "reconciliation interval")
+	cmdAgentd.Flags().DurationVar(&flagAgentdTimeout, "reconcile-timeout", 0, "timeout of each reconciliation (default interval)")
+	cmdAgentd.Flags().StringVar(&flagAgentdStatusFile, "status-file", "", "path of the status report (default RunDir + agent-status.json)")
+	cmdAgentd.Flags().StringVar(&flagAgentdListen, "listen", "", "address to serve status on (disabled if empty)")
+	cmdAgentd.Flags().BoolVar(&flagAgentdOnce, "once", false, "reconcile once and exit")
+}
+
+func runAgentd(cmd *cobra.Command, args []string) error {
+	if !hasExpFeature("AGENT") {
+		return errors.New("agent requires TORCX_EXP_AGENT")
+	}
+	if len(args) != 0 || flagAgentdSource == "" {
+		return cmd.Usage()
+	}
+	if flagAgentdInterval <= 0 {
+		return errors.New("interval must be positive")
+	}
+	if flagAgentdTimeout < 0 {
+		return errors.New("reconcile timeout must not be negative")
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	statusPath := flagAgentdStatusFile
+	if statusPath == "" {
+		statusPath = filepath.Join(commonCfg.RunDir, "agent-status.json")
+	}
+	agent := torcx.NewAgent(commonCfg, flagAgentdSource, statusPath)
+	agent.Timeout = flagAgentdTimeout
+	if agent.Timeout == 0 {
+		agent.Timeout = flagAgentdInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if flagAgentdOnce {
+		return agent.Reconcile(ctx)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	if flagAgentdListen != "" {
+		server := &http.Server{Addr: flagAgentdListen, Handler: agent}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logrus.WithField("listen", flagAgentdListen).Error("status server failed: ", err)
+			}
+		}()
+		defer server.Close()
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"source":   flagAgentdSource,
+		"interval": flagAgentdInterval,
+		"status":   statusPath,
+	}).Info("agent started")
+	if err := agent.Run(ctx, flagAgentdInterval); err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
+}
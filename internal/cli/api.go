@@ -0,0 +1,32 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdAPI = &cobra.Command{
+		Use:   "api [command]",
+		Short: "Serve a local management API (experimental)",
+		Long: `This subcommand operates on the torcx varlink API over a unix socket.
+It requires the "TORCX_EXP_API" experimental flag.`,
+	}
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdAPI)
+}
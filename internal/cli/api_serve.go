@@ -0,0 +1,86 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdAPIServe = &cobra.Command{
+		Use:   "serve",
+		Short: "serve the varlink API on a unix socket",
+		Long: `Serve the "org.flatcar.torcx" varlink interface on a unix socket,
+exposing apply status, store contents, profile management and fetching.
+Read-only methods are allowed to any caller able to connect to the socket
+(owner and group); mutating ones only to root and to callers matching
+"--allow-uid" or "--allow-gid".`,
+		RunE: runAPIServe,
+	}
+	flagAPIServeSocket   string
+	flagAPIServeAllowUID []uint
+	flagAPIServeAllowGID []uint
+)
+
+func init() {
+	cmdAPI.AddCommand(cmdAPIServe)
+	cmdAPIServe.Flags().StringVar(&flagAPIServeSocket, "socket", "", "path of the API socket (default RunDir + api.sock)")
+	cmdAPIServe.Flags().UintSliceVar(&flagAPIServeAllowUID, "allow-uid", nil, "UIDs allowed to call mutating methods")
+	cmdAPIServe.Flags().UintSliceVar(&flagAPIServeAllowGID, "allow-gid", nil, "GIDs allowed to call mutating methods")
+}
+
+func runAPIServe(cmd *cobra.Command, args []string) error {
+	if !hasExpFeature("API") {
+		return errors.New("API server requires TORCX_EXP_API")
+	}
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	socketPath := flagAPIServeSocket
+	if socketPath == "" {
+		socketPath = filepath.Join(commonCfg.RunDir, "api.sock")
+	}
+
+	server := &torcx.APIServer{Config: commonCfg}
+	for _, uid := range flagAPIServeAllowUID {
+		server.Policy.WriteUIDs = append(server.Policy.WriteUIDs, uint32(uid))
+	}
+	for _, gid := range flagAPIServeAllowGID {
+		server.Policy.WriteGIDs = append(server.Policy.WriteGIDs, uint32(gid))
+	}
+
+	l, err := torcx.ListenAPISocket(socketPath)
+	if err != nil {
+		return errors.Wrapf(err, "listening on %s", socketPath)
+	}
+	defer l.Close()
+
+	logrus.WithFields(logrus.Fields{
+		"socket":    socketPath,
+		"interface": torcx.APIInterface,
+	}).Info("serving API")
+	return server.Serve(l)
+}
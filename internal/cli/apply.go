@@ -0,0 +1,61 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdApply = &cobra.Command{
+		Use:   "apply --plan=PATH",
+		Short: "approve an apply plan for next boot",
+		Long: `Verify that the plan in PATH (from "torcx plan") still matches the system,
+then select its upper profile for next boot and record it as the approved
+plan. The next apply executes it exactly, or fails if the system diverged
+from it in the meantime (e.g. a different archive or profile).`,
+		RunE: runApply,
+	}
+	flagApplyPlan string
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdApply)
+	cmdApply.Flags().StringVar(&flagApplyPlan, "plan", "", "path of the plan file to approve")
+}
+
+func runApply(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 || flagApplyPlan == "" {
+		return cmd.Usage()
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	applyCfg, err := fillApplyRuntime(commonCfg)
+	if err != nil {
+		return errors.Wrap(err, "apply configuration failed")
+	}
+
+	plan, err := torcx.ReadApplyPlan(flagApplyPlan)
+	if err != nil {
+		return err
+	}
+	return torcx.ApproveApplyPlan(applyCfg, plan)
+}
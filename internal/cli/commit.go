@@ -0,0 +1,71 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdCommit = &cobra.Command{
+		Use:   "commit",
+		Short: "commit a staged apply",
+		Long: `Commit the apply staged by "torcx stage": staged images are moved in place at
+once, their assets are propagated and the system is sealed. Nothing is
+changed if the staged apply does not match the configured profiles, or if a
+staged archive changed since.`,
+		RunE: runCommit,
+	}
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdCommit)
+}
+
+func runCommit(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	if torcx.IsExistingPath(commonCfg.RunDir) {
+		return errors.Errorf("torcx already run, %s exists", commonCfg.RunDir)
+	}
+	applyCfg, err := fillApplyRuntime(commonCfg)
+	if err != nil {
+		return errors.Wrap(err, "apply configuration failed")
+	}
+	observer, closeObserver := applyObserver(commonCfg)
+	defer closeObserver()
+	applyCfg.Observer = observer
+
+	if err := torcx.CommitProfile(applyCfg); err != nil {
+		return errors.Wrap(err, "commit failed")
+	}
+	if err := torcx.SealSystemState(applyCfg); err != nil {
+		return errors.Wrap(err, "sealing system state failed")
+	}
+	logrus.WithFields(logrus.Fields{
+		"profile": applyCfg.RunProfile(),
+	}).Info("staged apply committed")
+	return nil
+}
@@ -31,6 +31,13 @@ import (
 func fillCommonRuntime(OsRelease string) (*torcx.CommonConfig, error) {
 	var err error
 
+	if prefix := viper.GetString("root_prefix"); prefix != "" {
+		if !filepath.IsAbs(prefix) {
+			return nil, errors.Errorf("root prefix %q is not an absolute path", prefix)
+		}
+		torcx.RootPrefix = prefix
+	}
+
 	usrMountpoint := torcx.VendorUsrDir
 	path, ok := viper.Get("USR_MOUNTPOINT").(string)
 	if ok && filepath.IsAbs(path) {
@@ -39,10 +46,10 @@ func fillCommonRuntime(OsRelease string) (*torcx.CommonConfig, error) {
 
 	// Default common config settings
 	commonCfg := torcx.CommonConfig{
-		BaseDir: torcx.DefaultBaseDir,
-		RunDir:  torcx.DefaultRunDir,
+		BaseDir: torcx.RootPath(torcx.DefaultBaseDir),
+		RunDir:  torcx.RootPath(torcx.DefaultRunDir),
 		UsrDir:  usrMountpoint,
-		ConfDir: torcx.DefaultConfDir,
+		ConfDir: torcx.RootPath(torcx.DefaultConfDir),
 		StorePaths: []string{
 			torcx.VendorStoreDir(usrMountpoint),
 		},
@@ -81,6 +88,15 @@ func fillCommonRuntime(OsRelease string) (*torcx.CommonConfig, error) {
 	if confdir := viper.GetString("confdir"); confdir != "" {
 		commonCfg.ConfDir = confdir
 	}
+	if eventStream := viper.GetString("event_stream"); eventStream != "" {
+		commonCfg.EventStream = eventStream
+	}
+	if commonCfg.HashAlgorithm != "" {
+		torcx.HashAlgorithm = commonCfg.HashAlgorithm
+	}
+	if commonCfg.HashWorkers > 0 {
+		torcx.HashWorkers = commonCfg.HashWorkers
+	}
 
 	// Add user and runtime store paths (versioned first)
 	if OsRelease != "" {
@@ -91,11 +107,13 @@ func fillCommonRuntime(OsRelease string) (*torcx.CommonConfig, error) {
 	if extraStorePaths != nil {
 		commonCfg.StorePaths = append(commonCfg.StorePaths, extraStorePaths...)
 	}
+	torcx.ResolveStoreImages(&commonCfg)
 
 	if err := torcx.ValidateCommonConfig(&commonCfg); err != nil {
 		return nil, errors.Wrap(err, "invalid common config")
 	}
 	logrus.WithFields(logrus.Fields{
+		"root_prefix": torcx.RootPrefix,
 		"base_dir":    commonCfg.BaseDir,
 		"run_dir":     commonCfg.RunDir,
 		"conf_dir":    commonCfg.ConfDir,
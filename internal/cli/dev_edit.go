@@ -0,0 +1,67 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdDevEdit = &cobra.Command{
+		Use:   "edit [--discard] NAME",
+		Short: "edit the contents of an applied image in place",
+		Long: `Mount a writable overlay on the unpack root of the applied image NAME, so
+that its binaries and assets can be hot-patched. Modified files are kept in a
+scratch directory under the torcx run directory, whose path is printed as
+JSON. Propagated copies of assets (e.g. systemd units) are not updated until
+the next apply. Use "torcx dev export" to turn the modified tree back into an
+archive.
+With "--discard", the overlay is unmounted and the modifications dropped.`,
+		RunE: runDevEdit,
+	}
+	flagDevEditDiscard bool
+)
+
+func init() {
+	cmdDev.AddCommand(cmdDevEdit)
+	cmdDevEdit.Flags().BoolVar(&flagDevEditDiscard, "discard", false, "unmount the overlay and drop modifications")
+}
+
+func runDevEdit(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	if flagDevEditDiscard {
+		return torcx.DevDiscard(commonCfg, args[0])
+	}
+
+	overlay, err := torcx.DevEdit(commonCfg, args[0])
+	if err != nil {
+		return err
+	}
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	return jsonOut.Encode(overlay)
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdDevExport = &cobra.Command{
+		Use:   "export --output=PATH [--format=FORMAT] NAME",
+		Short: "export the unpacked tree of an image as an archive",
+		Long: `Write the current contents of the unpack root of the applied image NAME,
+including modifications made through "torcx dev edit", as a new archive at
+PATH (tgz by default).`,
+		RunE: runDevExport,
+	}
+	flagDevExportOutput string
+	flagDevExportFormat string
+)
+
+func init() {
+	cmdDev.AddCommand(cmdDevExport)
+	cmdDevExport.Flags().StringVarP(&flagDevExportOutput, "output", "o", "", "output archive path")
+	cmdDevExport.Flags().StringVar(&flagDevExportFormat, "format", "tgz", "archive format to export to (tgz, zst, txz, squashfs or erofs)")
+}
+
+func runDevExport(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 || args[0] == "" || flagDevExportOutput == "" {
+		return cmd.Usage()
+	}
+	format, err := torcx.ParseArchiveFormat(flagDevExportFormat)
+	if err != nil {
+		return err
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	if err := torcx.DevExport(commonCfg, args[0], format, flagDevExportOutput); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"image": args[0],
+		"path":  flagDevExportOutput,
+	}).Info("image exported")
+	return nil
+}
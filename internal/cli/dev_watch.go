@@ -0,0 +1,101 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdDevWatch = &cobra.Command{
+		Use:   "watch --target=<DIR> [--interval=<DURATION>]",
+		Short: "re-apply into a dev tree whenever the user store or profile change",
+		Long: `Watch the user store, user profiles and next-profile selection, and whenever
+they change (e.g. a rebuilt archive is copied into the user store), tear down
+the dev tree DIR and apply the profile into it again, as "torcx simulate"
+would. This tightens the edit-build-test loop for image authors.
+Only trees created by this command are torn down.`,
+		RunE: runDevWatch,
+	}
+	flagDevWatchTarget   string
+	flagDevWatchInterval time.Duration
+)
+
+func init() {
+	cmdDev.AddCommand(cmdDevWatch)
+	cmdDevWatch.Flags().StringVar(&flagDevWatchTarget, "target", "", "dev tree to apply into")
+	cmdDevWatch.Flags().DurationVar(&flagDevWatchInterval, "interval", time.Second, "polling interval")
+}
+
+func runDevWatch(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 || flagDevWatchTarget == "" {
+		return cmd.Usage()
+	}
+	if flagDevWatchInterval <= 0 {
+		return errors.New("interval must be positive")
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	observer, closeObserver := applyObserver(commonCfg)
+	defer closeObserver()
+
+	paths := commonCfg.DevWatchPaths()
+	logrus.WithFields(logrus.Fields{
+		"target":   flagDevWatchTarget,
+		"watching": paths,
+	}).Info("dev watch started")
+	err = torcx.WatchPaths(ctx, paths, flagDevWatchInterval, func() error {
+		// Profile selection may have changed as well.
+		applyCfg, err := fillApplyRuntime(commonCfg)
+		if err != nil {
+			return errors.Wrap(err, "apply configuration failed")
+		}
+		applyCfg.Observer = observer
+		if err := torcx.DevApply(applyCfg, flagDevWatchTarget); err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"target": flagDevWatchTarget,
+			"images": len(applyCfg.AppliedImages),
+		}).Info("dev tree applied")
+		return nil
+	})
+	if err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdGraph = &cobra.Command{
+		Use:   "graph",
+		Short: "show the dependency graph of the merged profile",
+		Long: `Show the images of the merged profile which would be applied on next boot,
+along with the store providing each of them, their assets, and relations
+between images (dependencies from profile fragments, reference conflicts and
+asset collisions). Archives are inspected without being unpacked.`,
+		RunE: runGraph,
+	}
+	flagGraphFormat string
+	flagGraphName   string
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdGraph)
+	cmdGraph.Flags().StringVar(&flagGraphFormat, "format", "dot", "output format, either \"dot\" or \"json\"")
+	cmdGraph.Flags().StringVar(&flagGraphName, "name", "", "upper profile name to use instead of the next profile")
+}
+
+func runGraph(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	if flagGraphFormat != "dot" && flagGraphFormat != "json" {
+		return errors.Errorf("unknown output format %q", flagGraphFormat)
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	applyCfg, err := fillApplyRuntime(commonCfg)
+	if err != nil {
+		return errors.Wrap(err, "apply configuration failed")
+	}
+	if flagGraphName != "" {
+		applyCfg.UpperProfile = flagGraphName
+	}
+
+	graph, err := torcx.BuildProfileGraph(applyCfg)
+	if err != nil {
+		return err
+	}
+
+	if flagGraphFormat == "dot" {
+		return graph.WriteDot(os.Stdout)
+	}
+
+	graphOut := ProfileGraph{
+		Kind:  TorcxProfileGraphV0K,
+		Value: *graph,
+	}
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	return jsonOut.Encode(graphOut)
+}
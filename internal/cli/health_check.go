@@ -0,0 +1,61 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdHealthCheck = &cobra.Command{
+		Use:   "health-check [--timeout=DURATION]",
+		Short: "run health checks shipped by applied images",
+		Long: `Run the health checks shipped by all images in the current run profile.
+Only if all of them pass, the run profile is recorded as the last good
+profile, for rollback purposes.`,
+		RunE: runHealthCheck,
+	}
+	flagHealthCheckTimeout time.Duration
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdHealthCheck)
+	cmdHealthCheck.Flags().DurationVar(&flagHealthCheckTimeout, "timeout", 2*time.Minute, "timeout for each health check")
+}
+
+func runHealthCheck(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	results, err := torcx.RunHealthChecks(commonCfg, flagHealthCheckTimeout)
+	for _, res := range results {
+		if res.Error != "" {
+			fmt.Printf("%s:%s %s: failed: %s\n", res.Image.Name, res.Image.Reference, res.Check, res.Error)
+			continue
+		}
+		fmt.Printf("%s:%s %s: ok\n", res.Image.Name, res.Image.Reference, res.Check)
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdHotAdd = &cobra.Command{
+		Use:   "hot-add <IMNAME>:<REF>",
+		Short: "apply one more image to the running system",
+		Long: `Apply image IMNAME+REF on top of the sealed system, without rebooting: it is
+unpacked, its binaries and units are propagated, and systemd is reloaded.
+Units are not started. Only images whose manifest declares "hot_safe", which
+ship no profile fragment nor networkd, sysusers, tmpfiles or udev assets, and
+which are not applied yet, can be hot-added. The image is appended to the
+running profile and recorded in the seal until the next apply, but not added
+to any profile.`,
+		RunE: runHotAdd,
+	}
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdHotAdd)
+}
+
+func runHotAdd(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return cmd.Usage()
+	}
+	imstr := strings.SplitN(args[0], ":", 2)
+	if len(imstr) != 2 || imstr[0] == "" || imstr[1] == "" {
+		return cmd.Usage()
+	}
+	im := torcx.Image{
+		Name:      imstr[0],
+		Reference: imstr[1],
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	applyCfg, err := fillApplyRuntime(commonCfg)
+	if err != nil {
+		return errors.Wrap(err, "apply configuration failed")
+	}
+
+	applied, err := torcx.HotAdd(applyCfg, im)
+	if err != nil {
+		return errors.Wrapf(err, "failed to hot-add %s:%s", im.Name, im.Reference)
+	}
+	fmt.Printf("%s:%s %s\n", applied.Name, applied.Reference, applied.Root)
+	return nil
+}
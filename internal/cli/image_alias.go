@@ -0,0 +1,93 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdImageAlias = &cobra.Command{
+		Use:   "alias [<IMNAME>:<ALIAS> [<REF>]]",
+		Short: "manage image reference aliases",
+		Long: `Point the alias reference ALIAS of image IMNAME to the existing
+reference REF (e.g. "docker:current" to "20.10.12"), replacing any previous
+alias. Aliases live in writable stores and can be used in profiles as any
+other reference; they are resolved at apply time, and the concrete target
+is recorded in the seal file.
+
+Without arguments, all aliases are listed. With "--remove", the alias
+IMNAME:ALIAS is removed.`,
+		RunE: runImageAlias,
+	}
+	flagImageAliasRemove bool
+)
+
+func init() {
+	cmdImage.AddCommand(cmdImageAlias)
+	cmdImageAlias.Flags().BoolVar(&flagImageAliasRemove, "remove", false, "remove the alias")
+}
+
+func runImageAlias(cmd *cobra.Command, args []string) error {
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	if len(args) == 0 {
+		if flagImageAliasRemove {
+			return cmd.Usage()
+		}
+		aliases, err := torcx.ListImageAliases(commonCfg)
+		if err != nil {
+			return err
+		}
+		for _, al := range aliases {
+			fmt.Println(al.String())
+		}
+		return nil
+	}
+
+	imstr := strings.SplitN(args[0], ":", 2)
+	if len(imstr) != 2 || imstr[0] == "" || imstr[1] == "" {
+		return cmd.Usage()
+	}
+	name, alias := imstr[0], imstr[1]
+
+	if flagImageAliasRemove {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+		if err := torcx.RemoveImageAlias(commonCfg, name, alias); err != nil {
+			return errors.Wrapf(err, "failed to remove alias %s:%s", name, alias)
+		}
+		return nil
+	}
+
+	if len(args) != 2 || args[1] == "" {
+		return cmd.Usage()
+	}
+	path, err := torcx.SetImageAlias(commonCfg, name, alias, args[1])
+	if err != nil {
+		return errors.Wrapf(err, "failed to set alias %s:%s", name, alias)
+	}
+	fmt.Println(path)
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"os"
+	"strings"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdImageCat = &cobra.Command{
+		Use:   "cat IMNAME:REF <PATH>",
+		Short: "print a file from an image archive in the store",
+		Long: `Print the regular file at PATH in the archive for image IMNAME+REF in the
+stores, without unpacking it (e.g. "/.torcx/manifest.json").
+Reading squashfs archives requires unsquashfs, and erofs ones fsck.erofs.`,
+		RunE: runImageCat,
+	}
+)
+
+func init() {
+	cmdImage.AddCommand(cmdImageCat)
+}
+
+func runImageCat(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 || args[1] == "" {
+		return cmd.Usage()
+	}
+	imstr := strings.SplitN(args[0], ":", 2)
+	if len(imstr) != 2 || imstr[0] == "" || imstr[1] == "" {
+		return cmd.Usage()
+	}
+	im := torcx.Image{
+		Name:      imstr[0],
+		Reference: imstr[1],
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	reader, err := commonCfg.OpenImage(im)
+	if err != nil {
+		return err
+	}
+	b, err := reader.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdImageConvert = &cobra.Command{
+		Use:   "convert --format=<FORMAT> <IMNAME>:<REF>",
+		Short: "convert a stored image archive to another format",
+		Long: `Convert the archive for image IMNAME+REF to FORMAT (tgz, zst, txz, squashfs or erofs).
+The converted archive is stored next to the source one (or in the user store,
+if the source is in a read-only store) and its hash is recorded.
+Archive contents, including the image manifest, are preserved.`,
+		RunE: runImageConvert,
+	}
+	flagImageConvertFormat  string
+	flagImageConvertReplace bool
+)
+
+func init() {
+	cmdImage.AddCommand(cmdImageConvert)
+	cmdImageConvert.Flags().StringVar(&flagImageConvertFormat, "format", "", "target archive format (tgz, zst, txz, squashfs or erofs)")
+	cmdImageConvert.Flags().BoolVar(&flagImageConvertReplace, "replace", false, "remove the source archive once converted")
+}
+
+func runImageConvert(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 || flagImageConvertFormat == "" {
+		return cmd.Usage()
+	}
+	imstr := strings.SplitN(args[0], ":", 2)
+	if len(imstr) != 2 || imstr[0] == "" || imstr[1] == "" {
+		return cmd.Usage()
+	}
+	im := torcx.Image{
+		Name:      imstr[0],
+		Reference: imstr[1],
+	}
+	format, err := torcx.ParseArchiveFormat(flagImageConvertFormat)
+	if err != nil {
+		return err
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	storeCache, err := torcx.NewStoreCache(commonCfg.StorePaths)
+	if err != nil {
+		return err
+	}
+	archive, err := storeCache.ArchiveFor(im)
+	if err != nil {
+		return err
+	}
+
+	converted, err := torcx.ConvertStoredArchive(commonCfg, archive, format, flagImageConvertReplace)
+	if err != nil {
+		return errors.Wrapf(err, "failed to convert %s:%s", im.Name, im.Reference)
+	}
+	fmt.Println(converted.Filepath)
+	return nil
+}
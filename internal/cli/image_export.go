@@ -0,0 +1,102 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdImageExport = &cobra.Command{
+		Use:   "export <IMNAME>:<REF>",
+		Short: "export an image archive from the store",
+		Long: `Export the archive for image IMNAME+REF from the stores, to a path or to
+stdout. Archives with a recorded hash are verified before being exported.
+If "--format" is specified, the archive is converted to the given format.`,
+		RunE: runImageExport,
+	}
+	flagImageExportFormat string
+	flagImageExportOutput string
+)
+
+func init() {
+	cmdImage.AddCommand(cmdImageExport)
+	cmdImageExport.Flags().StringVar(&flagImageExportFormat, "format", "", "archive format to export to (tgz, zst, txz, squashfs or erofs)")
+	cmdImageExport.Flags().StringVarP(&flagImageExportOutput, "output", "o", "-", "output path, or \"-\" for stdout")
+}
+
+func runImageExport(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return cmd.Usage()
+	}
+	imstr := strings.SplitN(args[0], ":", 2)
+	if len(imstr) != 2 || imstr[0] == "" || imstr[1] == "" {
+		return cmd.Usage()
+	}
+	im := torcx.Image{
+		Name:      imstr[0],
+		Reference: imstr[1],
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	storeCache, err := torcx.NewStoreCache(commonCfg.StorePaths)
+	if err != nil {
+		return err
+	}
+	archive, err := storeCache.ArchiveFor(im)
+	if err != nil {
+		return err
+	}
+
+	format := archive.Format
+	if flagImageExportFormat != "" {
+		format, err = torcx.ParseArchiveFormat(flagImageExportFormat)
+		if err != nil {
+			return err
+		}
+	}
+
+	if flagImageExportOutput != "-" {
+		// Write to a temporary file first, not to leave partial exports.
+		outPath := flagImageExportOutput
+		fp, err := os.OpenFile(outPath+".partial", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(fp.Name())
+		defer fp.Close()
+		if err := torcx.ExportArchive(archive, format, fp); err != nil {
+			return errors.Wrapf(err, "failed to export %s:%s", im.Name, im.Reference)
+		}
+		if err := fp.Close(); err != nil {
+			return err
+		}
+		return os.Rename(fp.Name(), filepath.Clean(outPath))
+	}
+
+	if err := torcx.ExportArchive(archive, format, os.Stdout); err != nil {
+		return errors.Wrapf(err, "failed to export %s:%s", im.Name, im.Reference)
+	}
+	return nil
+}
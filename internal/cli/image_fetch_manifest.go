@@ -0,0 +1,84 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdImageFetchManifest = &cobra.Command{
+		Use:   "fetch-manifest --remote=NAME IMNAME:REF",
+		Short: "fetch the manifest of a remote image, without its archive",
+		Long: `Fetch the image manifest and profile fragment published by a remote
+alongside the archive for image IMNAME+REF, without downloading the archive.
+This allows checking assets and dependencies of an image before fetching it.`,
+		RunE: runImageFetchManifest,
+	}
+	flagImageFetchManifestRemote  string
+	flagImageFetchManifestTimeout time.Duration
+)
+
+func init() {
+	cmdImage.AddCommand(cmdImageFetchManifest)
+	cmdImageFetchManifest.Flags().StringVar(&flagImageFetchManifestRemote, "remote", "", "remote publishing the image")
+	cmdImageFetchManifest.Flags().DurationVar(&flagImageFetchManifestTimeout, "timeout", time.Minute, "timeout for fetching manifests")
+}
+
+func runImageFetchManifest(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 || flagImageFetchManifestRemote == "" {
+		return cmd.Usage()
+	}
+	imstr := strings.SplitN(args[0], ":", 2)
+	if len(imstr) != 2 || imstr[0] == "" || imstr[1] == "" {
+		return cmd.Usage()
+	}
+	im := torcx.Image{
+		Name:      imstr[0],
+		Reference: imstr[1],
+		Remote:    flagImageFetchManifestRemote,
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flagImageFetchManifestTimeout)
+	defer cancel()
+	rc, err := commonCfg.LoadRemotes(ctx, []string{im.Remote})
+	if err != nil {
+		return err
+	}
+	meta, err := rc.FetchMetadata(ctx, im)
+	if err != nil {
+		return err
+	}
+
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	return jsonOut.Encode(ImageFetchManifest{
+		Kind:  TorcxImageFetchManifestV0K,
+		Value: *meta,
+	})
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdImageFiles = &cobra.Command{
+		Use:   "files IMNAME:REF",
+		Short: "list the entries of an image archive in the store",
+		Long: `List the entries of the archive for image IMNAME+REF in the stores, without
+unpacking it, one per line as "MODE SIZE PATH" (with " -> TARGET" for
+symlinks). Reading squashfs archives requires unsquashfs, and erofs ones
+fsck.erofs.`,
+		RunE: runImageFiles,
+	}
+)
+
+func init() {
+	cmdImage.AddCommand(cmdImageFiles)
+}
+
+func runImageFiles(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return cmd.Usage()
+	}
+	imstr := strings.SplitN(args[0], ":", 2)
+	if len(imstr) != 2 || imstr[0] == "" || imstr[1] == "" {
+		return cmd.Usage()
+	}
+	im := torcx.Image{
+		Name:      imstr[0],
+		Reference: imstr[1],
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	reader, err := commonCfg.OpenImage(im)
+	if err != nil {
+		return err
+	}
+	entries, err := reader.Entries()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		line := fmt.Sprintf("%s %d %s", entry.Mode, entry.Size, entry.Path)
+		if entry.Linkname != "" {
+			line += " -> " + entry.Linkname
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
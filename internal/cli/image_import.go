@@ -0,0 +1,75 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/openpgp"
+)
+
+var (
+	cmdImageImport = &cobra.Command{
+		Use:   "import [--remote=<NAME>] [--namespace=<NS>] <ARCHIVE>",
+		Short: "import a self-describing archive into the user store",
+		Long: `Import the local archive file ARCHIVE into the user store, without a
+remote contents manifest. The archive must come with its metadata sidecar
+(ARCHIVE.meta), whose hash is verified before the archive is installed.
+If "--remote" is specified, or if the signature policy requires it, the
+signature embedded in the metadata is also checked (against the keyrings of
+remote NAME, or against the machine trust store).
+With "--namespace", the archive is imported into namespace NS of the user
+store, as image NS/NAME; it must then be signed by a key of the namespace,
+if it has any.
+On success, the imported archive path is printed.`,
+		RunE: runImageImport,
+	}
+	flagImageImportRemote    string
+	flagImageImportNamespace string
+)
+
+func init() {
+	cmdImage.AddCommand(cmdImageImport)
+	cmdImageImport.Flags().StringVar(&flagImageImportRemote, "remote", "", "remote whose keyrings to verify against")
+	cmdImageImport.Flags().StringVar(&flagImageImportNamespace, "namespace", "", "store namespace to import into")
+}
+
+func runImageImport(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return cmd.Usage()
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	var keyrings []openpgp.KeyRing
+	if flagImageImportRemote != "" {
+		keyrings, err = commonCfg.RemoteKeyrings(flagImageImportRemote)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load keyrings for %s", flagImageImportRemote)
+		}
+	}
+
+	archive, err := torcx.ImportArchiveInto(commonCfg, args[0], flagImageImportNamespace, keyrings)
+	if err != nil {
+		return errors.Wrapf(err, "failed to import %s", args[0])
+	}
+	fmt.Println(archive.Filepath)
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdImageInspect = &cobra.Command{
+		Use:   "inspect [--remote=NAME] IMNAME:REF",
+		Short: "inspect an image archive in the store",
+		Long: `Inspect the archive for image IMNAME+REF in the stores, without unpacking
+it, reporting its assets, profile fragment and version notes.
+If the image manifest carries no notes, they are looked up in the cached
+contents manifest of the remote given with "--remote".`,
+		RunE: runImageInspect,
+	}
+	flagImageInspectRemote string
+)
+
+func init() {
+	cmdImage.AddCommand(cmdImageInspect)
+	cmdImageInspect.Flags().StringVar(&flagImageInspectRemote, "remote", "", "remote to look up version notes from")
+}
+
+func runImageInspect(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return cmd.Usage()
+	}
+	imstr := strings.SplitN(args[0], ":", 2)
+	if len(imstr) != 2 || imstr[0] == "" || imstr[1] == "" {
+		return cmd.Usage()
+	}
+	im := torcx.Image{
+		Name:      imstr[0],
+		Reference: imstr[1],
+		Remote:    flagImageInspectRemote,
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	inspection, err := commonCfg.InspectImage(im)
+	if err != nil {
+		return err
+	}
+
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	return jsonOut.Encode(ImageInspect{
+		Kind:  TorcxImageInspectV0K,
+		Value: *inspection,
+	})
+}
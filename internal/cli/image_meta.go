@@ -0,0 +1,62 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdImageMeta = &cobra.Command{
+		Use:   "meta [--signature=<PATH>] <ARCHIVE>",
+		Short: "write the metadata sidecar of a local archive",
+		Long: `Compute the metadata of the local archive file ARCHIVE (its hash, its
+image manifest and its detached signature, ARCHIVE.asc by default) and write
+it to the ARCHIVE.meta sidecar, so that the archive can be imported and
+verified on its own.
+On success, the sidecar path is printed.`,
+		RunE: runImageMeta,
+	}
+	flagImageMetaSignature string
+)
+
+func init() {
+	cmdImage.AddCommand(cmdImageMeta)
+	cmdImageMeta.Flags().StringVar(&flagImageMetaSignature, "signature", "", "path to the detached signature")
+}
+
+func runImageMeta(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return cmd.Usage()
+	}
+	archivePath := args[0]
+	sigPath := flagImageMetaSignature
+	if sigPath == "" {
+		sigPath = archivePath + ".asc"
+	}
+
+	meta, err := torcx.NewArchiveMeta(archivePath, sigPath)
+	if err != nil {
+		return err
+	}
+	if err := torcx.WriteArchiveMeta(archivePath, meta); err != nil {
+		return err
+	}
+	fmt.Println(archivePath + ".meta")
+	return nil
+}
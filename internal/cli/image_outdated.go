@@ -0,0 +1,76 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdImageOutdated = &cobra.Command{
+		Use:   "outdated [--name=PNAME]",
+		Short: "list profile images with newer versions on their remote",
+		Long: `Check the images of the merged profile which would be applied on next boot
+against their remotes, listing the newer versions available for each of them,
+along with their notes. Images without a remote are skipped.`,
+		RunE: runImageOutdated,
+	}
+	flagImageOutdatedName    string
+	flagImageOutdatedTimeout time.Duration
+)
+
+func init() {
+	cmdImage.AddCommand(cmdImageOutdated)
+	cmdImageOutdated.Flags().StringVar(&flagImageOutdatedName, "name", "", "upper profile name to use instead of the next profile")
+	cmdImageOutdated.Flags().DurationVar(&flagImageOutdatedTimeout, "timeout", time.Minute, "timeout for fetching contents manifests")
+}
+
+func runImageOutdated(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	applyCfg, err := fillApplyRuntime(commonCfg)
+	if err != nil {
+		return errors.Wrap(err, "apply configuration failed")
+	}
+	if flagImageOutdatedName != "" {
+		applyCfg.UpperProfile = flagImageOutdatedName
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flagImageOutdatedTimeout)
+	defer cancel()
+	outdated, err := torcx.OutdatedImages(ctx, applyCfg)
+	if err != nil {
+		return err
+	}
+
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	return jsonOut.Encode(ImageOutdated{
+		Kind:  TorcxImageOutdatedV0K,
+		Value: outdated,
+	})
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdImageQuarantineList = &cobra.Command{
+		Use:   "list",
+		Short: "list quarantined archives",
+		RunE:  runImageQuarantineList,
+	}
+)
+
+func init() {
+	cmdImageQuarantine.AddCommand(cmdImageQuarantineList)
+}
+
+func runImageQuarantineList(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	entries, err := torcx.ListQuarantined(commonCfg)
+	if err != nil {
+		return err
+	}
+
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	return jsonOut.Encode(QuarantineList{
+		Kind:  TorcxQuarantineListV0K,
+		Value: entries,
+	})
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdImageQuarantineRestore = &cobra.Command{
+		Use:   "restore <IMNAME>:<REF>",
+		Short: "restore quarantined archives into their stores",
+		Long: `Move all quarantined archives for image IMNAME+REF back into their
+stores, e.g. once the signing key has been added to the trust store.
+Restored archives are still subject to the signature policy when applied.`,
+		RunE: runImageQuarantineRestore,
+	}
+)
+
+func init() {
+	cmdImageQuarantine.AddCommand(cmdImageQuarantineRestore)
+}
+
+func runImageQuarantineRestore(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return cmd.Usage()
+	}
+	imstr := strings.SplitN(args[0], ":", 2)
+	if len(imstr) != 2 || imstr[0] == "" || imstr[1] == "" {
+		return cmd.Usage()
+	}
+	im := torcx.Image{
+		Name:      imstr[0],
+		Reference: imstr[1],
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	restored, err := torcx.RestoreQuarantined(commonCfg, im)
+	for _, path := range restored {
+		fmt.Println(path)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to restore %s:%s", im.Name, im.Reference)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdImageRemove = &cobra.Command{
+		Use:   "remove <IMNAME>:<REF>",
+		Short: "remove an image from writable stores",
+		Long: `Remove all archives for image IMNAME+REF from writable stores
+(i.e. not vendor nor OEM ones), including their recorded hashes.
+Images referenced by any profile or by the currently running one are not
+removed, unless "--force" is specified.
+Once no profile references any version of the image anymore, the cleanup hook
+declared by its manifest (if any) is run, and its state directories and the
+writable layers of its overlays are removed, unless "--keep-state" is
+specified.`,
+		RunE: runImageRemove,
+	}
+	flagImageRemoveForce     bool
+	flagImageRemoveKeepState bool
+)
+
+func init() {
+	cmdImage.AddCommand(cmdImageRemove)
+	cmdImageRemove.Flags().BoolVar(&flagImageRemoveForce, "force", false, "remove the image even if in use")
+	cmdImageRemove.Flags().BoolVar(&flagImageRemoveKeepState, "keep-state", false, "keep the image state directories")
+}
+
+func runImageRemove(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return cmd.Usage()
+	}
+	imstr := strings.SplitN(args[0], ":", 2)
+	if len(imstr) != 2 || imstr[0] == "" || imstr[1] == "" {
+		return cmd.Usage()
+	}
+	im := torcx.Image{
+		Name:      imstr[0],
+		Reference: imstr[1],
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	// The state is declared by the archive, thus read before removing it.
+	var state *torcx.ImageState
+	if !flagImageRemoveKeepState {
+		state, err = torcx.ReadImageState(commonCfg, im)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"image":     im.Name,
+				"reference": im.Reference,
+				"error":     err,
+			}).Warn("unable to read image state, it will be kept")
+		}
+	}
+
+	removed, err := torcx.RemoveImage(commonCfg, im, flagImageRemoveForce)
+	if err != nil {
+		return errors.Wrapf(err, "failed to remove %s:%s", im.Name, im.Reference)
+	}
+	for _, path := range removed {
+		fmt.Println(path)
+	}
+
+	if _, err := torcx.CleanupImageState(commonCfg, state); err != nil {
+		return errors.Wrapf(err, "failed to clean up state of %s:%s", im.Name, im.Reference)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/openpgp"
+)
+
+var (
+	cmdImageVerifySig = &cobra.Command{
+		Use:   "verify-sig [--remote=<NAME>] [--signature=<PATH>] <ARCHIVE>",
+		Short: "verify the detached signature of a local archive",
+		Long: `Verify the local archive file ARCHIVE against its detached, armored
+signature (ARCHIVE.asc by default), without fetching anything.
+If there is no such signature, the archive is checked against the hash and
+signature carried by its metadata sidecar (ARCHIVE.meta) instead.
+The signature is checked against the keyrings of the configured remote NAME,
+or against the machine trust store if no remote is given.
+On success, the signing key is printed.`,
+		RunE: runImageVerifySig,
+	}
+	flagImageVerifySigRemote    string
+	flagImageVerifySigSignature string
+)
+
+func init() {
+	cmdImage.AddCommand(cmdImageVerifySig)
+	cmdImageVerifySig.Flags().StringVar(&flagImageVerifySigRemote, "remote", "", "remote whose keyrings to verify against")
+	cmdImageVerifySig.Flags().StringVar(&flagImageVerifySigSignature, "signature", "", "path to the detached signature")
+}
+
+func runImageVerifySig(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return cmd.Usage()
+	}
+	archivePath := args[0]
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	var keyrings []openpgp.KeyRing
+	if flagImageVerifySigRemote != "" {
+		keyrings, err = commonCfg.RemoteKeyrings(flagImageVerifySigRemote)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load keyrings for %s", flagImageVerifySigRemote)
+		}
+	} else {
+		keys, err := commonCfg.LoadTrustedKeys()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			keyrings = []openpgp.KeyRing{keys}
+		}
+	}
+
+	authorities, err := commonCfg.LoadTimestampAuthorities()
+	if err != nil {
+		return err
+	}
+	signer, err := torcx.VerifyArchiveFile(archivePath, flagImageVerifySigSignature, keyrings, authorities)
+	if err != nil {
+		return err
+	}
+	fmt.Println(signer.PrimaryKey.KeyIdString())
+	for name := range signer.Identities {
+		fmt.Println(name)
+	}
+	return nil
+}
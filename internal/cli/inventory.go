@@ -0,0 +1,78 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdInventory = &cobra.Command{
+		Use:   "inventory [--signing-key=PATH] [--compute-digests]",
+		Short: "export the node inventory as a signed JSON document",
+		Long: `Print a single JSON document describing the torcx state of this node, for
+uploading to CMDB or asset management systems: node identity, OS version,
+applied profiles and images with their digests, store contents and pending
+next profile. The document is clearsigned with the private key in the armored
+keyring at "--signing-key". Store archives without a recorded hash are only
+hashed with "--compute-digests".`,
+		RunE: runInventory,
+	}
+	flagInventorySigningKey     string
+	flagInventoryComputeDigests bool
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdInventory)
+	cmdInventory.Flags().StringVar(&flagInventorySigningKey, "signing-key", "", "armored private keyring signing the inventory")
+	cmdInventory.Flags().BoolVar(&flagInventoryComputeDigests, "compute-digests", false, "hash store archives without a recorded hash")
+}
+
+func runInventory(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	var signer *openpgp.Entity
+	if flagInventorySigningKey != "" {
+		if signer, err = torcx.ReadSigningKey(flagInventorySigningKey); err != nil {
+			return err
+		}
+	} else {
+		logrus.Warn("no signing key, exporting an unsigned inventory")
+	}
+
+	inv, err := torcx.NewInventory(commonCfg, flagInventoryComputeDigests)
+	if err != nil {
+		return errors.Wrap(err, "taking inventory failed")
+	}
+	b, err := torcx.EncodeInventory(inv, signer)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(b)
+	return err
+}
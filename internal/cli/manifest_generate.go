@@ -0,0 +1,80 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdManifestGenerate = &cobra.Command{
+		Use:   "generate [--output=<PATH>] <DIR>",
+		Short: "generate an image manifest from a directory tree",
+		Long: `Detect the assets of the image root directory DIR (binaries, systemd and
+networkd units, udev rules, sysusers and tmpfiles fragments) and print the
+corresponding image manifest, to be stored as DIR/.torcx/manifest.json.
+Shared libraries are reported, as they are not propagated.`,
+		RunE: runManifestGenerate,
+	}
+	flagManifestGenerateOutput string
+)
+
+func init() {
+	cmdManifest.AddCommand(cmdManifestGenerate)
+	cmdManifestGenerate.Flags().StringVarP(&flagManifestGenerateOutput, "output", "o", "-", "output path, or \"-\" for stdout")
+}
+
+func runManifestGenerate(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return cmd.Usage()
+	}
+	gen, err := torcx.GenerateManifest(args[0])
+	if err != nil {
+		return err
+	}
+	if len(gen.Libraries) > 0 {
+		logrus.WithField("libraries", gen.Libraries).Warn("shared libraries are not propagated, binaries must locate them on their own (e.g. with an rpath)")
+	}
+
+	manifest := torcx.ImageManifestV0{
+		Kind:  torcx.ImageManifestV0K,
+		Value: gen.Assets,
+	}
+	if flagManifestGenerateOutput == "-" {
+		return writeManifest(os.Stdout, manifest)
+	}
+	fp, err := os.Create(flagManifestGenerateOutput)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if err := writeManifest(fp, manifest); err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
+// writeManifest writes `manifest` as indented JSON to `w`.
+func writeManifest(w io.Writer, manifest torcx.ImageManifestV0) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(manifest)
+}
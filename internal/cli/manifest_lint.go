@@ -0,0 +1,68 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdManifestLint = &cobra.Command{
+		Use:   "lint [--policy=<PATH>] <DIR>",
+		Short: "check an image directory tree and its manifest against policy rules",
+		Long: `Check the image root directory DIR and its manifest against the lint rules:
+the manifest must be valid and its assets present, symlinks must not be
+absolute nor escape the image, units must have an [Install] section, binaries
+must be executable, and files must not be setuid/setgid unless allowed by the
+policy. Violations are printed and fail the command, to catch bad addons in CI.`,
+		RunE: runManifestLint,
+	}
+	flagManifestLintPolicy string
+)
+
+func init() {
+	cmdManifest.AddCommand(cmdManifestLint)
+	cmdManifestLint.Flags().StringVar(&flagManifestLintPolicy, "policy", "", "path to a lint policy, disabling rules or allowing setuid files")
+}
+
+func runManifestLint(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return cmd.Usage()
+	}
+	policy := torcx.LintPolicy{}
+	if flagManifestLintPolicy != "" {
+		p, err := torcx.ReadLintPolicy(flagManifestLintPolicy)
+		if err != nil {
+			return errors.Wrap(err, "failed to read lint policy")
+		}
+		policy = *p
+	}
+
+	findings, err := torcx.LintImage(args[0], policy)
+	if err != nil {
+		return err
+	}
+	for _, f := range findings {
+		fmt.Printf("%s: %s (%s)\n", f.Rule, f.Message, f.Path)
+	}
+	if len(findings) > 0 {
+		return errors.Errorf("%d lint violations found", len(findings))
+	}
+	return nil
+}
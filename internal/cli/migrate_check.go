@@ -0,0 +1,73 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdMigrateCheck = &cobra.Command{
+		Use:   "migrate-check [--fix]",
+		Short: "check for deprecated manifests and print migration steps",
+		Long: `Scan the configuration and all profiles for manifests using deprecated
+kinds, printing the migration steps for each of them.
+With "--fix", manifests in the configuration directory (e.g. user profiles)
+are rewritten in place; vendor and OEM ones are read-only and only reported.
+The command fails if any deprecated manifest is left.`,
+		RunE: runMigrateCheck,
+	}
+	flagMigrateCheckFix bool
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdMigrateCheck)
+	cmdMigrateCheck.Flags().BoolVar(&flagMigrateCheckFix, "fix", false, "rewrite fixable manifests")
+}
+
+func runMigrateCheck(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	migrations, err := torcx.CheckMigrations(commonCfg)
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, m := range migrations {
+		if flagMigrateCheckFix && m.Fixable {
+			if err := torcx.ApplyMigration(m); err != nil {
+				return errors.Wrapf(err, "failed to migrate %s", m.Path)
+			}
+			fmt.Printf("%s: migrated from %s to %s\n", m.Path, m.Kind, m.Replacement)
+			continue
+		}
+		pending++
+		fmt.Printf("%s: kind %s is deprecated, %s\n", m.Path, m.Kind, m.Step)
+	}
+	if pending > 0 {
+		return errors.Errorf("%d deprecated manifests left", pending)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdNotify = &cobra.Command{
+		Use:   "notify [--dry-run] [--timeout=DURATION]",
+		Short: "send a summary of the applied profile to the notify endpoint",
+		Long: `POST a JSON summary of the applied profile (node identity, generation, applied
+images with their digests and apply result) to the "notify" endpoint of the
+configuration, clearsigned with its signing key if set. The generation is
+bumped each time the applied images change. This is run once the network is
+up by a unit generated at boot. With "--dry-run", the summary is printed
+instead of being sent.`,
+		RunE: runNotify,
+	}
+	flagNotifyDryRun  bool
+	flagNotifyTimeout time.Duration
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdNotify)
+	cmdNotify.Flags().BoolVar(&flagNotifyDryRun, "dry-run", false, "print the summary instead of sending it")
+	cmdNotify.Flags().DurationVar(&flagNotifyTimeout, "timeout", time.Minute, "timeout for sending the summary")
+}
+
+func runNotify(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	summary, err := torcx.NewNotifySummary(commonCfg)
+	if err != nil {
+		return errors.Wrap(err, "summarizing applied profile failed")
+	}
+	if flagNotifyDryRun {
+		b, err := torcx.EncodeNotifySummary(summary, nil)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	if commonCfg.Notify == nil {
+		return errors.New("no notify endpoint configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flagNotifyTimeout)
+	defer cancel()
+	if err := torcx.SendNotifySummary(ctx, commonCfg, summary); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"endpoint":   commonCfg.Notify.Endpoint,
+		"generation": summary.Generation,
+		"result":     summary.Result,
+	}).Info("applied profile notified")
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+// logObserver reports fetch and apply events as log entries.
+type logObserver struct {
+	// progress tracks the last reported download quarter, per image.
+	progress map[torcx.Image]int64
+}
+
+var (
+	_ torcx.FetchObserver = &logObserver{}
+	_ torcx.ApplyObserver = &logObserver{}
+)
+
+func newLogObserver() *logObserver {
+	return &logObserver{progress: map[torcx.Image]int64{}}
+}
+
+func imageFields(im torcx.Image) logrus.Fields {
+	return logrus.Fields{
+		"image":     im.Name,
+		"reference": im.Reference,
+	}
+}
+
+func (lo *logObserver) FetchStarted(im torcx.Image, url string) {
+	lo.progress[im] = 0
+	logrus.WithFields(imageFields(im)).WithField("url", url).Info("fetching image")
+}
+
+func (lo *logObserver) FetchProgress(im torcx.Image, written int64, total int64) {
+	if total <= 0 {
+		return
+	}
+	quarter := written * 4 / total
+	if quarter <= lo.progress[im] || quarter >= 4 {
+		return
+	}
+	lo.progress[im] = quarter
+	logrus.WithFields(imageFields(im)).WithFields(logrus.Fields{
+		"written": written,
+		"total":   total,
+	}).Infof("fetch %d%% done", quarter*25)
+}
+
+func (lo *logObserver) FetchFinished(im torcx.Image, path string, err error) {
+	delete(lo.progress, im)
+	if err != nil {
+		logrus.WithFields(imageFields(im)).Error("fetch failed: ", err)
+		return
+	}
+	logrus.WithFields(imageFields(im)).WithField("path", path).Info("image fetched")
+}
+
+func (lo *logObserver) ApplyStarted(images []torcx.Image) {}
+
+func (lo *logObserver) ImageStarted(im torcx.Image) {}
+
+func (lo *logObserver) ImageLocated(im torcx.Image, archive torcx.Archive) {}
+
+func (lo *logObserver) ImageVerified(im torcx.Image, archive torcx.Archive) {}
+
+func (lo *logObserver) ImageUnpacked(im torcx.Image, rootfs string) {}
+
+func (lo *logObserver) ImageApplied(im torcx.Image, assets torcx.Assets) {
+	logrus.WithFields(imageFields(im)).WithFields(logrus.Fields{
+		"binaries": len(assets.Binaries),
+		"units":    len(assets.Units) + len(assets.Network),
+	}).Info("image applied")
+}
+
+func (lo *logObserver) ImageFailed(im torcx.Image, err error) {
+	logrus.WithFields(imageFields(im)).Error("image failed: ", err)
+}
+
+func (lo *logObserver) ApplyFinished(applied []torcx.Image, err error) {
+	logrus.WithField("images", len(applied)).Info("profile applied")
+}
+
+func (lo *logObserver) SystemSealed(path string, err error) {}
+
+// applyObserver returns the observer for an apply: log entries, plus the
+// configured event stream, if any. The returned function closes the stream.
+func applyObserver(commonCfg *torcx.CommonConfig) (torcx.ApplyObserver, func()) {
+	logObs := newLogObserver()
+	if commonCfg.EventStream == "" {
+		return logObs, func() {}
+	}
+	stream, err := torcx.OpenEventStream(commonCfg.EventStream)
+	if err != nil {
+		logrus.WithField("target", commonCfg.EventStream).Warn("no event stream: ", err)
+		return logObs, func() {}
+	}
+	return torcx.MultiApplyObserver{logObs, stream}, func() { stream.Close() }
+}
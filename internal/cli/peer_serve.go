@@ -0,0 +1,62 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdPeerServe = &cobra.Command{
+		Use:   "serve",
+		Short: "serve verified archives to LAN peers",
+		Long: `Serve archives from local stores to LAN peers, over HTTP.
+Only archives which have been fetched and verified from a remote are served,
+addressed by their hash. Peers verify served archives again before use.`,
+		RunE: runPeerServe,
+	}
+	flagPeerServeListen string
+)
+
+func init() {
+	cmdPeer.AddCommand(cmdPeerServe)
+	cmdPeerServe.Flags().StringVar(&flagPeerServeListen, "listen", ":8095", "address to listen on")
+}
+
+func runPeerServe(cmd *cobra.Command, args []string) error {
+	if !hasExpFeature("PEER_FETCH") {
+		return errors.New("peer sharing requires TORCX_EXP_PEER_FETCH")
+	}
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"listen":      flagPeerServeListen,
+		"store_paths": commonCfg.StorePaths,
+	}).Info("serving archives to peers")
+	return http.ListenAndServe(flagPeerServeListen, torcx.NewPeerHandler(commonCfg.StorePaths))
+}
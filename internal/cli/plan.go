@@ -0,0 +1,83 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdPlan = &cobra.Command{
+		Use:   "plan [--name=PNAME] [--output=PATH]",
+		Short: "compute the plan for next apply",
+		Long: `Compute a deterministic plan of what would be applied on next boot (or
+with the given upper profile): the exact archives, with their hashes, and
+all propagated assets. Once reviewed, it can be approved for next boot with
+"torcx apply --plan". Archives are inspected without being unpacked.`,
+		RunE: runPlan,
+	}
+	flagPlanName   string
+	flagPlanOutput string
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdPlan)
+	cmdPlan.Flags().StringVar(&flagPlanName, "name", "", "upper profile name to use instead of the next profile")
+	cmdPlan.Flags().StringVar(&flagPlanOutput, "output", "", "path of the plan file (default: stdout)")
+}
+
+func runPlan(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	applyCfg, err := fillApplyRuntime(commonCfg)
+	if err != nil {
+		return errors.Wrap(err, "apply configuration failed")
+	}
+	if flagPlanName != "" {
+		applyCfg.UpperProfile = flagPlanName
+	}
+
+	return writePlan(applyCfg, flagPlanOutput)
+}
+
+// writePlan computes the apply plan for `applyCfg`, writing it to
+// `path` or to stdout.
+func writePlan(applyCfg *torcx.ApplyConfig, path string) error {
+	plan, err := torcx.NewApplyPlan(applyCfg)
+	if err != nil {
+		return errors.Wrap(err, "failed to compute apply plan")
+	}
+	if path != "" {
+		return torcx.WriteApplyPlan(path, plan)
+	}
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	return jsonOut.Encode(torcx.ApplyPlanV0JSON{
+		Kind:  torcx.ApplyPlanV0K,
+		Value: *plan,
+	})
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdPolicyCheck = &cobra.Command{
+		Use:   "policy-check [--name=PNAME]",
+		Short: "evaluate apply policies against the next profile",
+		Long: `Evaluate the apply policies against the merged profile which would be
+applied on next boot (or with the given upper profile), as done before each
+apply. Archives are inspected without being unpacked nor mounted.
+Violations are printed as JSON; the exit code is 0 unless an enforced rule
+is violated.`,
+		RunE: runPolicyCheck,
+	}
+	flagPolicyCheckName    string
+	flagPolicyCheckTimeout time.Duration
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdPolicyCheck)
+	cmdPolicyCheck.Flags().StringVar(&flagPolicyCheckName, "name", "", "upper profile name to use instead of the next profile")
+	cmdPolicyCheck.Flags().DurationVar(&flagPolicyCheckTimeout, "timeout", time.Minute, "timeout for policy commands")
+}
+
+func runPolicyCheck(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	applyCfg, err := fillApplyRuntime(commonCfg)
+	if err != nil {
+		return errors.Wrap(err, "apply configuration failed")
+	}
+	if flagPolicyCheckName != "" {
+		applyCfg.UpperProfile = flagPolicyCheckName
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flagPolicyCheckTimeout)
+	defer cancel()
+	violations, err := torcx.EvaluatePolicies(ctx, applyCfg)
+	if err != nil {
+		return err
+	}
+
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	if err := jsonOut.Encode(PolicyCheck{
+		Kind:  TorcxPolicyCheckV0K,
+		Value: violations,
+	}); err != nil {
+		return err
+	}
+	enforced := 0
+	for _, v := range violations {
+		if v.Mode != torcx.PolicyModeWarn {
+			enforced++
+		}
+	}
+	if enforced > 0 {
+		return errors.Errorf("%d enforced policy violations", enforced)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdPrecheck = &cobra.Command{
+		Use:   "precheck [--against-live]",
+		Short: "list all assets which would be propagated on next apply",
+		Long: `List every binary, unit, udev rule, sysusers and tmpfiles entry which would
+be propagated on next boot (or with the given upper profile), along with the
+image providing it. Collisions between images are flagged.
+Archives are inspected without being unpacked nor mounted.
+With "--against-live", assets are instead compared with the live system:
+upgrades and downgrades of the running images, assets replacing others, and
+vendor files in /usr which would be shadowed are reported.`,
+		RunE: runPrecheck,
+	}
+	flagPrecheckName        string
+	flagPrecheckAgainstLive bool
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdPrecheck)
+	cmdPrecheck.Flags().StringVar(&flagPrecheckName, "name", "", "upper profile name to use instead of the next profile")
+	cmdPrecheck.Flags().BoolVar(&flagPrecheckAgainstLive, "against-live", false, "compare assets with the live system")
+}
+
+func runPrecheck(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	applyCfg, err := fillApplyRuntime(commonCfg)
+	if err != nil {
+		return errors.Wrap(err, "apply configuration failed")
+	}
+	if flagPrecheckName != "" {
+		applyCfg.UpperProfile = flagPrecheckName
+	}
+
+	plan, err := torcx.PlanPropagation(applyCfg)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range plan.Collisions() {
+		logrus.WithFields(logrus.Fields{
+			"image":       e.Image,
+			"source":      e.Source,
+			"destination": e.Destination,
+			"provided by": e.CollidesWith,
+		}).Warn("asset collision, it will not be propagated")
+	}
+	incomplete := false
+	for _, im := range plan.Images {
+		if im.Error != "" {
+			incomplete = true
+			logrus.WithFields(logrus.Fields{
+				"image":     im.Name,
+				"reference": im.Reference,
+			}).Error(im.Error)
+		}
+	}
+
+	var precheckOut interface{} = Precheck{
+		Kind:  TorcxPrecheckV0K,
+		Value: *plan,
+	}
+	if flagPrecheckAgainstLive {
+		diff, err := torcx.DiffPropagationLive(applyCfg, plan)
+		if err != nil {
+			return err
+		}
+		for _, e := range diff.Entries {
+			if e.Shadows != "" {
+				logrus.WithFields(logrus.Fields{
+					"image":       e.Image,
+					"destination": e.Destination,
+					"shadows":     e.Shadows,
+				}).Warn("asset shadows a vendor file")
+			}
+		}
+		precheckOut = PrecheckLive{
+			Kind:  TorcxPrecheckLiveV0K,
+			Value: *diff,
+		}
+	}
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	if err := jsonOut.Encode(precheckOut); err != nil {
+		return err
+	}
+
+	if incomplete {
+		return errors.New("incomplete precheck")
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdProfileAnnotate = &cobra.Command{
+		Use:   "annotate --name|--file [--set KEY=VALUE] [--unset KEY]",
+		Short: "sets annotations on a profile",
+		Long: `Set or remove free-form annotations on a user profile, e.g. its
+description, owner, ticket_url or created_by. Annotations are kept when the
+profile is edited, and shown by "profile list" and "status".
+Profiles using the deprecated v0 kind are rewritten as v1.`,
+		RunE: runProfileAnnotate,
+	}
+	flagProfileAnnotateName  string
+	flagProfileAnnotateFile  string
+	flagProfileAnnotateSet   []string
+	flagProfileAnnotateUnset []string
+)
+
+func init() {
+	cmdProfile.AddCommand(cmdProfileAnnotate)
+	cmdProfileAnnotate.Flags().StringVar(&flagProfileAnnotateName, "name", "", "edit profile in user store with name NAME")
+	cmdProfileAnnotate.Flags().StringVar(&flagProfileAnnotateFile, "file", "", "edit profile at path FILE")
+	cmdProfileAnnotate.Flags().StringSliceVar(&flagProfileAnnotateSet, "set", nil, "annotation to set, as KEY=VALUE (repeatable)")
+	cmdProfileAnnotate.Flags().StringSliceVar(&flagProfileAnnotateUnset, "unset", nil, "annotation to remove (repeatable)")
+}
+
+func runProfileAnnotate(cmd *cobra.Command, args []string) error {
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+
+	set := map[string]string{}
+	for _, pair := range flagProfileAnnotateSet {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("invalid annotation %q, expected KEY=VALUE", pair)
+		}
+		set[kv[0]] = kv[1]
+	}
+
+	// Don't allow editing non-user profiles.
+	if flagProfileAnnotateName != "" {
+		if flagProfileAnnotateFile != "" {
+			return cmd.Usage()
+		}
+		profiles, err := torcx.ListProfiles([]string{commonCfg.UserProfileDir()})
+		if err != nil {
+			return errors.Wrap(err, "unable to list profiles")
+		}
+		if _, ok := profiles[flagProfileAnnotateName]; !ok {
+			return fmt.Errorf("profile %s does not exist", flagProfileAnnotateName)
+		}
+		flagProfileAnnotateFile = filepath.Join(commonCfg.UserProfileDir(), flagProfileAnnotateName+".json")
+	}
+
+	if flagProfileAnnotateFile == "" {
+		return cmd.Usage()
+	}
+
+	annotations, err := torcx.AnnotateProfile(flagProfileAnnotateFile, set, flagProfileAnnotateUnset)
+	if err != nil {
+		return errors.Wrap(err, "could not annotate profile")
+	}
+
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	return jsonOut.Encode(annotations)
+}
@@ -129,6 +129,24 @@ func runProfileCheck(cmd *cobra.Command, args []string) error {
 			}).Debug("skipping remoteless image")
 			continue
 		}
+		if torcx.IsVersionQuery(im.Reference) {
+			resolved, err := storeCache.ResolveVersion(im)
+			if err != nil {
+				missing = true
+				logrus.WithFields(logrus.Fields{
+					"name":      im.Name,
+					"reference": im.Reference,
+					"remote":    im.Remote,
+				}).Error(err)
+				continue
+			}
+			logrus.WithFields(logrus.Fields{
+				"name":      im.Name,
+				"query":     im.Reference,
+				"reference": resolved.Reference,
+			}).Debug("image version resolved")
+			im = resolved
+		}
 		ar, err := storeCache.ArchiveFor(im)
 		if err != nil {
 			missing = true
@@ -53,8 +53,12 @@ func runProfileList(cmd *cobra.Command, args []string) error {
 		return errors.Wrap(err, "profiles listing failed")
 	}
 	profNames := make([]string, 0, len(localProfiles))
-	for k := range localProfiles {
+	annotations := map[string]map[string]string{}
+	for k, path := range localProfiles {
 		profNames = append(profNames, k)
+		if ann, err := torcx.ReadProfileAnnotations(path); err == nil && len(ann) > 0 {
+			annotations[k] = ann
+		}
 	}
 
 	var userName, nextName, curPath *string
@@ -80,6 +84,7 @@ func runProfileList(cmd *cobra.Command, args []string) error {
 			CurrentProfilePath: curPath,
 			NextProfileName:    nextName,
 			Profiles:           profNames,
+			Annotations:        annotations,
 		},
 	}
 
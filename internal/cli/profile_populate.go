@@ -89,6 +89,7 @@ func runProfilePopulate(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	profile = commonCfg.FilterRecommends(profile)
 
 	// Empty profiles are allowed
 	if len(profile) == 0 {
@@ -124,10 +125,11 @@ func runProfilePopulate(cmd *cobra.Command, args []string) error {
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMins)*time.Minute)
 	defer cancel()
-	remotesCache, err := torcx.NewRemotesCache(ctx, commonCfg.UsrDir, commonCfg.RemotesDirs(), remotes)
+	remotesCache, err := commonCfg.LoadRemotes(ctx, remotes)
 	if err != nil {
 		return err
 	}
+	remotesCache.Observer = newLogObserver()
 
 	versionedStorePath := commonCfg.UserStorePath(flagProfilePopulateOsVersion)
 	if err := os.MkdirAll(versionedStorePath, 0755); err != nil {
@@ -149,6 +151,13 @@ func runProfilePopulate(cmd *cobra.Command, args []string) error {
 		ctxTo, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMins)*time.Minute)
 		defer cancel()
 		if err := remotesCache.FetchImage(ctxTo, im, versionedStorePath); err != nil {
+			if im.Recommended {
+				logrus.WithFields(logrus.Fields{
+					"image":     im.Name,
+					"reference": im.Reference,
+				}).Warn("recommended image not fetched: ", err)
+				continue
+			}
 			return err
 		}
 		remoteCount++
@@ -30,10 +30,12 @@ var (
 		Long:  "marks a given profile active for the next boot",
 		RunE:  runProfileSetNext,
 	}
+	flagProfileSetNextPlan string
 )
 
 func init() {
 	cmdProfile.AddCommand(cmdProfileSetNext)
+	cmdProfileSetNext.Flags().StringVar(&flagProfileSetNextPlan, "plan", "", "write the resulting apply plan to this path")
 }
 
 func runProfileSetNext(cmd *cobra.Command, args []string) error {
@@ -63,5 +65,14 @@ func runProfileSetNext(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return errors.Wrap(err, "could not write profile file")
 	}
+
+	if flagProfileSetNextPlan != "" {
+		applyCfg, err := fillApplyRuntime(commonCfg)
+		if err != nil {
+			return errors.Wrap(err, "apply configuration failed")
+		}
+		applyCfg.UpperProfile = profileName
+		return writePlan(applyCfg, flagProfileSetNextPlan)
+	}
 	return nil
 }
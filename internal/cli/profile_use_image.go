@@ -32,9 +32,10 @@ var (
 		Long:  "adds the image referenced by NAME+REF to the list of images in profile PROFNAME",
 		RunE:  runProfileUse,
 	}
-	flagProfileUseAllow string
-	flagProfileUseName  string
-	flagProfileUseFile  string
+	flagProfileUseAllow  string
+	flagProfileUseName   string
+	flagProfileUseFile   string
+	flagProfileUseEnable []string
 )
 
 func init() {
@@ -42,6 +43,7 @@ func init() {
 	cmdProfileUse.Flags().StringVar(&flagProfileUseAllow, "allow", "", "pass --allow=missing to add a missing package to a profile")
 	cmdProfileUse.Flags().StringVar(&flagProfileUseName, "name", "", "edit profile in user store with name NAME")
 	cmdProfileUse.Flags().StringVar(&flagProfileUseFile, "file", "", "edit profile at path FILE")
+	cmdProfileUse.Flags().StringSliceVar(&flagProfileUseEnable, "enable", nil, "unit of the image to enable on apply (repeatable)")
 }
 
 func runProfileUse(cmd *cobra.Command, args []string) error {
@@ -106,6 +108,7 @@ func runProfileUse(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	image.Enable = strings.Join(flagProfileUseEnable, " ")
 	if err := torcx.AddToProfile(flagProfileUseFile, image); err != nil {
 		return errors.Wrap(err, "could not write new profile")
 	}
@@ -0,0 +1,122 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdProfileVerify = &cobra.Command{
+		Use:   "verify [--name=<PNAME> | --file=<PATH>]",
+		Short: "verify end-to-end that a pinned profile would apply",
+		Long: `Verify end-to-end that the given profile (or the next profile on boot, if none
+is specified) would apply: all images are pinned to concrete references, and
+present in a store or fetchable from their remote; archives match their
+recorded and published digests and the signature policy; manifests and
+profile fragments parse; fragment requests do not conflict and assets do not
+collide. The result is printed as JSON, and any problem fails the command,
+as a single gate for promoting a profile to the fleet.`,
+		RunE: runProfileVerify,
+	}
+
+	flagProfileVerifyName      string
+	flagProfileVerifyPath      string
+	flagProfileVerifyOsVersion string
+	flagProfileVerifyTimeout   time.Duration
+)
+
+func init() {
+	cmdProfile.AddCommand(cmdProfileVerify)
+	cmdProfileVerify.Flags().StringVar(&flagProfileVerifyName, "name", "", "profile name to verify")
+	cmdProfileVerify.Flags().StringVar(&flagProfileVerifyPath, "file", "", "profile file to verify")
+	cmdProfileVerify.Flags().StringVarP(&flagProfileVerifyOsVersion, "os-release", "n", "", "override OS version")
+	cmdProfileVerify.Flags().DurationVar(&flagProfileVerifyTimeout, "timeout", time.Minute, "timeout for remote lookups")
+}
+
+func runProfileVerify(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime(flagProfileVerifyOsVersion)
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	if flagProfileVerifyPath == "" {
+		if flagProfileVerifyName == "" {
+			flagProfileVerifyName, err = commonCfg.NextProfileName()
+			if err != nil {
+				return errors.Wrapf(err, "unable to determine next profile")
+			}
+			logrus.Infof("No profile specified, using next profile %q", flagProfileVerifyName)
+		}
+		localProfiles, err := torcx.ListProfiles(commonCfg.ProfileDirs())
+		if err != nil {
+			return errors.Wrap(err, "profiles listing failed")
+		}
+		var ok bool
+		if flagProfileVerifyPath, ok = localProfiles[flagProfileVerifyName]; !ok {
+			return fmt.Errorf("profile %q not found", flagProfileVerifyName)
+		}
+	}
+
+	profile, err := torcx.ReadProfilePath(flagProfileVerifyPath)
+	if err != nil {
+		return err
+	}
+
+	remotes := []string{}
+	seen := map[string]bool{}
+	for _, im := range profile {
+		if im.Remote != "" && !seen[im.Remote] {
+			remotes = append(remotes, im.Remote)
+			seen[im.Remote] = true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flagProfileVerifyTimeout)
+	defer cancel()
+	var rc *torcx.RemotesCache
+	if len(remotes) > 0 {
+		if rc, err = commonCfg.LoadRemotes(ctx, remotes); err != nil {
+			logrus.Warnf("unable to load remotes, only checking stores: %s", err)
+			rc = nil
+		}
+	}
+
+	verification, err := torcx.VerifyProfile(ctx, commonCfg, profile, rc)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(ProfileVerify{TorcxProfileVerifyV0K, *verification}); err != nil {
+		return err
+	}
+	if len(verification.Problems) > 0 {
+		return errors.Errorf("%d problems found in profile %s", len(verification.Problems), flagProfileVerifyPath)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdQuery = &cobra.Command{
+		Use:   "query KEY [IMAGE]",
+		Short: "print a single value of the sealed system state",
+		RunE:  runQuery,
+	}
+)
+
+func init() {
+	keys, imageKeys := torcx.QueryKeys()
+	cmdQuery.Long = fmt.Sprintf(`Print a single value of the sealed system state, for use in scripts.
+Supported keys: %s.
+With an IMAGE name, supported keys for that applied image: %s.`,
+		strings.Join(keys, ", "), strings.Join(imageKeys, ", "))
+	TorcxCmd.AddCommand(cmdQuery)
+}
+
+func runQuery(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return cmd.Usage()
+	}
+	image := ""
+	if len(args) == 2 {
+		image = args[1]
+	}
+	value, err := torcx.Query(args[0], image)
+	if err != nil {
+		return err
+	}
+	fmt.Println(value)
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdRemoteAudit = &cobra.Command{
+		Use:   "audit [--verify]",
+		Short: "list archives fetched from remotes",
+		Long: `List the records of the local fetch audit log, one per archive fetched
+from a remote (see the "fetch_audit" configuration setting).
+With --verify, the chain of records is checked first, failing if entries
+have been altered or removed.`,
+		RunE: runRemoteAudit,
+	}
+	flagRemoteAuditVerify bool
+)
+
+func init() {
+	cmdRemote.AddCommand(cmdRemoteAudit)
+	cmdRemoteAudit.Flags().BoolVar(&flagRemoteAuditVerify, "verify", false, "verify the chain of audit records")
+}
+
+func runRemoteAudit(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	var records []torcx.FetchRecord
+	if flagRemoteAuditVerify {
+		records, err = torcx.VerifyFetchAudit(commonCfg.FetchAuditLog())
+	} else {
+		records, err = torcx.ReadFetchAudit(commonCfg.FetchAuditLog())
+	}
+	if os.IsNotExist(errors.Cause(err)) {
+		records, err = []torcx.FetchRecord{}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	return jsonOut.Encode(records)
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdRemoteDiff = &cobra.Command{
+		Use:   "diff [--update] REMOTE",
+		Short: "compare the cached contents manifest of a remote to a fresh one",
+		Long: `Compare the cached contents manifest of a remote to a freshly fetched
+and verified one, reporting added, removed and changed versions per image.
+With "--update", the fetched manifest replaces the cached one.`,
+		RunE: runRemoteDiff,
+	}
+	flagRemoteDiffUpdate  bool
+	flagRemoteDiffTimeout time.Duration
+)
+
+func init() {
+	cmdRemote.AddCommand(cmdRemoteDiff)
+	cmdRemoteDiff.Flags().BoolVar(&flagRemoteDiffUpdate, "update", false, "replace the cached manifest with the fetched one")
+	cmdRemoteDiff.Flags().DurationVar(&flagRemoteDiffTimeout, "timeout", time.Minute, "timeout for fetching the contents manifest")
+}
+
+func runRemoteDiff(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flagRemoteDiffTimeout)
+	defer cancel()
+	diffs, err := commonCfg.DiffRemote(ctx, args[0], flagRemoteDiffUpdate)
+	if err != nil {
+		return err
+	}
+
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	return jsonOut.Encode(RemoteDiff{
+		Kind:  TorcxRemoteDiffV0K,
+		Value: diffs,
+	})
+}
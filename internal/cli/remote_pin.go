@@ -0,0 +1,68 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdRemotePin = &cobra.Command{
+		Use:   "pin REMOTE",
+		Short: "print the digest of the contents manifest of a remote",
+		Long: `Fetch and verify the contents manifest of a remote, printing its digest
+for the "remote_pins" configuration setting. The currently pinned digest,
+if any, is not enforced, so that pins can be renewed.`,
+		RunE: runRemotePin,
+	}
+	flagRemotePinTimeout time.Duration
+)
+
+func init() {
+	cmdRemote.AddCommand(cmdRemotePin)
+	cmdRemotePin.Flags().DurationVar(&flagRemotePinTimeout, "timeout", time.Minute, "timeout for fetching the contents manifest")
+}
+
+func runRemotePin(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flagRemotePinTimeout)
+	defer cancel()
+	digest, err := commonCfg.RemoteDigest(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if pin, ok := commonCfg.RemotePins[args[0]]; ok && !strings.EqualFold(pin, digest) {
+		logrus.WithFields(logrus.Fields{
+			"remote": args[0],
+			"pinned": pin,
+		}).Warn("contents manifest does not match pinned digest")
+	}
+	fmt.Println(digest)
+	return nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdRemotePublish = &cobra.Command{
+		Use:   "publish [--signing-key=PATH] DIR",
+		Short: "generate the contents manifest for a directory of archives",
+		Long: `Scan DIR for image archives, compute their hashes and write (or update) the
+"torcx_remote_contents.json.asc" contents manifest in DIR, clearsigned with
+the private key in the armored keyring at "--signing-key". Image manifests
+and profile fragments of tgz archives are published alongside them. DIR is
+then ready to be uploaded under the base URL of a remote.`,
+		RunE: runRemotePublish,
+	}
+	flagRemotePublishSigningKey string
+)
+
+func init() {
+	cmdRemote.AddCommand(cmdRemotePublish)
+	cmdRemotePublish.Flags().StringVar(&flagRemotePublishSigningKey, "signing-key", "", "armored private keyring signing the contents manifest")
+}
+
+func runRemotePublish(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return cmd.Usage()
+	}
+
+	var signer *openpgp.Entity
+	if flagRemotePublishSigningKey != "" {
+		var err error
+		if signer, err = torcx.ReadSigningKey(flagRemotePublishSigningKey); err != nil {
+			return err
+		}
+	} else {
+		logrus.Warn("no signing key, publishing an unsigned contents manifest")
+	}
+
+	contents, err := torcx.PublishRemote(args[0], signer)
+	if err != nil {
+		return errors.Wrap(err, "publishing failed")
+	}
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	return jsonOut.Encode(contents)
+}
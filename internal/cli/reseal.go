@@ -0,0 +1,63 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdReseal = &cobra.Command{
+		Use:   "reseal",
+		Short: "record an OS update beneath the sealed state",
+		Long: `Record in the seal that the OS under /usr changed beneath the applied
+images, e.g. after an update, so that the seal metadata does not go stale.
+Applied images are re-validated against the updated OS: archives from a store
+versioned for the previous OS, and vendor archives replaced or removed by the
+update, are reported as incompatible, recorded as warnings, and fail the
+command, as they should be re-applied.`,
+		RunE: runReseal,
+	}
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdReseal)
+}
+
+func runReseal(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	report, err := torcx.Reseal(commonCfg)
+	if err != nil {
+		return err
+	}
+	for _, w := range report.Incompatible {
+		fmt.Printf("%s: %s (%s)\n", w.Kind, w.Message, w.Path)
+	}
+	if len(report.Incompatible) > 0 {
+		return errors.Errorf("%d images incompatible with OS %s", len(report.Incompatible), report.OsVersionID)
+	}
+	return nil
+}
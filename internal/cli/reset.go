@@ -0,0 +1,75 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdReset = &cobra.Command{
+		Use:   "reset [--profiles] [--store] [--next-profile] [--caches] [--history]",
+		Short: "reset torcx state to vendor defaults",
+		Long: `Remove user profiles, user store contents, next-profile selection,
+cached remote manifests and the last good profile record, so that only vendor
+and OEM images are applied on next boot. Flags restrict the reset to the
+selected parts; without flags, everything is reset.
+Removed paths are printed; with "--dry-run", nothing is removed.`,
+		RunE: runReset,
+	}
+	flagResetProfiles    bool
+	flagResetStore       bool
+	flagResetNextProfile bool
+	flagResetCaches      bool
+	flagResetHistory     bool
+	flagResetDryRun      bool
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdReset)
+	cmdReset.Flags().BoolVar(&flagResetProfiles, "profiles", false, "remove user profiles and node profile overrides")
+	cmdReset.Flags().BoolVar(&flagResetStore, "store", false, "remove the user store contents")
+	cmdReset.Flags().BoolVar(&flagResetNextProfile, "next-profile", false, "remove the next-profile selection")
+	cmdReset.Flags().BoolVar(&flagResetCaches, "caches", false, "remove cached remote contents manifests and squashfs chunk hashes")
+	cmdReset.Flags().BoolVar(&flagResetHistory, "history", false, "remove the last good profile record")
+	cmdReset.Flags().BoolVar(&flagResetDryRun, "dry-run", false, "only print what would be removed")
+}
+
+func runReset(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	removed, err := torcx.Reset(commonCfg, torcx.ResetOptions{
+		Profiles:    flagResetProfiles,
+		Store:       flagResetStore,
+		NextProfile: flagResetNextProfile,
+		Caches:      flagResetCaches,
+		History:     flagResetHistory,
+		DryRun:      flagResetDryRun,
+	})
+	for _, path := range removed {
+		fmt.Println(path)
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdServe = &cobra.Command{
+		Use:   "serve [--listen=<ADDR>] [--store=<DIR>]... [--signing-key=<PATH>]",
+		Short: "serve stores over HTTP as a remote",
+		Long: `Serve archives from stores over HTTP, in the layout of a torcx remote: a
+"torcx_remote_contents.json.asc" contents manifest is generated from the
+current store contents on each request, and clearsigned with the private key
+in the armored keyring at "--signing-key", next to the archives and their
+sidecars. A single build machine can thus act as the remote for a test lab.`,
+		RunE: runServe,
+	}
+	flagServeListen     string
+	flagServeStores     []string
+	flagServeSigningKey string
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdServe)
+	cmdServe.Flags().StringVar(&flagServeListen, "listen", ":8096", "address to listen on")
+	cmdServe.Flags().StringSliceVar(&flagServeStores, "store", nil, "store directory to serve (default: all store paths)")
+	cmdServe.Flags().StringVar(&flagServeSigningKey, "signing-key", "", "armored private keyring signing the contents manifest")
+}
+
+func runServe(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	stores := flagServeStores
+	if len(stores) == 0 {
+		stores = commonCfg.StorePaths
+	}
+	var signer *openpgp.Entity
+	if flagServeSigningKey != "" {
+		if signer, err = torcx.ReadSigningKey(flagServeSigningKey); err != nil {
+			return err
+		}
+	} else {
+		logrus.Warn("no signing key, serving an unsigned contents manifest")
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"listen":      flagServeListen,
+		"store_paths": stores,
+	}).Info("serving stores as a remote")
+	return http.ListenAndServe(flagServeListen, torcx.NewStoreServer(stores, signer))
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdSimulate = &cobra.Command{
+		Use:   "simulate --target=<DIR>",
+		Short: "simulate an apply into a target tree",
+		Long: `Perform a full apply and seal of the configured profile into the target tree
+DIR instead of the live system, without mounts nor privileges: images are
+unpacked (squashfs ones with unsquashfs, erofs ones with fsck.erofs), and binaries and units are
+symlinked or copied below DIR. This allows testing profile and image
+combinations in CI pipelines, e.g. inside unprivileged containers.`,
+		RunE: runSimulate,
+	}
+	flagSimulateTarget string
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdSimulate)
+	cmdSimulate.Flags().StringVar(&flagSimulateTarget, "target", "", "directory to apply into")
+}
+
+func runSimulate(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 || flagSimulateTarget == "" {
+		return cmd.Usage()
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	applyCfg, err := fillApplyRuntime(commonCfg)
+	if err != nil {
+		return errors.Wrap(err, "apply configuration failed")
+	}
+	observer, closeObserver := applyObserver(commonCfg)
+	defer closeObserver()
+	applyCfg.Observer = observer
+
+	if err := torcx.SimulateApply(applyCfg, flagSimulateTarget); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"target":  applyCfg.TargetRoot,
+		"profile": applyCfg.RunProfile(),
+	}).Info("apply simulated")
+	return nil
+}
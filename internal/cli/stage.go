@@ -0,0 +1,75 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdStage = &cobra.Command{
+		Use:   "stage [--discard]",
+		Short: "stage the next apply ahead of time",
+		Long: `Run the expensive phase of the apply of the configured profile ahead of
+time: images are verified and unpacked (or mounted) below a private staging
+directory, without propagating any asset. The apply by torcx-generator (or
+"torcx commit") then only moves the staged images in place, propagates their
+assets and seals the system. If the staged apply is outdated by then, it is
+discarded and a full apply is performed instead.
+With "--discard", the staged apply (if any) is discarded instead.`,
+		RunE: runStage,
+	}
+	flagStageDiscard bool
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdStage)
+	cmdStage.Flags().BoolVar(&flagStageDiscard, "discard", false, "discard the staged apply")
+}
+
+func runStage(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	if flagStageDiscard {
+		return torcx.DiscardStaged(commonCfg)
+	}
+	applyCfg, err := fillApplyRuntime(commonCfg)
+	if err != nil {
+		return errors.Wrap(err, "apply configuration failed")
+	}
+	observer, closeObserver := applyObserver(commonCfg)
+	defer closeObserver()
+	applyCfg.Observer = observer
+
+	staged, err := torcx.StageProfile(applyCfg)
+	if err != nil {
+		return errors.Wrap(err, "staging failed")
+	}
+	logrus.WithFields(logrus.Fields{
+		"images": len(staged.Images),
+		"record": applyCfg.StagedApplyPath(),
+	}).Info("apply staged")
+	return nil
+}
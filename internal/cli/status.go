@@ -0,0 +1,105 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdStatus = &cobra.Command{
+		Use:   "status",
+		Short: "report the state of the current apply",
+		Long: `Report whether the system state is sealed, the current and next
+profiles, and the number of warnings (by kind) collected during the last
+apply. Full warning records are available in the warnings file.
+If the sealed state has been verified, the number of inconsistencies found
+by the last verification is also reported.
+For a sealed state, the live mounts created by the apply (the unpack
+directory, squashfs and erofs images) are listed, as found in the mount table:
+mounts missing or modified since they were sealed are flagged.
+If the user store is configured to be encrypted, whether it is unlocked is
+also reported.`,
+		RunE: runStatus,
+	}
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdStatus)
+}
+
+func runStatus(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	status := statusValue{
+		Sealed:         torcx.IsExistingPath(torcx.RootPath(torcx.SealPath)),
+		WarningsPath:   commonCfg.RunWarnings(),
+		WarningsByKind: map[string]int{},
+	}
+	if upper, _, err := torcx.CurrentProfileNames(); err == nil {
+		status.UpperProfileName = &upper
+		if profiles, err := torcx.ListProfiles(commonCfg.ProfileDirs()); err == nil {
+			if path, ok := profiles[upper]; ok {
+				status.UpperAnnotations, _ = torcx.ReadProfileAnnotations(path)
+			}
+		}
+	}
+	if path, err := torcx.CurrentProfilePath(); err == nil {
+		status.CurrentProfilePath = &path
+	}
+	if next, err := commonCfg.NextProfileName(); err == nil {
+		status.NextProfileName = &next
+	}
+	warnings, err := torcx.ReadWarnings(status.WarningsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	status.Warnings = len(warnings)
+	status.WarningsByKind = torcx.CountWarnings(warnings)
+	if drift, err := torcx.ReadWarnings(commonCfg.RunConsistency()); err == nil {
+		inconsistencies := len(drift)
+		status.Inconsistencies = &inconsistencies
+	}
+	if status.Sealed {
+		mounts, err := torcx.ListLiveMounts(commonCfg)
+		if err != nil {
+			return errors.Wrap(err, "listing live mounts")
+		}
+		status.Mounts = mounts
+	}
+	if commonCfg.StoreEncryption != nil {
+		if state, err := torcx.UserStoreEncryption(commonCfg); err == nil {
+			status.StoreEncryption = &state
+		}
+	}
+
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	return jsonOut.Encode(Status{
+		Kind:  TorcxStatusV0K,
+		Value: status,
+	})
+}
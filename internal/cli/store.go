@@ -0,0 +1,29 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import "github.com/spf13/cobra"
+
+var (
+	cmdStore = &cobra.Command{
+		Use:   "store [command]",
+		Short: "Operate on image stores",
+		Long:  `This subcommand operates on whole image stores.`,
+	}
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdStore)
+}
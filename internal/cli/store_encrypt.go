@@ -0,0 +1,58 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdStoreEncrypt = &cobra.Command{
+		Use:   "encrypt",
+		Short: "encrypt the user store",
+		Long: `Set up encryption at rest of the user store, with the key configured by the
+"store_encryption" configuration setting. The store must be empty: archives
+can be moved out beforehand, and back in once it is encrypted.`,
+		RunE: runStoreEncrypt,
+	}
+)
+
+func init() {
+	cmdStore.AddCommand(cmdStoreEncrypt)
+}
+
+func runStoreEncrypt(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	state, err := torcx.EncryptUserStore(commonCfg)
+	if err != nil {
+		return err
+	}
+
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	return jsonOut.Encode(state)
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdStoreSync = &cobra.Command{
+		Use:   "sync [--remote=NAME] SRC DST",
+		Short: "copy missing archives between stores",
+		Long: `Copy all archives from SRC missing in the local store directory DST, along
+with their signature and metadata sidecars. SRC is a local store directory,
+an SSH location (ssh://[user@]host[:port]/path, transferred with rsync) or
+the base URL of an HTTP remote (e.g. "torcx serve"). Archives are verified
+against their hash at the source, and skipped if it is unknown. The contents
+manifest of HTTP sources is verified against the keyrings of the configured
+remote NAME, or against the machine trust store. Interrupted transfers are
+resumed by running the same sync again.`,
+		RunE: runStoreSync,
+	}
+	flagStoreSyncRemote string
+)
+
+func init() {
+	cmdStore.AddCommand(cmdStoreSync)
+	cmdStoreSync.Flags().StringVar(&flagStoreSyncRemote, "remote", "", "remote whose keyrings to verify HTTP sources against")
+}
+
+func runStoreSync(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 || args[0] == "" || args[1] == "" {
+		return cmd.Usage()
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	var keyrings []openpgp.KeyRing
+	if flagStoreSyncRemote != "" {
+		keyrings, err = commonCfg.RemoteKeyrings(flagStoreSyncRemote)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load keyrings for %s", flagStoreSyncRemote)
+		}
+	} else {
+		keys, err := commonCfg.LoadTrustedKeys()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			keyrings = []openpgp.KeyRing{keys}
+		}
+	}
+
+	synced, err := torcx.SyncStore(context.Background(), commonCfg, args[0], args[1], keyrings)
+	if err != nil {
+		return errors.Wrap(err, "store sync failed")
+	}
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	return jsonOut.Encode(StoreSync{
+		Kind:  TorcxStoreSyncV0K,
+		Value: synced,
+	})
+}
@@ -0,0 +1,50 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdSupportedKinds = &cobra.Command{
+		Use:   "supported-kinds",
+		Short: "list the manifest kinds understood by torcx",
+		Long: `List as JSON the manifest and record kinds (with their revision) that this
+torcx is able to parse, so that tooling can check compatibility before
+shipping a manifest.`,
+		RunE: runSupportedKinds,
+	}
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdSupportedKinds)
+}
+
+func runSupportedKinds(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(SupportedKinds{
+		Kind:  TorcxSupportedKindsV0K,
+		Value: torcx.SupportedKinds(),
+	})
+}
@@ -59,8 +59,21 @@ func runGenerator(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return errors.Wrap(err, "apply configuration failed")
 	}
-
-	err = torcx.ApplyProfile(applyCfg)
+	observer, closeObserver := applyObserver(commonCfg)
+	defer closeObserver()
+	applyCfg.Observer = observer
+
+	err = applyOrCommit(applyCfg)
+	// Generator output directories are passed as arguments (normal, early, late)
+	if len(args) > 0 {
+		if gateErr := torcx.WriteBootGate(applyCfg, args[0]); gateErr != nil {
+			logrus.Errorf("failed to generate boot gate: %s", gateErr)
+		}
+		// Failed applies are notified as well.
+		if notifyErr := torcx.WriteNotifyUnit(applyCfg, args[0], runtimeBinary()); notifyErr != nil {
+			logrus.Errorf("failed to generate notify unit: %s", notifyErr)
+		}
+	}
 	if err != nil {
 		return errors.Wrap(err, "apply failed")
 	}
@@ -69,9 +82,45 @@ func runGenerator(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return errors.Wrapf(err, "sealing system state failed")
 	}
+
+	if len(args) > 0 {
+		if err := torcx.WriteHealthCheckUnit(applyCfg, args[0], runtimeBinary()); err != nil {
+			logrus.Errorf("failed to generate health check unit: %s", err)
+		}
+		if err := torcx.WriteVerifyTimer(applyCfg, args[0], runtimeBinary()); err != nil {
+			logrus.Errorf("failed to generate verify timer: %s", err)
+		}
+	}
 	return nil
 }
 
+// applyOrCommit commits the staged apply, if any, falling back to a full
+// apply if committing failed before touching the system (e.g. as the staged
+// apply is outdated).
+func applyOrCommit(applyCfg *torcx.ApplyConfig) error {
+	if !torcx.IsExistingPath(applyCfg.StagedApplyPath()) {
+		return torcx.ApplyProfile(applyCfg)
+	}
+	err := torcx.CommitProfile(applyCfg)
+	if err == nil || torcx.IsExistingPath(applyCfg.RunDir) {
+		return err
+	}
+	logrus.Warnf("ignoring staged apply: %s", err)
+	if err := torcx.DiscardStaged(&applyCfg.CommonConfig); err != nil {
+		logrus.Errorf("failed to discard staged apply: %s", err)
+	}
+	return torcx.ApplyProfile(applyCfg)
+}
+
+// runtimeBinary returns the path of the torcx runtime binary, for use in
+// generated units.
+func runtimeBinary() string {
+	if exe, err := os.Readlink("/proc/self/exe"); err == nil && filepath.Base(exe) == "torcx" {
+		return exe
+	}
+	return "/usr/bin/torcx"
+}
+
 // fillApplyRuntime populates runtime config starting from system-wide configuration
 func fillApplyRuntime(commonCfg *torcx.CommonConfig) (*torcx.ApplyConfig, error) {
 	lowerProfileNames, err := lowerProfiles(commonCfg)
@@ -86,6 +135,13 @@ func fillApplyRuntime(commonCfg *torcx.CommonConfig) (*torcx.ApplyConfig, error)
 		upperProfileName = ""
 	}
 
+	// Per-node overrides take precedence over next-profile
+	if nodeProfileName, err := nodeProfile(commonCfg); err != nil {
+		logrus.Warnf("ignoring node profile overrides: %s", err)
+	} else if nodeProfileName != "" {
+		upperProfileName = nodeProfileName
+	}
+
 	logrus.WithFields(logrus.Fields{
 		"lower profiles (vendor/oem)": lowerProfileNames,
 		"upper profile (user)":        upperProfileName,
@@ -98,6 +154,26 @@ func fillApplyRuntime(commonCfg *torcx.CommonConfig) (*torcx.ApplyConfig, error)
 	}, nil
 }
 
+// nodeProfile returns the upper profile selected for this node by
+// per-node overrides, if any.
+func nodeProfile(commonCfg *torcx.CommonConfig) (string, error) {
+	profileName, err := commonCfg.NodeProfileName(torcx.CurrentNodeIdentity())
+	if err != nil || profileName == "" {
+		return "", err
+	}
+	localProfiles, err := torcx.ListProfiles(commonCfg.ProfileDirs())
+	if err != nil {
+		return "", err
+	}
+	if _, ok := localProfiles[profileName]; !ok {
+		return "", errors.Errorf("profile %q not found", profileName)
+	}
+	logrus.WithFields(logrus.Fields{
+		"profile": profileName,
+	}).Info("using node profile override")
+	return profileName, nil
+}
+
 // lowerProfiles returns a list of lower profiles (vendor/oem) found on
 // the system at runtime. The set may be empty.
 func lowerProfiles(commonCfg *torcx.CommonConfig) ([]string, error) {
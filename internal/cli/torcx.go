@@ -51,6 +51,10 @@ func Init() error {
 
 	verboseFlag := TorcxCmd.PersistentFlags().VarPF((*cliCfgVerbose)(&TorcxCliCfg), "verbose", "v", "verbosity level")
 	verboseFlag.NoOptDefVal = "info"
+	TorcxCmd.PersistentFlags().String("root-prefix", "", "relocate runtime, base and configuration directories below this prefix")
+	if err := viper.BindPFlag("root_prefix", TorcxCmd.PersistentFlags().Lookup("root-prefix")); err != nil {
+		return err
+	}
 
 	multicall.AddCobra(TorcxCmd.Use, TorcxCmd)
 	multicall.AddCobra(TorcxGenCmd.Use, TorcxGenCmd)
@@ -0,0 +1,370 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var (
+	cmdTUI = &cobra.Command{
+		Use:   "tui [--name=PNAME]",
+		Short: "interactively edit a user profile",
+		Long: `Browse the images available in the local stores and on the configured
+remotes, toggle them in a user profile, pin their versions and preview the
+resulting merged profile. The next profile is edited by default; it is
+created on write if missing. Vendor and OEM profiles are read-only.
+Type "h" at the prompt for the list of commands.`,
+		RunE: runTUI,
+	}
+	flagTUIName    string
+	flagTUITimeout time.Duration
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdTUI)
+	cmdTUI.Flags().StringVar(&flagTUIName, "name", "", "user profile to edit instead of the next profile")
+	cmdTUI.Flags().DurationVar(&flagTUITimeout, "timeout", time.Minute, "timeout for fetching contents manifests")
+}
+
+const tuiHelp = `commands:
+  t N...      toggle images N in the profile
+  p N REF     pin image N to version REF
+  m           preview the merged profile
+  w           write the profile
+  q           quit (twice to discard unsaved changes)
+  h, ?        show this help`
+
+func runTUI(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	applyCfg, err := fillApplyRuntime(commonCfg)
+	if err != nil {
+		return errors.Wrap(err, "apply configuration failed")
+	}
+	if flagTUIName != "" {
+		applyCfg.UpperProfile = flagTUIName
+	}
+	if applyCfg.UpperProfile == "" {
+		return errors.New("no next profile, use --name to select a profile")
+	}
+
+	// Don't allow editing non-user profiles.
+	path := filepath.Join(commonCfg.UserProfileDir(), applyCfg.UpperProfile+".json")
+	profiles, err := torcx.ListProfiles(commonCfg.ProfileDirs())
+	if err != nil {
+		return errors.Wrap(err, "unable to list profiles")
+	}
+	images := []torcx.Image{}
+	if existing, ok := profiles[applyCfg.UpperProfile]; ok {
+		if filepath.Clean(existing) != path {
+			return errors.Errorf("profile %s is read-only", existing)
+		}
+		if images, err = torcx.ReadProfilePath(path); err != nil {
+			return err
+		}
+	}
+
+	storeCache, err := torcx.NewStoreCache(commonCfg.StorePaths)
+	if err != nil {
+		return errors.Wrap(err, "unable to scan for packages")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), flagTUITimeout)
+	defer cancel()
+	rc, err := commonCfg.LoadRemotes(ctx, nil)
+	if err != nil {
+		logrus.WithField("error", err).Warn("unable to load remotes, only listing local images")
+		rc = nil
+	}
+
+	session := newTUISession(applyCfg, path, torcx.ListAvailableImages(&storeCache, rc), images)
+	session.clear = terminal.IsTerminal(int(os.Stdout.Fd()))
+	return session.run(os.Stdin, os.Stdout)
+}
+
+// tuiSession is an interactive, line-based, profile editing session.
+type tuiSession struct {
+	applyCfg *torcx.ApplyConfig
+	path     string
+	// rows are the image names listed, in order
+	rows      []string
+	available map[string]torcx.AvailableImage
+	images    []torcx.Image
+	dirty     bool
+	// clear is set if the screen is cleared before each render
+	clear   bool
+	message string
+}
+
+func newTUISession(applyCfg *torcx.ApplyConfig, path string, available []torcx.AvailableImage, images []torcx.Image) *tuiSession {
+	s := &tuiSession{
+		applyCfg:  applyCfg,
+		path:      path,
+		available: map[string]torcx.AvailableImage{},
+		images:    images,
+	}
+	for _, av := range available {
+		s.available[av.Name] = av
+		s.rows = append(s.rows, av.Name)
+	}
+	// Profile images which are nowhere to be found can still be removed.
+	for _, im := range images {
+		if _, ok := s.available[im.Name]; !ok {
+			s.available[im.Name] = torcx.AvailableImage{Name: im.Name, Local: []string{}}
+			s.rows = append(s.rows, im.Name)
+		}
+	}
+	return s
+}
+
+// run reads commands from `in` until quit or EOF, rendering to `out`.
+func (s *tuiSession) run(in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	quitting := false
+	for {
+		s.render(out)
+		fmt.Fprint(out, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		s.message = ""
+		if fields[0] == "q" {
+			if !s.dirty || quitting {
+				return nil
+			}
+			quitting = true
+			s.message = "unsaved changes, type q again to discard them"
+			continue
+		}
+		quitting = false
+		if err := s.exec(fields[0], fields[1:]); err != nil {
+			s.message = "error: " + err.Error()
+		}
+	}
+}
+
+// exec runs a single command.
+func (s *tuiSession) exec(command string, args []string) error {
+	switch command {
+	case "t":
+		if len(args) == 0 {
+			return errors.New("usage: t N...")
+		}
+		for _, arg := range args {
+			name, err := s.row(arg)
+			if err != nil {
+				return err
+			}
+			s.toggle(name)
+		}
+	case "p":
+		if len(args) != 2 {
+			return errors.New("usage: p N REF")
+		}
+		name, err := s.row(args[0])
+		if err != nil {
+			return err
+		}
+		s.pin(name, args[1])
+	case "m":
+		merged, err := torcx.PreviewProfile(s.applyCfg, s.images)
+		if err != nil {
+			return err
+		}
+		lines := []string{"merged profile:"}
+		for _, im := range merged {
+			lines = append(lines, "  "+formatTUIImage(im))
+		}
+		s.message = strings.Join(lines, "\n")
+	case "w":
+		if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+			return err
+		}
+		if err := torcx.SaveProfile(s.path, s.images); err != nil {
+			return errors.Wrap(err, "could not write profile")
+		}
+		s.dirty = false
+		s.message = "profile written to " + s.path
+	case "h", "?":
+		s.message = tuiHelp
+	default:
+		return errors.Errorf("unknown command %q, type h for help", command)
+	}
+	return nil
+}
+
+// row returns the image name listed at the 1-based row `arg`.
+func (s *tuiSession) row(arg string) (string, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(s.rows) {
+		return "", errors.Errorf("invalid image number %q", arg)
+	}
+	return s.rows[n-1], nil
+}
+
+// selected returns the index of image `name` in the profile, or -1.
+func (s *tuiSession) selected(name string) int {
+	for i, im := range s.images {
+		if im.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// toggle removes image `name` from the profile, or adds it at its highest
+// local version, falling back to the highest version on a remote.
+func (s *tuiSession) toggle(name string) {
+	if i := s.selected(name); i >= 0 {
+		s.images = append(s.images[:i], s.images[i+1:]...)
+		s.dirty = true
+		return
+	}
+	im := torcx.Image{Name: name, Reference: torcx.DefaultTagRef}
+	av := s.available[name]
+	if len(av.Local) > 0 {
+		im.Reference = av.Local[len(av.Local)-1]
+	} else {
+		for _, remote := range sortedRemotes(av) {
+			versions := av.Remotes[remote]
+			if len(versions) > 0 {
+				im.Reference = versions[len(versions)-1]
+				im.Remote = remote
+				break
+			}
+		}
+	}
+	s.images = append(s.images, im)
+	s.dirty = true
+}
+
+// pin sets the reference of image `name`, adding it to the profile if
+// needed. Versions only found on a remote are fetched from there.
+func (s *tuiSession) pin(name string, ref string) {
+	i := s.selected(name)
+	if i < 0 {
+		s.images = append(s.images, torcx.Image{Name: name})
+		i = len(s.images) - 1
+	}
+	im := &s.images[i]
+	im.Reference = ref
+	av := s.available[name]
+	if !containsString(av.Local, ref) && !containsString(av.Remotes[im.Remote], ref) {
+		for _, remote := range sortedRemotes(av) {
+			if containsString(av.Remotes[remote], ref) {
+				im.Remote = remote
+				break
+			}
+		}
+	}
+	s.dirty = true
+}
+
+// render writes the images table, followed by the last message.
+func (s *tuiSession) render(out io.Writer) {
+	if s.clear {
+		fmt.Fprint(out, "\033[H\033[2J")
+	}
+	status := ""
+	if s.dirty {
+		status = " [modified]"
+	}
+	fmt.Fprintf(out, "profile %s (%s)%s\n\n", s.applyCfg.UpperProfile, s.path, status)
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\t\tNAME\tREFERENCE\tLOCAL\tREMOTES")
+	for n, name := range s.rows {
+		mark, ref := "[ ]", "-"
+		if i := s.selected(name); i >= 0 {
+			mark, ref = "[x]", s.images[i].Reference
+			if s.images[i].Remote != "" {
+				ref += " (" + s.images[i].Remote + ")"
+			}
+			if s.images[i].Recommended {
+				mark = "[~]"
+			}
+		}
+		av := s.available[name]
+		remotes := []string{}
+		for _, remote := range sortedRemotes(av) {
+			remotes = append(remotes, remote+": "+strings.Join(av.Remotes[remote], " "))
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", n+1, mark, name, ref,
+			strings.Join(av.Local, " "), strings.Join(remotes, ", "))
+	}
+	tw.Flush()
+	if s.message != "" {
+		fmt.Fprintf(out, "\n%s\n", s.message)
+	}
+	fmt.Fprintln(out)
+}
+
+// formatTUIImage formats a merged profile entry.
+func formatTUIImage(im torcx.Image) string {
+	entry := im.Name + ":" + im.Reference
+	if im.Remote != "" {
+		entry += " (remote " + im.Remote + ")"
+	}
+	if im.Recommended {
+		entry += " [recommended]"
+	}
+	return entry
+}
+
+// sortedRemotes returns the remote names offering `av`, sorted.
+func sortedRemotes(av torcx.AvailableImage) []string {
+	remotes := make([]string, 0, len(av.Remotes))
+	for remote := range av.Remotes {
+		remotes = append(remotes, remote)
+	}
+	sort.Strings(remotes)
+	return remotes
+}
+
+// containsString returns whether `list` contains `s`.
+func containsString(list []string, s string) bool {
+	for _, entry := range list {
+		if entry == s {
+			return true
+		}
+	}
+	return false
+}
@@ -14,6 +14,10 @@
 
 package cli
 
+import (
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
 const (
 	// TorcxProfileListV0K is the JSON kind identifier for a profile list
 	TorcxProfileListV0K = "torcx-profile-list-v0"
@@ -31,6 +35,8 @@ type profileList struct {
 	CurrentProfilePath *string  `json:"current_profile_path"`
 	NextProfileName    *string  `json:"next_profile_name"`
 	Profiles           []string `json:"profiles"`
+	// Annotations are keyed by profile name, for annotated profiles only
+	Annotations map[string]map[string]string `json:"annotations,omitempty"`
 }
 
 const (
@@ -50,3 +56,181 @@ type ImageEntry struct {
 	Reference string `json:"reference"`
 	Filepath  string `json:"filepath"`
 }
+
+const (
+	// TorcxProfileGraphV0K is the JSON kind identifier for a profile graph
+	TorcxProfileGraphV0K = "torcx-profile-graph-v0"
+)
+
+// ProfileGraph is the JSON container for profile graph output
+type ProfileGraph struct {
+	Kind  string             `json:"kind"`
+	Value torcx.ProfileGraph `json:"value"`
+}
+
+const (
+	// TorcxPrecheckV0K is the JSON kind identifier for a propagation plan
+	TorcxPrecheckV0K = "torcx-precheck-v0"
+)
+
+// Precheck is the JSON container for precheck output
+type Precheck struct {
+	Kind  string                `json:"kind"`
+	Value torcx.PropagationPlan `json:"value"`
+}
+
+const (
+	// TorcxQuarantineListV0K is the JSON kind identifier for a quarantine list
+	TorcxQuarantineListV0K = "torcx-quarantine-list-v0"
+)
+
+// QuarantineList is the JSON container for quarantine list output
+type QuarantineList struct {
+	Kind  string                     `json:"kind"`
+	Value []torcx.QuarantinedArchive `json:"value"`
+}
+
+const (
+	// TorcxStatusV0K is the JSON kind identifier for status output
+	TorcxStatusV0K = "torcx-status-v0"
+)
+
+// Status is the JSON container for status output
+type Status struct {
+	Kind  string      `json:"kind"`
+	Value statusValue `json:"value"`
+}
+
+type statusValue struct {
+	Sealed             bool              `json:"sealed"`
+	UpperProfileName   *string           `json:"upper_profile_name"`
+	UpperAnnotations   map[string]string `json:"upper_profile_annotations,omitempty"`
+	CurrentProfilePath *string           `json:"current_profile_path"`
+	NextProfileName    *string           `json:"next_profile_name"`
+	WarningsPath       string            `json:"warnings_path"`
+	Warnings           int               `json:"warnings"`
+	WarningsByKind     map[string]int    `json:"warnings_by_kind"`
+	Inconsistencies    *int              `json:"inconsistencies"`
+	Mounts             []torcx.LiveMount `json:"mounts,omitempty"`
+	// StoreEncryption is only reported if the user store is configured
+	// to be encrypted
+	StoreEncryption *torcx.StoreEncryptionState `json:"store_encryption,omitempty"`
+}
+
+const (
+	// TorcxRemoteDiffV0K is the JSON kind identifier for remote diff output
+	TorcxRemoteDiffV0K = "torcx-remote-diff-v0"
+)
+
+// RemoteDiff is the JSON container for remote diff output
+type RemoteDiff struct {
+	Kind  string               `json:"kind"`
+	Value []torcx.ContentsDiff `json:"value"`
+}
+
+const (
+	// TorcxImageInspectV0K is the JSON kind identifier for image inspect output
+	TorcxImageInspectV0K = "torcx-image-inspect-v0"
+)
+
+// ImageInspect is the JSON container for image inspect output
+type ImageInspect struct {
+	Kind  string                `json:"kind"`
+	Value torcx.ImageInspection `json:"value"`
+}
+
+const (
+	// TorcxImageOutdatedV0K is the JSON kind identifier for image outdated output
+	TorcxImageOutdatedV0K = "torcx-image-outdated-v0"
+)
+
+// ImageOutdated is the JSON container for image outdated output
+type ImageOutdated struct {
+	Kind  string                `json:"kind"`
+	Value []torcx.OutdatedImage `json:"value"`
+}
+
+const (
+	// TorcxImageFetchManifestV0K is the JSON kind identifier for image fetch-manifest output
+	TorcxImageFetchManifestV0K = "torcx-image-fetch-manifest-v0"
+)
+
+// ImageFetchManifest is the JSON container for image fetch-manifest output
+type ImageFetchManifest struct {
+	Kind  string              `json:"kind"`
+	Value torcx.ImageMetadata `json:"value"`
+}
+
+const (
+	// TorcxSupportedKindsV0K is the JSON kind identifier for supported-kinds output
+	TorcxSupportedKindsV0K = "torcx-supported-kinds-v0"
+)
+
+// SupportedKinds is the JSON container for supported-kinds output
+type SupportedKinds struct {
+	Kind  string   `json:"kind"`
+	Value []string `json:"value"`
+}
+
+const (
+	// TorcxVersionV0K is the JSON kind identifier for version output
+	TorcxVersionV0K = "torcx-version-v0"
+)
+
+// Version is the JSON container for version output
+type Version struct {
+	Kind  string      `json:"kind"`
+	Value VersionInfo `json:"value"`
+}
+
+// VersionInfo describes the capabilities of a torcx build
+type VersionInfo struct {
+	Version        string                `json:"version"`
+	ArchiveFormats []torcx.ArchiveFormat `json:"archive_formats"`
+	ManifestKinds  []string              `json:"manifest_kinds"`
+	Features       []string              `json:"features"`
+}
+
+const (
+	// TorcxPrecheckLiveV0K is the JSON kind identifier for a propagation plan compared with the live system
+	TorcxPrecheckLiveV0K = "torcx-precheck-live-v0"
+)
+
+// PrecheckLive is the JSON container for precheck --against-live output
+type PrecheckLive struct {
+	Kind  string         `json:"kind"`
+	Value torcx.LiveDiff `json:"value"`
+}
+
+const (
+	// TorcxProfileVerifyV0K is the JSON kind identifier for profile verify output
+	TorcxProfileVerifyV0K = "torcx-profile-verify-v0"
+)
+
+// ProfileVerify is the JSON container for profile verify output
+type ProfileVerify struct {
+	Kind  string                    `json:"kind"`
+	Value torcx.ProfileVerification `json:"value"`
+}
+
+const (
+	// TorcxStoreSyncV0K is the JSON kind identifier for store sync output
+	TorcxStoreSyncV0K = "torcx-store-sync-v0"
+)
+
+// StoreSync is the JSON container for store sync output
+type StoreSync struct {
+	Kind  string                `json:"kind"`
+	Value []torcx.SyncedArchive `json:"value"`
+}
+
+const (
+	// TorcxPolicyCheckV0K is the JSON kind identifier for policy-check output
+	TorcxPolicyCheckV0K = "torcx-policy-check-v0"
+)
+
+// PolicyCheck is the JSON container for policy-check output
+type PolicyCheck struct {
+	Kind  string                  `json:"kind"`
+	Value []torcx.PolicyViolation `json:"value"`
+}
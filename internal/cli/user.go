@@ -0,0 +1,104 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdUser = &cobra.Command{
+		Use:   "user [command]",
+		Short: "Operate on the profile of the current user (experimental)",
+		Long: `This subcommand operates on a per-user profile, applied without privileges.
+It requires the "TORCX_EXP_USER_MODE" experimental flag.`,
+	}
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdUser)
+}
+
+// fillUserRuntime generates the runtime config for user-mode subcommands,
+// rooted at XDG base directories of the current user.
+func fillUserRuntime() (*torcx.UserConfig, error) {
+	home := os.Getenv("HOME")
+	if !filepath.IsAbs(home) {
+		return nil, errors.Errorf("non-absolute HOME %q", home)
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if !filepath.IsAbs(runtimeDir) {
+		return nil, errors.Errorf("non-absolute XDG_RUNTIME_DIR %q", runtimeDir)
+	}
+	dataDir := xdgDir("XDG_DATA_HOME", filepath.Join(home, ".local", "share"))
+	confDir := xdgDir("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+
+	// System-wide stores are used as read-only lookup paths,
+	// the user store is appended last.
+	systemCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return nil, errors.Wrap(err, "common configuration failed")
+	}
+
+	commonCfg := torcx.CommonConfig{
+		BaseDir: filepath.Join(dataDir, "torcx"),
+		RunDir:  filepath.Join(runtimeDir, "torcx"),
+		UsrDir:  systemCfg.UsrDir,
+		ConfDir: filepath.Join(confDir, "torcx"),
+	}
+	commonCfg.StorePaths = append(systemCfg.StorePaths, commonCfg.UserStorePath(""))
+	if err := torcx.ValidateCommonConfig(&commonCfg); err != nil {
+		return nil, errors.Wrap(err, "invalid user config")
+	}
+
+	upperProfileName, err := commonCfg.NextProfileName()
+	if err != nil {
+		logrus.Warnf("no next user profile: %s", err)
+		upperProfileName = ""
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"base_dir":      commonCfg.BaseDir,
+		"run_dir":       commonCfg.RunDir,
+		"conf_dir":      commonCfg.ConfDir,
+		"upper profile": upperProfileName,
+	}).Debug("user configuration parsed")
+
+	return &torcx.UserConfig{
+		ApplyConfig: torcx.ApplyConfig{
+			CommonConfig: commonCfg,
+			UpperProfile: upperProfileName,
+		},
+		BinDir:   filepath.Join(home, ".local", "bin"),
+		UnitsDir: filepath.Join(runtimeDir, "systemd", "user"),
+	}, nil
+}
+
+// xdgDir returns the value of the XDG environment variable `key`,
+// or `fallback` if unset or non-absolute.
+func xdgDir(key string, fallback string) string {
+	dir := os.Getenv(key)
+	if !filepath.IsAbs(dir) {
+		return fallback
+	}
+	return dir
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+)
+
+var (
+	cmdUserApply = &cobra.Command{
+		Use:   "apply",
+		Short: "apply the next user profile",
+		Long: `Apply the next profile of the current user, without privileges.
+Binaries are symlinked into "~/.local/bin" and systemd units are propagated as
+runtime user units. Only tgz images are supported.`,
+		RunE: runUserApply,
+	}
+)
+
+func init() {
+	cmdUser.AddCommand(cmdUserApply)
+}
+
+func runUserApply(cmd *cobra.Command, args []string) error {
+	if !hasExpFeature("USER_MODE") {
+		return errors.New("user mode requires TORCX_EXP_USER_MODE")
+	}
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+
+	userCfg, err := fillUserRuntime()
+	if err != nil {
+		return errors.Wrap(err, "user configuration failed")
+	}
+	if torcx.IsExistingPath(userCfg.RunDir) {
+		logrus.WithField("path", userCfg.RunDir).Info("torcx already run for this user")
+		return nil
+	}
+
+	if err := torcx.ApplyUserProfile(userCfg); err != nil {
+		return errors.Wrap(err, "user apply failed")
+	}
+	return nil
+}
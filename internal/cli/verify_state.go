@@ -0,0 +1,63 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdVerifyState = &cobra.Command{
+		Use:   "verify-state [--digest-sample=N]",
+		Short: "verify the sealed state is still in place",
+		Long: `Verify that the state recorded at seal time is still in place: the unpack
+directory, squashfs and erofs images are still mounted, image roots still exist, and
+a random sample of applied archives still match their recorded digest.
+Drift is logged, recorded in the consistency file, and fails the command.`,
+		RunE: runVerifyState,
+	}
+	flagVerifyStateDigestSample int
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdVerifyState)
+	cmdVerifyState.Flags().IntVar(&flagVerifyStateDigestSample, "digest-sample", 1, "number of archives to verify against their digest (0 for all)")
+}
+
+func runVerifyState(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	drift, err := torcx.VerifyConsistency(commonCfg, flagVerifyStateDigestSample)
+	if err != nil {
+		return err
+	}
+	for _, d := range drift {
+		fmt.Printf("%s: %s (%s)\n", d.Kind, d.Message, d.Path)
+	}
+	if len(drift) > 0 {
+		return errors.Errorf("%d inconsistencies found", len(drift))
+	}
+	return nil
+}
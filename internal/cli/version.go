@@ -0,0 +1,64 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/flatcar-linux/torcx/pkg/version"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdVersion = &cobra.Command{
+		Use:   "version [--json]",
+		Short: "print the torcx version",
+		Long: `Print the torcx build version.
+With "--json", also report the supported archive formats, the supported
+manifest kinds and the compiled-in features, so that provisioning tools can
+adapt their payloads to the capabilities of the node.`,
+		RunE: runVersion,
+	}
+	flagVersionJSON bool
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdVersion)
+	cmdVersion.Flags().BoolVar(&flagVersionJSON, "json", false, "print capabilities as JSON")
+}
+
+func runVersion(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	if !flagVersionJSON {
+		fmt.Println(version.VERSION)
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(Version{
+		Kind: TorcxVersionV0K,
+		Value: VersionInfo{
+			Version:        version.VERSION,
+			ArchiveFormats: torcx.ArchiveFormats(),
+			ManifestKinds:  torcx.SupportedKinds(),
+			Features:       torcx.Features(),
+		},
+	})
+}
@@ -0,0 +1,438 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// NodeStateV0K - desired node state kind, v0
+	NodeStateV0K = "torcx-node-state-v0"
+	// AgentStatusV0K - agent status report kind, v0
+	AgentStatusV0K = "torcx-agent-status-v0"
+
+	// agentSource is the error reports source of agent reconciliations.
+	agentSource = "agent"
+)
+
+// profileNameRegexp matches valid profile names.
+var profileNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,512}$`)
+
+// NodeStateV0JSON holds a JSON desired node state (version 0).
+type NodeStateV0JSON struct {
+	Kind  string      `json:"kind"`
+	Value NodeStateV0 `json:"value"`
+}
+
+// NodeStateV0 describes the desired addons of a node: the upper profile
+// to apply on next boot, and its images.
+type NodeStateV0 struct {
+	ProfileName string    `json:"profile_name"`
+	Images      []ImageV1 `json:"images"`
+}
+
+// AgentStatusV0JSON holds a JSON agent status report (version 0).
+type AgentStatusV0JSON struct {
+	Kind  string      `json:"kind"`
+	Value AgentStatus `json:"value"`
+}
+
+// AgentStatus reports the outcome of the last reconciliation.
+type AgentStatus struct {
+	Source         string    `json:"source"`
+	DesiredProfile string    `json:"desired_profile,omitempty"`
+	NextProfile    string    `json:"next_profile,omitempty"`
+	CurrentProfile string    `json:"current_profile,omitempty"`
+	RebootRequired bool      `json:"reboot_required"`
+	Images         []ImageV1 `json:"images,omitempty"`
+	LastReconcile  time.Time `json:"last_reconcile,omitempty"`
+	LastSuccess    time.Time `json:"last_success,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+}
+
+// Agent reconciles the node towards a desired state, read from a local
+// file or an HTTP(S) endpoint: images are fetched into the user store,
+// written as a user profile, and selected as next profile.
+// The new profile is applied on the following boot.
+type Agent struct {
+	Config *CommonConfig
+	// Source is the path or URL of the desired node state.
+	Source string
+	// StatusPath is where status reports are written, if not empty.
+	StatusPath string
+	// Timeout bounds each reconciliation, if positive.
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	status AgentStatus
+}
+
+// NewAgent returns an agent reconciling towards the state at `source`.
+func NewAgent(cc *CommonConfig, source string, statusPath string) *Agent {
+	return &Agent{
+		Config:     cc,
+		Source:     source,
+		StatusPath: statusPath,
+		status:     AgentStatus{Source: source},
+	}
+}
+
+// Run reconciles every `interval`, until the context is canceled.
+// Repeated reconciliation failures are rate-limited in the journal.
+func (a *Agent) Run(ctx context.Context, interval time.Duration) error {
+	if a.Config == nil {
+		return errors.New("nil CommonConfig")
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		reporter := newErrorReporter(a.Config, agentSource, logrus.ErrorLevel)
+		if err := a.Reconcile(ctx); err != nil {
+			reporter.report(logrus.Fields{
+				"source": a.Source,
+			}, "reconciliation failed: "+err.Error())
+		}
+		reporter.close()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile performs a single reconciliation towards the desired state,
+// recording its outcome in the agent status.
+func (a *Agent) Reconcile(ctx context.Context) error {
+	if a.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
+	}
+	status, err := a.reconcile(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = errors.Wrapf(err, "reconciliation timed out after %s", a.Timeout)
+	}
+	status.Source = a.Source
+	status.LastReconcile = time.Now().UTC()
+	if err != nil {
+		status.LastError = err.Error()
+	} else {
+		status.LastSuccess = status.LastReconcile
+	}
+
+	a.mu.Lock()
+	if err != nil {
+		// Keep the last known-good state around.
+		status.LastSuccess = a.status.LastSuccess
+		if status.DesiredProfile == "" {
+			status.DesiredProfile = a.status.DesiredProfile
+		}
+	}
+	a.status = status
+	a.mu.Unlock()
+
+	if a.StatusPath != "" {
+		if werr := writeAgentStatus(a.StatusPath, status); werr != nil {
+			logrus.WithFields(logrus.Fields{
+				"path":  a.StatusPath,
+				"error": werr,
+			}).Warn("unable to write agent status")
+		}
+	}
+	return err
+}
+
+func (a *Agent) reconcile(ctx context.Context) (AgentStatus, error) {
+	status := AgentStatus{}
+	if a.Config == nil {
+		return status, errors.New("nil CommonConfig")
+	}
+
+	state, err := readNodeState(ctx, a.Config.httpClient(), a.Source)
+	if err != nil {
+		return status, errors.Wrap(err, "reading desired state")
+	}
+	status.DesiredProfile = state.ProfileName
+	status.Images = state.Images
+	images := ImagesFromJSONV1(ImagesV1{Images: state.Images})
+
+	if err := fetchMissingImages(ctx, a.Config, images); err != nil {
+		return status, err
+	}
+
+	profilePath := filepath.Join(a.Config.UserProfileDir(), state.ProfileName+".json")
+	if err := os.MkdirAll(a.Config.UserProfileDir(), 0755); err != nil {
+		return status, err
+	}
+	changed, err := writeProfileV1(profilePath, images)
+	if err != nil {
+		return status, errors.Wrapf(err, "writing profile %q", profilePath)
+	}
+	if changed {
+		logrus.WithFields(logrus.Fields{
+			"profile": state.ProfileName,
+			"path":    profilePath,
+		}).Info("profile updated")
+	}
+
+	if next, err := a.Config.NextProfileName(); err != nil || next != state.ProfileName {
+		if err := a.Config.SetNextProfileName(state.ProfileName); err != nil {
+			return status, errors.Wrap(err, "setting next profile")
+		}
+		logrus.WithField("profile", state.ProfileName).Info("next profile set")
+	}
+	status.NextProfile = state.ProfileName
+
+	// A reboot is required unless the desired profile is running, with
+	// all desired images applied.
+	status.RebootRequired = true
+	if upper, _, err := CurrentProfileNames(); err == nil {
+		status.CurrentProfile = upper
+		if current, err := ReadCurrentProfile(); err == nil && upper == state.ProfileName {
+			status.RebootRequired = changed || !containsImages(current, images)
+		}
+	}
+	return status, nil
+}
+
+// fetchMissingImages fetches all images not yet available in local stores
+// into the user store.
+func fetchMissingImages(ctx context.Context, cc *CommonConfig, images []Image) error {
+	storeCache, err := NewStoreCache(cc.StorePaths)
+	if err != nil {
+		return err
+	}
+
+	missing := []Image{}
+	remotes := []string{}
+	seen := map[string]bool{}
+	for _, im := range images {
+		if _, err := storeCache.ArchiveFor(im); err == nil {
+			continue
+		}
+		if im.Remote == "" {
+			return errors.Errorf("image %s:%s not found locally, and no remote configured", im.Name, im.Reference)
+		}
+		missing = append(missing, im)
+		if !seen[im.Remote] {
+			remotes = append(remotes, im.Remote)
+			seen[im.Remote] = true
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	remotesCache, err := cc.LoadRemotes(ctx, remotes)
+	if err != nil {
+		return errors.Wrap(err, "loading remotes")
+	}
+	storePath := cc.UserStorePath("")
+	if err := os.MkdirAll(storePath, 0755); err != nil {
+		return err
+	}
+	for _, im := range missing {
+		if err := remotesCache.FetchImage(ctx, im, storePath); err != nil {
+			return errors.Wrapf(err, "fetching %s:%s", im.Name, im.Reference)
+		}
+	}
+	return nil
+}
+
+// Status returns the outcome of the last reconciliation.
+func (a *Agent) Status() AgentStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.status
+}
+
+// ServeHTTP serves the agent status on `/status`, and its health on
+// `/healthz` (failing if the last reconciliation failed).
+func (a *Agent) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	status := a.Status()
+	switch req.URL.Path {
+	case "/status":
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(AgentStatusV0JSON{AgentStatusV0K, status})
+	case "/healthz":
+		if status.LastReconcile.IsZero() || status.LastError != "" {
+			http.Error(w, "not reconciled", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, "ok\n")
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// readNodeState reads and validates the desired node state at `source`,
+// either a local path or an HTTP(S) URL.
+func readNodeState(ctx context.Context, client *http.Client, source string) (NodeStateV0, error) {
+	var rd io.Reader
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		req, err := http.NewRequest(http.MethodGet, source, nil)
+		if err != nil {
+			return NodeStateV0{}, err
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return NodeStateV0{}, err
+		}
+		defer resp.Body.Close()
+		if err := checkHTTPStatus(resp); err != nil {
+			return NodeStateV0{}, err
+		}
+		rd = resp.Body
+	} else {
+		fp, err := os.Open(source)
+		if err != nil {
+			return NodeStateV0{}, err
+		}
+		defer fp.Close()
+		rd = bufio.NewReader(fp)
+	}
+
+	var manifest NodeStateV0JSON
+	if err := json.NewDecoder(rd).Decode(&manifest); err != nil {
+		return NodeStateV0{}, err
+	}
+	if manifest.Kind != NodeStateV0K {
+		return NodeStateV0{}, errors.Errorf("unknown node state kind %q", manifest.Kind)
+	}
+	state := manifest.Value
+	if !profileNameRegexp.MatchString(state.ProfileName) {
+		return NodeStateV0{}, errors.Errorf("invalid profile name %q", state.ProfileName)
+	}
+	for _, im := range state.Images {
+		if im.Name == "" || im.Reference == "" {
+			return NodeStateV0{}, errors.New("missing image name or reference")
+		}
+		// Desired images are pinned, to be reproducible across the fleet.
+		if IsVersionQuery(im.Reference) {
+			return NodeStateV0{}, errors.Errorf("image %s:%s is not pinned to a concrete reference", im.Name, im.Reference)
+		}
+	}
+	return state, nil
+}
+
+// writeProfileV1 atomically writes `images` as a v1 profile at `path`,
+// returning whether its content changed.
+func writeProfileV1(path string, images []Image) (bool, error) {
+	manifest := newProfileV1(images)
+	// Annotations are kept across rewrites of the profile.
+	if annotations, err := ReadProfileAnnotations(path); err == nil {
+		manifest.Value.Annotations = annotations
+	}
+	return writeProfileManifest(path, manifest)
+}
+
+// newProfileV1 builds a v1 profile manifest listing `images`.
+func newProfileV1(images []Image) ProfileManifestV1JSON {
+	manifest := ProfileManifestV1JSON{
+		Kind:  ProfileManifestV1K,
+		Value: ImagesToJSONV1(images),
+	}
+	if manifest.Value.Images == nil {
+		manifest.Value.Images = []ImageV1{}
+	}
+	required, recommended := 0, 0
+	for _, im := range images {
+		if im.Recommended {
+			manifest.Value.Recommends[recommended].Remote = im.Remote
+			recommended++
+			continue
+		}
+		manifest.Value.Images[required].Remote = im.Remote
+		required++
+	}
+	return manifest
+}
+
+// writeProfileManifest atomically writes `manifest` at `path`, returning
+// whether it changed.
+func writeProfileManifest(path string, manifest ProfileManifestV1JSON) (bool, error) {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	content = append(content, '\n')
+	if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, content) {
+		return false, nil
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".profile")
+	if err != nil {
+		return false, err
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName)
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		return false, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmpName, path)
+}
+
+// writeAgentStatus atomically writes a status report at `path`.
+func writeAgentStatus(path string, status AgentStatus) error {
+	content, err := json.MarshalIndent(AgentStatusV0JSON{AgentStatusV0K, status}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// containsImages returns whether all `images` are referenced in `profile`.
+func containsImages(profile []Image, images []Image) bool {
+	for _, im := range images {
+		if !profileContains(profile, im) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,158 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAgentReconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_agent_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cc := &CommonConfig{
+		BaseDir: filepath.Join(dir, "base"),
+		RunDir:  filepath.Join(dir, "run"),
+		ConfDir: filepath.Join(dir, "conf"),
+		UsrDir:  filepath.Join(dir, "usr"),
+	}
+	userStore := cc.UserStorePath("")
+	cc.StorePaths = []string{userStore}
+	if err := os.MkdirAll(userStore, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(userStore, "foo:1.torcx.tgz"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	statePath := filepath.Join(dir, "state.json")
+	state := `{"kind": "torcx-node-state-v0", "value": {"profile_name": "fleet", "images": [{"name": "foo", "reference": "1"}]}}`
+	if err := ioutil.WriteFile(statePath, []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+	statusPath := filepath.Join(cc.RunDir, "agent-status.json")
+	agent := NewAgent(cc, statePath, statusPath)
+
+	rec := httptest.NewRecorder()
+	agent.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected unhealthy agent before reconciliation, got %d", rec.Code)
+	}
+
+	if err := agent.Reconcile(context.Background()); err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	images, err := ReadProfilePath(filepath.Join(cc.UserProfileDir(), "fleet.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsImages(images, []Image{{Name: "foo", Reference: "1"}}) || len(images) != 1 {
+		t.Errorf("unexpected profile content %v", images)
+	}
+	next, err := cc.NextProfileName()
+	if err != nil || next != "fleet" {
+		t.Errorf("unexpected next profile %q %v", next, err)
+	}
+	status := agent.Status()
+	if status.LastError != "" || status.NextProfile != "fleet" || !status.RebootRequired {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if !IsExistingPath(statusPath) {
+		t.Error("status report not written")
+	}
+	rec = httptest.NewRecorder()
+	agent.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected healthy agent, got %d", rec.Code)
+	}
+
+	// Unpinned and unavailable images fail reconciliation.
+	for _, state := range []string{
+		`{"kind": "torcx-node-state-v0", "value": {"profile_name": "fleet", "images": [{"name": "foo", "reference": "latest"}]}}`,
+		`{"kind": "torcx-node-state-v0", "value": {"profile_name": "fleet", "images": [{"name": "bar", "reference": "1"}]}}`,
+		`{"kind": "torcx-node-state-v0", "value": {"profile_name": "../fleet", "images": []}}`,
+	} {
+		if err := ioutil.WriteFile(statePath, []byte(state), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := agent.Reconcile(context.Background()); err == nil {
+			t.Errorf("expected error reconciling %s", state)
+		}
+	}
+	if status := agent.Status(); status.LastError == "" || status.LastSuccess.IsZero() {
+		t.Errorf("unexpected status after failure %+v", status)
+	}
+}
+
+// unresolvedTransport fails all requests, as if no name could be resolved.
+type unresolvedTransport struct{}
+
+func (unresolvedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: req.URL.Hostname(), IsNotFound: true}
+}
+
+func TestAgentReconcileTimeout(t *testing.T) {
+	dir := t.TempDir()
+	cc := &CommonConfig{
+		BaseDir:   filepath.Join(dir, "base"),
+		RunDir:    filepath.Join(dir, "run"),
+		ConfDir:   filepath.Join(dir, "conf"),
+		UsrDir:    filepath.Join(dir, "usr"),
+		Transport: unresolvedTransport{},
+	}
+	remoteDir := filepath.Join(cc.ConfDir, "remotes", "unreachable")
+	if err := os.MkdirAll(remoteDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{"kind": "remote-manifest-v0", "value": {"base_url": "https://torcx.invalid/", "keys": []}}`
+	if err := ioutil.WriteFile(filepath.Join(remoteDir, "remote.json"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	statePath := filepath.Join(dir, "state.json")
+	state := `{"kind": "torcx-node-state-v0", "value": {"profile_name": "fleet", "images": [{"name": "foo", "reference": "1", "remote": "unreachable"}]}}`
+	if err := ioutil.WriteFile(statePath, []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	agent := NewAgent(cc, statePath, "")
+	agent.Timeout = 100 * time.Millisecond
+	done := make(chan error)
+	go func() {
+		done <- agent.Reconcile(context.Background())
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Errorf("expected timeout, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("reconciliation not bounded by its timeout")
+	}
+	if status := agent.Status(); !strings.Contains(status.LastError, "timed out") {
+		t.Errorf("timeout not recorded in status %+v", status)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ImageAlias is an image reference pointing to another reference of
+// the same image, e.g. `docker:current` -> `docker:20.10.12`.
+type ImageAlias struct {
+	Image
+	// Target is the reference pointed to by the alias.
+	Target string
+}
+
+// String returns the alias in the form used in the seal file,
+// e.g. `docker:current=20.10.12`.
+func (al ImageAlias) String() string {
+	return fmt.Sprintf("%s:%s=%s", al.Name, al.Reference, al.Target)
+}
+
+// resolveAlias returns the archive an aliased archive points to.
+// Aliases are symlinks to an archive of the same image, with a different
+// reference. Archives which are not aliases are returned unchanged.
+func resolveAlias(ar Archive) (Archive, bool) {
+	fi, err := os.Lstat(ar.Filepath)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return ar, false
+	}
+	targetPath, err := filepath.EvalSymlinks(ar.Filepath)
+	if err != nil {
+		return ar, false
+	}
+	targetInfo, err := os.Lstat(targetPath)
+	if err != nil {
+		return ar, false
+	}
+	target, ok := scanStoreEntry(filepath.Dir(targetPath), targetInfo)
+	if !ok || target.Name != ar.Name || target.Reference == ar.Reference {
+		return ar, false
+	}
+	target.Remote = ar.Remote
+	return target, true
+}
+
+// ListImageAliases returns all aliases found in writable stores.
+func ListImageAliases(cc *CommonConfig) ([]ImageAlias, error) {
+	if cc == nil {
+		return nil, errors.New("nil CommonConfig")
+	}
+
+	aliases := []ImageAlias{}
+	seen := map[Image]bool{}
+	for _, dir := range cc.WritableStorePaths() {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, fi := range files {
+			if fi.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+			archive, ok := scanStoreEntry(dir, fi)
+			if !ok || seen[archive.Image] {
+				continue
+			}
+			target, ok := resolveAlias(archive)
+			if !ok {
+				continue
+			}
+			seen[archive.Image] = true
+			aliases = append(aliases, ImageAlias{archive.Image, target.Reference})
+		}
+	}
+	sort.Slice(aliases, func(i, j int) bool {
+		return aliases[i].String() < aliases[j].String()
+	})
+	return aliases, nil
+}
+
+// SetImageAlias points the alias reference `alias` of image `name` to the
+// existing reference `target`, replacing any previous alias. Alias symlinks
+// are placed next to the target archives if in a writable store, otherwise
+// in the user store. The created alias path is returned.
+func SetImageAlias(cc *CommonConfig, name string, alias string, target string) (string, error) {
+	if cc == nil {
+		return "", errors.New("nil CommonConfig")
+	}
+	if name == "" || alias == "" || target == "" {
+		return "", errors.New("missing image name, alias or target reference")
+	}
+	if alias == target {
+		return "", errors.New("an alias cannot point to itself")
+	}
+
+	storeCache, err := NewStoreCache(cc.StorePaths)
+	if err != nil {
+		return "", err
+	}
+	targetArchive, err := storeCache.ArchiveFor(Image{Name: name, Reference: target})
+	if err != nil {
+		return "", err
+	}
+	// Chained aliases are flattened, pointing straight to the concrete archive.
+	targetArchive, _ = resolveAlias(targetArchive)
+
+	destDir := filepath.Dir(targetArchive.Filepath)
+	if !isWritableStore(cc, destDir) {
+		destDir = cc.UserStorePath("")
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			return "", err
+		}
+	}
+	linkTarget := targetArchive.Filepath
+	if filepath.Dir(linkTarget) == destDir {
+		linkTarget = filepath.Base(linkTarget)
+	}
+	aliasPath := filepath.Join(destDir, name+":"+alias+targetArchive.Format.FileSuffix())
+	if IsExistingPath(aliasPath) && !isAliasLink(aliasPath) {
+		return "", errors.Errorf("%s is an archive, not an alias", aliasPath)
+	}
+	tmpPath := partialPath(destDir, filepath.Base(aliasPath), "")
+	_ = os.Remove(tmpPath)
+	if err := os.Symlink(linkTarget, tmpPath); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPath, aliasPath); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	updateStoreIndex(destDir)
+	if err := removeAliasLinks(cc, name, alias, aliasPath); err != nil {
+		return "", err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"name":   name,
+		"alias":  alias,
+		"target": targetArchive.Reference,
+		"path":   aliasPath,
+	}).Info("image alias set")
+	return aliasPath, nil
+}
+
+// RemoveImageAlias removes the alias reference `alias` of image `name`
+// from writable stores. Target archives are left untouched.
+func RemoveImageAlias(cc *CommonConfig, name string, alias string) error {
+	if cc == nil {
+		return errors.New("nil CommonConfig")
+	}
+	found := false
+	for _, dir := range cc.WritableStorePaths() {
+		for _, format := range archiveFormats {
+			if isAliasLink(filepath.Join(dir, name+":"+alias+format.FileSuffix())) {
+				found = true
+			}
+		}
+	}
+	if !found {
+		return errors.Errorf("alias %s:%s not found in writable stores", name, alias)
+	}
+	return removeAliasLinks(cc, name, alias, "")
+}
+
+// removeAliasLinks removes all alias symlinks for `name:alias` from
+// writable stores except `keep`, refusing to remove concrete archives.
+func removeAliasLinks(cc *CommonConfig, name string, alias string, keep string) error {
+	for _, dir := range cc.WritableStorePaths() {
+		removed := false
+		for _, format := range archiveFormats {
+			aliasPath := filepath.Join(dir, name+":"+alias+format.FileSuffix())
+			if aliasPath == keep {
+				continue
+			}
+			fi, err := os.Lstat(aliasPath)
+			if err != nil {
+				continue
+			}
+			if fi.Mode()&os.ModeSymlink == 0 {
+				return errors.Errorf("%s is an archive, not an alias", aliasPath)
+			}
+			if err := os.Remove(aliasPath); err != nil {
+				return err
+			}
+			removed = true
+		}
+		if removed {
+			updateStoreIndex(dir)
+		}
+	}
+	return nil
+}
+
+// isAliasLink returns whether `path` is a symlink in a store.
+func isAliasLink(path string) bool {
+	fi, err := os.Lstat(path)
+	return err == nil && fi.Mode()&os.ModeSymlink != 0
+}
+
+// isWritableStore returns whether `dir` is one of the writable stores.
+func isWritableStore(cc *CommonConfig, dir string) bool {
+	for _, p := range cc.WritableStorePaths() {
+		if filepath.Clean(p) == filepath.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordAlias records the concrete target of an alias resolved at apply
+// time, to be written in the seal.
+func (applyCfg *ApplyConfig) recordAlias(al ImageAlias) {
+	for _, entry := range applyCfg.ResolvedAliases {
+		if entry == al {
+			return
+		}
+	}
+	applyCfg.ResolvedAliases = append(applyCfg.ResolvedAliases, al)
+}
+
+// sealAliases formats resolved aliases for the seal file.
+func sealAliases(aliases []ImageAlias) string {
+	entries := make([]string, 0, len(aliases))
+	for _, al := range aliases {
+		entries = append(entries, al.String())
+	}
+	return strings.Join(entries, " ")
+}
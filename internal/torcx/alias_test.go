@@ -0,0 +1,135 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestImageAlias(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_alias_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cc := &CommonConfig{
+		BaseDir: filepath.Join(dir, "base"),
+		RunDir:  filepath.Join(dir, "run"),
+		ConfDir: filepath.Join(dir, "conf"),
+		UsrDir:  filepath.Join(dir, "usr"),
+	}
+	vendorStore := VendorStoreDir(cc.UsrDir)
+	userStore := cc.UserStorePath("")
+	cc.StorePaths = []string{vendorStore, userStore}
+	for _, d := range []string{vendorStore, userStore} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(vendorStore, "foo:1.torcx.tgz"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(userStore, "foo:2.torcx.squashfs"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alias to a read-only store goes to the user store.
+	aliasPath, err := SetImageAlias(cc, "foo", "current", "1")
+	if err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	if aliasPath != filepath.Join(userStore, "foo:current.torcx.tgz") {
+		t.Fatalf("unexpected alias path %q", aliasPath)
+	}
+
+	// Re-pointing replaces the previous alias, even across formats.
+	if _, err := SetImageAlias(cc, "foo", "current", "2"); err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	if IsExistingPath(aliasPath) {
+		t.Error("previous alias not removed")
+	}
+	link, err := os.Readlink(filepath.Join(userStore, "foo:current.torcx.squashfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "foo:2.torcx.squashfs" {
+		t.Errorf("expected relative alias link, got %q", link)
+	}
+
+	// Chained aliases point to the concrete archive.
+	if _, err := SetImageAlias(cc, "foo", "stable", "current"); err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	aliases, err := ListImageAliases(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 2 || aliases[0].String() != "foo:current=2" || aliases[1].String() != "foo:stable=2" {
+		t.Fatalf("unexpected aliases %v", aliases)
+	}
+
+	storeCache, err := NewStoreCache(cc.StorePaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := storeCache.ArchiveFor(Image{Name: "foo", Reference: "current"})
+	if err != nil {
+		t.Fatalf("alias not found in store: %s", err)
+	}
+	target, ok := resolveAlias(archive)
+	if !ok || target.Reference != "2" || target.Filepath != filepath.Join(userStore, "foo:2.torcx.squashfs") {
+		t.Fatalf("unexpected alias resolution %v %v", target, ok)
+	}
+	if _, ok := resolveAlias(target); ok {
+		t.Error("concrete archive resolved as alias")
+	}
+
+	// Aliased targets are in use.
+	if _, err := RemoveImage(cc, Image{Name: "foo", Reference: "2"}, false); errors.Cause(err) != ErrImageInUse {
+		t.Errorf("expected %s, got %v", ErrImageInUse, err)
+	}
+
+	// Concrete archives are never overwritten nor removed as aliases.
+	if _, err := SetImageAlias(cc, "foo", "2", "1"); err == nil {
+		t.Error("expected error overwriting an archive with an alias")
+	}
+	if err := RemoveImageAlias(cc, "foo", "2"); err == nil {
+		t.Error("expected error removing an archive as alias")
+	}
+
+	if err := RemoveImageAlias(cc, "foo", "current"); err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	if !IsExistingPath(filepath.Join(userStore, "foo:2.torcx.squashfs")) {
+		t.Error("alias target removed")
+	}
+	if err := RemoveImageAlias(cc, "foo", "current"); err == nil {
+		t.Error("expected error removing missing alias")
+	}
+
+	if got := sealAliases([]ImageAlias{
+		{Image{Name: "foo", Reference: "current"}, "2"},
+		{Image{Name: "bar", Reference: "stable"}, "1.0"},
+	}); got != "foo:current=2 bar:stable=1.0" {
+		t.Errorf("unexpected seal aliases %q", got)
+	}
+}
@@ -0,0 +1,487 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// APIInterface is the name of the varlink interface exposed by torcx.
+	APIInterface = "org.flatcar.torcx"
+
+	// apiFetchTimeout bounds the time spent in a single FetchImages call.
+	apiFetchTimeout = 10 * time.Minute
+)
+
+// apiInterfaceDescription is the varlink IDL of APIInterface.
+const apiInterfaceDescription = `# Manage torcx addons on this node.
+interface org.flatcar.torcx
+
+type Image (name: string, reference: string, remote: ?string)
+type Archive (name: string, reference: string, filepath: string, format: string)
+type Profile (name: string, path: string)
+
+# Returns the sealed state of the running system, if any.
+method GetStatus() -> (sealed: bool, upper_profile: ?string, lower_profiles: ?[]string, profile_path: ?string, next_profile: ?string, images: ?[]Image)
+# Lists all archives in the stores.
+method ListImages() -> (archives: []Archive)
+# Lists all available profiles.
+method ListProfiles() -> (profiles: []Profile)
+# Returns the images in a profile.
+method GetProfile(name: string) -> (images: []Image)
+# Creates or replaces a user profile.
+method PutProfile(name: string, images: []Image) -> ()
+# Removes a user profile.
+method DeleteProfile(name: string) -> ()
+# Selects the profile applied on next boot.
+method SetNextProfile(name: string) -> ()
+# Fetches images missing from local stores.
+method FetchImages(images: []Image) -> ()
+
+error NotFound (name: string)
+error PermissionDenied ()
+error Failed (message: string)
+`
+
+// APIPolicy authorizes API callers, identified by their socket credentials.
+// Read-only methods are allowed to any caller able to connect; mutating
+// methods are only allowed to root and to the listed UIDs and GIDs.
+type APIPolicy struct {
+	WriteUIDs []uint32
+	WriteGIDs []uint32
+}
+
+// canWrite returns whether a caller with credentials `cred` may call
+// mutating methods.
+func (p APIPolicy) canWrite(cred *unix.Ucred) bool {
+	if cred == nil {
+		return false
+	}
+	if cred.Uid == 0 {
+		return true
+	}
+	for _, uid := range p.WriteUIDs {
+		if cred.Uid == uid {
+			return true
+		}
+	}
+	for _, gid := range p.WriteGIDs {
+		if cred.Gid == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// APIServer serves the torcx varlink API over a unix socket.
+type APIServer struct {
+	Config *CommonConfig
+	Policy APIPolicy
+}
+
+// apiCall is a varlink method call.
+type apiCall struct {
+	Method     string          `json:"method"`
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+	More       bool            `json:"more,omitempty"`
+	Oneway     bool            `json:"oneway,omitempty"`
+}
+
+// apiReply is a varlink method reply.
+type apiReply struct {
+	Parameters interface{} `json:"parameters"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// apiError is a varlink error, returned by method handlers.
+type apiError struct {
+	Name       string
+	Parameters interface{}
+}
+
+func (e *apiError) Error() string {
+	return e.Name
+}
+
+// apiImage is the API representation of an image.
+type apiImage struct {
+	Name      string `json:"name"`
+	Reference string `json:"reference"`
+	Remote    string `json:"remote,omitempty"`
+}
+
+// apiMethod describes a method handler, and whether it mutates state.
+type apiMethod struct {
+	handler func(*APIServer, json.RawMessage) (interface{}, error)
+	write   bool
+}
+
+var apiMethods = map[string]apiMethod{
+	"GetStatus":      {(*APIServer).getStatus, false},
+	"ListImages":     {(*APIServer).listImages, false},
+	"ListProfiles":   {(*APIServer).listProfiles, false},
+	"GetProfile":     {(*APIServer).getProfile, false},
+	"PutProfile":     {(*APIServer).putProfile, true},
+	"DeleteProfile":  {(*APIServer).deleteProfile, true},
+	"SetNextProfile": {(*APIServer).setNextProfile, true},
+	"FetchImages":    {(*APIServer).fetchImages, true},
+}
+
+// ListenAPISocket creates a unix socket at `path`, replacing any stale one.
+// The socket is only accessible by its owner and group.
+func ListenAPISocket(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve accepts connections on `l`, until it is closed.
+func (s *APIServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn serves sequential calls on a single connection.
+func (s *APIServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	cred := peerCredentials(conn)
+	rd := bufio.NewReader(conn)
+	for {
+		msg, err := rd.ReadBytes(0)
+		if err != nil {
+			return
+		}
+		var call apiCall
+		reply := apiReply{Parameters: struct{}{}}
+		if err := json.Unmarshal(msg[:len(msg)-1], &call); err != nil {
+			return
+		}
+
+		params, err := s.dispatch(call, cred)
+		if err != nil {
+			reply.Error, reply.Parameters = apiErrorReply(err)
+		} else if params != nil {
+			reply.Parameters = params
+		}
+		if call.Oneway {
+			continue
+		}
+		out, err := json.Marshal(reply)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(append(out, 0)); err != nil {
+			return
+		}
+	}
+}
+
+// dispatch routes a call to its handler, enforcing the policy.
+func (s *APIServer) dispatch(call apiCall, cred *unix.Ucred) (interface{}, error) {
+	logFields := logrus.Fields{
+		"method": call.Method,
+	}
+	if cred != nil {
+		logFields["uid"] = cred.Uid
+		logFields["pid"] = cred.Pid
+	}
+
+	switch call.Method {
+	case "org.varlink.service.GetInfo":
+		return map[string]interface{}{
+			"vendor":     "Flatcar",
+			"product":    "torcx",
+			"version":    "1",
+			"url":        "https://github.com/flatcar-linux/torcx",
+			"interfaces": []string{"org.varlink.service", APIInterface},
+		}, nil
+	case "org.varlink.service.GetInterfaceDescription":
+		var req struct {
+			Interface string `json:"interface"`
+		}
+		if err := json.Unmarshal(orEmpty(call.Parameters), &req); err != nil || req.Interface != APIInterface {
+			return nil, &apiError{"org.varlink.service.InterfaceNotFound", map[string]string{"interface": req.Interface}}
+		}
+		return map[string]string{"description": apiInterfaceDescription}, nil
+	}
+
+	if !strings.HasPrefix(call.Method, APIInterface+".") {
+		return nil, &apiError{"org.varlink.service.InterfaceNotFound", map[string]string{"interface": call.Method}}
+	}
+	name := strings.TrimPrefix(call.Method, APIInterface+".")
+	method, ok := apiMethods[name]
+	if !ok {
+		return nil, &apiError{"org.varlink.service.MethodNotFound", map[string]string{"method": call.Method}}
+	}
+	if call.More {
+		return nil, &apiError{"org.varlink.service.MethodNotImplemented", map[string]string{"method": call.Method}}
+	}
+	if method.write && !s.Policy.canWrite(cred) {
+		logrus.WithFields(logFields).Warn("API call denied")
+		return nil, &apiError{APIInterface + ".PermissionDenied", struct{}{}}
+	}
+
+	logrus.WithFields(logFields).Debug("API call")
+	return method.handler(s, orEmpty(call.Parameters))
+}
+
+// apiErrorReply converts a handler error to a varlink error reply.
+func apiErrorReply(err error) (string, interface{}) {
+	if e, ok := errors.Cause(err).(*apiError); ok {
+		return e.Name, e.Parameters
+	}
+	return APIInterface + ".Failed", map[string]string{"message": err.Error()}
+}
+
+// orEmpty returns an empty JSON object for missing parameters.
+func orEmpty(params json.RawMessage) json.RawMessage {
+	if len(params) == 0 {
+		return json.RawMessage("{}")
+	}
+	return params
+}
+
+// peerCredentials returns the credentials of the process at the other end
+// of a unix socket, or nil if unavailable.
+func peerCredentials(conn net.Conn) *unix.Ucred {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var cred *unix.Ucred
+	_ = raw.Control(func(fd uintptr) {
+		cred, _ = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	return cred
+}
+
+// invalidParameter returns a varlink InvalidParameter error.
+func invalidParameter(name string) error {
+	return &apiError{"org.varlink.service.InvalidParameter", map[string]string{"parameter": name}}
+}
+
+// decodeProfileName decodes and validates a `name` parameter.
+func decodeProfileName(params json.RawMessage) (string, error) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(params, &req); err != nil || !profileNameRegexp.MatchString(req.Name) {
+		return "", invalidParameter("name")
+	}
+	return req.Name, nil
+}
+
+// decodeImages converts API images to internal ones, validating them.
+func decodeImages(in []apiImage) ([]Image, error) {
+	images := make([]Image, 0, len(in))
+	for _, im := range in {
+		if im.Name == "" || im.Reference == "" {
+			return nil, invalidParameter("images")
+		}
+		images = append(images, Image{Name: im.Name, Reference: im.Reference, Remote: im.Remote})
+	}
+	return images, nil
+}
+
+// encodeImages converts internal images to API ones.
+func encodeImages(images []Image) []apiImage {
+	out := make([]apiImage, 0, len(images))
+	for _, im := range images {
+		out = append(out, apiImage{im.Name, im.Reference, im.Remote})
+	}
+	return out
+}
+
+func (s *APIServer) getStatus(params json.RawMessage) (interface{}, error) {
+	status := map[string]interface{}{"sealed": false}
+	if next, err := s.Config.NextProfileName(); err == nil {
+		status["next_profile"] = next
+	}
+	upper, lower, err := CurrentProfileNames()
+	if err != nil {
+		return status, nil
+	}
+	status["sealed"] = true
+	status["upper_profile"] = upper
+	status["lower_profiles"] = lower
+	if path, err := CurrentProfilePath(); err == nil {
+		status["profile_path"] = path
+		if images, err := ReadProfilePath(path); err == nil {
+			status["images"] = encodeImages(images)
+		}
+	}
+	return status, nil
+}
+
+func (s *APIServer) listImages(params json.RawMessage) (interface{}, error) {
+	storeCache, err := NewStoreCache(s.Config.StorePaths)
+	if err != nil {
+		return nil, err
+	}
+	type archive struct {
+		Name      string        `json:"name"`
+		Reference string        `json:"reference"`
+		Filepath  string        `json:"filepath"`
+		Format    ArchiveFormat `json:"format"`
+	}
+	archives := []archive{}
+	for _, ar := range storeCache.Images {
+		archives = append(archives, archive{ar.Name, ar.Reference, ar.Filepath, ar.Format})
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		if archives[i].Name != archives[j].Name {
+			return archives[i].Name < archives[j].Name
+		}
+		return CompareVersions(archives[i].Reference, archives[j].Reference) < 0
+	})
+	return map[string]interface{}{"archives": archives}, nil
+}
+
+func (s *APIServer) listProfiles(params json.RawMessage) (interface{}, error) {
+	profiles, err := ListProfiles(s.Config.ProfileDirs())
+	if err != nil {
+		return nil, err
+	}
+	type profile struct {
+		Name string `json:"name"`
+		Path string `json:"path"`
+	}
+	out := []profile{}
+	for name, path := range profiles {
+		out = append(out, profile{name, path})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return map[string]interface{}{"profiles": out}, nil
+}
+
+func (s *APIServer) getProfile(params json.RawMessage) (interface{}, error) {
+	name, err := decodeProfileName(params)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := ListProfiles(s.Config.ProfileDirs())
+	if err != nil {
+		return nil, err
+	}
+	path, ok := profiles[name]
+	if !ok {
+		return nil, &apiError{APIInterface + ".NotFound", map[string]string{"name": name}}
+	}
+	images, err := ReadProfilePath(path)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"images": encodeImages(images)}, nil
+}
+
+func (s *APIServer) putProfile(params json.RawMessage) (interface{}, error) {
+	name, err := decodeProfileName(params)
+	if err != nil {
+		return nil, err
+	}
+	var req struct {
+		Images []apiImage `json:"images"`
+	}
+	if err := json.Unmarshal(params, &req); err != nil {
+		return nil, invalidParameter("images")
+	}
+	images, err := decodeImages(req.Images)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(s.Config.UserProfileDir(), 0755); err != nil {
+		return nil, err
+	}
+	_, err = writeProfileV1(filepath.Join(s.Config.UserProfileDir(), name+".json"), images)
+	return nil, err
+}
+
+func (s *APIServer) deleteProfile(params json.RawMessage) (interface{}, error) {
+	name, err := decodeProfileName(params)
+	if err != nil {
+		return nil, err
+	}
+	// Only user profiles can be removed.
+	err = os.Remove(filepath.Join(s.Config.UserProfileDir(), name+".json"))
+	if os.IsNotExist(err) {
+		return nil, &apiError{APIInterface + ".NotFound", map[string]string{"name": name}}
+	}
+	return nil, err
+}
+
+func (s *APIServer) setNextProfile(params json.RawMessage) (interface{}, error) {
+	name, err := decodeProfileName(params)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := ListProfiles(s.Config.ProfileDirs())
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := profiles[name]; !ok {
+		return nil, &apiError{APIInterface + ".NotFound", map[string]string{"name": name}}
+	}
+	return nil, s.Config.SetNextProfileName(name)
+}
+
+func (s *APIServer) fetchImages(params json.RawMessage) (interface{}, error) {
+	var req struct {
+		Images []apiImage `json:"images"`
+	}
+	if err := json.Unmarshal(params, &req); err != nil {
+		return nil, invalidParameter("images")
+	}
+	images, err := decodeImages(req.Images)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiFetchTimeout)
+	defer cancel()
+	return nil, fetchMissingImages(ctx, s.Config, images)
+}
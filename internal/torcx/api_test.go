@@ -0,0 +1,136 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// apiTestCall performs a varlink call on `conn`, returning the reply.
+func apiTestCall(t *testing.T, conn net.Conn, rd *bufio.Reader, method string, params interface{}) map[string]interface{} {
+	msg, err := json.Marshal(map[string]interface{}{"method": method, "parameters": params})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(append(msg, 0)); err != nil {
+		t.Fatal(err)
+	}
+	out, err := rd.ReadBytes(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := map[string]interface{}{}
+	if err := json.Unmarshal(out[:len(out)-1], &reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestAPIServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_api_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cc := &CommonConfig{
+		BaseDir: filepath.Join(dir, "base"),
+		RunDir:  filepath.Join(dir, "run"),
+		ConfDir: filepath.Join(dir, "conf"),
+		UsrDir:  filepath.Join(dir, "usr"),
+	}
+	// The test runs as the socket owner, thus allowed to write.
+	server := &APIServer{Config: cc, Policy: APIPolicy{WriteUIDs: []uint32{uint32(os.Getuid())}}}
+	l, err := ListenAPISocket(filepath.Join(cc.RunDir, "api.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go server.Serve(l)
+
+	conn, err := net.Dial("unix", filepath.Join(cc.RunDir, "api.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+
+	reply := apiTestCall(t, conn, rd, "org.flatcar.torcx.PutProfile", map[string]interface{}{
+		"name":   "p",
+		"images": []map[string]string{{"name": "foo", "reference": "1"}},
+	})
+	if reply["error"] != nil {
+		t.Fatalf("unexpected error %v", reply)
+	}
+	reply = apiTestCall(t, conn, rd, "org.flatcar.torcx.GetProfile", map[string]string{"name": "p"})
+	images, ok := reply["parameters"].(map[string]interface{})["images"].([]interface{})
+	if !ok || len(images) != 1 || images[0].(map[string]interface{})["name"] != "foo" {
+		t.Errorf("unexpected profile %v", reply)
+	}
+	reply = apiTestCall(t, conn, rd, "org.flatcar.torcx.SetNextProfile", map[string]string{"name": "p"})
+	if reply["error"] != nil {
+		t.Fatalf("unexpected error %v", reply)
+	}
+	if next, err := cc.NextProfileName(); err != nil || next != "p" {
+		t.Errorf("unexpected next profile %q %v", next, err)
+	}
+
+	for _, tt := range []struct {
+		method string
+		params interface{}
+		exp    string
+	}{
+		{"org.flatcar.torcx.GetProfile", map[string]string{"name": "missing"}, "org.flatcar.torcx.NotFound"},
+		{"org.flatcar.torcx.PutProfile", map[string]string{"name": "../p"}, "org.varlink.service.InvalidParameter"},
+		{"org.flatcar.torcx.Reboot", nil, "org.varlink.service.MethodNotFound"},
+		{"org.example.Other", nil, "org.varlink.service.InterfaceNotFound"},
+	} {
+		reply = apiTestCall(t, conn, rd, tt.method, tt.params)
+		if reply["error"] != tt.exp {
+			t.Errorf("%s: expected error %s, got %v", tt.method, tt.exp, reply)
+		}
+	}
+
+	reply = apiTestCall(t, conn, rd, "org.varlink.service.GetInterfaceDescription", map[string]string{"interface": APIInterface})
+	if reply["error"] != nil {
+		t.Errorf("unexpected error %v", reply)
+	}
+}
+
+func TestAPIPolicy(t *testing.T) {
+	policy := APIPolicy{WriteUIDs: []uint32{1000}, WriteGIDs: []uint32{10}}
+	for _, tt := range []struct {
+		cred *unix.Ucred
+		exp  bool
+	}{
+		{nil, false},
+		{&unix.Ucred{Uid: 0, Gid: 0}, true},
+		{&unix.Ucred{Uid: 1000, Gid: 1000}, true},
+		{&unix.Ucred{Uid: 1001, Gid: 10}, true},
+		{&unix.Ucred{Uid: 1001, Gid: 1001}, false},
+	} {
+		if got := policy.canWrite(tt.cred); got != tt.exp {
+			t.Errorf("credentials %+v: expected %t, got %t", tt.cred, tt.exp, got)
+		}
+	}
+}
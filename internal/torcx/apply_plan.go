@@ -0,0 +1,227 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ApplyPlanV0K - apply plan kind, v0
+const ApplyPlanV0K = "torcx-apply-plan-v0"
+
+// ErrPlanDiverged is returned when the state of the system does not match
+// an apply plan anymore.
+var ErrPlanDiverged = errors.New("system diverged from apply plan")
+
+// ApplyPlan is a deterministic record of what an apply would do: the
+// profiles in use, the exact archives applied and the assets propagated.
+type ApplyPlan struct {
+	LowerProfiles []string       `json:"lower_profiles"`
+	UpperProfile  string         `json:"upper_profile"`
+	Images        []PlannedImage `json:"images"`
+	Entries       []PlanEntry    `json:"entries"`
+}
+
+// PlannedImage is an archive which would be applied.
+type PlannedImage struct {
+	Name      string        `json:"name"`
+	Reference string        `json:"reference"`
+	Filepath  string        `json:"filepath"`
+	Format    ArchiveFormat `json:"format"`
+	Hash      string        `json:"hash"`
+}
+
+// ApplyPlanV0JSON is the JSON record of an apply plan.
+type ApplyPlanV0JSON struct {
+	Kind  string    `json:"kind"`
+	Value ApplyPlan `json:"value"`
+}
+
+// NewApplyPlan computes, without unpacking nor mounting archives, the plan
+// for applying the profile of the given configuration. All images must be
+// available, as a plan can not be partial.
+func NewApplyPlan(applyCfg *ApplyConfig) (*ApplyPlan, error) {
+	pp, err := PlanPropagation(applyCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &ApplyPlan{
+		LowerProfiles: applyCfg.LowerProfiles,
+		UpperProfile:  applyCfg.UpperProfile,
+		Images:        []PlannedImage{},
+		Entries:       pp.Entries,
+	}
+	if plan.LowerProfiles == nil {
+		plan.LowerProfiles = []string{}
+	}
+	for _, node := range pp.Images {
+		if node.Error != "" && node.Error != ErrInspectUnsupported.Error() {
+			return nil, errors.Errorf("image %s:%s: %s", node.Name, node.Reference, node.Error)
+		}
+		hash, err := computeHash(node.Filepath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to hash %s", node.Filepath)
+		}
+		plan.Images = append(plan.Images, PlannedImage{
+			Name:      node.Name,
+			Reference: node.Reference,
+			Filepath:  node.Filepath,
+			Format:    node.Format,
+			Hash:      hash,
+		})
+	}
+	return plan, nil
+}
+
+// Diff returns the differences from `plan` to `actual`, if any.
+func (plan *ApplyPlan) Diff(actual *ApplyPlan) []string {
+	diffs := []string{}
+	if !reflect.DeepEqual(plan.LowerProfiles, actual.LowerProfiles) {
+		diffs = append(diffs, fmt.Sprintf("lower profiles: planned %v, got %v", plan.LowerProfiles, actual.LowerProfiles))
+	}
+	if plan.UpperProfile != actual.UpperProfile {
+		diffs = append(diffs, fmt.Sprintf("upper profile: planned %q, got %q", plan.UpperProfile, actual.UpperProfile))
+	}
+
+	planned := make(map[string]PlannedImage, len(plan.Images))
+	for _, pi := range plan.Images {
+		planned[pi.Name] = pi
+	}
+	for _, ai := range actual.Images {
+		pi, ok := planned[ai.Name]
+		delete(planned, ai.Name)
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("image %s:%s: not planned", ai.Name, ai.Reference))
+		case pi != ai:
+			diffs = append(diffs, fmt.Sprintf("image %s: planned %s:%s (%s), got %s:%s (%s)", ai.Name, pi.Reference, pi.Filepath, pi.Hash, ai.Reference, ai.Filepath, ai.Hash))
+		}
+	}
+	for _, pi := range plan.Images {
+		if _, ok := planned[pi.Name]; ok {
+			diffs = append(diffs, fmt.Sprintf("image %s:%s: missing", pi.Name, pi.Reference))
+		}
+	}
+
+	if !reflect.DeepEqual(plan.Entries, actual.Entries) {
+		diffs = append(diffs, "propagated assets differ")
+	}
+	return diffs
+}
+
+// WriteApplyPlan atomically writes `plan` as a JSON record at `path`.
+func WriteApplyPlan(path string, plan *ApplyPlan) error {
+	tmpPath := path + ".tmp"
+	fp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer fp.Close()
+	bufwr := bufio.NewWriter(fp)
+	enc := json.NewEncoder(bufwr)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(ApplyPlanV0JSON{ApplyPlanV0K, *plan}); err != nil {
+		return errors.Wrapf(err, "writing %q", path)
+	}
+	if err := bufwr.Flush(); err != nil {
+		return errors.Wrapf(err, "writing %q", path)
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ReadApplyPlan reads the apply plan record at `path`.
+func ReadApplyPlan(path string) (*ApplyPlan, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var record ApplyPlanV0JSON
+	if err := json.NewDecoder(bufio.NewReader(fp)).Decode(&record); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s", path)
+	}
+	if record.Kind != ApplyPlanV0K {
+		return nil, errors.Errorf("invalid apply plan kind: %s", record.Kind)
+	}
+	return &record.Value, nil
+}
+
+// checkPlan ensures the plan for `applyCfg` (with the planned upper
+// profile) exactly matches `plan`.
+func checkPlan(applyCfg *ApplyConfig, plan *ApplyPlan) error {
+	actual, err := NewApplyPlan(applyCfg)
+	if err != nil {
+		return errors.Wrap(ErrPlanDiverged, err.Error())
+	}
+	if diffs := plan.Diff(actual); len(diffs) > 0 {
+		for _, d := range diffs {
+			logrus.WithField("plan", "diverged").Error(d)
+		}
+		return errors.Wrapf(ErrPlanDiverged, "%d differences", len(diffs))
+	}
+	return nil
+}
+
+// ApproveApplyPlan verifies that `plan` still matches the system, then
+// selects its upper profile for next boot and records it as the approved
+// plan, which the next apply executes exactly or refuses.
+func ApproveApplyPlan(applyCfg *ApplyConfig, plan *ApplyPlan) error {
+	if applyCfg == nil {
+		return errors.New("missing apply configuration")
+	}
+	cfg := *applyCfg
+	cfg.UpperProfile = plan.UpperProfile
+	if err := checkPlan(&cfg, plan); err != nil {
+		return err
+	}
+	if plan.UpperProfile != "" {
+		if err := applyCfg.SetNextProfileName(plan.UpperProfile); err != nil {
+			return errors.Wrap(err, "could not write profile file")
+		}
+	}
+	return WriteApplyPlan(applyCfg.ApprovedPlan(), plan)
+}
+
+// executeApprovedPlan ensures an apply matches the approved plan, if any,
+// consuming it. Without an approved plan, all applies are allowed.
+func executeApprovedPlan(applyCfg *ApplyConfig) error {
+	path := applyCfg.ApprovedPlan()
+	plan, err := ReadApplyPlan(path)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	if err := checkPlan(applyCfg, plan); err != nil {
+		return errors.Wrapf(err, "approved plan %s", path)
+	}
+	logrus.WithField("path", path).Info("executing approved apply plan")
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestApplyPlan(t *testing.T) {
+	dir := t.TempDir()
+	storeDir := filepath.Join(dir, "store")
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(storeDir, "foo:1.torcx.tgz")
+	writeTestTgz(t, archive, map[string]string{
+		".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/foo"]}}`,
+		"bin/foo":              "foo",
+	})
+
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			RunDir:     filepath.Join(dir, "run"),
+			ConfDir:    filepath.Join(dir, "conf"),
+			UsrDir:     filepath.Join(dir, "usr"),
+			StorePaths: []string{storeDir},
+		},
+		UpperProfile: "user",
+	}
+	profileDir := applyCfg.UserProfileDir()
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	profile := `{"kind": "profile-manifest-v1", "value": {"images": [{"name": "foo", "reference": "1"}]}}`
+	if err := ioutil.WriteFile(filepath.Join(profileDir, "user.json"), []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := NewApplyPlan(applyCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Images) != 1 || plan.Images[0].Filepath != archive || plan.Images[0].Hash == "" {
+		t.Fatalf("unexpected planned images %v", plan.Images)
+	}
+	if len(plan.Entries) != 1 || plan.Entries[0].Destination != filepath.Join(applyCfg.RunBinDir(), "foo") {
+		t.Fatalf("unexpected planned entries %v", plan.Entries)
+	}
+
+	planPath := filepath.Join(dir, "plan.json")
+	if err := WriteApplyPlan(planPath, plan); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadApplyPlan(planPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := read.Diff(plan); len(diffs) != 0 {
+		t.Errorf("unexpected differences after round-trip: %v", diffs)
+	}
+
+	if err := ApproveApplyPlan(applyCfg, read); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := applyCfg.NextProfileName(); err != nil || name != "user" {
+		t.Errorf("unexpected next profile %q (%v)", name, err)
+	}
+	if err := executeApprovedPlan(applyCfg); err != nil {
+		t.Errorf("unexpected error executing plan: %s", err)
+	}
+	if IsExistingPath(applyCfg.ApprovedPlan()) {
+		t.Error("approved plan not consumed")
+	}
+
+	// Replacing the archive makes the plan diverge.
+	if err := WriteApplyPlan(applyCfg.ApprovedPlan(), plan); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTgz(t, archive, map[string]string{
+		".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/bar"]}}`,
+		"bin/bar":              "bar",
+	})
+	if err := executeApprovedPlan(applyCfg); errors.Cause(err) != ErrPlanDiverged {
+		t.Errorf("expected ErrPlanDiverged, got %v", err)
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// ArchiveMetaV0K - archive metadata sidecar kind, v0
+	ArchiveMetaV0K = "torcx-archive-meta-v0"
+	// metaSidecarSuffix is appended to archive paths for their metadata sidecar.
+	metaSidecarSuffix = ".meta"
+)
+
+// ArchiveMeta makes a lone archive file self-describing: it carries the
+// archive digest, image manifest and detached signature, so that the
+// archive can be verified without a remote contents manifest.
+type ArchiveMeta struct {
+	// Hash is the archive hash (e.g. "sha512-<hex>").
+	Hash string `json:"hash"`
+	// Manifest is the image manifest embedded in the archive, if known.
+	Manifest *Assets `json:"manifest,omitempty"`
+	// Signature is the armored detached signature of the archive, if any.
+	Signature string `json:"signature,omitempty"`
+}
+
+// ArchiveMetaV0JSON is the JSON record of an archive metadata sidecar.
+type ArchiveMetaV0JSON struct {
+	Kind  string      `json:"kind"`
+	Value ArchiveMeta `json:"value"`
+}
+
+// NewArchiveMeta computes the metadata of the archive file at `path`,
+// including the detached signature at `sigPath` if it exists.
+func NewArchiveMeta(path string, sigPath string) (*ArchiveMeta, error) {
+	ar, err := archiveAt(path)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := computeHash(ar.Filepath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to hash %s", ar.Filepath)
+	}
+	meta := &ArchiveMeta{
+		Hash: hash,
+	}
+
+	md, err := ReadArchiveMetadata(ar)
+	switch {
+	case err == nil:
+		meta.Manifest = &md.Assets
+	case err != ErrInspectUnsupported:
+		return nil, err
+	}
+
+	if sigPath != "" {
+		sig, err := ioutil.ReadFile(sigPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		meta.Signature = string(sig)
+	}
+	return meta, nil
+}
+
+// WriteArchiveMeta atomically writes `meta` as the metadata sidecar of
+// the archive at `archivePath`.
+func WriteArchiveMeta(archivePath string, meta *ArchiveMeta) error {
+	b, err := json.MarshalIndent(ArchiveMetaV0JSON{ArchiveMetaV0K, *meta}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := archivePath + metaSidecarSuffix
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".meta")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName)
+	if _, err := tmpFile.Write(append(b, '\n')); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
+
+// ReadArchiveMeta reads the metadata sidecar of the archive at `archivePath`.
+func ReadArchiveMeta(archivePath string) (*ArchiveMeta, error) {
+	b, err := ioutil.ReadFile(archivePath + metaSidecarSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return decodeArchiveMeta(b)
+}
+
+// decodeArchiveMeta decodes an archive metadata record.
+func decodeArchiveMeta(b []byte) (*ArchiveMeta, error) {
+	var record ArchiveMetaV0JSON
+	if err := json.Unmarshal(b, &record); err != nil {
+		return nil, errors.Wrap(err, "failed to decode archive metadata")
+	}
+	if record.Kind != ArchiveMetaV0K {
+		return nil, errors.Errorf("invalid archive metadata kind: %s", record.Kind)
+	}
+	if record.Value.Hash == "" {
+		return nil, errors.New("archive metadata without hash")
+	}
+	return &record.Value, nil
+}
+
+// fetchArchiveMeta fetches the metadata sidecar published next to the
+// archive for `im`, on a best-effort basis: remotes are not required to
+// publish one, so nil is returned if it can not be fetched or decoded.
+func (rc *RemotesCache) fetchArchiveMeta(ctx context.Context, im Image, baseURL *url.URL, location *url.URL) *ArchiveMeta {
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil
+	}
+	remote := rc.Configs[im.Remote]
+	b, err := fetchPublished(ctx, remote.httpClient(), baseURL, location.String()+metaSidecarSuffix)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"name":      im.Name,
+			"reference": im.Reference,
+			"error":     err,
+		}).Debug("no published archive metadata")
+		return nil
+	}
+	meta, err := decodeArchiveMeta(b)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"name":      im.Name,
+			"reference": im.Reference,
+			"error":     err,
+		}).Warn("ignoring invalid archive metadata")
+		return nil
+	}
+	return meta
+}
+
+// checkSignature checks the embedded signature of the archive at `path`
+// against `keyrings`, returning the signer.
+func (meta *ArchiveMeta) checkSignature(path string, keyrings []openpgp.KeyRing) (*openpgp.Entity, error) {
+	if meta.Signature == "" {
+		return nil, errors.Errorf("%s is not signed", path)
+	}
+	var lastErr error
+	for _, keyring := range keyrings {
+		fp, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := checkArmoredSignature(keyring, bufio.NewReader(fp), strings.NewReader(meta.Signature), nil)
+		fp.Close()
+		if err == nil {
+			return signer, nil
+		}
+		lastErr = preferSignatureError(lastErr, err)
+	}
+	return nil, errors.Wrapf(lastErr, "verifying signature of %s", path)
+}
+
+// verifyFetched checks metadata published by a remote against the archive
+// fetched at `path`: the embedded signature must be valid for `keyrings`,
+// and the hash must match. Until then, its hash can not be trusted.
+func (meta *ArchiveMeta) verifyFetched(path string, keyrings []openpgp.KeyRing) error {
+	if len(keyrings) == 0 {
+		return errors.New("no keys to verify signature")
+	}
+	if _, err := meta.checkSignature(path, keyrings); err != nil {
+		return err
+	}
+	valid, err := validateHash(path, meta.Hash)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errors.Errorf("mismatching hash for %s", path)
+	}
+	return nil
+}
+
+// VerifyArchiveFile checks the archive file at `path` against its detached
+// signature at `sigPath` (default: the `.asc` sidecar) or, if there is no
+// such file, against its metadata sidecar: the hash is checked, then the
+// embedded signature. Detached signatures may be countersigned by a
+// timestamp token from `authorities`. It returns the signer.
+func VerifyArchiveFile(path string, sigPath string, keyrings []openpgp.KeyRing, authorities *x509.CertPool) (*openpgp.Entity, error) {
+	if len(keyrings) == 0 {
+		return nil, errors.New("no keys to verify signature")
+	}
+	if sigPath != "" || IsExistingPath(path+signatureSidecarSuffix) {
+		if sigPath == "" {
+			sigPath = path + signatureSidecarSuffix
+		}
+		return VerifyDetachedSignature(path, sigPath, keyrings, authorities)
+	}
+
+	meta, err := ReadArchiveMeta(path)
+	if os.IsNotExist(err) {
+		return nil, errors.Errorf("%s is not signed", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	valid, err := validateHash(path, meta.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, errors.Errorf("mismatching hash for %s", path)
+	}
+	return meta.checkSignature(path, keyrings)
+}
+
+// ImportArchive copies the self-describing archive at `path` into the user
+// store, after verifying it against its metadata sidecar. With `keyrings`,
+// or if the signature policy requires it, its embedded signature must also
+// be valid. It returns the imported archive.
+func ImportArchive(cc *CommonConfig, path string, keyrings []openpgp.KeyRing) (Archive, error) {
+	return ImportArchiveInto(cc, path, "", keyrings)
+}
+
+// ImportArchiveInto is ImportArchive, importing into namespace `ns` of the
+// user store if not empty. Namespaces with their own trusted keys require
+// a signature by one of them, unless `keyrings` are given.
+func ImportArchiveInto(cc *CommonConfig, path string, ns string, keyrings []openpgp.KeyRing) (Archive, error) {
+	ar, err := archiveAt(path)
+	if err != nil {
+		return Archive{}, err
+	}
+	meta, err := ReadArchiveMeta(path)
+	if err != nil {
+		return Archive{}, errors.Wrapf(err, "reading metadata for %s", path)
+	}
+
+	if ns != "" {
+		if err := ValidateNamespace(ns); err != nil {
+			return Archive{}, err
+		}
+		ar.Name = ns + namespaceSeparator + ar.Name
+		if len(keyrings) == 0 {
+			keys, err := cc.LoadNamespaceKeys(ns)
+			if err != nil {
+				return Archive{}, err
+			}
+			if len(keys) > 0 {
+				keyrings = []openpgp.KeyRing{keys}
+			}
+		}
+	}
+	if len(keyrings) == 0 && cc.signaturesRequired() {
+		keys, err := cc.LoadTrustedKeys()
+		if err != nil {
+			return Archive{}, err
+		}
+		if len(keys) == 0 {
+			return Archive{}, errors.New("no trusted keys in the machine trust store")
+		}
+		keyrings = []openpgp.KeyRing{keys}
+	}
+	if len(keyrings) > 0 {
+		signer, err := meta.checkSignature(path, keyrings)
+		if err != nil {
+			return Archive{}, errors.Wrap(ErrArchiveUnverified, err.Error())
+		}
+		logrus.WithFields(logrus.Fields{
+			"path":   path,
+			"signer": signer.PrimaryKey.KeyIdString(),
+		}).Debug("archive signature verified")
+	}
+
+	storeDir := cc.UserStorePath("")
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		return Archive{}, err
+	}
+	if ns != "" {
+		if storeDir, err = CreateNamespace(storeDir, ns); err != nil {
+			return Archive{}, err
+		}
+	}
+	fileName := filepath.Base(ar.Filepath)
+	target := filepath.Join(storeDir, fileName)
+	if IsExistingPath(target) {
+		return Archive{}, errors.Errorf("archive %s already exists in the store", target)
+	}
+	tmpName := partialPath(storeDir, fileName, meta.Hash)
+	defer os.Remove(tmpName)
+	if err := copyFile(path, tmpName); err != nil {
+		return Archive{}, err
+	}
+	// The hash is verified before the archive is moved in place.
+	if err := installArchive(tmpName, target, meta.Hash, 0); err != nil {
+		return Archive{}, err
+	}
+	if err := WriteArchiveMeta(target, meta); err != nil {
+		return Archive{}, errors.Wrapf(err, "failed to record metadata for %s", target)
+	}
+	ar.Filepath = target
+	return ar, nil
+}
+
+// archiveAt returns the archive for the file at `path`, named as in stores.
+func archiveAt(path string) (Archive, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Archive{}, err
+	}
+	ar, ok := scanStoreEntry(filepath.Dir(path), fi)
+	if !ok {
+		return Archive{}, errors.Errorf("%s is not an image archive", path)
+	}
+	return ar, nil
+}
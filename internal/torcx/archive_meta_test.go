@@ -0,0 +1,126 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestArchiveMetaImport(t *testing.T) {
+	dir := t.TempDir()
+	cc := &CommonConfig{
+		BaseDir: filepath.Join(dir, "var"),
+		ConfDir: filepath.Join(dir, "etc"),
+	}
+	origLockdown := LockdownPath
+	defer func() { LockdownPath = origLockdown }()
+	LockdownPath = filepath.Join(dir, "lockdown")
+
+	srcPath := filepath.Join(dir, "foo:1.torcx.tgz")
+	writeTestTgz(t, srcPath, map[string]string{
+		".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/foo"]}}`,
+		"bin/foo":              "foo",
+	})
+	signer := writeTrustedKey(t, filepath.Join(dir, "key.asc"))
+	signTestArchive(t, Archive{Image{Name: "foo", Reference: "1"}, srcPath, ArchiveFormatTgz}, signer)
+
+	meta, err := NewArchiveMeta(srcPath, srcPath+signatureSidecarSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Manifest == nil || len(meta.Manifest.Binaries) != 1 || meta.Signature == "" {
+		t.Fatalf("incomplete metadata: %+v", meta)
+	}
+	if err := WriteArchiveMeta(srcPath, meta); err != nil {
+		t.Fatal(err)
+	}
+	// The embedded signature is used once the detached one is gone.
+	if err := os.Remove(srcPath + signatureSidecarSuffix); err != nil {
+		t.Fatal(err)
+	}
+	keyrings := []openpgp.KeyRing{openpgp.EntityList{signer}}
+	if _, err := VerifyArchiveFile(srcPath, "", keyrings, nil); err != nil {
+		t.Fatalf("verifying with metadata: %s", err)
+	}
+
+	ar, err := ImportArchive(cc, srcPath, keyrings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(cc.UserStorePath(""), "foo:1.torcx.tgz"); ar.Filepath != expected {
+		t.Errorf("expected %s, got %s", expected, ar.Filepath)
+	}
+	if imported, err := ReadArchiveMeta(ar.Filepath); err != nil || imported.Hash != meta.Hash {
+		t.Errorf("metadata not recorded for imported archive: %v", err)
+	}
+	if err := verifyArchive(ar); err != nil {
+		t.Errorf("imported archive not verified: %s", err)
+	}
+	if _, err := ImportArchive(cc, srcPath, keyrings); err == nil {
+		t.Error("expected error importing an existing archive")
+	}
+
+	if err := ioutil.WriteFile(srcPath, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyArchiveFile(srcPath, "", keyrings, nil); err == nil {
+		t.Error("expected hash mismatch for tampered archive")
+	}
+}
+
+func TestArchiveMetaVerifyFetched(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo:1.torcx.tgz")
+	writeTestTgz(t, path, map[string]string{
+		"bin/foo": "foo",
+	})
+	signer := writeTrustedKey(t, filepath.Join(dir, "key.asc"))
+	other := writeTrustedKey(t, filepath.Join(dir, "other.asc"))
+	signTestArchive(t, Archive{Image{Name: "foo", Reference: "1"}, path, ArchiveFormatTgz}, signer)
+	meta, err := NewArchiveMeta(path, path+signatureSidecarSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyrings := []openpgp.KeyRing{openpgp.EntityList{signer}}
+
+	if err := meta.verifyFetched(path, keyrings); err != nil {
+		t.Fatalf("verifying signed metadata: %s", err)
+	}
+
+	unsigned := *meta
+	unsigned.Signature = ""
+	forged := *meta
+	forged.Hash = "sha512-00"
+	tests := []struct {
+		desc     string
+		meta     ArchiveMeta
+		keyrings []openpgp.KeyRing
+	}{
+		{"no keyrings", *meta, nil},
+		{"untrusted signer", *meta, []openpgp.KeyRing{openpgp.EntityList{other}}},
+		{"unsigned", unsigned, keyrings},
+		{"mismatching hash", forged, keyrings},
+	}
+	for _, tt := range tests {
+		if err := tt.meta.verifyFetched(path, tt.keyrings); err == nil {
+			t.Errorf("testcase %q failed, expected error", tt.desc)
+		}
+	}
+}
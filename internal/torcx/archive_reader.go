@@ -0,0 +1,359 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+)
+
+// squashfsListRoot is the destination prefix of unsquashfs listings.
+const squashfsListRoot = "squashfs-root"
+
+// ArchiveEntry is an entry of an image archive.
+type ArchiveEntry struct {
+	// Path is the absolute path of the entry in the image.
+	Path string `json:"path"`
+	// Mode holds the entry type and permission bits.
+	Mode os.FileMode `json:"mode"`
+	// Size is the size of regular files.
+	Size int64 `json:"size"`
+	// Linkname is the target of symlinks.
+	Linkname string `json:"linkname,omitempty"`
+}
+
+// ArchiveReader reads an image archive without unpacking nor mounting it.
+type ArchiveReader interface {
+	// Entries lists all entries of the archive, in archive order.
+	Entries() ([]ArchiveEntry, error)
+	// ReadFile returns the content of the regular file at the absolute
+	// `path` in the image. Missing files have an os.ErrNotExist cause.
+	ReadFile(path string) ([]byte, error)
+}
+
+// OpenArchive returns a reader for `ar`, based on its format. Reading
+// squashfs archives requires unsquashfs, and erofs ones fsck.erofs:
+// ErrInspectUnsupported is returned if they are not available.
+func OpenArchive(ar Archive) (ArchiveReader, error) {
+	if _, err := os.Stat(ar.Filepath); err != nil {
+		return nil, err
+	}
+	switch ar.Format {
+	case ArchiveFormatTgz, ArchiveFormatZst, ArchiveFormatTxz:
+		return tarballReader{ar.Filepath}, nil
+	case ArchiveFormatSquashfs:
+		if _, err := exec.LookPath(unsquashfsBinary); err != nil {
+			return nil, ErrInspectUnsupported
+		}
+		return squashfsReader{ar.Filepath}, nil
+	case ArchiveFormatErofs:
+		if _, err := exec.LookPath(fsckErofsBinary); err != nil {
+			return nil, ErrInspectUnsupported
+		}
+		return erofsReader{ar.Filepath}, nil
+	}
+	return nil, errors.Errorf("unrecognized format for archive: %q", ar.Format)
+}
+
+// tarballReader reads tgz, zst and txz archives, scanning the stream for
+// each operation.
+type tarballReader struct {
+	path string
+}
+
+// walk calls `fn` with each tar entry of the archive, until it returns
+// false or an error.
+func (r tarballReader) walk(fn func(*tar.Header, io.Reader) (bool, error)) error {
+	fp, err := os.Open(r.path)
+	if err != nil {
+		return errors.Wrapf(err, "opening %q", r.path)
+	}
+	defer fp.Close()
+
+	dr, err := decompressTarball(r.path, bufio.NewReader(fp))
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "reading %q", r.path)
+		}
+		more, err := fn(hdr, tr)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+func (r tarballReader) Entries() ([]ArchiveEntry, error) {
+	entries := []ArchiveEntry{}
+	err := r.walk(func(hdr *tar.Header, _ io.Reader) (bool, error) {
+		entries = append(entries, ArchiveEntry{
+			Path:     filepath.Clean("/" + hdr.Name),
+			Mode:     hdr.FileInfo().Mode(),
+			Size:     hdr.Size,
+			Linkname: hdr.Linkname,
+		})
+		return true, nil
+	})
+	return entries, err
+}
+
+func (r tarballReader) ReadFile(path string) ([]byte, error) {
+	path = filepath.Clean("/" + path)
+	var content []byte
+	err := r.walk(func(hdr *tar.Header, tr io.Reader) (bool, error) {
+		if filepath.Clean("/"+hdr.Name) != path || hdr.Typeflag != tar.TypeReg {
+			return true, nil
+		}
+		b, err := ioutil.ReadAll(tr)
+		content = b
+		return false, err
+	})
+	if err == nil && content == nil {
+		err = errors.Wrapf(os.ErrNotExist, "%s not found in %q", path, r.path)
+	}
+	return content, err
+}
+
+// decompressTarball returns the tar stream of the tarball archive at
+// `path`, read from `r`: zst archives are zstd-compressed, txz ones
+// xz-compressed, others gzipped.
+func decompressTarball(path string, r io.Reader) (io.ReadCloser, error) {
+	switch archiveFormatOf(path) {
+	case ArchiveFormatZst:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case ArchiveFormatTxz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	}
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return gr, nil
+}
+
+// squashfsReader reads squashfs archives with unsquashfs.
+type squashfsReader struct {
+	path string
+}
+
+func (r squashfsReader) Entries() ([]ArchiveEntry, error) {
+	out, err := exec.Command(unsquashfsBinary, "-lls", "-d", squashfsListRoot, r.path).Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %q", r.path)
+	}
+	return parseSquashfsListing(out), nil
+}
+
+func (r squashfsReader) ReadFile(path string) ([]byte, error) {
+	path = filepath.Clean("/" + path)
+	tmpDir, err := ioutil.TempDir("", "torcx-peek")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Only the requested file is extracted.
+	target := filepath.Join(tmpDir, squashfsListRoot)
+	out, err := exec.Command(unsquashfsBinary, "-no-xattrs", "-f", "-d", target, r.path, path).CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s failed: %s", unsquashfsBinary, strings.TrimSpace(string(out)))
+	}
+	fi, err := os.Lstat(filepath.Join(target, path))
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil, errors.Wrapf(os.ErrNotExist, "%s not found in %q", path, r.path)
+	}
+	return ioutil.ReadFile(filepath.Join(target, path))
+}
+
+// erofsReader reads erofs archives, extracted with fsck.erofs as they
+// can not be listed without being mounted.
+type erofsReader struct {
+	path string
+}
+
+// extract extracts the archive into a temporary directory, returning the
+// image root along with a cleanup function.
+func (r erofsReader) extract() (string, func(), error) {
+	tmpDir, err := ioutil.TempDir("", "torcx-peek")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+	target := filepath.Join(tmpDir, "erofs-root")
+	if err := extractErofs(r.path, target); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return target, cleanup, nil
+}
+
+func (r erofsReader) Entries() ([]ArchiveEntry, error) {
+	root, cleanup, err := r.extract()
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %q", r.path)
+	}
+	defer cleanup()
+
+	entries := []ArchiveEntry{}
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		entry := ArchiveEntry{
+			Path: filepath.Clean("/" + strings.TrimPrefix(path, root)),
+			Mode: fi.Mode(),
+		}
+		if fi.Mode().IsRegular() {
+			entry.Size = fi.Size()
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			entry.Linkname, _ = os.Readlink(path)
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+func (r erofsReader) ReadFile(path string) ([]byte, error) {
+	path = filepath.Clean("/" + path)
+	root, cleanup, err := r.extract()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	fi, err := os.Lstat(filepath.Join(root, path))
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil, errors.Wrapf(os.ErrNotExist, "%s not found in %q", path, r.path)
+	}
+	return ioutil.ReadFile(filepath.Join(root, path))
+}
+
+// parseSquashfsListing parses a long unsquashfs listing, e.g.
+// "-rwxr-xr-x root/root 1234 2018-01-01 00:00 squashfs-root/bin/foo".
+// Lines not describing an entry (e.g. progress output) are skipped.
+func parseSquashfsListing(out []byte) []ArchiveEntry {
+	entries := []ArchiveEntry{}
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		idx := strings.Index(line, " "+squashfsListRoot)
+		if idx < 0 || len(line) < 10 {
+			continue
+		}
+		name := line[idx+1+len(squashfsListRoot):]
+		if name != "" && name[0] != '/' {
+			continue
+		}
+		entry := ArchiveEntry{Mode: parseModeString(line[:10])}
+		if entry.Mode&os.ModeSymlink != 0 {
+			if parts := strings.SplitN(name, " -> ", 2); len(parts) == 2 {
+				name, entry.Linkname = parts[0], parts[1]
+			}
+		}
+		entry.Path = filepath.Clean("/" + name)
+		if fields := strings.Fields(line[:idx]); len(fields) >= 3 && entry.Mode.IsRegular() {
+			entry.Size, _ = strconv.ParseInt(fields[2], 10, 64)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// parseModeString parses a ls-style mode string (e.g. "drwxr-xr-x").
+func parseModeString(s string) os.FileMode {
+	var mode os.FileMode
+	switch s[0] {
+	case 'd':
+		mode |= os.ModeDir
+	case 'l':
+		mode |= os.ModeSymlink
+	case 'c':
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case 'b':
+		mode |= os.ModeDevice
+	case 'p':
+		mode |= os.ModeNamedPipe
+	case 's':
+		mode |= os.ModeSocket
+	}
+	for i, c := range s[1:10] {
+		if c != '-' && c != 'S' && c != 'T' {
+			mode |= 1 << uint(8-i)
+		}
+	}
+	switch s[3] {
+	case 's', 'S':
+		mode |= os.ModeSetuid
+	}
+	switch s[6] {
+	case 's', 'S':
+		mode |= os.ModeSetgid
+	}
+	switch s[9] {
+	case 't', 'T':
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// OpenImage returns a reader for the local archive of `im`, resolving
+// version queries like InspectImage.
+func (cc *CommonConfig) OpenImage(im Image) (ArchiveReader, error) {
+	storeCache, err := NewStoreCache(cc.StorePaths)
+	if err != nil {
+		return nil, err
+	}
+	im, err = storeCache.ResolveVersion(im)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := storeCache.ArchiveFor(im)
+	if err != nil {
+		return nil, err
+	}
+	return OpenArchive(archive)
+}
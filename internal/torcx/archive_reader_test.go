@@ -0,0 +1,133 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestTgzArchiveReader(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo:1.torcx.tgz")
+	writeTestTgz(t, path, map[string]string{
+		".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/foo"]}}`,
+		"bin/foo":              "foo",
+	})
+
+	reader, err := OpenArchive(Archive{Filepath: path, Format: ArchiveFormatTgz})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := reader.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]int64{}
+	for _, entry := range entries {
+		found[entry.Path] = entry.Size
+	}
+	if size, ok := found["/bin/foo"]; !ok || size != 3 {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+
+	b, err := reader.ReadFile("bin/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "foo" {
+		t.Errorf("unexpected content %q", b)
+	}
+	if _, err := reader.ReadFile("/bin/bar"); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("expected not-exist error, got %v", err)
+	}
+}
+
+func TestSquashfsArchiveReader(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo:1.torcx.squashfs")
+	if err := ioutil.WriteFile(path, []byte("squashfs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fake unsquashfs, listing and extracting a fixed image.
+	fakeTool := filepath.Join(dir, "unsquashfs")
+	script := `#!/bin/sh
+if [ "$1" = "-lls" ]; then
+	cat <<LIST
+Parallel unsquashfs: Using 4 processors
+3 inodes (2 blocks) to write
+
+drwxr-xr-x root/root                38 2018-03-01 10:00 squashfs-root
+drwxr-xr-x root/root                25 2018-03-01 10:00 squashfs-root/.torcx
+-rw-r--r-- root/root                64 2018-03-01 10:00 squashfs-root/.torcx/manifest.json
+-rwsr-xr-x root/root              1234 2018-03-01 10:00 squashfs-root/bin/foo me
+lrwxrwxrwx root/root                 6 2018-03-01 10:00 squashfs-root/bin/bar -> foo me
+LIST
+	exit 0
+fi
+mkdir -p "$4/.torcx"
+if [ "$6" = "/.torcx/manifest.json" ]; then
+	echo '{"kind": "image-manifest-v0", "value": {"bin": ["/bin/foo me"]}}' > "$4/.torcx/manifest.json"
+fi
+`
+	if err := ioutil.WriteFile(fakeTool, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldTool := unsquashfsBinary
+	unsquashfsBinary = fakeTool
+	defer func() { unsquashfsBinary = oldTool }()
+
+	ar := Archive{Filepath: path, Format: ArchiveFormatSquashfs}
+	reader, err := OpenArchive(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := reader.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ArchiveEntry{
+		{Path: "/", Mode: os.ModeDir | 0755},
+		{Path: "/.torcx", Mode: os.ModeDir | 0755},
+		{Path: "/.torcx/manifest.json", Mode: 0644, Size: 64},
+		{Path: "/bin/foo me", Mode: os.ModeSetuid | 0755, Size: 1234},
+		{Path: "/bin/bar", Mode: os.ModeSymlink | 0777, Linkname: "foo me"},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected entries %+v, got %+v", expected, entries)
+	}
+
+	meta, err := ReadArchiveMetadata(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(meta.Assets.Binaries, []string{"/bin/foo me"}) {
+		t.Errorf("unexpected assets %+v", meta.Assets)
+	}
+	if _, err := reader.ReadFile("/bin/baz"); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("expected not-exist error, got %v", err)
+	}
+
+	unsquashfsBinary = filepath.Join(dir, "missing")
+	if _, err := OpenArchive(ar); err != ErrInspectUnsupported {
+		t.Errorf("expected unsupported error, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"github.com/flatcar-linux/torcx/internal/third_party/docker/pkg/loopback"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Store is a source of image archives. Embedders can provide their own
+// implementation (e.g. an in-memory store) to a StoreCache.
+type Store interface {
+	// Name identifies the store in logs, usually its path.
+	Name() string
+	// Archives returns all image archives in the store.
+	Archives() ([]Archive, error)
+}
+
+// DirStore is a Store backed by a local directory.
+type DirStore string
+
+// Name implements Store.
+func (d DirStore) Name() string {
+	return string(d)
+}
+
+// Archives implements Store, using the store index when up to date.
+func (d DirStore) Archives() ([]Archive, error) {
+	return storeArchives(string(d))
+}
+
+// Mounter performs the mount operations needed to apply images.
+// Embedders can swap it to run without privileges, or to record calls.
+type Mounter interface {
+	// Mount mounts `source` on `target`, see mount(2).
+	Mount(source, target, fstype string, flags uintptr, data string) error
+	// Unmount unmounts `target`, see umount2(2).
+	Unmount(target string, flags int) error
+	// MountSquashfs mounts the squashfs image at `path` read-only on `target`.
+	MountSquashfs(path, target string) error
+	// MountLoop mounts the `fstype` filesystem image at `path` read-only
+	// on `target`, backed by a loop device.
+	MountLoop(path, target, fstype string) error
+}
+
+// SystemMounter is the Mounter performing mount syscalls on the host.
+type SystemMounter struct{}
+
+// DefaultMounter is used when no Mounter is configured.
+var DefaultMounter Mounter = SystemMounter{}
+
+// Mount implements Mounter. The new mount API is used where available,
+// falling back to mount(2) on older kernels.
+func (SystemMounter) Mount(source, target, fstype string, flags uintptr, data string) error {
+	if hasMountAPI() {
+		err := mountWithAPI(source, target, fstype, flags, data)
+		if err != errMountAPIUnsupported && errors.Cause(err) != unix.ENOSYS {
+			return err
+		}
+	}
+	return unix.Mount(source, target, fstype, flags, data)
+}
+
+// Unmount implements Mounter.
+func (SystemMounter) Unmount(target string, flags int) error {
+	return unix.Unmount(target, flags)
+}
+
+// MountSquashfs implements Mounter, attaching `path` to a loop device.
+func (m SystemMounter) MountSquashfs(path, target string) error {
+	return m.MountLoop(path, target, "squashfs")
+}
+
+// MountLoop implements Mounter.
+func (SystemMounter) MountLoop(path, target, fstype string) error {
+	loopDev, err := loopback.AttachLoopDevice(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to attach %q to a loop device", path)
+	}
+	defer loopDev.Close()
+
+	return SystemMounter{}.Mount(loopDev.Name(), target, fstype, unix.MS_RDONLY, "")
+}
+
+// mounter returns the configured Mounter, or the default one.
+func (cc *CommonConfig) mounter() Mounter {
+	if cc == nil || cc.Mounter == nil {
+		return DefaultMounter
+	}
+	return cc.Mounter
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// memStore is an in-memory Store.
+type memStore []Archive
+
+func (memStore) Name() string { return "memory" }
+
+func (m memStore) Archives() ([]Archive, error) { return m, nil }
+
+// fakeMounter records mount operations, without performing them.
+type fakeMounter struct {
+	mounts []string
+}
+
+func (f *fakeMounter) Mount(source, target, fstype string, flags uintptr, data string) error {
+	f.mounts = append(f.mounts, fstype+":"+target)
+	return nil
+}
+
+func (f *fakeMounter) Unmount(target string, flags int) error {
+	return nil
+}
+
+func (f *fakeMounter) MountSquashfs(path, target string) error {
+	f.mounts = append(f.mounts, "squashfs:"+target)
+	return nil
+}
+
+func (f *fakeMounter) MountLoop(path, target, fstype string) error {
+	f.mounts = append(f.mounts, fstype+":"+target)
+	return nil
+}
+
+// roundTripFunc is an http.RoundTripper replaying canned responses.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestNewStoreCacheFrom(t *testing.T) {
+	ar := Archive{Image: Image{Name: "foo", Reference: "1"}, Filepath: "/mem/foo:1.torcx.tgz", Format: ArchiveFormatTgz}
+	sc, err := NewStoreCacheFrom([]Store{memStore{ar}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := sc.ArchiveFor(Image{Name: "foo", Reference: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Filepath != ar.Filepath {
+		t.Errorf("expected %s, got %s", ar.Filepath, got.Filepath)
+	}
+	if len(sc.Paths) != 1 || sc.Paths[0] != "memory" {
+		t.Errorf("unexpected store paths %v", sc.Paths)
+	}
+}
+
+func TestMounterInjection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_backend_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mounter := &fakeMounter{}
+	applyCfg := &ApplyConfig{CommonConfig: CommonConfig{RunDir: dir, Mounter: mounter}}
+	topDir, err := mountFilesystemImage(applyCfg, filepath.Join(dir, "foo.torcx.squashfs"), ArchiveFormatSquashfs, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	erofsDir, err := mountFilesystemImage(applyCfg, filepath.Join(dir, "bar.torcx.erofs"), ArchiveFormatErofs, "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounter.mounts) != 2 || mounter.mounts[0] != "squashfs:"+topDir || mounter.mounts[1] != "erofs:"+erofsDir {
+		t.Errorf("unexpected mounts %v", mounter.mounts)
+	}
+}
+
+func TestTransportInjection(t *testing.T) {
+	var requested []string
+	cc := &CommonConfig{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			requested = append(requested, req.URL.String())
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(strings.NewReader(`{"kind": "torcx-node-state-v0", "value": {"profile_name": "fleet", "images": []}}`)),
+				Request:    req,
+			}, nil
+		}),
+	}
+	state, err := readNodeState(context.Background(), cc.httpClient(), "https://recorded.invalid/state.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.ProfileName != "fleet" {
+		t.Errorf("unexpected state %+v", state)
+	}
+
+	remote := Remote{Transport: cc.Transport}
+	if _, err := remote.httpClient().Get("https://recorded.invalid/manifest"); err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 2 {
+		t.Errorf("expected 2 recorded requests, got %v", requested)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultBootCriticalTarget is the target gated on boot-critical images.
+	DefaultBootCriticalTarget = "basic.target"
+	// bootGateUnit is the generated unit gating the boot on boot-critical images.
+	bootGateUnit = "torcx-boot-critical.service"
+)
+
+// bootCriticalTarget returns the systemd target gated on boot-critical images.
+func (cc *CommonConfig) bootCriticalTarget() string {
+	if cc.BootCriticalTarget != "" {
+		return cc.BootCriticalTarget
+	}
+	return DefaultBootCriticalTarget
+}
+
+// FailedBootCritical returns the boot-critical images which have not been
+// applied.
+func (applyCfg *ApplyConfig) FailedBootCritical() []Image {
+	applied := make(map[string]bool, len(applyCfg.AppliedImages))
+	for _, ai := range applyCfg.AppliedImages {
+		applied[ai.Name] = true
+	}
+	failed := []Image{}
+	for _, im := range applyCfg.BootCritical {
+		if !applied[im.Name] {
+			failed = append(failed, im)
+		}
+	}
+	return failed
+}
+
+// WriteBootGate generates, in the systemd generator directory `unitDir`, a
+// unit required by and ordered before the boot-critical target. The unit
+// fails if any boot-critical image could not be applied, failing the boot
+// transaction visibly. Nothing is generated if no image is boot-critical.
+func WriteBootGate(applyCfg *ApplyConfig, unitDir string) error {
+	if applyCfg == nil {
+		return errors.New("missing apply configuration")
+	}
+	if len(applyCfg.BootCritical) == 0 {
+		return nil
+	}
+	target := applyCfg.bootCriticalTarget()
+
+	names := []string{}
+	for _, im := range applyCfg.FailedBootCritical() {
+		names = append(names, im.Name+":"+im.Reference)
+	}
+	execStart := "/bin/true"
+	if len(names) > 0 {
+		execStart = fmt.Sprintf(`/bin/sh -c "echo 'boot-critical torcx images failed to apply: %s' >&2; exit 1"`, strings.Join(names, " "))
+	}
+	unit := strings.Join([]string{
+		"# Automatically generated by torcx-generator",
+		"",
+		"[Unit]",
+		"Description=Boot-critical torcx images",
+		"DefaultDependencies=no",
+		"Before=" + target,
+		"",
+		"[Service]",
+		"Type=oneshot",
+		"RemainAfterExit=yes",
+		"ExecStart=" + execStart,
+		"",
+	}, "\n")
+	if err := ioutil.WriteFile(filepath.Join(unitDir, bootGateUnit), []byte(unit), 0644); err != nil {
+		return errors.Wrap(err, "writing boot gate unit")
+	}
+
+	requiresDir := filepath.Join(unitDir, target+".requires")
+	if err := os.MkdirAll(requiresDir, 0755); err != nil {
+		return err
+	}
+	link := filepath.Join(requiresDir, bootGateUnit)
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(filepath.Join("..", bootGateUnit), link)
+}
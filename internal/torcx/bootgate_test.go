@@ -0,0 +1,73 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteBootGate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_bootgate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	applyCfg := &ApplyConfig{}
+	if err := WriteBootGate(applyCfg, dir); err != nil {
+		t.Fatal(err)
+	}
+	if IsExistingPath(filepath.Join(dir, bootGateUnit)) {
+		t.Error("unexpected boot gate without boot-critical images")
+	}
+
+	docker := Image{Name: "docker", Reference: "19.03", BootCritical: true}
+	applyCfg = &ApplyConfig{
+		CommonConfig: CommonConfig{BootCriticalTarget: "multi-user.target"},
+		BootCritical: []Image{docker},
+	}
+	if err := WriteBootGate(applyCfg, dir); err != nil {
+		t.Fatal(err)
+	}
+	unit, err := ioutil.ReadFile(filepath.Join(dir, bootGateUnit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(unit), "Before=multi-user.target") || !strings.Contains(string(unit), "exit 1") {
+		t.Errorf("unexpected failing boot gate unit:\n%s", unit)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "multi-user.target.requires", bootGateUnit)); err != nil {
+		t.Error(err)
+	}
+
+	applyCfg.AppliedImages = []AppliedImage{{Image: docker}}
+	if failed := applyCfg.FailedBootCritical(); len(failed) != 0 {
+		t.Errorf("unexpected failed images %v", failed)
+	}
+	if err := WriteBootGate(applyCfg, dir); err != nil {
+		t.Fatal(err)
+	}
+	unit, err = ioutil.ReadFile(filepath.Join(dir, bootGateUnit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(unit), "ExecStart=/bin/true") {
+		t.Errorf("unexpected passing boot gate unit:\n%s", unit)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrBudgetExceeded is returned for optional images which could not be
+// applied within the apply time budget.
+var ErrBudgetExceeded = errors.New("apply time budget exceeded")
+
+// ApplyBudget bounds the time spent applying images, so that slow storage
+// can not hold up early boot. Boot-critical images are never dropped.
+type ApplyBudget struct {
+	// Deadline is the overall apply time budget (e.g. "30s"), after
+	// which optional images are not applied anymore.
+	Deadline string `json:"deadline,omitempty"`
+	// ImageTimeout is the time budget for each optional image (e.g. "5s"),
+	// from archive lookup to unpacking.
+	ImageTimeout string `json:"image_timeout,omitempty"`
+}
+
+// startBudget arms the configured apply deadline and image timeout,
+// counting from `now`.
+func (applyCfg *ApplyConfig) startBudget(now time.Time) error {
+	budget := applyCfg.ApplyBudget
+	if budget == nil {
+		return nil
+	}
+	if budget.Deadline != "" {
+		deadline, err := time.ParseDuration(budget.Deadline)
+		if err != nil || deadline <= 0 {
+			return errors.Errorf("invalid apply deadline %q", budget.Deadline)
+		}
+		applyCfg.deadline = now.Add(deadline)
+	}
+	if budget.ImageTimeout != "" {
+		timeout, err := time.ParseDuration(budget.ImageTimeout)
+		if err != nil || timeout <= 0 {
+			return errors.Errorf("invalid image timeout %q", budget.ImageTimeout)
+		}
+		applyCfg.imageTimeout = timeout
+	}
+	return nil
+}
+
+// imageDeadline returns when applying `im`, started at `start`, runs out
+// of budget. It is zero for boot-critical images and without a budget.
+func (applyCfg *ApplyConfig) imageDeadline(im Image, start time.Time) time.Time {
+	if im.BootCritical {
+		return time.Time{}
+	}
+	deadline := applyCfg.deadline
+	if applyCfg.imageTimeout > 0 {
+		timeout := start.Add(applyCfg.imageTimeout)
+		if deadline.IsZero() || timeout.Before(deadline) {
+			deadline = timeout
+		}
+	}
+	return deadline
+}
+
+// checkDeadline returns ErrBudgetExceeded if `deadline` is set and has passed.
+func checkDeadline(deadline time.Time) error {
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return ErrBudgetExceeded
+	}
+	return nil
+}
+
+// deadlineReader fails reads once its deadline has passed, aborting
+// the unpacking of an archive which ran out of budget.
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+	expired  bool
+}
+
+// newDeadlineReader wraps `r`, which is returned as is without deadline.
+func newDeadlineReader(r io.Reader, deadline time.Time) io.Reader {
+	if deadline.IsZero() {
+		return r
+	}
+	return &deadlineReader{r: r, deadline: deadline}
+}
+
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	if err := checkDeadline(dr.deadline); err != nil {
+		dr.expired = true
+		return 0, err
+	}
+	return dr.r.Read(p)
+}
+
+// unpackError returns the error for the failed unpacking of `path` from
+// `r` into `topDir`. If it ran out of budget, the partial tree is removed
+// and ErrBudgetExceeded returned: extractors do not preserve error causes,
+// so the reader itself is checked.
+func unpackError(r io.Reader, topDir, path string, err error) error {
+	if dr, ok := r.(*deadlineReader); ok && dr.expired {
+		_ = os.RemoveAll(topDir)
+		return errors.Wrapf(ErrBudgetExceeded, "unpacking %q", path)
+	}
+	return errors.Wrapf(err, "unpacking %q", path)
+}
+
+// discardUnpacked removes the partially applied `imageRoot` of an image
+// dropped after unpacking, on a best-effort basis.
+func discardUnpacked(applyCfg *ApplyConfig, format ArchiveFormat, imageRoot string) {
+	if imageRoot == "" {
+		return
+	}
+	var err error
+	if format.isFilesystemImage() {
+		err = applyCfg.mounter().Unmount(imageRoot, 0)
+	} else {
+		unmountImageTmpfs(applyCfg, imageRoot)
+	}
+	if err == nil {
+		err = os.RemoveAll(imageRoot)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"path":  imageRoot,
+			"error": err,
+		}).Warn("unable to discard dropped image")
+	}
+}
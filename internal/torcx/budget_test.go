@@ -0,0 +1,136 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestApplyBudgetDropsOptionalImages(t *testing.T) {
+	dir := t.TempDir()
+	storeDir := filepath.Join(dir, "store")
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"foo", "bar"} {
+		writeTestTgz(t, filepath.Join(storeDir, name+":1.torcx.tgz"), map[string]string{
+			".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/` + name + `"]}}`,
+			"bin/" + name:          name,
+		})
+	}
+
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			BaseDir:     filepath.Join(dir, "base"),
+			RunDir:      DefaultRunDir,
+			ConfDir:     filepath.Join(dir, "conf"),
+			UsrDir:      filepath.Join(dir, "usr"),
+			StorePaths:  []string{storeDir},
+			Mounter:     &fakeMounter{},
+			ApplyBudget: &ApplyBudget{Deadline: "1ns"},
+		},
+		UpperProfile: "user",
+	}
+	profileDir := applyCfg.UserProfileDir()
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	profile := `{"kind": "profile-manifest-v1", "value": {"images": [
+		{"name": "foo", "reference": "1", "boot_critical": true},
+		{"name": "bar", "reference": "1"}
+	]}}`
+	if err := ioutil.WriteFile(filepath.Join(profileDir, "user.json"), []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SimulateApply(applyCfg, filepath.Join(dir, "target")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applyCfg.AppliedImages) != 1 || applyCfg.AppliedImages[0].Name != "foo" {
+		t.Errorf("expected only the boot-critical image to be applied, got %+v", applyCfg.AppliedImages)
+	}
+	counts := CountWarnings(applyCfg.Warnings)
+	if counts[WarningDroppedImage] != 1 || counts[WarningSkippedImage] != 0 {
+		t.Errorf("expected a single dropped image, got %v", counts)
+	}
+	for _, w := range applyCfg.Warnings {
+		if w.Kind == WarningDroppedImage && (w.Image == nil || w.Image.Name != "bar") {
+			t.Errorf("unexpected dropped image %+v", w.Image)
+		}
+	}
+}
+
+func TestUnpackDeadline(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "foo:1.torcx.tgz")
+	writeTestTgz(t, archive, map[string]string{
+		"bin/foo": "foo",
+	})
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			BaseDir: filepath.Join(dir, "base"),
+			RunDir:  filepath.Join(dir, "run"),
+		},
+	}
+
+	_, err := unpackTgzUser(applyCfg, archive, "foo", time.Now().Add(-time.Second))
+	if errors.Cause(err) != ErrBudgetExceeded {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+	if IsExistingPath(filepath.Join(applyCfg.RunUnpackDir(), "foo")) {
+		t.Error("partially unpacked image not removed")
+	}
+
+	root, err := unpackTgzUser(applyCfg, archive, "foo", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsExistingPath(filepath.Join(root, "bin", "foo")) {
+		t.Error("image not unpacked within budget")
+	}
+}
+
+func TestStartBudget(t *testing.T) {
+	now := time.Now()
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			ApplyBudget: &ApplyBudget{Deadline: "30s", ImageTimeout: "5s"},
+		},
+	}
+	if err := applyCfg.startBudget(now); err != nil {
+		t.Fatal(err)
+	}
+	if got := applyCfg.imageDeadline(Image{Name: "foo"}, now); !got.Equal(now.Add(5 * time.Second)) {
+		t.Errorf("unexpected image deadline %s", got)
+	}
+	if got := applyCfg.imageDeadline(Image{Name: "foo"}, now.Add(28*time.Second)); !got.Equal(now.Add(30 * time.Second)) {
+		t.Errorf("image deadline not capped by the apply deadline: %s", got)
+	}
+	if got := applyCfg.imageDeadline(Image{Name: "foo", BootCritical: true}, now); !got.IsZero() {
+		t.Errorf("unexpected deadline for boot-critical image: %s", got)
+	}
+
+	applyCfg.ApplyBudget.Deadline = "soon"
+	if err := applyCfg.startBudget(now); err == nil {
+		t.Error("invalid deadline accepted")
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// boardNamePaths are where the board name is read from, in order.
+	boardNamePaths = []string{
+		"/sys/class/dmi/id/board_name",
+		"/sys/firmware/devicetree/base/model",
+	}
+	// detectVirtualization returns the virtualization technology the host
+	// runs under ("none" if bare-metal) and whether it is a container.
+	detectVirtualization = func() (string, bool) {
+		if out, err := exec.Command("systemd-detect-virt", "--container").Output(); err == nil {
+			return strings.TrimSpace(string(out)), true
+		}
+		out, _ := exec.Command("systemd-detect-virt", "--vm").Output()
+		tech := strings.TrimSpace(string(out))
+		if tech == "" {
+			tech = "none"
+		}
+		return tech, false
+	}
+)
+
+// ImageConditions restrict the environments an image is applied in, after
+// systemd `Condition*=` settings. Each non-empty condition must hold; a
+// leading "!" negates it.
+type ImageConditions struct {
+	// Virtualization is "vm", "container", a technology as reported by
+	// systemd-detect-virt (e.g. "kvm", "amazon") or "none" for bare-metal.
+	Virtualization string `json:"virtualization,omitempty"`
+	// KernelCommandLine is a kernel parameter ("name" or "name=value").
+	KernelCommandLine string `json:"kernel_command_line,omitempty"`
+	// OEM is the platform (e.g. "azure") from the `flatcar.oem.id` or
+	// `coreos.oem.id` kernel parameter.
+	OEM string `json:"oem,omitempty"`
+	// Board is a glob pattern matched against the DMI board name or the
+	// devicetree model.
+	Board string `json:"board,omitempty"`
+}
+
+// toJSON returns the conditions for a profile entry, nil if there are none.
+func (ic ImageConditions) toJSON() *ImageConditions {
+	if ic == (ImageConditions{}) {
+		return nil
+	}
+	return &ic
+}
+
+// hostEnvironment describes the host, for image conditions.
+type hostEnvironment struct {
+	virtualization string
+	container      bool
+	cmdline        []string
+	board          string
+}
+
+// readHostEnvironment probes the host environment.
+func readHostEnvironment() hostEnvironment {
+	env := hostEnvironment{}
+	env.virtualization, env.container = detectVirtualization()
+	if b, err := ioutil.ReadFile(kernelCmdlinePath); err == nil {
+		env.cmdline = strings.Fields(string(b))
+	}
+	for _, p := range boardNamePaths {
+		if b, err := ioutil.ReadFile(p); err == nil {
+			env.board = strings.TrimSpace(strings.TrimRight(string(b), "\x00"))
+			break
+		}
+	}
+	return env
+}
+
+// oem returns the platform from the kernel command-line.
+func (env hostEnvironment) oem() string {
+	for _, token := range env.cmdline {
+		for _, key := range []string{"flatcar.oem.id=", "coreos.oem.id="} {
+			if strings.HasPrefix(token, key) {
+				return strings.TrimPrefix(token, key)
+			}
+		}
+	}
+	return ""
+}
+
+// hasKernelParameter checks the kernel command-line for "name" (matching
+// "name" and "name=..." tokens) or "name=value".
+func (env hostEnvironment) hasKernelParameter(param string) bool {
+	for _, token := range env.cmdline {
+		if token == param || (!strings.Contains(param, "=") && strings.HasPrefix(token, param+"=")) {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns whether all conditions hold in `env`.
+func (ic ImageConditions) match(env hostEnvironment) (bool, error) {
+	checks := []struct {
+		value string
+		fn    func(string) (bool, error)
+	}{
+		{ic.Virtualization, func(v string) (bool, error) {
+			switch v {
+			case "vm":
+				return !env.container && env.virtualization != "none", nil
+			case "container":
+				return env.container, nil
+			}
+			return env.virtualization == v, nil
+		}},
+		{ic.KernelCommandLine, func(v string) (bool, error) {
+			return env.hasKernelParameter(v), nil
+		}},
+		{ic.OEM, func(v string) (bool, error) {
+			return env.oem() == v, nil
+		}},
+		{ic.Board, func(v string) (bool, error) {
+			ok, err := path.Match(v, env.board)
+			if err != nil {
+				return false, errors.Wrapf(err, "invalid board pattern %q", v)
+			}
+			return ok, nil
+		}},
+	}
+	for _, check := range checks {
+		if check.value == "" {
+			continue
+		}
+		value, negate := check.value, false
+		if strings.HasPrefix(value, "!") {
+			value, negate = value[1:], true
+		}
+		ok, err := check.fn(value)
+		if err != nil {
+			return false, err
+		}
+		if ok == negate {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// filterConditions drops the images whose conditions do not hold on this host.
+func filterConditions(images []Image) ([]Image, error) {
+	var env *hostEnvironment
+	filtered := make([]Image, 0, len(images))
+	for _, im := range images {
+		if im.Conditions == (ImageConditions{}) {
+			filtered = append(filtered, im)
+			continue
+		}
+		if env == nil {
+			probed := readHostEnvironment()
+			env = &probed
+		}
+		ok, err := im.Conditions.match(*env)
+		if err != nil {
+			return nil, errors.Wrapf(err, "image %s:%s", im.Name, im.Reference)
+		}
+		if !ok {
+			logrus.WithFields(logrus.Fields{
+				"image":     im.Name,
+				"reference": im.Reference,
+			}).Info("image conditions not met, skipping")
+			continue
+		}
+		filtered = append(filtered, im)
+	}
+	return filtered, nil
+}
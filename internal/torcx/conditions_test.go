@@ -0,0 +1,89 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImageConditionsMatch(t *testing.T) {
+	env := hostEnvironment{
+		virtualization: "kvm",
+		cmdline:        strings.Fields("root=/dev/sda4 flatcar.oem.id=azure console"),
+		board:          "Virtual Machine",
+	}
+	tests := []struct {
+		cond     ImageConditions
+		expected bool
+	}{
+		{ImageConditions{}, true},
+		{ImageConditions{Virtualization: "vm"}, true},
+		{ImageConditions{Virtualization: "kvm"}, true},
+		{ImageConditions{Virtualization: "container"}, false},
+		{ImageConditions{Virtualization: "!none"}, true},
+		{ImageConditions{KernelCommandLine: "console"}, true},
+		{ImageConditions{KernelCommandLine: "root"}, true},
+		{ImageConditions{KernelCommandLine: "root=/dev/sda3"}, false},
+		{ImageConditions{OEM: "azure"}, true},
+		{ImageConditions{OEM: "!azure"}, false},
+		{ImageConditions{Board: "Virtual*"}, true},
+		{ImageConditions{OEM: "azure", Board: "Raspberry*"}, false},
+	}
+	for _, tt := range tests {
+		ok, err := tt.cond.match(env)
+		if err != nil {
+			t.Errorf("%+v: %s", tt.cond, err)
+			continue
+		}
+		if ok != tt.expected {
+			t.Errorf("%+v: expected %v, got %v", tt.cond, tt.expected, ok)
+		}
+	}
+}
+
+func TestFilterConditions(t *testing.T) {
+	dir := t.TempDir()
+	origCmdline, origBoards, origVirt := kernelCmdlinePath, boardNamePaths, detectVirtualization
+	defer func() { kernelCmdlinePath, boardNamePaths, detectVirtualization = origCmdline, origBoards, origVirt }()
+	kernelCmdlinePath = filepath.Join(dir, "cmdline")
+	boardNamePaths = []string{filepath.Join(dir, "board_name")}
+	detectVirtualization = func() (string, bool) { return "none", false }
+	if err := ioutil.WriteFile(kernelCmdlinePath, []byte("coreos.oem.id=packet\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	images := ImagesFromJSONV1(ImagesV1{Images: []ImageV1{
+		{Name: "docker", Reference: "1"},
+		{Name: "azure-agent", Reference: "1", Conditions: &ImageConditions{OEM: "azure"}},
+		{Name: "metal-tools", Reference: "1", Conditions: &ImageConditions{Virtualization: "none", OEM: "packet"}},
+	}})
+	filtered, err := filterConditions(images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, im := range filtered {
+		names = append(names, im.Name)
+	}
+	if strings.Join(names, ",") != "docker,metal-tools" {
+		t.Errorf("unexpected images %v", names)
+	}
+	if entry := filtered[1].ToJSONV1(); entry.Conditions == nil || entry.Conditions.OEM != "packet" {
+		t.Errorf("conditions lost in profile entry: %+v", entry)
+	}
+}
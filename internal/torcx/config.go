@@ -21,6 +21,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -90,12 +91,87 @@ func ReadCommonConfig(cfgPath string, commonCfg *CommonConfig) error {
 	if len(fileCfg.Value.StorePaths) > 0 {
 		commonCfg.StorePaths = append(commonCfg.StorePaths, fileCfg.Value.StorePaths...)
 	}
+	if fileCfg.Value.RequireIMASignatures {
+		commonCfg.RequireIMASignatures = true
+	}
+	if fileCfg.Value.RequireSignedImages {
+		commonCfg.RequireSignedImages = true
+	}
+	if fileCfg.Value.BootCriticalTarget != "" {
+		commonCfg.BootCriticalTarget = fileCfg.Value.BootCriticalTarget
+	}
+	if fileCfg.Value.VerifyInterval != "" {
+		commonCfg.VerifyInterval = fileCfg.Value.VerifyInterval
+	}
+	if fileCfg.Value.ErrorReportInterval != "" {
+		if _, err := time.ParseDuration(fileCfg.Value.ErrorReportInterval); err != nil {
+			return errors.Errorf("invalid error report interval %q", fileCfg.Value.ErrorReportInterval)
+		}
+		commonCfg.ErrorReportInterval = fileCfg.Value.ErrorReportInterval
+	}
+	if fileCfg.Value.FetchPolicy != nil {
+		commonCfg.FetchPolicy = fileCfg.Value.FetchPolicy
+	}
+	for name, pin := range fileCfg.Value.RemotePins {
+		if err := validatePin(pin); err != nil {
+			return errors.Wrapf(err, "remote %s", name)
+		}
+	}
+	if len(fileCfg.Value.RemotePins) > 0 {
+		commonCfg.RemotePins = fileCfg.Value.RemotePins
+	}
+	if fileCfg.Value.FetchAudit != nil {
+		if err := fileCfg.Value.FetchAudit.validate(); err != nil {
+			return err
+		}
+		commonCfg.FetchAudit = fileCfg.Value.FetchAudit
+	}
+	if fileCfg.Value.Notify != nil {
+		if err := fileCfg.Value.Notify.validate(); err != nil {
+			return err
+		}
+		commonCfg.Notify = fileCfg.Value.Notify
+	}
+	if fileCfg.Value.StoreEncryption != nil {
+		if err := fileCfg.Value.StoreEncryption.validate(); err != nil {
+			return err
+		}
+		commonCfg.StoreEncryption = fileCfg.Value.StoreEncryption
+	}
+	if fileCfg.Value.UnpackLimits != nil {
+		commonCfg.UnpackLimits = fileCfg.Value.UnpackLimits
+	}
+	if fileCfg.Value.HashAlgorithm != "" {
+		if !IsHashAlgorithm(fileCfg.Value.HashAlgorithm) {
+			return errors.Errorf("unknown hash algorithm %q", fileCfg.Value.HashAlgorithm)
+		}
+		commonCfg.HashAlgorithm = fileCfg.Value.HashAlgorithm
+	}
+	if fileCfg.Value.HashWorkers > 0 {
+		commonCfg.HashWorkers = fileCfg.Value.HashWorkers
+	}
+	if fileCfg.Value.SquashfsVerification != nil {
+		commonCfg.SquashfsVerification = fileCfg.Value.SquashfsVerification
+	}
+	if fileCfg.Value.ApplyBudget != nil {
+		commonCfg.ApplyBudget = fileCfg.Value.ApplyBudget
+	}
+	if fileCfg.Value.InstallRecommends != nil {
+		commonCfg.InstallRecommends = fileCfg.Value.InstallRecommends
+	}
+	if fileCfg.Value.EventStream != "" {
+		commonCfg.EventStream = fileCfg.Value.EventStream
+	}
 
 	return nil
 }
 
 // RuntimeConfigPath determines runtime location of torcx common configuration file.
 func RuntimeConfigPath() string {
+	// The kernel command-line only applies to the host instance.
+	if RootPrefix != "" {
+		return RootPath(defaultCfgPath)
+	}
 	cfgPath, err := procConfigPath()
 	if err != nil {
 		cfgPath = defaultCfgPath
@@ -0,0 +1,212 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// WarningMissingMount is recorded for sealed mounts no longer present.
+	WarningMissingMount = "missing-mount"
+	// WarningMissingImage is recorded for applied images whose root is gone.
+	WarningMissingImage = "missing-image"
+	// WarningModifiedArchive is recorded for applied archives not matching
+	// their recorded digest anymore.
+	WarningModifiedArchive = "modified-archive"
+
+	// verifyStateUnit is the generated unit verifying the sealed state.
+	verifyStateUnit = "torcx-verify-state"
+	// verifyStateSource is the error reports source of state verifications.
+	verifyStateSource = "verify-state"
+)
+
+var (
+	// mountInfoPath is where the mount table is read from.
+	mountInfoPath = "/proc/self/mountinfo"
+
+	// mountInfoUnescaper decodes octal escapes in mountinfo paths.
+	mountInfoUnescaper = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+)
+
+// VerifyConsistency checks that the state recorded at seal time is still
+// in place: the unpack directory and squashfs images are still mounted, and
+// image roots still exist. Up to `digestSample` randomly picked archives
+// (all of them if zero) are also checked against their recorded digest.
+// All drift found is recorded in the consistency file and returned.
+func VerifyConsistency(cc *CommonConfig, digestSample int) ([]Warning, error) {
+	return verifyConsistency(cc, filepath.Dir(RootPath(SealPath)), digestSample)
+}
+
+// verifyConsistency implements VerifyConsistency, reading image
+// environment files from `metadataDir`.
+func verifyConsistency(cc *CommonConfig, metadataDir string, digestSample int) ([]Warning, error) {
+	if cc == nil {
+		return nil, errors.New("missing common configuration")
+	}
+	images, err := ReadProfilePath(cc.RunProfile())
+	if err != nil {
+		return nil, errors.Wrap(err, "reading run profile")
+	}
+	mounts, err := readMountPoints(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Repeated drift is rate-limited in the journal, as verification is
+	// periodically run by a timer.
+	reporter := newErrorReporter(cc, verifyStateSource, logrus.WarnLevel)
+	defer reporter.close()
+	drift := []Warning{}
+	report := func(kind string, message string, im *Image, path string) {
+		reporter.report(logrus.Fields{
+			"kind": kind,
+			"path": path,
+		}, message+": "+path)
+		drift = append(drift, Warning{
+			Kind:    kind,
+			Message: message,
+			Image:   im,
+			Path:    path,
+			Time:    time.Now().UTC(),
+		})
+	}
+
+	if !mounts[filepath.Clean(cc.RunUnpackDir())] {
+		report(WarningMissingMount, "unpack directory not mounted", nil, cc.RunUnpackDir())
+	}
+	applied := []AppliedImage{}
+	for i := range images {
+		im := &images[i]
+		meta, err := ReadMetadata(filepath.Join(metadataDir, imageEnvPrefix+imagePathName(im.Name)))
+		if err != nil {
+			report(WarningMissingImage, "image environment file missing", im, metadataDir)
+			continue
+		}
+		ai := AppliedImage{
+			Image:   *im,
+			Archive: meta[ImageEnvArchive],
+			Digest:  meta[ImageEnvDigest],
+			Root:    meta[ImageEnvRoot],
+		}
+		if !IsExistingPath(ai.Root) {
+			report(WarningMissingImage, "image root missing", im, ai.Root)
+			continue
+		}
+		if format := archiveFormatOf(ai.Archive); format.isFilesystemImage() && !mounts[filepath.Clean(ai.Root)] {
+			report(WarningMissingMount, string(format)+" image not mounted", im, ai.Root)
+		}
+		if ai.Digest != "" {
+			applied = append(applied, ai)
+		}
+	}
+
+	rand.Shuffle(len(applied), func(i, j int) { applied[i], applied[j] = applied[j], applied[i] })
+	if digestSample > 0 && digestSample < len(applied) {
+		applied = applied[:digestSample]
+	}
+	for _, ai := range applied {
+		im := ai.Image
+		valid, err := validateArchiveHash(ai.Archive, archiveFormatOf(ai.Archive), ai.Digest, cc.squashfsCheck(true))
+		if err != nil {
+			report(WarningModifiedArchive, fmt.Sprintf("unable to verify archive: %s", err), &im, ai.Archive)
+		} else if !valid {
+			report(WarningModifiedArchive, "archive does not match its recorded digest", &im, ai.Archive)
+		}
+	}
+
+	if err := writeWarnings(cc.RunConsistency(), drift); err != nil {
+		return drift, errors.Wrap(err, "writing consistency report")
+	}
+	return drift, nil
+}
+
+// readMountPoints returns the set of mount points in the mountinfo file at `path`.
+func readMountPoints(path string) (map[string]bool, error) {
+	entries, err := readMountInfo(path)
+	if err != nil {
+		return nil, err
+	}
+	mounts := map[string]bool{}
+	for target := range entries {
+		mounts[target] = true
+	}
+	return mounts, nil
+}
+
+// WriteVerifyTimer generates, in the systemd generator directory `unitDir`,
+// a timer periodically running `command verify-state`, if a verification
+// interval is configured.
+func WriteVerifyTimer(applyCfg *ApplyConfig, unitDir string, command string) error {
+	if applyCfg == nil {
+		return errors.New("missing apply configuration")
+	}
+	if applyCfg.VerifyInterval == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(applyCfg.VerifyInterval)
+	if err != nil || interval < time.Second {
+		return errors.Errorf("invalid verify interval %q", applyCfg.VerifyInterval)
+	}
+	seconds := fmt.Sprintf("%ds", int64(interval/time.Second))
+
+	service := strings.Join([]string{
+		"# Automatically generated by torcx-generator",
+		"",
+		"[Unit]",
+		"Description=Verify consistency of torcx sealed state",
+		"",
+		"[Service]",
+		"Type=oneshot",
+		"ExecStart=" + command + " verify-state",
+		"",
+	}, "\n")
+	timer := strings.Join([]string{
+		"# Automatically generated by torcx-generator",
+		"",
+		"[Unit]",
+		"Description=Periodic verification of torcx sealed state",
+		"",
+		"[Timer]",
+		"OnBootSec=" + seconds,
+		"OnUnitActiveSec=" + seconds,
+		"",
+	}, "\n")
+	if err := ioutil.WriteFile(filepath.Join(unitDir, verifyStateUnit+".service"), []byte(service), 0644); err != nil {
+		return errors.Wrap(err, "writing verify service")
+	}
+	if err := ioutil.WriteFile(filepath.Join(unitDir, verifyStateUnit+".timer"), []byte(timer), 0644); err != nil {
+		return errors.Wrap(err, "writing verify timer")
+	}
+
+	wantsDir := filepath.Join(unitDir, "timers.target.wants")
+	if err := os.MkdirAll(wantsDir, 0755); err != nil {
+		return err
+	}
+	link := filepath.Join(wantsDir, verifyStateUnit+".timer")
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(filepath.Join("..", verifyStateUnit+".timer"), link)
+}
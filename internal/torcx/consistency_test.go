@@ -0,0 +1,100 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyConsistency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_consistency_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cc := &CommonConfig{RunDir: filepath.Join(dir, "run")}
+	metadataDir := filepath.Join(dir, "metadata")
+	for _, d := range []string{metadataDir, filepath.Join(cc.RunUnpackDir(), "foo"), filepath.Join(cc.RunUnpackDir(), "bar")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeRunProfile(cc.RunProfile(), []Image{{Name: "foo", Reference: "1"}, {Name: "bar", Reference: "2"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	fooArchive := filepath.Join(dir, "foo:1.torcx.tgz")
+	barArchive := filepath.Join(dir, "bar:2.torcx.squashfs")
+	for _, path := range []string{fooArchive, barArchive} {
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fooDigest, err := computeHash(fooArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied := []AppliedImage{
+		{Image: Image{Name: "foo", Reference: "1"}, Archive: fooArchive, Digest: fooDigest, Root: filepath.Join(cc.RunUnpackDir(), "foo")},
+		{Image: Image{Name: "bar", Reference: "2"}, Archive: barArchive, Root: filepath.Join(cc.RunUnpackDir(), "bar")},
+	}
+	if err := writeImageEnvFiles(metadataDir, applied); err != nil {
+		t.Fatal(err)
+	}
+
+	origMountInfoPath := mountInfoPath
+	defer func() { mountInfoPath = origMountInfoPath }()
+	mountInfoPath = filepath.Join(dir, "mountinfo")
+	unpackMount := "36 35 0:32 / " + cc.RunUnpackDir() + " rw - tmpfs none rw\n"
+	mountInfo := unpackMount + "37 36 7:0 / " + applied[1].Root + " ro - squashfs /dev/loop0 ro\n"
+	if err := ioutil.WriteFile(mountInfoPath, []byte(mountInfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	drift, err := verifyConsistency(cc, metadataDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) != 0 {
+		t.Errorf("unexpected drift %+v", drift)
+	}
+
+	// Tamper with the tgz archive and unmount the squashfs image
+	if err := ioutil.WriteFile(fooArchive, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mountInfoPath, []byte(unpackMount), 0644); err != nil {
+		t.Fatal(err)
+	}
+	drift, err = verifyConsistency(cc, metadataDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := CountWarnings(drift)
+	if counts[WarningModifiedArchive] != 1 || counts[WarningMissingMount] != 1 || len(drift) != 2 {
+		t.Errorf("unexpected drift %+v", drift)
+	}
+	recorded, err := ReadWarnings(cc.RunConsistency())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != len(drift) {
+		t.Errorf("expected %d recorded inconsistencies, got %d", len(drift), len(recorded))
+	}
+}
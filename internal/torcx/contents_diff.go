@@ -0,0 +1,154 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// ContentsDiff reports changes between two contents manifests for an image.
+type ContentsDiff struct {
+	Image string `json:"image"`
+	// Added and Removed are versions only present in the new or old manifest.
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	// Changed are versions whose archive (hash or location) changed.
+	Changed []string `json:"changed,omitempty"`
+	// OldDefault and NewDefault are set if the default version changed.
+	OldDefault string `json:"old_default,omitempty"`
+	NewDefault string `json:"new_default,omitempty"`
+}
+
+// DiffRemoteContents compares two contents manifests, returning changes
+// for each image (sorted by name). A nil manifest is considered empty.
+func DiffRemoteContents(old, new *RemoteContents) []ContentsDiff {
+	if old == nil {
+		old = &RemoteContents{}
+	}
+	if new == nil {
+		new = &RemoteContents{}
+	}
+
+	names := map[string]bool{}
+	for name := range old.Images {
+		names[name] = true
+	}
+	for name := range new.Images {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	diffs := []ContentsDiff{}
+	for _, name := range sorted {
+		oldImage, newImage := old.Images[name], new.Images[name]
+		diff := ContentsDiff{Image: name}
+		oldVersions := make(map[string]RemoteVersion, len(oldImage.versions))
+		for _, v := range oldImage.versions {
+			oldVersions[v.version] = v
+		}
+		newVersions := make(map[string]bool, len(newImage.versions))
+		for _, v := range newImage.versions {
+			newVersions[v.version] = true
+			prev, ok := oldVersions[v.version]
+			if !ok {
+				diff.Added = append(diff.Added, v.version)
+			} else if !sameArchive(prev, v) {
+				diff.Changed = append(diff.Changed, v.version)
+			}
+		}
+		for _, v := range oldImage.versions {
+			if !newVersions[v.version] {
+				diff.Removed = append(diff.Removed, v.version)
+			}
+		}
+		if oldImage.defaultVersion != newImage.defaultVersion {
+			diff.OldDefault = oldImage.defaultVersion
+			diff.NewDefault = newImage.defaultVersion
+		}
+		if len(diff.Added)+len(diff.Removed)+len(diff.Changed) > 0 || diff.OldDefault != diff.NewDefault {
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs
+}
+
+// sameArchive returns whether two remote versions point to the same archive.
+func sameArchive(a, b RemoteVersion) bool {
+	return a.format == b.format && a.hash == b.hash && a.location == b.location && a.digestLocation == b.digestLocation
+}
+
+// DiffRemote compares the cached contents manifest of remote `name` to a
+// freshly fetched one. If `update` is set, the fetched manifest replaces
+// the cached one.
+func (cc *CommonConfig) DiffRemote(ctx context.Context, name string, update bool) ([]ContentsDiff, error) {
+	cached, err := readCachedContents(cc.RemoteContentsCacheDir(), name)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+
+	rc := RemotesCache{
+		UsrMountpoint: cc.UsrDir,
+		Transport:     cc.Transport,
+		Policy:        cc.FetchPolicy,
+		Pins:          cc.RemotePins,
+	}
+	if update {
+		rc.CacheDir = cc.RemoteContentsCacheDir()
+	}
+	if err := rc.Load(ctx, cc.RemotesDirs(), []string{name}); err != nil {
+		return nil, err
+	}
+	fresh, ok := rc.Contents[name]
+	if !ok {
+		return nil, errors.Errorf("remote %s not found", name)
+	}
+	return DiffRemoteContents(cached, &fresh), nil
+}
+
+// writeCachedContents atomically caches the verified contents manifest of remote `name`.
+func writeCachedContents(dir string, name string, manifest string) error {
+	path := filepath.Join(dir, name+".json")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(manifest), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// readCachedContents reads the cached contents manifest of remote `name`.
+func readCachedContents(dir string, name string) (*RemoteContents, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name+".json"))
+	if err != nil {
+		return nil, err
+	}
+	contents, err := decodeContents(string(b))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode cached contents for %s", name)
+	}
+	return contents, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDiffRemoteContents(t *testing.T) {
+	oldManifest := `{"kind": "torcx-remote-contents-v1", "value": {"images": [
+		{"name": "docker", "defaultVersion": "19.03", "versions": [
+			{"version": "18.06", "format": "tgz", "hash": "sha512-a", "location": "docker-18.06.torcx.tgz"},
+			{"version": "19.03", "format": "tgz", "hash": "sha512-b", "location": "docker-19.03.torcx.tgz"}]},
+		{"name": "rkt", "defaultVersion": "1", "versions": [
+			{"version": "1", "format": "tgz", "hash": "sha512-c", "location": "rkt-1.torcx.tgz"}]}]}}`
+	newManifest := `{"kind": "torcx-remote-contents-v1", "value": {"images": [
+		{"name": "docker", "defaultVersion": "20.10", "versions": [
+			{"version": "19.03", "format": "tgz", "hash": "sha512-x", "location": "docker-19.03.torcx.tgz"},
+			{"version": "20.10", "format": "tgz", "hash": "sha512-d", "location": "docker-20.10.torcx.tgz"}]},
+		{"name": "rkt", "defaultVersion": "1", "versions": [
+			{"version": "1", "format": "tgz", "hash": "sha512-c", "location": "rkt-1.torcx.tgz"}]}]}}`
+
+	dir, err := ioutil.TempDir("", "torcx_contents_diff_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := writeCachedContents(dir, "com.example", oldManifest); err != nil {
+		t.Fatal(err)
+	}
+	oldContents, err := readCachedContents(dir, "com.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newContents, err := decodeContents(newManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ContentsDiff{
+		{
+			Image:      "docker",
+			Added:      []string{"20.10"},
+			Removed:    []string{"18.06"},
+			Changed:    []string{"19.03"},
+			OldDefault: "19.03",
+			NewDefault: "20.10",
+		},
+	}
+	diffs := DiffRemoteContents(oldContents, newContents)
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("expected %+v, got %+v", expected, diffs)
+	}
+
+	diffs = DiffRemoteContents(nil, newContents)
+	if len(diffs) != 2 || len(diffs[0].Added) != 2 || len(diffs[1].Added) != 1 {
+		t.Errorf("unexpected diff against empty manifest %+v", diffs)
+	}
+}
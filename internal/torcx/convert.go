@@ -0,0 +1,337 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/sys/unix"
+
+	pkgtar "github.com/flatcar-linux/torcx/pkg/tar"
+)
+
+// mksquashfsBinary is the tool used to create squashfs archives.
+var mksquashfsBinary = "mksquashfs"
+
+// mkfsErofsBinary is the tool used to create EROFS archives.
+var mkfsErofsBinary = "mkfs.erofs"
+
+// ParseArchiveFormat parses the name of an archive format.
+func ParseArchiveFormat(s string) (ArchiveFormat, error) {
+	switch s {
+	case ArchiveFormatTgz:
+		return ArchiveFormatTgz, nil
+	case ArchiveFormatSquashfs:
+		return ArchiveFormatSquashfs, nil
+	case ArchiveFormatZst:
+		return ArchiveFormatZst, nil
+	case ArchiveFormatTxz:
+		return ArchiveFormatTxz, nil
+	case ArchiveFormatErofs:
+		return ArchiveFormatErofs, nil
+	}
+	return ArchiveFormatUnknown, errors.Errorf("unknown archive format %q, must be one of %q, %q, %q, %q, %q", s, ArchiveFormatTgz, ArchiveFormatSquashfs, ArchiveFormatZst, ArchiveFormatTxz, ArchiveFormatErofs)
+}
+
+// ExportArchive writes the archive `ar` to `w`, converting it to `format`.
+// Archives with a recorded hash are verified before being exported.
+func ExportArchive(ar Archive, format ArchiveFormat, w io.Writer) error {
+	if err := verifyArchive(ar); err != nil {
+		return errors.Wrapf(err, "failed to verify %s", ar.Filepath)
+	}
+
+	srcPath := ar.Filepath
+	if format != ar.Format {
+		tmpDir, err := ioutil.TempDir("", "torcx-export")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+		srcPath = filepath.Join(tmpDir, "archive"+format.FileSuffix())
+		if err := ConvertArchive(ar, format, srcPath); err != nil {
+			return err
+		}
+	}
+
+	fp, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	_, err = io.Copy(w, bufio.NewReader(fp))
+	return err
+}
+
+// ConvertArchive converts the archive `src` to `format`, writing the
+// result to `destPath`. Archive contents (including the image manifest)
+// are preserved.
+func ConvertArchive(src Archive, format ArchiveFormat, destPath string) error {
+	if src.Format == format {
+		return copyFile(src.Filepath, destPath)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "torcx-convert")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	rootDir := filepath.Join(tmpDir, "rootfs")
+	if err := os.Mkdir(rootDir, 0755); err != nil {
+		return err
+	}
+
+	cleanup, err := expandArchive(src, rootDir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to expand %s", src.Filepath)
+	}
+	defer cleanup()
+
+	logrus.WithFields(logrus.Fields{
+		"source": src.Filepath,
+		"format": format,
+		"target": destPath,
+	}).Debug("converting archive")
+	return writeArchive(rootDir, format, destPath)
+}
+
+// ConvertStoredArchive converts the stored archive `ar` to `format`, placing
+// the result next to it (or in the user store, if `ar` is in a read-only
+// store) and recording its hash. If `replace` is set, the source archive
+// is removed once converted.
+func ConvertStoredArchive(cc *CommonConfig, ar Archive, format ArchiveFormat, replace bool) (Archive, error) {
+	if cc == nil {
+		return Archive{}, errors.New("nil CommonConfig")
+	}
+	if ar.Format == format {
+		return Archive{}, errors.Errorf("archive %s is already in %s format", ar.Filepath, format)
+	}
+	if err := verifyArchive(ar); err != nil {
+		return Archive{}, errors.Wrapf(err, "failed to verify %s", ar.Filepath)
+	}
+
+	destDir := filepath.Dir(ar.Filepath)
+	if !isWritableStore(cc, destDir) {
+		if replace {
+			return Archive{}, errors.Errorf("cannot replace %s in a read-only store", ar.Filepath)
+		}
+		destDir = cc.UserStorePath("")
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			return Archive{}, err
+		}
+	}
+
+	fileName := ar.Name + ":" + ar.Reference + format.FileSuffix()
+	destPath := filepath.Join(destDir, fileName)
+	if IsExistingPath(destPath) {
+		return Archive{}, errors.Errorf("target archive %s already exists", destPath)
+	}
+	tmpPath := partialPath(destDir, fileName, "")
+	defer os.Remove(tmpPath)
+	if err := ConvertArchive(ar, format, tmpPath); err != nil {
+		return Archive{}, err
+	}
+
+	// Converted archives have new contents, thus a new digest.
+	hash, err := computeHash(tmpPath)
+	if err != nil {
+		return Archive{}, errors.Wrapf(err, "failed to hash %s", tmpPath)
+	}
+	if err := installArchive(tmpPath, destPath, hash, 0); err != nil {
+		return Archive{}, err
+	}
+
+	if replace {
+		for _, p := range []string{ar.Filepath + hashSidecarSuffix, ar.Filepath + metaSidecarSuffix, ar.Filepath} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return Archive{}, err
+			}
+		}
+		updateStoreIndex(destDir)
+	}
+
+	return Archive{ar.Image, destPath, format}, nil
+}
+
+// computeHash returns the hash of the file at `path` with HashAlgorithm,
+// in the format used by remote contents manifests (e.g. "sha512-<hex>").
+func computeHash(path string) (string, error) {
+	return hashFile(path, HashAlgorithm)
+}
+
+// expandArchive makes the contents of `ar` available under `rootDir`,
+// returning a cleanup function to be called once done.
+func expandArchive(ar Archive, rootDir string) (func(), error) {
+	noop := func() {}
+	privileged := os.Geteuid() == 0
+
+	switch ar.Format {
+	case ArchiveFormatTgz, ArchiveFormatZst, ArchiveFormatTxz:
+		fp, err := os.Open(ar.Filepath)
+		if err != nil {
+			return noop, err
+		}
+		defer fp.Close()
+		dr, err := decompressTarball(ar.Filepath, bufio.NewReader(fp))
+		if err != nil {
+			return noop, err
+		}
+		defer dr.Close()
+
+		untarCfg := pkgtar.ExtractCfg{}.Default()
+		untarCfg.Chown = privileged
+		untarCfg.XattrPrivileged = privileged
+		return noop, pkgtar.ExtractDir(tar.NewReader(dr), rootDir, untarCfg)
+	case ArchiveFormatSquashfs:
+		if !privileged {
+			return noop, errors.New("expanding squashfs archives requires root privileges")
+		}
+		if err := DefaultMounter.MountSquashfs(ar.Filepath, rootDir); err != nil {
+			return noop, err
+		}
+		return func() { DefaultMounter.Unmount(rootDir, unix.MNT_DETACH) }, nil
+	case ArchiveFormatErofs:
+		return noop, extractErofs(ar.Filepath, rootDir)
+	default:
+		return noop, errors.Errorf("unsupported source format %q", ar.Format)
+	}
+}
+
+// writeArchive creates an archive of `format` at `destPath` with the
+// contents of `rootDir`.
+func writeArchive(rootDir string, format ArchiveFormat, destPath string) error {
+	switch format {
+	case ArchiveFormatTgz:
+		return writeTgz(rootDir, destPath)
+	case ArchiveFormatSquashfs:
+		return writeSquashfs(rootDir, destPath)
+	case ArchiveFormatZst:
+		return writeZst(rootDir, destPath)
+	case ArchiveFormatTxz:
+		return writeTxz(rootDir, destPath)
+	case ArchiveFormatErofs:
+		return writeErofs(rootDir, destPath)
+	default:
+		return errors.Errorf("unsupported target format %q", format)
+	}
+}
+
+// writeTgz creates a tgz archive at `destPath` with the contents of `rootDir`.
+func writeTgz(rootDir string, destPath string) error {
+	return writeTarball(rootDir, destPath, func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	})
+}
+
+// writeZst creates a zst archive at `destPath` with the contents of `rootDir`.
+func writeZst(rootDir string, destPath string) error {
+	return writeTarball(rootDir, destPath, func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w)
+	})
+}
+
+// writeTxz creates a txz archive at `destPath` with the contents of `rootDir`.
+func writeTxz(rootDir string, destPath string) error {
+	return writeTarball(rootDir, destPath, func(w io.Writer) (io.WriteCloser, error) {
+		return xz.NewWriter(w)
+	})
+}
+
+// writeTarball creates a tarball at `destPath` with the contents of
+// `rootDir`, compressed by the writer returned by `compress`.
+func writeTarball(rootDir string, destPath string, compress func(io.Writer) (io.WriteCloser, error)) error {
+	fp, err := os.OpenFile(destPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	bufwr := bufio.NewWriter(fp)
+	cw, err := compress(bufwr)
+	if err != nil {
+		return err
+	}
+
+	if err := pkgtar.Create(cw, rootDir); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if err := bufwr.Flush(); err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
+// writeSquashfs creates a squashfs archive at `destPath` with the contents
+// of `rootDir`. When unprivileged, ownership cannot be preserved on expansion
+// and all files are recorded as owned by root.
+func writeSquashfs(rootDir string, destPath string) error {
+	args := []string{rootDir, destPath, "-noappend", "-no-progress"}
+	if os.Geteuid() != 0 {
+		args = append(args, "-all-root")
+	}
+	cmd := exec.Command(mksquashfsBinary, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "%s failed: %s", mksquashfsBinary, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// writeErofs creates an EROFS archive at `destPath` with the contents of
+// `rootDir`. As for squashfs, all files are recorded as owned by root when
+// unprivileged.
+func writeErofs(rootDir string, destPath string) error {
+	args := []string{}
+	if os.Geteuid() != 0 {
+		args = append(args, "--all-root")
+	}
+	args = append(args, destPath, rootDir)
+	out, err := exec.Command(mkfsErofsBinary, args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "%s failed: %s", mkfsErofsBinary, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// copyFile copies the regular file at `srcPath` to `destPath`.
+func copyFile(srcPath string, destPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, err := os.OpenFile(destPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	if _, err := io.Copy(dest, src); err != nil {
+		return err
+	}
+	return dest.Close()
+}
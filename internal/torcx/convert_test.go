@@ -0,0 +1,244 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// writeTestTgz writes a tgz archive at `path` with regular `files`.
+func writeTestTgz(t *testing.T, path string, files map[string]string) {
+	fp, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	gw := gzip.NewWriter(fp)
+	tw := tar.NewWriter(gw)
+
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(files[name])),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpandRepackTgz(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_convert_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/foo"]}}`,
+		"bin/foo":              "foo",
+	}
+	srcPath := filepath.Join(dir, "foo:1.torcx.tgz")
+	writeTestTgz(t, srcPath, files)
+	src := Archive{Image{Name: "foo", Reference: "1"}, srcPath, ArchiveFormatTgz}
+
+	rootDir := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cleanup, err := expandArchive(src, rootDir)
+	if err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	defer cleanup()
+	destPath := filepath.Join(dir, "out.torcx.tgz")
+	if err := writeTgz(rootDir, destPath); err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+
+	meta, err := ReadArchiveMetadata(Archive{src.Image, destPath, ArchiveFormatTgz})
+	if err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	if len(meta.Assets.Binaries) != 1 || meta.Assets.Binaries[0] != "/bin/foo" {
+		t.Errorf("manifest not preserved: %v", meta.Assets)
+	}
+}
+
+func TestExportArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_export_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srcPath := filepath.Join(dir, "foo:1.torcx.tgz")
+	writeTestTgz(t, srcPath, map[string]string{"bin/foo": "foo"})
+	src := Archive{Image{Name: "foo", Reference: "1"}, srcPath, ArchiveFormatTgz}
+	content, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := ExportArchive(src, ArchiveFormatTgz, &out); err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Error("exported archive differs from source")
+	}
+
+	// Corrupted archives are not exported.
+	if err := writeHashSidecar(srcPath, "sha512-00"); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := ExportArchive(src, ArchiveFormatTgz, &out); err == nil {
+		t.Error("expected error exporting corrupted archive")
+	}
+}
+
+func TestConvertStoredArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_convert_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Fake mksquashfs, writing a marker into the target archive.
+	fakeTool := filepath.Join(dir, "mksquashfs")
+	script := "#!/bin/sh\ntest -f \"$1/bin/foo\" && echo squashfs > \"$2\"\n"
+	if err := ioutil.WriteFile(fakeTool, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldTool := mksquashfsBinary
+	mksquashfsBinary = fakeTool
+	defer func() { mksquashfsBinary = oldTool }()
+
+	cc := &CommonConfig{
+		BaseDir: filepath.Join(dir, "base"),
+		UsrDir:  filepath.Join(dir, "usr"),
+	}
+	store := cc.UserStorePath("")
+	cc.StorePaths = []string{store}
+	if err := os.MkdirAll(store, 0755); err != nil {
+		t.Fatal(err)
+	}
+	srcPath := filepath.Join(store, "foo:1.torcx.tgz")
+	writeTestTgz(t, srcPath, map[string]string{"bin/foo": "foo"})
+	src := Archive{Image{Name: "foo", Reference: "1"}, srcPath, ArchiveFormatTgz}
+
+	converted, err := ConvertStoredArchive(cc, src, ArchiveFormatSquashfs, true)
+	if err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	if converted.Filepath != filepath.Join(store, "foo:1.torcx.squashfs") {
+		t.Fatalf("unexpected target %s", converted.Filepath)
+	}
+	if err := verifyArchive(converted); err != nil {
+		t.Errorf("converted archive failed verification: %s", err)
+	}
+	if hash, err := readHashSidecar(converted.Filepath); err != nil || hash == "" {
+		t.Errorf("hash not recorded: %v", err)
+	}
+	if IsExistingPath(srcPath) {
+		t.Error("source archive not replaced")
+	}
+}
+
+func TestTarballArchives(t *testing.T) {
+	for _, format := range []ArchiveFormat{ArchiveFormatZst, ArchiveFormatTxz} {
+		t.Run(string(format), func(t *testing.T) {
+			testTarballArchive(t, format)
+		})
+	}
+}
+
+// testTarballArchive checks that archives converted to the tarball
+// `format` are discovered in stores, inspected and unpacked.
+func testTarballArchive(t *testing.T, format ArchiveFormat) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "foo:1.torcx.tgz")
+	writeTestTgz(t, srcPath, map[string]string{
+		".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/foo"]}}`,
+		"bin/foo":              "foo",
+	})
+	storeDir := filepath.Join(dir, "store")
+	if err := os.Mkdir(storeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	destPath := filepath.Join(storeDir, "foo:1"+format.FileSuffix())
+	src := Archive{Image{Name: "foo", Reference: "1"}, srcPath, ArchiveFormatTgz}
+	if err := ConvertArchive(src, format, destPath); err != nil {
+		t.Fatal(err)
+	}
+
+	sc, err := NewStoreCache([]string{storeDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar, err := sc.ArchiveFor(src.Image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ar.Format != format || ar.Filepath != destPath {
+		t.Errorf("unexpected archive %+v", ar)
+	}
+	var parsed ArchiveFormat
+	if err := json.Unmarshal([]byte(`"`+format+`"`), &parsed); err != nil || parsed != format {
+		t.Errorf("unexpected format %q (%v)", parsed, err)
+	}
+
+	meta, err := ReadArchiveMetadata(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Assets.Binaries) != 1 || meta.Assets.Binaries[0] != "/bin/foo" {
+		t.Errorf("manifest not preserved: %v", meta.Assets)
+	}
+	applyCfg := &ApplyConfig{CommonConfig: CommonConfig{RunDir: filepath.Join(dir, "run")}}
+	root, err := unpackTgzUser(applyCfg, ar.Filepath, "foo", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "bin", "foo")); err != nil || string(b) != "foo" {
+		t.Errorf("unexpected unpacked content %q (%v)", b, err)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// credentialHelperPrefix is prepended to helper names to find their
+	// executable, for compatibility with docker credential helpers.
+	credentialHelperPrefix = "docker-credential-"
+	// credentialHelperTimeout bounds each credential helper invocation.
+	credentialHelperTimeout = 30 * time.Second
+	// credentialsNotFound is the message helpers print when they have no
+	// credentials for a server.
+	credentialsNotFound = "credentials not found"
+	// identityTokenUsername marks helper credentials carrying a bearer token.
+	identityTokenUsername = "<token>"
+	// credentialsDirEnv is set by systemd to the directory holding the
+	// credentials passed to a unit.
+	credentialsDirEnv = "CREDENTIALS_DIRECTORY"
+	// remoteCredentialPrefix is prepended to remote names for the systemd
+	// credential used by default for a remote, e.g. `torcx.remote.stable`.
+	remoteCredentialPrefix = "torcx.remote."
+)
+
+// helperCredentials are the credentials returned by a helper `get` call.
+type helperCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// credentialTransport is a RoundTripper authenticating requests with
+// credentials provided by a helper executable, following the docker
+// credential helpers protocol: the helper is run as `<helper> get` with the
+// server URL on stdin, and prints the credentials as JSON on stdout.
+// Alternatively, credentials in the same format can be read from a systemd
+// credential. Credentials are only requested for HTTPS (or loopback)
+// servers, and are cached per server for the lifetime of the transport.
+type credentialTransport struct {
+	base http.RoundTripper
+	// lookup returns the credentials for a server, or nil if there are none.
+	lookup func(ctx context.Context, server string) (*helperCredentials, error)
+
+	mu    sync.Mutex
+	cache map[string]*helperCredentials
+}
+
+// newCredentialTransport returns a transport wrapping `base`, authenticating
+// requests via the credential helper `helper`.
+func newCredentialTransport(base http.RoundTripper, helper string) *credentialTransport {
+	return &credentialTransport{
+		base: base,
+		lookup: func(ctx context.Context, server string) (*helperCredentials, error) {
+			return runCredentialHelper(ctx, helper, server)
+		},
+		cache: map[string]*helperCredentials{},
+	}
+}
+
+// newSystemdCredentialTransport returns a transport wrapping `base`,
+// authenticating requests with the systemd credential `name`.
+func newSystemdCredentialTransport(base http.RoundTripper, name string) *credentialTransport {
+	return &credentialTransport{
+		base: base,
+		lookup: func(_ context.Context, server string) (*helperCredentials, error) {
+			return readSystemdCredentials(name, server)
+		},
+		cache: map[string]*helperCredentials{},
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *credentialTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" || !credentialsAllowed(req) {
+		return t.base.RoundTrip(req)
+	}
+	server := req.URL.Scheme + "://" + req.URL.Host
+	creds, err := t.credentials(req.Context(), server)
+	if err != nil {
+		return nil, err
+	}
+	if creds == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the original request.
+	authReq := req.Clone(req.Context())
+	if creds.Username == identityTokenUsername {
+		authReq.Header.Set("Authorization", "Bearer "+creds.Secret)
+	} else {
+		authReq.SetBasicAuth(creds.Username, creds.Secret)
+	}
+	return t.base.RoundTrip(authReq)
+}
+
+// credentials returns the (cached) credentials for `server`, or nil if the
+// helper has none.
+func (t *credentialTransport) credentials(ctx context.Context, server string) (*helperCredentials, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if creds, ok := t.cache[server]; ok {
+		return creds, nil
+	}
+	creds, err := t.lookup(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	t.cache[server] = creds
+	return creds, nil
+}
+
+// runCredentialHelper asks `helper` for the credentials of `server`.
+func runCredentialHelper(ctx context.Context, helper string, server string) (*helperCredentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, credentialHelperTimeout)
+	defer cancel()
+
+	path := credentialHelperPath(helper)
+	cmd := exec.CommandContext(ctx, path, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		out := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(strings.ToLower(out), credentialsNotFound) {
+			logrus.WithFields(logrus.Fields{
+				"helper": helper,
+				"server": server,
+			}).Debug("no credentials from helper")
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "credential helper %s failed: %s", helper, out)
+	}
+
+	var creds helperCredentials
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return nil, errors.Wrapf(err, "invalid output from credential helper %s", helper)
+	}
+	if creds.Secret == "" {
+		return nil, nil
+	}
+	return &creds, nil
+}
+
+// credentialHelperPath returns the executable for `helper`: absolute paths
+// are used as-is, while names are looked up as `docker-credential-<name>`.
+func credentialHelperPath(helper string) string {
+	if filepath.IsAbs(helper) {
+		return helper
+	}
+	return credentialHelperPrefix + helper
+}
+
+// credentialsAllowed returns whether credentials may be sent along `req`,
+// i.e. over HTTPS, or to a loopback server.
+func credentialsAllowed(req *http.Request) bool {
+	if req.URL.Scheme == "https" {
+		return true
+	}
+	if req.URL.Scheme != "http" {
+		return false
+	}
+	host := req.URL.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// readSystemdCredentials reads the credentials for `server` from the systemd
+// credential `name`, holding them in the credential helpers output format.
+// Credentials bound to another server (by their ServerURL) are skipped.
+func readSystemdCredentials(name string, server string) (*helperCredentials, error) {
+	path, err := systemdCredentialPath(name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading credential %s", name)
+	}
+	var creds helperCredentials
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return nil, errors.Wrapf(err, "invalid credential %s", name)
+	}
+	if creds.Secret == "" {
+		return nil, nil
+	}
+	if creds.ServerURL != "" && strings.TrimSuffix(creds.ServerURL, "/") != server {
+		logrus.WithFields(logrus.Fields{
+			"credential": name,
+			"server":     server,
+		}).Debug("credential bound to another server")
+		return nil, nil
+	}
+	return &creds, nil
+}
+
+// systemdCredentialPath returns the path of the systemd credential `name`
+// passed to the current unit, via LoadCredential= (or its variants) or
+// ImportCredential=.
+func systemdCredentialPath(name string) (string, error) {
+	if err := validateCredentialName(name); err != nil {
+		return "", err
+	}
+	dir := os.Getenv(credentialsDirEnv)
+	if dir == "" {
+		return "", errors.Errorf("credential %s not passed, %s is unset", name, credentialsDirEnv)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// hasSystemdCredential returns whether the systemd credential `name` was
+// passed to the current unit.
+func hasSystemdCredential(name string) bool {
+	path, err := systemdCredentialPath(name)
+	return err == nil && IsExistingPath(path)
+}
+
+// validateCredentialName checks `name` is a valid systemd credential name.
+func validateCredentialName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return errors.Errorf("invalid credential name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// devMarker is written at the top of dev trees, so that only trees
+// previously created by a dev apply are ever torn down.
+const devMarker = ".torcx-dev"
+
+// DevWatchPaths returns the paths watched for changes in dev mode: the
+// user store (including versioned subdirectories), user profiles and the
+// next-profile selection.
+func (cc *CommonConfig) DevWatchPaths() []string {
+	return []string{cc.UserStorePath(""), cc.UserProfileDir(), cc.NextProfile()}
+}
+
+// DevApply tears down the dev tree at `target` and simulates a fresh apply
+// into it (see SimulateApply).
+func DevApply(applyCfg *ApplyConfig, target string) error {
+	if err := DevTeardown(target); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(target, devMarker), nil, 0644); err != nil {
+		return errors.Wrap(err, "marking dev tree")
+	}
+	return SimulateApply(applyCfg, target)
+}
+
+// DevTeardown removes the dev tree at `target`. Non-empty directories not
+// created by DevApply are refused, to avoid removing unrelated data.
+func DevTeardown(target string) error {
+	files, err := ioutil.ReadDir(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	if !IsExistingPath(filepath.Join(target, devMarker)) {
+		return errors.Errorf("refusing to tear down %s, not a dev tree", target)
+	}
+	for _, fi := range files {
+		if err := os.RemoveAll(filepath.Join(target, fi.Name())); err != nil {
+			return errors.Wrapf(err, "tearing down %s", target)
+		}
+	}
+	return nil
+}
+
+// WatchPaths calls `onChange` once, then whenever the content of `paths`
+// changes, as polled every `interval`, until `ctx` is done. Errors from
+// `onChange` are logged, and watching continues.
+func WatchPaths(ctx context.Context, paths []string, interval time.Duration, onChange func() error) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := ""
+	for {
+		fingerprint, err := pathsFingerprint(paths)
+		if err != nil {
+			logrus.WithField("error", err).Warn("unable to scan watched paths")
+		} else if fingerprint != last {
+			last = fingerprint
+			if err := onChange(); err != nil {
+				logrus.WithField("error", err).Error("dev apply failed")
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// pathsFingerprint summarizes the names, sizes and modification times of
+// all files below `paths`. Missing paths are part of the summary.
+func pathsFingerprint(paths []string) (string, error) {
+	h := sha256.New()
+	for _, root := range paths {
+		err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					fmt.Fprintf(h, "%s missing\n", path)
+					return nil
+				}
+				return err
+			}
+			fmt.Fprintf(h, "%s %v %d %d\n", path, fi.Mode(), fi.Size(), fi.ModTime().UnixNano())
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
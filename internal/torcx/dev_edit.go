@@ -0,0 +1,121 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// DevOverlay is a writable overlay mounted on the unpack root of an
+// applied image, for editing its contents in place.
+type DevOverlay struct {
+	Name string `json:"name"`
+	// Root is the unpack root the overlay is mounted on.
+	Root string `json:"root"`
+	// Upper holds the files modified through the overlay.
+	Upper string `json:"upper"`
+}
+
+// devOverlay returns the overlay layout of image `name`.
+func (cc *CommonConfig) devOverlay(name string) DevOverlay {
+	return DevOverlay{
+		Name:  name,
+		Root:  filepath.Join(cc.RunUnpackDir(), imagePathName(name)),
+		Upper: filepath.Join(cc.RunDevDir(), imagePathName(name), "upper"),
+	}
+}
+
+// DevEdit mounts a writable overlay on the unpack root of the applied
+// image `name`, backed by a scratch directory under RunDevDir, so that
+// its binaries and assets can be hot-patched. Propagated copies (e.g.
+// systemd units) are not updated until the next apply.
+func DevEdit(cc *CommonConfig, name string) (*DevOverlay, error) {
+	if cc == nil {
+		return nil, errors.New("nil CommonConfig")
+	}
+	if name == "" {
+		return nil, errors.New("missing image name")
+	}
+	overlay := cc.devOverlay(name)
+	if fi, err := os.Stat(overlay.Root); err != nil || !fi.IsDir() {
+		return nil, errors.Errorf("image %s is not unpacked", name)
+	}
+	scratch := filepath.Dir(overlay.Upper)
+	if IsExistingPath(scratch) {
+		return nil, errors.Errorf("image %s is already being edited", name)
+	}
+	work := filepath.Join(scratch, "work")
+	for _, dir := range []string{overlay.Upper, work} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	// The lower layer is resolved before the overlay hides it.
+	opts := "lowerdir=" + overlay.Root + ",upperdir=" + overlay.Upper + ",workdir=" + work
+	if err := cc.mounter().Mount("overlay", overlay.Root, "overlay", 0, opts); err != nil {
+		os.RemoveAll(scratch)
+		return nil, errors.Wrapf(err, "failed to mount overlay on %s", overlay.Root)
+	}
+	logrus.WithFields(logrus.Fields{
+		"image": name,
+		"root":  overlay.Root,
+		"upper": overlay.Upper,
+	}).Info("image overlay mounted")
+	return &overlay, nil
+}
+
+// DevDiscard unmounts the overlay of image `name` and removes its scratch
+// directory, reverting the image to its unpacked contents.
+func DevDiscard(cc *CommonConfig, name string) error {
+	if cc == nil {
+		return errors.New("nil CommonConfig")
+	}
+	overlay := cc.devOverlay(name)
+	scratch := filepath.Dir(overlay.Upper)
+	if !IsExistingPath(scratch) {
+		return errors.Errorf("image %s is not being edited", name)
+	}
+	if err := cc.mounter().Unmount(overlay.Root, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+		return errors.Wrapf(err, "failed to unmount overlay on %s", overlay.Root)
+	}
+	return os.RemoveAll(scratch)
+}
+
+// DevExport writes the current contents of the unpack root of image
+// `name` (including edits through its overlay, if any) as a new archive
+// of `format` at `destPath`.
+func DevExport(cc *CommonConfig, name string, format ArchiveFormat, destPath string) error {
+	if cc == nil {
+		return errors.New("nil CommonConfig")
+	}
+	root := cc.devOverlay(name).Root
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		return errors.Errorf("image %s is not unpacked", name)
+	}
+
+	// Write to a temporary file first, not to leave partial exports.
+	tmpPath := destPath + ".partial"
+	defer os.Remove(tmpPath)
+	if err := writeArchive(root, format, tmpPath); err != nil {
+		return errors.Wrapf(err, "failed to export %s", name)
+	}
+	return os.Rename(tmpPath, destPath)
+}
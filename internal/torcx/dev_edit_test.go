@@ -0,0 +1,78 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDevEdit(t *testing.T) {
+	dir := t.TempDir()
+	mounter := &fakeMounter{}
+	cc := &CommonConfig{
+		RunDir:  filepath.Join(dir, "run"),
+		Mounter: mounter,
+	}
+	if _, err := DevEdit(cc, "foo"); err == nil {
+		t.Fatal("expected error editing a missing image")
+	}
+
+	root := filepath.Join(cc.RunUnpackDir(), "foo")
+	if err := os.MkdirAll(filepath.Join(root, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "bin", "foo"), []byte("patched"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	overlay, err := DevEdit(cc, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overlay.Root != root || !IsExistingPath(overlay.Upper) {
+		t.Errorf("unexpected overlay %+v", overlay)
+	}
+	if expected := []string{"overlay:" + root}; !reflect.DeepEqual(mounter.mounts, expected) {
+		t.Errorf("expected mounts %v, got %v", expected, mounter.mounts)
+	}
+	if _, err := DevEdit(cc, "foo"); err == nil {
+		t.Error("expected error editing an image twice")
+	}
+
+	archive := Archive{Filepath: filepath.Join(dir, "foo:dev.torcx.tgz"), Format: ArchiveFormatTgz}
+	if err := DevExport(cc, "foo", ArchiveFormatTgz, archive.Filepath); err != nil {
+		t.Fatal(err)
+	}
+	expanded := filepath.Join(dir, "expanded")
+	if _, err := expandArchive(archive, expanded); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(expanded, "bin", "foo")); err != nil || string(b) != "patched" {
+		t.Errorf("unexpected exported content %q (%v)", b, err)
+	}
+
+	if err := DevDiscard(cc, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if IsExistingPath(filepath.Dir(overlay.Upper)) {
+		t.Error("scratch directory not removed")
+	}
+	if err := DevDiscard(cc, "foo"); err == nil {
+		t.Error("expected error discarding an image not being edited")
+	}
+}
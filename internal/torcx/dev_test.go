@@ -0,0 +1,77 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDevTeardown(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "data"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := DevTeardown(dir); err == nil {
+		t.Fatal("expected unmarked tree to be refused")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, devMarker), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := DevTeardown(dir); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("unexpected leftovers %v", files)
+	}
+	if err := DevTeardown(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("unexpected error for missing tree: %s", err)
+	}
+}
+
+func TestWatchPaths(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	runs := 0
+	err := WatchPaths(ctx, []string{dir, filepath.Join(dir, "missing")}, time.Millisecond, func() error {
+		runs++
+		switch runs {
+		case 1:
+			return ioutil.WriteFile(filepath.Join(dir, "foo:1.torcx.tgz"), []byte("foo"), 0644)
+		case 2:
+			return os.Remove(filepath.Join(dir, "foo:1.torcx.tgz"))
+		default:
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if runs != 3 {
+		t.Errorf("expected 3 runs, got %d", runs)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// dialTimeout bounds each single connection attempt.
+	dialTimeout = 10 * time.Second
+	// attemptDelay is the delay between racing connection attempts (RFC 8305).
+	attemptDelay = 250 * time.Millisecond
+	// tlsHandshakeTimeout bounds TLS handshakes with remotes.
+	tlsHandshakeTimeout = 10 * time.Second
+	// responseHeaderTimeout bounds the wait for response headers from remotes.
+	responseHeaderTimeout = 30 * time.Second
+)
+
+// httpClient returns an HTTP client for this remote, honoring its
+// DNS servers and static host mappings.
+func (r *Remote) httpClient() *http.Client {
+	return r.newHTTPClient(http.ProxyFromEnvironment)
+}
+
+// archiveClient returns an HTTP client for fetching archives from this
+// remote, routed through its archive proxy (if any).
+func (r *Remote) archiveClient() (*http.Client, error) {
+	if r.ArchiveProxy == "" {
+		return r.httpClient(), nil
+	}
+	proxyURL, err := url.Parse(r.ArchiveProxy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid archive proxy %q", r.ArchiveProxy)
+	}
+	return r.newHTTPClient(http.ProxyURL(proxyURL)), nil
+}
+
+// newHTTPClient returns an HTTP client for this remote, using `proxy`.
+func (r *Remote) newHTTPClient(proxy func(*http.Request) (*url.URL, error)) *http.Client {
+	transport := r.Transport
+	if transport == nil {
+		transport = &http.Transport{
+			Proxy:                 proxy,
+			DialContext:           r.dialContext,
+			TLSHandshakeTimeout:   tlsHandshakeTimeout,
+			ResponseHeaderTimeout: responseHeaderTimeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConns:          10,
+		}
+	}
+	switch {
+	case r.Credential != "":
+		transport = newSystemdCredentialTransport(transport, r.Credential)
+	case r.CredentialHelper != "":
+		transport = newCredentialTransport(transport, r.CredentialHelper)
+	}
+	return &http.Client{
+		Transport: transport,
+	}
+}
+
+// httpClient returns an HTTP client for requests not bound to a remote,
+// using the configured Transport (if any).
+func (cc *CommonConfig) httpClient() *http.Client {
+	if cc == nil || cc.Transport == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{
+		Transport: cc.Transport,
+	}
+}
+
+// resolver returns the DNS resolver for this remote.
+func (r *Remote) resolver() *net.Resolver {
+	if r == nil || len(r.DNSServers) == 0 {
+		return net.DefaultResolver
+	}
+
+	servers := r.DNSServers
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			// Rotate across configured servers on each query.
+			server := servers[int(atomic.AddUint32(&next, 1)-1)%len(servers)]
+			d := net.Dialer{Timeout: dialTimeout}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// dialContext resolves `addr` according to this remote configuration,
+// then races connections to all resolved addresses.
+func (r *Remote) dialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if static, ok := r.Hosts[host]; ok && len(static) > 0 {
+		for _, s := range static {
+			if ip := net.ParseIP(s); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	} else if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		ipAddrs, err := r.resolver().LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ia := range ipAddrs {
+			ips = append(ips, ia.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.Errorf("no addresses for host %s", host)
+	}
+
+	return raceDial(ctx, network, interleaveFamilies(ips), port)
+}
+
+// interleaveFamilies orders addresses alternating between IPv6 and IPv4,
+// starting with the family of the first address (RFC 8305, section 4).
+func interleaveFamilies(ips []net.IP) []net.IP {
+	var first, second []net.IP
+	firstIsV4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == firstIsV4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+
+	res := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			res = append(res, first[i])
+		}
+		if i < len(second) {
+			res = append(res, second[i])
+		}
+	}
+	return res
+}
+
+// raceDial starts staggered connection attempts to all `ips`, returning
+// the first established connection and canceling all others.
+func raceDial(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(ips))
+	dialer := net.Dialer{Timeout: dialTimeout}
+
+	started := 0
+	failed := 0
+	var lastErr error
+	// closeLate drains pending attempts in the background, closing late winners.
+	closeLate := func(pending int) {
+		go func() {
+			for i := 0; i < pending; i++ {
+				if late := <-results; late.conn != nil {
+					late.conn.Close()
+				}
+			}
+		}()
+	}
+	for started < len(ips) || failed < started {
+		var delay <-chan time.Time
+		if started < len(ips) {
+			ip := ips[started]
+			started++
+			go func() {
+				conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+				results <- result{conn, err}
+			}()
+			delay = time.After(attemptDelay)
+		}
+
+		select {
+		case res := <-results:
+			if res.err == nil {
+				closeLate(started - failed - 1)
+				return res.conn, nil
+			}
+			failed++
+			lastErr = res.err
+		case <-delay:
+		case <-ctx.Done():
+			closeLate(started - failed)
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, errors.Wrap(lastErr, "all connection attempts failed")
+}
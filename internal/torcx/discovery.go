@@ -0,0 +1,114 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// discoveryService is the SRV service name for remote discovery.
+	discoveryService = "torcx"
+	// wellKnownPath is the path of the well-known discovery document.
+	wellKnownPath = "/.well-known/torcx"
+	// maxDiscoverySize bounds the size of a discovery document.
+	maxDiscoverySize = 64 * 1024
+)
+
+// discoverTemplateURL discovers the base URL template of a remote from its
+// discovery domain, first via a `_torcx._tcp` SRV record and then via a
+// well-known document.
+func (r *Remote) discoverTemplateURL(ctx context.Context) (string, error) {
+	if r == nil {
+		return "", errNilRemote
+	}
+	domain := r.DiscoveryDomain
+
+	_, srvs, srvErr := r.resolver().LookupSRV(ctx, discoveryService, "tcp", domain)
+	if srvErr == nil && len(srvs) > 0 {
+		target := strings.TrimSuffix(srvs[0].Target, ".")
+		if target == "" {
+			return "", errors.Errorf("service explicitly unavailable at %s", domain)
+		}
+		host := net.JoinHostPort(target, strconv.Itoa(int(srvs[0].Port)))
+		return replaceURLHost(r.TemplateURL, host), nil
+	}
+
+	tmpl, err := r.fetchWellKnown(ctx, domain)
+	if err != nil {
+		return "", errors.Wrapf(err, "no SRV record (%v) and failed well-known lookup", srvErr)
+	}
+	return tmpl, nil
+}
+
+// fetchWellKnown retrieves the base URL template from the well-known
+// discovery document served on `domain`.
+func (r *Remote) fetchWellKnown(ctx context.Context, domain string) (string, error) {
+	req, err := http.NewRequest("GET", "https://"+domain+wellKnownPath, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := r.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("unexpected HTTP status %q", resp.Status)
+	}
+
+	return decodeDiscovery(io.LimitReader(resp.Body, maxDiscoverySize))
+}
+
+// decodeDiscovery decodes a discovery document, returning its base URL template.
+func decodeDiscovery(rd io.Reader) (string, error) {
+	var doc RemoteDiscoveryV0JSON
+	if err := json.NewDecoder(rd).Decode(&doc); err != nil {
+		return "", errors.Wrap(err, "failed to decode discovery document")
+	}
+	if doc.Kind != RemoteDiscoveryV0K {
+		return "", errors.Errorf("invalid discovery document kind: %s", doc.Kind)
+	}
+	if doc.Value.BaseURL == "" {
+		return "", errEmptyTemplateURL
+	}
+	return doc.Value.BaseURL, nil
+}
+
+// replaceURLHost replaces the authority of URL template `tmpl` with `host`,
+// keeping its scheme and (templated) path. An empty template results in
+// an HTTPS URL rooted at `host`.
+func replaceURLHost(tmpl string, host string) string {
+	sep := strings.Index(tmpl, "://")
+	if tmpl == "" || sep < 0 {
+		return "https://" + host + "/"
+	}
+
+	prefix := tmpl[:sep+len("://")]
+	rest := tmpl[sep+len("://"):]
+	slash := strings.Index(rest, "/")
+	if slash < 0 {
+		return prefix + host + "/"
+	}
+	return prefix + host + rest[slash:]
+}
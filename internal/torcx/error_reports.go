@@ -0,0 +1,209 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ErrorReportsV0K - aggregated error reports kind, v0
+	ErrorReportsV0K = "torcx-error-reports-v0"
+
+	// defaultErrorReportInterval is the default minimum interval between
+	// journal entries for an identical, repeated error.
+	defaultErrorReportInterval = 6 * time.Hour
+	// errorReportExpiry is how long an error which did not occur again is
+	// remembered.
+	errorReportExpiry = 24 * time.Hour
+)
+
+// ErrorReport aggregates the occurrences of an identical error.
+type ErrorReport struct {
+	// Source is the periodic run reporting the error (e.g. "verify-state").
+	Source string `json:"source"`
+	// Message is the error message.
+	Message string `json:"message"`
+	// Count is the number of occurrences.
+	Count int `json:"count"`
+	// Suppressed is the number of occurrences not logged since LastReported.
+	Suppressed int `json:"suppressed"`
+	// FirstSeen is when the error first occurred.
+	FirstSeen time.Time `json:"first_seen"`
+	// LastSeen is when the error last occurred.
+	LastSeen time.Time `json:"last_seen"`
+	// LastReported is when the error was last logged.
+	LastReported time.Time `json:"last_reported"`
+}
+
+// ErrorReportsV0JSON holds the aggregated error reports.
+type ErrorReportsV0JSON struct {
+	Kind  string        `json:"kind"`
+	Value []ErrorReport `json:"value"`
+}
+
+// errorReporter logs the errors of a single periodic run, deduplicated and
+// rate-limited across runs: an error already logged less than the report
+// interval ago is only counted, and later logged along with its count,
+// first and last seen timestamps.
+type errorReporter struct {
+	path     string
+	source   string
+	level    logrus.Level
+	interval time.Duration
+	now      time.Time
+
+	reports []ErrorReport
+	seen    map[string]bool
+}
+
+// newErrorReporter returns a reporter logging errors of `source` at `level`
+// (either logrus.ErrorLevel or logrus.WarnLevel), aggregated in the error
+// reports file of `cc`.
+func newErrorReporter(cc *CommonConfig, source string, level logrus.Level) *errorReporter {
+	r := &errorReporter{
+		path:     cc.RunErrorReports(),
+		source:   source,
+		level:    level,
+		interval: defaultErrorReportInterval,
+		now:      time.Now().UTC(),
+		seen:     map[string]bool{},
+	}
+	if cc.ErrorReportInterval != "" {
+		if interval, err := time.ParseDuration(cc.ErrorReportInterval); err == nil {
+			r.interval = interval
+		}
+	}
+	reports, err := readErrorReports(r.path)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		logrus.WithFields(logrus.Fields{
+			"path":  r.path,
+			"error": err,
+		}).Warn("unable to read error reports")
+	}
+	r.reports = reports
+	return r
+}
+
+// report records an occurrence of `message`, logging it with `fields` unless
+// it was already logged less than the report interval ago.
+func (r *errorReporter) report(fields logrus.Fields, message string) {
+	r.seen[message] = true
+	var report *ErrorReport
+	for i := range r.reports {
+		if r.reports[i].Source == r.source && r.reports[i].Message == message {
+			report = &r.reports[i]
+			break
+		}
+	}
+	if report == nil {
+		r.reports = append(r.reports, ErrorReport{
+			Source:    r.source,
+			Message:   message,
+			FirstSeen: r.now,
+		})
+		report = &r.reports[len(r.reports)-1]
+	}
+	report.Count++
+	report.LastSeen = r.now
+
+	if !report.LastReported.IsZero() && r.now.Sub(report.LastReported) < r.interval {
+		report.Suppressed++
+		logrus.WithFields(fields).WithField("count", report.Count).Debug("repeated error suppressed: ", message)
+		return
+	}
+	entry := logrus.WithFields(fields)
+	if report.Count > 1 {
+		entry = entry.WithFields(logrus.Fields{
+			"count":      report.Count,
+			"suppressed": report.Suppressed,
+			"first_seen": report.FirstSeen.Format(time.RFC3339),
+			"last_seen":  report.LastSeen.Format(time.RFC3339),
+		})
+	}
+	if r.level == logrus.WarnLevel {
+		entry.Warn(message)
+	} else {
+		entry.Error(message)
+	}
+	report.Suppressed = 0
+	report.LastReported = r.now
+}
+
+// close forgets the errors of this source which did not occur in this run,
+// as resolved, and saves the reports on a best-effort basis.
+func (r *errorReporter) close() {
+	reports := []ErrorReport{}
+	for _, report := range r.reports {
+		if report.Source == r.source && !r.seen[report.Message] {
+			logrus.WithFields(logrus.Fields{
+				"source": report.Source,
+				"count":  report.Count,
+			}).Info("error resolved: ", report.Message)
+			continue
+		}
+		if r.now.Sub(report.LastSeen) > errorReportExpiry {
+			continue
+		}
+		reports = append(reports, report)
+	}
+	r.reports = reports
+
+	if err := writeErrorReports(r.path, reports); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"path":  r.path,
+			"error": err,
+		}).Warn("unable to write error reports")
+	}
+}
+
+// readErrorReports reads the error reports file at `path`.
+func readErrorReports(path string) ([]ErrorReport, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var record ErrorReportsV0JSON
+	if err := json.Unmarshal(b, &record); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s", path)
+	}
+	if record.Kind != ErrorReportsV0K {
+		return nil, errors.Errorf("invalid error reports kind: %s", record.Kind)
+	}
+	return record.Value, nil
+}
+
+// writeErrorReports atomically writes `reports` at `path`.
+func writeErrorReports(path string, reports []ErrorReport) error {
+	b, err := json.MarshalIndent(ErrorReportsV0JSON{ErrorReportsV0K, reports}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, append(b, '\n'), 0644); err != nil {
+		return errors.Wrapf(err, "writing %q", path)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// warnHook records warning log entries.
+type warnHook struct {
+	entries []*logrus.Entry
+}
+
+func (h *warnHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.WarnLevel}
+}
+
+func (h *warnHook) Fire(e *logrus.Entry) error {
+	h.entries = append(h.entries, e)
+	return nil
+}
+
+func TestErrorReporter(t *testing.T) {
+	cc := &CommonConfig{RunDir: t.TempDir(), ErrorReportInterval: "1h"}
+	hook := &warnHook{}
+	origHooks := logrus.StandardLogger().Hooks
+	defer func() { logrus.StandardLogger().Hooks = origHooks }()
+	logrus.StandardLogger().Hooks = logrus.LevelHooks{}
+	logrus.AddHook(hook)
+
+	run := func(now time.Time, messages ...string) {
+		r := newErrorReporter(cc, "verify-state", logrus.WarnLevel)
+		r.now = now
+		for _, m := range messages {
+			r.report(logrus.Fields{"path": "/foo"}, m)
+		}
+		r.close()
+	}
+	warnings := func() []*logrus.Entry {
+		return hook.entries
+	}
+
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	run(start, "image root missing")
+	run(start.Add(10*time.Minute), "image root missing")
+	run(start.Add(20*time.Minute), "image root missing")
+	if n := len(warnings()); n != 1 {
+		t.Fatalf("expected repeated error to be logged once, got %d entries", n)
+	}
+
+	run(start.Add(61*time.Minute), "image root missing")
+	entries := warnings()
+	if len(entries) != 2 {
+		t.Fatalf("expected repeated error to be logged again after the interval, got %d entries", len(entries))
+	}
+	last := entries[1]
+	if last.Data["count"] != 4 || last.Data["suppressed"] != 2 || last.Data["first_seen"] != start.Format(time.RFC3339) {
+		t.Errorf("unexpected aggregated fields %v", last.Data)
+	}
+
+	// Resolved errors are forgotten, and reported at once on recurrence.
+	run(start.Add(62 * time.Minute))
+	reports, err := readErrorReports(cc.RunErrorReports())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 0 {
+		t.Errorf("expected resolved error to be forgotten, got %+v", reports)
+	}
+	run(start.Add(63*time.Minute), "image root missing")
+	if n := len(warnings()); n != 3 {
+		t.Errorf("expected recurring error to be logged, got %d entries", n)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ApplyEventV0K - apply event record kind, v0
+	ApplyEventV0K = "torcx-apply-event-v0"
+
+	// EventStarted is emitted once profiles have been merged.
+	EventStarted = "started"
+	// EventImageStarted is emitted before applying an image.
+	EventImageStarted = "image-started"
+	// EventImageLocated is emitted once the archive of an image is found.
+	EventImageLocated = "image-located"
+	// EventImageVerified is emitted once an archive passed verification.
+	EventImageVerified = "image-verified"
+	// EventImageMounted is emitted once an image is unpacked or mounted.
+	EventImageMounted = "image-mounted"
+	// EventAssetsPropagated is emitted once image assets are propagated.
+	EventAssetsPropagated = "assets-propagated"
+	// EventImageFailed is emitted when an image fails to apply.
+	EventImageFailed = "image-failed"
+	// EventFinished is emitted once all images have been processed.
+	EventFinished = "finished"
+	// EventSealed is emitted once the system state is sealed.
+	EventSealed = "sealed"
+
+	// eventStreamFdPrefix selects an inherited file descriptor as stream.
+	eventStreamFdPrefix = "fd:"
+)
+
+// ApplyEvent is a single record of an apply event stream.
+type ApplyEvent struct {
+	Kind  string    `json:"kind"`
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	// Image is the image the event is about, if any.
+	Image *Image `json:"image,omitempty"`
+	// Images are the requested (started) or applied (finished) images.
+	Images []Image `json:"images,omitempty"`
+	// Path is the archive, image root or seal path, depending on the event.
+	Path string `json:"path,omitempty"`
+	// Error is set for failures.
+	Error string `json:"error,omitempty"`
+}
+
+// EventStream is an ApplyObserver writing events as newline-delimited
+// JSON records, so that orchestrators can track apply progress.
+type EventStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	wr  io.Writer
+}
+
+var _ ApplyObserver = &EventStream{}
+
+// NewEventStream returns an event stream writing to `w`.
+func NewEventStream(w io.Writer) *EventStream {
+	return &EventStream{
+		enc: json.NewEncoder(w),
+		wr:  w,
+	}
+}
+
+// OpenEventStream opens the event stream `target`, either a file path
+// (appended to) or an inherited file descriptor as "fd:N".
+func OpenEventStream(target string) (*EventStream, error) {
+	if strings.HasPrefix(target, eventStreamFdPrefix) {
+		fd, err := strconv.Atoi(strings.TrimPrefix(target, eventStreamFdPrefix))
+		if err != nil || fd < 0 {
+			return nil, errors.Errorf("invalid event stream descriptor %q", target)
+		}
+		fp := os.NewFile(uintptr(fd), target)
+		if _, err := fp.Stat(); err != nil {
+			return nil, errors.Wrapf(err, "event stream %s", target)
+		}
+		return NewEventStream(fp), nil
+	}
+	fp, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening event stream")
+	}
+	return NewEventStream(fp), nil
+}
+
+// Close closes the underlying writer, if it can be closed.
+func (es *EventStream) Close() error {
+	if c, ok := es.wr.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// emit writes a single event. Write errors are ignored, as a broken
+// stream must not fail the apply.
+func (es *EventStream) emit(ev ApplyEvent) {
+	ev.Kind = ApplyEventV0K
+	ev.Time = time.Now().UTC()
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	_ = es.enc.Encode(ev)
+}
+
+// errorString returns the message of `err`, if any.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// ApplyStarted implements ApplyObserver.
+func (es *EventStream) ApplyStarted(images []Image) {
+	es.emit(ApplyEvent{Event: EventStarted, Images: images})
+}
+
+// ImageStarted implements ApplyObserver.
+func (es *EventStream) ImageStarted(im Image) {
+	es.emit(ApplyEvent{Event: EventImageStarted, Image: &im})
+}
+
+// ImageLocated implements ApplyObserver.
+func (es *EventStream) ImageLocated(im Image, archive Archive) {
+	es.emit(ApplyEvent{Event: EventImageLocated, Image: &im, Path: archive.Filepath})
+}
+
+// ImageVerified implements ApplyObserver.
+func (es *EventStream) ImageVerified(im Image, archive Archive) {
+	es.emit(ApplyEvent{Event: EventImageVerified, Image: &im, Path: archive.Filepath})
+}
+
+// ImageUnpacked implements ApplyObserver.
+func (es *EventStream) ImageUnpacked(im Image, rootfs string) {
+	es.emit(ApplyEvent{Event: EventImageMounted, Image: &im, Path: rootfs})
+}
+
+// ImageApplied implements ApplyObserver.
+func (es *EventStream) ImageApplied(im Image, assets Assets) {
+	es.emit(ApplyEvent{Event: EventAssetsPropagated, Image: &im})
+}
+
+// ImageFailed implements ApplyObserver.
+func (es *EventStream) ImageFailed(im Image, err error) {
+	es.emit(ApplyEvent{Event: EventImageFailed, Image: &im, Error: errorString(err)})
+}
+
+// ApplyFinished implements ApplyObserver.
+func (es *EventStream) ApplyFinished(applied []Image, err error) {
+	es.emit(ApplyEvent{Event: EventFinished, Images: applied, Error: errorString(err)})
+}
+
+// SystemSealed implements ApplyObserver.
+func (es *EventStream) SystemSealed(path string, err error) {
+	es.emit(ApplyEvent{Event: EventSealed, Path: path, Error: errorString(err)})
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEventStream(t *testing.T) {
+	dir := t.TempDir()
+	storeDir := filepath.Join(dir, "store")
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTgz(t, filepath.Join(storeDir, "foo:1.torcx.tgz"), map[string]string{
+		".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/foo"]}}`,
+		"bin/foo":              "foo",
+	})
+
+	buf := &bytes.Buffer{}
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			BaseDir:    filepath.Join(dir, "base"),
+			RunDir:     DefaultRunDir,
+			ConfDir:    filepath.Join(dir, "conf"),
+			UsrDir:     filepath.Join(dir, "usr"),
+			StorePaths: []string{storeDir},
+			Mounter:    &fakeMounter{},
+		},
+		UpperProfile: "user",
+		Observer:     MultiApplyObserver{NopApplyObserver{}, NewEventStream(buf)},
+	}
+	profileDir := applyCfg.UserProfileDir()
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	profile := `{"kind": "profile-manifest-v1", "value": {"images": [{"name": "foo", "reference": "1"}]}}`
+	if err := ioutil.WriteFile(filepath.Join(profileDir, "user.json"), []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SimulateApply(applyCfg, filepath.Join(dir, "target")); err != nil {
+		t.Fatal(err)
+	}
+
+	events := []string{}
+	sc := bufio.NewScanner(buf)
+	for sc.Scan() {
+		var ev ApplyEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			t.Fatalf("invalid event %q: %s", sc.Text(), err)
+		}
+		if ev.Kind != ApplyEventV0K {
+			t.Errorf("unexpected event kind %q", ev.Kind)
+		}
+		if ev.Event == EventImageMounted && (ev.Image == nil || ev.Image.Name != "foo" || ev.Path == "") {
+			t.Errorf("unexpected mount event %+v", ev)
+		}
+		events = append(events, ev.Event)
+	}
+	expected := []string{
+		EventStarted,
+		EventImageStarted, EventImageLocated, EventImageVerified, EventImageMounted, EventAssetsPropagated,
+		EventFinished,
+		EventSealed,
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+}
+
+func TestOpenEventStream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.json")
+	for i := 0; i < 2; i++ {
+		stream, err := OpenEventStream(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.SystemSealed("/seal", nil)
+		if err := stream.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte("\n")); n != 2 {
+		t.Errorf("expected 2 appended events, got %d", n)
+	}
+
+	for _, target := range []string{"fd:foo", "fd:-1", "fd:1000"} {
+		if _, err := OpenEventStream(target); err == nil {
+			t.Errorf("expected error for %s", target)
+		}
+	}
+}
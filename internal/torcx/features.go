@@ -0,0 +1,86 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"sort"
+)
+
+// features are the optional capabilities compiled into this torcx, as
+// advertised to provisioning tools (see `torcx version --json`).
+var features = []string{
+	"apply-plans",
+	"apply-policies",
+	"apply-budget",
+	"apply-events",
+	"apply-simulation",
+	"archive-meta",
+	"archive-peek",
+	"credential-helpers",
+	"dev-edit",
+	"dev-watch",
+	"error-reports",
+	"fetch-audit",
+	"fetch-peers",
+	"fetch-rsync",
+	"hash-trees",
+	"hot-add",
+	"ima-appraisal",
+	"image-aliases",
+	"image-conditions",
+	"image-signatures",
+	"incremental-unpack",
+	"inventory",
+	"key-lifecycle",
+	"live-mounts",
+	"manifest-lint",
+	"mount-api",
+	"node-profiles",
+	"notify",
+	"path-only",
+	"profile-annotations",
+	"profile-tui",
+	"profile-verify",
+	"provides",
+	"recommends",
+	"remote-pins",
+	"remote-publish",
+	"reseal",
+	"root-prefix",
+	"roles",
+	"selinux-labels",
+	"serve-remote",
+	"signature-timestamps",
+	"squashfs-sampling",
+	"staged-apply",
+	"state-cleanup",
+	"store-encryption",
+	"store-images",
+	"store-namespaces",
+	"store-sync",
+	"systemd-credentials",
+	"tmpfs-caps",
+	"unit-templating",
+	"unpack-limits",
+	"version-queries",
+	"writable-overlays",
+}
+
+// Features returns the sorted optional capabilities of this torcx.
+func Features() []string {
+	f := append([]string{}, features...)
+	sort.Strings(f)
+	return f
+}
@@ -0,0 +1,251 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// FetchRecordV0K - fetch audit record kind, v0
+	FetchRecordV0K = "torcx-fetch-record-v0"
+)
+
+// FetchAudit configures the audit trail of archives fetched from remotes.
+type FetchAudit struct {
+	// Log appends a record of each fetch to the local audit log.
+	Log bool `json:"log,omitempty"`
+	// Endpoint is the URL of a transparency log each record is POSTed to.
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// FetchRecord is a single entry of the fetch audit log.
+type FetchRecord struct {
+	Kind  string    `json:"kind"`
+	Time  time.Time `json:"time"`
+	Image Image     `json:"image"`
+	// URL is the remote location the archive was fetched from.
+	URL string `json:"url"`
+	// Digest is the hash of the fetched archive.
+	Digest string `json:"digest"`
+	// ManifestDigest is the digest of the contents manifest listing it.
+	ManifestDigest string `json:"manifest_digest,omitempty"`
+	// Signer is the key ID which signed the contents manifest, if any.
+	Signer string `json:"signer,omitempty"`
+	// MachineID identifies the fetching node.
+	MachineID string `json:"machine_id,omitempty"`
+	// Submitted is set once the record was accepted by the endpoint.
+	Submitted bool `json:"submitted,omitempty"`
+	// Previous is the digest of the previous log entry, chaining records
+	// so that edited or removed entries can be detected.
+	Previous string `json:"previous,omitempty"`
+}
+
+// validate checks the fetch audit settings.
+func (fa *FetchAudit) validate() error {
+	if fa.Endpoint == "" {
+		return nil
+	}
+	u, err := url.Parse(fa.Endpoint)
+	if err != nil {
+		return errors.Wrapf(err, "invalid fetch audit endpoint %q", fa.Endpoint)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errors.Errorf("unsupported scheme for fetch audit endpoint %q", fa.Endpoint)
+	}
+	return nil
+}
+
+// auditFetch records the fetch of `im` from `location` into `targetPath`,
+// on a best-effort basis: audit failures never fail the fetch itself.
+func (rc *RemotesCache) auditFetch(ctx context.Context, im Image, location string, targetPath string, hash string) {
+	if rc.Audit == nil || (!rc.Audit.Log && rc.Audit.Endpoint == "") {
+		return
+	}
+	fields := logrus.Fields{
+		"name":      im.Name,
+		"reference": im.Reference,
+		"remote":    im.Remote,
+	}
+	if hash == "" {
+		computed, err := hashFile(targetPath, HashSHA512)
+		if err != nil {
+			fields["error"] = err
+			logrus.WithFields(fields).Warn("unable to hash fetched archive for audit")
+			return
+		}
+		hash = computed
+	}
+	record := FetchRecord{
+		Kind:           FetchRecordV0K,
+		Time:           time.Now().UTC(),
+		Image:          im,
+		URL:            location,
+		Digest:         hash,
+		ManifestDigest: rc.Digests[im.Remote],
+		Signer:         rc.Signers[im.Remote],
+		MachineID:      CurrentNodeIdentity().MachineID,
+	}
+
+	if rc.Audit.Endpoint != "" {
+		if err := submitFetchRecord(ctx, &http.Client{Transport: rc.Transport}, rc.Audit.Endpoint, record); err != nil {
+			fields["endpoint"] = rc.Audit.Endpoint
+			fields["error"] = err
+			logrus.WithFields(fields).Warn("unable to submit fetch record to transparency log")
+		} else {
+			record.Submitted = true
+		}
+	}
+	if rc.Audit.Log && rc.AuditLog != "" {
+		if err := appendFetchRecord(ctx, rc.AuditLog, record); err != nil {
+			fields["path"] = rc.AuditLog
+			fields["error"] = err
+			logrus.WithFields(fields).Warn("unable to record fetch in audit log")
+		}
+	}
+}
+
+// submitFetchRecord POSTs `record` as JSON to the transparency log at `endpoint`.
+func submitFetchRecord(ctx context.Context, client *http.Client, endpoint string, record FetchRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusAccepted {
+		return nil
+	}
+	return checkHTTPStatus(resp)
+}
+
+// appendFetchRecord appends `record` to the audit log at `path`, chained
+// to the last entry. Appends are serialized by a lock, as the log may be
+// written by concurrent fetches.
+func appendFetchRecord(ctx context.Context, path string, record FetchRecord) error {
+	lock, err := lockFile(ctx, path+".lock")
+	if err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+
+	_, lines, err := readFetchAudit(path)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+	if len(lines) > 0 {
+		record.Previous = fetchRecordDigest(lines[len(lines)-1])
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if _, err := fp.Write(append(line, '\n')); err != nil {
+		return errors.Wrapf(err, "writing %q", path)
+	}
+	if err := fp.Sync(); err != nil {
+		return errors.Wrapf(err, "writing %q", path)
+	}
+	return fp.Close()
+}
+
+// fetchRecordDigest returns the digest of a serialized record.
+func fetchRecordDigest(line []byte) string {
+	sum := sha512.Sum512(line)
+	return HashSHA512 + "-" + hex.EncodeToString(sum[:])
+}
+
+// ReadFetchAudit reads all records of the audit log at `path`.
+func ReadFetchAudit(path string) ([]FetchRecord, error) {
+	records, _, err := readFetchAudit(path)
+	return records, err
+}
+
+// readFetchAudit reads all records of the audit log at `path`, along
+// with their serialized lines, which digests are computed over.
+func readFetchAudit(path string) ([]FetchRecord, [][]byte, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fp.Close()
+
+	records := []FetchRecord{}
+	lines := [][]byte{}
+	sc := bufio.NewScanner(fp)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var record FetchRecord
+		if err := json.Unmarshal(sc.Bytes(), &record); err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to decode %s, entry %d", path, len(records)+1)
+		}
+		if record.Kind != FetchRecordV0K {
+			return nil, nil, errors.Errorf("invalid fetch record kind: %s", record.Kind)
+		}
+		records = append(records, record)
+		lines = append(lines, append([]byte{}, sc.Bytes()...))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, errors.Wrapf(err, "reading %s", path)
+	}
+	return records, lines, nil
+}
+
+// VerifyFetchAudit checks the chain of the audit log at `path`, returning
+// its records. Chain breaks (altered, removed or reordered entries) are
+// reported with the number of the first offending entry.
+func VerifyFetchAudit(path string) ([]FetchRecord, error) {
+	records, lines, err := readFetchAudit(path)
+	if err != nil {
+		return nil, err
+	}
+	previous := ""
+	for i, record := range records {
+		if record.Previous != previous {
+			return records, errors.Errorf("audit log chain broken at entry %d", i+1)
+		}
+		previous = fetchRecordDigest(lines[i])
+	}
+	return records, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_fetch_audit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	submitted := []FetchRecord{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var record FetchRecord
+		if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&record) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		submitted = append(submitted, record)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	archive := filepath.Join(dir, "foo:1.torcx.tgz")
+	if err := ioutil.WriteFile(archive, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rc := RemotesCache{
+		Audit:    &FetchAudit{Log: true, Endpoint: srv.URL},
+		AuditLog: filepath.Join(dir, "fetch-audit.log"),
+		Digests:  map[string]string{"r": "sha512-00"},
+		Signers:  map[string]string{"r": "0123456789ABCDEF"},
+	}
+	im := Image{Name: "foo", Reference: "1", Remote: "r"}
+	rc.auditFetch(context.Background(), im, "https://example.com/foo:1.torcx.tgz", archive, "")
+	rc.auditFetch(context.Background(), im, "https://example.com/foo:1.torcx.tgz", archive, "sha512-01")
+
+	records, err := VerifyFetchAudit(rc.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || len(submitted) != 2 {
+		t.Fatalf("expected 2 records, got %d (%d submitted)", len(records), len(submitted))
+	}
+	expectedHash, err := hashFile(archive, HashSHA512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[0].Digest != expectedHash || records[1].Digest != "sha512-01" {
+		t.Fatalf("unexpected digests: %q %q", records[0].Digest, records[1].Digest)
+	}
+	if !records[0].Submitted || records[0].Signer != "0123456789ABCDEF" || records[0].ManifestDigest != "sha512-00" {
+		t.Fatalf("unexpected record: %+v", records[0])
+	}
+	if records[0].Previous != "" || records[1].Previous == "" {
+		t.Fatalf("records not chained: %q %q", records[0].Previous, records[1].Previous)
+	}
+
+	// Altering the first entry breaks the chain.
+	b, err := ioutil.ReadFile(rc.AuditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = bytes.Replace(b, []byte("sha512-00"), []byte("sha512-ff"), 1)
+	if err := ioutil.WriteFile(rc.AuditLog, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyFetchAudit(rc.AuditLog); err == nil {
+		t.Fatal("expected chain verification failure")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// ErrFetchDenied is returned when the fetch policy does not allow an image
+// to be fetched from a remote.
+var ErrFetchDenied = errors.New("fetch denied by policy")
+
+// FetchRules are allow/deny lists of image name globs.
+type FetchRules struct {
+	// Allow, if not empty, restricts fetches to matching image names.
+	Allow []string `json:"allow,omitempty"`
+	// Deny refuses fetches of matching image names.
+	Deny []string `json:"deny,omitempty"`
+}
+
+// FetchPolicy restricts which image names may be fetched from which remotes.
+type FetchPolicy struct {
+	FetchRules
+	// Remotes are rules applying to a single remote, on top of global ones.
+	Remotes map[string]FetchRules `json:"remotes,omitempty"`
+}
+
+// Check returns an error if fetching `im` from its remote is not allowed.
+// A nil policy allows everything.
+func (fp *FetchPolicy) Check(im Image) error {
+	if fp == nil {
+		return nil
+	}
+	rules := []FetchRules{fp.FetchRules}
+	if remoteRules, ok := fp.Remotes[im.Remote]; ok {
+		rules = append(rules, remoteRules)
+	}
+	for _, r := range rules {
+		denied, err := matchAny(r.Deny, im.Name)
+		if err != nil {
+			return err
+		}
+		if denied {
+			return errors.Wrapf(ErrFetchDenied, "image %s denied from remote %q", im.Name, im.Remote)
+		}
+		if len(r.Allow) == 0 {
+			continue
+		}
+		allowed, err := matchAny(r.Allow, im.Name)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return errors.Wrapf(ErrFetchDenied, "image %s not allowed from remote %q", im.Name, im.Remote)
+		}
+	}
+	return nil
+}
+
+// matchAny returns whether `name` matches any of `globs`.
+func matchAny(globs []string, name string) (bool, error) {
+	for _, glob := range globs {
+		ok, err := path.Match(glob, name)
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid fetch policy pattern %q", glob)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestFetchPolicyCheck(t *testing.T) {
+	policy := &FetchPolicy{
+		FetchRules: FetchRules{Deny: []string{"evil*"}},
+		Remotes: map[string]FetchRules{
+			"com.example.docker": {Allow: []string{"docker", "containerd*"}},
+		},
+	}
+
+	tests := []struct {
+		image   Image
+		allowed bool
+	}{
+		{Image{Name: "docker", Remote: "com.example.docker"}, true},
+		{Image{Name: "containerd-shim", Remote: "com.example.docker"}, true},
+		{Image{Name: "rkt", Remote: "com.example.docker"}, false},
+		{Image{Name: "rkt", Remote: "com.example.other"}, true},
+		{Image{Name: "evil-addon", Remote: "com.example.other"}, false},
+	}
+	for _, tt := range tests {
+		err := policy.Check(tt.image)
+		if tt.allowed && err != nil {
+			t.Errorf("%s from %s: unexpected error %s", tt.image.Name, tt.image.Remote, err)
+		}
+		if !tt.allowed && errors.Cause(err) != ErrFetchDenied {
+			t.Errorf("%s from %s: expected denial, got %v", tt.image.Name, tt.image.Remote, err)
+		}
+	}
+
+	var nilPolicy *FetchPolicy
+	if err := nilPolicy.Check(Image{Name: "anything"}); err != nil {
+		t.Errorf("unexpected error from nil policy: %s", err)
+	}
+	if err := (&FetchPolicy{FetchRules: FetchRules{Allow: []string{"["}}}).Check(Image{Name: "docker"}); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+
+	rc := &RemotesCache{Policy: policy}
+	err := rc.FetchImage(context.Background(), Image{Name: "rkt", Reference: "1", Remote: "com.example.docker"}, t.TempDir())
+	if errors.Cause(err) != ErrFetchDenied {
+		t.Errorf("expected fetch denial, got %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// fragmentPath is the well-known location for a profile fragment,
+	// listing additional images required by an image.
+	fragmentPath = "/.torcx/profile.json"
+	// maxFragmentDepth is the maximum nesting depth of profile fragments.
+	maxFragmentDepth = 4
+)
+
+// pendingImage is an image queued for apply, along with its nesting depth.
+type pendingImage struct {
+	Image
+	depth int
+}
+
+// resolveImages applies all `images` in order via `applyFn`, which returns
+// the applied image (with its reference resolved, e.g. for `latest`) and
+// the profile fragment (if any) shipped by it. Fragments are resolved
+// recursively, queueing additional images after the current ones.
+// Apply continues on error; the list of successfully applied images is returned.
+// Images dropped as they ran out of budget are not accounted as failures.
+// Fragments nested deeper than maxFragmentDepth are not resolved, and are
+// reported as failures on their own: the images shipping them stay applied.
+//
+// Recommended images are weak dependencies: failing to apply them (e.g. as
+// they are missing from the store) is not accounted as a failure.
+//
+// Capability requests are satisfied by any applied image providing them, as
+// declared by its manifest. They are resolved once all queued images have
+// been applied, falling back to applying the named image (if any).
+func resolveImages(images []Image, applyFn func(Image) (Image, []Image, error)) ([]Image, error) {
+	// Images explicitly listed in profiles take precedence over
+	// the ones requested by fragments.
+	seen := make(map[string]Image, len(images))
+	queue := make([]pendingImage, 0, len(images))
+	for _, im := range images {
+		if im.Capability == "" {
+			seen[im.Name] = im
+		}
+		queue = append(queue, pendingImage{im, 0})
+	}
+
+	// provided maps capabilities to the first applied image providing them.
+	provided := map[string]string{}
+	applied := []Image{}
+	failedImages := []Image{}
+	droppedFragments := 0
+	for len(queue) > 0 {
+		pending := queue[0]
+		queue = queue[1:]
+		im := pending.Image
+		logFields := logrus.Fields{
+			"image":     im.Name,
+			"reference": im.Reference,
+		}
+
+		if im.Capability != "" {
+			logFields["capability"] = im.Capability
+			if provider, ok := provided[im.Capability]; ok {
+				logrus.WithFields(logFields).WithField("provider", provider).Debug("capability provided")
+				continue
+			}
+			if hasQueuedImages(queue) {
+				// Pending images may still provide it.
+				queue = append(queue, pending)
+				continue
+			}
+			if _, ok := seen[im.Name]; ok || im.Name == "" {
+				logrus.WithFields(logFields).Error("capability not provided by any image")
+				failedImages = append(failedImages, im)
+				continue
+			}
+			logrus.WithFields(logFields).Debug("capability not provided, applying fallback image")
+			im.Capability = ""
+			seen[im.Name] = im
+		}
+
+		resolved, fragment, err := applyFn(im)
+		if errors.Cause(err) == ErrBudgetExceeded {
+			logrus.WithFields(logFields).Warn("optional image dropped: ", err)
+			continue
+		}
+		if err != nil && im.Recommended {
+			logrus.WithFields(logFields).Info("recommended image skipped: ", err)
+			continue
+		}
+		if err != nil {
+			logrus.WithFields(logFields).Debug("image failed: ", err)
+			failedImages = append(failedImages, im)
+			continue
+		}
+		applied = append(applied, resolved)
+		for _, capability := range resolved.ProvidedCapabilities() {
+			if _, ok := provided[capability]; !ok {
+				provided[capability] = resolved.Name
+			}
+		}
+		if capability := pending.Capability; capability != "" && provided[capability] == "" {
+			logrus.WithFields(logFields).Error("fallback image does not provide capability")
+		}
+
+		if len(fragment) == 0 {
+			continue
+		}
+		if pending.depth >= maxFragmentDepth {
+			droppedFragments++
+			logrus.WithFields(logFields).WithField("depth", pending.depth).Error("profile fragments nested too deeply")
+			continue
+		}
+		for _, dep := range fragmentImages(im, fragment, seen) {
+			logrus.WithFields(logFields).WithField("dependency", dep.Name).WithField("recommended", dep.Recommended).Debug("image requested by profile fragment")
+			queue = append(queue, pendingImage{dep, pending.depth + 1})
+		}
+	}
+
+	if len(failedImages) > 0 {
+		return applied, fmt.Errorf("failed to install %d images", len(failedImages))
+	}
+	if droppedFragments > 0 {
+		return applied, fmt.Errorf("dropped %d profile fragments nested too deeply", droppedFragments)
+	}
+	return applied, nil
+}
+
+// hasQueuedImages returns whether `queue` holds concrete images, as opposed
+// to capability requests only.
+func hasQueuedImages(queue []pendingImage) bool {
+	for _, pending := range queue {
+		if pending.Capability == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// readImageFragment returns the images listed in the profile fragment
+// shipped inside an unpacked image, if any.
+func readImageFragment(imageRoot string) ([]Image, error) {
+	if imageRoot == "" {
+		return nil, errors.New("missing image top directory")
+	}
+
+	path := filepath.Join(imageRoot, fragmentPath)
+	fp, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Corner-case: most images do not ship a fragment
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fp.Close()
+
+	images, err := readProfileReader(bufio.NewReader(fp))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading fragment %q", path)
+	}
+	return images, nil
+}
+
+// fragmentImages filters the images requested by the fragment of `parent`,
+// returning only those not yet `seen` (which are then marked as such).
+// Requests for an already seen image are skipped, which also breaks
+// dependency cycles. Capability requests are resolved later on, and kept.
+func fragmentImages(parent Image, fragment []Image, seen map[string]Image) []Image {
+	deps := []Image{}
+	for _, im := range fragment {
+		if im.Capability != "" && im.Name == "" && im.Reference == "" {
+			deps = append(deps, im)
+			continue
+		}
+		if im.Name == "" || im.Reference == "" {
+			continue
+		}
+		if im.Capability != "" {
+			deps = append(deps, im)
+			continue
+		}
+		if prev, ok := seen[im.Name]; ok {
+			if prev.Reference != im.Reference {
+				logrus.WithFields(logrus.Fields{
+					"image":     im.Name,
+					"requested": im.Reference,
+					"selected":  prev.Reference,
+					"parent":    parent.Name,
+				}).Warn("conflicting reference requested by profile fragment")
+			}
+			continue
+		}
+		seen[im.Name] = im
+		deps = append(deps, im)
+	}
+	return deps
+}
+
+// installRecommends returns whether recommended images are applied.
+func (cc *CommonConfig) installRecommends() bool {
+	return cc.InstallRecommends == nil || *cc.InstallRecommends
+}
+
+// FilterRecommends drops recommended images from `images`, unless the
+// configuration installs recommends.
+func (cc *CommonConfig) FilterRecommends(images []Image) []Image {
+	if cc.installRecommends() {
+		return images
+	}
+	filtered := make([]Image, 0, len(images))
+	for _, im := range images {
+		if im.Recommended {
+			logrus.WithFields(logrus.Fields{
+				"image":     im.Name,
+				"reference": im.Reference,
+			}).Debug("recommended image not installed by policy")
+			continue
+		}
+		filtered = append(filtered, im)
+	}
+	return filtered
+}
@@ -0,0 +1,321 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFragments creates a fake unpacked image for each entry in `deps`,
+// shipping a profile fragment with the given dependencies.
+func writeFragments(t *testing.T, baseDir string, deps map[string][]Image) {
+	for name, ims := range deps {
+		dir := filepath.Join(baseDir, name, ".torcx")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if len(ims) == 0 {
+			continue
+		}
+		fragment := ProfileManifestV1JSON{
+			Kind:  ProfileManifestV1K,
+			Value: ImagesToJSONV1(ims),
+		}
+		b, err := json.Marshal(fragment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "profile.json"), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResolveImages(t *testing.T) {
+	tests := []struct {
+		desc    string
+		profile []Image
+		deps    map[string][]Image
+
+		expApplied []Image
+		expErr     bool
+	}{
+		{
+			"no fragments",
+			[]Image{{Name: "a", Reference: "1"}},
+			map[string][]Image{"a": nil},
+
+			[]Image{{Name: "a", Reference: "1"}},
+			false,
+		},
+		{
+			"nested",
+			[]Image{{Name: "a", Reference: "1"}},
+			map[string][]Image{
+				"a": {{Name: "b", Reference: "2"}},
+				"b": {{Name: "c", Reference: "3"}},
+				"c": nil,
+			},
+
+			[]Image{{Name: "a", Reference: "1"}, {Name: "b", Reference: "2"}, {Name: "c", Reference: "3"}},
+			false,
+		},
+		{
+			"cycle",
+			[]Image{{Name: "a", Reference: "1"}},
+			map[string][]Image{
+				"a": {{Name: "b", Reference: "2"}},
+				"b": {{Name: "a", Reference: "1"}},
+			},
+
+			[]Image{{Name: "a", Reference: "1"}, {Name: "b", Reference: "2"}},
+			false,
+		},
+		{
+			"profile wins over fragment",
+			[]Image{{Name: "a", Reference: "1"}, {Name: "b", Reference: "2"}},
+			map[string][]Image{
+				"a": {{Name: "b", Reference: "9"}},
+				"b": nil,
+			},
+
+			[]Image{{Name: "a", Reference: "1"}, {Name: "b", Reference: "2"}},
+			false,
+		},
+		{
+			"too deep",
+			[]Image{{Name: "a", Reference: "1"}},
+			map[string][]Image{
+				"a": {{Name: "b", Reference: "1"}},
+				"b": {{Name: "c", Reference: "1"}},
+				"c": {{Name: "d", Reference: "1"}},
+				"d": {{Name: "e", Reference: "1"}},
+				"e": {{Name: "f", Reference: "1"}},
+				"f": nil,
+			},
+
+			[]Image{{Name: "a", Reference: "1"}, {Name: "b", Reference: "1"}, {Name: "c", Reference: "1"}, {Name: "d", Reference: "1"}, {Name: "e", Reference: "1"}},
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		tmpDir, err := ioutil.TempDir("", "torcx_fragment_test_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+		writeFragments(t, tmpDir, tt.deps)
+
+		applied, err := resolveImages(tt.profile, func(im Image) (Image, []Image, error) {
+			fragment, err := readImageFragment(filepath.Join(tmpDir, im.Name))
+			return im, fragment, err
+		})
+		if tt.expErr != (err != nil) {
+			t.Errorf("testcase %q failed, expected error %t, got %v", tt.desc, tt.expErr, err)
+		}
+		if !reflect.DeepEqual(applied, tt.expApplied) {
+			t.Errorf("testcase %q failed:\n got: %v\n expected: %v", tt.desc, applied, tt.expApplied)
+		}
+	}
+}
+
+func TestResolveFragmentDepth(t *testing.T) {
+	tmpDir := t.TempDir()
+	// "f" sits at depth 5, below the fragment shipped by "e".
+	writeFragments(t, tmpDir, map[string][]Image{
+		"a": {{Name: "b", Reference: "1"}},
+		"b": {{Name: "c", Reference: "1"}},
+		"c": {{Name: "d", Reference: "1"}},
+		"d": {{Name: "e", Reference: "1"}},
+		"e": {{Name: "f", Reference: "1"}},
+		"f": {{Name: "g", Reference: "1"}},
+		"g": nil,
+	})
+
+	tried := []string{}
+	applied, err := resolveImages([]Image{{Name: "a", Reference: "1"}}, func(im Image) (Image, []Image, error) {
+		tried = append(tried, im.Name)
+		fragment, err := readImageFragment(filepath.Join(tmpDir, im.Name))
+		return im, fragment, err
+	})
+	if err == nil || err.Error() != "dropped 1 profile fragments nested too deeply" {
+		t.Fatalf("expected a dropped fragment, got %v", err)
+	}
+	expected := []Image{{Name: "a", Reference: "1"}, {Name: "b", Reference: "1"}, {Name: "c", Reference: "1"}, {Name: "d", Reference: "1"}, {Name: "e", Reference: "1"}}
+	if !reflect.DeepEqual(applied, expected) {
+		t.Errorf("got applied %v, expected %v", applied, expected)
+	}
+	if !reflect.DeepEqual(tried, []string{"a", "b", "c", "d", "e"}) {
+		t.Errorf("images beyond the maximum depth applied: %v", tried)
+	}
+}
+
+func TestResolveCapabilities(t *testing.T) {
+	provides := map[string]string{
+		"containerd": "container-runtime",
+		"docker":     "container-runtime",
+	}
+	tests := []struct {
+		desc    string
+		profile []Image
+		deps    map[string][]Image
+
+		expApplied []string
+		expErr     bool
+	}{
+		{
+			"provided by profile",
+			[]Image{{Name: "kubelet", Reference: "1"}, {Name: "containerd", Reference: "1"}},
+			map[string][]Image{
+				"kubelet":    {{Name: "docker", Reference: "1", Capability: "container-runtime"}},
+				"containerd": nil,
+			},
+
+			[]string{"kubelet", "containerd"},
+			false,
+		},
+		{
+			"fallback",
+			[]Image{{Name: "kubelet", Reference: "1"}},
+			map[string][]Image{
+				"kubelet": {{Name: "docker", Reference: "1", Capability: "container-runtime"}},
+				"docker":  nil,
+			},
+
+			[]string{"kubelet", "docker"},
+			false,
+		},
+		{
+			"provided by a later fragment",
+			[]Image{{Name: "kubelet", Reference: "1"}, {Name: "tools", Reference: "1"}},
+			map[string][]Image{
+				"kubelet":    {{Capability: "container-runtime"}},
+				"tools":      {{Name: "containerd", Reference: "1"}},
+				"containerd": nil,
+			},
+
+			[]string{"kubelet", "tools", "containerd"},
+			false,
+		},
+		{
+			"not provided",
+			[]Image{{Name: "kubelet", Reference: "1"}},
+			map[string][]Image{
+				"kubelet": {{Capability: "container-runtime"}},
+			},
+
+			[]string{"kubelet"},
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		tmpDir, err := ioutil.TempDir("", "torcx_fragment_test_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+		writeFragments(t, tmpDir, tt.deps)
+
+		applied, err := resolveImages(tt.profile, func(im Image) (Image, []Image, error) {
+			if im.Capability != "" {
+				t.Errorf("testcase %q failed, capability request %q applied", tt.desc, im.Capability)
+			}
+			im.Provides = provides[im.Name]
+			fragment, err := readImageFragment(filepath.Join(tmpDir, im.Name))
+			return im, fragment, err
+		})
+		if tt.expErr != (err != nil) {
+			t.Errorf("testcase %q failed, expected error %t, got %v", tt.desc, tt.expErr, err)
+		}
+		names := []string{}
+		for _, im := range applied {
+			names = append(names, im.Name)
+		}
+		if !reflect.DeepEqual(names, tt.expApplied) {
+			t.Errorf("testcase %q failed:\n got: %v\n expected: %v", tt.desc, names, tt.expApplied)
+		}
+	}
+}
+
+func TestResolveRecommends(t *testing.T) {
+	yes, no := true, false
+	deps := map[string][]Image{
+		"kubelet": {
+			{Name: "cni", Reference: "1"},
+			{Name: "crictl", Reference: "1", Recommended: true},
+			{Name: "missing", Reference: "1", Recommended: true},
+		},
+		"cni":    nil,
+		"crictl": nil,
+	}
+	tests := []struct {
+		desc    string
+		install *bool
+
+		expApplied []string
+	}{
+		{
+			"default",
+			nil,
+			[]string{"kubelet", "cni", "crictl"},
+		},
+		{
+			"install",
+			&yes,
+			[]string{"kubelet", "cni", "crictl"},
+		},
+		{
+			"skip",
+			&no,
+			[]string{"kubelet", "cni"},
+		},
+	}
+
+	for _, tt := range tests {
+		tmpDir, err := ioutil.TempDir("", "torcx_fragment_test_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir)
+		writeFragments(t, tmpDir, deps)
+
+		cc := CommonConfig{InstallRecommends: tt.install}
+		applied, err := resolveImages([]Image{{Name: "kubelet", Reference: "1"}}, func(im Image) (Image, []Image, error) {
+			imageRoot := filepath.Join(tmpDir, im.Name)
+			if _, err := os.Stat(imageRoot); err != nil {
+				return im, nil, err
+			}
+			fragment, err := readImageFragment(imageRoot)
+			return im, cc.FilterRecommends(fragment), err
+		})
+		if err != nil {
+			t.Errorf("testcase %q failed, unexpected error: %v", tt.desc, err)
+		}
+		names := []string{}
+		for _, im := range applied {
+			names = append(names, im.Name)
+		}
+		if !reflect.DeepEqual(names, tt.expApplied) {
+			t.Errorf("testcase %q failed:\n got: %v\n expected: %v", tt.desc, names, tt.expApplied)
+		}
+	}
+}
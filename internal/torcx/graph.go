@@ -0,0 +1,298 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// GraphEdgeRequires marks an image requested by a profile fragment
+	GraphEdgeRequires = "requires"
+	// GraphEdgeRecommends marks an image recommended by a profile fragment
+	GraphEdgeRecommends = "recommends"
+	// GraphEdgeConflicts marks a fragment request for a different reference than the selected one
+	GraphEdgeConflicts = "conflicts"
+	// GraphEdgeCollides marks an asset also provided by an image applied earlier
+	GraphEdgeCollides = "collides"
+)
+
+// ProfileGraph describes the images of a merged profile and their relations.
+type ProfileGraph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// GraphNode is an image in a profile graph, in apply order.
+type GraphNode struct {
+	Name      string        `json:"name"`
+	Reference string        `json:"reference"`
+	Remote    string        `json:"remote,omitempty"`
+	Source    string        `json:"source"`
+	Store     string        `json:"store,omitempty"`
+	Filepath  string        `json:"filepath,omitempty"`
+	Format    ArchiveFormat `json:"format,omitempty"`
+	Assets    *Assets       `json:"assets,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// GraphEdge is a relation between two images in a profile graph.
+type GraphEdge struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Kind      string `json:"kind"`
+	Reference string `json:"reference,omitempty"`
+	Asset     string `json:"asset,omitempty"`
+}
+
+// BuildProfileGraph computes the graph of the profile which would be applied
+// with the given configuration, inspecting archives without unpacking them.
+func BuildProfileGraph(applyCfg *ApplyConfig) (*ProfileGraph, error) {
+	inspected, err := inspectProfile(applyCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	graph := &ProfileGraph{
+		Nodes: []GraphNode{},
+		Edges: []GraphEdge{},
+	}
+	for _, ii := range inspected {
+		graph.Nodes = append(graph.Nodes, ii.node)
+		if ii.meta == nil {
+			continue
+		}
+		for _, dep := range ii.meta.Fragment {
+			if dep.Capability != "" {
+				// Satisfied by any providing image, not a hard requirement.
+				continue
+			}
+			graph.Edges = append(graph.Edges, GraphEdge{
+				From:      ii.node.Name,
+				To:        dep.Name,
+				Kind:      fragmentEdgeKind(dep),
+				Reference: dep.Reference,
+			})
+		}
+	}
+
+	graph.markConflicts()
+	graph.addCollisions()
+	return graph, nil
+}
+
+// inspectedImage is an image of a merged profile, inspected without unpacking it.
+type inspectedImage struct {
+	node GraphNode
+	meta *ImageMetadata
+}
+
+// inspectProfile resolves the profile which would be applied with the given
+// configuration (including profile fragments), inspecting archives in the
+// process. Inspection errors are recorded on each image.
+func inspectProfile(applyCfg *ApplyConfig) ([]inspectedImage, error) {
+	if applyCfg == nil {
+		return nil, errors.New("missing apply configuration")
+	}
+
+	images, err := mergeProfiles(applyCfg)
+	if err != nil {
+		return nil, err
+	}
+	return inspectImages(applyCfg, images)
+}
+
+// inspectImages resolves `images` along with their profile fragments,
+// inspecting archives in the process. Inspection errors are recorded on
+// each image.
+func inspectImages(applyCfg *ApplyConfig, images []Image) ([]inspectedImage, error) {
+	storeCache, err := NewStoreCache(applyCfg.StorePaths)
+	if err != nil {
+		return nil, err
+	}
+
+	profileImages := make(map[string]bool, len(images))
+	for _, im := range images {
+		profileImages[im.Name] = true
+	}
+
+	inspected := []inspectedImage{}
+	// Errors are recorded on each image, thus the overall result is ignored.
+	_, _ = resolveImages(images, func(im Image) (Image, []Image, error) {
+		node := GraphNode{
+			Name:      im.Name,
+			Reference: im.Reference,
+			Remote:    im.Remote,
+			Source:    "profile",
+		}
+		if !profileImages[im.Name] {
+			node.Source = "fragment"
+		}
+
+		im, err := storeCache.ResolveVersion(im)
+		if err != nil {
+			node.Error = err.Error()
+			inspected = append(inspected, inspectedImage{node, nil})
+			return im, nil, err
+		}
+		node.Reference = im.Reference
+
+		archive, err := storeCache.ArchiveFor(im)
+		if err != nil {
+			node.Error = err.Error()
+			inspected = append(inspected, inspectedImage{node, nil})
+			return im, nil, err
+		}
+		node.Store = filepath.Dir(archive.Filepath)
+		node.Filepath = archive.Filepath
+		node.Format = archive.Format
+
+		meta, err := ReadArchiveMetadata(archive)
+		if err == ErrInspectUnsupported {
+			node.Error = err.Error()
+			inspected = append(inspected, inspectedImage{node, nil})
+			return im, nil, nil
+		}
+		if err != nil {
+			node.Error = err.Error()
+			inspected = append(inspected, inspectedImage{node, nil})
+			return im, nil, err
+		}
+		node.Assets = &meta.Assets
+		im.Provides = strings.Join(meta.Assets.Provides, " ")
+		inspected = append(inspected, inspectedImage{node, meta})
+		return im, applyCfg.FilterRecommends(meta.Fragment), nil
+	})
+
+	return inspected, nil
+}
+
+// fragmentEdgeKind returns the kind of the edge to an image requested by
+// a profile fragment.
+func fragmentEdgeKind(dep Image) string {
+	if dep.Recommended {
+		return GraphEdgeRecommends
+	}
+	return GraphEdgeRequires
+}
+
+// markConflicts flags fragment requests which do not match the selected reference.
+func (g *ProfileGraph) markConflicts() {
+	selected := make(map[string]string, len(g.Nodes))
+	for _, n := range g.Nodes {
+		selected[n.Name] = n.Reference
+	}
+	for i, e := range g.Edges {
+		isRequest := e.Kind == GraphEdgeRequires || e.Kind == GraphEdgeRecommends
+		if ref, ok := selected[e.To]; ok && isRequest && ref != e.Reference {
+			g.Edges[i].Kind = GraphEdgeConflicts
+		}
+	}
+}
+
+// addCollisions adds edges for assets propagated to the same destination
+// by multiple images. Only the first image (in apply order) wins.
+func (g *ProfileGraph) addCollisions() {
+	owners := map[string]string{}
+	for _, n := range g.Nodes {
+		if n.Assets == nil {
+			continue
+		}
+		for _, dest := range assetDestinations(n.Assets) {
+			owner, ok := owners[dest]
+			if !ok {
+				owners[dest] = n.Name
+				continue
+			}
+			g.Edges = append(g.Edges, GraphEdge{
+				From:  n.Name,
+				To:    owner,
+				Kind:  GraphEdgeCollides,
+				Asset: dest,
+			})
+		}
+	}
+}
+
+// assetDestinations returns the (flattened) destination names of top-level assets.
+func assetDestinations(assets *Assets) []string {
+	dests := []string{}
+	groups := []struct {
+		prefix  string
+		entries []string
+	}{
+		{"bin", assets.Binaries},
+		{"network", assets.Network},
+		{"units", assets.Units},
+		{"sysusers", assets.Sysusers},
+		{"tmpfiles", assets.Tmpfiles},
+		{"udev_rules", assets.UdevRules},
+	}
+	for _, group := range groups {
+		for _, entry := range group.entries {
+			if entry == "" {
+				continue
+			}
+			dests = append(dests, group.prefix+"/"+filepath.Base(entry))
+		}
+	}
+	return dests
+}
+
+// WriteDot renders the graph in Graphviz DOT format.
+func (g *ProfileGraph) WriteDot(w io.Writer) error {
+	if g == nil {
+		return errors.New("nil ProfileGraph")
+	}
+
+	if _, err := fmt.Fprintln(w, "digraph torcx {"); err != nil {
+		return err
+	}
+	for _, n := range g.Nodes {
+		label := fmt.Sprintf("%s:%s\n%s", n.Name, n.Reference, n.Store)
+		attrs := ""
+		if n.Error != "" {
+			label += "\n" + n.Error
+			attrs = ", color=red"
+		}
+		if _, err := fmt.Fprintf(w, "  %q [label=%q%s];\n", n.Name, label, attrs); err != nil {
+			return err
+		}
+	}
+	for _, e := range g.Edges {
+		label := e.Kind
+		style := ""
+		switch e.Kind {
+		case GraphEdgeConflicts:
+			label += " " + e.Reference
+			style = ", color=red"
+		case GraphEdgeCollides:
+			label += " " + e.Asset
+			style = ", style=dashed"
+		case GraphEdgeRecommends:
+			style = ", style=dotted"
+		}
+		if _, err := fmt.Fprintf(w, "  %q -> %q [label=%q%s];\n", e.From, e.To, label, style); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
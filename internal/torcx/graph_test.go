@@ -0,0 +1,45 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGraphRelations(t *testing.T) {
+	g := &ProfileGraph{
+		Nodes: []GraphNode{
+			{Name: "a", Reference: "1", Assets: &Assets{Binaries: []string{"/bin/tool"}}},
+			{Name: "b", Reference: "2", Assets: &Assets{Binaries: []string{"/usr/bin/tool"}, Units: []string{"/lib/b.service"}}},
+			{Name: "c", Reference: "3"},
+		},
+		Edges: []GraphEdge{
+			{From: "a", To: "b", Kind: GraphEdgeRequires, Reference: "2"},
+			{From: "a", To: "c", Kind: GraphEdgeRequires, Reference: "4"},
+		},
+	}
+	g.markConflicts()
+	g.addCollisions()
+
+	expected := []GraphEdge{
+		{From: "a", To: "b", Kind: GraphEdgeRequires, Reference: "2"},
+		{From: "a", To: "c", Kind: GraphEdgeConflicts, Reference: "4"},
+		{From: "b", To: "a", Kind: GraphEdgeCollides, Asset: "bin/tool"},
+	}
+	if !reflect.DeepEqual(g.Edges, expected) {
+		t.Fatalf("wrong edges:\n got: %v\n expected: %v", g.Edges, expected)
+	}
+}
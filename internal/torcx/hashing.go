@@ -0,0 +1,212 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// HashSHA512 hashes archives sequentially with SHA-512.
+	HashSHA512 = "sha512"
+	// HashSHA512Tree hashes fixed-size chunks of archives with SHA-512 in
+	// parallel, the hash being the SHA-512 of the concatenated chunk hashes.
+	HashSHA512Tree = "sha512tree"
+
+	// hashTreeChunkSize is the chunk size of HashSHA512Tree.
+	hashTreeChunkSize = 4 << 20
+	// hashBlockSize is the size of blocks read ahead of sequential hashing.
+	hashBlockSize = 1 << 20
+)
+
+var (
+	// HashAlgorithm is the algorithm of the hashes computed by torcx, e.g.
+	// when converting archives or publishing remotes. Verification always
+	// uses the algorithm of the recorded hash.
+	HashAlgorithm = HashSHA512
+
+	// HashWorkers is the number of chunks of an archive hashed
+	// concurrently, defaulting to the number of CPUs.
+	HashWorkers = runtime.NumCPU()
+)
+
+// IsHashAlgorithm returns whether `algorithm` is a supported hash algorithm.
+func IsHashAlgorithm(algorithm string) bool {
+	return algorithm == HashSHA512 || algorithm == HashSHA512Tree
+}
+
+// hashFile returns the hash of the file at `path` with `algorithm`, in
+// the format used by remote contents manifests (e.g. "sha512-<hex>").
+func hashFile(path string, algorithm string) (string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	var sum []byte
+	switch algorithm {
+	case HashSHA512:
+		sum, err = sha512ReadAhead(fp)
+	case HashSHA512Tree:
+		sum, err = sha512Tree(fp)
+	default:
+		return "", errors.Errorf("unknown hash algorithm %q", algorithm)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "hashing %q", path)
+	}
+	return algorithm + "-" + hex.EncodeToString(sum), nil
+}
+
+// sha512ReadAhead hashes `r` with SHA-512, reading the next block while
+// the current one is hashed, so that IO and hashing overlap.
+func sha512ReadAhead(r io.Reader) ([]byte, error) {
+	type block struct {
+		buf []byte
+		n   int
+		err error
+	}
+	free := make(chan []byte, 2)
+	free <- make([]byte, hashBlockSize)
+	free <- make([]byte, hashBlockSize)
+	filled := make(chan block, 2)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			var buf []byte
+			select {
+			case buf = <-free:
+			case <-done:
+				return
+			}
+			n, err := io.ReadFull(r, buf)
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			filled <- block{buf, n, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	h := sha512.New()
+	for {
+		b := <-filled
+		h.Write(b.buf[:b.n])
+		if b.err == io.EOF {
+			return h.Sum(nil), nil
+		}
+		if b.err != nil {
+			return nil, b.err
+		}
+		free <- b.buf
+	}
+}
+
+// sha512Tree computes the HashSHA512Tree hash of `fp`, hashing its chunks
+// with HashWorkers concurrent readers.
+func sha512Tree(fp *os.File) ([]byte, error) {
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	leaves, err := sha512TreeLeaves(fi.Size(), func(i int, buf []byte) ([]byte, error) {
+		n, err := fp.ReadAt(buf, int64(i)*hashTreeChunkSize)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return buf[:n], nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sha512TreeRoot(leaves), nil
+}
+
+// sha512TreeLeaves hashes the chunks of a `size` bytes file with
+// HashWorkers concurrent workers, each chunk being returned by `chunk`
+// (possibly in the chunk-sized `buf`).
+func sha512TreeLeaves(size int64, chunk func(i int, buf []byte) ([]byte, error)) ([][]byte, error) {
+	chunks := int((size + hashTreeChunkSize - 1) / hashTreeChunkSize)
+	if chunks == 0 {
+		chunks = 1
+	}
+	workers := HashWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > chunks {
+		workers = chunks
+	}
+
+	leaves := make([][]byte, chunks)
+	errs := make([]error, workers)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			buf := make([]byte, hashTreeChunkSize)
+			for i := range next {
+				if errs[w] != nil {
+					continue
+				}
+				b, err := chunk(i, buf)
+				if err != nil {
+					errs[w] = err
+					continue
+				}
+				sum := sha512.Sum512(b)
+				leaves[i] = sum[:]
+			}
+		}(w)
+	}
+	for i := 0; i < chunks; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return leaves, nil
+}
+
+// sha512TreeRoot returns the HashSHA512Tree hash of chunk hashes `leaves`.
+func sha512TreeRoot(leaves [][]byte) []byte {
+	root := sha512.Sum512(bytes.Join(leaves, nil))
+	return root[:]
+}
+
+// hashAlgorithmOf returns the algorithm of a recorded `hash`.
+func hashAlgorithmOf(hash string) string {
+	return strings.SplitN(hash, "-", 2)[0]
+}
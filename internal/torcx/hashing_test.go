@@ -0,0 +1,80 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashFile(t *testing.T) {
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("torcx"), (2*hashTreeChunkSize+1234)/5)
+	path := filepath.Join(dir, "foo:1.torcx.tgz")
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha512.Sum512(content)
+	hash, err := hashFile(path, HashSHA512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "sha512-" + hex.EncodeToString(sum[:]); hash != expected {
+		t.Errorf("expected %s, got %s", expected, hash)
+	}
+
+	leaves := []byte{}
+	for off := 0; off < len(content); off += hashTreeChunkSize {
+		end := off + hashTreeChunkSize
+		if end > len(content) {
+			end = len(content)
+		}
+		leaf := sha512.Sum512(content[off:end])
+		leaves = append(leaves, leaf[:]...)
+	}
+	root := sha512.Sum512(leaves)
+	expected := "sha512tree-" + hex.EncodeToString(root[:])
+
+	oldWorkers := HashWorkers
+	defer func() { HashWorkers = oldWorkers }()
+	for _, workers := range []int{1, 2, 8} {
+		HashWorkers = workers
+		hash, err := hashFile(path, HashSHA512Tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != expected {
+			t.Errorf("%d workers: expected %s, got %s", workers, expected, hash)
+		}
+	}
+
+	for _, hash := range []string{expected, "sha512-" + hex.EncodeToString(sum[:])} {
+		valid, err := validateHash(path, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !valid {
+			t.Errorf("hash %s not validated", hash)
+		}
+	}
+	if valid, err := validateHash(path, "sha512tree-"+hex.EncodeToString(sum[:])); err != nil || valid {
+		t.Errorf("wrong hash validated: %v", err)
+	}
+}
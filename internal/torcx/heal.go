@@ -0,0 +1,161 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// hashSidecarSuffix is the suffix of files recording the verified hash of an archive.
+	hashSidecarSuffix = ".hash"
+	// corruptedSuffix is appended to archives which failed verification.
+	corruptedSuffix = ".corrupted"
+)
+
+var (
+	// ErrArchiveCorrupted is returned when an archive does not match its recorded hash
+	ErrArchiveCorrupted = errors.New("archive does not match its recorded hash")
+
+	// HealTimeout bounds the time spent refetching a corrupted archive at apply time.
+	HealTimeout = 30 * time.Second
+)
+
+// writeHashSidecar records the verified hash of the archive at `archivePath`.
+// The sidecar is atomically renamed in place, to be safe for concurrent readers.
+func writeHashSidecar(archivePath string, hash string) error {
+	sidecarPath := archivePath + hashSidecarSuffix
+	tmpFile, err := ioutil.TempFile(filepath.Dir(archivePath), ".hash")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmpFile.WriteString(hash + "\n"); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, sidecarPath)
+}
+
+// readHashSidecar returns the recorded hash of the archive at `archivePath`.
+func readHashSidecar(archivePath string) (string, error) {
+	b, err := ioutil.ReadFile(archivePath + hashSidecarSuffix)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// verifyArchive checks an archive against its recorded hash, if any,
+// falling back to the hash in its metadata sidecar.
+// Archives without a recorded hash are not verified.
+func verifyArchive(ar Archive) error {
+	return verifyArchiveWith(ar, nil)
+}
+
+// verifyArchiveWith is verifyArchive, verifying squashfs archives as
+// specified by `check`.
+func verifyArchiveWith(ar Archive, check *squashfsCheck) error {
+	hash, err := readHashSidecar(ar.Filepath)
+	if os.IsNotExist(err) {
+		meta, merr := ReadArchiveMeta(ar.Filepath)
+		if os.IsNotExist(merr) {
+			return nil
+		}
+		if merr != nil {
+			return merr
+		}
+		hash, err = meta.Hash, nil
+	}
+	if err != nil {
+		return err
+	}
+	if hash == "" {
+		return nil
+	}
+
+	valid, err := validateArchiveHash(ar.Filepath, ar.Format, hash, check)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return ErrArchiveCorrupted
+	}
+	return nil
+}
+
+// healArchive refetches a corrupted archive from the remote configured for
+// the image, moving the corrupted one aside. The refetched archive is
+// verified again before being returned.
+func healArchive(applyCfg *ApplyConfig, im Image, corrupted Archive) (Archive, error) {
+	if im.Remote == "" {
+		return Archive{}, errors.New("no remote configured for image")
+	}
+	logFields := logrus.Fields{
+		"image":     im.Name,
+		"reference": im.Reference,
+		"remote":    im.Remote,
+		"path":      corrupted.Filepath,
+	}
+	logrus.WithFields(logFields).Warn("archive verification failed, refetching from remote")
+
+	storeDir := filepath.Dir(corrupted.Filepath)
+	if err := os.Rename(corrupted.Filepath, corrupted.Filepath+corruptedSuffix); err != nil {
+		return Archive{}, errors.Wrap(err, "moving corrupted archive aside")
+	}
+	_ = os.Remove(corrupted.Filepath + hashSidecarSuffix)
+	_ = os.Remove(corrupted.Filepath + metaSidecarSuffix)
+
+	ctx, cancel := context.WithTimeout(context.Background(), HealTimeout)
+	defer cancel()
+	remotesCache, err := applyCfg.LoadRemotes(ctx, []string{im.Remote})
+	if err != nil {
+		return Archive{}, errors.Wrap(err, "loading remote")
+	}
+	if err := remotesCache.FetchImage(ctx, im, storeDir); err != nil {
+		return Archive{}, errors.Wrap(err, "refetching archive")
+	}
+
+	storeCache, err := NewStoreCache([]string{storeDir})
+	if err != nil {
+		return Archive{}, err
+	}
+	healed, err := storeCache.ArchiveFor(im)
+	if err != nil {
+		return Archive{}, errors.Wrap(err, "locating refetched archive")
+	}
+	if err := verifyArchive(healed); err != nil {
+		return Archive{}, errors.Wrap(err, "verifying refetched archive")
+	}
+
+	logrus.WithFields(logFields).WithField("path", healed.Filepath).Info("corrupted archive healed")
+	return healed, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestVerifyArchive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "torcx_heal_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	content := []byte("archive content")
+	ar := Archive{
+		Filepath: filepath.Join(tmpDir, "foo:1.torcx.tgz"),
+		Format:   ArchiveFormatTgz,
+	}
+	if err := ioutil.WriteFile(ar.Filepath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// No recorded hash
+	if err := verifyArchive(ar); err != nil {
+		t.Fatalf("expected no error without sidecar, got %s", err)
+	}
+
+	hash := strings.Replace(digest.SHA512.FromBytes(content).String(), ":", "-", 1)
+	if err := writeHashSidecar(ar.Filepath, hash); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyArchive(ar); err != nil {
+		t.Fatalf("expected no error with matching hash, got %s", err)
+	}
+
+	if err := ioutil.WriteFile(ar.Filepath, []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyArchive(ar); err != ErrArchiveCorrupted {
+		t.Fatalf("expected %s, got %v", ErrArchiveCorrupted, err)
+	}
+}
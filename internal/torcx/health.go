@@ -0,0 +1,152 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// healthCheckUnit is the generated unit running image health checks.
+const healthCheckUnit = "torcx-health-check.service"
+
+// HealthCheckResult is the outcome of a single image health check.
+type HealthCheckResult struct {
+	Image  Image  `json:"image"`
+	Check  string `json:"check"`
+	Error  string `json:"error,omitempty"`
+	Output string `json:"output,omitempty"`
+}
+
+// RunHealthChecks runs the health checks shipped by all images in the
+// current run profile, each bounded by `timeout`. If all of them pass, the
+// run profile is recorded as the last good profile, for rollback purposes.
+func RunHealthChecks(cc *CommonConfig, timeout time.Duration) ([]HealthCheckResult, error) {
+	if cc == nil {
+		return nil, errors.New("missing common configuration")
+	}
+	images, err := ReadProfilePath(cc.RunProfile())
+	if err != nil {
+		return nil, errors.Wrap(err, "reading run profile")
+	}
+
+	results := []HealthCheckResult{}
+	failed := 0
+	for _, im := range images {
+		imageRoot := filepath.Join(cc.RunUnpackDir(), imagePathName(im.Name))
+		assets, err := retrieveAssets(&ApplyConfig{CommonConfig: *cc}, imageRoot)
+		if err != nil {
+			return results, errors.Wrapf(err, "retrieving assets of %s", im.Name)
+		}
+		for _, check := range assets.Checks {
+			res := runHealthCheck(im, imageRoot, check, timeout)
+			if res.Error != "" {
+				failed++
+				logrus.WithFields(logrus.Fields{
+					"image": im.Name,
+					"check": check,
+				}).Error("health check failed: ", res.Error)
+			}
+			results = append(results, res)
+		}
+	}
+	if failed > 0 {
+		return results, errors.Errorf("%d health checks failed", failed)
+	}
+
+	if _, err := writeProfileV1(cc.GoodProfile(), images); err != nil {
+		return results, errors.Wrap(err, "recording good profile")
+	}
+	logrus.WithField("path", cc.GoodProfile()).Info("profile marked good")
+	return results, nil
+}
+
+// runHealthCheck runs the `check` executable of an image unpacked at `imageRoot`.
+func runHealthCheck(im Image, imageRoot string, check string, timeout time.Duration) HealthCheckResult {
+	res := HealthCheckResult{Image: im, Check: check}
+	if !filepath.IsAbs(check) || filepath.Clean(check) != check {
+		res.Error = "invalid check path, must be absolute and clean"
+		return res
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, filepath.Join(imageRoot, check))
+	cmd.Env = append(os.Environ(),
+		ImageEnvName+"="+im.Name,
+		ImageEnvVersion+"="+im.Reference,
+		ImageEnvRoot+"="+imageRoot,
+	)
+	out, err := cmd.CombinedOutput()
+	res.Output = strings.TrimSpace(string(out))
+	if ctx.Err() == context.DeadlineExceeded {
+		res.Error = "timed out after " + timeout.String()
+	} else if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// WriteHealthCheckUnit generates, in the systemd generator directory
+// `unitDir`, a unit running `command health-check` once the system is up.
+// Nothing is generated if no applied image ships health checks.
+func WriteHealthCheckUnit(applyCfg *ApplyConfig, unitDir string, command string) error {
+	if applyCfg == nil {
+		return errors.New("missing apply configuration")
+	}
+	hasChecks := false
+	for _, ai := range applyCfg.AppliedImages {
+		if len(ai.Checks) > 0 {
+			hasChecks = true
+		}
+	}
+	if !hasChecks {
+		return nil
+	}
+
+	unit := strings.Join([]string{
+		"# Automatically generated by torcx-generator",
+		"",
+		"[Unit]",
+		"Description=Health checks of torcx images",
+		"After=multi-user.target",
+		"",
+		"[Service]",
+		"Type=oneshot",
+		"ExecStart=" + command + " health-check",
+		"",
+	}, "\n")
+	if err := ioutil.WriteFile(filepath.Join(unitDir, healthCheckUnit), []byte(unit), 0644); err != nil {
+		return errors.Wrap(err, "writing health check unit")
+	}
+
+	wantsDir := filepath.Join(unitDir, "multi-user.target.wants")
+	if err := os.MkdirAll(wantsDir, 0755); err != nil {
+		return err
+	}
+	link := filepath.Join(wantsDir, healthCheckUnit)
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(filepath.Join("..", healthCheckUnit), link)
+}
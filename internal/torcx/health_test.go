@@ -0,0 +1,76 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunHealthChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_health_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cc := &CommonConfig{RunDir: filepath.Join(dir, "run"), BaseDir: filepath.Join(dir, "base")}
+	for _, d := range []string{cc.BaseDir, filepath.Join(cc.RunUnpackDir(), "foo", ".torcx"), filepath.Join(cc.RunUnpackDir(), "foo", "bin")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	images := []Image{{Name: "foo", Reference: "1"}}
+	if err := writeRunProfile(cc.RunProfile(), images); err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{"kind": "image-manifest-v0", "value": {"checks": ["/bin/check"]}}`
+	imageRoot := filepath.Join(cc.RunUnpackDir(), "foo")
+	if err := ioutil.WriteFile(filepath.Join(imageRoot, manifestPath), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checkPath := filepath.Join(imageRoot, "bin", "check")
+
+	if err := ioutil.WriteFile(checkPath, []byte("#!/bin/sh\necho unhealthy\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	results, err := RunHealthChecks(cc, time.Minute)
+	if err == nil {
+		t.Fatal("expected failing health check")
+	}
+	if len(results) != 1 || results[0].Output != "unhealthy" {
+		t.Errorf("unexpected results %+v", results)
+	}
+	if IsExistingPath(cc.GoodProfile()) {
+		t.Error("profile marked good despite failing check")
+	}
+
+	if err := ioutil.WriteFile(checkPath, []byte("#!/bin/sh\ntest \"$TORCX_IMAGE_NAME\" = foo\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RunHealthChecks(cc, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	good, err := ReadProfilePath(cc.GoodProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(good) != 1 || good[0].Name != "foo" || good[0].Reference != "1" {
+		t.Errorf("unexpected good profile %v", good)
+	}
+}
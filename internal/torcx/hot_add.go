@@ -0,0 +1,172 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// hotAddLock is the runtime directory file serializing hot-adds.
+const hotAddLock = ".hot-add.lock"
+
+// systemctlBinary is the tool used to reload systemd after a hot-add.
+var systemctlBinary = "systemctl"
+
+// ErrNotHotSafe is returned when hot-adding an image whose manifest does not
+// declare it hot-safe, or which ships assets requiring a reboot.
+var ErrNotHotSafe = errors.New("image is not hot-safe")
+
+// HotAdd applies the single image `im` on top of the sealed system, without
+// rebooting: it is unpacked, its binaries and units are propagated and
+// systemd is reloaded. Only images declaring `hot_safe` in their manifest,
+// without profile fragment nor networkd, sysusers, tmpfiles or udev assets,
+// can be hot-added, if apply policies allow it. The image is appended to the running profile and
+// recorded in the seal as an addendum, until the next apply.
+func HotAdd(applyCfg *ApplyConfig, im Image) (*AppliedImage, error) {
+	if applyCfg == nil {
+		return nil, errors.New("missing apply configuration")
+	}
+	if im.Name == "" || im.Reference == "" {
+		return nil, errors.New("missing image name or reference")
+	}
+
+	sealPath := applyCfg.systemPath(SealPath)
+	meta, err := ReadMetadata(sealPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading seal")
+	}
+	lock, err := lockFile(context.Background(), filepath.Join(applyCfg.RunDir, hotAddLock))
+	if err != nil {
+		return nil, err
+	}
+	defer unlockFile(lock)
+
+	running, err := ReadProfilePath(applyCfg.RunProfile())
+	if err != nil {
+		return nil, errors.Wrap(err, "reading run profile")
+	}
+	for _, entry := range running {
+		if entry.Name == im.Name {
+			return nil, errors.Errorf("image %s already applied, as %s:%s", im.Name, entry.Name, entry.Reference)
+		}
+	}
+
+	storeCache, err := NewStoreCache(applyCfg.StorePaths)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := resolveImageVersion(&storeCache, im)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHotSafe(applyCfg, &storeCache, resolved); err != nil {
+		return nil, err
+	}
+	// Policies apply to the running profile as it would be once extended.
+	if err := enforcePolicies(applyCfg, append(append([]Image{}, running...), resolved)); err != nil {
+		return nil, err
+	}
+
+	// The unpack directory is read-only once sealed.
+	unpackDir := applyCfg.RunUnpackDir()
+	if err := applyCfg.mounter().Mount(unpackDir, unpackDir, "", unix.MS_REMOUNT, ""); err != nil {
+		return nil, errors.Wrap(err, "failed to remount read-write")
+	}
+	applied, err := applyImage(applyCfg, &storeCache, resolved)
+	if rerr := applyCfg.mounter().Mount(unpackDir, unpackDir, "", unix.MS_REMOUNT|unix.MS_RDONLY, ""); rerr != nil && err == nil {
+		err = errors.Wrap(rerr, "failed to remount read-only")
+	}
+	if err != nil {
+		return nil, err
+	}
+	applied.Requested = im.Reference
+	applyCfg.AppliedImages = append(applyCfg.AppliedImages, applied)
+	if err := remountImageTmpfs(applyCfg); err != nil {
+		return &applied, err
+	}
+
+	if err := writeImageEnvFiles(filepath.Dir(sealPath), []AppliedImage{applied}); err != nil {
+		return &applied, err
+	}
+	if err := linkImageRoots(applyCfg.RunImagesDir(), []AppliedImage{applied}); err != nil {
+		return &applied, err
+	}
+	resolved.Provides = applied.Provides
+	if err := os.Chmod(applyCfg.RunProfile(), 0644); err != nil {
+		return &applied, err
+	}
+	if err := writeRunProfile(applyCfg.RunProfile(), append(running, resolved)); err != nil {
+		return &applied, err
+	}
+	hotAdded := strings.TrimSpace(meta[SealHotAdded] + " " + resolved.Name + ":" + resolved.Reference)
+	if err := updateSeal(sealPath, map[string]string{SealHotAdded: hotAdded}); err != nil {
+		return &applied, err
+	}
+
+	if !applyCfg.simulated() {
+		if out, err := exec.Command(systemctlBinary, "daemon-reload").CombinedOutput(); err != nil {
+			return &applied, errors.Wrapf(err, "systemd reload failed: %s", strings.TrimSpace(string(out)))
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"image":     applied.Name,
+		"reference": applied.Reference,
+		"path":      applied.Root,
+	}).Info("image hot-added")
+	return &applied, nil
+}
+
+// checkHotSafe inspects the archive for `im`, refusing it unless its
+// manifest declares it hot-safe and it only ships assets which can be
+// propagated on a running system.
+func checkHotSafe(applyCfg *ApplyConfig, storeCache *StoreCache, im Image) error {
+	_, archive, err := locateImage(applyCfg, storeCache, im)
+	if err != nil {
+		return err
+	}
+	meta, err := ReadArchiveMetadata(archive)
+	if err != nil {
+		return errors.Wrapf(err, "inspecting %s", archive.Filepath)
+	}
+	if !meta.Assets.HotSafe {
+		return errors.Wrap(ErrNotHotSafe, "manifest does not declare hot_safe")
+	}
+	if len(meta.Fragment) > 0 {
+		return errors.Wrap(ErrNotHotSafe, "image ships a profile fragment")
+	}
+	unsafe := []struct {
+		kind   string
+		assets []string
+	}{
+		{"network", meta.Assets.Network},
+		{"sysusers", meta.Assets.Sysusers},
+		{"tmpfiles", meta.Assets.Tmpfiles},
+		{"udev_rules", meta.Assets.UdevRules},
+	}
+	for _, entry := range unsafe {
+		if len(entry.assets) > 0 {
+			return errors.Wrapf(ErrNotHotSafe, "image ships %s assets", entry.kind)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestHotAdd(t *testing.T) {
+	dir := t.TempDir()
+	storeDir := filepath.Join(dir, "store")
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTgz(t, filepath.Join(storeDir, "foo:1.torcx.tgz"), map[string]string{
+		".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/foo"]}}`,
+		"bin/foo":              "foo",
+	})
+	writeTestTgz(t, filepath.Join(storeDir, "tool:2.torcx.tgz"), map[string]string{
+		".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/tool"], "hot_safe": true}}`,
+		"bin/tool":             "tool",
+	})
+	writeTestTgz(t, filepath.Join(storeDir, "users:1.torcx.tgz"), map[string]string{
+		".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"sysusers": ["/sysusers/users.conf"], "hot_safe": true}}`,
+		"sysusers/users.conf":  "u users - -\n",
+	})
+
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			BaseDir:    filepath.Join(dir, "base"),
+			RunDir:     DefaultRunDir,
+			ConfDir:    filepath.Join(dir, "conf"),
+			UsrDir:     filepath.Join(dir, "usr"),
+			StorePaths: []string{storeDir},
+		},
+		UpperProfile: "user",
+	}
+	profileDir := applyCfg.UserProfileDir()
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	profile := `{"kind": "profile-manifest-v1", "value": {"images": [{"name": "foo", "reference": "1"}]}}`
+	if err := ioutil.WriteFile(filepath.Join(profileDir, "user.json"), []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "target")
+	if err := SimulateApply(applyCfg, target); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, im := range []Image{{Name: "foo", Reference: "1"}, {Name: "users", Reference: "1"}} {
+		if _, err := HotAdd(applyCfg, im); err == nil {
+			t.Errorf("expected error hot-adding %s", im.Name)
+		}
+	}
+	if _, err := HotAdd(applyCfg, Image{Name: "users", Reference: "1"}); errors.Cause(err) != ErrNotHotSafe {
+		t.Errorf("expected %v, got %v", ErrNotHotSafe, err)
+	}
+
+	// Enforced policies also apply to hot-added images.
+	policyPath := filepath.Join(applyCfg.ConfDir, "policies", "no-tool.json")
+	if err := os.MkdirAll(filepath.Dir(policyPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	policy := `{"kind": "torcx-policy-v0", "value": {"rules": [{"name": "no-tool", "image": "tool", "forbidden": true}]}}`
+	if err := ioutil.WriteFile(policyPath, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := HotAdd(applyCfg, Image{Name: "tool", Reference: "2"}); errors.Cause(err) != ErrPolicyViolation {
+		t.Errorf("expected %v, got %v", ErrPolicyViolation, err)
+	}
+	if IsExistingPath(filepath.Join(applyCfg.RunBinDir(), "tool")) {
+		t.Error("unexpected binary of an image refused by policy")
+	}
+	if err := os.Remove(policyPath); err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := HotAdd(applyCfg, Image{Name: "tool", Reference: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := os.Readlink(filepath.Join(applyCfg.RunBinDir(), "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bin != filepath.Join(applied.Root, "bin", "tool") {
+		t.Errorf("unexpected binary symlink %s", bin)
+	}
+	images, err := ReadProfilePath(applyCfg.RunProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[1].Name != "tool" || images[1].Reference != "2" {
+		t.Errorf("unexpected run profile %v", images)
+	}
+	seal, err := ReadMetadata(applyCfg.systemPath(SealPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seal[SealHotAdded] != "tool:2" {
+		t.Errorf("unexpected hot-added images %q", seal[SealHotAdded])
+	}
+	if !IsExistingPath(filepath.Join(target, filepath.Dir(SealPath), imageEnvPrefix+"tool")) {
+		t.Error("missing image environment file")
+	}
+	if _, err := HotAdd(applyCfg, Image{Name: "tool", Reference: "2"}); err == nil {
+		t.Error("expected error hot-adding an image twice")
+	}
+}
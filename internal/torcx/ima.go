@@ -0,0 +1,110 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// imaXattr is the extended attribute holding IMA hashes and signatures.
+	imaXattr = "security.ima"
+	// imaDigsig and imaVerityDigsig are the IMA xattr types carrying a
+	// signature (as opposed to a plain hash).
+	imaDigsig       = 0x03
+	imaVerityDigsig = 0x06
+)
+
+var (
+	// IMAPolicyPath is the securityfs entry exposing the IMA policy.
+	IMAPolicyPath = "/sys/kernel/security/ima/policy"
+	// kernelCmdlinePath is where kernel boot parameters are read from.
+	kernelCmdlinePath = "/proc/cmdline"
+
+	// getIMAXattr returns the raw IMA attribute of `path`.
+	getIMAXattr = func(path string) ([]byte, error) {
+		size, err := unix.Getxattr(path, imaXattr, nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		size, err = unix.Getxattr(path, imaXattr, buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	}
+)
+
+// imaAppraisalEnforced returns whether the host enforces an IMA appraisal
+// policy, i.e. the loaded policy has appraise rules and appraisal has not
+// been relaxed on the kernel command-line.
+func imaAppraisalEnforced() bool {
+	if cmdline, err := ioutil.ReadFile(kernelCmdlinePath); err == nil {
+		for _, token := range strings.Fields(string(cmdline)) {
+			switch token {
+			case "ima_appraise=off", "ima_appraise=log", "ima_appraise=fix":
+				return false
+			}
+		}
+	}
+
+	fp, err := os.Open(IMAPolicyPath)
+	if err != nil {
+		return false
+	}
+	defer fp.Close()
+	sc := bufio.NewScanner(fp)
+	for sc.Scan() {
+		if strings.HasPrefix(strings.TrimSpace(sc.Text()), "appraise ") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIMASignatures ensures all binaries of an unpacked image carry an
+// IMA signature, as they would otherwise be denied execution.
+func checkIMASignatures(imageRoot string, binaries []string) error {
+	if imageRoot == "" {
+		return errors.New("missing image top directory")
+	}
+
+	unsigned := []string{}
+	for _, binEntry := range binaries {
+		if binEntry == "" {
+			continue
+		}
+		path := filepath.Join(imageRoot, binEntry)
+		value, err := getIMAXattr(path)
+		if err != nil && err != unix.ENODATA {
+			return errors.Wrapf(err, "failed to read IMA attribute of %s", binEntry)
+		}
+		if len(value) == 0 || (value[0] != imaDigsig && value[0] != imaVerityDigsig) {
+			unsigned = append(unsigned, binEntry)
+		}
+	}
+	if len(unsigned) > 0 {
+		return errors.Errorf("binaries lack IMA signatures, while appraisal is enforced: %s", strings.Join(unsigned, ", "))
+	}
+	return nil
+}
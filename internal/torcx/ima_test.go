@@ -0,0 +1,77 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestIMAAppraisalEnforced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_ima_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origPolicy, origCmdline := IMAPolicyPath, kernelCmdlinePath
+	defer func() { IMAPolicyPath, kernelCmdlinePath = origPolicy, origCmdline }()
+	IMAPolicyPath = filepath.Join(dir, "policy")
+	kernelCmdlinePath = filepath.Join(dir, "cmdline")
+
+	if imaAppraisalEnforced() {
+		t.Error("expected no appraisal without policy")
+	}
+	if err := ioutil.WriteFile(IMAPolicyPath, []byte("measure func=BPRM_CHECK\nappraise func=BPRM_CHECK appraise_type=imasig\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !imaAppraisalEnforced() {
+		t.Error("expected appraisal to be enforced")
+	}
+	if err := ioutil.WriteFile(kernelCmdlinePath, []byte("root=/dev/sda ima_appraise=log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if imaAppraisalEnforced() {
+		t.Error("expected appraisal in log mode not to be enforced")
+	}
+}
+
+func TestCheckIMASignatures(t *testing.T) {
+	origGet := getIMAXattr
+	defer func() { getIMAXattr = origGet }()
+	xattrs := map[string][]byte{
+		"/root/bin/signed": {imaDigsig, 0x02},
+		"/root/bin/hashed": {0x04, 0x01},
+	}
+	getIMAXattr = func(path string) ([]byte, error) {
+		if v, ok := xattrs[path]; ok {
+			return v, nil
+		}
+		return nil, unix.ENODATA
+	}
+
+	if err := checkIMASignatures("/root", []string{"/bin/signed"}); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	for _, bin := range []string{"/bin/hashed", "/bin/missing"} {
+		if err := checkIMASignatures("/root", []string{"/bin/signed", bin}); err == nil {
+			t.Errorf("expected error for %s", bin)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// imageCurrentLink is the name of the per-image symlink to its unpack root.
+	imageCurrentLink = "current"
+	// imageEnvPrefix is the file name prefix of per-image environment files.
+	imageEnvPrefix = "torcx-"
+
+	// ImageEnvName is the key label for the image name
+	ImageEnvName = "TORCX_IMAGE_NAME"
+	// ImageEnvReference is the key label for the reference requested by the profile
+	ImageEnvReference = "TORCX_IMAGE_REFERENCE"
+	// ImageEnvVersion is the key label for the concrete applied reference
+	ImageEnvVersion = "TORCX_IMAGE_VERSION"
+	// ImageEnvDigest is the key label for the recorded archive hash
+	ImageEnvDigest = "TORCX_IMAGE_DIGEST"
+	// ImageEnvArchive is the key label for the applied archive path
+	ImageEnvArchive = "TORCX_IMAGE_ARCHIVE"
+	// ImageEnvRoot is the key label for the unpacked image root
+	ImageEnvRoot = "TORCX_IMAGE_ROOT"
+)
+
+// AppliedImage records an image applied by the current profile.
+type AppliedImage struct {
+	// Image is the concrete image, after version and alias resolution.
+	Image
+	// Requested is the reference as requested by the profile.
+	Requested string
+	// Archive is the path of the applied archive.
+	Archive string
+	// Digest is the recorded hash of the archive, if any.
+	Digest string
+	// Root is where the image has been unpacked.
+	Root string
+	// Checks are the health-check executables shipped by the image.
+	Checks []string
+}
+
+// ImageEnvPath returns the path of the environment file for image `name`,
+// written next to the seal.
+func ImageEnvPath(name string) string {
+	return filepath.Join(filepath.Dir(RootPath(SealPath)), imageEnvPrefix+imagePathName(name))
+}
+
+// archiveDigest returns the recorded hash of `ar`, or an empty string.
+func archiveDigest(ar Archive) string {
+	hash, err := readHashSidecar(ar.Filepath)
+	if err != nil {
+		return ""
+	}
+	return hash
+}
+
+// writeImageEnvFiles writes an environment file in `dir` for each applied
+// image, suitable for systemd `EnvironmentFile=` directives.
+func writeImageEnvFiles(dir string, applied []AppliedImage) error {
+	for _, ai := range applied {
+		content := []string{
+			fmt.Sprintf("%s=%q", ImageEnvName, ai.Name),
+			fmt.Sprintf("%s=%q", ImageEnvReference, ai.Requested),
+			fmt.Sprintf("%s=%q", ImageEnvVersion, ai.Reference),
+			fmt.Sprintf("%s=%q", ImageEnvDigest, ai.Digest),
+			fmt.Sprintf("%s=%q", ImageEnvArchive, ai.Archive),
+			fmt.Sprintf("%s=%q", ImageEnvRoot, ai.Root),
+		}
+		path := filepath.Join(dir, imageEnvPrefix+imagePathName(ai.Name))
+		data := []byte(strings.Join(content, "\n") + "\n")
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			return errors.Wrapf(err, "writing environment file for %s", ai.Name)
+		}
+	}
+	return nil
+}
+
+// linkImageRoots points a stable `<dir>/<name>/current` symlink to the
+// unpack root of each applied image, so that external units can reference
+// image paths without encoding versions. Links are atomically replaced.
+func linkImageRoots(dir string, applied []AppliedImage) error {
+	for _, ai := range applied {
+		imageDir := filepath.Join(dir, imagePathName(ai.Name))
+		if err := os.MkdirAll(imageDir, 0755); err != nil {
+			return err
+		}
+		link := filepath.Join(imageDir, imageCurrentLink)
+		tmpLink := link + ".tmp"
+		if err := os.Remove(tmpLink); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Symlink(ai.Root, tmpLink); err != nil {
+			return errors.Wrapf(err, "linking root of %s", ai.Name)
+		}
+		if err := os.Rename(tmpLink, link); err != nil {
+			_ = os.Remove(tmpLink)
+			return errors.Wrapf(err, "linking root of %s", ai.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteImageEnvFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_imageenv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	applied := []AppliedImage{
+		{
+			Image:     Image{Name: "docker", Reference: "19.03"},
+			Requested: "stable",
+			Archive:   "/var/lib/torcx/store/docker:19.03.torcx.tgz",
+			Digest:    "sha512-0123",
+			Root:      "/run/torcx/unpack/docker",
+		},
+	}
+	if err := writeImageEnvFiles(dir, applied); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := ReadMetadata(filepath.Join(dir, "torcx-docker"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		ImageEnvName:      "docker",
+		ImageEnvReference: "stable",
+		ImageEnvVersion:   "19.03",
+		ImageEnvDigest:    "sha512-0123",
+		ImageEnvArchive:   "/var/lib/torcx/store/docker:19.03.torcx.tgz",
+		ImageEnvRoot:      "/run/torcx/unpack/docker",
+	}
+	for key, value := range expected {
+		if meta[key] != value {
+			t.Errorf("expected %s=%q, got %q", key, value, meta[key])
+		}
+	}
+}
+
+func TestLinkImageRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_imageenv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	applied := []AppliedImage{{Image: Image{Name: "docker", Reference: "19.03"}, Root: "/run/torcx/unpack/docker"}}
+	for i := 0; i < 2; i++ {
+		if err := linkImageRoots(dir, applied); err != nil {
+			t.Fatal(err)
+		}
+		target, err := os.Readlink(filepath.Join(dir, "docker", "current"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != applied[0].Root {
+			t.Errorf("expected link to %s, got %s", applied[0].Root, target)
+		}
+		applied[0].Root = "/run/torcx/unpack/docker-next"
+	}
+}
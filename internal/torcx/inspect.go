@@ -0,0 +1,90 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInspectUnsupported is returned when an archive format cannot be inspected without mounting it
+	// (i.e. squashfs archives, when unsquashfs is not available)
+	ErrInspectUnsupported = errors.New("archive format cannot be inspected without mounting")
+)
+
+// ImageMetadata holds metadata embedded in an image archive.
+type ImageMetadata struct {
+	// Assets are the assets listed in the image manifest
+	Assets Assets `json:"assets"`
+	// Fragment are the images requested by the profile fragment
+	Fragment []Image `json:"fragment,omitempty"`
+	// Files are the absolute paths of all non-directory entries in the archive
+	Files []string `json:"-"`
+}
+
+// ReadArchiveMetadata reads the image manifest and profile fragment embedded
+// in an archive, without unpacking nor mounting it.
+func ReadArchiveMetadata(ar Archive) (*ImageMetadata, error) {
+	reader, err := OpenArchive(ar)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := reader.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &ImageMetadata{}
+	hasManifest, hasFragment := false, false
+	for _, entry := range entries {
+		if entry.Mode.IsDir() {
+			continue
+		}
+		meta.Files = append(meta.Files, entry.Path)
+		switch entry.Path {
+		case manifestPath:
+			hasManifest = true
+		case fragmentPath:
+			hasFragment = true
+		}
+	}
+
+	if hasManifest {
+		b, err := reader.ReadFile(manifestPath)
+		if err != nil {
+			return nil, err
+		}
+		assets, err := decodeImageManifest(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding image manifest in %q", ar.Filepath)
+		}
+		meta.Assets = *assets
+	}
+	if hasFragment {
+		b, err := reader.ReadFile(fragmentPath)
+		if err != nil {
+			return nil, err
+		}
+		images, err := readProfileReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding profile fragment in %q", ar.Filepath)
+		}
+		meta.Fragment = images
+	}
+
+	return meta, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+)
+
+// InventoryV0K - node inventory kind, v0
+const InventoryV0K = "torcx-inventory-v0"
+
+// Inventory describes the torcx state of a node, for asset management systems.
+type Inventory struct {
+	// MachineID is the node machine-id, if known.
+	MachineID string `json:"machine_id"`
+	// Hostname is the node hostname, if known.
+	Hostname string `json:"hostname"`
+	// OsVersionID is the VERSION_ID of the running OS, if known.
+	OsVersionID string `json:"os_version_id"`
+	// Sealed is whether a profile has been applied and sealed.
+	Sealed bool `json:"sealed"`
+	// UpperProfile is the applied upper profile, if sealed.
+	UpperProfile string `json:"upper_profile,omitempty"`
+	// LowerProfiles are the applied lower profiles, if sealed.
+	LowerProfiles []string `json:"lower_profiles,omitempty"`
+	// NextProfile is the upper profile pending for the next boot.
+	NextProfile string `json:"next_profile,omitempty"`
+	// Applied are the images applied by the sealed profile.
+	Applied []InventoryImage `json:"applied"`
+	// Store are the archives available in all stores.
+	Store []InventoryImage `json:"store"`
+	// Time is when the inventory was taken.
+	Time time.Time `json:"time"`
+}
+
+// InventoryImage is an image archive listed in an inventory.
+type InventoryImage struct {
+	Name      string `json:"name"`
+	Reference string `json:"reference"`
+	// Requested is the reference requested by the profile, for applied images.
+	Requested string `json:"requested,omitempty"`
+	Format    string `json:"format,omitempty"`
+	Archive   string `json:"archive"`
+	// Digest is the archive hash, if recorded (or computed).
+	Digest string `json:"digest,omitempty"`
+}
+
+// InventoryV0JSON is the JSON record of a node inventory.
+type InventoryV0JSON struct {
+	Kind  string    `json:"kind"`
+	Value Inventory `json:"value"`
+}
+
+// NewInventory takes the inventory of the node torcx state. Store archives
+// without a recorded hash are hashed if `computeDigests` is set.
+func NewInventory(cc *CommonConfig, computeDigests bool) (*Inventory, error) {
+	return newInventory(cc, RootPath(SealPath), computeDigests)
+}
+
+// newInventory implements NewInventory against the seal file at `sealPath`.
+func newInventory(cc *CommonConfig, sealPath string, computeDigests bool) (*Inventory, error) {
+	if cc == nil {
+		return nil, errors.New("missing common configuration")
+	}
+	node := CurrentNodeIdentity()
+	inv := &Inventory{
+		MachineID:   node.MachineID,
+		Hostname:    node.Hostname,
+		OsVersionID: sealOsVersionID(cc.UsrDir),
+		Applied:     []InventoryImage{},
+		Store:       []InventoryImage{},
+		Time:        time.Now().UTC(),
+	}
+	if next, err := cc.NextProfileName(); err == nil {
+		inv.NextProfile = next
+	}
+
+	if meta, err := ReadMetadata(sealPath); err == nil {
+		inv.Sealed = true
+		inv.UpperProfile = meta[SealUpperProfile]
+		if lower := meta[SealLowerProfiles]; lower != "" {
+			inv.LowerProfiles = strings.Split(lower, ":")
+		}
+		applied, err := appliedInventoryImages(cc, sealPath)
+		if err != nil {
+			return nil, err
+		}
+		inv.Applied = applied
+	}
+
+	storeCache, err := NewStoreCache(cc.StorePaths)
+	if err != nil {
+		return nil, err
+	}
+	for _, ar := range storeCache.Images {
+		entry := InventoryImage{
+			Name:      ar.Name,
+			Reference: ar.Reference,
+			Format:    string(ar.Format),
+			Archive:   ar.Filepath,
+			Digest:    archiveDigest(ar),
+		}
+		if entry.Digest == "" && computeDigests {
+			if entry.Digest, err = computeHash(ar.Filepath); err != nil {
+				return nil, errors.Wrapf(err, "failed to hash %s", ar.Filepath)
+			}
+		}
+		inv.Store = append(inv.Store, entry)
+	}
+	sort.Slice(inv.Store, func(i, j int) bool {
+		if inv.Store[i].Name != inv.Store[j].Name {
+			return inv.Store[i].Name < inv.Store[j].Name
+		}
+		return inv.Store[i].Reference < inv.Store[j].Reference
+	})
+	return inv, nil
+}
+
+// appliedInventoryImages lists the images of the run profile, as recorded
+// in their environment files next to the seal file at `sealPath`.
+func appliedInventoryImages(cc *CommonConfig, sealPath string) ([]InventoryImage, error) {
+	applied := []InventoryImage{}
+	images, err := ReadProfilePath(cc.RunProfile())
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Wrap(err, "reading run profile")
+	}
+	for _, im := range images {
+		env, err := ReadMetadata(filepath.Join(filepath.Dir(sealPath), imageEnvPrefix+imagePathName(im.Name)))
+		if err != nil {
+			continue
+		}
+		applied = append(applied, InventoryImage{
+			Name:      im.Name,
+			Reference: env[ImageEnvVersion],
+			Requested: env[ImageEnvReference],
+			Archive:   env[ImageEnvArchive],
+			Digest:    env[ImageEnvDigest],
+		})
+	}
+	return applied, nil
+}
+
+// EncodeInventory serializes `inv` as a JSON document, clearsigned by
+// `signer` if not nil.
+func EncodeInventory(inv *Inventory, signer *openpgp.Entity) ([]byte, error) {
+	if inv == nil {
+		return nil, errors.New("missing inventory")
+	}
+	return encodeSignedJSON(InventoryV0JSON{InventoryV0K, *inv}, signer)
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestInventory(t *testing.T) {
+	dir := t.TempDir()
+	storeDir := filepath.Join(dir, "store")
+	cc := &CommonConfig{
+		RunDir:     filepath.Join(dir, "run"),
+		ConfDir:    filepath.Join(dir, "conf"),
+		UsrDir:     filepath.Join(dir, "usr"),
+		StorePaths: []string{storeDir},
+	}
+	metadataDir := filepath.Join(dir, "metadata")
+	for _, d := range []string{metadataDir, cc.RunDir, cc.ConfDir, storeDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fooArchive := filepath.Join(storeDir, "foo:1.torcx.tgz")
+	barArchive := filepath.Join(storeDir, "bar:2.torcx.squashfs")
+	for _, path := range []string{fooArchive, barArchive} {
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cc.SetNextProfileName("next"); err != nil {
+		t.Fatal(err)
+	}
+	profile := `{"kind": "profile-manifest-v1", "value": {"images": []}}`
+	if err := ioutil.WriteFile(filepath.Join(cc.UserProfileDir(), "next.json"), []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unsealed nodes only report their stores.
+	inv, err := newInventory(cc, filepath.Join(metadataDir, "torcx"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.Sealed || len(inv.Applied) != 0 || len(inv.Store) != 2 || inv.NextProfile != "next" {
+		t.Errorf("unexpected unsealed inventory %+v", inv)
+	}
+	if inv.Store[0].Name != "bar" || inv.Store[0].Digest != "" {
+		t.Errorf("unexpected store entry %+v", inv.Store[0])
+	}
+
+	fooDigest, err := computeHash(fooArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := []Image{{Name: "foo", Reference: "1"}}
+	if err := writeRunProfile(cc.RunProfile(), images); err != nil {
+		t.Fatal(err)
+	}
+	applied := []AppliedImage{{Image: images[0], Requested: "latest", Archive: fooArchive, Digest: fooDigest}}
+	if err := writeImageEnvFiles(metadataDir, applied); err != nil {
+		t.Fatal(err)
+	}
+	sealPath := filepath.Join(metadataDir, "torcx")
+	seal := "TORCX_LOWER_PROFILES=\"vendor:oem\"\nTORCX_UPPER_PROFILE=\"user\"\n"
+	if err := ioutil.WriteFile(sealPath, []byte(seal), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	inv, err = newInventory(cc, sealPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inv.Sealed || inv.UpperProfile != "user" || len(inv.LowerProfiles) != 2 {
+		t.Errorf("unexpected sealed inventory %+v", inv)
+	}
+	if len(inv.Applied) != 1 || inv.Applied[0].Reference != "1" || inv.Applied[0].Requested != "latest" || inv.Applied[0].Digest != fooDigest {
+		t.Errorf("unexpected applied images %+v", inv.Applied)
+	}
+	if inv.Store[1].Name != "foo" || inv.Store[1].Digest != fooDigest {
+		t.Errorf("expected computed store digest, got %+v", inv.Store[1])
+	}
+
+	signer := writeTrustedKey(t, filepath.Join(t.TempDir(), "key.asc"))
+	b, err := EncodeInventory(inv, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := verifyManifest("inventory", string(b), []openpgp.KeyRing{openpgp.EntityList{signer}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record InventoryV0JSON
+	if err := json.Unmarshal([]byte(plaintext), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Kind != InventoryV0K || record.Value.UpperProfile != "user" {
+		t.Errorf("unexpected signed inventory %+v", record)
+	}
+}
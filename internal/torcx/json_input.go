@@ -23,6 +23,10 @@ const (
 	RemoteManifestV0K = "remote-manifest-v0"
 	// RemoteContentsV1K - remote contents kind, v1
 	RemoteContentsV1K = "torcx-remote-contents-v1"
+	// RemoteDiscoveryV0K - remote discovery document kind, v0
+	RemoteDiscoveryV0K = "torcx-remote-discovery-v0"
+	// NodeProfilesV0K - node profile overrides kind, v0
+	NodeProfilesV0K = "torcx-node-profiles-v0"
 )
 
 // * Profile manifest version 1: added "remote".
@@ -36,13 +40,28 @@ type ProfileManifestV1JSON struct {
 // ImagesV1 contains an array of image entries.
 type ImagesV1 struct {
 	Images []ImageV1 `json:"images"`
+	// Recommends are weak dependencies, only applied if available
+	Recommends []ImageV1 `json:"recommends,omitempty"`
+	// Roles are the names of the roles the images must satisfy
+	Roles []string `json:"roles,omitempty"`
+	// Annotations are free-form metadata (e.g. owner), see AnnotateProfile
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 // ImageV1 describes and addon image within a v1 profile.
 type ImageV1 struct {
-	Name      string `json:"name"`
-	Reference string `json:"reference"`
-	Remote    string `json:"remote"`
+	Name         string `json:"name"`
+	Reference    string `json:"reference"`
+	Remote       string `json:"remote"`
+	BootCritical bool   `json:"boot_critical,omitempty"`
+	// Enable are units of the image to enable on apply
+	Enable []string `json:"enable,omitempty"`
+	// Conditions restrict the environments the image is applied in
+	Conditions *ImageConditions `json:"conditions,omitempty"`
+	// Propagation is how assets are propagated (e.g. "path-only")
+	Propagation string `json:"propagation,omitempty"`
+	// Capability requests any image providing it, see Assets.Provides
+	Capability string `json:"capability,omitempty"`
 }
 
 // * Profile manifest version 0: initial version.
@@ -74,8 +93,17 @@ type RemoteManifestV0JSON struct {
 
 // RemoteV0 describes a remote.
 type RemoteV0 struct {
-	BaseURL string        `json:"base_url"`
-	Keys    []RemoteKeyV0 `json:"keys"`
+	BaseURL         string              `json:"base_url"`
+	Keys            []RemoteKeyV0       `json:"keys"`
+	DNSServers      []string            `json:"dns_servers,omitempty"`
+	Hosts           map[string][]string `json:"hosts,omitempty"`
+	DiscoveryDomain string              `json:"discovery_domain,omitempty"`
+	Peers           []string            `json:"peers,omitempty"`
+	ArchiveProxy    string              `json:"archive_proxy,omitempty"`
+	// CredentialHelper provides credentials for this remote at fetch time
+	CredentialHelper string `json:"credential_helper,omitempty"`
+	// Credential is the systemd credential holding credentials for this remote
+	Credential string `json:"credential,omitempty"`
 }
 
 // RemoteKeyV0 represents a signing key for a remote.
@@ -83,6 +111,19 @@ type RemoteKeyV0 struct {
 	ArmoredKeyring string `json:"armored_keyring,omitempty"`
 }
 
+// * Remote discovery version 0: initial version.
+
+// RemoteDiscoveryV0JSON holds a JSON well-known discovery document (version 0).
+type RemoteDiscoveryV0JSON struct {
+	Kind  string            `json:"kind"`
+	Value RemoteDiscoveryV0 `json:"value"`
+}
+
+// RemoteDiscoveryV0 describes a discovered remote location.
+type RemoteDiscoveryV0 struct {
+	BaseURL string `json:"base_url"`
+}
+
 // * Remote contents version 1: initial version.
 
 // RemoteContentsV1JSON holds JSON contents metadata for a remote manifest.
@@ -106,8 +147,37 @@ type RemoteImageV1 struct {
 // RemoteVersionV1 describes a specific image (with version and format)
 // available on a remote.
 type RemoteVersionV1 struct {
-	Format   string `json:"format"`
-	Hash     string `json:"hash"`
-	Location string `json:"location"`
-	Version  string `json:"version"`
+	Format         string `json:"format"`
+	Hash           string `json:"hash"`
+	Location       string `json:"location"`
+	DigestLocation string `json:"digestLocation,omitempty"`
+	Version        string `json:"version"`
+	Notes          string `json:"notes,omitempty"`
+	NotesURL       string `json:"notesURL,omitempty"`
+	Size           int64  `json:"size,omitempty"`
+	// ManifestLocation and FragmentLocation point to the image manifest
+	// and profile fragment, published alongside the archive.
+	ManifestLocation string `json:"manifestLocation,omitempty"`
+	FragmentLocation string `json:"fragmentLocation,omitempty"`
+}
+
+// * Node profile overrides version 0: initial version.
+
+// NodeProfilesV0JSON holds JSON per-node profile overrides (version 0).
+type NodeProfilesV0JSON struct {
+	Kind  string         `json:"kind"`
+	Value NodeProfilesV0 `json:"value"`
+}
+
+// NodeProfilesV0 contains an ordered list of node matching rules.
+type NodeProfilesV0 struct {
+	Rules []NodeProfileRuleV0 `json:"rules"`
+}
+
+// NodeProfileRuleV0 maps nodes to an upper profile. Empty matchers
+// match any node.
+type NodeProfileRuleV0 struct {
+	Hostname        string `json:"hostname,omitempty"`
+	MachineIDPrefix string `json:"machine_id_prefix,omitempty"`
+	Profile         string `json:"profile"`
 }
@@ -0,0 +1,201 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// signatureSidecarSuffix is appended to archive paths for detached
+	// (armored) signatures.
+	signatureSidecarSuffix = ".asc"
+	// trustedKeySuffix is the suffix of armored keys in the trust store.
+	trustedKeySuffix = ".asc"
+)
+
+// LockdownPath is the securityfs entry exposing the kernel lockdown mode.
+var LockdownPath = "/sys/kernel/security/lockdown"
+
+// kernelLockdown returns whether the kernel runs in a lockdown mode,
+// i.e. the selected mode (in brackets) is not "none".
+func kernelLockdown() bool {
+	b, err := ioutil.ReadFile(LockdownPath)
+	if err != nil {
+		return false
+	}
+	for _, mode := range strings.Fields(string(b)) {
+		if strings.HasPrefix(mode, "[") {
+			return mode != "[none]"
+		}
+	}
+	return false
+}
+
+// signaturesRequired returns whether only signed images can be applied,
+// either by configuration or because of kernel lockdown.
+func (cc *CommonConfig) signaturesRequired() bool {
+	return cc.RequireSignedImages || kernelLockdown()
+}
+
+// LoadTrustedKeys loads all armored keys from the machine trust store.
+// Missing directories are skipped.
+func (cc *CommonConfig) LoadTrustedKeys() (openpgp.EntityList, error) {
+	return loadArmoredKeysFrom(cc.TrustedKeysDirs())
+}
+
+// loadArmoredKeysFrom loads all armored keys from `dirs`, skipping
+// missing directories.
+func loadArmoredKeysFrom(dirs []string) (openpgp.EntityList, error) {
+	keys := openpgp.EntityList{}
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, fi := range files {
+			if !fi.Mode().IsRegular() || !strings.HasSuffix(fi.Name(), trustedKeySuffix) {
+				continue
+			}
+			path := filepath.Join(dir, fi.Name())
+			el, err := readArmoredKeys(path)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to load trusted keys from %s", path)
+			}
+			keys = append(keys, el...)
+		}
+	}
+	return keys, nil
+}
+
+// readArmoredKeys reads an armored keyring at `path`.
+func readArmoredKeys(path string) (openpgp.EntityList, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return openpgp.ReadArmoredKeyRing(bufio.NewReader(fp))
+}
+
+// VerifyDetachedSignature checks the armored detached signature at
+// `sigPath` for the file at `path` against `keyrings`, returning the signer.
+// If the signature is countersigned by a timestamp token from one of
+// `authorities`, signing keys are checked at the timestamp.
+func VerifyDetachedSignature(path string, sigPath string, keyrings []openpgp.KeyRing, authorities *x509.CertPool) (*openpgp.Entity, error) {
+	if len(keyrings) == 0 {
+		return nil, errors.New("no keys to verify signature")
+	}
+	if _, err := os.Stat(sigPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("%s is not signed", path)
+		}
+		return nil, err
+	}
+	stamp, err := readSignatureTimestamp(sigPath, authorities)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, keyring := range keyrings {
+		signer, err := checkDetachedSignature(path, sigPath, keyring, stamp)
+		if err == nil {
+			return signer, nil
+		}
+		lastErr = preferSignatureError(lastErr, err)
+	}
+	return nil, errors.Wrapf(lastErr, "verifying signature of %s", path)
+}
+
+// checkDetachedSignature checks a detached signature against a single keyring.
+func checkDetachedSignature(path string, sigPath string, keyring openpgp.KeyRing, stamp *signatureTimestamp) (*openpgp.Entity, error) {
+	sig, err := os.Open(sigPath)
+	if err != nil {
+		return nil, err
+	}
+	defer sig.Close()
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return checkArmoredSignature(keyring, bufio.NewReader(fp), bufio.NewReader(sig), stamp)
+}
+
+// verifyArchiveSignature checks the detached signature sidecar of `ar`
+// (or the signature in its metadata sidecar) against `keys`, returning
+// the signer.
+func verifyArchiveSignature(ar Archive, keys openpgp.EntityList, authorities *x509.CertPool) (*openpgp.Entity, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no trusted keys in the machine trust store")
+	}
+	if !IsExistingPath(ar.Filepath + signatureSidecarSuffix) {
+		if meta, err := ReadArchiveMeta(ar.Filepath); err == nil && meta.Signature != "" {
+			return meta.checkSignature(ar.Filepath, []openpgp.KeyRing{keys})
+		}
+	}
+	return VerifyDetachedSignature(ar.Filepath, ar.Filepath+signatureSidecarSuffix, []openpgp.KeyRing{keys}, authorities)
+}
+
+// enforceSignaturePolicy refuses archives not signed by a trusted key,
+// when signatures are required. Archives of namespaces with their own keys
+// must always be signed by one of them; machine-wide keys are not used.
+func enforceSignaturePolicy(cc *CommonConfig, ar Archive) error {
+	var keys openpgp.EntityList
+	var err error
+	if ns, _ := SplitNamespace(ar.Name); ns != "" {
+		if keys, err = cc.LoadNamespaceKeys(ns); err != nil {
+			return err
+		}
+	}
+	if len(keys) == 0 {
+		if !cc.signaturesRequired() {
+			return nil
+		}
+		if keys, err = cc.LoadTrustedKeys(); err != nil {
+			return err
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("no trusted keys in the machine trust store")
+	}
+	authorities, err := cc.LoadTimestampAuthorities()
+	if err != nil {
+		return err
+	}
+	signer, err := verifyArchiveSignature(ar, keys, authorities)
+	if err != nil {
+		return errors.Wrap(ErrArchiveUnverified, err.Error())
+	}
+	logrus.WithFields(logrus.Fields{
+		"path":   ar.Filepath,
+		"signer": signer.PrimaryKey.KeyIdString(),
+	}).Debug("archive signature verified")
+	return nil
+}
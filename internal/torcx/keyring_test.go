@@ -0,0 +1,187 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// writeTrustedKey generates a signing key, storing its public part at `path`.
+func writeTrustedKey(t *testing.T, path string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity("torcx test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return entity
+}
+
+// signTestArchive writes a detached signature of `ar` by `signer`.
+func signTestArchive(t *testing.T, ar Archive, signer *openpgp.Entity) {
+	content, err := ioutil.ReadFile(ar.Filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := &bytes.Buffer{}
+	if err := openpgp.ArmoredDetachSign(sig, signer, bytes.NewReader(content), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(ar.Filepath+signatureSidecarSuffix, sig.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignaturePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_keyring_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origLockdown := LockdownPath
+	defer func() { LockdownPath = origLockdown }()
+	LockdownPath = filepath.Join(dir, "lockdown")
+
+	cc := &CommonConfig{
+		ConfDir: filepath.Join(dir, "conf"),
+		UsrDir:  filepath.Join(dir, "usr"),
+	}
+	ar := Archive{Image: Image{Name: "foo", Reference: "1"}, Filepath: filepath.Join(dir, "foo:1.torcx.tgz")}
+	if err := ioutil.WriteFile(ar.Filepath, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// No policy, unsigned images are accepted.
+	if err := enforceSignaturePolicy(cc, ar); err != nil {
+		t.Fatalf("unexpected error without policy: %s", err)
+	}
+
+	// Lockdown implies the policy.
+	if err := ioutil.WriteFile(LockdownPath, []byte("none [integrity] confidentiality\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := enforceSignaturePolicy(cc, ar); err == nil {
+		t.Fatal("expected error for unsigned archive under lockdown")
+	}
+
+	trusted := writeTrustedKey(t, filepath.Join(cc.ConfDir, "trusted-keys.d", "test.asc"))
+	if err := enforceSignaturePolicy(cc, ar); err == nil {
+		t.Fatal("expected error for unsigned archive with trusted keys")
+	}
+	signTestArchive(t, ar, trusted)
+	if err := enforceSignaturePolicy(cc, ar); err != nil {
+		t.Fatalf("unexpected error for signed archive: %s", err)
+	}
+
+	// Signatures by untrusted keys are refused.
+	untrusted := writeTrustedKey(t, filepath.Join(dir, "untrusted.asc"))
+	signTestArchive(t, ar, untrusted)
+	if err := enforceSignaturePolicy(cc, ar); err == nil {
+		t.Fatal("expected error for archive signed by untrusted key")
+	}
+}
+
+func TestKernelLockdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_keyring_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origLockdown := LockdownPath
+	defer func() { LockdownPath = origLockdown }()
+	LockdownPath = filepath.Join(dir, "lockdown")
+
+	for _, tt := range []struct {
+		content string
+		exp     bool
+	}{
+		{"[none] integrity confidentiality\n", false},
+		{"none integrity [confidentiality]\n", true},
+	} {
+		if err := ioutil.WriteFile(LockdownPath, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := kernelLockdown(); got != tt.exp {
+			t.Errorf("%q: expected %t, got %t", tt.content, tt.exp, got)
+		}
+	}
+}
+
+func TestRemoteKeyrings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_keyring_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cc := &CommonConfig{
+		ConfDir: filepath.Join(dir, "conf"),
+		UsrDir:  filepath.Join(dir, "usr"),
+	}
+	remoteDir := filepath.Join(cc.ConfDir, "remotes", "test")
+	signer := writeTrustedKey(t, filepath.Join(remoteDir, "key.asc"))
+	manifest := `{"kind": "remote-manifest-v0", "value": {"base_url": "https://example.com/${COREOS_BOARD}/", "keys": [{"armored_keyring": "key.asc"}]}}`
+	if err := ioutil.WriteFile(filepath.Join(remoteDir, "remote.json"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cc.RemoteKeyrings("missing"); err == nil {
+		t.Error("expected error for missing remote")
+	}
+	keyrings, err := cc.RemoteKeyrings("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar := Archive{Filepath: filepath.Join(dir, "foo:1.torcx.tgz")}
+	if err := ioutil.WriteFile(ar.Filepath, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	signTestArchive(t, ar, signer)
+	got, err := VerifyDetachedSignature(ar.Filepath, ar.Filepath+signatureSidecarSuffix, keyrings, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PrimaryKey.KeyId != signer.PrimaryKey.KeyId {
+		t.Errorf("unexpected signer %s", got.PrimaryKey.KeyIdString())
+	}
+	if err := ioutil.WriteFile(ar.Filepath, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyDetachedSignature(ar.Filepath, ar.Filepath+signatureSidecarSuffix, keyrings, nil); err == nil {
+		t.Error("expected error for tampered archive")
+	}
+}
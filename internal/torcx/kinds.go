@@ -0,0 +1,137 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// supportedKinds are the manifest and record kinds this torcx understands.
+var supportedKinds = []string{
+	ImageManifestV0K,
+	CommonConfigV0K,
+	ProfileManifestV0K,
+	ProfileManifestV1K,
+	RemoteManifestV0K,
+	RemoteContentsV1K,
+	RemoteDiscoveryV0K,
+	NodeProfilesV0K,
+	RoleV0K,
+	PolicyV0K,
+	NodeStateV0K,
+	StoreIndexV0K,
+	WarningsV0K,
+	TimingV0K,
+	ApplyPlanV0K,
+	ArchiveMetaV0K,
+	LintPolicyV0K,
+	ApplyEventV0K,
+	ErrorReportsV0K,
+	InventoryV0K,
+	StagedApplyV0K,
+	NotifyV0K,
+}
+
+// SupportedKinds returns the sorted manifest kinds this torcx understands.
+func SupportedKinds() []string {
+	kinds := append([]string{}, supportedKinds...)
+	sort.Strings(kinds)
+	return kinds
+}
+
+// FutureKindError is returned for manifests of a known kind, but of a newer
+// revision than this torcx understands.
+type FutureKindError struct {
+	// Kind is the manifest kind, e.g. "profile-manifest-v2".
+	Kind string
+	// Supported is the newest supported revision of the same kind.
+	Supported string
+	// MinTorcxVersion is the minimum torcx version required, if declared
+	// by the manifest.
+	MinTorcxVersion string
+}
+
+func (e *FutureKindError) Error() string {
+	name, version, _ := splitKind(e.Kind)
+	msg := fmt.Sprintf("manifest kind %s v%d from the future (newest supported: %s)", name, version, e.Supported)
+	if e.MinTorcxVersion != "" {
+		msg += ", requires torcx " + e.MinTorcxVersion + " or later"
+	}
+	return msg
+}
+
+// splitKind splits a kind into its name and revision, e.g.
+// "profile-manifest-v1" into "profile-manifest" and 1.
+func splitKind(kind string) (string, int, bool) {
+	idx := strings.LastIndex(kind, "-v")
+	if idx <= 0 {
+		return "", 0, false
+	}
+	version, err := strconv.Atoi(kind[idx+2:])
+	if err != nil || version < 0 {
+		return "", 0, false
+	}
+	return kind[:idx], version, true
+}
+
+// futureKind returns a FutureKindError if `kind` is a newer revision of a
+// supported kind, or nil otherwise.
+func futureKind(kind string, minTorcxVersion string) error {
+	name, version, ok := splitKind(kind)
+	if !ok {
+		return nil
+	}
+	newest, newestVersion := "", -1
+	for _, supported := range supportedKinds {
+		sName, sVersion, ok := splitKind(supported)
+		if ok && sName == name && sVersion > newestVersion {
+			newest, newestVersion = supported, sVersion
+		}
+	}
+	if newestVersion < 0 || version <= newestVersion {
+		return nil
+	}
+	return &FutureKindError{
+		Kind:            kind,
+		Supported:       newest,
+		MinTorcxVersion: minTorcxVersion,
+	}
+}
+
+// decodeImageManifest decodes an image manifest.
+func decodeImageManifest(b []byte) (*Assets, error) {
+	var container kindValueJSON
+	if err := json.Unmarshal(b, &container); err != nil {
+		return nil, err
+	}
+	switch container.Kind {
+	case ImageManifestV0K:
+		var assets Assets
+		if err := json.Unmarshal(container.Value, &assets); err != nil {
+			return nil, err
+		}
+		return &assets, nil
+	}
+	if err := futureKind(container.Kind, container.MinTorcxVersion); err != nil {
+		return nil, err
+	}
+	return nil, errors.Errorf("unknown image manifest kind %q", container.Kind)
+}
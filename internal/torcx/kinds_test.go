@@ -0,0 +1,63 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestFutureKind(t *testing.T) {
+	tests := []struct {
+		kind   string
+		future bool
+	}{
+		{ProfileManifestV1K, false},
+		{ProfileManifestV0K, false},
+		{"profile-manifest-v2", true},
+		{"torcx-remote-contents-v2", true},
+		{"torcx-remote-contents-v0", false},
+		{"unknown-manifest-v3", false},
+		{"profile-manifest-invalid", false},
+	}
+	for _, tt := range tests {
+		err := futureKind(tt.kind, "")
+		if (err != nil) != tt.future {
+			t.Errorf("%s: expected future=%v, got %v", tt.kind, tt.future, err)
+		}
+	}
+}
+
+func TestReadFutureProfile(t *testing.T) {
+	in := `{"kind": "profile-manifest-v2", "min_torcx_version": "0.3.0", "value": {}}`
+	_, err := readProfileReader(strings.NewReader(in))
+	fkErr, ok := errors.Cause(err).(*FutureKindError)
+	if !ok {
+		t.Fatalf("expected FutureKindError, got %v", err)
+	}
+	if fkErr.Supported != ProfileManifestV1K || fkErr.MinTorcxVersion != "0.3.0" {
+		t.Errorf("unexpected error fields: %+v", fkErr)
+	}
+	expected := "manifest kind profile-manifest v2 from the future (newest supported: profile-manifest-v1), requires torcx 0.3.0 or later"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+
+	if _, err := decodeImageManifest([]byte(`{"kind": "image-manifest-v1", "value": {}}`)); err == nil || !strings.Contains(err.Error(), "from the future") {
+		t.Errorf("expected future kind error for image manifest, got %v", err)
+	}
+}
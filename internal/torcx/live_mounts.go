@@ -0,0 +1,217 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MountOK is the state of a live mount matching the sealed state.
+	MountOK = "ok"
+	// MountMissing is the state of a sealed mount not in the mount table.
+	MountMissing = "missing"
+	// MountModified is the state of a live mount not matching the sealed
+	// state anymore (e.g. remounted read-write, or another filesystem
+	// mounted on top of it).
+	MountModified = "modified"
+)
+
+// sysBlockDir is where loop device backing files are looked up.
+var sysBlockDir = "/sys/block"
+
+// mountInfoEntry is a single entry of a mountinfo file, see proc(5).
+type mountInfoEntry struct {
+	target      string
+	source      string
+	fstype      string
+	options     string
+	propagation string
+}
+
+// LiveMount is a mount created by torcx while applying, as found in the
+// mount table and correlated with the sealed state.
+type LiveMount struct {
+	// Image is the applied image the mount belongs to, if any.
+	Image string `json:"image,omitempty"`
+	// Target is the mount point.
+	Target string `json:"target"`
+	// Source is the mounted device (e.g. a loop device), if mounted.
+	Source string `json:"source,omitempty"`
+	// Backing is the file backing a loop device source.
+	Backing string `json:"backing,omitempty"`
+	// FSType is the mounted filesystem type.
+	FSType string `json:"fstype,omitempty"`
+	// Options are the per-mount options.
+	Options string `json:"options,omitempty"`
+	// Propagation is the mount propagation type (`shared:N`, `master:N`,
+	// `unbindable` or `private`).
+	Propagation string `json:"propagation,omitempty"`
+	// State is MountOK, MountMissing or MountModified.
+	State string `json:"state"`
+	// Reason explains why a mount is flagged as modified.
+	Reason string `json:"reason,omitempty"`
+}
+
+// ListLiveMounts enumerates the mounts created by torcx for the sealed
+// state (the unpack directory and squashfs images), flagging missing
+// mounts, and mounts modified since they were sealed.
+func ListLiveMounts(cc *CommonConfig) ([]LiveMount, error) {
+	return listLiveMounts(cc, filepath.Dir(RootPath(SealPath)))
+}
+
+// listLiveMounts implements ListLiveMounts, reading image environment
+// files from `metadataDir`.
+func listLiveMounts(cc *CommonConfig, metadataDir string) ([]LiveMount, error) {
+	if cc == nil {
+		return nil, errors.New("missing common configuration")
+	}
+	images, err := ReadProfilePath(cc.RunProfile())
+	if err != nil {
+		return nil, errors.Wrap(err, "reading run profile")
+	}
+	entries, err := readMountInfo(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := []LiveMount{liveMount(entries, "", cc.RunUnpackDir(), "tmpfs", "")}
+	for _, im := range images {
+		meta, err := ReadMetadata(filepath.Join(metadataDir, imageEnvPrefix+imagePathName(im.Name)))
+		if err != nil {
+			continue
+		}
+		archive := meta[ImageEnvArchive]
+		format := archiveFormatOf(archive)
+		if !format.isFilesystemImage() {
+			// Size-capped tgz images have their own tmpfs instance.
+			if entry, ok := entries[filepath.Clean(meta[ImageEnvRoot])]; ok && entry.fstype == "tmpfs" {
+				mounts = append(mounts, liveMount(entries, im.Name, meta[ImageEnvRoot], "tmpfs", ""))
+			}
+			continue
+		}
+		mounts = append(mounts, liveMount(entries, im.Name, meta[ImageEnvRoot], string(format), archive))
+	}
+	return mounts, nil
+}
+
+// liveMount correlates the topmost mount on `target` with the expected
+// read-only `fstype` mount, backed by `archive` if not empty.
+func liveMount(entries map[string]mountInfoEntry, image, target, fstype, archive string) LiveMount {
+	target = filepath.Clean(target)
+	lm := LiveMount{
+		Image:  image,
+		Target: target,
+		State:  MountMissing,
+	}
+	entry, ok := entries[target]
+	if !ok {
+		return lm
+	}
+	lm.Source = entry.source
+	lm.FSType = entry.fstype
+	lm.Options = entry.options
+	lm.Propagation = entry.propagation
+	lm.State = MountOK
+	if archive != "" {
+		lm.Backing = loopBackingFile(entry.source)
+	}
+
+	switch {
+	case entry.fstype != fstype:
+		lm.State, lm.Reason = MountModified, "expected a "+fstype+" mount"
+	case !hasMountOption(entry.options, "ro"):
+		lm.State, lm.Reason = MountModified, "mounted read-write"
+	case archive != "" && lm.Backing != "" && filepath.Clean(lm.Backing) != filepath.Clean(archive):
+		lm.State, lm.Reason = MountModified, "backed by "+lm.Backing+" instead of "+archive
+	}
+	return lm
+}
+
+// readMountInfo parses the mountinfo file at `path`, keyed by mount point.
+// For stacked mounts, the topmost one is kept.
+func readMountInfo(path string) (map[string]mountInfoEntry, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	entries := map[string]mountInfoEntry{}
+	sc := bufio.NewScanner(fp)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		entry := mountInfoEntry{
+			target:      mountInfoUnescaper.Replace(fields[4]),
+			propagation: "private",
+		}
+		if len(fields) > 5 {
+			entry.options = fields[5]
+		}
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				if i+2 < len(fields) {
+					entry.fstype = fields[i+1]
+					entry.source = mountInfoUnescaper.Replace(fields[i+2])
+				}
+				break
+			}
+			if fields[i] == "unbindable" || strings.HasPrefix(fields[i], "shared:") || strings.HasPrefix(fields[i], "master:") {
+				if entry.propagation == "private" {
+					entry.propagation = fields[i]
+				} else {
+					entry.propagation += " " + fields[i]
+				}
+			}
+		}
+		entries[entry.target] = entry
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.Wrapf(err, "reading %s", path)
+	}
+	return entries, nil
+}
+
+// hasMountOption returns whether the comma-separated `options` include `opt`.
+func hasMountOption(options, opt string) bool {
+	for _, o := range strings.Split(options, ",") {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// loopBackingFile returns the file backing the loop device `dev`, or an
+// empty string if unknown.
+func loopBackingFile(dev string) string {
+	if !strings.HasPrefix(dev, "/dev/loop") {
+		return ""
+	}
+	b, err := ioutil.ReadFile(filepath.Join(sysBlockDir, filepath.Base(dev), "loop", "backing_file"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
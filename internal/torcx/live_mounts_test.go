@@ -0,0 +1,96 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListLiveMounts(t *testing.T) {
+	dir := t.TempDir()
+	cc := &CommonConfig{RunDir: filepath.Join(dir, "run")}
+	metadataDir := filepath.Join(dir, "metadata")
+	for _, d := range []string{metadataDir, cc.RunUnpackDir()} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	images := []Image{{Name: "foo", Reference: "1"}, {Name: "bar", Reference: "2"}, {Name: "baz", Reference: "3"}}
+	if err := writeRunProfile(cc.RunProfile(), images); err != nil {
+		t.Fatal(err)
+	}
+	applied := []AppliedImage{
+		{Image: images[0], Archive: filepath.Join(dir, "foo:1.torcx.tgz"), Root: filepath.Join(cc.RunUnpackDir(), "foo")},
+		{Image: images[1], Archive: filepath.Join(dir, "bar:2.torcx.squashfs"), Root: filepath.Join(cc.RunUnpackDir(), "bar")},
+		{Image: images[2], Archive: filepath.Join(dir, "baz:3.torcx.squashfs"), Root: filepath.Join(cc.RunUnpackDir(), "baz")},
+	}
+	if err := writeImageEnvFiles(metadataDir, applied); err != nil {
+		t.Fatal(err)
+	}
+
+	origMountInfoPath, origSysBlockDir := mountInfoPath, sysBlockDir
+	defer func() { mountInfoPath, sysBlockDir = origMountInfoPath, origSysBlockDir }()
+	mountInfoPath = filepath.Join(dir, "mountinfo")
+	sysBlockDir = filepath.Join(dir, "block")
+	backing := filepath.Join(sysBlockDir, "loop0", "loop", "backing_file")
+	if err := os.MkdirAll(filepath.Dir(backing), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(backing, []byte(applied[1].Archive+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mountInfo := "36 35 0:32 / " + cc.RunUnpackDir() + " ro,relatime shared:12 - tmpfs none ro\n" +
+		"37 36 7:0 / " + applied[1].Root + " ro master:3 - squashfs /dev/loop0 ro\n"
+	if err := ioutil.WriteFile(mountInfoPath, []byte(mountInfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts, err := listLiveMounts(cc, metadataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 3 {
+		t.Fatalf("expected 3 mounts, got %+v", mounts)
+	}
+	if m := mounts[0]; m.State != MountOK || m.FSType != "tmpfs" || m.Propagation != "shared:12" {
+		t.Errorf("unexpected unpack directory mount %+v", m)
+	}
+	if m := mounts[1]; m.Image != "bar" || m.State != MountOK || m.Source != "/dev/loop0" || m.Backing != applied[1].Archive || m.Propagation != "master:3" {
+		t.Errorf("unexpected bar mount %+v", m)
+	}
+	if m := mounts[2]; m.Image != "baz" || m.State != MountMissing {
+		t.Errorf("expected baz mount to be missing, got %+v", m)
+	}
+
+	// Remount the unpack directory read-write and shadow bar
+	mountInfo += "38 35 0:33 / " + cc.RunUnpackDir() + " rw - tmpfs none rw\n" +
+		"39 36 0:34 / " + applied[1].Root + " ro - tmpfs none ro\n"
+	if err := ioutil.WriteFile(mountInfoPath, []byte(mountInfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mounts, err = listLiveMounts(cc, metadataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := mounts[0]; m.State != MountModified || m.Propagation != "private" {
+		t.Errorf("expected read-write unpack directory to be modified, got %+v", m)
+	}
+	if m := mounts[1]; m.State != MountModified {
+		t.Errorf("expected shadowed bar mount to be modified, got %+v", m)
+	}
+}
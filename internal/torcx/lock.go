@@ -0,0 +1,115 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// lockPollInterval is the interval between attempts to acquire a busy lock.
+	lockPollInterval = 500 * time.Millisecond
+)
+
+var (
+	// processLocks serializes lock holders within this process, keyed
+	// by path, as record locks are only exclusive across processes.
+	processLocks   = map[string]chan struct{}{}
+	processLocksMu sync.Mutex
+)
+
+// processLock returns the in-process lock for `path`, a channel holding
+// a token while the lock is taken.
+func processLock(path string) chan struct{} {
+	processLocksMu.Lock()
+	defer processLocksMu.Unlock()
+	path = filepath.Clean(path)
+	ch, ok := processLocks[path]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		processLocks[path] = ch
+	}
+	return ch
+}
+
+// lockFile acquires an exclusive advisory lock on `path`, creating it if needed,
+// and waiting until `ctx` is done if the lock is busy.
+// POSIX record locks are used (instead of flock), as they are honored
+// across clients on network filesystems such as NFS and CIFS. Those are
+// owned by the whole process, so concurrent holders within it (e.g. API
+// connections) are serialized beforehand.
+func lockFile(ctx context.Context, path string) (*os.File, error) {
+	local := processLock(path)
+	select {
+	case local <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "waiting for lock on %s", path)
+	}
+
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		<-local
+		return nil, err
+	}
+
+	lk := unix.Flock_t{
+		Type:   unix.F_WRLCK,
+		Whence: 0,
+		Start:  0,
+		Len:    0,
+	}
+	for {
+		err := unix.FcntlFlock(fp.Fd(), unix.F_SETLK, &lk)
+		if err == nil {
+			return fp, nil
+		}
+		if err != unix.EAGAIN && err != unix.EACCES {
+			fp.Close()
+			<-local
+			return nil, errors.Wrapf(err, "locking %s", path)
+		}
+		select {
+		case <-ctx.Done():
+			fp.Close()
+			<-local
+			return nil, errors.Wrapf(ctx.Err(), "waiting for lock on %s", path)
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// unlockFile releases a lock acquired via lockFile.
+func unlockFile(fp *os.File) error {
+	if fp == nil {
+		return nil
+	}
+	defer func() { <-processLock(fp.Name()) }()
+
+	lk := unix.Flock_t{
+		Type: unix.F_UNLCK,
+	}
+	if err := unix.FcntlFlock(fp.Fd(), unix.F_SETLK, &lk); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
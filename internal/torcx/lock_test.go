@@ -0,0 +1,91 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestLockFileContention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+	held, err := lockFile(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Record locks never conflict within a process, the second
+	// holder must wait nonetheless.
+	acquired := make(chan error)
+	go func() {
+		fp, err := lockFile(context.Background(), path)
+		if err == nil {
+			err = unlockFile(fp)
+		}
+		acquired <- err
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatalf("lock acquired while held: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := unlockFile(held); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not acquired once released")
+	}
+}
+
+func TestLockFileCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.lock")
+	held, err := lockFile(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := lockFile(ctx, path); errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+
+	// Giving up must not leave the lock taken.
+	if err := unlockFile(held); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	fp, err := lockFile(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unlockFile(fp); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// binDirs are the image directories holding binaries.
+	binDirs = []string{"bin", "sbin", "usr/bin", "usr/sbin"}
+	// libDirs are the image directories holding shared libraries.
+	libDirs = []string{"lib", "lib64", "usr/lib", "usr/lib64"}
+	// unitSuffixes are the file suffixes of systemd units.
+	unitSuffixes = []string{".service", ".socket", ".timer", ".path", ".mount", ".automount", ".swap", ".target", ".slice", ".scope", ".device"}
+	// unitDirSuffixes are the suffixes of unit dependency and drop-in directories.
+	unitDirSuffixes = []string{".wants", ".requires", ".d"}
+)
+
+// GeneratedManifest is an image manifest detected from a directory tree.
+type GeneratedManifest struct {
+	// Assets are the detected assets.
+	Assets Assets
+	// Libraries are the shared libraries found. They are not propagated:
+	// binaries must locate them on their own (e.g. with an rpath).
+	Libraries []string
+}
+
+// GenerateManifest detects the assets of the image root directory `dir`:
+// binaries, systemd and networkd units (with their dependency and drop-in
+// directories), udev rules, sysusers and tmpfiles fragments.
+func GenerateManifest(dir string) (*GeneratedManifest, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errors.Errorf("%s is not a directory", dir)
+	}
+
+	gen := &GeneratedManifest{}
+	for _, sub := range binDirs {
+		files, err := listAssets(dir, sub, func(fi os.FileInfo) bool {
+			return fi.Mode().IsRegular() && fi.Mode()&0111 != 0
+		})
+		if err != nil {
+			return nil, err
+		}
+		gen.Assets.Binaries = append(gen.Assets.Binaries, files...)
+	}
+
+	for _, prefix := range []string{"lib", "usr/lib"} {
+		groups := []struct {
+			sub    string
+			assets *[]string
+			match  func(os.FileInfo) bool
+		}{
+			{"systemd/system", &gen.Assets.Units, isUnitAsset},
+			{"systemd/network", &gen.Assets.Network, suffixMatcher(".network", ".netdev", ".link")},
+			{"udev/rules.d", &gen.Assets.UdevRules, suffixMatcher(".rules")},
+			{"sysusers.d", &gen.Assets.Sysusers, suffixMatcher(".conf")},
+			{"tmpfiles.d", &gen.Assets.Tmpfiles, suffixMatcher(".conf")},
+		}
+		for _, group := range groups {
+			files, err := listAssets(dir, filepath.Join(prefix, group.sub), group.match)
+			if err != nil {
+				return nil, err
+			}
+			*group.assets = append(*group.assets, files...)
+		}
+	}
+
+	for _, sub := range libDirs {
+		files, err := listAssets(dir, sub, func(fi os.FileInfo) bool {
+			return !fi.IsDir() && (strings.HasSuffix(fi.Name(), ".so") || strings.Contains(fi.Name(), ".so."))
+		})
+		if err != nil {
+			return nil, err
+		}
+		gen.Libraries = append(gen.Libraries, files...)
+	}
+	return gen, nil
+}
+
+// listAssets returns the sorted absolute image paths of the entries of
+// `dir`/`sub` accepted by `match`.
+func listAssets(dir string, sub string, match func(os.FileInfo) bool) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	assets := []string{}
+	for _, fi := range files {
+		if match(fi) {
+			assets = append(assets, filepath.Join("/", sub, fi.Name()))
+		}
+	}
+	sort.Strings(assets)
+	return assets, nil
+}
+
+// isUnitAsset matches unit files, and their dependency and drop-in directories.
+func isUnitAsset(fi os.FileInfo) bool {
+	if fi.IsDir() {
+		return hasAnySuffix(fi.Name(), unitDirSuffixes...)
+	}
+	return hasAnySuffix(fi.Name(), unitSuffixes...)
+}
+
+// suffixMatcher matches non-directory entries with any of `suffixes`.
+func suffixMatcher(suffixes ...string) func(os.FileInfo) bool {
+	return func(fi os.FileInfo) bool {
+		return !fi.IsDir() && hasAnySuffix(fi.Name(), suffixes...)
+	}
+}
+
+// hasAnySuffix returns whether `name` ends with any of `suffixes`.
+func hasAnySuffix(name string, suffixes ...string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGenerateManifest(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]os.FileMode{
+		"bin/docker":                                0755,
+		"bin/README":                                0644,
+		"usr/sbin/dockerd":                          0755,
+		"lib/systemd/system/docker.service":         0644,
+		"lib/systemd/system/docker.socket":          0644,
+		"lib/systemd/system/notes.txt":              0644,
+		"lib/systemd/system/sockets.target.wants/x": 0644,
+		"usr/lib/systemd/network/50-docker.network": 0644,
+		"usr/lib/udev/rules.d/90-docker.rules":      0644,
+		"usr/lib/sysusers.d/docker.conf":            0644,
+		"lib/tmpfiles.d/docker.conf":                0644,
+		"usr/lib/libdevmapper.so.1.02":              0644,
+	}
+	for name, mode := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gen, err := GenerateManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Assets{
+		Binaries:  []string{"/bin/docker", "/usr/sbin/dockerd"},
+		Network:   []string{"/usr/lib/systemd/network/50-docker.network"},
+		Units:     []string{"/lib/systemd/system/docker.service", "/lib/systemd/system/docker.socket", "/lib/systemd/system/sockets.target.wants"},
+		Sysusers:  []string{"/usr/lib/sysusers.d/docker.conf"},
+		Tmpfiles:  []string{"/lib/tmpfiles.d/docker.conf"},
+		UdevRules: []string{"/usr/lib/udev/rules.d/90-docker.rules"},
+	}
+	if !reflect.DeepEqual(gen.Assets, expected) {
+		t.Errorf("wrong assets:\n got: %+v\n expected: %+v", gen.Assets, expected)
+	}
+	if !reflect.DeepEqual(gen.Libraries, []string{"/usr/lib/libdevmapper.so.1.02"}) {
+		t.Errorf("unexpected libraries %v", gen.Libraries)
+	}
+}
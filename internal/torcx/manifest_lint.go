@@ -0,0 +1,271 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// LintPolicyV0K - manifest lint policy kind, v0
+	LintPolicyV0K = "torcx-lint-policy-v0"
+
+	// LintRuleManifest checks that the image manifest is valid and its assets exist.
+	LintRuleManifest = "manifest"
+	// LintRuleSymlinkEscape checks for symlinks pointing outside of the image.
+	LintRuleSymlinkEscape = "symlink-escape"
+	// LintRuleUnitInstall checks that units have an [Install] section.
+	LintRuleUnitInstall = "unit-install"
+	// LintRuleBinExecutable checks that binaries are executable files.
+	LintRuleBinExecutable = "bin-executable"
+	// LintRuleSetuid checks for setuid/setgid files.
+	LintRuleSetuid = "setuid"
+)
+
+// lintRules are all lint rules, in evaluation order.
+var lintRules = []string{LintRuleManifest, LintRuleSymlinkEscape, LintRuleUnitInstall, LintRuleBinExecutable, LintRuleSetuid}
+
+// LintPolicy configures the manifest linter.
+type LintPolicy struct {
+	// Disable are the rules not to enforce.
+	Disable []string `json:"disable,omitempty"`
+	// SetuidAllowed are the image paths allowed to be setuid/setgid.
+	SetuidAllowed []string `json:"setuid_allowed,omitempty"`
+}
+
+// LintPolicyV0JSON holds a JSON lint policy (version 0).
+type LintPolicyV0JSON struct {
+	Kind  string     `json:"kind"`
+	Value LintPolicy `json:"value"`
+}
+
+// LintFinding is a rule violation found by the manifest linter.
+type LintFinding struct {
+	Rule    string `json:"rule"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ReadLintPolicy reads the lint policy at `path`.
+func ReadLintPolicy(path string) (*LintPolicy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest LintPolicyV0JSON
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s", path)
+	}
+	if manifest.Kind != LintPolicyV0K {
+		return nil, errors.Errorf("invalid lint policy kind: %q", manifest.Kind)
+	}
+	for _, rule := range manifest.Value.Disable {
+		if !containsString(lintRules, rule) {
+			return nil, errors.Errorf("unknown lint rule %q", rule)
+		}
+	}
+	return &manifest.Value, nil
+}
+
+// LintImage checks the image root directory `dir` and its manifest
+// against `policy`, returning the rule violations found.
+func LintImage(dir string, policy LintPolicy) ([]LintFinding, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &imageLinter{
+		root:     root,
+		policy:   policy,
+		findings: []LintFinding{},
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(root, manifestPath))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		l.report(LintRuleManifest, manifestPath, "missing image manifest")
+	} else if assets, err := decodeImageManifest(b); err != nil {
+		l.report(LintRuleManifest, manifestPath, err.Error())
+	} else {
+		l.lintAssets(assets)
+	}
+
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		l.lintFile(path, fi)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(l.findings, func(i, j int) bool {
+		return l.findings[i].Path < l.findings[j].Path
+	})
+	return l.findings, nil
+}
+
+// imageLinter accumulates the findings for an image.
+type imageLinter struct {
+	root     string
+	policy   LintPolicy
+	findings []LintFinding
+}
+
+// report records a finding, unless its rule is disabled.
+func (l *imageLinter) report(rule string, path string, msg string) {
+	if containsString(l.policy.Disable, rule) {
+		return
+	}
+	l.findings = append(l.findings, LintFinding{rule, path, msg})
+}
+
+// imagePath returns the absolute image path of host path `path`.
+func (l *imageLinter) imagePath(path string) string {
+	return filepath.Join("/", strings.TrimPrefix(path, l.root))
+}
+
+// lintAssets checks the assets listed in the manifest.
+func (l *imageLinter) lintAssets(assets *Assets) {
+	for _, entries := range [][]string{assets.Network, assets.Units, assets.Sysusers, assets.Tmpfiles, assets.UdevRules} {
+		for _, entry := range entries {
+			if _, err := os.Lstat(filepath.Join(l.root, entry)); err != nil {
+				l.report(LintRuleManifest, entry, "asset not found in image")
+			}
+		}
+	}
+	for _, entry := range assets.Units {
+		l.lintUnit(entry)
+	}
+	for _, entry := range assets.StateDirs {
+		if err := validateStateDir(entry); err != nil {
+			l.report(LintRuleManifest, entry, err.Error())
+		}
+	}
+	if err := validateWritableOverlays(assets.Writable); err != nil {
+		l.report(LintRuleManifest, "writable", err.Error())
+	}
+	for _, ov := range assets.Writable {
+		if fi, err := os.Stat(filepath.Join(l.root, ov.Path)); err != nil || !fi.IsDir() {
+			l.report(LintRuleManifest, ov.Path, "writable directory not found in image")
+		}
+	}
+	if assets.TmpfsSize != "" {
+		if _, err := parseMemorySize(assets.TmpfsSize); err != nil {
+			l.report(LintRuleManifest, assets.TmpfsSize, err.Error())
+		}
+	}
+	if assets.Cleanup != "" {
+		if fi, err := os.Stat(filepath.Join(l.root, assets.Cleanup)); err != nil || !fi.Mode().IsRegular() {
+			l.report(LintRuleManifest, assets.Cleanup, "cleanup hook not found in image")
+		}
+	}
+	for _, entry := range assets.Binaries {
+		path := filepath.Join(l.root, entry)
+		fi, err := os.Stat(path)
+		if err != nil {
+			l.report(LintRuleManifest, entry, "asset not found in image")
+			continue
+		}
+		if !fi.IsDir() {
+			l.lintBinary(entry, fi)
+			continue
+		}
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			l.report(LintRuleManifest, entry, err.Error())
+			continue
+		}
+		for _, child := range files {
+			if !child.IsDir() {
+				l.lintBinary(filepath.Join(entry, child.Name()), child)
+			}
+		}
+	}
+}
+
+// lintUnit checks that a unit file asset has an [Install] section.
+// Directories (dependencies, drop-ins) are not checked.
+func (l *imageLinter) lintUnit(entry string) {
+	path := filepath.Join(l.root, entry)
+	fi, err := os.Stat(path)
+	if err != nil || fi.IsDir() || !hasAnySuffix(entry, unitSuffixes...) {
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		l.report(LintRuleManifest, entry, err.Error())
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) == "[Install]" {
+			return
+		}
+	}
+	l.report(LintRuleUnitInstall, entry, "unit has no [Install] section")
+}
+
+// lintBinary checks that a binary asset is an executable regular file.
+func (l *imageLinter) lintBinary(entry string, fi os.FileInfo) {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if st, err := os.Stat(filepath.Join(l.root, entry)); err == nil {
+			fi = st
+		}
+	}
+	if !fi.Mode().IsRegular() || fi.Mode()&0111 == 0 {
+		l.report(LintRuleBinExecutable, entry, "binary is not an executable file")
+	}
+}
+
+// lintFile checks any file of the image.
+func (l *imageLinter) lintFile(path string, fi os.FileInfo) {
+	entry := l.imagePath(path)
+	if fi.Mode()&os.ModeSymlink != 0 {
+		dest, err := os.Readlink(path)
+		if err != nil {
+			l.report(LintRuleSymlinkEscape, entry, err.Error())
+			return
+		}
+		if filepath.IsAbs(dest) {
+			l.report(LintRuleSymlinkEscape, entry, "absolute symlink to "+dest+" points to the host once unpacked")
+		} else if target := filepath.Join(filepath.Dir(path), dest); target != l.root && !strings.HasPrefix(target, l.root+"/") {
+			l.report(LintRuleSymlinkEscape, entry, "symlink to "+dest+" escapes the image")
+		}
+		return
+	}
+	if fi.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 && !containsString(l.policy.SetuidAllowed, entry) {
+		l.report(LintRuleSetuid, entry, "setuid/setgid file not allowed by policy")
+	}
+}
+
+// containsString returns whether `list` contains `s`.
+func containsString(list []string, s string) bool {
+	for _, entry := range list {
+		if entry == s {
+			return true
+		}
+	}
+	return false
+}
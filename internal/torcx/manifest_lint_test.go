@@ -0,0 +1,93 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLintImage(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]struct {
+		mode    os.FileMode
+		content string
+	}{
+		".torcx/manifest.json": {0644, `{"kind": "image-manifest-v0", "value": {
+			"bin": ["/bin/docker", "/bin/notes"],
+			"units": ["/lib/systemd/system/docker.service", "/lib/systemd/system/docker.socket", "/lib/systemd/system/missing.service"]}}`},
+		"bin/docker":                        {0755, ""},
+		"bin/notes":                         {0644, ""},
+		"bin/helper":                        {0755 | os.ModeSetuid, ""},
+		"lib/systemd/system/docker.service": {0644, "[Service]\nExecStart=/bin/docker\n\n[Install]\nWantedBy=multi-user.target\n"},
+		"lib/systemd/system/docker.socket":  {0644, "[Socket]\nListenStream=/run/docker.sock\n"},
+	}
+	for name, f := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(f.content), f.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, f.mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, dest := range map[string]string{
+		"bin/abs":      "/usr/bin/docker",
+		"bin/escape":   "../../etc/passwd",
+		"bin/internal": "docker",
+	} {
+		if err := os.Symlink(dest, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	findings, err := LintImage(dir, LintPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := map[string]string{}
+	for _, f := range findings {
+		rules[f.Path] = f.Rule
+	}
+	expected := map[string]string{
+		"/bin/abs":                            LintRuleSymlinkEscape,
+		"/bin/escape":                         LintRuleSymlinkEscape,
+		"/bin/helper":                         LintRuleSetuid,
+		"/bin/notes":                          LintRuleBinExecutable,
+		"/lib/systemd/system/docker.socket":   LintRuleUnitInstall,
+		"/lib/systemd/system/missing.service": LintRuleManifest,
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("wrong findings:\n got: %v\n expected: %v", rules, expected)
+	}
+
+	policy := LintPolicy{
+		Disable:       []string{LintRuleSymlinkEscape, LintRuleUnitInstall},
+		SetuidAllowed: []string{"/bin/helper"},
+	}
+	findings, err = LintImage(dir, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 2 {
+		t.Errorf("expected 2 findings with policy, got %v", findings)
+	}
+}
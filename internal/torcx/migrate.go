@@ -0,0 +1,126 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Migration is a deprecated manifest found on the system, along with the
+// steps to migrate it.
+type Migration struct {
+	// Path is the manifest file.
+	Path string `json:"path"`
+	// Kind is the deprecated manifest kind.
+	Kind string `json:"kind"`
+	// Replacement is the kind to migrate to.
+	Replacement string `json:"replacement"`
+	// Step is the actionable migration step.
+	Step string `json:"step"`
+	// Fixable is set if the manifest can be rewritten automatically.
+	Fixable bool `json:"fixable"`
+}
+
+// CheckMigrations scans configuration and profiles for manifests using
+// deprecated kinds. Only manifests in the configuration directory (e.g.
+// user profiles) can be fixed; vendor and OEM ones are read-only.
+func CheckMigrations(cc *CommonConfig) ([]Migration, error) {
+	if cc == nil {
+		return nil, errors.New("nil CommonConfig")
+	}
+
+	paths := []string{filepath.Join(cc.ConfDir, "config.json"), cc.NodeProfiles()}
+	for _, dir := range cc.ProfileDirs() {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, fi := range files {
+			if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".json") {
+				paths = append(paths, filepath.Join(dir, fi.Name()))
+			}
+		}
+	}
+
+	migrations := []Migration{}
+	for _, path := range paths {
+		kind, err := readManifestKind(path)
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				continue
+			}
+			return nil, err
+		}
+		replacement, ok := deprecatedKinds[kind]
+		if !ok {
+			continue
+		}
+		m := Migration{
+			Path:        path,
+			Kind:        kind,
+			Replacement: replacement,
+			Fixable:     kind == ProfileManifestV0K && filepath.Dir(path) == filepath.Clean(cc.UserProfileDir()),
+		}
+		if m.Fixable {
+			m.Step = "rewrite as " + replacement + " (run with --fix)"
+		} else {
+			m.Step = "read-only manifest, ask the vendor/OEM to ship " + replacement
+		}
+		migrations = append(migrations, m)
+	}
+	return migrations, nil
+}
+
+// ApplyMigration rewrites a fixable manifest to its replacement kind.
+func ApplyMigration(m Migration) error {
+	if !m.Fixable {
+		return errors.Errorf("%s can not be migrated automatically", m.Path)
+	}
+	switch m.Kind {
+	case ProfileManifestV0K:
+		manifest, err := getProfileV0(m.Path)
+		if err != nil {
+			return err
+		}
+		_, err = writeProfileV1(m.Path, ImagesFromJSONV0(manifest.Value))
+		return err
+	default:
+		return errors.Errorf("no migration for kind %s", m.Kind)
+	}
+}
+
+// readManifestKind returns the kind of the JSON manifest at `path`.
+func readManifestKind(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var container struct {
+		Kind string `json:"kind"`
+	}
+	if err := json.Unmarshal(b, &container); err != nil {
+		return "", errors.Wrapf(err, "failed to decode %s", path)
+	}
+	return container.Kind, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_migrate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cc := &CommonConfig{
+		ConfDir: filepath.Join(dir, "conf"),
+		UsrDir:  filepath.Join(dir, "usr"),
+	}
+	v0 := `{"kind": "profile-manifest-v0", "value": {"images": [{"name": "foo", "reference": "1"}]}}`
+	v1 := `{"kind": "profile-manifest-v1", "value": {"images": []}}`
+	for path, content := range map[string]string{
+		filepath.Join(cc.UserProfileDir(), "old.json"):             v0,
+		filepath.Join(cc.UserProfileDir(), "new.json"):             v1,
+		filepath.Join(VendorProfilesDir(cc.UsrDir), "vendor.json"): v0,
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrations, err := CheckMigrations(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 2 {
+		t.Fatalf("unexpected migrations %+v", migrations)
+	}
+	for _, m := range migrations {
+		fixable := filepath.Base(m.Path) == "old.json"
+		if m.Fixable != fixable {
+			t.Errorf("%s: expected fixable=%t", m.Path, fixable)
+		}
+		if !m.Fixable {
+			if err := ApplyMigration(m); err == nil {
+				t.Errorf("%s: expected error migrating read-only manifest", m.Path)
+			}
+			continue
+		}
+		if err := ApplyMigration(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	images, err := ReadProfilePath(filepath.Join(cc.UserProfileDir(), "old.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Name != "foo" || images[0].Reference != "1" {
+		t.Errorf("unexpected migrated profile %v", images)
+	}
+	if migrations, _ := CheckMigrations(cc); len(migrations) != 1 {
+		t.Errorf("unexpected migrations after fix %+v", migrations)
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Constants of the new mount API (Linux 5.2+), not provided by x/sys/unix.
+const (
+	fsopenCloexec        = 0x1
+	fsconfigSetFlag      = 0x0
+	fsconfigSetString    = 0x1
+	fsconfigCmdCreate    = 0x6
+	fsmountCloexec       = 0x1
+	moveMountFEmptyPath  = 0x4
+	openTreeClone        = 0x1
+	atRecursive          = 0x8000
+	mountAttrRdonly      = 0x1
+	mountAttrNosuid      = 0x2
+	mountAttrNodev       = 0x4
+	mountAttrNoexec      = 0x8
+	mountAttrIdmap       = 0x100000
+	mountAttrSize        = 32
+	fsContextLogMaxBytes = 1024
+
+	// sysMountSetattr is mount_setattr(2), which x/sys/unix does not know
+	// yet. Syscall numbers are shared across architectures since Linux 5.1,
+	// up to a per-ABI offset (e.g. on mips), hence the relative number.
+	sysMountSetattr = unix.SYS_FSOPEN + 12
+)
+
+// errMountAPIUnsupported is returned for mount operations the new mount
+// API is not used for, which are then performed with mount(2).
+var errMountAPIUnsupported = errors.New("operation not supported by the mount API")
+
+var (
+	mountAPIOnce      sync.Once
+	mountAPISupported bool
+)
+
+// mountAttr is the `struct mount_attr` argument of mount_setattr(2).
+type mountAttr struct {
+	attrSet     uint64
+	attrClr     uint64
+	propagation uint64
+	usernsFd    uint64
+}
+
+// hasMountAPI returns whether the running kernel supports the new mount
+// API, probing it once.
+func hasMountAPI() bool {
+	mountAPIOnce.Do(func() {
+		fd, err := fsopen("tmpfs")
+		if err == nil {
+			unix.Close(fd)
+			mountAPISupported = true
+		}
+	})
+	return mountAPISupported
+}
+
+// mountWithAPI performs a mount(2) equivalent with the new mount API: new
+// filesystems are configured and mounted detached, then moved onto
+// `target`. Bind mounts are cloned and moved, and mount moves use
+// move_mount(2). Other operations (e.g. propagation changes and remounts)
+// return errMountAPIUnsupported.
+func mountWithAPI(source, target, fstype string, flags uintptr, data string) error {
+	switch {
+	case flags&unix.MS_MOVE != 0:
+		return moveMount(-1, source, target, 0)
+	case flags&unix.MS_BIND != 0:
+		if flags&^(unix.MS_BIND|unix.MS_REC) != 0 || data != "" {
+			return errMountAPIUnsupported
+		}
+		treeFlags := openTreeClone | unix.O_CLOEXEC
+		if flags&unix.MS_REC != 0 {
+			treeFlags |= atRecursive
+		}
+		fd, err := openTree(source, uint(treeFlags))
+		if err != nil {
+			return errors.Wrapf(err, "open_tree %q", source)
+		}
+		defer unix.Close(fd)
+		return moveMount(fd, "", target, moveMountFEmptyPath)
+	case fstype == "":
+		return errMountAPIUnsupported
+	}
+
+	attrs, ok := mountAttrs(flags)
+	if !ok {
+		return errMountAPIUnsupported
+	}
+	fsfd, err := fsopen(fstype)
+	if err != nil {
+		return errors.Wrapf(err, "fsopen %q", fstype)
+	}
+	defer unix.Close(fsfd)
+
+	if source != "" {
+		if err := fsconfig(fsfd, fsconfigSetString, "source", source); err != nil {
+			return fsContextError(fsfd, err, "setting source")
+		}
+	}
+	for _, opt := range parseMountData(data) {
+		cmd := fsconfigSetString
+		if opt[1] == "" {
+			cmd = fsconfigSetFlag
+		}
+		if err := fsconfig(fsfd, cmd, opt[0], opt[1]); err != nil {
+			return fsContextError(fsfd, err, "setting option "+opt[0])
+		}
+	}
+	if err := fsconfig(fsfd, fsconfigCmdCreate, "", ""); err != nil {
+		return fsContextError(fsfd, err, "creating "+fstype+" filesystem")
+	}
+	mfd, err := fsmount(fsfd, attrs)
+	if err != nil {
+		return fsContextError(fsfd, err, "fsmount")
+	}
+	defer unix.Close(mfd)
+	return moveMount(mfd, "", target, moveMountFEmptyPath)
+}
+
+// BindIDMapped bind-mounts `source` on `target`, with ownership mapped
+// through the user namespace at `usernsPath` (e.g. `/proc/<pid>/ns/user`).
+// It requires the new mount API, and a filesystem supporting idmapped mounts.
+func (SystemMounter) BindIDMapped(source, target, usernsPath string) error {
+	if !hasMountAPI() {
+		return errors.New("idmapped mounts require the new mount API")
+	}
+	userns, err := unix.Open(usernsPath, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return errors.Wrapf(err, "opening user namespace %q", usernsPath)
+	}
+	defer unix.Close(userns)
+
+	fd, err := openTree(source, openTreeClone|unix.O_CLOEXEC)
+	if err != nil {
+		return errors.Wrapf(err, "open_tree %q", source)
+	}
+	defer unix.Close(fd)
+	attr := mountAttr{attrSet: mountAttrIdmap, usernsFd: uint64(userns)}
+	if err := mountSetattr(fd, &attr); err != nil {
+		return errors.Wrapf(err, "idmapping %q", source)
+	}
+	return moveMount(fd, "", target, moveMountFEmptyPath)
+}
+
+// mountAttrs translates mount(2) flags into fsmount(2) attributes, if all
+// of them have an equivalent.
+func mountAttrs(flags uintptr) (uint, bool) {
+	var attrs uint
+	for flag, attr := range map[uintptr]uint{
+		unix.MS_RDONLY: mountAttrRdonly,
+		unix.MS_NOSUID: mountAttrNosuid,
+		unix.MS_NODEV:  mountAttrNodev,
+		unix.MS_NOEXEC: mountAttrNoexec,
+	} {
+		if flags&flag != 0 {
+			attrs |= attr
+			flags &^= flag
+		}
+	}
+	return attrs, flags == 0
+}
+
+// parseMountData splits mount(2) data into key/value options, with an
+// empty value for flags.
+func parseMountData(data string) [][2]string {
+	opts := [][2]string{}
+	for _, entry := range strings.Split(data, ",") {
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		opts = append(opts, [2]string{kv[0], kv[1]})
+	}
+	return opts
+}
+
+// fsContextError annotates `err` with the messages logged by the kernel in
+// the filesystem context `fsfd`, which explain most configuration errors.
+func fsContextError(fsfd int, err error, what string) error {
+	msgs := []string{}
+	buf := make([]byte, fsContextLogMaxBytes)
+	for {
+		n, readErr := unix.Read(fsfd, buf)
+		if readErr != nil || n <= 0 {
+			break
+		}
+		// Messages are prefixed with their level, e.g. "e " for errors.
+		msg := strings.TrimSpace(string(buf[:n]))
+		if len(msg) > 2 && msg[1] == ' ' {
+			msg = msg[2:]
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) > 0 {
+		return errors.Wrapf(err, "%s (%s)", what, strings.Join(msgs, "; "))
+	}
+	return errors.Wrap(err, what)
+}
+
+func fsopen(fstype string) (int, error) {
+	p, err := unix.BytePtrFromString(fstype)
+	if err != nil {
+		return -1, err
+	}
+	fd, _, errno := unix.Syscall(unix.SYS_FSOPEN, uintptr(unsafe.Pointer(p)), fsopenCloexec, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func fsconfig(fsfd int, cmd int, key string, value string) error {
+	var keyp, valuep *byte
+	var err error
+	if key != "" {
+		if keyp, err = unix.BytePtrFromString(key); err != nil {
+			return err
+		}
+	}
+	if value != "" {
+		if valuep, err = unix.BytePtrFromString(value); err != nil {
+			return err
+		}
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_FSCONFIG, uintptr(fsfd), uintptr(cmd),
+		uintptr(unsafe.Pointer(keyp)), uintptr(unsafe.Pointer(valuep)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func fsmount(fsfd int, attrs uint) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_FSMOUNT, uintptr(fsfd), fsmountCloexec, uintptr(attrs))
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func openTree(path string, flags uint) (int, error) {
+	p, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+	dirfd := unix.AT_FDCWD
+	fd, _, errno := unix.Syscall(unix.SYS_OPEN_TREE, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(flags))
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// moveMount moves the mount at `fromFd` (or at path `from`, if `fromFd` is
+// negative) onto `target`.
+func moveMount(fromFd int, from string, target string, flags uint) error {
+	fromp, err := unix.BytePtrFromString(from)
+	if err != nil {
+		return err
+	}
+	targetp, err := unix.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	if fromFd < 0 {
+		fromFd = unix.AT_FDCWD
+	}
+	dirfd := unix.AT_FDCWD
+	_, _, errno := unix.Syscall6(unix.SYS_MOVE_MOUNT, uintptr(fromFd), uintptr(unsafe.Pointer(fromp)),
+		uintptr(dirfd), uintptr(unsafe.Pointer(targetp)), uintptr(flags), 0)
+	if errno != 0 {
+		return errors.Wrapf(errno, "move_mount to %q", target)
+	}
+	return nil
+}
+
+func mountSetattr(fd int, attr *mountAttr) error {
+	empty, err := unix.BytePtrFromString("")
+	if err != nil {
+		return err
+	}
+	_, _, errno := unix.Syscall6(sysMountSetattr, uintptr(fd), uintptr(unsafe.Pointer(empty)),
+		uintptr(unix.AT_EMPTY_PATH), uintptr(unsafe.Pointer(attr)), mountAttrSize, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
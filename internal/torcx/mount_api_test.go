@@ -0,0 +1,49 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMountAttrs(t *testing.T) {
+	attrs, ok := mountAttrs(unix.MS_RDONLY | unix.MS_NODEV)
+	if !ok || attrs != mountAttrRdonly|mountAttrNodev {
+		t.Errorf("unexpected attributes %#x (%t)", attrs, ok)
+	}
+	if _, ok := mountAttrs(unix.MS_RDONLY | unix.MS_REMOUNT); ok {
+		t.Error("remount flag translated to a mount attribute")
+	}
+}
+
+func TestParseMountData(t *testing.T) {
+	opts := parseMountData("size=450M,,noswap,mode=0755")
+	exp := [][2]string{{"size", "450M"}, {"noswap", ""}, {"mode", "0755"}}
+	if !reflect.DeepEqual(opts, exp) {
+		t.Errorf("got %v, expected %v", opts, exp)
+	}
+}
+
+func TestMountWithAPIFallback(t *testing.T) {
+	// These are left to mount(2), without any syscall attempted.
+	for _, flags := range []uintptr{unix.MS_PRIVATE, unix.MS_REMOUNT | unix.MS_RDONLY, unix.MS_BIND | unix.MS_RDONLY} {
+		if err := mountWithAPI("/a", "/b", "", flags, ""); err != errMountAPIUnsupported {
+			t.Errorf("flags %#x: expected %s, got %v", flags, errMountAPIUnsupported, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// MachineIDPath is the path of the local machine-id file.
+var MachineIDPath = "/etc/machine-id"
+
+// NodeIdentity identifies the local node for profile override matching.
+type NodeIdentity struct {
+	Hostname  string
+	MachineID string
+}
+
+// CurrentNodeIdentity returns the identity of the running node. Missing
+// identifiers are left empty, and only match rules without such matcher.
+func CurrentNodeIdentity() NodeIdentity {
+	node := NodeIdentity{}
+	if hostname, err := os.Hostname(); err == nil {
+		node.Hostname = hostname
+	}
+	if b, err := ioutil.ReadFile(MachineIDPath); err == nil {
+		node.MachineID = strings.TrimSpace(string(b))
+	}
+	return node
+}
+
+// NodeProfileName returns the upper profile selected for `node` by the
+// per-node overrides file, evaluating rules in order. An empty name is
+// returned if the file is missing or no rule matches.
+func (cc *CommonConfig) NodeProfileName(node NodeIdentity) (string, error) {
+	fp, err := os.Open(cc.NodeProfiles())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer fp.Close()
+
+	var manifest NodeProfilesV0JSON
+	if err := json.NewDecoder(bufio.NewReader(fp)).Decode(&manifest); err != nil {
+		return "", errors.Wrapf(err, "parsing %s", cc.NodeProfiles())
+	}
+	if manifest.Kind != NodeProfilesV0K {
+		return "", errors.Errorf("unknown node profiles kind %q", manifest.Kind)
+	}
+
+	for i, rule := range manifest.Value.Rules {
+		ok, err := rule.matches(node)
+		if err != nil {
+			return "", errors.Wrapf(err, "rule #%d", i)
+		}
+		if !ok {
+			continue
+		}
+		if rule.Profile == "" {
+			return "", errors.Errorf("rule #%d: missing profile name", i)
+		}
+		logrus.WithFields(logrus.Fields{
+			"rule":       i,
+			"hostname":   node.Hostname,
+			"machine-id": node.MachineID,
+			"profile":    rule.Profile,
+		}).Debug("node profile override matched")
+		return strings.TrimSuffix(rule.Profile, ".json"), nil
+	}
+	return "", nil
+}
+
+// matches returns whether the rule applies to `node`. Hostnames are
+// matched case-insensitively against a glob pattern.
+func (rule NodeProfileRuleV0) matches(node NodeIdentity) (bool, error) {
+	if rule.Hostname != "" {
+		ok, err := path.Match(strings.ToLower(rule.Hostname), strings.ToLower(node.Hostname))
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid hostname pattern %q", rule.Hostname)
+		}
+		if !ok || node.Hostname == "" {
+			return false, nil
+		}
+	}
+	if rule.MachineIDPrefix != "" {
+		if node.MachineID == "" || !strings.HasPrefix(node.MachineID, strings.ToLower(rule.MachineIDPrefix)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
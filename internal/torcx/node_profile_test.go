@@ -0,0 +1,71 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestNodeProfileName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_node_profile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cc := &CommonConfig{ConfDir: dir}
+
+	name, err := cc.NodeProfileName(NodeIdentity{Hostname: "gpu-1"})
+	if err != nil || name != "" {
+		t.Fatalf("missing file: expected no override, got %q %v", name, err)
+	}
+
+	manifest := `{"kind": "torcx-node-profiles-v0", "value": {"rules": [
+		{"hostname": "GPU-*", "profile": "gpu.json"},
+		{"hostname": "edge-*", "machine_id_prefix": "4F3A", "profile": "canary"},
+		{"machine_id_prefix": "4f3a", "profile": "fleet"}
+	]}}`
+	if err := ioutil.WriteFile(cc.NodeProfiles(), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		node NodeIdentity
+		exp  string
+	}{
+		{NodeIdentity{Hostname: "gpu-1", MachineID: "4f3a00"}, "gpu"},
+		{NodeIdentity{Hostname: "edge-1", MachineID: "4f3a00"}, "canary"},
+		{NodeIdentity{Hostname: "edge-1", MachineID: "ffff00"}, ""},
+		{NodeIdentity{Hostname: "worker-1", MachineID: "4f3a00"}, "fleet"},
+		{NodeIdentity{}, ""},
+	}
+	for _, tt := range tests {
+		got, err := cc.NodeProfileName(tt.node)
+		if err != nil {
+			t.Errorf("node %v: got unexpected error: %s", tt.node, err)
+		}
+		if got != tt.exp {
+			t.Errorf("node %v: expected %q, got %q", tt.node, tt.exp, got)
+		}
+	}
+
+	if err := ioutil.WriteFile(cc.NodeProfiles(), []byte(`{"kind": "torcx-config-v0", "value": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cc.NodeProfileName(NodeIdentity{}); err == nil {
+		t.Error("expected error on wrong kind")
+	}
+}
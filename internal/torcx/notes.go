@@ -0,0 +1,180 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// ImageNotes are the changelog notes of an image version, inline or as a URL.
+type ImageNotes struct {
+	Text string `json:"text,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+// IsZero returns whether no notes are available.
+func (n ImageNotes) IsZero() bool {
+	return n.Text == "" && n.URL == ""
+}
+
+// VersionNotes returns the notes of image `name` at `version`, as listed in
+// the contents manifest.
+func (rcs *RemoteContents) VersionNotes(name string, version string) ImageNotes {
+	if rcs == nil {
+		return ImageNotes{}
+	}
+	for _, v := range rcs.Images[name].versions {
+		if v.version == version {
+			return ImageNotes{Text: v.notes, URL: v.notesURL}
+		}
+	}
+	return ImageNotes{}
+}
+
+// ImageInspection describes a local archive and its embedded metadata.
+type ImageInspection struct {
+	Archive
+	Hash     string     `json:"hash,omitempty"`
+	Assets   *Assets    `json:"assets,omitempty"`
+	Fragment []Image    `json:"fragment,omitempty"`
+	Notes    ImageNotes `json:"notes"`
+	// Error is set if the archive could not be inspected.
+	Error string `json:"error,omitempty"`
+}
+
+// InspectImage inspects the local archive for `im`, without unpacking it.
+// Notes are read from the image manifest, falling back to the cached
+// contents manifest of the image remote, if any.
+func (cc *CommonConfig) InspectImage(im Image) (*ImageInspection, error) {
+	storeCache, err := NewStoreCache(cc.StorePaths)
+	if err != nil {
+		return nil, err
+	}
+	im, err = storeCache.ResolveVersion(im)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := storeCache.ArchiveFor(im)
+	if err != nil {
+		return nil, err
+	}
+
+	inspection := &ImageInspection{Archive: archive}
+	if hash, err := readHashSidecar(archive.Filepath); err == nil {
+		inspection.Hash = hash
+	}
+	meta, err := ReadArchiveMetadata(archive)
+	if err != nil {
+		inspection.Error = err.Error()
+	} else {
+		inspection.Assets = &meta.Assets
+		inspection.Fragment = meta.Fragment
+		inspection.Notes = ImageNotes{Text: meta.Assets.Notes, URL: meta.Assets.NotesURL}
+	}
+	if inspection.Notes.IsZero() && im.Remote != "" {
+		if contents, err := readCachedContents(cc.RemoteContentsCacheDir(), im.Remote); err == nil {
+			inspection.Notes = contents.VersionNotes(im.Name, archive.Reference)
+		}
+	}
+	return inspection, nil
+}
+
+// VersionNotes is an image version along with its notes.
+type VersionNotes struct {
+	Version string     `json:"version"`
+	Notes   ImageNotes `json:"notes"`
+}
+
+// OutdatedImage is a profile image with newer versions available on its remote.
+type OutdatedImage struct {
+	Image
+	// Current is the concrete local version, if any.
+	Current string `json:"current,omitempty"`
+	// Newer are the newer remote versions, in ascending order.
+	Newer []VersionNotes `json:"newer"`
+}
+
+// OutdatedImages checks the images of the profile which would be applied
+// with the given configuration against their remotes, returning the ones
+// with newer versions available. Images without a remote are skipped.
+func OutdatedImages(ctx context.Context, applyCfg *ApplyConfig) ([]OutdatedImage, error) {
+	if applyCfg == nil {
+		return nil, errors.New("missing apply configuration")
+	}
+	images, err := mergeProfiles(applyCfg)
+	if err != nil {
+		return nil, err
+	}
+	storeCache, err := NewStoreCache(applyCfg.StorePaths)
+	if err != nil {
+		return nil, err
+	}
+
+	remotes := []string{}
+	seen := map[string]bool{}
+	for _, im := range images {
+		if im.Remote != "" && !seen[im.Remote] {
+			seen[im.Remote] = true
+			remotes = append(remotes, im.Remote)
+		}
+	}
+	outdated := []OutdatedImage{}
+	if len(remotes) == 0 {
+		return outdated, nil
+	}
+	rc, err := applyCfg.LoadRemotes(ctx, remotes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, im := range images {
+		contents, ok := rc.Contents[im.Remote]
+		if im.Remote == "" || !ok {
+			continue
+		}
+		ri := contents.Images[im.Name]
+		current := im.Reference
+		switch {
+		case current == DefaultTagRef:
+			current = ri.defaultVersion
+		case IsVersionQuery(current):
+			current = ""
+			if resolved, err := storeCache.ResolveVersion(im); err == nil {
+				current = resolved.Reference
+			}
+		}
+
+		entry := OutdatedImage{Image: im, Current: current, Newer: []VersionNotes{}}
+		for _, v := range ri.versions {
+			if current == "" || CompareVersions(v.version, current) > 0 {
+				entry.Newer = append(entry.Newer, VersionNotes{
+					Version: v.version,
+					Notes:   ImageNotes{Text: v.notes, URL: v.notesURL},
+				})
+			}
+		}
+		if len(entry.Newer) == 0 {
+			continue
+		}
+		sort.Slice(entry.Newer, func(i, j int) bool {
+			return CompareVersions(entry.Newer[i].Version, entry.Newer[j].Version) < 0
+		})
+		outdated = append(outdated, entry)
+	}
+	return outdated, nil
+}
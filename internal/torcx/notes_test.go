@@ -0,0 +1,67 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInspectImageNotes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_notes_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	storeDir := filepath.Join(dir, "store")
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTgz(t, filepath.Join(storeDir, "foo:1.torcx.tgz"), map[string]string{
+		".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/foo"], "notes": "fixes CVE-0000-0000"}}`,
+	})
+	writeTestTgz(t, filepath.Join(storeDir, "bar:2.torcx.tgz"), map[string]string{
+		"bin/bar": "bar",
+	})
+	contents := `{"kind": "torcx-remote-contents-v1", "value": {"images": [
+		{"name": "bar", "defaultVersion": "2", "versions": [
+			{"version": "2", "format": "tgz", "hash": "sha512-a", "location": "bar-2.torcx.tgz", "notesURL": "https://example.com/bar/2"}]}]}}`
+	cc := &CommonConfig{BaseDir: filepath.Join(dir, "base"), StorePaths: []string{storeDir}}
+	if err := writeCachedContents(cc.RemoteContentsCacheDir(), "com.example", contents); err != nil {
+		t.Fatal(err)
+	}
+
+	inspection, err := cc.InspectImage(Image{Name: "foo", Reference: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspection.Notes.Text != "fixes CVE-0000-0000" {
+		t.Errorf("unexpected notes %+v", inspection.Notes)
+	}
+	if inspection.Assets == nil || len(inspection.Assets.Binaries) != 1 {
+		t.Errorf("unexpected assets %+v", inspection.Assets)
+	}
+
+	inspection, err = cc.InspectImage(Image{Name: "bar", Reference: "2", Remote: "com.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspection.Notes.URL != "https://example.com/bar/2" {
+		t.Errorf("expected notes from cached contents, got %+v", inspection.Notes)
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// NotifyV0K - apply notification kind, v0
+	NotifyV0K = "torcx-notify-v0"
+
+	// NotifyResultSuccess is the result of applies without skipped images.
+	NotifyResultSuccess = "success"
+	// NotifyResultDegraded is the result of sealed applies which skipped
+	// or dropped some images.
+	NotifyResultDegraded = "degraded"
+	// NotifyResultFailed is the result of applies which were not sealed.
+	NotifyResultFailed = "failed"
+
+	// notifyUnit is the generated unit sending the notification.
+	notifyUnit = "torcx-notify.service"
+)
+
+// Notify configures the summary of the applied profile POSTed to a fleet
+// endpoint after boot.
+type Notify struct {
+	// Endpoint is the URL the summary is POSTed to.
+	Endpoint string `json:"endpoint"`
+	// SigningKey is the armored private keyring clearsigning the summary.
+	SigningKey string `json:"signing_key,omitempty"`
+}
+
+// validate checks that the notification endpoint is an http(s) URL.
+func (n *Notify) validate() error {
+	if n.Endpoint == "" {
+		return errors.New("missing notify endpoint")
+	}
+	u, err := url.Parse(n.Endpoint)
+	if err != nil {
+		return errors.Wrapf(err, "invalid notify endpoint %q", n.Endpoint)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errors.Errorf("unsupported scheme for notify endpoint %q", n.Endpoint)
+	}
+	return nil
+}
+
+// NotifySummary is the summary of the applied profile sent to the notify
+// endpoint.
+type NotifySummary struct {
+	// MachineID is the node machine-id, if known.
+	MachineID string `json:"machine_id"`
+	// Hostname is the node hostname, if known.
+	Hostname string `json:"hostname"`
+	// Generation is bumped each time the applied images change.
+	Generation int `json:"generation"`
+	// Result is either NotifyResultSuccess, NotifyResultDegraded or
+	// NotifyResultFailed.
+	Result string `json:"result"`
+	// UpperProfile is the applied upper profile, if sealed.
+	UpperProfile string `json:"upper_profile,omitempty"`
+	// Images are the applied images, with their digests.
+	Images []InventoryImage `json:"images"`
+	// Warnings are the number of apply warnings, by kind.
+	Warnings map[string]int `json:"warnings,omitempty"`
+	// Time is when the summary was taken.
+	Time time.Time `json:"time"`
+}
+
+// NotifyV0JSON is the JSON record of an apply notification.
+type NotifyV0JSON struct {
+	Kind  string        `json:"kind"`
+	Value NotifySummary `json:"value"`
+}
+
+// notifyState records the last summary accepted by the notify endpoint.
+type notifyState struct {
+	Generation int              `json:"generation"`
+	Images     []InventoryImage `json:"images"`
+}
+
+// NewNotifySummary summarizes the applied profile of the node, for the
+// notify endpoint.
+func NewNotifySummary(cc *CommonConfig) (*NotifySummary, error) {
+	return newNotifySummary(cc, RootPath(SealPath))
+}
+
+// newNotifySummary implements NewNotifySummary against the seal file at
+// `sealPath`.
+func newNotifySummary(cc *CommonConfig, sealPath string) (*NotifySummary, error) {
+	if cc == nil {
+		return nil, errors.New("missing common configuration")
+	}
+	node := CurrentNodeIdentity()
+	summary := &NotifySummary{
+		MachineID: node.MachineID,
+		Hostname:  node.Hostname,
+		Result:    NotifyResultFailed,
+		Images:    []InventoryImage{},
+		Time:      time.Now().UTC(),
+	}
+
+	warnings, err := ReadWarnings(cc.RunWarnings())
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Wrap(err, "reading apply warnings")
+	}
+	if len(warnings) > 0 {
+		summary.Warnings = CountWarnings(warnings)
+	}
+
+	if meta, err := ReadMetadata(sealPath); err == nil {
+		summary.UpperProfile = meta[SealUpperProfile]
+		if summary.Images, err = appliedInventoryImages(cc, sealPath); err != nil {
+			return nil, err
+		}
+		summary.Result = NotifyResultSuccess
+		if summary.Warnings[WarningSkippedImage]+summary.Warnings[WarningSkippedRecommendation]+summary.Warnings[WarningDroppedImage] > 0 {
+			summary.Result = NotifyResultDegraded
+		}
+	}
+
+	state, err := readNotifyState(cc.NotifyState())
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+	summary.Generation = state.Generation
+	if state.Generation == 0 || !reflect.DeepEqual(state.Images, summary.Images) {
+		summary.Generation++
+	}
+	return summary, nil
+}
+
+// EncodeNotifySummary serializes `summary` as a JSON document, clearsigned
+// by `signer` if not nil.
+func EncodeNotifySummary(summary *NotifySummary, signer *openpgp.Entity) ([]byte, error) {
+	if summary == nil {
+		return nil, errors.New("missing notify summary")
+	}
+	return encodeSignedJSON(NotifyV0JSON{NotifyV0K, *summary}, signer)
+}
+
+// SendNotifySummary POSTs `summary` to the configured notify endpoint,
+// clearsigned by the configured signing key if any. Once accepted, its
+// generation is recorded, to be bumped when the applied images change.
+func SendNotifySummary(ctx context.Context, cc *CommonConfig, summary *NotifySummary) error {
+	if cc == nil || cc.Notify == nil {
+		return errors.New("no notify endpoint configured")
+	}
+	var signer *openpgp.Entity
+	if cc.Notify.SigningKey != "" {
+		var err error
+		if signer, err = ReadSigningKey(cc.Notify.SigningKey); err != nil {
+			return err
+		}
+	}
+	b, err := EncodeNotifySummary(summary, signer)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, cc.Notify.Endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if signer != nil {
+		req.Header.Set("Content-Type", "text/plain")
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := cc.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusAccepted, http.StatusNoContent:
+	default:
+		if err := checkHTTPStatus(resp); err != nil {
+			return errors.Wrapf(err, "notifying %s", cc.Notify.Endpoint)
+		}
+	}
+
+	return writeNotifyState(cc.NotifyState(), notifyState{summary.Generation, summary.Images})
+}
+
+// readNotifyState reads the notification state at `path`.
+func readNotifyState(path string) (notifyState, error) {
+	state := notifyState{}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return state, errors.Wrapf(err, "failed to decode %s", path)
+	}
+	return state, nil
+}
+
+// writeNotifyState atomically writes `state` at `path`.
+func writeNotifyState(path string, state notifyState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// WriteNotifyUnit generates, in the systemd generator directory `unitDir`,
+// a unit running `command notify` once the network is up, if a notify
+// endpoint is configured.
+func WriteNotifyUnit(applyCfg *ApplyConfig, unitDir string, command string) error {
+	if applyCfg == nil {
+		return errors.New("missing apply configuration")
+	}
+	if applyCfg.Notify == nil {
+		return nil
+	}
+
+	unit := strings.Join([]string{
+		"# Automatically generated by torcx-generator",
+		"",
+		"[Unit]",
+		"Description=Notify the torcx applied profile",
+		"Wants=network-online.target",
+		"After=network-online.target",
+		"",
+		"[Service]",
+		"Type=oneshot",
+		"ExecStart=" + command + " notify",
+		"",
+	}, "\n")
+	if err := ioutil.WriteFile(filepath.Join(unitDir, notifyUnit), []byte(unit), 0644); err != nil {
+		return errors.Wrap(err, "writing notify unit")
+	}
+
+	wantsDir := filepath.Join(unitDir, "multi-user.target.wants")
+	if err := os.MkdirAll(wantsDir, 0755); err != nil {
+		return err
+	}
+	link := filepath.Join(wantsDir, notifyUnit)
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(filepath.Join("..", notifyUnit), link)
+}
@@ -0,0 +1,147 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNotifySummary(t *testing.T) {
+	dir := t.TempDir()
+	var received []NotifyV0JSON
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var record NotifyV0JSON
+		if err := json.NewDecoder(req.Body).Decode(&record); err != nil {
+			t.Error(err)
+		}
+		received = append(received, record)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	cc := &CommonConfig{
+		BaseDir: filepath.Join(dir, "base"),
+		RunDir:  filepath.Join(dir, "run"),
+		Notify:  &Notify{Endpoint: server.URL},
+	}
+	metadataDir := filepath.Join(dir, "metadata")
+	for _, d := range []string{metadataDir, cc.RunDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sealPath := filepath.Join(metadataDir, "torcx")
+
+	// Unsealed nodes report a failed apply.
+	summary, err := newNotifySummary(cc, sealPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Result != NotifyResultFailed || summary.Generation != 1 || len(summary.Images) != 0 {
+		t.Errorf("unexpected unsealed summary %+v", summary)
+	}
+	if err := SendNotifySummary(context.Background(), cc, summary); err != nil {
+		t.Fatal(err)
+	}
+
+	seal := func(images []Image) {
+		if err := writeRunProfile(cc.RunProfile(), images); err != nil {
+			t.Fatal(err)
+		}
+		applied := []AppliedImage{}
+		for _, im := range images {
+			applied = append(applied, AppliedImage{Image: im, Archive: "/store/" + im.Name + ".torcx.tgz", Digest: "sha512-" + im.Reference})
+		}
+		if err := writeImageEnvFiles(metadataDir, applied); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(sealPath, []byte("TORCX_UPPER_PROFILE=\"user\"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seal([]Image{{Name: "foo", Reference: "1"}})
+	applyCfg := &ApplyConfig{CommonConfig: *cc}
+	applyCfg.warnSkipped(Image{Name: "bar", Reference: "2"}, os.ErrNotExist)
+	if err := writeWarnings(cc.RunWarnings(), applyCfg.Warnings); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err = newNotifySummary(cc, sealPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Result != NotifyResultDegraded || summary.Generation != 2 || summary.UpperProfile != "user" {
+		t.Errorf("unexpected sealed summary %+v", summary)
+	}
+	if len(summary.Images) != 1 || summary.Images[0].Digest != "sha512-1" {
+		t.Errorf("unexpected applied images %+v", summary.Images)
+	}
+	if err := SendNotifySummary(context.Background(), cc, summary); err != nil {
+		t.Fatal(err)
+	}
+
+	// The generation is only bumped when the applied images change.
+	if err := os.Remove(cc.RunWarnings()); err != nil {
+		t.Fatal(err)
+	}
+	if summary, err = newNotifySummary(cc, sealPath); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Result != NotifyResultSuccess || summary.Generation != 2 {
+		t.Errorf("unexpected unchanged summary %+v", summary)
+	}
+	seal([]Image{{Name: "foo", Reference: "2"}})
+	if summary, err = newNotifySummary(cc, sealPath); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Generation != 3 {
+		t.Errorf("expected generation 3, got %d", summary.Generation)
+	}
+
+	if len(received) != 2 || received[0].Kind != NotifyV0K || received[1].Value.Result != NotifyResultDegraded {
+		t.Errorf("unexpected notifications %+v", received)
+	}
+}
+
+func TestWriteNotifyUnit(t *testing.T) {
+	unitDir := t.TempDir()
+	applyCfg := &ApplyConfig{}
+	if err := WriteNotifyUnit(applyCfg, unitDir, "/usr/bin/torcx"); err != nil {
+		t.Fatal(err)
+	}
+	if IsExistingPath(filepath.Join(unitDir, notifyUnit)) {
+		t.Error("unexpected notify unit without endpoint")
+	}
+
+	applyCfg.Notify = &Notify{Endpoint: "https://fleet.example.com/torcx"}
+	if err := WriteNotifyUnit(applyCfg, unitDir, "/usr/bin/torcx"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(unitDir, "multi-user.target.wants", notifyUnit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "ExecStart=/usr/bin/torcx notify") || !strings.Contains(string(b), "After=network-online.target") {
+		t.Errorf("unexpected notify unit:\n%s", b)
+	}
+}
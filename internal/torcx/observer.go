@@ -0,0 +1,203 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io"
+)
+
+// FetchObserver receives structured progress events while fetching images
+// from remotes. Events for a single image are delivered in order, from the
+// goroutine performing the fetch.
+type FetchObserver interface {
+	// FetchStarted is called before fetching `im` from `url`.
+	FetchStarted(im Image, url string)
+	// FetchProgress is called while downloading, with the number of bytes
+	// written so far and the total size (-1 if unknown).
+	FetchProgress(im Image, written int64, total int64)
+	// FetchFinished is called once `im` has been fetched to `path`, or on error.
+	FetchFinished(im Image, path string, err error)
+}
+
+// ApplyObserver receives structured lifecycle events while applying a profile.
+type ApplyObserver interface {
+	// ApplyStarted is called once profiles have been merged, before
+	// applying `images`.
+	ApplyStarted(images []Image)
+	// ImageStarted is called before unpacking `im`.
+	ImageStarted(im Image)
+	// ImageLocated is called once the store archive for `im` has been found.
+	ImageLocated(im Image, archive Archive)
+	// ImageVerified is called once the archive for `im` passed hash and
+	// signature checks.
+	ImageVerified(im Image, archive Archive)
+	// ImageUnpacked is called once `im` has been unpacked at `rootfs`.
+	ImageUnpacked(im Image, rootfs string)
+	// ImageApplied is called once the assets of `im` have been propagated.
+	ImageApplied(im Image, assets Assets)
+	// ImageFailed is called if `im` could not be applied.
+	ImageFailed(im Image, err error)
+	// ApplyFinished is called once all images have been processed, or
+	// as soon as the apply fails before any image is processed.
+	ApplyFinished(applied []Image, err error)
+	// SystemSealed is called once the system state has been sealed at
+	// `path`, or on error.
+	SystemSealed(path string, err error)
+}
+
+// NopFetchObserver is a FetchObserver ignoring all events. It can be
+// embedded to only implement a subset of events.
+type NopFetchObserver struct{}
+
+// FetchStarted implements FetchObserver.
+func (NopFetchObserver) FetchStarted(im Image, url string) {}
+
+// FetchProgress implements FetchObserver.
+func (NopFetchObserver) FetchProgress(im Image, written int64, total int64) {}
+
+// FetchFinished implements FetchObserver.
+func (NopFetchObserver) FetchFinished(im Image, path string, err error) {}
+
+// NopApplyObserver is an ApplyObserver ignoring all events. It can be
+// embedded to only implement a subset of events.
+type NopApplyObserver struct{}
+
+// ApplyStarted implements ApplyObserver.
+func (NopApplyObserver) ApplyStarted(images []Image) {}
+
+// ImageStarted implements ApplyObserver.
+func (NopApplyObserver) ImageStarted(im Image) {}
+
+// ImageLocated implements ApplyObserver.
+func (NopApplyObserver) ImageLocated(im Image, archive Archive) {}
+
+// ImageVerified implements ApplyObserver.
+func (NopApplyObserver) ImageVerified(im Image, archive Archive) {}
+
+// ImageUnpacked implements ApplyObserver.
+func (NopApplyObserver) ImageUnpacked(im Image, rootfs string) {}
+
+// ImageApplied implements ApplyObserver.
+func (NopApplyObserver) ImageApplied(im Image, assets Assets) {}
+
+// ImageFailed implements ApplyObserver.
+func (NopApplyObserver) ImageFailed(im Image, err error) {}
+
+// ApplyFinished implements ApplyObserver.
+func (NopApplyObserver) ApplyFinished(applied []Image, err error) {}
+
+// SystemSealed implements ApplyObserver.
+func (NopApplyObserver) SystemSealed(path string, err error) {}
+
+// MultiApplyObserver is an ApplyObserver forwarding all events to each
+// of its observers, in order.
+type MultiApplyObserver []ApplyObserver
+
+// ApplyStarted implements ApplyObserver.
+func (mo MultiApplyObserver) ApplyStarted(images []Image) {
+	for _, o := range mo {
+		o.ApplyStarted(images)
+	}
+}
+
+// ImageStarted implements ApplyObserver.
+func (mo MultiApplyObserver) ImageStarted(im Image) {
+	for _, o := range mo {
+		o.ImageStarted(im)
+	}
+}
+
+// ImageLocated implements ApplyObserver.
+func (mo MultiApplyObserver) ImageLocated(im Image, archive Archive) {
+	for _, o := range mo {
+		o.ImageLocated(im, archive)
+	}
+}
+
+// ImageVerified implements ApplyObserver.
+func (mo MultiApplyObserver) ImageVerified(im Image, archive Archive) {
+	for _, o := range mo {
+		o.ImageVerified(im, archive)
+	}
+}
+
+// ImageUnpacked implements ApplyObserver.
+func (mo MultiApplyObserver) ImageUnpacked(im Image, rootfs string) {
+	for _, o := range mo {
+		o.ImageUnpacked(im, rootfs)
+	}
+}
+
+// ImageApplied implements ApplyObserver.
+func (mo MultiApplyObserver) ImageApplied(im Image, assets Assets) {
+	for _, o := range mo {
+		o.ImageApplied(im, assets)
+	}
+}
+
+// ImageFailed implements ApplyObserver.
+func (mo MultiApplyObserver) ImageFailed(im Image, err error) {
+	for _, o := range mo {
+		o.ImageFailed(im, err)
+	}
+}
+
+// ApplyFinished implements ApplyObserver.
+func (mo MultiApplyObserver) ApplyFinished(applied []Image, err error) {
+	for _, o := range mo {
+		o.ApplyFinished(applied, err)
+	}
+}
+
+// SystemSealed implements ApplyObserver.
+func (mo MultiApplyObserver) SystemSealed(path string, err error) {
+	for _, o := range mo {
+		o.SystemSealed(path, err)
+	}
+}
+
+// fetchObserver returns the configured fetch observer, or a no-op one.
+func (rc *RemotesCache) fetchObserver() FetchObserver {
+	if rc == nil || rc.Observer == nil {
+		return NopFetchObserver{}
+	}
+	return rc.Observer
+}
+
+// applyObserver returns the configured apply observer, or a no-op one.
+func (applyCfg *ApplyConfig) applyObserver() ApplyObserver {
+	if applyCfg == nil || applyCfg.Observer == nil {
+		return NopApplyObserver{}
+	}
+	return applyCfg.Observer
+}
+
+// progressReader reports read progress of an archive download.
+type progressReader struct {
+	io.Reader
+	im       Image
+	observer FetchObserver
+	written  int64
+	total    int64
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.Reader.Read(p)
+	if n > 0 {
+		pr.written += int64(n)
+		pr.observer.FetchProgress(pr.im, pr.written, pr.total)
+	}
+	return n, err
+}
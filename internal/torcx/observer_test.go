@@ -0,0 +1,77 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// progressRecorder records progress events, ignoring other fetch events.
+type progressRecorder struct {
+	NopFetchObserver
+	written []int64
+	total   int64
+}
+
+func (pr *progressRecorder) FetchProgress(im Image, written int64, total int64) {
+	pr.written = append(pr.written, written)
+	pr.total = total
+}
+
+func TestFetchProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_observer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := strings.Repeat("a", 100*1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	recorder := &progressRecorder{}
+	rc := &RemotesCache{Observer: recorder}
+	baseURL, _ := url.Parse(srv.URL + "/")
+	location, _ := url.Parse("./foo:1.torcx.tgz")
+	im := Image{Name: "foo", Reference: "1"}
+	if err := rc.downloadArchive(context.Background(), im, (&Remote{}).httpClient(), baseURL, location, dir, "", 0); err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+
+	if len(recorder.written) == 0 {
+		t.Fatal("no progress reported")
+	}
+	if last := recorder.written[len(recorder.written)-1]; last != int64(len(content)) {
+		t.Errorf("expected %d bytes written, got %d", len(content), last)
+	}
+	if recorder.total != int64(len(content)) {
+		t.Errorf("expected total %d, got %d", len(content), recorder.total)
+	}
+
+	// Missing observers default to no-op ones.
+	(&ApplyConfig{}).applyObserver().ImageStarted(im)
+	(&RemotesCache{}).fetchObserver().FetchStarted(im, "")
+}
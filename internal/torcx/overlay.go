@@ -0,0 +1,160 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// RetentionBoot clears the writable layer of an overlay on each apply.
+	RetentionBoot = "boot"
+	// RetentionReference keeps the writable layer of an overlay as long as
+	// the same image reference is applied.
+	RetentionReference = "reference"
+	// RetentionImage keeps the writable layer of an overlay across image
+	// references, until the image state is cleaned up.
+	RetentionImage = "image"
+
+	// overlayReferenceFile records the image reference writable layers
+	// were last mounted for.
+	overlayReferenceFile = ".reference"
+)
+
+// WritableOverlay is a directory of an image made writable by an overlay,
+// e.g. for plugins dropped at runtime.
+type WritableOverlay struct {
+	// Path is the absolute path of the directory in the image.
+	Path string `json:"path"`
+	// Retention is when the writable layer is cleared, RetentionReference
+	// by default.
+	Retention string `json:"retention,omitempty"`
+}
+
+// retention returns the retention policy of the overlay.
+func (ov WritableOverlay) retention() string {
+	if ov.Retention == "" {
+		return RetentionReference
+	}
+	return ov.Retention
+}
+
+// layerName returns the directory name of the writable layer of the
+// overlay, below the image overlays directory.
+func (ov WritableOverlay) layerName() string {
+	return strings.Replace(strings.TrimPrefix(ov.Path, "/"), "/", "-", -1)
+}
+
+// validateWritableOverlays checks that `overlays` are well-formed and do
+// not overlap.
+func validateWritableOverlays(overlays []WritableOverlay) error {
+	layers := map[string]string{}
+	for _, ov := range overlays {
+		if !filepath.IsAbs(ov.Path) || filepath.Clean(ov.Path) != ov.Path || ov.Path == "/" {
+			return errors.Errorf("invalid writable path %q, must be absolute, clean and not the image root", ov.Path)
+		}
+		switch ov.retention() {
+		case RetentionBoot, RetentionReference, RetentionImage:
+		default:
+			return errors.Errorf("invalid retention %q for writable path %s", ov.Retention, ov.Path)
+		}
+		if other, ok := layers[ov.layerName()]; ok {
+			return errors.Errorf("writable paths %s and %s collide", other, ov.Path)
+		}
+		layers[ov.layerName()] = ov.Path
+	}
+	for _, ov := range overlays {
+		for _, other := range overlays {
+			if strings.HasPrefix(ov.Path, other.Path+"/") {
+				return errors.Errorf("writable path %s is nested in %s", ov.Path, other.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// imageOverlaysDir returns the directory holding the writable layers of
+// the overlays of image `name`.
+func (cc *CommonConfig) imageOverlaysDir(name string) string {
+	return filepath.Join(cc.OverlaysDir(), imagePathName(name))
+}
+
+// mountWritableOverlays mounts the writable overlays declared by `im` on
+// its unpack root `imageRoot`. Writable layers are cleared according to
+// their retention, and the ones not declared anymore are removed.
+func mountWritableOverlays(applyCfg *ApplyConfig, im Image, imageRoot string, overlays []WritableOverlay) error {
+	if err := validateWritableOverlays(overlays); err != nil {
+		return err
+	}
+	dir := applyCfg.imageOverlaysDir(im.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	previous := ""
+	if b, err := ioutil.ReadFile(filepath.Join(dir, overlayReferenceFile)); err == nil {
+		previous = strings.TrimSpace(string(b))
+	}
+
+	declared := map[string]bool{}
+	for _, ov := range overlays {
+		declared[ov.layerName()] = true
+	}
+	if entries, err := ioutil.ReadDir(dir); err == nil {
+		for _, fi := range entries {
+			if fi.IsDir() && !declared[fi.Name()] {
+				if err := os.RemoveAll(filepath.Join(dir, fi.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, ov := range overlays {
+		lower := filepath.Join(imageRoot, ov.Path)
+		if fi, err := os.Stat(lower); err != nil || !fi.IsDir() {
+			return errors.Errorf("writable path %s is not a directory in the image", ov.Path)
+		}
+		layer := filepath.Join(dir, ov.layerName())
+		retention := ov.retention()
+		if retention == RetentionBoot || (retention == RetentionReference && previous != im.Reference) {
+			if err := os.RemoveAll(layer); err != nil {
+				return err
+			}
+		}
+		upper, work := filepath.Join(layer, "upper"), filepath.Join(layer, "work")
+		for _, d := range []string{upper, work} {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				return err
+			}
+		}
+		opts := "lowerdir=" + lower + ",upperdir=" + upper + ",workdir=" + work
+		if err := applyCfg.mounter().Mount("overlay", lower, "overlay", 0, opts); err != nil {
+			return errors.Wrapf(err, "failed to mount overlay on %s", lower)
+		}
+		logrus.WithFields(logrus.Fields{
+			"image":     im.Name,
+			"path":      lower,
+			"upper":     upper,
+			"retention": retention,
+		}).Debug("writable overlay mounted")
+	}
+	return ioutil.WriteFile(filepath.Join(dir, overlayReferenceFile), []byte(im.Reference+"\n"), 0644)
+}
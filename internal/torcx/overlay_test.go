@@ -0,0 +1,99 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMountWritableOverlays(t *testing.T) {
+	dir := t.TempDir()
+	mounter := &fakeMounter{}
+	applyCfg := &ApplyConfig{CommonConfig: CommonConfig{
+		BaseDir: filepath.Join(dir, "base"),
+		RunDir:  filepath.Join(dir, "run"),
+		Mounter: mounter,
+	}}
+	root := filepath.Join(applyCfg.RunUnpackDir(), "foo")
+	for _, d := range []string{"lib/plugins", "var/cache", "share/data"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	overlays := []WritableOverlay{
+		{Path: "/lib/plugins"},
+		{Path: "/var/cache", Retention: RetentionBoot},
+		{Path: "/share/data", Retention: RetentionImage},
+	}
+	layersDir := filepath.Join(applyCfg.OverlaysDir(), "foo")
+	drop := func(layer string) string {
+		path := filepath.Join(layersDir, layer, "upper", "dropped")
+		if err := ioutil.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	if err := mountWritableOverlays(applyCfg, Image{Name: "foo", Reference: "1"}, root, overlays); err != nil {
+		t.Fatal(err)
+	}
+	if len(mounter.mounts) != 3 || mounter.mounts[0] != "overlay:"+filepath.Join(root, "lib", "plugins") {
+		t.Errorf("unexpected mounts %v", mounter.mounts)
+	}
+	plugin, cache, data := drop("lib-plugins"), drop("var-cache"), drop("share-data")
+
+	if err := mountWritableOverlays(applyCfg, Image{Name: "foo", Reference: "1"}, root, overlays); err != nil {
+		t.Fatal(err)
+	}
+	if !IsExistingPath(plugin) || IsExistingPath(cache) || !IsExistingPath(data) {
+		t.Error("unexpected writable layers after applying the same reference")
+	}
+	if err := mountWritableOverlays(applyCfg, Image{Name: "foo", Reference: "2"}, root, overlays[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if IsExistingPath(filepath.Join(layersDir, "lib-plugins")) || !IsExistingPath(data) {
+		t.Error("unexpected writable layers after applying another reference")
+	}
+
+	cleaned, err := CleanupImageState(&applyCfg.CommonConfig, &ImageState{Image: Image{Name: "foo", Reference: "2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cleaned || IsExistingPath(layersDir) {
+		t.Error("writable layers not cleaned up")
+	}
+}
+
+func TestValidateWritableOverlays(t *testing.T) {
+	invalid := [][]WritableOverlay{
+		{{Path: "lib"}},
+		{{Path: "/"}},
+		{{Path: "/lib/../etc"}},
+		{{Path: "/lib", Retention: "forever"}},
+		{{Path: "/lib"}, {Path: "/lib/plugins"}},
+		{{Path: "/lib/plugins"}, {Path: "/lib-plugins"}},
+	}
+	for _, overlays := range invalid {
+		if err := validateWritableOverlays(overlays); err == nil {
+			t.Errorf("expected error for %v", overlays)
+		}
+	}
+	if err := validateWritableOverlays([]WritableOverlay{{Path: "/lib"}, {Path: "/libexec", Retention: RetentionImage}}); err != nil {
+		t.Error(err)
+	}
+}
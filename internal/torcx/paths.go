@@ -32,11 +32,31 @@ const (
 	OemProfilesDir = OemDir + "profiles"
 	// OemRemotesDir is the OEM remotes path
 	OemRemotesDir = OemDir + "remotes"
+	// OemTrustedKeysDir is the OEM trusted keys path
+	OemTrustedKeysDir = OemDir + "trusted-keys.d"
+	// OemRolesDir is the OEM roles path
+	OemRolesDir = OemDir + "roles"
+	// OemPoliciesDir is the OEM apply policies path
+	OemPoliciesDir = OemDir + "policies"
 
 	// defaultCfgPath is the default path for common torcx config
 	defaultCfgPath = DefaultConfDir + "config.json"
 )
 
+// RootPrefix, if set, relocates the runtime, base and configuration
+// directories, the seal metadata and propagated assets below it, so that
+// several isolated torcx instances can run on the same machine. Vendor and
+// OEM paths are left untouched.
+var RootPrefix string
+
+// RootPath returns the system path `path`, relocated below RootPrefix.
+func RootPath(path string) string {
+	if RootPrefix == "" {
+		return path
+	}
+	return filepath.Join(RootPrefix, path)
+}
+
 // VendorRemotesDir is the vendor remotes path
 func VendorRemotesDir(usrMountpoint string) string {
 	if usrMountpoint == "" {
@@ -53,6 +73,22 @@ func VendorProfilesDir(usrMountpoint string) string {
 	return filepath.Join(usrMountpoint, "share", "torcx", "profiles")
 }
 
+// VendorRolesDir is the vendor roles path
+func VendorRolesDir(usrMountpoint string) string {
+	if usrMountpoint == "" {
+		usrMountpoint = VendorUsrDir
+	}
+	return filepath.Join(usrMountpoint, "share", "torcx", "roles")
+}
+
+// VendorPoliciesDir is the vendor apply policies path
+func VendorPoliciesDir(usrMountpoint string) string {
+	if usrMountpoint == "" {
+		usrMountpoint = VendorUsrDir
+	}
+	return filepath.Join(usrMountpoint, "share", "torcx", "policies")
+}
+
 // VendorStoreDir is the vendor store path
 func VendorStoreDir(usrMountpoint string) string {
 	if usrMountpoint == "" {
@@ -61,11 +97,29 @@ func VendorStoreDir(usrMountpoint string) string {
 	return filepath.Join(usrMountpoint, "share", "torcx", "store")
 }
 
+// VendorTrustedKeysDir is the vendor trusted keys path
+func VendorTrustedKeysDir(usrMountpoint string) string {
+	if usrMountpoint == "" {
+		usrMountpoint = VendorUsrDir
+	}
+	return filepath.Join(usrMountpoint, "share", "torcx", "trusted-keys.d")
+}
+
 // RunUnpackDir is the directory where root filesystems are unpacked.
 func (cc *CommonConfig) RunUnpackDir() string {
 	return filepath.Join(cc.RunDir, "unpack")
 }
 
+// RunImagesDir is the directory holding stable per-image symlinks.
+func (cc *CommonConfig) RunImagesDir() string {
+	return filepath.Join(cc.RunDir, "images")
+}
+
+// RunStoresDir is the directory where store images are mounted.
+func (cc *CommonConfig) RunStoresDir() string {
+	return filepath.Join(cc.RunDir, "stores")
+}
+
 // RunBinDir is the directory where binaries are symlinked.
 func (cc *CommonConfig) RunBinDir() string {
 	return filepath.Join(cc.RunDir, "bin")
@@ -80,11 +134,100 @@ func (cc *CommonConfig) ProfileDirs() []string {
 	}
 }
 
+// RoleDirs are the directories where roles are looked up, in increasing
+// order of precedence.
+func (cc *CommonConfig) RoleDirs() []string {
+	return []string{
+		VendorRolesDir(cc.UsrDir),
+		OemRolesDir,
+		filepath.Join(cc.ConfDir, "roles"),
+	}
+}
+
+// PolicyDirs are the directories where apply policies are looked up, in
+// increasing order of precedence.
+func (cc *CommonConfig) PolicyDirs() []string {
+	return []string{
+		VendorPoliciesDir(cc.UsrDir),
+		OemPoliciesDir,
+		filepath.Join(cc.ConfDir, "policies"),
+	}
+}
+
 // RunProfile is the file where we copy the contents of the applied profile.
 func (cc *CommonConfig) RunProfile() string {
 	return filepath.Join(cc.RunDir, "profile.json")
 }
 
+// RunTiming is the file where the resources consumed to unpack images are recorded.
+func (cc *CommonConfig) RunTiming() string {
+	return filepath.Join(cc.RunDir, "timing.json")
+}
+
+// RunConsistency is the file where drift found by state verification is recorded.
+func (cc *CommonConfig) RunConsistency() string {
+	return filepath.Join(cc.RunDir, "consistency.json")
+}
+
+// RunErrorReports is the file where repeated errors of periodic runs are
+// aggregated, to rate-limit their reporting.
+func (cc *CommonConfig) RunErrorReports() string {
+	return filepath.Join(cc.RunDir, "error-reports.json")
+}
+
+// RemoteContentsCacheDir is the directory where verified remote contents
+// manifests are cached.
+func (cc *CommonConfig) RemoteContentsCacheDir() string {
+	return filepath.Join(cc.BaseDir, "remote-contents")
+}
+
+// FetchAuditLog is the append-only log of archives fetched from remotes.
+func (cc *CommonConfig) FetchAuditLog() string {
+	return filepath.Join(cc.BaseDir, "fetch-audit.log")
+}
+
+// NotifyState records the generation of the last summary accepted by the
+// notify endpoint.
+func (cc *CommonConfig) NotifyState() string {
+	return filepath.Join(cc.BaseDir, "notify-state.json")
+}
+
+// HashTreeCacheDir is the directory where the chunk hashes of squashfs
+// archives verified in full are cached, for sampled re-checks.
+func (cc *CommonConfig) HashTreeCacheDir() string {
+	return filepath.Join(cc.BaseDir, "hash-trees")
+}
+
+// OverlaysDir is the directory holding the writable layers of image overlays.
+func (cc *CommonConfig) OverlaysDir() string {
+	return filepath.Join(cc.BaseDir, "overlays")
+}
+
+// GoodProfile is the file recording the last profile which passed health checks.
+func (cc *CommonConfig) GoodProfile() string {
+	return filepath.Join(cc.BaseDir, "good-profile.json")
+}
+
+// RunWarnings is the file where warnings collected at apply time are recorded.
+func (cc *CommonConfig) RunWarnings() string {
+	return filepath.Join(cc.RunDir, "warnings.json")
+}
+
+// RunStagingDir is where StageProfile unpacks images ahead of the apply.
+func (cc *CommonConfig) RunStagingDir() string {
+	return filepath.Clean(cc.RunDir) + "-staging"
+}
+
+// RunDevDir holds the writable scratch of images edited in place by DevEdit.
+func (cc *CommonConfig) RunDevDir() string {
+	return filepath.Join(cc.RunDir, "dev")
+}
+
+// StagedApplyPath is the record of the images unpacked by StageProfile.
+func (cc *CommonConfig) StagedApplyPath() string {
+	return filepath.Join(cc.RunStagingDir(), "staged.json")
+}
+
 // UserStorePath is the path where user-fetched archives are written.
 // An optional target version can be specified for versioned user store.
 func (cc *CommonConfig) UserStorePath(version string) string {
@@ -105,6 +248,16 @@ func (cc *CommonConfig) NextProfile() string {
 	return filepath.Join(cc.ConfDir, "next-profile")
 }
 
+// ApprovedPlan is the apply plan which the next apply must match exactly.
+func (cc *CommonConfig) ApprovedPlan() string {
+	return filepath.Join(cc.ConfDir, "approved-plan.json")
+}
+
+// NodeProfiles is the path for the per-node profile overrides configuration file.
+func (cc *CommonConfig) NodeProfiles() string {
+	return filepath.Join(cc.ConfDir, "node-profiles.json")
+}
+
 // RemotesDirs returns the list of directories where we look for remotes manifests.
 func (cc *CommonConfig) RemotesDirs() []string {
 	dirs := []string{}
@@ -118,6 +271,16 @@ func (cc *CommonConfig) RemotesDirs() []string {
 	return dirs
 }
 
+// TrustedKeysDirs returns the list of directories forming the machine
+// trust store for image signatures.
+func (cc *CommonConfig) TrustedKeysDirs() []string {
+	return []string{
+		VendorTrustedKeysDir(cc.UsrDir),
+		OemTrustedKeysDir,
+		filepath.Join(cc.ConfDir, "trusted-keys.d"),
+	}
+}
+
 // VendorOsReleasePath returns the path to vendor os-release file
 // for the specific OS partition mounted at `usrMountpoint`.
 func VendorOsReleasePath(usrMountpoint string) string {
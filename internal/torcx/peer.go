@@ -0,0 +1,159 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// peerArchivesPath is the URL path prefix under which peers serve archives.
+	peerArchivesPath = "/archives/"
+	// peerTimeout bounds a whole archive transfer from a single peer.
+	peerTimeout = 2 * time.Minute
+)
+
+// PeerHandler serves verified archives from local stores to LAN peers.
+// Archives are addressed by their verified hash, as
+// `/archives/<hash>/<archive-file-name>`. Only archives with a recorded
+// hash (i.e. fetched and verified from a remote) are served.
+type PeerHandler struct {
+	StorePaths []string
+}
+
+// NewPeerHandler returns an HTTP handler serving archives from `storePaths`.
+func NewPeerHandler(storePaths []string) *PeerHandler {
+	return &PeerHandler{
+		StorePaths: storePaths,
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (ph *PeerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hash, fileName, err := parsePeerPath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	archivePath := ph.lookup(hash, fileName)
+	if archivePath == "" {
+		http.NotFound(w, r)
+		return
+	}
+	fp, err := os.Open(archivePath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		http.Error(w, "failed to stat archive", http.StatusInternalServerError)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"path": archivePath,
+		"peer": r.RemoteAddr,
+	}).Debug("serving archive to peer")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, fileName, fi.ModTime(), fp)
+}
+
+// lookup returns the path of a stored archive named `fileName` whose
+// recorded hash matches `hash`, or an empty string if none is found.
+func (ph *PeerHandler) lookup(hash string, fileName string) string {
+	for _, dir := range ph.StorePaths {
+		archivePath := filepath.Join(dir, fileName)
+		recorded, err := readHashSidecar(archivePath)
+		if err != nil || recorded != hash {
+			continue
+		}
+		if IsExistingPath(archivePath) {
+			return archivePath
+		}
+	}
+	return ""
+}
+
+// parsePeerPath splits a peer archive URL path into hash and file name.
+func parsePeerPath(urlPath string) (string, string, error) {
+	if !strings.HasPrefix(urlPath, peerArchivesPath) {
+		return "", "", errors.Errorf("unknown path %q", urlPath)
+	}
+	parts := strings.Split(strings.TrimPrefix(urlPath, peerArchivesPath), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("invalid archive path %q", urlPath)
+	}
+	fileName := parts[1]
+	if archiveFormatOf(fileName) == ArchiveFormatUnknown {
+		return "", "", errors.Errorf("invalid extension for image archive %s", fileName)
+	}
+	return parts[0], fileName, nil
+}
+
+// fetchFromPeers tries to download an archive from LAN peers, in order,
+// before falling back to the upstream remote. Peers are not trusted: the
+// archive is only kept if it matches the expected hash.
+func (rc *RemotesCache) fetchFromPeers(ctx context.Context, im Image, client *http.Client, peers []string, location *url.URL, baseDir string, hash string, size int64) error {
+	fileName := path.Base(location.String())
+	peerLocation := &url.URL{
+		Path: strings.TrimPrefix(peerArchivesPath, "/") + hash + "/" + fileName,
+	}
+
+	err := errors.New("no peers available")
+	for _, peer := range peers {
+		if !strings.HasSuffix(peer, "/") {
+			peer = peer + "/"
+		}
+		peerURL, perr := url.Parse(peer)
+		if perr != nil {
+			err = errors.Wrapf(perr, "invalid peer URL %q", peer)
+			continue
+		}
+
+		peerCtx, cancel := context.WithTimeout(ctx, peerTimeout)
+		err = rc.downloadArchive(peerCtx, im, client, peerURL, peerLocation, baseDir, hash, size)
+		cancel()
+		if err == nil {
+			logrus.WithFields(logrus.Fields{
+				"peer": peer,
+				"path": filepath.Join(baseDir, fileName),
+			}).Info("image archive fetched from peer")
+			return nil
+		}
+		logrus.WithFields(logrus.Fields{
+			"peer":  peer,
+			"error": err,
+		}).Debug("failed to fetch from peer")
+	}
+
+	return err
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPeerFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_peer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	peerStore := filepath.Join(dir, "peer")
+	localStore := filepath.Join(dir, "local")
+	for _, d := range []string{peerStore, localStore} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content := []byte("archive content")
+	hash := fmt.Sprintf("sha512-%x", sha512.Sum512(content))
+	fileName := "foo:1.torcx.tgz"
+	if err := ioutil.WriteFile(filepath.Join(peerStore, fileName), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// An unverified archive is not served.
+	if err := ioutil.WriteFile(filepath.Join(peerStore, "bar:1.torcx.tgz"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeHashSidecar(filepath.Join(peerStore, fileName), hash); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(NewPeerHandler([]string{peerStore}))
+	defer srv.Close()
+
+	rc := &RemotesCache{}
+	client := (&Remote{}).httpClient()
+	ctx := context.Background()
+
+	location := &url.URL{Path: "bar:1.torcx.tgz"}
+	if err := rc.fetchFromPeers(ctx, Image{}, client, []string{srv.URL}, location, localStore, hash, 0); err == nil {
+		t.Fatal("expected error fetching unverified archive")
+	}
+
+	location = &url.URL{Path: fileName}
+	if err := rc.fetchFromPeers(ctx, Image{}, client, []string{"http://127.0.0.1:1", srv.URL}, location, localStore, hash, 0); err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(localStore, fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(content) {
+		t.Fatalf("expected %q, got %q", content, got)
+	}
+	if recorded, err := readHashSidecar(filepath.Join(localStore, fileName)); err != nil || recorded != hash {
+		t.Fatalf("unexpected recorded hash %q: %v", recorded, err)
+	}
+}
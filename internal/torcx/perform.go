@@ -17,15 +17,14 @@ package torcx
 import (
 	"archive/tar"
 	"bufio"
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/flatcar-linux/torcx/internal/third_party/docker/pkg/loopback"
 	pkgtar "github.com/flatcar-linux/torcx/pkg/tar"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -44,6 +43,8 @@ var (
 //    this includes symlinking binaries into BinDir and installing systemd
 //    transient units.
 //  * seal: system state is frozen, profile and metadata written to RunDir
+// When committing a staged apply, the unpack phase has already been run
+// by StageProfile, see CommitProfile.
 func ApplyProfile(applyCfg *ApplyConfig) error {
 	var err error
 	if applyCfg == nil {
@@ -55,158 +56,365 @@ func ApplyProfile(applyCfg *ApplyConfig) error {
 		return errors.Wrap(err, "profile setup")
 	}
 
+	defer applyCfg.saveWarnings()
+	defer applyCfg.saveTimings()
+
+	if err := applyCfg.startBudget(time.Now()); err != nil {
+		return err
+	}
+
+	mountStoreImages(applyCfg)
+	unlockUserStore(applyCfg)
+
+	if err := executeApprovedPlan(applyCfg); err != nil {
+		applyCfg.applyObserver().ApplyFinished(nil, err)
+		return err
+	}
+	if err := enforcePolicies(applyCfg, nil); err != nil {
+		applyCfg.applyObserver().ApplyFinished(nil, err)
+		return err
+	}
+
 	images, err := mergeProfiles(applyCfg)
 	if err != nil {
+		applyCfg.applyObserver().ApplyFinished(nil, err)
 		return err
 	}
+	applyCfg.applyObserver().ApplyStarted(images)
 	if len(images) > 0 {
-		if err := applyImages(applyCfg, images); err != nil {
+		images, err = applyImages(applyCfg, images)
+		if err != nil {
+			applyCfg.applyObserver().ApplyFinished(images, err)
 			return err
 		}
 	}
+	applyCfg.applyObserver().ApplyFinished(images, nil)
+
+	if err := writeRunProfile(applyCfg.RunProfile(), images); err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"upper profile":  applyCfg.UpperProfile,
+		"sealed profile": applyCfg.RunProfile(),
+	}).Debug("profile applied")
+	return nil
+}
 
+// writeRunProfile writes the list of applied images as a read-only
+// profile at `path`.
+func writeRunProfile(path string, images []Image) error {
 	runProfile := ProfileManifestV0JSON{
 		Kind:  ProfileManifestV0K,
 		Value: ImagesToJSONV0(images),
 	}
-	rpp, err := os.Create(applyCfg.RunProfile())
+	rpp, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer rpp.Close()
 	bufwr := bufio.NewWriter(rpp)
-	defer bufwr.Flush()
 	enc := json.NewEncoder(bufwr)
 	enc.SetIndent("", "  ")
 	if err := enc.Encode(runProfile); err != nil {
-		return errors.Wrapf(err, "writing %q", applyCfg.RunProfile())
+		return errors.Wrapf(err, "writing %q", path)
 	}
-
-	err = os.Chmod(applyCfg.RunProfile(), 0444)
-	if err != nil {
-		return err
+	if err := bufwr.Flush(); err != nil {
+		return errors.Wrapf(err, "writing %q", path)
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"upper profile":  applyCfg.UpperProfile,
-		"sealed profile": applyCfg.RunProfile(),
-	}).Debug("profile applied")
-	return nil
+	return os.Chmod(path, 0444)
 }
 
 // applyImages unpacks and propagates assets from a list of images.
-func applyImages(applyCfg *ApplyConfig, images []Image) error {
+// Profile fragments shipped inside images are resolved recursively, and
+// the full list of applied images is returned.
+func applyImages(applyCfg *ApplyConfig, images []Image) ([]Image, error) {
 	if applyCfg == nil {
-		return errors.New("missing apply configuration")
+		return nil, errors.New("missing apply configuration")
 	}
 
 	storeCache, err := NewStoreCache(applyCfg.StorePaths)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Unpack all images, continuing on error
-	failedImages := []Image{}
+	for _, ar := range storeCache.Shadowed {
+		shadowed := ar.Image
+		applyCfg.warn(Warning{
+			Kind:    WarningShadowedArchive,
+			Message: "archive shadowed by another archive for the same image",
+			Image:   &shadowed,
+			Path:    ar.Filepath,
+		})
+	}
 
 	for _, im := range images {
-		// Some log fields we keep using
-		logFields := logrus.Fields{
-			"image":     im.Name,
-			"reference": im.Reference,
+		if im.BootCritical {
+			applyCfg.BootCritical = append(applyCfg.BootCritical, im)
 		}
+	}
 
-		archive, err := storeCache.ArchiveFor(im)
+	return resolveImages(images, func(im Image) (Image, []Image, error) {
+		observer := applyCfg.applyObserver()
+		observer.ImageStarted(im)
+		if err := checkDeadline(applyCfg.imageDeadline(im, time.Now())); err != nil {
+			err = errors.Wrap(err, "apply deadline reached")
+			observer.ImageFailed(im, err)
+			applyCfg.warnDropped(im, err)
+			return im, nil, err
+		}
+		resolved, err := resolveImageVersion(&storeCache, im)
 		if err != nil {
-			logrus.WithFields(logFields).Error(err)
-			failedImages = append(failedImages, im)
-			continue
+			observer.ImageFailed(im, err)
+			applyCfg.warnSkipped(im, err)
+			return im, nil, err
 		}
+		applied, err := applyImage(applyCfg, &storeCache, resolved)
+		if err != nil {
+			observer.ImageFailed(resolved, err)
+			if errors.Cause(err) == ErrBudgetExceeded {
+				applyCfg.warnDropped(resolved, err)
+			} else {
+				applyCfg.warnSkipped(resolved, err)
+			}
+			return resolved, nil, err
+		}
+		applied.Requested = im.Reference
+		applyCfg.AppliedImages = append(applyCfg.AppliedImages, applied)
+		resolved.Provides = applied.Provides
+		fragment, err := readImageFragment(applied.Root)
+		return resolved, applyCfg.FilterRecommends(fragment), err
+	})
+}
 
-		var imageRoot string
-		switch archive.Format {
-		case ArchiveFormatTgz:
-			imageRoot, err = unpackTgz(applyCfg, archive.Filepath, im.Name)
-		case ArchiveFormatSquashfs:
-			imageRoot, err = mountSquashfs(applyCfg, archive.Filepath, im.Name)
-		default:
-			err = fmt.Errorf("unrecognized format for archive: %q", archive)
+// applyImage unpacks and propagates assets from a single image,
+// returning where and from which archive it has been unpacked.
+func applyImage(applyCfg *ApplyConfig, storeCache *StoreCache, im Image) (AppliedImage, error) {
+	// Some log fields we keep using
+	logFields := logrus.Fields{
+		"image":     im.Name,
+		"reference": im.Reference,
+	}
+	deadline := applyCfg.imageDeadline(im, time.Now())
+
+	located, archive, err := locateImage(applyCfg, storeCache, im)
+	if err != nil {
+		return AppliedImage{}, err
+	}
+	if located.Reference != im.Reference {
+		logFields["target"] = located.Reference
+	}
+	im = located
+
+	imageRoot, staged, err := applyCfg.stagedRoot(im, archive)
+	if err != nil {
+		logrus.WithFields(logFields).Error(err)
+		return AppliedImage{}, err
+	}
+	if staged {
+		logrus.WithFields(logFields).WithField("path", imageRoot).Debug("staged image reused")
+	} else if archive, imageRoot, err = unpackImage(applyCfg, im, archive, deadline); err != nil {
+		return AppliedImage{}, err
+	}
+	logFields["path"] = imageRoot
+
+	assets, err := retrieveAssets(applyCfg, imageRoot)
+	if err != nil {
+		logrus.WithFields(logFields).Error("failed retrieving assets from image: ", err)
+		return AppliedImage{}, err
+	}
+	im.Provides = strings.Join(assets.Provides, " ")
+	if assets, err = propagatedAssets(im, assets); err != nil {
+		logrus.WithFields(logFields).Error("refusing image: ", err)
+		return AppliedImage{}, err
+	}
+
+	if applyCfg.RequireIMASignatures && imaAppraisalEnforced() {
+		if err := checkIMASignatures(imageRoot, assets.Binaries); err != nil {
+			logrus.WithFields(logFields).Error("refusing image: ", err)
+			return AppliedImage{}, err
 		}
-		if err != nil {
-			failedImages = append(failedImages, im)
-			logrus.WithFields(logFields).Error("failed to unpack: ", err)
-			continue
+		logrus.WithFields(logFields).Debug("IMA signatures checked")
+	}
+
+	if len(assets.FileContexts) > 0 && !applyCfg.simulated() {
+		if err := applyFileContexts(applyCfg, imageRoot, assets.FileContexts); err != nil {
+			logrus.WithFields(logFields).Error("failed to apply file contexts: ", err)
+			return AppliedImage{}, err
 		}
-		logFields["path"] = imageRoot
-		logrus.WithFields(logFields).Debug("image unpacked")
+		logrus.WithFields(logFields).WithField("contexts", len(assets.FileContexts)).Debug("file contexts applied")
+	}
 
-		assets, err := retrieveAssets(applyCfg, imageRoot)
-		if err != nil {
-			failedImages = append(failedImages, im)
-			logrus.WithFields(logFields).Error("failed retrieving assets from image: ", err)
-			continue
+	if len(assets.Writable) > 0 && !applyCfg.simulated() {
+		if err := mountWritableOverlays(applyCfg, im, imageRoot, assets.Writable); err != nil {
+			logrus.WithFields(logFields).Error("failed to mount writable overlays: ", err)
+			return AppliedImage{}, err
 		}
+		logrus.WithFields(logFields).WithField("overlays", len(assets.Writable)).Debug("writable overlays mounted")
+	}
 
-		if len(assets.Binaries) > 0 {
-			if err := propagateBins(applyCfg, imageRoot, assets.Binaries); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.Binaries).Error("failed to propagate binaries: ", err)
-				continue
-			}
-			logrus.WithFields(logFields).WithField("assets", assets.Binaries).Debug("binaries propagated")
+	if len(assets.Binaries) > 0 {
+		if err := propagateBins(applyCfg, imageRoot, assets.Binaries); err != nil {
+			logrus.WithFields(logFields).WithField("assets", assets.Binaries).Error("failed to propagate binaries: ", err)
+			return AppliedImage{}, err
 		}
+		logrus.WithFields(logFields).WithField("assets", assets.Binaries).Debug("binaries propagated")
+	}
 
-		if len(assets.Network) > 0 {
-			if err := propagateNetworkdUnits(applyCfg, imageRoot, assets.Network); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.Network).Error("failed to propagate networkd units: ", err)
-				continue
-			}
+	if len(assets.Network) > 0 {
+		if err := propagateNetworkdUnits(applyCfg, imageRoot, assets.Network); err != nil {
+			logrus.WithFields(logFields).WithField("assets", assets.Network).Error("failed to propagate networkd units: ", err)
+			return AppliedImage{}, err
+		}
 
-			logrus.WithFields(logFields).WithField("assets", assets.Network).Debug("networkd units propagated")
+		logrus.WithFields(logFields).WithField("assets", assets.Network).Debug("networkd units propagated")
+	}
+
+	if len(assets.Units) > 0 {
+		if err := propagateSystemdUnits(applyCfg, imageRoot, assets.Units); err != nil {
+			logrus.WithFields(logFields).WithField("assets", assets.Units).Error("failed to propagate systemd units: ", err)
+			return AppliedImage{}, err
 		}
+		logrus.WithFields(logFields).WithField("assets", assets.Units).Debug("systemd units propagated")
+	}
 
-		if len(assets.Units) > 0 {
-			if err := propagateSystemdUnits(applyCfg, imageRoot, assets.Units); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.Units).Error("failed to propagate systemd units: ", err)
-				continue
-			}
-			logrus.WithFields(logFields).WithField("assets", assets.Units).Debug("systemd units propagated")
+	if enable := im.EnabledUnits(); len(enable) > 0 {
+		if err := enableSystemdUnits(applyCfg, enable); err != nil {
+			logrus.WithFields(logFields).WithField("units", enable).Error("failed to enable systemd units: ", err)
+			return AppliedImage{}, err
 		}
+		logrus.WithFields(logFields).WithField("units", enable).Debug("systemd units enabled")
+	}
 
-		if len(assets.Sysusers) > 0 {
-			if err := propagateSysusersUnits(applyCfg, imageRoot, assets.Sysusers); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.Sysusers).Error("failed to propagate sysusers: ", err)
-				continue
-			}
-			logrus.WithFields(logFields).WithField("assets", assets.Sysusers).Debug("sysusers propagated")
+	if len(assets.Sysusers) > 0 {
+		if err := propagateSysusersUnits(applyCfg, imageRoot, assets.Sysusers); err != nil {
+			logrus.WithFields(logFields).WithField("assets", assets.Sysusers).Error("failed to propagate sysusers: ", err)
+			return AppliedImage{}, err
 		}
+		logrus.WithFields(logFields).WithField("assets", assets.Sysusers).Debug("sysusers propagated")
+	}
 
-		if len(assets.Tmpfiles) > 0 {
-			if err := propagateTmpfilesUnits(applyCfg, imageRoot, assets.Tmpfiles); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.Units).Error("failed to propagate tmpfiles: ", err)
-				continue
-			}
-			logrus.WithFields(logFields).WithField("assets", assets.Units).Debug("tmpfiles propagated")
+	if len(assets.Tmpfiles) > 0 {
+		if err := propagateTmpfilesUnits(applyCfg, imageRoot, assets.Tmpfiles); err != nil {
+			logrus.WithFields(logFields).WithField("assets", assets.Units).Error("failed to propagate tmpfiles: ", err)
+			return AppliedImage{}, err
 		}
+		logrus.WithFields(logFields).WithField("assets", assets.Units).Debug("tmpfiles propagated")
+	}
 
-		if len(assets.UdevRules) > 0 {
-			if err := propagateUdevRules(applyCfg, imageRoot, assets.UdevRules); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.UdevRules).Error("failed to propagate udev rules: ", err)
-				continue
-			}
-			logrus.WithFields(logFields).WithField("assets", assets.UdevRules).Debug("udev rules propagated")
+	if len(assets.UdevRules) > 0 {
+		if err := propagateUdevRules(applyCfg, imageRoot, assets.UdevRules); err != nil {
+			logrus.WithFields(logFields).WithField("assets", assets.UdevRules).Error("failed to propagate udev rules: ", err)
+			return AppliedImage{}, err
 		}
+		logrus.WithFields(logFields).WithField("assets", assets.UdevRules).Debug("udev rules propagated")
 	}
 
-	if len(failedImages) > 0 {
-		return fmt.Errorf("failed to install %d images", len(failedImages))
+	applyCfg.applyObserver().ImageApplied(im, *assets)
+	return AppliedImage{
+		Image:   im,
+		Archive: archive.Filepath,
+		Digest:  archiveDigest(archive),
+		Root:    imageRoot,
+		Checks:  assets.Checks,
+	}, nil
+}
+
+// locateImage returns the archive for `im`, resolving image aliases.
+// The returned image references the alias target, if any.
+func locateImage(applyCfg *ApplyConfig, storeCache *StoreCache, im Image) (Image, Archive, error) {
+	logFields := logrus.Fields{
+		"image":     im.Name,
+		"reference": im.Reference,
 	}
 
-	return nil
+	archive, err := storeCache.ArchiveFor(im)
+	if err != nil {
+		logrus.WithFields(logFields).Error(err)
+		return im, Archive{}, err
+	}
+	if target, ok := resolveAlias(archive); ok {
+		applyCfg.recordAlias(ImageAlias{im, target.Reference})
+		logFields["target"] = target.Reference
+		logrus.WithFields(logFields).Debug("alias resolved")
+		archive = target
+		im.Reference = target.Reference
+	}
+	applyCfg.applyObserver().ImageLocated(im, archive)
+	return im, archive, nil
+}
+
+// unpackImage verifies `archive` and unpacks (or mounts) it under the
+// unpack directory, returning the (possibly healed) archive and the
+// image root. Assets are not propagated.
+func unpackImage(applyCfg *ApplyConfig, im Image, archive Archive, deadline time.Time) (Archive, string, error) {
+	logFields := logrus.Fields{
+		"image":     im.Name,
+		"reference": im.Reference,
+	}
+
+	if err := verifyArchiveWith(archive, applyCfg.squashfsCheck(false)); err != nil {
+		if archive, err = healArchive(applyCfg, im, archive); err != nil {
+			logrus.WithFields(logFields).Error("failed to heal corrupted archive: ", err)
+			return archive, "", err
+		}
+	}
+	if err := enforceSignaturePolicy(&applyCfg.CommonConfig, archive); err != nil {
+		logrus.WithFields(logFields).Error("refusing image: ", err)
+		quarantineRejected(applyCfg, archive, err)
+		return archive, "", err
+	}
+	applyCfg.applyObserver().ImageVerified(im, archive)
+
+	var tmpfsSize int64
+	if archive.Format.isTarball() && !applyCfg.simulated() {
+		var err error
+		if tmpfsSize, err = imageTmpfsSize(applyCfg, im, archive); err != nil {
+			logrus.WithFields(logFields).Error("refusing image: ", err)
+			return archive, "", err
+		}
+	}
+
+	var imageRoot string
+	err := applyCfg.accountUnpack(im, archive.Format, func() (err error) {
+		switch archive.Format {
+		case ArchiveFormatTgz, ArchiveFormatZst, ArchiveFormatTxz:
+			if applyCfg.simulated() {
+				imageRoot, err = unpackTgzUser(applyCfg, archive.Filepath, imagePathName(im.Name), deadline)
+			} else if tmpfsSize > 0 {
+				imageRoot, err = unpackTgzCapped(applyCfg, archive.Filepath, imagePathName(im.Name), tmpfsSize, deadline)
+			} else {
+				imageRoot, err = unpackTgz(applyCfg, archive.Filepath, imagePathName(im.Name), deadline)
+			}
+		case ArchiveFormatSquashfs, ArchiveFormatErofs:
+			imageRoot, err = mountFilesystemImage(applyCfg, archive.Filepath, archive.Format, imagePathName(im.Name))
+		default:
+			err = fmt.Errorf("unrecognized format for archive: %q", archive.Filepath)
+		}
+		return err
+	})
+	if err == nil && tmpfsSize > 0 {
+		applyCfg.recordTmpfsUsage(im, imageRoot, tmpfsSize)
+	}
+	if err == nil {
+		// Assets are not propagated yet, so the image can still be dropped.
+		if err = checkDeadline(deadline); err != nil {
+			discardUnpacked(applyCfg, archive.Format, imageRoot)
+		}
+	}
+	if err != nil {
+		if errors.Cause(err) == ErrBudgetExceeded {
+			logrus.WithFields(logFields).Warn("image dropped: ", err)
+			return archive, "", err
+		}
+		logrus.WithFields(logFields).Error("failed to unpack: ", err)
+		return archive, "", err
+	}
+	logFields["path"] = imageRoot
+	logrus.WithFields(logFields).Debug("image unpacked")
+	applyCfg.applyObserver().ImageUnpacked(im, imageRoot)
+	return archive, imageRoot, nil
 }
 
 // SealSystemState is a one-time-op which seals the current state of the system,
@@ -216,14 +424,23 @@ func SealSystemState(applyCfg *ApplyConfig) error {
 		return errors.New("missing apply configuration")
 	}
 
-	dirname := filepath.Dir(SealPath)
+	sealPath := applyCfg.systemPath(SealPath)
+	err := sealSystemState(applyCfg, sealPath)
+	applyCfg.applyObserver().SystemSealed(sealPath, err)
+	return err
+}
+
+// sealSystemState writes the seal at `sealPath`, exports applied images
+// and freezes the unpack directory.
+func sealSystemState(applyCfg *ApplyConfig, sealPath string) error {
+	dirname := filepath.Dir(sealPath)
 	if _, err := os.Stat(dirname); err != nil && os.IsNotExist(err) {
 		if err := os.MkdirAll(dirname, 0755); err != nil {
 			return err
 		}
 	}
 
-	fp, err := os.Create(SealPath)
+	fp, err := os.Create(sealPath)
 	if err != nil {
 		return err
 	}
@@ -235,6 +452,8 @@ func SealSystemState(applyCfg *ApplyConfig) error {
 		fmt.Sprintf("%s=%q", SealRunProfilePath, applyCfg.RunProfile()),
 		fmt.Sprintf("%s=%q", SealBindir, applyCfg.RunBinDir()),
 		fmt.Sprintf("%s=%q", SealUnpackdir, applyCfg.RunUnpackDir()),
+		fmt.Sprintf("%s=%q", SealImageAliases, sealAliases(applyCfg.ResolvedAliases)),
+		fmt.Sprintf("%s=%q", SealOsVersionID, sealOsVersionID(applyCfg.UsrDir)),
 	}
 
 	for _, line := range content {
@@ -244,15 +463,25 @@ func SealSystemState(applyCfg *ApplyConfig) error {
 		}
 	}
 
+	if err := writeImageEnvFiles(dirname, applyCfg.AppliedImages); err != nil {
+		return err
+	}
+	if err := linkImageRoots(applyCfg.RunImagesDir(), applyCfg.AppliedImages); err != nil {
+		return err
+	}
+
 	// Remount the unpackdir RO
-	if err := unix.Mount(applyCfg.RunUnpackDir(), applyCfg.RunUnpackDir(),
+	if err := applyCfg.mounter().Mount(applyCfg.RunUnpackDir(), applyCfg.RunUnpackDir(),
 		"", unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
 
 		return errors.Wrap(err, "failed to remount read-only")
 	}
+	if err := remountImageTmpfs(applyCfg); err != nil {
+		return err
+	}
 
 	logrus.WithFields(logrus.Fields{
-		"path":    SealPath,
+		"path":    sealPath,
 		"content": content,
 	}).Debug("system state sealed")
 
@@ -282,9 +511,18 @@ func setupPaths(applyCfg *ApplyConfig) error {
 		}
 	}
 
+	// Staged images are moved in place at once, along with their mounts.
+	if applyCfg.staged != nil {
+		if err := applyCfg.mounter().Mount(applyCfg.stagedUnpackDir(), applyCfg.RunUnpackDir(), "", unix.MS_MOVE, ""); err != nil {
+			return errors.Wrap(err, "failed to move staged unpack dir")
+		}
+		logrus.WithField("target", applyCfg.RunUnpackDir()).Debug("moved staged unpack dir")
+		return nil
+	}
+
 	// Now, mount a tmpfs directory to the unpack directory.
 	// We need to do this because "/run" is typically marked "noexec".
-	if err := unix.Mount("none", applyCfg.RunUnpackDir(), "tmpfs", 0, "size=450M"); err != nil {
+	if err := applyCfg.mounter().Mount("none", applyCfg.RunUnpackDir(), "tmpfs", 0, "size=450M"); err != nil {
 		return errors.Wrap(err, "failed to mount unpack dir")
 	}
 
@@ -297,8 +535,10 @@ func setupPaths(applyCfg *ApplyConfig) error {
 	return nil
 }
 
-// unpackTgz renders a tgz rootfs, returning the target top directory.
-func unpackTgz(applyCfg *ApplyConfig, tgzPath, imageName string) (string, error) {
+// unpackTgz renders a tarball (tgz, zst or txz) rootfs, returning the target top directory.
+// Files unchanged since a previous unpack of the image are reused.
+// Unpacking is aborted, and the partial tree removed, once `deadline` (if set) has passed.
+func unpackTgz(applyCfg *ApplyConfig, tgzPath, imageName string, deadline time.Time) (string, error) {
 	if applyCfg == nil {
 		return "", errors.New("missing apply configuration")
 	}
@@ -308,37 +548,21 @@ func unpackTgz(applyCfg *ApplyConfig, tgzPath, imageName string) (string, error)
 	}
 
 	topDir := filepath.Join(applyCfg.RunUnpackDir(), imageName)
-	if _, err := os.Stat(topDir); err != nil && os.IsNotExist(err) {
-		if err := os.MkdirAll(topDir, 0755); err != nil {
-			return "", err
-		}
-	}
-
-	fp, err := os.Open(tgzPath)
-	if err != nil {
-		return "", errors.Wrapf(err, "opening %q", tgzPath)
-	}
-	defer fp.Close()
-
-	gr, err := gzip.NewReader(fp)
-	if err != nil {
-		return "", err
-	}
-	defer gr.Close()
-
-	tr := tar.NewReader(gr)
 	untarCfg := pkgtar.ExtractCfg{}.Default()
 	untarCfg.XattrPrivileged = true
-	err = pkgtar.ChrootUntar(tr, topDir, untarCfg)
+	err := extractTgz(tgzPath, topDir, deadline, func(tr *tar.Reader) error {
+		return pkgtar.ChrootUntar(tr, topDir, untarCfg)
+	})
 	if err != nil {
-		return "", errors.Wrapf(err, "unpacking %q", tgzPath)
+		return "", err
 	}
 
 	return topDir, nil
 }
 
-// mountSquashfs mounts a squashfs rootfs, returning the mounted directory.
-func mountSquashfs(applyCfg *ApplyConfig, archivePath, imageName string) (string, error) {
+// mountFilesystemImage mounts a squashfs or erofs rootfs, returning the
+// mounted directory.
+func mountFilesystemImage(applyCfg *ApplyConfig, archivePath string, format ArchiveFormat, imageName string) (string, error) {
 	if applyCfg == nil {
 		return "", errors.New("missing apply configuration")
 	}
@@ -354,13 +578,15 @@ func mountSquashfs(applyCfg *ApplyConfig, archivePath, imageName string) (string
 		}
 	}
 
-	loopDev, err := loopback.AttachLoopDevice(archivePath)
-	if err != nil {
-		return "", err
+	// A previous tgz unpack of the image is not reusable anymore.
+	_ = os.Remove(unpackSidePath(topDir, unpackIndexSuffix))
+	var err error
+	if format == ArchiveFormatErofs {
+		err = applyCfg.mounter().MountLoop(archivePath, topDir, ArchiveFormatErofs)
+	} else {
+		err = applyCfg.mounter().MountSquashfs(archivePath, topDir)
 	}
-	defer loopDev.Close()
-
-	if err := unix.Mount(loopDev.Name(), topDir, "squashfs", unix.MS_RDONLY, ""); err != nil {
+	if err != nil {
 		return "", err
 	}
 
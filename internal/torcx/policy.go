@@ -0,0 +1,502 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// PolicyV0K - apply policy manifest kind, v0
+	PolicyV0K = "torcx-policy-v0"
+
+	// PolicyModeEnforce blocks the apply on violations.
+	PolicyModeEnforce = "enforce"
+	// PolicyModeWarn only records violations as warnings.
+	PolicyModeWarn = "warn"
+
+	// policyCommandTimeout bounds each policy command invocation.
+	policyCommandTimeout = 30 * time.Second
+)
+
+// ErrPolicyViolation is returned when the profile to apply violates an
+// enforced policy.
+var ErrPolicyViolation = errors.New("profile violates policy")
+
+// Policy is a set of rules the profile about to be applied must satisfy.
+type Policy struct {
+	// Mode is the default mode of the rules and commands of this policy.
+	Mode string `json:"mode,omitempty"`
+	// Rules are the built-in rules of this policy.
+	Rules []PolicyRule `json:"rules,omitempty"`
+	// Commands are external evaluators (e.g. wrapping a Rego or CEL
+	// engine), see PolicyCommand.
+	Commands []PolicyCommand `json:"commands,omitempty"`
+}
+
+// PolicyV0JSON holds a JSON policy manifest (version 0).
+type PolicyV0JSON struct {
+	Kind  string `json:"kind"`
+	Value Policy `json:"value"`
+}
+
+// PolicyRule is a built-in policy rule. It checks all images whose name
+// matches Image (all of them, if empty), on the nodes matching Node.
+type PolicyRule struct {
+	Name    string `json:"name"`
+	Message string `json:"message,omitempty"`
+	Mode    string `json:"mode,omitempty"`
+	// Node restricts the rule to matching nodes, if set.
+	Node  *PolicyNodeMatch `json:"node,omitempty"`
+	Image string           `json:"image,omitempty"`
+	// Required is set if a matching image must be in the profile.
+	Required bool `json:"required,omitempty"`
+	// Forbidden is set if matching images must not be in the profile.
+	Forbidden bool `json:"forbidden,omitempty"`
+	// AllowRemotes and DenyRemotes are globs of the remote names matching
+	// images may (not) come from. Images without a remote are not checked.
+	AllowRemotes []string `json:"allow_remotes,omitempty"`
+	DenyRemotes  []string `json:"deny_remotes,omitempty"`
+	// MinVersion and MaxVersion bound the references of matching images.
+	MinVersion string `json:"min_version,omitempty"`
+	MaxVersion string `json:"max_version,omitempty"`
+	// DenyAssets are the asset kinds (as in image manifests, e.g.
+	// `udev_rules`) matching images must not ship.
+	DenyAssets []string `json:"deny_assets,omitempty"`
+}
+
+// PolicyNodeMatch selects nodes, as per-node profile overrides do. Empty
+// matchers match any node.
+type PolicyNodeMatch struct {
+	Hostname        string `json:"hostname,omitempty"`
+	MachineIDPrefix string `json:"machine_id_prefix,omitempty"`
+}
+
+// PolicyCommand is an external policy evaluator: the command is run with
+// the PolicyInput as JSON on stdin, and prints a JSON array of
+// PolicyViolation on stdout.
+type PolicyCommand struct {
+	Name    string   `json:"name"`
+	Command []string `json:"command"`
+	Mode    string   `json:"mode,omitempty"`
+}
+
+// PolicyInput is the document policies are evaluated against: the node,
+// and the images which would be applied (including the ones requested by
+// profile fragments), along with their manifest assets.
+type PolicyInput struct {
+	Hostname  string      `json:"hostname"`
+	MachineID string      `json:"machine_id"`
+	Profile   string      `json:"profile"`
+	Images    []GraphNode `json:"images"`
+}
+
+// PolicyViolation is a policy rule not satisfied by the profile.
+type PolicyViolation struct {
+	// Policy is the policy manifest (or evaluator) the rule comes from.
+	Policy  string `json:"policy"`
+	Rule    string `json:"rule"`
+	Mode    string `json:"mode"`
+	Image   string `json:"image,omitempty"`
+	Message string `json:"message"`
+}
+
+// PolicyEvaluator evaluates policies against the profile about to be
+// applied, e.g. embedding a Rego or CEL engine. Violations without a mode
+// are enforced.
+type PolicyEvaluator interface {
+	Evaluate(ctx context.Context, input PolicyInput) ([]PolicyViolation, error)
+}
+
+// LoadedPolicy is a policy along with the manifest it was read from.
+type LoadedPolicy struct {
+	Policy
+	Path string `json:"path"`
+}
+
+// ReadPolicies reads all policies from the policy directories, sorted by
+// file name. Policies in later directories replace the ones with the same
+// file name in earlier directories.
+func (cc *CommonConfig) ReadPolicies() ([]LoadedPolicy, error) {
+	paths := map[string]string{}
+	for _, dir := range cc.PolicyDirs() {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, fi := range files {
+			if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".json") {
+				paths[fi.Name()] = filepath.Join(dir, fi.Name())
+			}
+		}
+	}
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	policies := []LoadedPolicy{}
+	for _, name := range names {
+		policy, err := ReadPolicy(paths[name])
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, LoadedPolicy{*policy, paths[name]})
+	}
+	return policies, nil
+}
+
+// ReadPolicy reads and validates the policy manifest at `path`.
+func ReadPolicy(path string) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest PolicyV0JSON
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode policy %s", path)
+	}
+	if manifest.Kind != PolicyV0K {
+		if err := futureKind(manifest.Kind, ""); err != nil {
+			return nil, errors.Wrapf(err, "policy %s", path)
+		}
+		return nil, errors.Errorf("invalid policy kind in %s: %q", path, manifest.Kind)
+	}
+	if err := manifest.Value.validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid policy %s", path)
+	}
+	return &manifest.Value, nil
+}
+
+// validate checks the policy modes, rules and commands.
+func (p *Policy) validate() error {
+	if err := validatePolicyMode(p.Mode); err != nil {
+		return err
+	}
+	for i, rule := range p.Rules {
+		if rule.Name == "" {
+			return errors.Errorf("rule #%d: missing name", i)
+		}
+		if err := validatePolicyMode(rule.Mode); err != nil {
+			return errors.Wrapf(err, "rule %s", rule.Name)
+		}
+		for _, glob := range append([]string{rule.Image}, append(rule.AllowRemotes, rule.DenyRemotes...)...) {
+			if _, err := path.Match(glob, ""); err != nil {
+				return errors.Wrapf(err, "rule %s: invalid pattern %q", rule.Name, glob)
+			}
+		}
+		for _, kind := range rule.DenyAssets {
+			if !containsString(policyAssetKinds, kind) {
+				return errors.Errorf("rule %s: unknown asset kind %q", rule.Name, kind)
+			}
+		}
+	}
+	for i, cmd := range p.Commands {
+		if cmd.Name == "" {
+			return errors.Errorf("command #%d: missing name", i)
+		}
+		if len(cmd.Command) == 0 || cmd.Command[0] == "" {
+			return errors.Errorf("command %s: missing executable", cmd.Name)
+		}
+		if err := validatePolicyMode(cmd.Mode); err != nil {
+			return errors.Wrapf(err, "command %s", cmd.Name)
+		}
+	}
+	return nil
+}
+
+// validatePolicyMode checks `mode` is empty or a known policy mode.
+func validatePolicyMode(mode string) error {
+	switch mode {
+	case "", PolicyModeEnforce, PolicyModeWarn:
+		return nil
+	}
+	return errors.Errorf("unknown policy mode %q", mode)
+}
+
+// policyAssetKinds are the asset kinds rules can deny, as in image manifests.
+var policyAssetKinds = []string{"bin", "network", "units", "sysusers", "tmpfiles", "udev_rules", "file_contexts", "checks", "provides", "state_dirs", "cleanup"}
+
+// EvaluatePolicies evaluates all policies, along with the evaluators of
+// `applyCfg`, against the profile which would be applied with it.
+// Archives are inspected without being unpacked.
+func EvaluatePolicies(ctx context.Context, applyCfg *ApplyConfig) ([]PolicyViolation, error) {
+	return evaluatePolicies(ctx, applyCfg, nil)
+}
+
+// evaluatePolicies implements EvaluatePolicies against `images` (along
+// with their fragments), or the merged profile if nil.
+func evaluatePolicies(ctx context.Context, applyCfg *ApplyConfig, images []Image) ([]PolicyViolation, error) {
+	if applyCfg == nil {
+		return nil, errors.New("missing apply configuration")
+	}
+	policies, err := applyCfg.ReadPolicies()
+	if err != nil {
+		return nil, err
+	}
+	violations := []PolicyViolation{}
+	if len(policies) == 0 && len(applyCfg.PolicyEvaluators) == 0 {
+		return violations, nil
+	}
+
+	var inspected []inspectedImage
+	if images == nil {
+		inspected, err = inspectProfile(applyCfg)
+	} else {
+		inspected, err = inspectImages(applyCfg, images)
+	}
+	if err != nil {
+		return nil, err
+	}
+	node := CurrentNodeIdentity()
+	input := PolicyInput{
+		Hostname:  node.Hostname,
+		MachineID: node.MachineID,
+		Profile:   applyCfg.UpperProfile,
+		Images:    make([]GraphNode, 0, len(inspected)),
+	}
+	for _, ii := range inspected {
+		input.Images = append(input.Images, ii.node)
+	}
+
+	for _, p := range policies {
+		found, err := p.evaluate(ctx, node, input)
+		if err != nil {
+			return nil, err
+		}
+		violations = append(violations, found...)
+	}
+	for _, evaluator := range applyCfg.PolicyEvaluators {
+		found, err := evaluator.Evaluate(ctx, input)
+		if err != nil {
+			return nil, errors.Wrap(err, "policy evaluator failed")
+		}
+		for _, v := range found {
+			if v.Mode == "" {
+				v.Mode = PolicyModeEnforce
+			}
+			violations = append(violations, v)
+		}
+	}
+	return violations, nil
+}
+
+// evaluate checks `input` against the rules and commands of this policy.
+func (p *LoadedPolicy) evaluate(ctx context.Context, node NodeIdentity, input PolicyInput) ([]PolicyViolation, error) {
+	violations := []PolicyViolation{}
+	for _, rule := range p.Rules {
+		if rule.Node != nil {
+			ok, err := NodeProfileRuleV0{Hostname: rule.Node.Hostname, MachineIDPrefix: rule.Node.MachineIDPrefix}.matches(node)
+			if err != nil {
+				return nil, errors.Wrapf(err, "policy %s, rule %s", p.Path, rule.Name)
+			}
+			if !ok {
+				continue
+			}
+		}
+		mode := p.mode(rule.Mode)
+		for _, found := range rule.check(input.Images) {
+			found.Policy, found.Rule, found.Mode = p.Path, rule.Name, mode
+			if rule.Message != "" {
+				found.Message = rule.Message + ": " + found.Message
+			}
+			violations = append(violations, found)
+		}
+	}
+
+	for _, cmd := range p.Commands {
+		mode := p.mode(cmd.Mode)
+		found, err := runPolicyCommand(ctx, cmd, input)
+		if err != nil && mode == PolicyModeWarn {
+			found = []PolicyViolation{{Message: err.Error()}}
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "policy %s", p.Path)
+		}
+		for _, v := range found {
+			v.Policy = p.Path
+			if v.Rule == "" {
+				v.Rule = cmd.Name
+			}
+			// Commands in warn mode never block, enforced ones may only
+			// warn about some violations.
+			if mode == PolicyModeWarn || v.Mode != PolicyModeWarn {
+				v.Mode = mode
+			}
+			violations = append(violations, v)
+		}
+	}
+	return violations, nil
+}
+
+// mode returns `mode`, defaulting to the policy mode, then enforcement.
+func (p *Policy) mode(mode string) string {
+	if mode == "" {
+		mode = p.Mode
+	}
+	if mode == "" {
+		mode = PolicyModeEnforce
+	}
+	return mode
+}
+
+// check returns the violations of this rule by `images`. Policy, rule
+// name and mode are left to the caller.
+func (rule PolicyRule) check(images []GraphNode) []PolicyViolation {
+	glob := rule.Image
+	if glob == "" {
+		glob = "*"
+	}
+	violations := []PolicyViolation{}
+	matched := false
+	for _, im := range images {
+		if ok, _ := path.Match(glob, im.Name); !ok {
+			continue
+		}
+		matched = true
+		report := func(format string, args ...interface{}) {
+			violations = append(violations, PolicyViolation{
+				Image:   im.Name,
+				Message: errors.Errorf(format, args...).Error(),
+			})
+		}
+
+		if rule.Forbidden {
+			report("image %s is forbidden", im.Name)
+		}
+		if im.Remote != "" {
+			if denied, _ := matchAny(rule.DenyRemotes, im.Remote); denied {
+				report("image %s from denied remote %s", im.Name, im.Remote)
+			}
+			if allowed, _ := matchAny(rule.AllowRemotes, im.Remote); len(rule.AllowRemotes) > 0 && !allowed {
+				report("image %s from remote %s, which is not allowed", im.Name, im.Remote)
+			}
+		}
+		if !IsVersionQuery(im.Reference) {
+			if rule.MinVersion != "" && CompareVersions(im.Reference, rule.MinVersion) < 0 {
+				report("image %s:%s is older than %s", im.Name, im.Reference, rule.MinVersion)
+			}
+			if rule.MaxVersion != "" && CompareVersions(im.Reference, rule.MaxVersion) > 0 {
+				report("image %s:%s is newer than %s", im.Name, im.Reference, rule.MaxVersion)
+			}
+		}
+		if len(rule.DenyAssets) > 0 && im.Assets == nil {
+			// Images which could not be inspected (e.g. squashfs archives
+			// without unsquashfs) may ship any asset.
+			report("image %s assets could not be inspected", im.Name)
+		} else if len(rule.DenyAssets) > 0 {
+			// All asset fields are omitted when empty.
+			b, _ := json.Marshal(im.Assets)
+			var fields map[string]json.RawMessage
+			_ = json.Unmarshal(b, &fields)
+			for _, kind := range rule.DenyAssets {
+				if _, ok := fields[kind]; ok {
+					report("image %s ships denied %s assets", im.Name, kind)
+				}
+			}
+		}
+	}
+	if rule.Required && !matched {
+		violations = append(violations, PolicyViolation{
+			Message: "no image matching " + glob + " in the profile",
+		})
+	}
+	return violations
+}
+
+// runPolicyCommand runs the external evaluator `cmd` against `input`.
+func runPolicyCommand(ctx context.Context, cmd PolicyCommand, input PolicyInput) ([]PolicyViolation, error) {
+	ctx, cancel := context.WithTimeout(ctx, policyCommandTimeout)
+	defer cancel()
+
+	in, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	c := exec.CommandContext(ctx, cmd.Command[0], cmd.Command[1:]...)
+	c.Stdin = bytes.NewReader(in)
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		return nil, errors.Wrapf(err, "policy command %s failed: %s", cmd.Name, strings.TrimSpace(stderr.String()))
+	}
+
+	violations := []PolicyViolation{}
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return violations, nil
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &violations); err != nil {
+		return nil, errors.Wrapf(err, "invalid output from policy command %s", cmd.Name)
+	}
+	return violations, nil
+}
+
+// enforcePolicies evaluates all policies before an apply, recording
+// violations as warnings. It fails if any enforced rule is violated.
+// Policies are evaluated against `images`, or the merged profile if nil.
+func enforcePolicies(applyCfg *ApplyConfig, images []Image) error {
+	ctx := context.Background()
+	if !applyCfg.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, applyCfg.deadline)
+		defer cancel()
+	}
+	violations, err := evaluatePolicies(ctx, applyCfg, images)
+	if err != nil {
+		return errors.Wrap(err, "policy evaluation failed")
+	}
+
+	blocking := []string{}
+	for _, v := range violations {
+		w := Warning{
+			Kind:    WarningPolicyViolation,
+			Message: v.Rule + ": " + v.Message,
+			Path:    v.Policy,
+		}
+		if v.Image != "" {
+			w.Image = &Image{Name: v.Image}
+		}
+		applyCfg.warn(w)
+		logrus.WithFields(logrus.Fields{
+			"policy": v.Policy,
+			"rule":   v.Rule,
+			"mode":   v.Mode,
+		}).Warn(v.Message)
+		if v.Mode != PolicyModeWarn {
+			blocking = append(blocking, v.Rule+": "+v.Message)
+		}
+	}
+	if len(blocking) > 0 {
+		return errors.Wrap(ErrPolicyViolation, strings.Join(blocking, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// policyFunc adapts a function to the PolicyEvaluator interface.
+type policyFunc func(ctx context.Context, input PolicyInput) ([]PolicyViolation, error)
+
+func (f policyFunc) Evaluate(ctx context.Context, input PolicyInput) ([]PolicyViolation, error) {
+	return f(ctx, input)
+}
+
+func TestEvaluatePolicies(t *testing.T) {
+	dir := t.TempDir()
+	machineID := filepath.Join(dir, "machine-id")
+	if err := ioutil.WriteFile(machineID, []byte("0123456789abcdef\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldMachineIDPath := MachineIDPath
+	MachineIDPath = machineID
+	defer func() { MachineIDPath = oldMachineIDPath }()
+
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			RunDir:  dir,
+			ConfDir: filepath.Join(dir, "conf"),
+			UsrDir:  filepath.Join(dir, "usr"),
+		},
+		LowerProfiles: []string{"vendor"},
+	}
+	command := filepath.Join(dir, "evaluator")
+	files := map[string]string{
+		filepath.Join(VendorProfilesDir(applyCfg.UsrDir), "vendor.json"): `{"kind": "profile-manifest-v1", "value": {"images": [
+			{"name": "docker", "reference": "19.03", "remote": "stable"},
+			{"name": "debug", "reference": "1", "remote": "testing"}
+		]}}`,
+		filepath.Join(applyCfg.ConfDir, "policies", "prod.json"): `{"kind": "torcx-policy-v0", "value": {"rules": [
+			{"name": "no-testing", "deny_remotes": ["test*"]},
+			{"name": "docker-20", "image": "docker", "min_version": "20", "mode": "warn"},
+			{"name": "kubelet", "image": "kubelet", "required": true, "node": {"machine_id_prefix": "fff"}}
+		], "commands": [{"name": "external", "command": ["` + command + `"], "mode": "warn"}]}}`,
+		command: "#!/bin/sh\ncat > /dev/null\necho '[{\"message\": \"external finding\", \"mode\": \"enforce\"}]'\n",
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	applyCfg.PolicyEvaluators = []PolicyEvaluator{policyFunc(func(_ context.Context, input PolicyInput) ([]PolicyViolation, error) {
+		if input.MachineID != "0123456789abcdef" || len(input.Images) != 2 {
+			t.Errorf("unexpected policy input %+v", input)
+		}
+		return nil, nil
+	})}
+
+	violations, err := EvaluatePolicies(context.Background(), applyCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, v := range violations {
+		got = append(got, v.Rule+"/"+v.Mode+"/"+v.Image)
+	}
+	expected := "no-testing/enforce/debug docker-20/warn/docker external/warn/"
+	if strings.Join(got, " ") != expected {
+		t.Fatalf("expected violations %q, got %q", expected, strings.Join(got, " "))
+	}
+
+	err = enforcePolicies(applyCfg, nil)
+	if errors.Cause(err) != ErrPolicyViolation || !strings.Contains(err.Error(), "no-testing") || strings.Contains(err.Error(), "docker-20") {
+		t.Errorf("expected only the enforced rule to block the apply, got %v", err)
+	}
+	if counts := CountWarnings(applyCfg.Warnings); counts[WarningPolicyViolation] != 3 {
+		t.Errorf("expected 3 policy warnings, got %v", counts)
+	}
+}
+
+func TestReadPolicyInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	for _, value := range []string{
+		`{"rules": [{"image": "docker"}]}`,
+		`{"mode": "audit"}`,
+		`{"rules": [{"name": "no-udev", "deny_assets": ["udev"]}]}`,
+		`{"commands": [{"name": "opa"}]}`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(`{"kind": "torcx-policy-v0", "value": `+value+`}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadPolicy(path); err == nil {
+			t.Errorf("%s: expected policy to be rejected", value)
+		}
+	}
+}
+
+func TestPolicyDenyAssets(t *testing.T) {
+	p := LoadedPolicy{
+		Policy: Policy{Rules: []PolicyRule{
+			{Name: "no-udev", DenyAssets: []string{"udev_rules"}},
+			{Name: "no-units", DenyAssets: []string{"units"}, Mode: PolicyModeWarn},
+		}},
+		Path: "/etc/torcx/policies/assets.json",
+	}
+	input := PolicyInput{Images: []GraphNode{
+		{Name: "plain", Assets: &Assets{Binaries: []string{"/bin/plain"}}},
+		{Name: "udev", Assets: &Assets{UdevRules: []string{"/udev/99-foo.rules"}}},
+		// Not inspected, e.g. as unsquashfs is not available.
+		{Name: "opaque", Error: ErrInspectUnsupported.Error()},
+	}}
+
+	violations, err := p.evaluate(context.Background(), NodeIdentity{}, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, v := range violations {
+		got = append(got, v.Rule+"/"+v.Mode+"/"+v.Image)
+	}
+	expected := "no-udev/enforce/udev no-udev/enforce/opaque no-units/warn/opaque"
+	if strings.Join(got, " ") != expected {
+		t.Fatalf("expected violations %q, got %q", expected, strings.Join(got, " "))
+	}
+	if !strings.Contains(violations[1].Message, "could not be inspected") {
+		t.Errorf("unexpected violation message %q", violations[1].Message)
+	}
+}
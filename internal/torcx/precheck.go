@@ -0,0 +1,144 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// PropagationPlan lists all assets which would be propagated by an apply.
+type PropagationPlan struct {
+	Images  []GraphNode `json:"images"`
+	Entries []PlanEntry `json:"entries"`
+}
+
+// PlanEntry is a single file which would be propagated to the host.
+type PlanEntry struct {
+	Image       string `json:"image"`
+	Reference   string `json:"reference"`
+	Kind        string `json:"kind"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// CollidesWith is the image which already provides the same destination, if any
+	CollidesWith string `json:"collides_with,omitempty"`
+}
+
+// Collisions returns the plan entries which would not be propagated,
+// because an image applied earlier provides the same destination.
+func (pp *PropagationPlan) Collisions() []PlanEntry {
+	collisions := []PlanEntry{}
+	for _, e := range pp.Entries {
+		if e.CollidesWith != "" {
+			collisions = append(collisions, e)
+		}
+	}
+	return collisions
+}
+
+// PlanPropagation computes, without unpacking nor mounting archives, the
+// list of assets which would be propagated by applying the profile for the
+// given configuration.
+func PlanPropagation(applyCfg *ApplyConfig) (*PropagationPlan, error) {
+	inspected, err := inspectProfile(applyCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &PropagationPlan{
+		Images:  []GraphNode{},
+		Entries: []PlanEntry{},
+	}
+	owners := map[string]string{}
+	for _, ii := range inspected {
+		plan.Images = append(plan.Images, ii.node)
+		if ii.meta == nil {
+			continue
+		}
+		for _, e := range planImage(applyCfg, ii.meta) {
+			e.Image = ii.node.Name
+			e.Reference = ii.node.Reference
+			if owner, ok := owners[e.Destination]; ok {
+				e.CollidesWith = owner
+			} else {
+				owners[e.Destination] = e.Image
+			}
+			plan.Entries = append(plan.Entries, e)
+		}
+	}
+
+	return plan, nil
+}
+
+// planImage lists assets which would be propagated from a single image,
+// following the same flattening rules as propagateBins and propagateUnits.
+func planImage(applyCfg *ApplyConfig, meta *ImageMetadata) []PlanEntry {
+	entries := []PlanEntry{}
+
+	for _, asset := range meta.Assets.Binaries {
+		if asset == "" {
+			continue
+		}
+		asset = filepath.Clean("/" + asset)
+		for _, f := range meta.Files {
+			if f == asset || strings.HasPrefix(f, asset+"/") {
+				entries = append(entries, PlanEntry{
+					Kind:        "bin",
+					Source:      f,
+					Destination: filepath.Join(applyCfg.RunBinDir(), filepath.Base(f)),
+				})
+			}
+		}
+	}
+
+	groups := []struct {
+		kind     string
+		assets   []string
+		unitsDir string
+	}{
+		{"network", meta.Assets.Network, filepath.Join(systemdDir, "network")},
+		{"units", meta.Assets.Units, filepath.Join(systemdDir, "system")},
+		{"sysusers", meta.Assets.Sysusers, sysUsersDir},
+		{"tmpfiles", meta.Assets.Tmpfiles, tmpFilesDir},
+		{"udev_rules", meta.Assets.UdevRules, udevRulesDir},
+	}
+	for _, group := range groups {
+		for _, asset := range group.assets {
+			if asset == "" {
+				continue
+			}
+			asset = filepath.Clean("/" + asset)
+			for _, f := range meta.Files {
+				// Directory assets are only propagated one level deep
+				dest := ""
+				if f == asset {
+					dest = filepath.Join(group.unitsDir, filepath.Base(f))
+				} else if filepath.Dir(f) == asset {
+					dest = filepath.Join(group.unitsDir, filepath.Base(asset), filepath.Base(f))
+				}
+				if dest == "" {
+					continue
+				}
+				entries = append(entries, PlanEntry{
+					Kind:        group.kind,
+					Source:      f,
+					Destination: dest,
+				})
+			}
+		}
+	}
+
+	return entries
+}
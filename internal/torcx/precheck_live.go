@@ -0,0 +1,141 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// LiveNew is an asset which is not propagated on the live system.
+	LiveNew = "new"
+	// LiveUnchanged is an asset propagated by the same image version.
+	LiveUnchanged = "unchanged"
+	// LiveUpgrade is an asset propagated by an older version of the image.
+	LiveUpgrade = "upgrade"
+	// LiveDowngrade is an asset propagated by a newer version of the image.
+	LiveDowngrade = "downgrade"
+	// LiveReplace is an asset propagated by another image (or not by torcx).
+	LiveReplace = "replace"
+)
+
+// LiveDiff compares a propagation plan with the live system.
+type LiveDiff struct {
+	Entries []LiveDiffEntry `json:"entries"`
+	// Removed are the live images which would not be applied anymore.
+	Removed []Image `json:"removed"`
+}
+
+// LiveDiffEntry is a plan entry, compared with the live system.
+type LiveDiffEntry struct {
+	PlanEntry
+	// Change is how the live asset would change (e.g. "upgrade").
+	Change string `json:"change"`
+	// LiveReference is the live version of the image, if applied.
+	LiveReference string `json:"live_reference,omitempty"`
+	// Shadows is the vendor file in /usr which the asset would shadow.
+	Shadows string `json:"shadows,omitempty"`
+}
+
+// vendorAssetDirs are the vendor directories which propagated assets of
+// each kind take precedence over, relative to the USR mountpoint.
+var vendorAssetDirs = map[string][]string{
+	"bin":        {"bin", "sbin"},
+	"network":    {"lib/systemd/network"},
+	"units":      {"lib/systemd/system"},
+	"sysusers":   {"lib/sysusers.d"},
+	"tmpfiles":   {"lib/tmpfiles.d"},
+	"udev_rules": {"lib/udev/rules.d"},
+}
+
+// DiffPropagationLive compares the assets of `plan` with the ones live on
+// the system: those propagated by the running profile (at RunDir) and the
+// vendor ones they would shadow in /usr.
+func DiffPropagationLive(applyCfg *ApplyConfig, plan *PropagationPlan) (*LiveDiff, error) {
+	live := map[string]string{}
+	liveImages, err := ReadProfilePath(applyCfg.RunProfile())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, im := range liveImages {
+		live[im.Name] = im.Reference
+	}
+
+	usrDir := applyCfg.UsrDir
+	if usrDir == "" {
+		usrDir = VendorUsrDir
+	}
+	diff := &LiveDiff{
+		Entries: []LiveDiffEntry{},
+		Removed: []Image{},
+	}
+	planned := map[string]bool{}
+	for _, im := range plan.Images {
+		planned[im.Name] = true
+	}
+	for _, im := range liveImages {
+		if !planned[im.Name] {
+			diff.Removed = append(diff.Removed, im)
+		}
+	}
+
+	for _, e := range plan.Entries {
+		if e.CollidesWith != "" {
+			continue
+		}
+		entry := LiveDiffEntry{
+			PlanEntry:     e,
+			Change:        LiveNew,
+			LiveReference: live[e.Image],
+		}
+		if IsExistingPath(e.Destination) {
+			switch liveRef, ok := live[e.Image]; {
+			case !ok:
+				entry.Change = LiveReplace
+			case liveRef == e.Reference:
+				entry.Change = LiveUnchanged
+			case CompareVersions(e.Reference, liveRef) > 0:
+				entry.Change = LiveUpgrade
+			default:
+				entry.Change = LiveDowngrade
+			}
+		}
+		entry.Shadows = vendorShadowed(usrDir, e)
+		diff.Entries = append(diff.Entries, entry)
+	}
+	return diff, nil
+}
+
+// vendorShadowed returns the vendor file shadowed by a plan entry, if any.
+func vendorShadowed(usrDir string, e PlanEntry) string {
+	rel := filepath.Base(e.Destination)
+	if e.Kind != "bin" {
+		for _, unitsDir := range []string{filepath.Join(systemdDir, "network"), filepath.Join(systemdDir, "system"), sysUsersDir, tmpFilesDir, udevRulesDir} {
+			if strings.HasPrefix(e.Destination, unitsDir+"/") {
+				rel = strings.TrimPrefix(e.Destination, unitsDir+"/")
+				break
+			}
+		}
+	}
+	for _, dir := range vendorAssetDirs[e.Kind] {
+		path := filepath.Join(usrDir, dir, rel)
+		if IsExistingPath(path) {
+			return path
+		}
+	}
+	return ""
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiffPropagationLive(t *testing.T) {
+	dir := t.TempDir()
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			RunDir: filepath.Join(dir, "run"),
+			UsrDir: filepath.Join(dir, "usr"),
+		},
+	}
+	if err := os.MkdirAll(applyCfg.RunBinDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeRunProfile(applyCfg.RunProfile(), []Image{{Name: "docker", Reference: "19.03"}, {Name: "old", Reference: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		filepath.Join(applyCfg.RunBinDir(), "docker"),
+		filepath.Join(applyCfg.RunBinDir(), "kubectl"),
+		filepath.Join(applyCfg.UsrDir, "bin", "docker"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plan := &PropagationPlan{
+		Images: []GraphNode{{Name: "docker", Reference: "20.10"}, {Name: "kube", Reference: "1"}},
+		Entries: []PlanEntry{
+			{Image: "docker", Reference: "20.10", Kind: "bin", Destination: filepath.Join(applyCfg.RunBinDir(), "docker")},
+			{Image: "docker", Reference: "20.10", Kind: "bin", Destination: filepath.Join(applyCfg.RunBinDir(), "dockerd")},
+			{Image: "kube", Reference: "1", Kind: "bin", Destination: filepath.Join(applyCfg.RunBinDir(), "kubectl")},
+			{Image: "kube", Reference: "1", Kind: "bin", Destination: filepath.Join(applyCfg.RunBinDir(), "docker"), CollidesWith: "docker"},
+		},
+	}
+	diff, err := DiffPropagationLive(applyCfg, plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		change  string
+		shadows string
+	}{
+		{LiveUpgrade, filepath.Join(applyCfg.UsrDir, "bin", "docker")},
+		{LiveNew, ""},
+		{LiveReplace, ""},
+	}
+	if len(diff.Entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %v", len(expected), diff.Entries)
+	}
+	for i, e := range expected {
+		if diff.Entries[i].Change != e.change || diff.Entries[i].Shadows != e.shadows {
+			t.Errorf("entry %d: expected %s/%q, got %s/%q", i, e.change, e.shadows, diff.Entries[i].Change, diff.Entries[i].Shadows)
+		}
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0].Name != "old" {
+		t.Errorf("unexpected removed images %v", diff.Removed)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanImage(t *testing.T) {
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			RunDir: "/run/torcx",
+		},
+	}
+	meta := &ImageMetadata{
+		Assets: Assets{
+			Binaries: []string{"/bin"},
+			Units:    []string{"/lib/systemd/system/foo.service", "/lib/systemd/system/multi-user.target.wants"},
+		},
+		Files: []string{
+			"/bin/foo",
+			"/bin/sub/bar",
+			"/lib/systemd/system/foo.service",
+			"/lib/systemd/system/multi-user.target.wants/foo.service",
+			"/lib/systemd/system/multi-user.target.wants/nested/skipped",
+			"/usr/share/unrelated",
+		},
+	}
+
+	expected := []PlanEntry{
+		{Kind: "bin", Source: "/bin/foo", Destination: "/run/torcx/bin/foo"},
+		{Kind: "bin", Source: "/bin/sub/bar", Destination: "/run/torcx/bin/bar"},
+		{Kind: "units", Source: "/lib/systemd/system/foo.service", Destination: "/run/systemd/system/foo.service"},
+		{Kind: "units", Source: "/lib/systemd/system/multi-user.target.wants/foo.service", Destination: "/run/systemd/system/multi-user.target.wants/foo.service"},
+	}
+	entries := planImage(applyCfg, meta)
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("wrong plan:\n got: %v\n expected: %v", entries, expected)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// statfsAvailable returns the number of bytes available to unprivileged
+// users on the filesystem holding `path`.
+var statfsAvailable = func(path string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+// ArchiveSize returns the archive size advertised by the remote for `im`,
+// or 0 if unknown.
+func (rcs *RemoteContents) ArchiveSize(im Image) int64 {
+	vers, ok := rcs.remoteVersion(im)
+	if !ok {
+		return 0
+	}
+	return vers.size
+}
+
+// checkFreeSpace ensures the filesystem holding `dir` has room for an
+// archive of `size` bytes, before starting to transfer it.
+func checkFreeSpace(dir string, size int64) error {
+	avail, err := statfsAvailable(dir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check free space in %s", dir)
+	}
+	if uint64(size) > avail {
+		return errors.Errorf("not enough free space in %s: %s needed, %s available", dir, formatSize(size), formatSize(int64(avail)))
+	}
+	return nil
+}
+
+// checkArchiveSize ensures the file at `path` is `size` bytes long.
+// A zero `size` means unknown, and is not checked.
+func checkArchiveSize(path string, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != size {
+		return errors.Errorf("mismatching size: expected %d bytes, got %d", size, fi.Size())
+	}
+	return nil
+}
+
+// formatSize formats a size in bytes for humans.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
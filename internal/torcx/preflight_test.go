@@ -0,0 +1,123 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveSize(t *testing.T) {
+	rcs := RemoteContentsFromJSONV1(RemoteImagesV1{
+		Images: []RemoteImageV1{
+			{
+				Name:           "foo",
+				DefaultVersion: "2",
+				Versions: []RemoteVersionV1{
+					{Version: "1", Location: "foo:1.torcx.tgz", Size: 10},
+					{Version: "2", Location: "foo:2.torcx.tgz", Size: 20},
+				},
+			},
+		},
+	})
+
+	tests := []struct {
+		im   Image
+		size int64
+	}{
+		{Image{Name: "foo", Reference: "1"}, 10},
+		{Image{Name: "foo", Reference: DefaultTagRef}, 20},
+		{Image{Name: "foo", Reference: "3"}, 0},
+		{Image{Name: "bar", Reference: "1"}, 0},
+	}
+	for _, tt := range tests {
+		if size := rcs.ArchiveSize(tt.im); size != tt.size {
+			t.Errorf("%s:%s: expected size %d, got %d", tt.im.Name, tt.im.Reference, tt.size, size)
+		}
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	orig := statfsAvailable
+	defer func() { statfsAvailable = orig }()
+	statfsAvailable = func(string) (uint64, error) { return 100, nil }
+
+	if err := checkFreeSpace("/store", 100); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := checkFreeSpace("/store", 101); err == nil {
+		t.Error("expected error for insufficient space")
+	}
+}
+
+func TestDownloadSizeMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("archive"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	baseURL, _ := url.Parse(srv.URL + "/")
+	location, _ := url.Parse("./foo:1.torcx.tgz")
+	rc := &RemotesCache{}
+	client := (&Remote{}).httpClient()
+
+	if err := rc.downloadArchive(context.Background(), Image{}, client, baseURL, location, dir, "", 3); err == nil {
+		t.Fatal("expected error for mismatching size")
+	}
+	if err := rc.downloadArchive(context.Background(), Image{}, client, baseURL, location, dir, "", 7); err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "foo:1.torcx.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "archive" {
+		t.Errorf("unexpected content %q", b)
+	}
+}
+
+func TestInstallArchiveSize(t *testing.T) {
+	dir := t.TempDir()
+	tmpName := filepath.Join(dir, ".partial")
+	if err := ioutil.WriteFile(tmpName, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "foo:1.torcx.tgz")
+	if err := installArchive(tmpName, target, "", 8); err == nil {
+		t.Fatal("expected error for mismatching size")
+	}
+	if IsExistingPath(target) {
+		t.Error("archive installed despite mismatching size")
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := map[int64]string{
+		512:             "512 B",
+		1536:            "1.5 KiB",
+		3 * 1024 * 1024: "3.0 MiB",
+	}
+	for size, expected := range tests {
+		if got := formatSize(size); got != expected {
+			t.Errorf("%d: expected %q, got %q", size, expected, got)
+		}
+	}
+}
@@ -16,6 +16,7 @@ package torcx
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -32,7 +33,7 @@ var DefaultLowerProfiles = []string{VendorProfileName, OemProfileName}
 
 // CurrentProfileNames returns the name of the currently running user and vendor profiles
 func CurrentProfileNames() (string, []string, error) {
-	meta, err := ReadMetadata(SealPath)
+	meta, err := ReadMetadata(RootPath(SealPath))
 	if err != nil {
 		return "", nil, err
 	}
@@ -53,7 +54,7 @@ func CurrentProfileNames() (string, []string, error) {
 func CurrentProfilePath() (string, error) {
 	var path string
 
-	meta, err := ReadMetadata(SealPath)
+	meta, err := ReadMetadata(RootPath(SealPath))
 	if err != nil {
 		return "", err
 	}
@@ -155,6 +156,9 @@ func readProfileReader(in io.Reader) ([]Image, error) {
 		return ImagesFromJSONV1(manifest.Value), nil
 	}
 
+	if err := futureKind(container.Kind, container.MinTorcxVersion); err != nil {
+		return nil, err
+	}
 	return nil, errors.Errorf("unknown profile kind %s", container.Kind)
 }
 
@@ -341,6 +345,7 @@ func ListProfiles(profileDirs []string) (map[string]string, error) {
 
 func mergeProfiles(applyCfg *ApplyConfig) ([]Image, error) {
 	var mergedImages []Image
+	roles := []string{}
 
 	if applyCfg == nil {
 		return nil, errors.New("missing apply configuration")
@@ -367,20 +372,40 @@ func mergeProfiles(applyCfg *ApplyConfig) ([]Image, error) {
 	// Then we do a stable merge of images from all profiles (in-order)
 	for _, lp := range resProfiles {
 		profilePath, ok := localProfiles[lp]
-		if !ok || profilePath == "" {
-			return nil, errors.Errorf("profile %q not found", lp)
-		}
-		fp, err := os.Open(profilePath)
-		if err != nil {
-			return nil, errors.Wrapf(err, "opening profile %q", profilePath)
+		b := applyCfg.previewUpper
+		if lp != applyCfg.UpperProfile || b == nil {
+			if !ok || profilePath == "" {
+				return nil, errors.Errorf("profile %q not found", lp)
+			}
+			b, err = ioutil.ReadFile(profilePath)
+			if err != nil {
+				return nil, errors.Wrapf(err, "opening profile %q", profilePath)
+			}
 		}
-		defer fp.Close()
-		images, err := readProfileReader(bufio.NewReader(fp))
+		images, err := readProfileReader(bytes.NewReader(b))
 		if err != nil && err != io.EOF {
 			return nil, errors.Wrapf(err, "reading profile %q", profilePath)
 		}
+		var container struct {
+			Kind  string `json:"kind"`
+			Value struct {
+				Roles []string `json:"roles"`
+			} `json:"value"`
+		}
+		if json.Unmarshal(b, &container) == nil {
+			applyCfg.warnDeprecatedKind(container.Kind, profilePath)
+			roles = appendUnique(roles, container.Value.Roles...)
+		}
 		mergedImages = mergeImages(mergedImages, images)
 	}
+	mergedImages, err = filterConditions(mergedImages)
+	if err != nil {
+		return nil, err
+	}
+	mergedImages = applyCfg.FilterRecommends(mergedImages)
+	if len(roles) > 0 {
+		return resolveRoles(&applyCfg.CommonConfig, mergedImages, roles)
+	}
 	return mergedImages, nil
 }
 
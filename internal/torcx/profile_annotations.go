@@ -0,0 +1,116 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Well-known profile annotations. Annotations are free-form, these keys
+// are only conventions.
+const (
+	// AnnotationDescription describes the purpose of the addon set.
+	AnnotationDescription = "description"
+	// AnnotationOwner is the team or person owning the profile.
+	AnnotationOwner = "owner"
+	// AnnotationTicketURL links to the ticket tracking the profile.
+	AnnotationTicketURL = "ticket_url"
+	// AnnotationCreatedBy records who (or what tool) created the profile.
+	AnnotationCreatedBy = "created_by"
+)
+
+// ReadProfileAnnotations returns the annotations of the profile at `path`.
+// Only v1 profiles can be annotated: others have no annotations.
+func ReadProfileAnnotations(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var container kindValueJSON
+	if err := json.Unmarshal(b, &container); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s", path)
+	}
+	if container.Kind != ProfileManifestV1K {
+		return nil, nil
+	}
+	var value struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(container.Value, &value); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s", path)
+	}
+	return value.Annotations, nil
+}
+
+// AnnotateProfile sets the annotations in `set` and removes the ones in
+// `unset` on the profile at `path`, returning the resulting annotations.
+// Images and other settings are preserved; v0 profiles are rewritten as v1.
+func AnnotateProfile(path string, set map[string]string, unset []string) (map[string]string, error) {
+	for key := range set {
+		if key == "" {
+			return nil, errors.New("empty annotation key")
+		}
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	kind, err := readManifestKind(path)
+	if err != nil {
+		return nil, err
+	}
+	if kind != ProfileManifestV1K {
+		// Only v1 profiles can hold annotations.
+		images, err := ReadProfilePath(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writeProfileV1(path, images); err != nil {
+			return nil, err
+		}
+	}
+
+	manifest, err := getProfileV1(path)
+	if err != nil {
+		return nil, err
+	}
+	annotations := map[string]string{}
+	for key, value := range manifest.Value.Annotations {
+		annotations[key] = value
+	}
+	for key, value := range set {
+		annotations[key] = value
+	}
+	for _, key := range unset {
+		delete(annotations, key)
+	}
+	manifest.Value.Annotations = annotations
+	if len(annotations) == 0 {
+		manifest.Value.Annotations = nil
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, append(b, '\n'), st.Mode().Perm()); err != nil {
+		return nil, err
+	}
+	return annotations, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAnnotateProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_annotations_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "p.json")
+	profile := `{"kind": "profile-manifest-v0", "value": {"images": [{"name": "foo", "reference": "1"}]}}`
+	if err := ioutil.WriteFile(path, []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ann, err := ReadProfileAnnotations(path); err != nil || ann != nil {
+		t.Fatalf("unexpected v0 annotations: %v %v", ann, err)
+	}
+
+	set := map[string]string{AnnotationOwner: "infra", AnnotationTicketURL: "https://example.com/1"}
+	if _, err := AnnotateProfile(path, set, nil); err != nil {
+		t.Fatal(err)
+	}
+	if kind, err := readManifestKind(path); err != nil || kind != ProfileManifestV1K {
+		t.Fatalf("profile not rewritten as v1: %q %v", kind, err)
+	}
+	ann, err := AnnotateProfile(path, map[string]string{AnnotationDescription: "docker"}, []string{AnnotationTicketURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{AnnotationOwner: "infra", AnnotationDescription: "docker"}
+	if !reflect.DeepEqual(ann, expected) {
+		t.Fatalf("expected %v, got %v", expected, ann)
+	}
+
+	// Annotations survive profile edits.
+	if err := AddToProfile(path, Image{Name: "bar", Reference: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeProfileV1(path, []Image{{Name: "foo", Reference: "2"}}); err != nil {
+		t.Fatal(err)
+	}
+	ann, err = ReadProfileAnnotations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ann, expected) {
+		t.Fatalf("annotations lost on edit: %v", ann)
+	}
+	images, err := ReadProfilePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Reference != "2" {
+		t.Fatalf("unexpected images: %v", images)
+	}
+
+	if _, err := AnnotateProfile(path, map[string]string{"": "x"}, nil); err == nil {
+		t.Fatal("expected error for empty key")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// AvailableImage is an image found in the local stores or on remotes,
+// along with its versions, as offered when editing a profile.
+type AvailableImage struct {
+	Name string `json:"name"`
+	// Local are the versions in the local stores, in ascending order.
+	Local []string `json:"local"`
+	// Remotes are the versions available on each remote, in ascending order.
+	Remotes map[string][]string `json:"remotes,omitempty"`
+}
+
+// ListAvailableImages returns all images in `storeCache` and in the
+// contents of `rc` (if not nil), sorted by name.
+func ListAvailableImages(storeCache *StoreCache, rc *RemotesCache) []AvailableImage {
+	byName := map[string]*AvailableImage{}
+	entry := func(name string) *AvailableImage {
+		if byName[name] == nil {
+			byName[name] = &AvailableImage{Name: name, Local: []string{}}
+		}
+		return byName[name]
+	}
+	if storeCache != nil {
+		for im := range storeCache.Images {
+			e := entry(im.Name)
+			e.Local = appendUnique(e.Local, im.Reference)
+		}
+	}
+	if rc != nil {
+		for remote, contents := range rc.Contents {
+			for name, ri := range contents.Images {
+				e := entry(name)
+				if e.Remotes == nil {
+					e.Remotes = map[string][]string{}
+				}
+				versions := []string{}
+				for _, v := range ri.versions {
+					versions = appendUnique(versions, v.version)
+				}
+				sortVersions(versions)
+				e.Remotes[remote] = versions
+			}
+		}
+	}
+
+	available := make([]AvailableImage, 0, len(byName))
+	for _, e := range byName {
+		sortVersions(e.Local)
+		available = append(available, *e)
+	}
+	sort.Slice(available, func(i, j int) bool {
+		return available[i].Name < available[j].Name
+	})
+	return available
+}
+
+// sortVersions sorts `versions` in ascending order.
+func sortVersions(versions []string) {
+	sort.Slice(versions, func(i, j int) bool {
+		return CompareVersions(versions[i], versions[j]) < 0
+	})
+}
+
+// PreviewProfile returns the merged profile which would be applied with
+// `applyCfg`, if the images of its upper profile were replaced by
+// `images`. The upper profile does not need to exist yet.
+func PreviewProfile(applyCfg *ApplyConfig, images []Image) ([]Image, error) {
+	if applyCfg == nil {
+		return nil, errors.New("missing apply configuration")
+	}
+	if applyCfg.UpperProfile == "" {
+		return nil, errors.New("missing upper profile")
+	}
+	path, err := applyCfg.profilePath(applyCfg.UpperProfile)
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(editedProfileV1(path, images))
+	if err != nil {
+		return nil, err
+	}
+
+	applyCfg.previewUpper = content
+	defer func() { applyCfg.previewUpper = nil }()
+	return mergeProfiles(applyCfg)
+}
+
+// SaveProfile replaces the images of the profile at `path` by `images`,
+// keeping its roles and annotations. The profile is created if missing.
+func SaveProfile(path string, images []Image) error {
+	_, err := writeProfileManifest(path, editedProfileV1(path, images))
+	return err
+}
+
+// profilePath returns the path of profile `name`, defaulting to the user
+// profile directory for profiles which do not exist yet.
+func (cc *CommonConfig) profilePath(name string) (string, error) {
+	profiles, err := ListProfiles(cc.ProfileDirs())
+	if err != nil {
+		return "", errors.Wrap(err, "profiles listing failed")
+	}
+	if path, ok := profiles[name]; ok && path != "" {
+		return path, nil
+	}
+	return filepath.Join(cc.UserProfileDir(), name+".json"), nil
+}
+
+// editedProfileV1 builds the manifest of the profile at `path` with its
+// images replaced by `images`.
+func editedProfileV1(path string, images []Image) ProfileManifestV1JSON {
+	manifest := newProfileV1(images)
+	if old, err := getProfileV1(path); err == nil {
+		manifest.Value.Roles = old.Value.Roles
+		manifest.Value.Annotations = old.Value.Annotations
+	}
+	return manifest
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPreviewProfile(t *testing.T) {
+	dir := t.TempDir()
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			RunDir:  dir,
+			ConfDir: filepath.Join(dir, "conf"),
+			UsrDir:  filepath.Join(dir, "usr"),
+		},
+		LowerProfiles: []string{"vendor"},
+		UpperProfile:  "user",
+	}
+	vendorProfile := filepath.Join(VendorProfilesDir(applyCfg.UsrDir), "vendor.json")
+	if err := os.MkdirAll(filepath.Dir(vendorProfile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(vendorProfile, []byte(`{"kind": "profile-manifest-v1", "value": {"images": [{"name": "docker", "reference": "com.coreos.cl"}]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The upper profile does not need to exist.
+	edited := []Image{{Name: "docker", Reference: "20.10"}, {Name: "crictl", Reference: "1.21", Remote: "tools"}}
+	merged, err := PreviewProfile(applyCfg, edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(merged, edited) {
+		t.Fatalf("expected %v, got %v", edited, merged)
+	}
+
+	userProfile := filepath.Join(applyCfg.UserProfileDir(), "user.json")
+	if err := os.MkdirAll(filepath.Dir(userProfile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(userProfile, []byte(`{"kind": "profile-manifest-v1", "value": {"images": [], "annotations": {"owner": "lab"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	merged, err = mergeProfiles(applyCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) != 1 || merged[0].Reference != "com.coreos.cl" {
+		t.Fatalf("expected preview to leave the profile untouched, got %v", merged)
+	}
+
+	if err := SaveProfile(userProfile, edited); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ReadProfilePath(userProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved, edited) {
+		t.Fatalf("expected %v, got %v", edited, saved)
+	}
+	annotations, err := ReadProfileAnnotations(userProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if annotations["owner"] != "lab" {
+		t.Fatalf("expected annotations to be kept, got %v", annotations)
+	}
+}
+
+func TestListAvailableImages(t *testing.T) {
+	storeCache := &StoreCache{Images: map[Image]Archive{
+		{Name: "docker", Reference: "20.10"}: {},
+		{Name: "docker", Reference: "19.03"}: {},
+	}}
+	rc := &RemotesCache{Contents: map[string]RemoteContents{
+		"tools": RemoteContentsFromJSONV1(RemoteImagesV1{Images: []RemoteImageV1{
+			{Name: "crictl", Versions: []RemoteVersionV1{{Version: "1.21"}, {Version: "1.9"}}},
+		}}),
+	}}
+	expected := []AvailableImage{
+		{Name: "crictl", Local: []string{}, Remotes: map[string][]string{"tools": {"1.9", "1.21"}}},
+		{Name: "docker", Local: []string{"19.03", "20.10"}},
+	}
+	if available := ListAvailableImages(storeCache, rc); !reflect.DeepEqual(available, expected) {
+		t.Fatalf("expected %v, got %v", expected, available)
+	}
+}
@@ -17,6 +17,7 @@ package torcx
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -126,6 +127,26 @@ func TestProfileAdd(t *testing.T) {
 	}
 }
 
+func TestWriteProfileRecommends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recommends.json")
+	in := []Image{
+		{Name: "kubelet", Reference: "1", Remote: "stable"},
+		{Name: "crictl", Reference: "1", Remote: "tools", Recommended: true},
+		{Name: "cni", Reference: "2", Remote: "stable"},
+	}
+	if _, err := writeProfileV1(path, in); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ReadProfilePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Image{in[0], in[2], in[1]}
+	if !reflect.DeepEqual(out, expected) {
+		t.Fatalf("images do not match.\nexpected: %v\ngot: %v", expected, out)
+	}
+}
+
 func TestMergeImages(t *testing.T) {
 	testCases := []struct {
 		desc  string
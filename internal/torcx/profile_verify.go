@@ -0,0 +1,229 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// VerifyUnpinned is reported for profile images not pinned to a concrete reference.
+	VerifyUnpinned = "unpinned"
+	// VerifyMissing is reported for images neither in a store nor fetchable.
+	VerifyMissing = "missing"
+	// VerifyDigest is reported for archives not matching their recorded or published digest.
+	VerifyDigest = "digest"
+	// VerifySignature is reported for archives refused by the signature policy.
+	VerifySignature = "signature"
+	// VerifyManifest is reported for images whose manifest or fragment does not parse.
+	VerifyManifest = "manifest"
+	// VerifyConflict is reported for fragment requests conflicting with the selected reference.
+	VerifyConflict = "conflict"
+	// VerifyCollision is reported for assets provided by multiple images.
+	VerifyCollision = "collision"
+)
+
+// ProfileVerification is the outcome of an end-to-end profile verification.
+type ProfileVerification struct {
+	// Images are the verified images, in apply order, including the ones
+	// requested by profile fragments.
+	Images []GraphNode `json:"images"`
+	// Problems are the issues found; the profile is valid if there are none.
+	Problems []VerifyProblem `json:"problems"`
+}
+
+// VerifyProblem is an issue found while verifying a profile.
+type VerifyProblem struct {
+	Kind      string `json:"kind"`
+	Image     string `json:"image"`
+	Reference string `json:"reference,omitempty"`
+	Message   string `json:"message"`
+}
+
+// VerifyProfile checks end-to-end that the pinned `images` of a profile
+// would apply: every image is pinned, and available in a store or
+// fetchable from its remote, archives match their digests and the signature
+// policy, manifests and fragments parse, fragment requests do not conflict
+// and assets do not collide. Remotes from `rc` (which may be nil) are used
+// for images missing from stores, and to check published digests.
+func VerifyProfile(ctx context.Context, cc *CommonConfig, images []Image, rc *RemotesCache) (*ProfileVerification, error) {
+	if cc == nil {
+		return nil, errors.New("missing common configuration")
+	}
+	storeCache, err := NewStoreCache(cc.StorePaths)
+	if err != nil {
+		return nil, err
+	}
+
+	images = cc.FilterRecommends(images)
+	profileImages := make(map[string]bool, len(images))
+	for _, im := range images {
+		profileImages[im.Name] = true
+	}
+
+	graph := &ProfileGraph{
+		Nodes: []GraphNode{},
+		Edges: []GraphEdge{},
+	}
+	problems := []VerifyProblem{}
+	report := func(kind string, im Image, err error) error {
+		problems = append(problems, VerifyProblem{kind, im.Name, im.Reference, err.Error()})
+		return err
+	}
+
+	// Problems are recorded on each image, thus the overall result is ignored.
+	_, _ = resolveImages(images, func(im Image) (Image, []Image, error) {
+		node := GraphNode{
+			Name:      im.Name,
+			Reference: im.Reference,
+			Source:    "profile",
+		}
+		if profileImages[im.Name] {
+			if IsVersionQuery(im.Reference) {
+				return im, nil, report(VerifyUnpinned, im, errors.Errorf("reference %q is not pinned", im.Reference))
+			}
+		} else {
+			node.Source = "fragment"
+			resolved, err := storeCache.ResolveVersion(im)
+			if err != nil && im.Recommended {
+				// Weak dependencies are only applied if available.
+				return im, nil, err
+			}
+			if err != nil {
+				return im, nil, report(VerifyMissing, im, err)
+			}
+			im = resolved
+			node.Reference = im.Reference
+		}
+
+		meta, err := verifyProfileImage(ctx, cc, &storeCache, rc, im, &node, report)
+		graph.Nodes = append(graph.Nodes, node)
+		if err != nil || meta == nil {
+			return im, nil, err
+		}
+		im.Provides = strings.Join(meta.Assets.Provides, " ")
+		for _, dep := range meta.Fragment {
+			if dep.Capability != "" {
+				continue
+			}
+			graph.Edges = append(graph.Edges, GraphEdge{
+				From:      im.Name,
+				To:        dep.Name,
+				Kind:      fragmentEdgeKind(dep),
+				Reference: dep.Reference,
+			})
+		}
+		return im, cc.FilterRecommends(meta.Fragment), nil
+	})
+
+	graph.markConflicts()
+	graph.addCollisions()
+	for _, e := range graph.Edges {
+		switch e.Kind {
+		case GraphEdgeConflicts:
+			problems = append(problems, VerifyProblem{VerifyConflict, e.From, "",
+				"profile fragment requests " + e.To + ":" + e.Reference + ", a different reference is selected"})
+		case GraphEdgeCollides:
+			problems = append(problems, VerifyProblem{VerifyCollision, e.From, "",
+				"asset " + e.Asset + " is already provided by " + e.To})
+		}
+	}
+
+	return &ProfileVerification{
+		Images:   graph.Nodes,
+		Problems: problems,
+	}, nil
+}
+
+// verifyProfileImage verifies a single pinned image, from its store archive
+// or its remote, returning its metadata (nil if it can not be inspected).
+func verifyProfileImage(ctx context.Context, cc *CommonConfig, storeCache *StoreCache, rc *RemotesCache, im Image, node *GraphNode, report func(string, Image, error) error) (*ImageMetadata, error) {
+	archive, err := storeCache.ArchiveFor(im)
+	if err != nil {
+		return verifyRemoteImage(ctx, rc, im, node, report)
+	}
+	node.Store = filepath.Dir(archive.Filepath)
+	node.Filepath = archive.Filepath
+	node.Format = archive.Format
+
+	if err := verifyArchive(archive); err != nil {
+		return nil, report(VerifyDigest, im, err)
+	}
+	if rc != nil && im.Remote != "" {
+		if _, _, hash, err := rc.CheckAvailable(im); err == nil && hash != "" {
+			valid, err := validateHash(archive.Filepath, hash)
+			if err != nil {
+				return nil, report(VerifyDigest, im, err)
+			}
+			if !valid {
+				return nil, report(VerifyDigest, im, errors.Errorf("archive does not match hash %s published by remote %s", hash, im.Remote))
+			}
+		}
+	}
+	if err := enforceSignaturePolicy(cc, archive); err != nil {
+		return nil, report(VerifySignature, im, err)
+	}
+
+	meta, err := ReadArchiveMetadata(archive)
+	if err == ErrInspectUnsupported {
+		if rc == nil || im.Remote == "" {
+			node.Error = err.Error()
+			return nil, nil
+		}
+		meta, err = rc.FetchMetadata(ctx, im)
+		if err == ErrNoPublishedManifest {
+			node.Error = err.Error()
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, report(VerifyManifest, im, err)
+	}
+	node.Assets = &meta.Assets
+	return meta, nil
+}
+
+// verifyRemoteImage verifies an image missing from stores is fetchable,
+// returning its published metadata, if any.
+func verifyRemoteImage(ctx context.Context, rc *RemotesCache, im Image, node *GraphNode, report func(string, Image, error) error) (*ImageMetadata, error) {
+	if rc == nil || im.Remote == "" {
+		return nil, report(VerifyMissing, im, errors.New("image not found in stores"))
+	}
+	if err := rc.Policy.Check(im); err != nil {
+		return nil, report(VerifyMissing, im, err)
+	}
+	_, location, _, err := rc.CheckAvailable(im)
+	if err == nil && location == nil {
+		err = errors.Errorf("image not found in stores nor in remote %s", im.Remote)
+	}
+	if err != nil {
+		return nil, report(VerifyMissing, im, err)
+	}
+
+	meta, err := rc.FetchMetadata(ctx, im)
+	if err == ErrNoPublishedManifest {
+		node.Error = "fetchable, " + err.Error()
+		return nil, nil
+	}
+	if err != nil {
+		return nil, report(VerifyManifest, im, err)
+	}
+	node.Assets = &meta.Assets
+	return meta, nil
+}
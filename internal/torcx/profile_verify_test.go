@@ -0,0 +1,85 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyProfile(t *testing.T) {
+	dir := t.TempDir()
+	storeDir := filepath.Join(dir, "store")
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTgz(t, filepath.Join(storeDir, "foo:1.torcx.tgz"), map[string]string{
+		".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/tool"]}}`,
+		".torcx/profile.json":  `{"kind": "profile-manifest-v0", "value": {"images": [{"name": "dep", "reference": "2"}]}}`,
+		"bin/tool":             "foo",
+	})
+	writeTestTgz(t, filepath.Join(storeDir, "bar:1.torcx.tgz"), map[string]string{
+		".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/tool"]}}`,
+		"bin/tool":             "bar",
+	})
+	corrupted := filepath.Join(storeDir, "baz:1.torcx.tgz")
+	writeTestTgz(t, corrupted, map[string]string{"bin/baz": "baz"})
+	if err := writeHashSidecar(corrupted, "sha512-00"); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := &CommonConfig{StorePaths: []string{storeDir}}
+	images := []Image{
+		{Name: "foo", Reference: "1"},
+		{Name: "bar", Reference: "1"},
+		{Name: "baz", Reference: "1"},
+		{Name: "qux", Reference: "latest"},
+		{Name: "dep", Reference: "1"},
+	}
+	verification, err := VerifyProfile(context.Background(), cc, images, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems := map[string]string{}
+	for _, p := range verification.Problems {
+		problems[p.Image] = p.Kind
+	}
+	expected := map[string]string{
+		"foo": VerifyConflict,
+		"bar": VerifyCollision,
+		"baz": VerifyDigest,
+		"qux": VerifyUnpinned,
+		"dep": VerifyMissing,
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("unexpected problems %v", verification.Problems)
+	}
+	for name, kind := range expected {
+		if problems[name] != kind {
+			t.Errorf("expected %s problem for %s, got %v", kind, name, verification.Problems)
+		}
+	}
+
+	verification, err = VerifyProfile(context.Background(), cc, images[:1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verification.Problems) != 1 || verification.Problems[0].Kind != VerifyMissing || verification.Problems[0].Image != "dep" {
+		t.Errorf("expected missing fragment dependency, got %v", verification.Problems)
+	}
+}
@@ -15,8 +15,6 @@
 package torcx
 
 import (
-	"encoding/json"
-	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -34,8 +32,36 @@ const (
 	sysUsersDir  = "/run/sysusers.d"
 	tmpFilesDir  = "/run/tmpfiles.d"
 	udevRulesDir = "/run/udev/rules.d"
+
+	// PropagationFull propagates all assets of an image into the system.
+	PropagationFull = ""
+	// PropagationPathOnly only exposes the binaries of an image via the
+	// torcx bindir, for tool-style addons: no units, networkd units,
+	// sysusers, tmpfiles nor udev rules are propagated.
+	PropagationPathOnly = "path-only"
 )
 
+// propagatedAssets returns the assets of `im` to propagate, according to
+// its propagation mode.
+func propagatedAssets(im Image, assets *Assets) (*Assets, error) {
+	switch im.Propagation {
+	case PropagationFull:
+		return assets, nil
+	case PropagationPathOnly:
+		if len(im.EnabledUnits()) > 0 {
+			return nil, errors.Errorf("units can not be enabled with %s propagation", PropagationPathOnly)
+		}
+		// SELinux labels and overlays are kept, as binaries may need them to run.
+		return &Assets{
+			Binaries:     assets.Binaries,
+			FileContexts: assets.FileContexts,
+			Provides:     assets.Provides,
+			Writable:     assets.Writable,
+		}, nil
+	}
+	return nil, errors.Errorf("unknown propagation mode %q", im.Propagation)
+}
+
 func retrieveAssets(applyCfg *ApplyConfig, imageRoot string) (*Assets, error) {
 	if applyCfg == nil {
 		return nil, errors.New("missing apply configuration")
@@ -54,43 +80,116 @@ func retrieveAssets(applyCfg *ApplyConfig, imageRoot string) (*Assets, error) {
 		return nil, err
 	}
 
-	var manifest ImageManifestV0
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	if err := json.Unmarshal(b, &manifest); err != nil {
-		return nil, err
-	}
-
-	return &manifest.Value, nil
+	return decodeImageManifest(b)
 }
 
 // propagateNetworkdUnits installs networkd unit files as runtime units (in /run/systemd/network/).
 func propagateNetworkdUnits(applyCfg *ApplyConfig, imageRoot string, units []string) error {
-	ndUnitsDir := filepath.Join(systemdDir, "network")
+	ndUnitsDir := applyCfg.systemPath(filepath.Join(systemdDir, "network"))
 	return propagateUnits(applyCfg, imageRoot, units, ndUnitsDir)
 }
 
 // propagateSystemdUnits installs systemd unit files as runtime units (in /run/systemd/system/).
 func propagateSystemdUnits(applyCfg *ApplyConfig, imageRoot string, units []string) error {
-	sdUnitsDir := filepath.Join(systemdDir, "system")
+	sdUnitsDir := applyCfg.systemPath(filepath.Join(systemdDir, "system"))
 	return propagateUnits(applyCfg, imageRoot, units, sdUnitsDir)
 }
 
+// enableSystemdUnits enables propagated systemd units as runtime units (in /run/systemd/system/).
+func enableSystemdUnits(applyCfg *ApplyConfig, units []string) error {
+	sdUnitsDir := applyCfg.systemPath(filepath.Join(systemdDir, "system"))
+	return enableUnits(sdUnitsDir, units)
+}
+
+// enableUnits enables units already propagated to `unitsDir`, by symlinking
+// them into the `.wants`/`.requires` directories of the targets listed in
+// their [Install] section (`multi-user.target` by default), like
+// `systemctl enable --runtime` would.
+func enableUnits(unitsDir string, units []string) error {
+	for _, unit := range units {
+		if unit == "" || strings.Contains(unit, "/") {
+			return errors.Errorf("invalid unit name %q", unit)
+		}
+		unitPath := filepath.Join(unitsDir, unit)
+		content, err := ioutil.ReadFile(unitPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return errors.Errorf("unit %s is not shipped by the image", unit)
+			}
+			return err
+		}
+		deps := installDependencies(string(content))
+		if len(deps) == 0 {
+			deps = []string{"multi-user.target.wants"}
+		}
+		for _, dep := range deps {
+			depDir := filepath.Join(unitsDir, dep)
+			if err := os.MkdirAll(depDir, 0755); err != nil {
+				return errors.Wrapf(err, "error creating %q", depDir)
+			}
+			link := filepath.Join(depDir, unit)
+			if _, err := os.Lstat(link); err == nil {
+				continue
+			}
+			if err := os.Symlink(filepath.Join("..", unit), link); err != nil {
+				return errors.Wrapf(err, "error enabling %s", unit)
+			}
+		}
+	}
+	return nil
+}
+
+// installDependencies returns the dependency directories (e.g.
+// "multi-user.target.wants") listed in the [Install] section of a unit.
+func installDependencies(content string) []string {
+	deps := []string{}
+	section := ""
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = line
+			continue
+		}
+		if section != "[Install]" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		suffix := ""
+		switch strings.TrimSpace(kv[0]) {
+		case "WantedBy":
+			suffix = ".wants"
+		case "RequiredBy":
+			suffix = ".requires"
+		default:
+			continue
+		}
+		for _, target := range strings.Fields(kv[1]) {
+			deps = append(deps, target+suffix)
+		}
+	}
+	return deps
+}
+
 // propagateSysusersUnits installs sysusers files as runtime configuration (in /run/sysusers.d/).
 func propagateSysusersUnits(applyCfg *ApplyConfig, imageRoot string, units []string) error {
-	return propagateUnits(applyCfg, imageRoot, units, sysUsersDir)
+	return propagateUnits(applyCfg, imageRoot, units, applyCfg.systemPath(sysUsersDir))
 }
 
 // propagateTmpfilesUnits installs tmpfiles files as runtime configuration (in /run/tmpfiles.d/).
 func propagateTmpfilesUnits(applyCfg *ApplyConfig, imageRoot string, units []string) error {
-	return propagateUnits(applyCfg, imageRoot, units, tmpFilesDir)
+	return propagateUnits(applyCfg, imageRoot, units, applyCfg.systemPath(tmpFilesDir))
 }
 
 // propagateUdevRules installs udev rules as runtime configuration (in /run/udev/rules.d/).
 func propagateUdevRules(applyCfg *ApplyConfig, imageRoot string, udevRules []string) error {
-	return propagateUnits(applyCfg, imageRoot, udevRules, udevRulesDir)
+	return propagateUnits(applyCfg, imageRoot, udevRules, applyCfg.systemPath(udevRulesDir))
 }
 
 // propagateUnits installs unit assets as runtime units for systemd/networkd/etc.
@@ -118,12 +217,13 @@ func propagateUnits(applyCfg *ApplyConfig, imageRoot string, units []string, uni
 		}
 	}
 
+	vars := unitTemplateVars(applyCfg, imageRoot)
 	for _, servEntry := range units {
 		if servEntry == "" {
 			continue
 		}
 		path := filepath.Join(imageRoot, servEntry)
-		if err := symlinkUnitAsset(applyCfg, unitsDir, path); err != nil {
+		if err := symlinkUnitAsset(applyCfg, unitsDir, path, vars); err != nil {
 			return err
 		}
 	}
@@ -189,9 +289,19 @@ func symlinkBinAsset(applyCfg *ApplyConfig, binDir string, asset string) error {
 	return filepath.Walk(asset, walkFn)
 }
 
+// unitTemplateVars returns the substitutions performed on propagated unit
+// files, so that they do not need to hard-code unpack paths.
+func unitTemplateVars(applyCfg *ApplyConfig, imageRoot string) *strings.Replacer {
+	return strings.NewReplacer(
+		"@"+ImageEnvRoot+"@", imageRoot,
+		"@"+SealBindir+"@", applyCfg.RunBinDir(),
+		"@"+SealUnpackdir+"@", applyCfg.RunUnpackDir(),
+	)
+}
+
 // symlinkUnitAsset propagates a single unit or a directory of units,
 // flattening all but the last intermediate directories.
-func symlinkUnitAsset(applyCfg *ApplyConfig, unitsDir string, asset string) error {
+func symlinkUnitAsset(applyCfg *ApplyConfig, unitsDir string, asset string, vars *strings.Replacer) error {
 	if applyCfg == nil {
 		return errors.New("missing apply configuration")
 	}
@@ -250,17 +360,16 @@ func symlinkUnitAsset(applyCfg *ApplyConfig, unitsDir string, asset string) erro
 				// Do not overwrite previous assets
 				return nil
 			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return errors.Wrapf(err, "error opening %q", path)
+			}
 			fpDst, err := os.Create(hostPath)
 			if err != nil {
 				return errors.Wrapf(err, "error creating %q", hostPath)
 			}
 			defer fpDst.Close()
-			fpSrc, err := os.Open(path)
-			if err != nil {
-				return errors.Wrapf(err, "error opening %q", path)
-			}
-			defer fpSrc.Close()
-			if _, err := io.Copy(fpDst, fpSrc); err != nil {
+			if _, err := vars.WriteString(fpDst, string(content)); err != nil {
 				return errors.Wrapf(err, "error copying to %q", hostPath)
 			}
 			return nil
@@ -0,0 +1,120 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPropagateUnitsTemplating(t *testing.T) {
+	dir := t.TempDir()
+	applyCfg := &ApplyConfig{CommonConfig: CommonConfig{RunDir: filepath.Join(dir, "run")}}
+	imageRoot := filepath.Join(applyCfg.RunUnpackDir(), "foo")
+	unit := filepath.Join(imageRoot, "lib", "systemd", "system", "foo.service")
+	if err := os.MkdirAll(filepath.Dir(unit), 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := "[Service]\nExecStart=@TORCX_IMAGE_ROOT@/bin/foo --bindir=@TORCX_BINDIR@ --unpack=@TORCX_UNPACKDIR@ @OTHER@\n"
+	if err := ioutil.WriteFile(unit, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unitsDir := filepath.Join(dir, "systemd")
+	if err := propagateUnits(applyCfg, imageRoot, []string{"/lib/systemd/system/foo.service"}, unitsDir); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(unitsDir, "foo.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[Service]\nExecStart=" + imageRoot + "/bin/foo --bindir=" + applyCfg.RunBinDir() + " --unpack=" + applyCfg.RunUnpackDir() + " @OTHER@\n"
+	if string(b) != expected {
+		t.Errorf("expected %q, got %q", expected, string(b))
+	}
+}
+
+func TestEnableUnits(t *testing.T) {
+	unitsDir := t.TempDir()
+	units := map[string]string{
+		"foo.service": "[Unit]\nDescription=foo\n\n[Install]\nWantedBy=multi-user.target sockets.target\nRequiredBy=bar.target\n",
+		"bar.service": "[Service]\nExecStart=/bin/bar\n",
+	}
+	for name, content := range units {
+		if err := ioutil.WriteFile(filepath.Join(unitsDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := enableUnits(unitsDir, []string{"foo.service", "bar.service"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{
+		"multi-user.target.wants/foo.service",
+		"sockets.target.wants/foo.service",
+		"bar.target.requires/foo.service",
+		"multi-user.target.wants/bar.service",
+	} {
+		dest, err := os.Readlink(filepath.Join(unitsDir, link))
+		if err != nil {
+			t.Errorf("missing %s: %s", link, err)
+			continue
+		}
+		if expected := filepath.Join("..", filepath.Base(link)); dest != expected {
+			t.Errorf("%s: expected link to %s, got %s", link, expected, dest)
+		}
+	}
+	// Enabling is idempotent.
+	if err := enableUnits(unitsDir, []string{"foo.service"}); err != nil {
+		t.Error(err)
+	}
+	if err := enableUnits(unitsDir, []string{"missing.service"}); err == nil {
+		t.Error("expected error for a unit not shipped by the image")
+	}
+}
+
+func TestPropagatedAssets(t *testing.T) {
+	assets := &Assets{
+		Binaries: []string{"/bin/foo"},
+		Units:    []string{"/lib/systemd/system/foo.service"},
+		Network:  []string{"/lib/systemd/network/foo.network"},
+		Tmpfiles: []string{"/lib/tmpfiles.d/foo.conf"},
+	}
+
+	full, err := propagatedAssets(Image{Name: "foo"}, assets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full != assets {
+		t.Errorf("expected all assets for full propagation, got %v", full)
+	}
+
+	pathOnly, err := propagatedAssets(Image{Name: "foo", Propagation: PropagationPathOnly}, assets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pathOnly.Binaries) != 1 || len(pathOnly.Units) != 0 || len(pathOnly.Network) != 0 || len(pathOnly.Tmpfiles) != 0 {
+		t.Errorf("expected only binaries for path-only propagation, got %v", pathOnly)
+	}
+
+	if _, err := propagatedAssets(Image{Name: "foo", Propagation: PropagationPathOnly, Enable: "foo.service"}, assets); err == nil {
+		t.Error("expected enabled units to be refused with path-only propagation")
+	}
+	if _, err := propagatedAssets(Image{Name: "foo", Propagation: "bogus"}, assets); err == nil {
+		t.Error("expected unknown propagation mode to be refused")
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+const (
+	// publishedManifestSuffix is appended to archive names for the image
+	// manifest published alongside them.
+	publishedManifestSuffix = ".manifest.json"
+	// publishedFragmentSuffix is appended to archive names for the profile
+	// fragment published alongside them.
+	publishedFragmentSuffix = ".fragment.json"
+)
+
+// PublishRemote scans `dir` for archives and writes in it a contents
+// manifest listing them, clearsigned by `signer` (if not nil), ready to be
+// uploaded as a remote. Image manifests and profile fragments of tgz
+// archives are published alongside them. When updating a previously
+// published manifest, default versions and per-version notes and digest
+// locations are kept. The written manifest is returned.
+func PublishRemote(dir string, signer *openpgp.Entity) (*RemoteContentsV1JSON, error) {
+	archives, err := scanStoreDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := remoteContents(archives, func(path string, fi os.FileInfo) (string, error) {
+		return computeHash(path)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	manifestPath := filepath.Join(dir, remoteContentsName)
+	previous, err := readPublishedContents(manifestPath)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+	if previous != nil {
+		mergePublished(&contents, previous)
+	}
+
+	if err := publishMetadata(dir, &contents); err != nil {
+		return nil, err
+	}
+
+	b, err := encodeContents(contents, signer)
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := manifestPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, manifestPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"path":   manifestPath,
+		"images": len(contents.Value.Images),
+		"signed": signer != nil,
+	}).Debug("remote contents published")
+	return &contents, nil
+}
+
+// remoteContents builds a contents manifest listing `archives` at their
+// file name, relative to the remote base URL, hashed by `hashFn`.
+func remoteContents(archives []Archive, hashFn func(string, os.FileInfo) (string, error)) (RemoteContentsV1JSON, error) {
+	byName := map[string]*RemoteImageV1{}
+	for _, ar := range archives {
+		fi, err := os.Stat(ar.Filepath)
+		if err != nil {
+			return RemoteContentsV1JSON{}, err
+		}
+		hash, err := hashFn(ar.Filepath, fi)
+		if err != nil {
+			return RemoteContentsV1JSON{}, errors.Wrapf(err, "hashing %s", ar.Filepath)
+		}
+		entry, ok := byName[ar.Name]
+		if !ok {
+			entry = &RemoteImageV1{Name: ar.Name, Versions: []RemoteVersionV1{}}
+			byName[ar.Name] = entry
+		}
+		entry.Versions = append(entry.Versions, RemoteVersionV1{
+			Format:   string(ar.Format),
+			Hash:     hash,
+			Location: filepath.Base(ar.Filepath),
+			Version:  ar.Reference,
+			Size:     fi.Size(),
+		})
+	}
+
+	contents := RemoteContentsV1JSON{
+		Kind:  RemoteContentsV1K,
+		Value: RemoteImagesV1{Images: []RemoteImageV1{}},
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry := byName[name]
+		sort.Slice(entry.Versions, func(i, j int) bool {
+			if c := CompareVersions(entry.Versions[i].Version, entry.Versions[j].Version); c != 0 {
+				return c < 0
+			}
+			return entry.Versions[i].Format < entry.Versions[j].Format
+		})
+		contents.Value.Images = append(contents.Value.Images, *entry)
+	}
+	return contents, nil
+}
+
+// encodeContents serializes a contents manifest, clearsigned by `signer` if not nil.
+func encodeContents(contents RemoteContentsV1JSON, signer *openpgp.Entity) ([]byte, error) {
+	return encodeSignedJSON(contents, signer)
+}
+
+// encodeSignedJSON serializes `v` as indented JSON, clearsigned by `signer`
+// if not nil.
+func encodeSignedJSON(v interface{}, signer *openpgp.Entity) ([]byte, error) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, '\n')
+	if signer == nil {
+		return b, nil
+	}
+	var signed bytes.Buffer
+	wr, err := clearsign.Encode(&signed, signer.PrivateKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := wr.Write(b); err != nil {
+		return nil, err
+	}
+	if err := wr.Close(); err != nil {
+		return nil, err
+	}
+	return signed.Bytes(), nil
+}
+
+// readPublishedContents reads a previously published contents manifest at
+// `path`, without verifying its signature as it is only used as a base.
+func readPublishedContents(path string) (*RemoteContentsV1JSON, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := clearsign.Decode(b); block != nil {
+		b = block.Plaintext
+	}
+	var contents RemoteContentsV1JSON
+	if err := json.Unmarshal(b, &contents); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s", path)
+	}
+	if contents.Kind != RemoteContentsV1K {
+		return nil, errors.Errorf("invalid manifest kind: %s", contents.Kind)
+	}
+	return &contents, nil
+}
+
+// mergePublished carries over the entries of a previous manifest not
+// derived from archives: default versions, and notes and digest locations
+// of versions still published with the same hash.
+func mergePublished(contents *RemoteContentsV1JSON, previous *RemoteContentsV1JSON) {
+	type versionKey struct{ name, version, format, hash string }
+	defaults := map[string]string{}
+	versions := map[versionKey]RemoteVersionV1{}
+	for _, im := range previous.Value.Images {
+		defaults[im.Name] = im.DefaultVersion
+		for _, v := range im.Versions {
+			versions[versionKey{im.Name, v.Version, v.Format, v.Hash}] = v
+		}
+	}
+	for i, im := range contents.Value.Images {
+		contents.Value.Images[i].DefaultVersion = defaults[im.Name]
+		for j, v := range im.Versions {
+			old, ok := versions[versionKey{im.Name, v.Version, v.Format, v.Hash}]
+			if !ok {
+				continue
+			}
+			entry := &contents.Value.Images[i].Versions[j]
+			entry.Notes = old.Notes
+			entry.NotesURL = old.NotesURL
+			entry.DigestLocation = old.DigestLocation
+		}
+	}
+}
+
+// publishMetadata writes the image manifest and profile fragment of each
+// tarball archive listed in `contents` next to it, recording their locations.
+func publishMetadata(dir string, contents *RemoteContentsV1JSON) error {
+	for i, im := range contents.Value.Images {
+		for j, v := range im.Versions {
+			format := ArchiveFormat(v.Format)
+			if !format.isTarball() {
+				continue
+			}
+			archivePath := filepath.Join(dir, v.Location)
+			meta, err := ReadArchiveMetadata(Archive{Filepath: archivePath, Format: format})
+			if err != nil {
+				return err
+			}
+			entry := &contents.Value.Images[i].Versions[j]
+			entry.ManifestLocation = v.Location + publishedManifestSuffix
+			if err := writeJSONFile(archivePath+publishedManifestSuffix, ImageManifestV0{ImageManifestV0K, meta.Assets}); err != nil {
+				return err
+			}
+			if len(meta.Fragment) == 0 {
+				continue
+			}
+			entry.FragmentLocation = v.Location + publishedFragmentSuffix
+			fragment := ProfileManifestV1JSON{ProfileManifestV1K, ImagesToJSONV1(meta.Fragment)}
+			if err := writeJSONFile(archivePath+publishedFragmentSuffix, fragment); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeJSONFile writes `value` as indented JSON at `path`.
+func writeJSONFile(path string, value interface{}) error {
+	b, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestPublishRemote(t *testing.T) {
+	dir := t.TempDir()
+	writeTestTgz(t, filepath.Join(dir, "foo:1.torcx.tgz"), map[string]string{
+		".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/foo"]}}`,
+		".torcx/profile.json":  `{"kind": "profile-manifest-v1", "value": {"images": [{"name": "bar", "reference": "2"}]}}`,
+		"bin/foo":              "foo",
+	})
+	writeTestTgz(t, filepath.Join(dir, "foo:10.torcx.tgz"), map[string]string{"bin/foo": "foo10"})
+	signer := writeTrustedKey(t, filepath.Join(t.TempDir(), "key.asc"))
+
+	contents, err := PublishRemote(dir, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contents.Value.Images) != 1 || len(contents.Value.Images[0].Versions) != 2 {
+		t.Fatalf("unexpected contents %+v", contents.Value)
+	}
+	v1 := contents.Value.Images[0].Versions[0]
+	if v1.Version != "1" || v1.ManifestLocation != "foo:1.torcx.tgz.manifest.json" || v1.FragmentLocation != "foo:1.torcx.tgz.fragment.json" {
+		t.Errorf("unexpected version entry %+v", v1)
+	}
+	fragment, err := ReadProfilePath(filepath.Join(dir, v1.FragmentLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fragment) != 1 || fragment[0].Name != "bar" {
+		t.Errorf("unexpected published fragment %v", fragment)
+	}
+
+	// Entries not derived from archives are kept on update.
+	contents.Value.Images[0].DefaultVersion = "10"
+	contents.Value.Images[0].Versions[1].Notes = "bump"
+	b, err := encodeContents(*contents, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, remoteContentsName), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PublishRemote(dir, signer); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = ioutil.ReadFile(filepath.Join(dir, remoteContentsName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := verifyManifest("test", string(b), []openpgp.KeyRing{openpgp.EntityList{signer}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	published, err := decodeContents(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := published.Images["foo"]
+	if image.defaultVersion != "10" {
+		t.Errorf("default version not kept: %q", image.defaultVersion)
+	}
+	for _, v := range image.versions {
+		if v.version == "10" && v.notes != "bump" {
+			t.Errorf("notes not kept: %+v", v)
+		}
+	}
+}
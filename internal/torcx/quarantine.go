@@ -0,0 +1,178 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// quarantineDir is the store subdirectory holding rejected archives.
+	quarantineDir = ".quarantine"
+	// reasonSuffix is appended to quarantined archive paths for the file
+	// recording why they were rejected.
+	reasonSuffix = ".reason"
+)
+
+// ErrArchiveUnverified is returned when the signature policy rejects an
+// unsigned or unverifiable archive.
+var ErrArchiveUnverified = errors.New("archive signature not verified")
+
+// QuarantinedArchive is an archive moved out of its store by policy.
+type QuarantinedArchive struct {
+	Archive
+	// Store is the store directory the archive was moved out of.
+	Store string `json:"store"`
+	// Reason explains why the archive was rejected.
+	Reason string `json:"reason"`
+	// Time is when the archive was quarantined.
+	Time time.Time `json:"time"`
+}
+
+// QuarantineArchive moves `ar` (with its sidecars) into the quarantine
+// directory of its store, recording `reason`, so that it is no longer
+// picked up by applies. It returns the quarantined archive path.
+func QuarantineArchive(cc *CommonConfig, ar Archive, reason string) (string, error) {
+	storeDir := filepath.Dir(ar.Filepath)
+	if !isWritableStore(cc, storeDir) {
+		return "", errors.Errorf("store %s is not writable", storeDir)
+	}
+	qDir := filepath.Join(storeDir, quarantineDir)
+	if err := os.MkdirAll(qDir, 0755); err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(ar.Filepath)
+	target := filepath.Join(qDir, name)
+	if err := ioutil.WriteFile(target+reasonSuffix, []byte(reason+"\n"), 0644); err != nil {
+		return "", errors.Wrap(err, "writing quarantine reason")
+	}
+	if err := os.Rename(ar.Filepath, target); err != nil {
+		_ = os.Remove(target + reasonSuffix)
+		return "", errors.Wrap(err, "moving archive to quarantine")
+	}
+	for _, suffix := range []string{hashSidecarSuffix, signatureSidecarSuffix, timestampSidecarSuffix, metaSidecarSuffix} {
+		if err := os.Rename(ar.Filepath+suffix, target+suffix); err != nil && !os.IsNotExist(err) {
+			return target, errors.Wrap(err, "moving archive sidecar to quarantine")
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"path":   ar.Filepath,
+		"reason": reason,
+	}).Warn("archive quarantined")
+	return target, nil
+}
+
+// ListQuarantined returns all quarantined archives in writable stores.
+func ListQuarantined(cc *CommonConfig) ([]QuarantinedArchive, error) {
+	entries := []QuarantinedArchive{}
+	for _, storeDir := range cc.WritableStorePaths() {
+		qDir := filepath.Join(storeDir, quarantineDir)
+		files, err := ioutil.ReadDir(qDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, fi := range files {
+			ar, ok := scanStoreEntry(qDir, fi)
+			if !ok {
+				continue
+			}
+			entry := QuarantinedArchive{
+				Archive: ar,
+				Store:   storeDir,
+				Time:    fi.ModTime(),
+			}
+			if info, err := os.Stat(ar.Filepath + reasonSuffix); err == nil {
+				entry.Time = info.ModTime()
+			}
+			if b, err := ioutil.ReadFile(ar.Filepath + reasonSuffix); err == nil {
+				entry.Reason = strings.TrimSpace(string(b))
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// RestoreQuarantined moves all quarantined archives for `im` back into
+// their stores, returning the restored archive paths. Restored archives
+// are still subject to the signature policy when applied.
+func RestoreQuarantined(cc *CommonConfig, im Image) ([]string, error) {
+	entries, err := ListQuarantined(cc)
+	if err != nil {
+		return nil, err
+	}
+
+	restored := []string{}
+	for _, entry := range entries {
+		if entry.Name != im.Name || entry.Reference != im.Reference {
+			continue
+		}
+		target := filepath.Join(entry.Store, filepath.Base(entry.Filepath))
+		if IsExistingPath(target) {
+			return restored, errors.Errorf("archive %s already exists in the store", target)
+		}
+		for _, suffix := range []string{hashSidecarSuffix, signatureSidecarSuffix, timestampSidecarSuffix, metaSidecarSuffix} {
+			if err := os.Rename(entry.Filepath+suffix, target+suffix); err != nil && !os.IsNotExist(err) {
+				return restored, err
+			}
+		}
+		if err := os.Rename(entry.Filepath, target); err != nil {
+			return restored, err
+		}
+		if err := os.Remove(entry.Filepath + reasonSuffix); err != nil && !os.IsNotExist(err) {
+			return restored, err
+		}
+		restored = append(restored, target)
+	}
+	if len(restored) == 0 {
+		return nil, errors.Errorf("image %s:%s not found in quarantine", im.Name, im.Reference)
+	}
+	return restored, nil
+}
+
+// quarantineRejected quarantines an archive rejected by the signature
+// policy, on a best-effort basis (e.g. read-only stores are left untouched).
+func quarantineRejected(applyCfg *ApplyConfig, ar Archive, reason error) {
+	if errors.Cause(reason) != ErrArchiveUnverified {
+		return
+	}
+	target, err := QuarantineArchive(&applyCfg.CommonConfig, ar, reason.Error())
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"path":  ar.Filepath,
+			"error": err,
+		}).Warn("unable to quarantine rejected archive")
+		return
+	}
+	rejected := ar.Image
+	applyCfg.warn(Warning{
+		Kind:    WarningQuarantinedArchive,
+		Message: reason.Error(),
+		Image:   &rejected,
+		Path:    target,
+	})
+}
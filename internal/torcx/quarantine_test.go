@@ -0,0 +1,92 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_quarantine_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cc := &CommonConfig{
+		BaseDir:             filepath.Join(dir, "base"),
+		ConfDir:             filepath.Join(dir, "conf"),
+		UsrDir:              filepath.Join(dir, "usr"),
+		RequireSignedImages: true,
+	}
+	userStore := cc.UserStorePath("")
+	cc.StorePaths = []string{userStore}
+	if err := os.MkdirAll(userStore, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ar := Archive{Image: Image{Name: "foo", Reference: "1"}, Filepath: filepath.Join(userStore, "foo:1.torcx.tgz"), Format: ArchiveFormatTgz}
+	if err := ioutil.WriteFile(ar.Filepath, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(ar.Filepath+hashSidecarSuffix, []byte("sha512-00"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeTrustedKey(t, filepath.Join(cc.ConfDir, "trusted-keys.d", "test.asc"))
+
+	perr := enforceSignaturePolicy(cc, ar)
+	if perr == nil {
+		t.Fatal("expected unsigned archive to be rejected")
+	}
+	applyCfg := &ApplyConfig{CommonConfig: *cc}
+	quarantineRejected(applyCfg, ar, perr)
+	if len(applyCfg.Warnings) != 1 || applyCfg.Warnings[0].Kind != WarningQuarantinedArchive {
+		t.Errorf("unexpected warnings %+v", applyCfg.Warnings)
+	}
+	if IsExistingPath(ar.Filepath) || IsExistingPath(ar.Filepath+hashSidecarSuffix) {
+		t.Error("rejected archive left in the store")
+	}
+	sc, err := NewStoreCache(cc.StorePaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sc.ArchiveFor(ar.Image); err == nil {
+		t.Error("quarantined archive still in store cache")
+	}
+
+	entries, err := ListQuarantined(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "foo" || entries[0].Store != userStore || entries[0].Reason != perr.Error() {
+		t.Fatalf("unexpected quarantine entries %+v", entries)
+	}
+
+	if _, err := RestoreQuarantined(cc, Image{Name: "foo", Reference: "2"}); err == nil {
+		t.Error("expected error restoring missing image")
+	}
+	restored, err := RestoreQuarantined(cc, ar.Image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 1 || restored[0] != ar.Filepath || !IsExistingPath(ar.Filepath+hashSidecarSuffix) {
+		t.Errorf("unexpected restore %v", restored)
+	}
+	if entries, _ := ListQuarantined(cc); len(entries) != 0 {
+		t.Errorf("unexpected entries after restore %+v", entries)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// sealQueries maps query keys to seal labels.
+	sealQueries = map[string]string{
+		"bindir":        SealBindir,
+		"unpackdir":     SealUnpackdir,
+		"profile-path":  SealRunProfilePath,
+		"upper-profile": SealUpperProfile,
+		"os-version":    SealOsVersionID,
+	}
+	// imageQueries maps per-image query keys to image environment labels.
+	imageQueries = map[string]string{
+		"unpackdir": ImageEnvRoot,
+		"reference": ImageEnvVersion,
+		"requested": ImageEnvReference,
+		"digest":    ImageEnvDigest,
+		"archive":   ImageEnvArchive,
+	}
+)
+
+// QueryKeys returns the supported query keys, and the ones taking an image name.
+func QueryKeys() ([]string, []string) {
+	keys, imageKeys := []string{}, []string{}
+	for k := range sealQueries {
+		keys = append(keys, k)
+	}
+	for k := range imageQueries {
+		imageKeys = append(imageKeys, k)
+	}
+	sort.Strings(keys)
+	sort.Strings(imageKeys)
+	return keys, imageKeys
+}
+
+// Query looks up a single value of the sealed system state. If `image` is
+// not empty, the value is looked up for that applied image.
+func Query(key string, image string) (string, error) {
+	return queryMetadata(RootPath(SealPath), key, image)
+}
+
+// queryMetadata implements Query against the seal file at `sealPath`.
+func queryMetadata(sealPath string, key string, image string) (string, error) {
+	path, label := sealPath, sealQueries[key]
+	if image != "" {
+		label = imageQueries[key]
+		path = filepath.Join(filepath.Dir(sealPath), imageEnvPrefix+imagePathName(image))
+	}
+	if label == "" {
+		if image != "" {
+			return "", errors.Errorf("unknown image query key %q", key)
+		}
+		return "", errors.Errorf("unknown query key %q", key)
+	}
+
+	if image != "" && !IsExistingPath(path) {
+		if !IsExistingPath(sealPath) {
+			return "", errors.New("no active profile")
+		}
+		return "", errors.Errorf("image %s not applied", image)
+	}
+	meta, err := ReadMetadata(path)
+	if err != nil {
+		return "", err
+	}
+	value, ok := meta[label]
+	if !ok {
+		return "", errors.Errorf("%s not found in %s", label, path)
+	}
+	return value, nil
+}
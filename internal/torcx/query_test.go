@@ -0,0 +1,76 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueryMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_query_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sealPath := filepath.Join(dir, "torcx")
+	if _, err := queryMetadata(sealPath, "bindir", ""); err == nil {
+		t.Error("expected failure without seal")
+	}
+
+	seal := SealBindir + "=\"/run/torcx/bin\"\n" + SealUnpackdir + "=\"/run/torcx/unpack\"\n"
+	if err := ioutil.WriteFile(sealPath, []byte(seal), 0644); err != nil {
+		t.Fatal(err)
+	}
+	applied := []AppliedImage{{Image: Image{Name: "docker", Reference: "19.03"}, Requested: "stable", Root: "/run/torcx/unpack/docker"}}
+	if err := writeImageEnvFiles(dir, applied); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key      string
+		image    string
+		expected string
+	}{
+		{"bindir", "", "/run/torcx/bin"},
+		{"unpackdir", "", "/run/torcx/unpack"},
+		{"unpackdir", "docker", "/run/torcx/unpack/docker"},
+		{"reference", "docker", "19.03"},
+		{"requested", "docker", "stable"},
+	}
+	for _, tt := range tests {
+		value, err := queryMetadata(sealPath, tt.key, tt.image)
+		if err != nil {
+			t.Errorf("%s %s: %s", tt.key, tt.image, err)
+			continue
+		}
+		if value != tt.expected {
+			t.Errorf("%s %s: expected %q, got %q", tt.key, tt.image, tt.expected, value)
+		}
+	}
+
+	if _, err := queryMetadata(sealPath, "reference", "rkt"); err == nil {
+		t.Error("expected failure for image not applied")
+	}
+	if _, err := queryMetadata(sealPath, "reference", ""); err == nil {
+		t.Error("expected failure for image key without image")
+	}
+	if _, err := queryMetadata(sealPath, "bogus", ""); err == nil {
+		t.Error("expected failure for unknown key")
+	}
+}
@@ -30,7 +30,6 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
-	"time"
 
 	"github.com/euank/gotmpl"
 	"github.com/northbright/ctx/ctxcopy"
@@ -95,7 +94,7 @@ func (r *Remote) evaluateURL(usrMountpoint string) (*url.URL, error) {
 
 // contentsURL returns the full evaluated URL to the remote contents manifest.
 func (r *Remote) contentsURL(usrMountpoint string) (*url.URL, error) {
-	manifestName, err := url.Parse("torcx_remote_contents.json.asc")
+	manifestName, err := url.Parse(remoteContentsName)
 	if err != nil {
 		return nil, err
 	}
@@ -182,33 +181,92 @@ type RemotesCache struct {
 	Contents      map[string]RemoteContents
 	Paths         map[string]string
 	UsrMountpoint string
+	// Observer receives fetch progress events, if set.
+	Observer FetchObserver
+	// Transport is used for all HTTP requests to remotes, if set.
+	Transport http.RoundTripper
+	// Policy restricts which images may be fetched, if set.
+	Policy *FetchPolicy
+	// CacheDir is where verified contents manifests are cached, if set.
+	CacheDir string
+	// Pins are the expected digests of contents manifests, by remote name.
+	Pins map[string]string
+	// Digests are the digests of the fetched contents manifests.
+	Digests map[string]string
+	// Signers are the key IDs which signed the contents manifests.
+	Signers map[string]string
+	// Audit records fetched archives, if set, see FetchAudit.
+	Audit *FetchAudit
+	// AuditLog is the local fetch audit log.
+	AuditLog string
 }
 
 // NewRemotesCache constructs a new RemotesCache
 func NewRemotesCache(ctx context.Context, usrMountpoint string, baseDirs []string, remotesFilter []string) (*RemotesCache, error) {
 	rc := RemotesCache{
-		Configs:       map[string]Remote{},
-		Contents:      map[string]RemoteContents{},
-		Paths:         map[string]string{},
 		UsrMountpoint: usrMountpoint,
 	}
+	if err := rc.Load(ctx, baseDirs, remotesFilter); err != nil {
+		return nil, err
+	}
+	return &rc, nil
+}
+
+// LoadRemotes constructs a new RemotesCache for `remotes` configured
+// under this configuration, using its Transport.
+func (cc *CommonConfig) LoadRemotes(ctx context.Context, remotes []string) (*RemotesCache, error) {
+	rc := RemotesCache{
+		UsrMountpoint: cc.UsrDir,
+		Transport:     cc.Transport,
+		Policy:        cc.FetchPolicy,
+		CacheDir:      cc.RemoteContentsCacheDir(),
+		Pins:          cc.RemotePins,
+		Audit:         cc.FetchAudit,
+		AuditLog:      cc.FetchAuditLog(),
+	}
+	if err := rc.Load(ctx, cc.RemotesDirs(), remotes); err != nil {
+		return nil, err
+	}
+	return &rc, nil
+}
+
+// Load processes all remotes found in `baseDirs` (restricted to
+// `remotesFilter`, if not empty), fetching and verifying their contents
+// manifests. It allows setting up a RemotesCache (e.g. with a custom
+// Transport) before any network access.
+func (rc *RemotesCache) Load(ctx context.Context, baseDirs []string, remotesFilter []string) error {
+	if rc.Configs == nil {
+		rc.Configs = map[string]Remote{}
+	}
+	if rc.Contents == nil {
+		rc.Contents = map[string]RemoteContents{}
+	}
+	if rc.Paths == nil {
+		rc.Paths = map[string]string{}
+	}
+	if rc.Digests == nil {
+		rc.Digests = map[string]string{}
+	}
+	if rc.Signers == nil {
+		rc.Signers = map[string]string{}
+	}
 
 	// Process all remote base directories and cache all remotes found.
 	for _, dir := range baseDirs {
 		glob := filepath.Join(dir, "*", "remote.json")
 		matches, err := filepath.Glob(glob)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		quotedDir := regexp.QuoteMeta(dir)
 		re, err := regexp.Compile(fmt.Sprintf(`^%s/(.*)/remote\.json$`, quotedDir))
 		if err != nil {
-			return nil, err
+			return err
 		}
 		for _, remote := range matches {
 			groups := re.FindStringSubmatch(remote)
 			if len(groups) != 2 {
-				return nil, errors.Errorf("non-unique matches: %s", groups)
+				return errors.Errorf("non-unique matches: %s", groups)
 			}
 			if groups[1] == "" {
 				continue
@@ -231,71 +289,90 @@ func NewRemotesCache(ctx context.Context, usrMountpoint string, baseDirs []strin
 
 	// Download and verify remote manifests.
 	for name, path := range rc.Paths {
-		fp, err := os.Open(path)
+		remote, err := readRemoteManifest(path)
 		if err != nil {
-			return nil, err
+			return errors.Wrapf(err, "failed to read remote %s", name)
 		}
-		defer fp.Close()
-		bufrd := bufio.NewReader(fp)
-		var jm RemoteManifestV0JSON
-		if err := json.NewDecoder(bufrd).Decode(&jm); err != nil {
-			return nil, errors.Wrapf(err, "failed to decode %s", name)
+		remote.Transport = rc.Transport
+		// Credentials passed for this remote (e.g. by ImportCredential=) are
+		// used, unless configured otherwise.
+		if remote.Credential == "" && remote.CredentialHelper == "" && hasSystemdCredential(remoteCredentialPrefix+name) {
+			remote.Credential = remoteCredentialPrefix + name
 		}
-		if jm.Kind != RemoteManifestV0K {
-			return nil, errors.Errorf("invalid manifest kind: %s", jm.Kind)
+		if remote.DiscoveryDomain != "" {
+			tmpl, err := remote.discoverTemplateURL(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "failed to discover base URL for %s", name)
+			}
+			logrus.WithFields(logrus.Fields{
+				"name":     name,
+				"base_url": tmpl,
+			}).Debug("remote discovered")
+			remote.TemplateURL = tmpl
 		}
-		remote := RemoteFromJSONV0(jm.Value)
 		rc.Configs[name] = remote
 		url, err := remote.contentsURL(rc.UsrMountpoint)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to evaluate URL for %s", name)
+			return errors.Wrapf(err, "failed to evaluate URL for %s", name)
 		}
 		keyrings, err := remote.loadKeyrings(filepath.Dir(path))
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to load keyrings for %s", name)
+			return errors.Wrapf(err, "failed to load keyrings for %s", name)
 		}
 		var manifest string
 		switch url.Scheme {
-		case "https", "http":
-			tries := 0
-			for {
-				tries++
-				tmpManifest, err := fetchManifest(ctx, url.String())
-				ctxErr := ctx.Err()
-				if err == nil && ctxErr == nil {
-					manifest = tmpManifest
-					break
-				}
-				if ctxErr != nil {
-					return nil, ctxErr
+		case "https", "http", "rsync":
+			client := remote.httpClient()
+			fields := logrus.Fields{
+				"name": name,
+				"url":  url.String(),
+			}
+			err := retryFetch(ctx, fields, func() error {
+				var err error
+				if url.Scheme == "rsync" {
+					manifest, err = rsyncManifest(ctx, url.String())
+				} else {
+					manifest, err = fetchManifest(ctx, client, url.String())
 				}
-				logrus.WithFields(logrus.Fields{
-					"attempt": tries,
-					"name":    name,
-					"error":   err,
-				}).Error("failed to fetch contents manifest")
-				time.Sleep(8 * time.Second)
+				return err
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed to fetch contents manifest for %s", name)
 			}
 		case "file":
 			path := strings.TrimPrefix(url.String(), "file://")
 			b, err := ioutil.ReadFile(filepath.Clean(path))
 			if err != nil {
-				return nil, errors.Wrapf(err, "failed to fetch contents manifest for %s", name)
+				return errors.Wrapf(err, "failed to fetch contents manifest for %s", name)
 			}
 			manifest = string(b)
 		default:
-			return nil, errors.Errorf("unsupported scheme %s", url.Scheme)
+			return errors.Errorf("unsupported scheme %s", url.Scheme)
 		}
 
-		unwrapped, err := verifyManifest(name, manifest, keyrings)
+		// Pins cover the metadata endpoint (and any mirror of it) too.
+		if err := rc.checkPin(name, manifest); err != nil {
+			return errors.Wrapf(err, "failed to verify contents manifest for %s", name)
+		}
+		rc.Digests[name] = ManifestDigest(manifest)
+		unwrapped, signer, err := verifyManifestSigner(name, manifest, keyrings)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to verify contents manifest for %s", name)
+			return errors.Wrapf(err, "failed to verify contents manifest for %s", name)
 		}
+		rc.Signers[name] = signer
 		contents, err := decodeContents(unwrapped)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to decode contents for %s", name)
+			return errors.Wrapf(err, "failed to decode contents for %s", name)
 		}
 		rc.Contents[name] = *contents
+		if rc.CacheDir != "" {
+			if err := writeCachedContents(rc.CacheDir, name, unwrapped); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"name":  name,
+					"error": err,
+				}).Warn("unable to cache contents manifest")
+			}
+		}
 
 		logrus.WithFields(logrus.Fields{
 			"name": name,
@@ -306,10 +383,53 @@ func NewRemotesCache(ctx context.Context, usrMountpoint string, baseDirs []strin
 
 	// Length sanity check.
 	if len(rc.Paths) != len(rc.Configs) || len(rc.Paths) != len(rc.Contents) {
-		return nil, errors.Errorf("length mismatch, %d vs %d vs %d", len(rc.Paths), len(rc.Configs), len(rc.Contents))
+		return errors.Errorf("length mismatch, %d vs %d vs %d", len(rc.Paths), len(rc.Configs), len(rc.Contents))
 	}
 
-	return &rc, nil
+	return nil
+}
+
+// readRemoteManifest reads the remote manifest at `path`.
+func readRemoteManifest(path string) (Remote, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return Remote{}, err
+	}
+	defer fp.Close()
+	var jm RemoteManifestV0JSON
+	if err := json.NewDecoder(bufio.NewReader(fp)).Decode(&jm); err != nil {
+		return Remote{}, errors.Wrapf(err, "failed to decode %s", path)
+	}
+	if jm.Kind != RemoteManifestV0K {
+		return Remote{}, errors.Errorf("invalid manifest kind: %s", jm.Kind)
+	}
+	if jm.Value.Credential != "" {
+		if err := validateCredentialName(jm.Value.Credential); err != nil {
+			return Remote{}, errors.Wrapf(err, "invalid remote manifest %s", path)
+		}
+	}
+	return RemoteFromJSONV0(jm.Value), nil
+}
+
+// RemoteKeyrings loads the keyrings of remote `name` from its local
+// manifest, without contacting the remote. As when loading remotes,
+// later remotes directories take precedence.
+func (cc *CommonConfig) RemoteKeyrings(name string) ([]openpgp.KeyRing, error) {
+	path := ""
+	for _, dir := range cc.RemotesDirs() {
+		candidate := filepath.Join(dir, name, "remote.json")
+		if IsExistingPath(candidate) {
+			path = candidate
+		}
+	}
+	if path == "" {
+		return nil, errors.Errorf("remote %q not found", name)
+	}
+	remote, err := readRemoteManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	return remote.loadKeyrings(filepath.Dir(path))
 }
 
 // CheckAvailable checks if a given Image is available in the configured remote.
@@ -325,11 +445,11 @@ func (rc *RemotesCache) CheckAvailable(im Image) (*url.URL, *url.URL, string, er
 
 	contents, ok := rc.Contents[im.Remote]
 	if !ok {
-		return nil, nil, "", errors.Errorf("manifest for remote %s not found: %s", im.Remote, rc)
+		return nil, nil, "", errors.Errorf("manifest for remote %s not found: %v", im.Remote, rc)
 	}
 	config, ok := rc.Configs[im.Remote]
 	if !ok {
-		return nil, nil, "", errors.Errorf("manifest for remote %s not found: %s", im.Remote, rc)
+		return nil, nil, "", errors.Errorf("manifest for remote %s not found: %v", im.Remote, rc)
 	}
 	baseURL, err := config.evaluateURL(rc.UsrMountpoint)
 	if err != nil {
@@ -347,8 +467,15 @@ func (rc *RemotesCache) CheckAvailable(im Image) (*url.URL, *url.URL, string, er
 }
 
 func verifyManifest(manifestName string, manifest string, keyrings []openpgp.KeyRing) (string, error) {
+	plaintext, _, err := verifyManifestSigner(manifestName, manifest, keyrings)
+	return plaintext, err
+}
+
+// verifyManifestSigner is verifyManifest, also returning the key ID of
+// the signer (empty for unsigned manifests accepted without keys).
+func verifyManifestSigner(manifestName string, manifest string, keyrings []openpgp.KeyRing) (string, string, error) {
 	if manifest == "" {
-		return "", errors.New("empty manifest")
+		return "", "", errors.New("empty manifest")
 	}
 	if len(keyrings) <= 0 {
 		logrus.WithFields(logrus.Fields{
@@ -362,41 +489,58 @@ func verifyManifest(manifestName string, manifest string, keyrings []openpgp.Key
 			logrus.WithFields(logrus.Fields{
 				"name": manifestName,
 			}).Warn("unsigned manifest and no keys to verify it")
-			return manifest, nil
+			return manifest, "", nil
 		}
-		return "", errors.New("no signed manifest detected")
+		return "", "", errors.New("no signed manifest detected")
 	}
 	if len(trailer) != 0 {
-		return "", errors.New("trailing data after signed manifest")
+		return "", "", errors.New("trailing data after signed manifest")
 	}
 	if signedBlock.ArmoredSignature == nil {
-		return "", errors.New("no clearsign data to verify")
+		return "", "", errors.New("no clearsign data to verify")
 	}
 	if len(signedBlock.Plaintext) <= 0 {
-		return "", errors.New("no plaintext to verify")
+		return "", "", errors.New("no plaintext to verify")
 	}
 
-	for _, kr := range keyrings {
-		if _, err := openpgp.CheckDetachedSignature(kr, bytes.NewReader(signedBlock.Bytes), signedBlock.ArmoredSignature.Body); err == nil {
-			return string(signedBlock.Plaintext), nil
+	sig, err := ioutil.ReadAll(signedBlock.ArmoredSignature.Body)
+	if err != nil {
+		return "", "", errors.Wrap(err, "reading manifest signature")
+	}
+	lastErr := errors.New("no keys to verify manifest")
+	for i, kr := range keyrings {
+		signer, err := checkSignature(kr, bytes.NewReader(signedBlock.Bytes), bytes.NewReader(sig))
+		if err == nil {
+			return string(signedBlock.Plaintext), signer.PrimaryKey.KeyIdString(), nil
+		}
+		if i == 0 {
+			lastErr = err
+		} else {
+			lastErr = preferSignatureError(lastErr, err)
 		}
 	}
 
-	return "", errors.New("unable to verify contents manifest")
+	return "", "", errors.Wrap(lastErr, "unable to verify contents manifest")
 }
 
-func fetchManifest(ctx context.Context, urlRaw string) (string, error) {
+func fetchManifest(ctx context.Context, client *http.Client, urlRaw string) (string, error) {
 	var manifest bytes.Buffer
 	req, err := http.NewRequest("GET", urlRaw, nil)
 	if err != nil {
 		return "", err
 	}
+	// Manifests are mutable, caches must revalidate them.
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("Cache-Control", "no-cache")
 
-	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
+	if err := checkHTTPStatus(resp); err != nil {
+		return "", err
+	}
 	buf := make([]byte, 32*1024)
 	if err := ctxcopy.Copy(ctx, &manifest, resp.Body, buf); err != nil {
 		return "", err
@@ -424,6 +568,9 @@ func decodeContents(manifest string) (*RemoteContents, error) {
 		return &value, nil
 	}
 
+	if err := futureKind(container.Kind, container.MinTorcxVersion); err != nil {
+		return nil, err
+	}
 	return nil, errors.Errorf("invalid manifest kind: %s", container.Kind)
 }
 
@@ -450,11 +597,23 @@ func (rcs *RemoteContents) CheckAvailable(im Image) (*url.URL, string, error) {
 			if vers.location == "" {
 				return nil, "", errEmptyLocation
 			}
-			path := vers.location
-			if !strings.Contains(path, "://") {
-				path = "./" + path
+			// Immutable locations are preferred, as they can be
+			// cached indefinitely by intermediate proxies. Archives
+			// are stored by file name, thus both must agree on it.
+			loc := vers.location
+			if vers.digestLocation != "" {
+				if path.Base(vers.digestLocation) == path.Base(vers.location) {
+					loc = vers.digestLocation
+				} else {
+					logrus.WithFields(logrus.Fields{
+						"name":            im.Name,
+						"reference":       im.Reference,
+						"location":        vers.location,
+						"digest_location": vers.digestLocation,
+					}).Warn("ignoring digest location with a different archive file name")
+				}
 			}
-			location, err := url.Parse(path)
+			location, err := parseLocation(loc)
 			if err != nil {
 				return nil, "", err
 			}
@@ -465,11 +624,23 @@ func (rcs *RemoteContents) CheckAvailable(im Image) (*url.URL, string, error) {
 	return nil, "", errors.Errorf("image %s:%s not found", im.Name, im.Reference)
 }
 
+// parseLocation parses a location from a contents manifest, which is
+// either relative to `base_url` or an absolute URL.
+func parseLocation(path string) (*url.URL, error) {
+	if !strings.Contains(path, "://") {
+		path = "./" + path
+	}
+	return url.Parse(path)
+}
+
 // FetchImage checks and fetch an image archive if available on a known remote.
 func (rc *RemotesCache) FetchImage(ctx context.Context, im Image, versionedStorePath string) error {
 	if rc == nil {
 		return errNilRemotesCache
 	}
+	if err := rc.Policy.Check(im); err != nil {
+		return err
+	}
 	baseURL, location, hash, err := rc.CheckAvailable(im)
 	if err != nil {
 		return err
@@ -481,40 +652,131 @@ func (rc *RemotesCache) FetchImage(ctx context.Context, im Image, versionedStore
 	switch baseURL.Scheme {
 	case "file":
 		return nil
-	case "https", "http":
-		tries := 0
-		for {
-			tries++
-			err := rc.downloadArchive(ctx, baseURL, location, versionedStorePath, hash)
-			ctxErr := ctx.Err()
-			if err == nil && ctxErr == nil {
-				return nil
-			}
-			if ctxErr != nil {
-				return ctxErr
+	case "https", "http", "rsync":
+	default:
+		return errors.Errorf("unsupported scheme while trying to fetch %s", baseURL.String())
+	}
+
+	// Namespaced images are fetched into their namespace directory.
+	storeDir := versionedStorePath
+	if ns, _ := SplitNamespace(im.Name); ns != "" {
+		if storeDir, err = CreateNamespace(versionedStorePath, ns); err != nil {
+			return err
+		}
+	}
+	targetPath := filepath.Join(storeDir, path.Base(location.String()))
+	// Published metadata is unsigned, its hash is only used once its
+	// embedded signature has been checked against the fetched archive.
+	var meta *ArchiveMeta
+	if hash == "" {
+		meta = rc.fetchArchiveMeta(ctx, im, baseURL, location)
+	}
+	contents := rc.Contents[im.Remote]
+	size := contents.ArchiveSize(im)
+	if size > 0 && !IsExistingPath(targetPath) {
+		if err := checkFreeSpace(versionedStorePath, size); err != nil {
+			return errors.Wrapf(err, "fetching %s:%s", im.Name, im.Reference)
+		}
+	}
+
+	observer := rc.fetchObserver()
+	observer.FetchStarted(im, baseURL.ResolveReference(location).String())
+	if size > 0 {
+		logrus.WithFields(logrus.Fields{
+			"name":      im.Name,
+			"reference": im.Reference,
+			"size":      formatSize(size),
+		}).Info("estimated download size")
+		observer.FetchProgress(im, 0, size)
+	}
+	err = rc.fetchArchive(ctx, im, baseURL, location, storeDir, hash, size)
+	if err == nil && meta != nil {
+		meta = rc.verifyArchiveMeta(im, targetPath, meta)
+		if meta != nil {
+			hash = meta.Hash
+			if werr := writeHashSidecar(targetPath, hash); werr != nil {
+				logrus.WithFields(logrus.Fields{
+					"path":  targetPath,
+					"error": werr,
+				}).Warn("unable to record archive hash")
 			}
+		}
+	}
+	if err == nil {
+		rc.auditFetch(ctx, im, baseURL.ResolveReference(location).String(), targetPath, hash)
+	}
+	if err == nil && meta != nil {
+		if werr := WriteArchiveMeta(targetPath, meta); werr != nil {
 			logrus.WithFields(logrus.Fields{
-				"attempt":   tries,
-				"name":      im.Name,
-				"reference": im.Reference,
-				"remote":    im.Remote,
-				"error":     err,
-			}).Error("failed to fetch")
-			time.Sleep(8 * time.Second)
+				"path":  targetPath,
+				"error": werr,
+			}).Warn("unable to record archive metadata")
 		}
-	default:
-		return errors.Errorf("unsupported scheme while trying to fetch %s", baseURL.String())
 	}
+	observer.FetchFinished(im, targetPath, err)
+	return err
+}
+
+// verifyArchiveMeta checks `meta` against the archive of `im` fetched at
+// `targetPath` and the keyrings of its remote. Metadata failing
+// verification is ignored, and nil is returned.
+func (rc *RemotesCache) verifyArchiveMeta(im Image, targetPath string, meta *ArchiveMeta) *ArchiveMeta {
+	fields := logrus.Fields{
+		"name":      im.Name,
+		"reference": im.Reference,
+	}
+	remote := rc.Configs[im.Remote]
+	keyrings, err := remote.loadKeyrings(filepath.Dir(rc.Paths[im.Remote]))
+	if err == nil {
+		err = meta.verifyFetched(targetPath, keyrings)
+	}
+	if err != nil {
+		logrus.WithFields(fields).WithField("error", err).Warn("ignoring unverified archive metadata")
+		return nil
+	}
+	return meta
+}
+
+// fetchArchive fetches an image archive from peers (if any) or from the remote.
+func (rc *RemotesCache) fetchArchive(ctx context.Context, im Image, baseURL *url.URL, location *url.URL, baseDir string, hash string, size int64) error {
+	remote := rc.Configs[im.Remote]
+	if hash != "" && len(remote.Peers) > 0 {
+		if err := rc.fetchFromPeers(ctx, im, remote.httpClient(), remote.Peers, location, baseDir, hash, size); err == nil {
+			return nil
+		}
+	}
+	client, err := remote.archiveClient()
+	if err != nil {
+		return err
+	}
+	fields := logrus.Fields{
+		"name":      im.Name,
+		"reference": im.Reference,
+		"remote":    im.Remote,
+	}
+	return retryFetch(ctx, fields, func() error {
+		if baseURL.Scheme == "rsync" {
+			return rc.rsyncArchive(ctx, baseURL, location, baseDir, hash, size)
+		}
+		return rc.downloadArchive(ctx, im, client, baseURL, location, baseDir, hash, size)
+	})
 }
 
 // downloadArchive downloads an image archive from a remote.
-func (rc *RemotesCache) downloadArchive(ctx context.Context, baseURL *url.URL, location *url.URL, baseDir string, hash string) error {
+func (rc *RemotesCache) downloadArchive(ctx context.Context, im Image, client *http.Client, baseURL *url.URL, location *url.URL, baseDir string, hash string, size int64) error {
 	fileName := path.Base(location.String())
-	if !strings.HasSuffix(fileName, ".torcx.tgz") && !strings.HasSuffix(fileName, ".torcx.squashfs") {
+	if archiveFormatOf(fileName) == ArchiveFormatUnknown {
 		return errors.Errorf("invalid extension for image archive %s", fileName)
 	}
 	targetPath := filepath.Join(baseDir, fileName)
-	tmpFile, err := ioutil.TempFile(baseDir, ".fetchimg")
+
+	lock, fetched, err := lockArchive(ctx, targetPath, hash)
+	if err != nil || fetched {
+		return err
+	}
+	defer unlockFile(lock)
+
+	tmpFile, err := createPartialFile(baseDir, fileName, hash)
 	if err != nil {
 		return err
 	}
@@ -532,14 +794,34 @@ func (rc *RemotesCache) downloadArchive(ctx context.Context, baseURL *url.URL, l
 	if err != nil {
 		return err
 	}
+	// Archives are verified by hash, thus cacheable as opaque blobs.
+	// Uniform headers avoid fragmenting caches on `Vary`.
+	req.Header.Set("Accept", "application/octet-stream")
+	req.Header.Set("Accept-Encoding", "identity")
 
-	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if err := checkHTTPStatus(resp); err != nil {
+		return err
+	}
+	total := resp.ContentLength
+	if size > 0 {
+		if total >= 0 && total != size {
+			return errors.Errorf("mismatching size for %s: expected %d bytes, remote announced %d", targetPath, size, total)
+		}
+		total = size
+	}
+	body := &progressReader{
+		Reader:   resp.Body,
+		im:       im,
+		observer: rc.fetchObserver(),
+		total:    total,
+	}
 	buf := make([]byte, 32*1024)
-	if err := ctxcopy.Copy(ctx, bufwr, resp.Body, buf); err != nil {
+	if err := ctxcopy.Copy(ctx, bufwr, body, buf); err != nil {
 		return err
 	}
 	if err := bufwr.Flush(); err != nil {
@@ -548,9 +830,43 @@ func (rc *RemotesCache) downloadArchive(ctx context.Context, baseURL *url.URL, l
 	if err := tmpFile.Close(); err != nil {
 		return errors.Wrapf(err, "failed to close %s", tmpName)
 	}
+
+	return installArchive(tmpName, targetPath, hash, size)
+}
+
+// lockArchive acquires the writer lock for the archive at `targetPath`.
+// Stores may be shared by multiple nodes (e.g. on NFS), thus writers
+// serialize on a per-archive lock and readers never see partial files.
+// If the archive has already been fetched (possibly by another writer),
+// the lock is released and `fetched` is true.
+func lockArchive(ctx context.Context, targetPath string, hash string) (lock *os.File, fetched bool, err error) {
+	baseDir, fileName := filepath.Split(targetPath)
+	lock, err = lockFile(ctx, filepath.Join(baseDir, "."+fileName+".lock"))
+	if err != nil {
+		return nil, false, err
+	}
+	if hash != "" {
+		if valid, err := validateHash(targetPath, hash); err == nil && valid {
+			logrus.WithFields(logrus.Fields{
+				"path": targetPath,
+			}).Info("image archive already fetched")
+			unlockFile(lock)
+			return nil, true, writeHashSidecar(targetPath, hash)
+		}
+	}
+	return lock, false, nil
+}
+
+// installArchive verifies a fully downloaded archive at `tmpName`,
+// and atomically moves it in place at `targetPath`. If known, the
+// expected `size` is checked first, as it is much cheaper than hashing.
+func installArchive(tmpName string, targetPath string, hash string, size int64) error {
 	if err := os.Chmod(tmpName, 0755); err != nil {
 		return errors.Wrapf(err, "failed to chmod %s", tmpName)
 	}
+	if err := checkArchiveSize(tmpName, size); err != nil {
+		return errors.Wrapf(err, "failed to validate %s", targetPath)
+	}
 
 	if hash != "" {
 		valid, err := validateHash(tmpName, hash)
@@ -564,6 +880,13 @@ func (rc *RemotesCache) downloadArchive(ctx context.Context, baseURL *url.URL, l
 	if err := os.Rename(tmpName, targetPath); err != nil {
 		return errors.Wrapf(err, "failed to save %s", targetPath)
 	}
+	if hash != "" {
+		if err := writeHashSidecar(targetPath, hash); err != nil {
+			return errors.Wrapf(err, "failed to record hash for %s", targetPath)
+		}
+	}
+
+	updateStoreIndex(filepath.Dir(targetPath))
 
 	logrus.WithFields(logrus.Fields{
 		"path": targetPath,
@@ -571,7 +894,33 @@ func (rc *RemotesCache) downloadArchive(ctx context.Context, baseURL *url.URL, l
 	return nil
 }
 
+// createPartialFile creates a hidden temporary file in `baseDir`, where
+// an archive can be downloaded before being atomically renamed in place.
+// If the expected hash is known, the temporary file is named after it.
+func createPartialFile(baseDir string, fileName string, hash string) (*os.File, error) {
+	if hash == "" {
+		return ioutil.TempFile(baseDir, ".fetchimg")
+	}
+	return os.OpenFile(partialPath(baseDir, fileName, hash), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+}
+
+// partialPath returns the path of the hidden partial file for an archive.
+func partialPath(baseDir string, fileName string, hash string) string {
+	if hash == "" {
+		return filepath.Join(baseDir, fmt.Sprintf(".%s.partial", fileName))
+	}
+	return filepath.Join(baseDir, fmt.Sprintf(".%s.%s.partial", fileName, hash))
+}
+
 func validateHash(path string, hash string) (bool, error) {
+	if alg := hashAlgorithmOf(hash); IsHashAlgorithm(alg) {
+		computed, err := hashFile(path, alg)
+		if err != nil {
+			return false, errors.Wrap(err, "could not read file for hash validation")
+		}
+		return computed == hash, nil
+	}
+
 	fp, err := os.Open(path)
 	if err != nil {
 		return false, err
@@ -0,0 +1,159 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// maxPublishedManifestSize bounds the size of manifests published alongside
+// archives, which are fetched before committing to a full download.
+const maxPublishedManifestSize = 1 << 20
+
+// ErrNoPublishedManifest is returned when a remote does not publish the
+// manifest of an image version alongside its archive.
+var ErrNoPublishedManifest = errors.New("no published image manifest")
+
+// remoteVersion returns the remote version matching `im`, resolving the
+// default vendor reference.
+func (rcs *RemoteContents) remoteVersion(im Image) (RemoteVersion, bool) {
+	if rcs == nil {
+		return RemoteVersion{}, false
+	}
+	ri, ok := rcs.Images[im.Name]
+	if !ok {
+		return RemoteVersion{}, false
+	}
+	targetVersion := im.Reference
+	if targetVersion == DefaultTagRef {
+		targetVersion = ri.defaultVersion
+	}
+	for _, vers := range ri.versions {
+		if vers.version == targetVersion {
+			return vers, true
+		}
+	}
+	return RemoteVersion{}, false
+}
+
+// FetchMetadata fetches the image manifest and profile fragment published
+// alongside the archive for `im`, without downloading the archive itself.
+// These are only meant to pre-validate an image (e.g. its dependencies)
+// before fetching it: the metadata embedded in the archive is authoritative.
+func (rc *RemotesCache) FetchMetadata(ctx context.Context, im Image) (*ImageMetadata, error) {
+	if rc == nil {
+		return nil, errNilRemotesCache
+	}
+	if err := rc.Policy.Check(im); err != nil {
+		return nil, err
+	}
+	baseURL, _, _, err := rc.CheckAvailable(im)
+	if err != nil {
+		return nil, err
+	}
+	if baseURL == nil {
+		return nil, errors.Errorf("image %s:%s has no remote", im.Name, im.Reference)
+	}
+	contents := rc.Contents[im.Remote]
+	vers, ok := contents.remoteVersion(im)
+	if !ok || vers.manifestLocation == "" {
+		return nil, ErrNoPublishedManifest
+	}
+
+	remote := rc.Configs[im.Remote]
+	client := remote.httpClient()
+	b, err := fetchPublished(ctx, client, baseURL, vers.manifestLocation)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching manifest for %s:%s", im.Name, im.Reference)
+	}
+	assets, err := decodeImageManifest(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decoding manifest for %s:%s", im.Name, im.Reference)
+	}
+	meta := &ImageMetadata{
+		Assets: *assets,
+	}
+
+	if vers.fragmentLocation != "" {
+		b, err := fetchPublished(ctx, client, baseURL, vers.fragmentLocation)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching profile fragment for %s:%s", im.Name, im.Reference)
+		}
+		images, err := readProfileReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding profile fragment for %s:%s", im.Name, im.Reference)
+		}
+		meta.Fragment = images
+	}
+	return meta, nil
+}
+
+// fetchPublished retrieves a small document at `path` (relative to
+// `baseURL`, or absolute), published by a remote alongside its archives.
+func fetchPublished(ctx context.Context, client *http.Client, baseURL *url.URL, path string) ([]byte, error) {
+	location, err := parseLocation(path)
+	if err != nil {
+		return nil, err
+	}
+	fullURL := baseURL.ResolveReference(location)
+	logrus.WithFields(logrus.Fields{
+		"url": fullURL.String(),
+	}).Debug("fetching published manifest")
+
+	var body io.Reader
+	switch fullURL.Scheme {
+	case "file":
+		fp, err := os.Open(fullURL.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		body = fp
+	case "https", "http":
+		req, err := http.NewRequest("GET", fullURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if err := checkHTTPStatus(resp); err != nil {
+			return nil, err
+		}
+		body = resp.Body
+	default:
+		return nil, errors.Errorf("unsupported scheme for %s", fullURL.String())
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxPublishedManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxPublishedManifestSize {
+		return nil, errors.Errorf("%s exceeds %d bytes", fullURL.String(), maxPublishedManifestSize)
+	}
+	return b, nil
+}
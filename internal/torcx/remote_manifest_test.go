@@ -0,0 +1,80 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestFetchMetadata(t *testing.T) {
+	docs := map[string]string{
+		"/foo:1.manifest.json": `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/foo"]}}`,
+		"/foo:1.profile.json":  `{"kind": "profile-manifest-v1", "value": {"images": [{"name": "bar", "reference": "2"}]}}`,
+		"/bad.json":            `{"kind": "profile-manifest-v1", "value": {}}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc, ok := docs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(doc))
+	}))
+	defer srv.Close()
+
+	rc := &RemotesCache{
+		UsrMountpoint: t.TempDir(),
+		Configs: map[string]Remote{
+			"r": {TemplateURL: srv.URL + "/"},
+		},
+		Contents: map[string]RemoteContents{
+			"r": RemoteContentsFromJSONV1(RemoteImagesV1{
+				Images: []RemoteImageV1{
+					{
+						Name:           "foo",
+						DefaultVersion: "1",
+						Versions: []RemoteVersionV1{
+							{Version: "1", Location: "foo:1.torcx.tgz", ManifestLocation: "foo:1.manifest.json", FragmentLocation: "foo:1.profile.json"},
+							{Version: "2", Location: "foo:2.torcx.tgz"},
+							{Version: "3", Location: "foo:3.torcx.tgz", ManifestLocation: "bad.json"},
+						},
+					},
+				},
+			}),
+		},
+	}
+
+	meta, err := rc.FetchMetadata(context.Background(), Image{Name: "foo", Reference: DefaultTagRef, Remote: "r"})
+	if err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(meta.Assets.Binaries, []string{"/bin/foo"}) {
+		t.Errorf("unexpected binaries %v", meta.Assets.Binaries)
+	}
+	if len(meta.Fragment) != 1 || meta.Fragment[0].Name != "bar" || meta.Fragment[0].Reference != "2" {
+		t.Errorf("unexpected fragment %v", meta.Fragment)
+	}
+
+	if _, err := rc.FetchMetadata(context.Background(), Image{Name: "foo", Reference: "2", Remote: "r"}); err != ErrNoPublishedManifest {
+		t.Errorf("expected ErrNoPublishedManifest, got %v", err)
+	}
+	if _, err := rc.FetchMetadata(context.Background(), Image{Name: "foo", Reference: "3", Remote: "r"}); err == nil {
+		t.Error("expected error for invalid manifest kind")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// pinPrefix prefixes the hex SHA-512 digest of pinned contents manifests.
+const pinPrefix = "sha512-"
+
+// ErrRemotePinMismatch is returned when a fetched contents manifest does
+// not match the digest pinned for its remote.
+var ErrRemotePinMismatch = errors.New("contents manifest does not match pinned digest")
+
+// ManifestDigest returns the pinnable digest of a raw (signed) contents
+// manifest, as served by its remote.
+func ManifestDigest(manifest string) string {
+	sum := sha512.Sum512([]byte(manifest))
+	return pinPrefix + hex.EncodeToString(sum[:])
+}
+
+// validatePin checks that `pin` is a well-formed manifest digest.
+func validatePin(pin string) error {
+	if !strings.HasPrefix(pin, pinPrefix) {
+		return errors.Errorf("invalid pin %q, expected %s<hex>", pin, pinPrefix)
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(pin, pinPrefix))
+	if err != nil || len(b) != sha512.Size {
+		return errors.Errorf("invalid pin %q, expected %s<hex>", pin, pinPrefix)
+	}
+	return nil
+}
+
+// checkPin verifies the raw contents manifest of remote `name` against
+// its pinned digest, if any.
+func (rc *RemotesCache) checkPin(name string, manifest string) error {
+	pin, ok := rc.Pins[name]
+	if !ok {
+		return nil
+	}
+	if digest := ManifestDigest(manifest); !strings.EqualFold(digest, pin) {
+		return errors.Wrapf(ErrRemotePinMismatch, "got %s, pinned %s", digest, pin)
+	}
+	return nil
+}
+
+// RemoteDigest fetches and verifies the contents manifest of remote
+// `name`, returning its digest for pinning. The configured pin, if any,
+// is not enforced, so that pins can be renewed: the manifest is not cached.
+func (cc *CommonConfig) RemoteDigest(ctx context.Context, name string) (string, error) {
+	rc := RemotesCache{
+		UsrMountpoint: cc.UsrDir,
+		Transport:     cc.Transport,
+		Policy:        cc.FetchPolicy,
+	}
+	if err := rc.Load(ctx, cc.RemotesDirs(), []string{name}); err != nil {
+		return "", err
+	}
+	digest, ok := rc.Digests[name]
+	if !ok {
+		return "", errors.Errorf("remote %s not found", name)
+	}
+	return digest, nil
+}
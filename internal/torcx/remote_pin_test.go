@@ -0,0 +1,82 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestRemotePins(t *testing.T) {
+	dir := t.TempDir()
+	cc := &CommonConfig{
+		BaseDir: filepath.Join(dir, "base"),
+		ConfDir: filepath.Join(dir, "conf"),
+		UsrDir:  filepath.Join(dir, "usr"),
+	}
+	remoteDir := filepath.Join(cc.ConfDir, "remotes", "test")
+	if err := os.MkdirAll(remoteDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	served := filepath.Join(dir, "served")
+	manifest := `{"kind": "remote-manifest-v0", "value": {"base_url": "file://` + served + `/", "keys": []}}`
+	if err := ioutil.WriteFile(filepath.Join(remoteDir, "remote.json"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	contents := `{"kind": "torcx-remote-contents-v1", "value": {"images": []}}`
+	if err := os.MkdirAll(served, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(served, remoteContentsName), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	digest, err := cc.RemoteDigest(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != ManifestDigest(contents) || validatePin(digest) != nil {
+		t.Fatalf("unexpected digest %s", digest)
+	}
+
+	cc.RemotePins = map[string]string{"test": digest}
+	if _, err := cc.LoadRemotes(ctx, []string{"test"}); err != nil {
+		t.Fatalf("pinned manifest refused: %s", err)
+	}
+
+	// A tampered metadata endpoint is refused, even for unsigned remotes.
+	if err := ioutil.WriteFile(filepath.Join(served, remoteContentsName), []byte(contents+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cc.LoadRemotes(ctx, []string{"test"}); errors.Cause(err) != ErrRemotePinMismatch {
+		t.Errorf("expected pin mismatch, got %v", err)
+	}
+	// Pins can still be renewed.
+	if renewed, err := cc.RemoteDigest(ctx, "test"); err != nil || renewed == digest {
+		t.Errorf("unexpected renewed digest %s (%v)", renewed, err)
+	}
+
+	for _, pin := range []string{"", "sha256-00", "sha512-zz", "sha512-00"} {
+		if validatePin(pin) == nil {
+			t.Errorf("%q: expected invalid pin", pin)
+		}
+	}
+}
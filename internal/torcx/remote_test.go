@@ -15,9 +15,15 @@
 package torcx
 
 import (
+	"context"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -115,3 +121,259 @@ COREOS_BOARD="amd64-usr"
 		}
 	}
 }
+
+func TestInterleaveFamilies(t *testing.T) {
+	in := []net.IP{
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("2001:db8::3"),
+		net.ParseIP("192.0.2.1"),
+	}
+	exp := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "2001:db8::3"}
+
+	out := interleaveFamilies(in)
+	if len(out) != len(exp) {
+		t.Fatalf("expected %d addresses, got %d", len(exp), len(out))
+	}
+	for i, ip := range out {
+		if ip.String() != exp[i] {
+			t.Errorf("position %d: expected %s, got %s", i, exp[i], ip)
+		}
+	}
+}
+
+func TestStaticHostsDial(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	srvURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first address is unroutable, the racing attempt must win.
+	r := &Remote{
+		Hosts: map[string][]string{
+			"mirror.torcx.test": {"192.0.2.1", "127.0.0.1"},
+		},
+	}
+	resp, err := r.httpClient().Get("http://mirror.torcx.test:" + srvURL.Port() + "/")
+	if err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "ok" {
+		t.Fatalf("expected %q, got %q", "ok", body)
+	}
+}
+
+func TestReplaceURLHost(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		exp  string
+	}{
+		{"", "https://mirror:8443/"},
+		{"https://example.com", "https://mirror:8443/"},
+		{"http://example.com/repo/${COREOS_BOARD}/", "http://mirror:8443/repo/${COREOS_BOARD}/"},
+	}
+
+	for _, tt := range tests {
+		out := replaceURLHost(tt.tmpl, "mirror:8443")
+		if out != tt.exp {
+			t.Errorf("template %q: expected %q, got %q", tt.tmpl, tt.exp, out)
+		}
+	}
+}
+
+func TestDecodeDiscovery(t *testing.T) {
+	valid := `{"kind": "torcx-remote-discovery-v0", "value": {"base_url": "https://mirror.example.com/${VERSION_ID}/"}}`
+	tmpl, err := decodeDiscovery(strings.NewReader(valid))
+	if err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	if tmpl != "https://mirror.example.com/${VERSION_ID}/" {
+		t.Fatalf("unexpected template %q", tmpl)
+	}
+
+	invalid := []string{
+		`{"kind": "remote-manifest-v0", "value": {"base_url": "https://example.com/"}}`,
+		`{"kind": "torcx-remote-discovery-v0", "value": {}}`,
+		`not json`,
+	}
+	for _, doc := range invalid {
+		if _, err := decodeDiscovery(strings.NewReader(doc)); err == nil {
+			t.Errorf("expected error for %q", doc)
+		}
+	}
+}
+
+func TestArchiveProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_proxy_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var proxied *http.Request
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r
+		w.Write([]byte("archive"))
+	}))
+	defer proxy.Close()
+
+	r := &Remote{
+		ArchiveProxy: proxy.URL,
+	}
+	client, err := r.archiveClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL, _ := url.Parse("http://upstream.torcx.test/repo/")
+	location, _ := url.Parse("./foo:1.torcx.tgz")
+	rc := &RemotesCache{}
+	if err := rc.downloadArchive(context.Background(), Image{}, client, baseURL, location, dir, "", 0); err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+
+	if proxied == nil {
+		t.Fatal("request not routed through proxy")
+	}
+	if proxied.URL.String() != "http://upstream.torcx.test/repo/foo:1.torcx.tgz" {
+		t.Errorf("unexpected proxied URL %q", proxied.URL)
+	}
+	if ae := proxied.Header.Get("Accept-Encoding"); ae != "identity" {
+		t.Errorf("unexpected Accept-Encoding %q", ae)
+	}
+}
+
+func TestDigestLocation(t *testing.T) {
+	rcs := RemoteContentsFromJSONV1(RemoteImagesV1{
+		Images: []RemoteImageV1{
+			{
+				Name: "foo",
+				Versions: []RemoteVersionV1{
+					{Version: "1", Location: "foo:1.torcx.tgz", DigestLocation: "blobs/sha512-aa/foo:1.torcx.tgz"},
+					{Version: "2", Location: "foo:2.torcx.tgz"},
+					// Archives are stored by file name, which must match.
+					{Version: "3", Location: "foo:3.torcx.tgz", DigestLocation: "blobs/sha512-cc.torcx.tgz"},
+				},
+			},
+		},
+	})
+
+	tests := map[string]string{
+		"1": "./blobs/sha512-aa/foo:1.torcx.tgz",
+		"2": "./foo:2.torcx.tgz",
+		"3": "./foo:3.torcx.tgz",
+	}
+	for ref, exp := range tests {
+		location, _, err := rcs.CheckAvailable(Image{Name: "foo", Reference: ref, Remote: "r"})
+		if err != nil {
+			t.Fatalf("got unexpected error: %s", err)
+		}
+		if location.String() != exp {
+			t.Errorf("reference %s: expected %q, got %q", ref, exp, location)
+		}
+	}
+}
+
+func TestCredentialHelper(t *testing.T) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	helper := filepath.Join(dir, "helper")
+	script := `#!/bin/sh
+read server
+echo "$server" >> ` + calls + `
+case "$server" in
+  *127.0.0.1*) echo '{"ServerURL": "'$server'", "Username": "<token>", "Secret": "s3cr3t"}' ;;
+  *) echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`
+	if err := ioutil.WriteFile(helper, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	r := &Remote{CredentialHelper: helper}
+	client := r.httpClient()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL + "/torcx_manifest.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if len(auth) != 2 || auth[0] != "Bearer s3cr3t" || auth[1] != "Bearer s3cr3t" {
+		t.Errorf("unexpected authorization headers %q", auth)
+	}
+	b, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(b), "\n") != 1 {
+		t.Errorf("expected credentials to be requested once, got %q", b)
+	}
+
+	creds, err := runCredentialHelper(context.Background(), helper, "https://peer.torcx.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds != nil {
+		t.Errorf("expected no credentials for unknown server, got %+v", creds)
+	}
+
+	req := httptest.NewRequest("GET", "http://mirror.torcx.test/foo", nil)
+	if credentialsAllowed(req) {
+		t.Error("credentials must not be sent over plain HTTP")
+	}
+}
+
+func TestSystemdCredential(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(credentialsDirEnv, dir)
+
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	creds := `{"ServerURL": "` + srv.URL + `/", "Username": "lab", "Secret": "s3cr3t"}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "torcx.remote.lab"), []byte(creds), 0400); err != nil {
+		t.Fatal(err)
+	}
+	if !hasSystemdCredential(remoteCredentialPrefix + "lab") {
+		t.Fatal("expected credential to be passed")
+	}
+
+	r := &Remote{Credential: remoteCredentialPrefix + "lab"}
+	resp, err := r.httpClient().Get(srv.URL + "/torcx_manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(auth) != 1 || !strings.HasPrefix(auth[0], "Basic ") {
+		t.Errorf("unexpected authorization headers %q", auth)
+	}
+
+	bound, err := readSystemdCredentials(remoteCredentialPrefix+"lab", "https://peer.torcx.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bound != nil {
+		t.Errorf("expected no credentials for another server, got %+v", bound)
+	}
+	if _, err := systemdCredentialPath("../lab"); err == nil {
+		t.Error("expected invalid credential name to be rejected")
+	}
+}
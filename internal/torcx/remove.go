@@ -0,0 +1,211 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// ErrImageInUse is returned when removing an image which is still referenced.
+var ErrImageInUse = errors.New("image is in use")
+
+// ImageUsers returns a description of all profiles referencing `im`,
+// including the currently running one and the last good one.
+func ImageUsers(cc *CommonConfig, im Image) ([]string, error) {
+	if cc == nil {
+		return nil, errors.New("nil CommonConfig")
+	}
+	users := []string{}
+
+	profiles, err := ListProfiles(cc.ProfileDirs())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list profiles")
+	}
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		images, err := ReadProfilePath(profiles[name])
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"path":  profiles[name],
+				"error": err,
+			}).Warn("unable to read profile")
+			continue
+		}
+		if profileContains(images, im) {
+			users = append(users, fmt.Sprintf("profile %q", name))
+		}
+	}
+
+	// A missing seal means this system has not been sealed yet.
+	if current, err := ReadCurrentProfile(); err == nil && profileContains(current, im) {
+		users = append(users, "current sealed profile")
+	}
+	// The last good profile is the rollback target, and must stay applicable.
+	if good, err := ReadProfilePath(cc.GoodProfile()); err == nil && profileContains(good, im) {
+		users = append(users, "last good profile")
+	}
+
+	aliases, err := ListImageAliases(cc)
+	if err != nil {
+		return nil, err
+	}
+	for _, al := range aliases {
+		if al.Name == im.Name && al.Target == im.Reference {
+			users = append(users, fmt.Sprintf("alias %q", al.Name+":"+al.Reference))
+		}
+	}
+
+	return users, nil
+}
+
+// profileContains returns whether `images` references `im`.
+func profileContains(images []Image, im Image) bool {
+	for _, entry := range images {
+		if entry.Name == im.Name && entry.Reference == im.Reference {
+			return true
+		}
+	}
+	return false
+}
+
+// WritableStorePaths returns store paths which torcx can write to,
+// i.e. all configured stores except vendor, OEM and image-backed ones.
+func (cc *CommonConfig) WritableStorePaths() []string {
+	vendorStore := filepath.Clean(VendorStoreDir(cc.UsrDir))
+	oemStore := filepath.Clean(OemStoreDir)
+	imageStores := filepath.Clean(cc.RunStoresDir())
+
+	paths := []string{}
+	for _, p := range cc.StorePaths {
+		p = filepath.Clean(p)
+		if p == vendorStore || strings.HasPrefix(p, vendorStore+"/") {
+			continue
+		}
+		if p == oemStore || strings.HasPrefix(p, oemStore+"/") {
+			continue
+		}
+		if strings.HasPrefix(p, imageStores+"/") {
+			continue
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// RemoveImage deletes all archives for `im` from writable stores, together
+// with their recorded hashes and any unpacked rootfs, returning the removed
+// archive paths. Unless `force` is set, images referenced by any profile
+// are not removed.
+func RemoveImage(cc *CommonConfig, im Image, force bool) ([]string, error) {
+	if cc == nil {
+		return nil, errors.New("nil CommonConfig")
+	}
+	if im.Name == "" || im.Reference == "" {
+		return nil, errors.New("missing image name or reference")
+	}
+
+	users, err := ImageUsers(cc, im)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) > 0 {
+		if !force {
+			return nil, errors.Wrapf(ErrImageInUse, "referenced by %s", strings.Join(users, ", "))
+		}
+		logrus.WithFields(logrus.Fields{
+			"name":      im.Name,
+			"reference": im.Reference,
+			"users":     users,
+		}).Warn("forcing removal of image in use")
+	}
+
+	removed := []string{}
+	defer func() {
+		for _, archivePath := range removed {
+			updateStoreIndex(filepath.Dir(archivePath))
+		}
+	}()
+	for _, dir := range cc.WritableStorePaths() {
+		for _, format := range archiveFormats {
+			archivePath := filepath.Join(archiveDir(dir, im), archiveFileName(im, format))
+			fi, err := os.Lstat(archivePath)
+			if err != nil {
+				continue
+			}
+			if !fi.Mode().IsRegular() && fi.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"path": archivePath,
+			}).Info("removing image archive")
+			if err := os.Remove(archivePath); err != nil {
+				return removed, err
+			}
+			removed = append(removed, archivePath)
+			for _, suffix := range []string{hashSidecarSuffix, corruptedSuffix, signatureSidecarSuffix, timestampSidecarSuffix, metaSidecarSuffix} {
+				if err := os.Remove(archivePath + suffix); err != nil && !os.IsNotExist(err) {
+					return removed, err
+				}
+			}
+		}
+	}
+	if len(removed) == 0 {
+		return nil, errors.Errorf("image %s:%s not found in writable stores", im.Name, im.Reference)
+	}
+
+	// Only the currently running profile has unpacked images.
+	if current, err := ReadCurrentProfile(); err == nil && profileContains(current, im) {
+		cleanUnpacked(cc, im)
+	}
+	return removed, nil
+}
+
+// cleanUnpacked removes the unpacked rootfs of an image, if any.
+// This is best-effort, as the unpack directory is read-only once sealed.
+func cleanUnpacked(cc *CommonConfig, im Image) {
+	topDir := filepath.Join(cc.RunUnpackDir(), imagePathName(im.Name))
+	if _, err := os.Lstat(topDir); err != nil {
+		return
+	}
+
+	// Squashfs images are mounted on their unpack directory.
+	if err := cc.mounter().Unmount(topDir, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+		logrus.WithFields(logrus.Fields{
+			"path":  topDir,
+			"error": err,
+		}).Debug("failed to unmount unpacked image")
+	}
+	if err := os.RemoveAll(topDir); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"path":  topDir,
+			"error": err,
+		}).Warn("unable to clean unpacked image, it will be cleared on next boot")
+		return
+	}
+	_ = os.Remove(unpackSidePath(topDir, unpackIndexSuffix))
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestRemoveImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_remove_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cc := &CommonConfig{
+		BaseDir: filepath.Join(dir, "base"),
+		RunDir:  filepath.Join(dir, "run"),
+		ConfDir: filepath.Join(dir, "conf"),
+		UsrDir:  filepath.Join(dir, "usr"),
+	}
+	vendorStore := VendorStoreDir(cc.UsrDir)
+	userStore := cc.UserStorePath("")
+	cc.StorePaths = []string{vendorStore, userStore}
+	for _, d := range []string{vendorStore, userStore, cc.UserProfileDir()} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []string{vendorStore, userStore} {
+		if err := ioutil.WriteFile(filepath.Join(d, "foo:1.torcx.tgz"), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeHashSidecar(filepath.Join(userStore, "foo:1.torcx.tgz"), "sha512-00"); err != nil {
+		t.Fatal(err)
+	}
+	profile := `{"kind": "profile-manifest-v0", "value": {"images": [{"name": "foo", "reference": "1"}]}}`
+	if err := ioutil.WriteFile(filepath.Join(cc.UserProfileDir(), "p.json"), []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	im := Image{Name: "foo", Reference: "1"}
+
+	if _, err := RemoveImage(cc, im, false); errors.Cause(err) != ErrImageInUse {
+		t.Fatalf("expected %s, got %v", ErrImageInUse, err)
+	}
+
+	removed, err := RemoveImage(cc, im, true)
+	if err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	if len(removed) != 1 || removed[0] != filepath.Join(userStore, "foo:1.torcx.tgz") {
+		t.Fatalf("unexpected removals %v", removed)
+	}
+	if IsExistingPath(filepath.Join(userStore, "foo:1.torcx.tgz.hash")) {
+		t.Error("hash sidecar not removed")
+	}
+	if !IsExistingPath(filepath.Join(vendorStore, "foo:1.torcx.tgz")) {
+		t.Error("vendor archive removed")
+	}
+
+	if _, err := RemoveImage(cc, im, true); err == nil {
+		t.Error("expected error removing missing image")
+	}
+
+	// Rollback targets are in use as well.
+	rollback := Image{Name: "bar", Reference: "2"}
+	if _, err := writeProfileV1(cc.GoodProfile(), []Image{rollback}); err != nil {
+		t.Fatal(err)
+	}
+	users, err := ImageUsers(cc, rollback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0] != "last good profile" {
+		t.Errorf("unexpected users %v", users)
+	}
+}
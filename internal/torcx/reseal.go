@@ -0,0 +1,201 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// WarningIncompatibleImage is recorded by a reseal for applied images which
+// are not compatible anymore with the updated OS.
+const WarningIncompatibleImage = "incompatible-image"
+
+// ResealReport is the outcome of resealing the system state after an OS update.
+type ResealReport struct {
+	// PreviousOsVersionID is the OS version the state was sealed on.
+	PreviousOsVersionID string `json:"previous_os_version_id"`
+	// OsVersionID is the OS version the state is now sealed on.
+	OsVersionID string `json:"os_version_id"`
+	// Incompatible are the applied images not compatible anymore with
+	// the updated OS, which should be re-applied on next boot.
+	Incompatible []Warning `json:"incompatible"`
+}
+
+// Reseal records in the seal that the OS under `cc.UsrDir` changed beneath
+// the applied images, e.g. by an update. Applied images are re-validated:
+// archives taken from a store versioned for the previous OS, and vendor
+// archives replaced or removed by the update, are reported as incompatible
+// and recorded as warnings.
+func Reseal(cc *CommonConfig) (*ResealReport, error) {
+	return reseal(cc, RootPath(SealPath))
+}
+
+// reseal implements Reseal against the seal file at `sealPath`.
+func reseal(cc *CommonConfig, sealPath string) (*ResealReport, error) {
+	if cc == nil {
+		return nil, errors.New("missing common configuration")
+	}
+	meta, err := ReadMetadata(sealPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading seal")
+	}
+	images, err := ReadProfilePath(cc.RunProfile())
+	if err != nil {
+		return nil, errors.Wrap(err, "reading run profile")
+	}
+
+	report := &ResealReport{
+		PreviousOsVersionID: meta[SealOsVersionID],
+		OsVersionID:         sealOsVersionID(cc.UsrDir),
+		Incompatible:        []Warning{},
+	}
+	incompatible := func(message string, im Image, path string) {
+		logrus.WithFields(logrus.Fields{
+			"image": im.Name,
+			"path":  path,
+		}).Warn(message)
+		report.Incompatible = append(report.Incompatible, Warning{
+			Kind:    WarningIncompatibleImage,
+			Message: message,
+			Image:   &im,
+			Path:    path,
+			Time:    time.Now().UTC(),
+		})
+	}
+
+	metadataDir := filepath.Dir(sealPath)
+	for _, im := range images {
+		env, err := ReadMetadata(filepath.Join(metadataDir, imageEnvPrefix+imagePathName(im.Name)))
+		if err != nil {
+			continue
+		}
+		archive := env[ImageEnvArchive]
+		if archive == "" {
+			continue
+		}
+		if report.PreviousOsVersionID != "" && report.PreviousOsVersionID != report.OsVersionID && isVersionedStoreArchive(archive, report.PreviousOsVersionID) {
+			incompatible(fmt.Sprintf("archive from a store versioned for OS %s", report.PreviousOsVersionID), im, archive)
+			continue
+		}
+		if !strings.HasPrefix(archive, filepath.Clean(cc.UsrDir)+"/") {
+			continue
+		}
+		if !IsExistingPath(archive) {
+			incompatible("vendor archive removed by the OS update", im, archive)
+			continue
+		}
+		if digest := env[ImageEnvDigest]; digest != "" {
+			valid, err := validateHash(archive, digest)
+			if err != nil {
+				incompatible(fmt.Sprintf("unable to verify vendor archive: %s", err), im, archive)
+			} else if !valid {
+				incompatible("vendor archive replaced by the OS update", im, archive)
+			}
+		}
+	}
+
+	updates := map[string]string{
+		SealOsVersionID:         report.OsVersionID,
+		SealPreviousOsVersionID: report.PreviousOsVersionID,
+	}
+	if err := updateSeal(sealPath, updates); err != nil {
+		return report, err
+	}
+	if len(report.Incompatible) > 0 {
+		warnings, err := ReadWarnings(cc.RunWarnings())
+		if err != nil && !os.IsNotExist(err) {
+			return report, err
+		}
+		if err := writeWarnings(cc.RunWarnings(), append(warnings, report.Incompatible...)); err != nil {
+			return report, errors.Wrap(err, "recording incompatible images")
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"previous_os_version_id": report.PreviousOsVersionID,
+		"os_version_id":          report.OsVersionID,
+		"incompatible":           len(report.Incompatible),
+	}).Info("system state resealed")
+	return report, nil
+}
+
+// sealOsVersionID returns the version of the OS at `usrDir`, or an empty
+// string if unknown.
+func sealOsVersionID(usrDir string) string {
+	id, err := CurrentOsVersionID(VendorOsReleasePath(usrDir))
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+// isVersionedStoreArchive returns whether `archive` is in a store
+// directory versioned for OS `version` (i.e. `.../store/<version>/`).
+func isVersionedStoreArchive(archive string, version string) bool {
+	storeDir := filepath.Dir(archive)
+	return filepath.Base(storeDir) == version && filepath.Base(filepath.Dir(storeDir)) == "store"
+}
+
+// updateSeal atomically rewrites the seal file at `path`, replacing the
+// values of `updates` labels and appending the missing ones.
+func updateSeal(path string, updates map[string]string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	lines := []string{}
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(strings.NewReader(string(b)))
+	for sc.Scan() {
+		line := sc.Text()
+		key := strings.SplitN(line, "=", 2)[0]
+		if value, ok := updates[key]; ok {
+			line = fmt.Sprintf("%s=%q", key, value)
+			seen[key] = true
+		}
+		lines = append(lines, line)
+	}
+	missing := []string{}
+	for key := range updates {
+		if !seen[key] {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	for _, key := range missing {
+		lines = append(lines, fmt.Sprintf("%s=%q", key, updates[key]))
+	}
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return errors.Wrap(err, "writing seal content")
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
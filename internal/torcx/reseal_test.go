@@ -0,0 +1,106 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReseal(t *testing.T) {
+	dir := t.TempDir()
+	cc := &CommonConfig{
+		RunDir: filepath.Join(dir, "run"),
+		UsrDir: filepath.Join(dir, "usr"),
+	}
+	metadataDir := filepath.Join(dir, "metadata")
+	versionedStore := filepath.Join(dir, "base", "store", "100.0")
+	vendorStore := VendorStoreDir(cc.UsrDir)
+	for _, d := range []string{metadataDir, cc.RunDir, versionedStore, vendorStore, filepath.Dir(VendorOsReleasePath(cc.UsrDir))} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(VendorOsReleasePath(cc.UsrDir), []byte("ID=flatcar\nVERSION_ID=101.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	images := []Image{{Name: "foo", Reference: "1"}, {Name: "bar", Reference: "2"}, {Name: "baz", Reference: "3"}}
+	if err := writeRunProfile(cc.RunProfile(), images); err != nil {
+		t.Fatal(err)
+	}
+	fooArchive := filepath.Join(versionedStore, "foo:1.torcx.tgz")
+	barArchive := filepath.Join(vendorStore, "bar:2.torcx.tgz")
+	bazArchive := filepath.Join(vendorStore, "baz:3.torcx.tgz")
+	for _, path := range []string{fooArchive, barArchive, bazArchive} {
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	barDigest, err := computeHash(barArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bazDigest, err := computeHash(bazArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied := []AppliedImage{
+		{Image: images[0], Archive: fooArchive},
+		{Image: images[1], Archive: barArchive, Digest: barDigest},
+		{Image: images[2], Archive: bazArchive, Digest: bazDigest},
+	}
+	if err := writeImageEnvFiles(metadataDir, applied); err != nil {
+		t.Fatal(err)
+	}
+	sealPath := filepath.Join(metadataDir, "torcx")
+	seal := "TORCX_UPPER_PROFILE=\"user\"\nTORCX_OS_VERSION_ID=\"100.0\"\n"
+	if err := ioutil.WriteFile(sealPath, []byte(seal), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The OS update replaced the vendor bar archive
+	if err := ioutil.WriteFile(barArchive, []byte("updated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := reseal(cc, sealPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.PreviousOsVersionID != "100.0" || report.OsVersionID != "101.0" {
+		t.Errorf("unexpected OS versions %+v", report)
+	}
+	if len(report.Incompatible) != 2 || report.Incompatible[0].Path != fooArchive || report.Incompatible[1].Path != barArchive {
+		t.Errorf("expected foo and bar to be incompatible, got %+v", report.Incompatible)
+	}
+
+	meta, err := ReadMetadata(sealPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta[SealOsVersionID] != "101.0" || meta[SealPreviousOsVersionID] != "100.0" || meta[SealUpperProfile] != "user" {
+		t.Errorf("unexpected seal content %v", meta)
+	}
+	warnings, err := ReadWarnings(cc.RunWarnings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts := CountWarnings(warnings); counts[WarningIncompatibleImage] != 2 {
+		t.Errorf("expected 2 incompatible-image warnings, got %v", counts)
+	}
+}
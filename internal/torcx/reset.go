@@ -0,0 +1,120 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ResetOptions selects which parts of the torcx state are removed by Reset.
+// If none is selected, all of them are.
+type ResetOptions struct {
+	// Profiles are user profiles and node profile overrides.
+	Profiles bool
+	// Store is the content of the user store.
+	Store bool
+	// NextProfile is the profile (and approved plan) selected for next boot.
+	NextProfile bool
+	// Caches are cached remote contents manifests.
+	Caches bool
+	// History is the record of the last good profile.
+	History bool
+	// DryRun only reports what would be removed.
+	DryRun bool
+}
+
+// all returns whether no part is selected, i.e. all of them are reset.
+func (opts ResetOptions) all() bool {
+	return !opts.Profiles && !opts.Store && !opts.NextProfile && !opts.Caches && !opts.History
+}
+
+// Reset removes user state, returning the node to vendor and OEM default
+// images on next boot. It returns the removed paths. Vendor and OEM
+// profiles and stores are never touched, nor is the running state.
+func Reset(cc *CommonConfig, opts ResetOptions) ([]string, error) {
+	if cc == nil {
+		return nil, errors.New("nil CommonConfig")
+	}
+
+	all := opts.all()
+	targets := []string{}
+	if all || opts.Profiles {
+		entries, err := dirEntries(cc.UserProfileDir())
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, entries...)
+		targets = append(targets, cc.NodeProfiles())
+	}
+	if all || opts.Store {
+		entries, err := dirEntries(cc.UserStorePath(""))
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, entries...)
+	}
+	if all || opts.NextProfile {
+		targets = append(targets, cc.NextProfile(), cc.ApprovedPlan())
+	}
+	if all || opts.Caches {
+		targets = append(targets, cc.RemoteContentsCacheDir(), cc.HashTreeCacheDir())
+	}
+	if all || opts.History {
+		targets = append(targets, cc.GoodProfile())
+	}
+
+	removed := []string{}
+	for _, path := range targets {
+		if _, err := os.Lstat(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, err
+		}
+		if !opts.DryRun {
+			if err := os.RemoveAll(path); err != nil {
+				return removed, errors.Wrapf(err, "failed to remove %s", path)
+			}
+		}
+		removed = append(removed, path)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"removed": len(removed),
+		"dry-run": opts.DryRun,
+	}).Debug("torcx state reset")
+	return removed, nil
+}
+
+// dirEntries returns the paths of all entries in `dir`, if it exists.
+func dirEntries(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	paths := make([]string, 0, len(files))
+	for _, fi := range files {
+		paths = append(paths, filepath.Join(dir, fi.Name()))
+	}
+	return paths, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestReset(t *testing.T) {
+	base := t.TempDir()
+	cc := &CommonConfig{
+		BaseDir: filepath.Join(base, "var"),
+		ConfDir: filepath.Join(base, "etc"),
+	}
+	files := []string{
+		filepath.Join(cc.UserProfileDir(), "custom.json"),
+		cc.NodeProfiles(),
+		filepath.Join(cc.UserStorePath(""), "foo:1.torcx.tgz"),
+		filepath.Join(cc.UserStorePath("1680.2.0"), "bar:1.torcx.tgz"),
+		cc.NextProfile(),
+		filepath.Join(cc.RemoteContentsCacheDir(), "r.json"),
+		cc.GoodProfile(),
+	}
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(f, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := Reset(cc, ResetOptions{NextProfile: true, History: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{cc.NextProfile(), cc.GoodProfile()}; !reflect.DeepEqual(removed, expected) {
+		t.Errorf("expected %v, got %v", expected, removed)
+	}
+	if !IsExistingPath(cc.NextProfile()) {
+		t.Error("dry-run removed next-profile")
+	}
+
+	removed, err = Reset(cc, ResetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		filepath.Join(cc.UserProfileDir(), "custom.json"),
+		cc.NodeProfiles(),
+		filepath.Join(cc.UserStorePath(""), "1680.2.0"),
+		filepath.Join(cc.UserStorePath(""), "foo:1.torcx.tgz"),
+		cc.NextProfile(),
+		cc.RemoteContentsCacheDir(),
+		cc.GoodProfile(),
+	}
+	sort.Strings(expected)
+	sort.Strings(removed)
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("expected %v, got %v", expected, removed)
+	}
+	for _, f := range files {
+		if IsExistingPath(f) {
+			t.Errorf("%s not removed", f)
+		}
+	}
+	if !IsExistingPath(cc.UserStorePath("")) {
+		t.Error("user store directory removed")
+	}
+}
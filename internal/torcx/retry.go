@@ -0,0 +1,226 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// FetchErrorClass is the class of a failed fetch attempt.
+type FetchErrorClass string
+
+const (
+	// FetchErrorDNS - name resolution failure
+	FetchErrorDNS FetchErrorClass = "dns"
+	// FetchErrorTLS - TLS handshake or certificate failure
+	FetchErrorTLS FetchErrorClass = "tls"
+	// FetchErrorTimeout - connection, request or I/O timeout
+	FetchErrorTimeout FetchErrorClass = "timeout"
+	// FetchErrorNetwork - other connection-level failure
+	FetchErrorNetwork FetchErrorClass = "network"
+	// FetchErrorClient - HTTP 4xx status
+	FetchErrorClient FetchErrorClass = "http-4xx"
+	// FetchErrorServer - HTTP 5xx status (and rate-limiting)
+	FetchErrorServer FetchErrorClass = "http-5xx"
+	// FetchErrorOther - anything else (e.g. a hash mismatch)
+	FetchErrorOther FetchErrorClass = "other"
+)
+
+var (
+	// fetchRetryBudgets holds the maximum number of failed attempts per
+	// error class. Transient network conditions, common at early boot,
+	// get a large budget: with delays capped at fetchBackoffMax, they
+	// are retried for roughly 7 to 14 minutes at most.
+	fetchRetryBudgets = map[FetchErrorClass]int{
+		FetchErrorDNS:     20,
+		FetchErrorTimeout: 20,
+		FetchErrorNetwork: 20,
+		FetchErrorTLS:     3,
+		FetchErrorClient:  1,
+		FetchErrorServer:  10,
+		FetchErrorOther:   3,
+	}
+
+	// fetchBackoffBase is the initial delay between fetch attempts.
+	fetchBackoffBase = 1 * time.Second
+	// fetchBackoffMax caps the delay between fetch attempts.
+	fetchBackoffMax = 60 * time.Second
+
+	// fetchErrors counts failed fetch attempts per error class.
+	fetchErrors = expvar.NewMap("torcx_fetch_errors")
+
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// FetchError is returned when fetching from a remote failed, after
+// exhausting the retry budget for its class.
+type FetchError struct {
+	Class    FetchErrorClass
+	Attempts int
+	Err      error
+}
+
+// Error implements error.
+func (fe *FetchError) Error() string {
+	return fmt.Sprintf("%s (class %s, after %d attempts)", fe.Err, fe.Class, fe.Attempts)
+}
+
+// Cause returns the underlying error of the last attempt.
+func (fe *FetchError) Cause() error {
+	return fe.Err
+}
+
+// httpStatusError is returned on unexpected HTTP response statuses.
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+// Error implements error.
+func (he *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status %q", he.Status)
+}
+
+// checkHTTPStatus ensures that `resp` is a successful response.
+func checkHTTPStatus(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return &httpStatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+	return nil
+}
+
+// classifyFetchError determines the class of a fetch error.
+func classifyFetchError(err error) FetchErrorClass {
+	class := FetchErrorOther
+	err = errors.Cause(err)
+	for err != nil {
+		switch e := err.(type) {
+		case *httpStatusError:
+			switch {
+			case e.StatusCode == http.StatusRequestTimeout:
+				return FetchErrorTimeout
+			case e.StatusCode == http.StatusTooManyRequests:
+				return FetchErrorServer
+			case e.StatusCode >= 500:
+				return FetchErrorServer
+			default:
+				return FetchErrorClient
+			}
+		case *net.DNSError:
+			if e.IsTimeout {
+				return FetchErrorTimeout
+			}
+			return FetchErrorDNS
+		case x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError, tls.RecordHeaderError:
+			return FetchErrorTLS
+		case *url.Error:
+			if e.Timeout() {
+				return FetchErrorTimeout
+			}
+			err = e.Err
+		case *net.OpError:
+			if e.Timeout() {
+				return FetchErrorTimeout
+			}
+			class = FetchErrorNetwork
+			err = e.Err
+		default:
+			if err == context.DeadlineExceeded {
+				return FetchErrorTimeout
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return FetchErrorTimeout
+			}
+			return class
+		}
+	}
+	return class
+}
+
+// backoffDelay returns the jittered delay before attempt number `attempt`+1,
+// exponentially increasing and capped at fetchBackoffMax.
+func backoffDelay(attempt int) time.Duration {
+	delay := fetchBackoffBase
+	for i := 1; i < attempt && delay < fetchBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > fetchBackoffMax {
+		delay = fetchBackoffMax
+	}
+
+	// Jitter in [delay/2, delay), to spread retries of many nodes.
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	half := delay / 2
+	return half + time.Duration(jitterRand.Int63n(int64(half)+1))
+}
+
+// retryFetch runs `fetch` until it succeeds, the context expires, or the
+// retry budget for the class of its error is exhausted.
+func retryFetch(ctx context.Context, fields logrus.Fields, fetch func() error) error {
+	failures := map[FetchErrorClass]int{}
+	attempt := 0
+	for {
+		attempt++
+		err := fetch()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err == nil {
+			return nil
+		}
+
+		class := classifyFetchError(err)
+		fetchErrors.Add(string(class), 1)
+		failures[class]++
+		if budget, ok := fetchRetryBudgets[class]; ok && failures[class] >= budget {
+			return &FetchError{
+				Class:    class,
+				Attempts: attempt,
+				Err:      err,
+			}
+		}
+
+		delay := backoffDelay(attempt)
+		logrus.WithFields(fields).WithFields(logrus.Fields{
+			"attempt":  attempt,
+			"class":    class,
+			"error":    err,
+			"retry_in": delay.String(),
+		}).Error("fetch attempt failed")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func TestClassifyFetchError(t *testing.T) {
+	tests := []struct {
+		err error
+		exp FetchErrorClass
+	}{
+		{&httpStatusError{StatusCode: 404}, FetchErrorClient},
+		{&httpStatusError{StatusCode: 429}, FetchErrorServer},
+		{&httpStatusError{StatusCode: 503}, FetchErrorServer},
+		{&httpStatusError{StatusCode: 408}, FetchErrorTimeout},
+		{&url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Name: "example.com"}}}, FetchErrorDNS},
+		{&url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, FetchErrorNetwork},
+		{errors.Wrap(context.DeadlineExceeded, "wrapped"), FetchErrorTimeout},
+		{errors.New("mismatching hash"), FetchErrorOther},
+	}
+
+	for _, tt := range tests {
+		class := classifyFetchError(tt.err)
+		if class != tt.exp {
+			t.Errorf("%q: expected class %s, got %s", tt.err, tt.exp, class)
+		}
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for attempt := 1; attempt < 12; attempt++ {
+		delay := backoffDelay(attempt)
+		if delay < fetchBackoffBase/2 || delay > fetchBackoffMax {
+			t.Errorf("attempt %d: delay %s out of bounds", attempt, delay)
+		}
+	}
+}
+
+func TestRetryFetch(t *testing.T) {
+	oldBase, oldMax := fetchBackoffBase, fetchBackoffMax
+	fetchBackoffBase, fetchBackoffMax = time.Millisecond, 2*time.Millisecond
+	defer func() { fetchBackoffBase, fetchBackoffMax = oldBase, oldMax }()
+	ctx := context.Background()
+
+	// Client errors are not retried.
+	attempts := 0
+	err := retryFetch(ctx, logrus.Fields{}, func() error {
+		attempts++
+		return &httpStatusError{StatusCode: 404, Status: "404 Not Found"}
+	})
+	fe, ok := err.(*FetchError)
+	if !ok {
+		t.Fatalf("expected FetchError, got %v", err)
+	}
+	if fe.Class != FetchErrorClient || attempts != 1 {
+		t.Errorf("unexpected class %s after %d attempts", fe.Class, attempts)
+	}
+
+	// Transient errors are retried until success.
+	attempts = 0
+	err = retryFetch(ctx, logrus.Fields{}, func() error {
+		attempts++
+		if attempts < 4 {
+			return &net.DNSError{Name: "example.com"}
+		}
+		return nil
+	})
+	if err != nil || attempts != 4 {
+		t.Errorf("unexpected result %v after %d attempts", err, attempts)
+	}
+
+	// Even without a deadline, they are not retried forever.
+	attempts = 0
+	err = retryFetch(ctx, logrus.Fields{}, func() error {
+		attempts++
+		return &net.DNSError{Name: "example.com"}
+	})
+	fe, ok = err.(*FetchError)
+	if !ok {
+		t.Fatalf("expected FetchError, got %v", err)
+	}
+	if fe.Class != FetchErrorDNS || attempts != fetchRetryBudgets[FetchErrorDNS] {
+		t.Errorf("unexpected class %s after %d attempts", fe.Class, attempts)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// RoleV0K - role manifest kind, v0
+const RoleV0K = "torcx-role-v0"
+
+// Role is a named set of interchangeable images, with constraints on how
+// many of them a profile may use (e.g. a `container-runtime` role satisfied
+// by exactly one of docker or containerd).
+type Role struct {
+	// Images are the names of the images fulfilling the role.
+	Images []string `json:"images"`
+	// Min is the minimum number of these images to apply.
+	Min int `json:"min,omitempty"`
+	// Max is the maximum number of these images to apply, if not zero.
+	Max int `json:"max,omitempty"`
+	// Default is the image added when fewer than Min images are selected.
+	Default *ImageV1 `json:"default,omitempty"`
+}
+
+// RoleV0JSON holds a JSON role manifest (version 0).
+type RoleV0JSON struct {
+	Kind  string `json:"kind"`
+	Value Role   `json:"value"`
+}
+
+// ReadRole reads role `name` from the role directories, the last one
+// taking precedence.
+func (cc *CommonConfig) ReadRole(name string) (*Role, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, errors.Errorf("invalid role name %q", name)
+	}
+	dirs := cc.RoleDirs()
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path := filepath.Join(dirs[i], name+".json")
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var manifest RoleV0JSON
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode role %s", path)
+		}
+		if manifest.Kind != RoleV0K {
+			if err := futureKind(manifest.Kind, ""); err != nil {
+				return nil, errors.Wrapf(err, "role %s", path)
+			}
+			return nil, errors.Errorf("invalid role kind in %s: %q", path, manifest.Kind)
+		}
+		role := manifest.Value
+		if len(role.Images) == 0 || role.Min < 0 || (role.Max > 0 && role.Max < role.Min) {
+			return nil, errors.Errorf("invalid constraints for role %s", name)
+		}
+		return &role, nil
+	}
+	return nil, errors.Errorf("role %q not found", name)
+}
+
+// resolveRoles checks `images` against the constraints of `roles`, adding
+// role defaults where needed, and returns the resulting images.
+func resolveRoles(cc *CommonConfig, images []Image, roles []string) ([]Image, error) {
+	for _, name := range roles {
+		role, err := cc.ReadRole(name)
+		if err != nil {
+			return nil, err
+		}
+		members := map[string]bool{}
+		for _, member := range role.Images {
+			members[member] = true
+		}
+		selected := []string{}
+		for _, im := range images {
+			if members[im.Name] {
+				selected = append(selected, im.Name)
+			}
+		}
+
+		if len(selected) < role.Min && role.Default != nil && members[role.Default.Name] {
+			im := ImageFromJSONV1(*role.Default)
+			images = append(images, im)
+			selected = append(selected, im.Name)
+			logrus.WithFields(logrus.Fields{
+				"role":      name,
+				"image":     im.Name,
+				"reference": im.Reference,
+			}).Debug("role default added")
+		}
+		if len(selected) < role.Min {
+			return nil, errors.Errorf("role %s requires at least %d of %s, got %d", name, role.Min, strings.Join(role.Images, ", "), len(selected))
+		}
+		if role.Max > 0 && len(selected) > role.Max {
+			return nil, errors.Errorf("role %s allows at most %d of %s, got %s", name, role.Max, strings.Join(role.Images, ", "), strings.Join(selected, ", "))
+		}
+	}
+	return images, nil
+}
+
+// appendUnique appends `names` to `list`, skipping the ones already in it.
+func appendUnique(list []string, names ...string) []string {
+	for _, name := range names {
+		found := false
+		for _, entry := range list {
+			if entry == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, name)
+		}
+	}
+	return list
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveRoles(t *testing.T) {
+	dir := t.TempDir()
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			RunDir:  dir,
+			ConfDir: filepath.Join(dir, "conf"),
+			UsrDir:  filepath.Join(dir, "usr"),
+		},
+		LowerProfiles: []string{"vendor"},
+		UpperProfile:  "user",
+	}
+	files := map[string]string{
+		filepath.Join(VendorRolesDir(applyCfg.UsrDir), "container-runtime.json"): `{"kind": "torcx-role-v0", "value": {"images": ["docker", "containerd"], "min": 1, "max": 1, "default": {"name": "docker", "reference": "com.coreos.cl"}}}`,
+		filepath.Join(VendorProfilesDir(applyCfg.UsrDir), "vendor.json"):         `{"kind": "profile-manifest-v1", "value": {"roles": ["container-runtime"], "images": []}}`,
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	userProfile := filepath.Join(applyCfg.UserProfileDir(), "user.json")
+	if err := os.MkdirAll(filepath.Dir(userProfile), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		images   string
+		expected []string
+		err      string
+	}{
+		{``, []string{"docker"}, ""},
+		{`{"name": "containerd", "reference": "1.4"}`, []string{"containerd"}, ""},
+		{`{"name": "containerd", "reference": "1.4"}, {"name": "docker", "reference": "20.10"}`, nil, "allows at most 1"},
+	}
+	for _, tt := range tests {
+		profile := `{"kind": "profile-manifest-v1", "value": {"images": [` + tt.images + `]}}`
+		if err := ioutil.WriteFile(userProfile, []byte(profile), 0644); err != nil {
+			t.Fatal(err)
+		}
+		images, err := mergeProfiles(applyCfg)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected error %q, got %v", tt.images, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.images, err)
+			continue
+		}
+		names := []string{}
+		for _, im := range images {
+			names = append(names, im.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(tt.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", tt.images, tt.expected, names)
+		}
+	}
+
+	// User roles take precedence over vendor ones.
+	userRole := filepath.Join(applyCfg.ConfDir, "roles", "container-runtime.json")
+	if err := os.MkdirAll(filepath.Dir(userRole), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(userRole, []byte(`{"kind": "torcx-role-v0", "value": {"images": ["docker", "containerd"], "max": 2}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mergeProfiles(applyCfg); err != nil {
+		t.Errorf("expected user role to allow both runtimes: %s", err)
+	}
+}
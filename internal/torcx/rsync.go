@@ -0,0 +1,108 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// rsyncBinary is the rsync client used for "rsync" remotes.
+var rsyncBinary = "rsync"
+
+// rsyncIOTimeout is the rsync I/O timeout, in seconds.
+const rsyncIOTimeout = "30"
+
+// rsync transfers `src` (an rsync URL) to local path `dest`, with
+// additional rsync options `opts`.
+// Transfers are performed in place, so that an interrupted transfer
+// can be resumed by re-running it against the same destination.
+func rsync(ctx context.Context, src string, dest string, opts ...string) error {
+	args := []string{
+		"--quiet",
+		"--partial",
+		"--inplace",
+		"--no-motd",
+		"--timeout=" + rsyncIOTimeout,
+	}
+	args = append(args, opts...)
+	args = append(args, "--", src, dest)
+	cmd := exec.CommandContext(ctx, rsyncBinary, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "rsync of %s failed: %s", src, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// rsyncManifest retrieves a contents manifest from an rsync remote.
+func rsyncManifest(ctx context.Context, urlRaw string) (string, error) {
+	tmpDir, err := ioutil.TempDir("", "torcx-rsync")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dest := filepath.Join(tmpDir, "manifest")
+	if err := rsync(ctx, urlRaw, dest); err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(dest)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// rsyncArchive transfers an image archive from an rsync remote.
+// Partial transfers are kept across attempts and resumed by rsync
+// delta-transfer, unless the resulting archive fails verification.
+func (rc *RemotesCache) rsyncArchive(ctx context.Context, baseURL *url.URL, location *url.URL, baseDir string, hash string, size int64) error {
+	fileName := path.Base(location.String())
+	if archiveFormatOf(fileName) == ArchiveFormatUnknown {
+		return errors.Errorf("invalid extension for image archive %s", fileName)
+	}
+	targetPath := filepath.Join(baseDir, fileName)
+
+	lock, fetched, err := lockArchive(ctx, targetPath, hash)
+	if err != nil || fetched {
+		return err
+	}
+	defer unlockFile(lock)
+
+	tmpName := partialPath(baseDir, fileName, hash)
+	fullURL := baseURL.ResolveReference(location)
+	logrus.WithFields(logrus.Fields{
+		"url": fullURL.String(),
+	}).Info("transferring image archive from remote")
+	if err := rsync(ctx, fullURL.String(), tmpName); err != nil {
+		return err
+	}
+
+	if err := installArchive(tmpName, targetPath, hash, size); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeRsync installs a fake rsync client, recording its arguments under
+// `dir` and copying `payload` to the destination. Transfers of sources
+// named "missing" fail instead.
+func fakeRsync(t *testing.T, dir string, payload string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, "payload"), []byte(payload), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := `#!/bin/sh
+printf '%s\n' "$@" > "` + dir + `/args"
+for arg; do src="$dest"; dest="$arg"; done
+case "$src" in
+*missing*)
+	echo "@ERROR: file not found" >&2
+	exit 23
+	;;
+esac
+cat "` + dir + `/payload" > "$dest"
+`
+	fakeTool := filepath.Join(dir, "rsync")
+	if err := ioutil.WriteFile(fakeTool, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldTool := rsyncBinary
+	rsyncBinary = fakeTool
+	t.Cleanup(func() { rsyncBinary = oldTool })
+}
+
+func TestRsyncArgs(t *testing.T) {
+	dir := t.TempDir()
+	fakeRsync(t, dir, "manifest")
+
+	dest := filepath.Join(dir, "dest")
+	if err := rsync(context.Background(), "rsync://example.com/torcx/manifest.json", dest, "--bwlimit=100"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Split(strings.TrimSpace(string(b)), "\n")
+	expected := []string{
+		"--quiet", "--partial", "--inplace", "--no-motd", "--timeout=30",
+		"--bwlimit=100",
+		"--", "rsync://example.com/torcx/manifest.json", dest,
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("got arguments %q, expected %q", args, expected)
+	}
+}
+
+func TestRsyncFailure(t *testing.T) {
+	dir := t.TempDir()
+	fakeRsync(t, dir, "")
+
+	_, err := rsyncManifest(context.Background(), "rsync://example.com/torcx/missing.json")
+	if err == nil {
+		t.Fatal("expected rsync failure")
+	}
+	if !strings.Contains(err.Error(), "@ERROR: file not found") {
+		t.Fatalf("rsync output missing from error: %v", err)
+	}
+}
+
+func TestRsyncArchive(t *testing.T) {
+	dir := t.TempDir()
+	fakeRsync(t, dir, "archive")
+	baseDir := t.TempDir()
+	baseURL, err := url.Parse("rsync://example.com/torcx/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The payload transferred by the fake client, and another hash.
+	ref := filepath.Join(dir, "payload")
+	hash, err := hashFile(ref, HashSHA512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRef := filepath.Join(dir, "other")
+	if err := ioutil.WriteFile(otherRef, []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	otherHash, err := hashFile(otherRef, HashSHA512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &RemotesCache{}
+	location := &url.URL{Path: "foo:1.torcx.tgz"}
+	targetPath := filepath.Join(baseDir, "foo:1.torcx.tgz")
+	err = rc.rsyncArchive(context.Background(), baseURL, location, baseDir, otherHash, -1)
+	if err == nil || !strings.Contains(err.Error(), "mismatching hash") {
+		t.Fatalf("expected hash mismatch, got %v", err)
+	}
+	if _, err := os.Stat(partialPath(baseDir, "foo:1.torcx.tgz", otherHash)); !os.IsNotExist(err) {
+		t.Errorf("partial archive kept after hash mismatch: %v", err)
+	}
+	if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+		t.Errorf("mismatching archive installed: %v", err)
+	}
+
+	if err := rc.rsyncArchive(context.Background(), baseURL, location, baseDir, hash, -1); err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := validateHash(targetPath, hash); err != nil || !valid {
+		t.Fatalf("archive not installed: %t %v", valid, err)
+	}
+}
+
+func TestRsyncArchiveExtension(t *testing.T) {
+	dir := t.TempDir()
+	fakeRsync(t, dir, "archive")
+	baseURL, err := url.Parse("rsync://example.com/torcx/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &RemotesCache{}
+	err = rc.rsyncArchive(context.Background(), baseURL, &url.URL{Path: "foo:1.zip"}, t.TempDir(), "", -1)
+	if err == nil || !strings.Contains(err.Error(), "invalid extension") {
+		t.Fatalf("expected invalid extension, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "args")); !os.IsNotExist(err) {
+		t.Errorf("rsync invoked for an invalid archive: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// selinuxXattr is the extended attribute holding SELinux file labels.
+const selinuxXattr = "security.selinux"
+
+var (
+	// SelinuxEnforcePath is the selinuxfs entry signaling SELinux is enabled.
+	SelinuxEnforcePath = "/sys/fs/selinux/enforce"
+
+	// setFileContext labels `path` (without following symlinks).
+	setFileContext = func(path, context string) error {
+		return unix.Lsetxattr(path, selinuxXattr, []byte(context), 0)
+	}
+
+	// selinuxContextRegexp matches "user:role:type[:range]" contexts.
+	selinuxContextRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.]+:[a-zA-Z0-9_.]+:[a-zA-Z0-9_.]+(:[a-zA-Z0-9_.,:-]+)?$`)
+)
+
+// FileContext maps a path inside an image to an SELinux file context.
+type FileContext struct {
+	// Path is the absolute path inside the image; directories are
+	// labelled recursively.
+	Path string `json:"path"`
+	// Context is the SELinux context, e.g. "system_u:object_r:bin_t:s0".
+	Context string `json:"context"`
+}
+
+// Validate checks that the file context mapping is well-formed.
+func (fc FileContext) Validate() error {
+	if !filepath.IsAbs(fc.Path) || filepath.Clean(fc.Path) != fc.Path {
+		return errors.Errorf("invalid file context path %q, must be absolute and clean", fc.Path)
+	}
+	if !selinuxContextRegexp.MatchString(fc.Context) {
+		return errors.Errorf("invalid SELinux context %q for %s", fc.Context, fc.Path)
+	}
+	return nil
+}
+
+// selinuxEnabled returns whether SELinux is enabled on the host.
+func selinuxEnabled() bool {
+	_, err := os.Stat(SelinuxEnforcePath)
+	return err == nil
+}
+
+// applyFileContexts labels the unpacked assets of an image according to
+// its manifest, if SELinux is enabled. Read-only (mounted) images can not
+// be relabelled, and must carry their labels in the archive instead.
+func applyFileContexts(applyCfg *ApplyConfig, imageRoot string, contexts []FileContext) error {
+	if len(contexts) <= 0 {
+		// Corner-case: no file contexts to apply
+		return nil
+	}
+	if applyCfg == nil {
+		return errors.New("missing apply configuration")
+	}
+	if imageRoot == "" {
+		return errors.New("missing image top directory")
+	}
+	for _, fc := range contexts {
+		if err := fc.Validate(); err != nil {
+			return err
+		}
+	}
+	if !selinuxEnabled() {
+		logrus.WithField("path", imageRoot).Debug("SELinux disabled, skipping file contexts")
+		return nil
+	}
+
+	for _, fc := range contexts {
+		root := filepath.Join(imageRoot, fc.Path)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return setFileContext(path, fc.Context)
+		})
+		if errors.Cause(err) == unix.EROFS {
+			logrus.WithFields(logrus.Fields{
+				"path":    root,
+				"context": fc.Context,
+			}).Warn("read-only image, file contexts must be embedded in the archive")
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to label %s as %s", fc.Path, fc.Context)
+		}
+	}
+	return nil
+}
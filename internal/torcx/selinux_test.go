@@ -0,0 +1,93 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileContextValidate(t *testing.T) {
+	for _, tt := range []struct {
+		fc    FileContext
+		valid bool
+	}{
+		{FileContext{"/bin/foo", "system_u:object_r:bin_t:s0"}, true},
+		{FileContext{"/lib/foo", "system_u:object_r:lib_t:s0-s0:c0.c1023"}, true},
+		{FileContext{"/bin/foo", "system_u:object_r:bin_t"}, true},
+		{FileContext{"bin/foo", "system_u:object_r:bin_t:s0"}, false},
+		{FileContext{"/bin/../foo", "system_u:object_r:bin_t:s0"}, false},
+		{FileContext{"/bin/foo", "bin_t"}, false},
+		{FileContext{"/bin/foo", "system_u:object_r:bin_t:s0\n"}, false},
+	} {
+		if err := tt.fc.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: expected valid=%t, got %v", tt.fc, tt.valid, err)
+		}
+	}
+}
+
+func TestApplyFileContexts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_selinux_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	imageRoot := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(filepath.Join(imageRoot, "lib", "foo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(imageRoot, "lib", "foo", "data"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]string{}
+	origSet, origEnforce := setFileContext, SelinuxEnforcePath
+	defer func() { setFileContext, SelinuxEnforcePath = origSet, origEnforce }()
+	setFileContext = func(path, context string) error {
+		labels[path] = context
+		return nil
+	}
+	contexts := []FileContext{{"/lib/foo", "system_u:object_r:foo_var_lib_t:s0"}}
+	applyCfg := &ApplyConfig{}
+
+	// Disabled SELinux skips labelling.
+	SelinuxEnforcePath = filepath.Join(dir, "missing")
+	if err := applyFileContexts(applyCfg, imageRoot, contexts); err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 0 {
+		t.Errorf("unexpected labels with SELinux disabled: %v", labels)
+	}
+
+	SelinuxEnforcePath = filepath.Join(dir, "enforce")
+	if err := ioutil.WriteFile(SelinuxEnforcePath, []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyFileContexts(applyCfg, imageRoot, contexts); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"lib/foo", "lib/foo/data"} {
+		if labels[filepath.Join(imageRoot, p)] != contexts[0].Context {
+			t.Errorf("%s not labelled, got %v", p, labels)
+		}
+	}
+
+	if err := applyFileContexts(applyCfg, imageRoot, []FileContext{{"/missing", contexts[0].Context}}); err == nil {
+		t.Error("expected error labelling missing path")
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+)
+
+// remoteContentsName is the file name of contents manifests under a remote base URL.
+const remoteContentsName = "torcx_remote_contents.json.asc"
+
+// StoreServer serves local stores over HTTP in the layout of a remote:
+// a contents manifest, generated from the current store contents and
+// clearsigned by Signer (if set), with archives and their sidecars next to it.
+// It lets a build machine act as the remote for a test lab.
+type StoreServer struct {
+	StorePaths []string
+	// Signer is the private key used to sign contents manifests. If nil,
+	// manifests are served unsigned, and only accepted by remotes without keys.
+	Signer *openpgp.Entity
+
+	mu     sync.Mutex
+	hashes map[string]cachedHash
+}
+
+// cachedHash is an archive hash, valid as long as the archive is unchanged.
+type cachedHash struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// NewStoreServer returns an HTTP handler serving `storePaths` as a remote.
+func NewStoreServer(storePaths []string, signer *openpgp.Entity) *StoreServer {
+	return &StoreServer{
+		StorePaths: storePaths,
+		Signer:     signer,
+		hashes:     map[string]cachedHash{},
+	}
+}
+
+// ReadSigningKey reads the first private key from the armored keyring at
+// `path`, for signing contents manifests. Encrypted keys are not supported.
+func ReadSigningKey(path string) (*openpgp.Entity, error) {
+	keys, err := readArmoredKeys(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading signing key %s", path)
+	}
+	for _, key := range keys {
+		if key.PrivateKey == nil {
+			continue
+		}
+		if key.PrivateKey.Encrypted {
+			return nil, errors.Errorf("signing key %s is encrypted", path)
+		}
+		return key, nil
+	}
+	return nil, errors.Errorf("no private key found in %s", path)
+}
+
+// ServeHTTP implements http.Handler.
+func (ss *StoreServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	storeCache, err := NewStoreCache(ss.StorePaths)
+	if err != nil {
+		http.Error(w, "failed to list stores", http.StatusInternalServerError)
+		return
+	}
+
+	if name == remoteContentsName {
+		manifest, err := ss.contentsManifest(&storeCache)
+		if err != nil {
+			logrus.WithField("error", err).Error("failed to generate contents manifest")
+			http.Error(w, "failed to generate contents manifest", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(w, r, name, time.Now(), bytes.NewReader(manifest))
+		return
+	}
+
+	filePath := serveLookup(&storeCache, name)
+	if filePath == "" {
+		http.NotFound(w, r)
+		return
+	}
+	fp, err := os.Open(filePath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		http.Error(w, "failed to stat archive", http.StatusInternalServerError)
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"path":   filePath,
+		"client": r.RemoteAddr,
+	}).Debug("serving store file")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, name, fi.ModTime(), fp)
+}
+
+// serveLookup returns the path of the archive (or archive sidecar) served
+// as `name`, or an empty string if there is none.
+func serveLookup(storeCache *StoreCache, name string) string {
+	if name == "" || strings.Contains(name, "/") {
+		return ""
+	}
+	for _, ar := range storeCache.Images {
+		base := filepath.Base(ar.Filepath)
+		if name == base {
+			return ar.Filepath
+		}
+		for _, suffix := range []string{signatureSidecarSuffix, timestampSidecarSuffix, metaSidecarSuffix} {
+			if name == base+suffix && IsExistingPath(ar.Filepath+suffix) {
+				return ar.Filepath + suffix
+			}
+		}
+	}
+	return ""
+}
+
+// contentsManifest generates the (signed) contents manifest for all archives in stores.
+func (ss *StoreServer) contentsManifest(storeCache *StoreCache) ([]byte, error) {
+	archives := make([]Archive, 0, len(storeCache.Images))
+	for _, ar := range storeCache.Images {
+		archives = append(archives, ar)
+	}
+	contents, err := remoteContents(archives, ss.archiveHash)
+	if err != nil {
+		return nil, err
+	}
+	return encodeContents(contents, ss.Signer)
+}
+
+// archiveHash returns the hash of the archive at `path`, computing it only
+// if the archive changed since it was last hashed.
+func (ss *StoreServer) archiveHash(path string, fi os.FileInfo) (string, error) {
+	ss.mu.Lock()
+	cached, ok := ss.hashes[path]
+	ss.mu.Unlock()
+	if ok && cached.size == fi.Size() && cached.modTime.Equal(fi.ModTime()) {
+		return cached.hash, nil
+	}
+
+	hash, err := computeHash(path)
+	if err != nil {
+		return "", err
+	}
+	ss.mu.Lock()
+	ss.hashes[path] = cachedHash{fi.Size(), fi.ModTime(), hash}
+	ss.mu.Unlock()
+	return hash, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestStoreServer(t *testing.T) {
+	dir := t.TempDir()
+	storeDir := filepath.Join(dir, "store")
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(storeDir, "foo:1.torcx.tgz")
+	writeTestTgz(t, archive, map[string]string{"bin/foo": "foo"})
+	signer := writeTrustedKey(t, filepath.Join(dir, "key.asc"))
+
+	server := httptest.NewServer(NewStoreServer([]string{storeDir}, signer))
+	defer server.Close()
+
+	get := func(name string) (int, string) {
+		resp, err := http.Get(server.URL + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	status, manifest := get(remoteContentsName)
+	if status != http.StatusOK {
+		t.Fatalf("unexpected status %d for contents manifest", status)
+	}
+	plaintext, err := verifyManifest("test", manifest, []openpgp.KeyRing{openpgp.EntityList{signer}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := decodeContents(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location, hash, err := contents.CheckAvailable(Image{Name: "foo", Reference: "1", Remote: "lab"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archiveURL := baseURL.ResolveReference(location)
+	if archiveURL.Path != "/foo:1.torcx.tgz" {
+		t.Fatalf("unexpected location %v", location)
+	}
+	if valid, err := validateHash(archive, hash); err != nil || !valid {
+		t.Errorf("published hash %s does not match archive: %v", hash, err)
+	}
+
+	status, content := get(archiveURL.Path[1:])
+	expected, err := ioutil.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || content != string(expected) {
+		t.Errorf("unexpected archive response %d", status)
+	}
+	for _, name := range []string{"foo:1.torcx.tgz.asc", "../store/foo:1.torcx.tgz", "bar:1.torcx.tgz"} {
+		if status, _ := get(name); status != http.StatusNotFound {
+			t.Errorf("expected %s not to be found, got %d", name, status)
+		}
+	}
+}
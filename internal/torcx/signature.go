@@ -0,0 +1,246 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+var (
+	// ErrUnknownSigner is returned when a signature was not issued by any
+	// key in the keyrings.
+	ErrUnknownSigner = errors.New("signed by an unknown key")
+	// ErrKeyExpired is returned when the signing key (or its primary key)
+	// has expired.
+	ErrKeyExpired = errors.New("signing key expired")
+	// ErrKeyRevoked is returned when the signing key (or its primary key)
+	// has been revoked.
+	ErrKeyRevoked = errors.New("signing key revoked")
+	// ErrBadSignature is returned when a signature, issued by a valid key,
+	// does not match the signed content.
+	ErrBadSignature = errors.New("bad signature")
+
+	// signatureTime returns the time key expiry is checked against.
+	signatureTime = time.Now
+)
+
+// Revocation reasons (RFC4880, section 5.2.3.23) which do not imply a key
+// compromise.
+const (
+	revocationSuperseded = 1
+	revocationRetired    = 3
+)
+
+// usableKeys is a keyring formed by keys already checked for signing.
+type usableKeys []openpgp.Key
+
+func (keys usableKeys) KeysById(id uint64) []openpgp.Key {
+	return keys
+}
+
+func (keys usableKeys) KeysByIdUsage(id uint64, requiredUsage byte) []openpgp.Key {
+	return keys
+}
+
+func (keys usableKeys) DecryptionKeys() []openpgp.Key {
+	return nil
+}
+
+// checkArmoredSignature checks the armored detached signature `armored` of
+// `signed` against `keyring`, optionally countersigned by `stamp`,
+// returning the signer.
+func checkArmoredSignature(keyring openpgp.KeyRing, signed io.Reader, armored io.Reader, stamp *signatureTimestamp) (*openpgp.Entity, error) {
+	block, err := armor.Decode(armored)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding armored signature")
+	}
+	if block.Type != openpgp.SignatureType {
+		return nil, errors.Errorf("unexpected armor type %q", block.Type)
+	}
+	return checkSignatureAt(keyring, signed, block.Body, stamp)
+}
+
+// checkSignature checks the binary detached signature `sig` of `signed`
+// against `keyring`, returning the signer. Unlike openpgp, it honors key
+// expiry, and tells expired and revoked keys apart from bad signatures.
+func checkSignature(keyring openpgp.KeyRing, signed io.Reader, sig io.Reader) (*openpgp.Entity, error) {
+	return checkSignatureAt(keyring, signed, sig, nil)
+}
+
+// checkSignatureAt is checkSignature for a signature optionally
+// countersigned by `stamp`: keys are then checked at the timestamp, so
+// that signatures made before keys expired (or were retired) stay valid.
+func checkSignatureAt(keyring openpgp.KeyRing, signed io.Reader, sig io.Reader, stamp *signatureTimestamp) (*openpgp.Entity, error) {
+	sigBytes, err := ioutil.ReadAll(sig)
+	if err != nil {
+		return nil, err
+	}
+	issuer, created, err := signatureIssuer(sigBytes)
+	if err != nil {
+		return nil, err
+	}
+	now := signatureTime()
+	if stamp != nil {
+		if created.After(stamp.Time) {
+			return nil, errors.Errorf("signature created on %s, after its timestamp", created.UTC().Format(time.RFC3339))
+		}
+		now = stamp.Time
+	}
+
+	candidates := keyring.KeysById(issuer)
+	if len(candidates) == 0 {
+		return nil, errors.Wrapf(ErrUnknownSigner, "key %016X", issuer)
+	}
+	usable := usableKeys{}
+	var keyErr error
+	for _, key := range candidates {
+		if err := checkSigningKey(key, now, stamp != nil); err != nil {
+			keyErr = err
+			continue
+		}
+		usable = append(usable, key)
+	}
+	if len(usable) == 0 {
+		return nil, keyErr
+	}
+
+	signer, err := openpgp.CheckDetachedSignature(usable, signed, bytes.NewReader(sigBytes))
+	if err != nil {
+		return nil, errors.Wrapf(ErrBadSignature, "key %016X: %s", issuer, err)
+	}
+	return signer, nil
+}
+
+// signatureIssuer returns the id of the key which issued `sig`, and when.
+func signatureIssuer(sig []byte) (uint64, time.Time, error) {
+	p, err := packet.NewReader(bytes.NewReader(sig)).Next()
+	if err != nil {
+		return 0, time.Time{}, errors.Wrap(err, "reading signature packet")
+	}
+	switch s := p.(type) {
+	case *packet.Signature:
+		if s.IssuerKeyId == nil {
+			return 0, time.Time{}, errors.New("signature has no issuer key id")
+		}
+		return *s.IssuerKeyId, s.CreationTime, nil
+	case *packet.SignatureV3:
+		return s.IssuerKeyId, s.CreationTime, nil
+	default:
+		return 0, time.Time{}, errors.Errorf("unexpected %T packet, expected a signature", p)
+	}
+}
+
+// checkSigningKey ensures `key` can issue signatures at `now`: neither it
+// nor its primary key may be revoked or expired, and subkeys must be bound
+// for signing. For `timestamped` signatures, keys superseded or retired
+// after `now` are still valid.
+func checkSigningKey(key openpgp.Key, now time.Time, timestamped bool) error {
+	keyID := key.PublicKey.KeyIdString()
+	primary := key.Entity.PrimaryKey
+	primarySig := primarySelfSignature(key.Entity)
+
+	for _, rev := range key.Entity.Revocations {
+		if !(timestamped && retiredAfter(rev, now)) {
+			return errors.Wrapf(ErrKeyRevoked, "primary key %s", primary.KeyIdString())
+		}
+	}
+	if primarySig == nil {
+		return errors.Errorf("key %s has no valid self-signature", primary.KeyIdString())
+	}
+	if expiry, ok := keyExpiry(primary, primarySig); ok && now.After(expiry) {
+		return errors.Wrapf(ErrKeyExpired, "primary key %s on %s", primary.KeyIdString(), expiry.UTC().Format(time.RFC3339))
+	}
+	if key.PublicKey == primary {
+		if primarySig.FlagsValid && !primarySig.FlagSign {
+			return errors.Errorf("key %s is not a signing key", keyID)
+		}
+		return nil
+	}
+
+	binding := key.SelfSignature
+	if binding == nil {
+		return errors.Errorf("subkey %s has no binding signature", keyID)
+	}
+	if binding.SigType == packet.SigTypeSubkeyRevocation || binding.RevocationReason != nil {
+		if !(timestamped && retiredAfter(binding, now)) {
+			return errors.Wrapf(ErrKeyRevoked, "subkey %s", keyID)
+		}
+		// The revocation supersedes the binding signature (and its flags),
+		// keep the behavior of a valid subkey.
+		return nil
+	}
+	if expiry, ok := keyExpiry(key.PublicKey, binding); ok && now.After(expiry) {
+		return errors.Wrapf(ErrKeyExpired, "subkey %s on %s", keyID, expiry.UTC().Format(time.RFC3339))
+	}
+	if !binding.FlagsValid || !binding.FlagSign {
+		return errors.Errorf("subkey %s is not bound for signing", keyID)
+	}
+	return nil
+}
+
+// retiredAfter returns whether the revocation `rev` was issued after `t`
+// for a key superseded or no longer used, as opposed to compromised.
+func retiredAfter(rev *packet.Signature, t time.Time) bool {
+	if rev.RevocationReason == nil || !rev.CreationTime.After(t) {
+		return false
+	}
+	switch *rev.RevocationReason {
+	case revocationSuperseded, revocationRetired:
+		return true
+	}
+	return false
+}
+
+// primarySelfSignature returns the self-signature of the primary
+// identity of `e`, or of any identity if none is flagged as primary.
+func primarySelfSignature(e *openpgp.Entity) *packet.Signature {
+	var sig *packet.Signature
+	for _, ident := range e.Identities {
+		if ident.SelfSignature == nil {
+			continue
+		}
+		if sig == nil || (ident.SelfSignature.IsPrimaryId != nil && *ident.SelfSignature.IsPrimaryId) {
+			sig = ident.SelfSignature
+		}
+	}
+	return sig
+}
+
+// keyExpiry returns when `pk` expires according to its self-signature
+// `sig`, if it has a lifetime at all.
+func keyExpiry(pk *packet.PublicKey, sig *packet.Signature) (time.Time, bool) {
+	if sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
+		return time.Time{}, false
+	}
+	return pk.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second), true
+}
+
+// preferSignatureError returns the most helpful of the failures met while
+// trying several keyrings: specific key errors win over unknown signers,
+// which are expected for all keyrings but the signer's one.
+func preferSignatureError(current error, next error) error {
+	if current != nil && errors.Cause(next) == ErrUnknownSigner {
+		return current
+	}
+	return next
+}
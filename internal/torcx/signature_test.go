@@ -0,0 +1,188 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// detachSign returns a binary detached signature of `content` by `signer`.
+func detachSign(t *testing.T, signer *openpgp.Entity, content string) []byte {
+	sig := &bytes.Buffer{}
+	if err := openpgp.DetachSign(sig, signer, bytes.NewBufferString(content), nil); err != nil {
+		t.Fatal(err)
+	}
+	return sig.Bytes()
+}
+
+// subkeySign returns a binary detached signature of `content` by `subkey`.
+func subkeySign(t *testing.T, subkey *openpgp.Subkey, content string) []byte {
+	sig := &packet.Signature{
+		SigType:      packet.SigTypeBinary,
+		PubKeyAlgo:   subkey.PrivateKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: time.Now(),
+		IssuerKeyId:  &subkey.PrivateKey.KeyId,
+	}
+	h := sig.Hash.New()
+	h.Write([]byte(content))
+	if err := sig.Sign(h, subkey.PrivateKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := sig.Serialize(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newTestEntity(t *testing.T) *openpgp.Entity {
+	entity, err := openpgp.NewEntity("torcx test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entity
+}
+
+func TestCheckSignature(t *testing.T) {
+	origTime := signatureTime
+	defer func() { signatureTime = origTime }()
+
+	signer := newTestEntity(t)
+	sig := detachSign(t, signer, "content")
+	keyring := openpgp.EntityList{signer}
+
+	got, err := checkSignature(keyring, bytes.NewBufferString("content"), bytes.NewReader(sig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PrimaryKey.KeyId != signer.PrimaryKey.KeyId {
+		t.Errorf("unexpected signer %s", got.PrimaryKey.KeyIdString())
+	}
+
+	_, err = checkSignature(keyring, bytes.NewBufferString("tampered"), bytes.NewReader(sig))
+	if errors.Cause(err) != ErrBadSignature {
+		t.Errorf("expected bad signature, got %v", err)
+	}
+
+	other := newTestEntity(t)
+	_, err = checkSignature(openpgp.EntityList{other}, bytes.NewBufferString("content"), bytes.NewReader(sig))
+	if errors.Cause(err) != ErrUnknownSigner {
+		t.Errorf("expected unknown signer, got %v", err)
+	}
+
+	// Expired keys are told apart from bad signatures, even for valid ones.
+	lifetime := uint32(3600)
+	for _, ident := range signer.Identities {
+		ident.SelfSignature.KeyLifetimeSecs = &lifetime
+	}
+	signatureTime = func() time.Time { return signer.PrimaryKey.CreationTime.Add(2 * time.Hour) }
+	_, err = checkSignature(keyring, bytes.NewBufferString("content"), bytes.NewReader(sig))
+	if errors.Cause(err) != ErrKeyExpired {
+		t.Errorf("expected expired key, got %v", err)
+	}
+	signatureTime = origTime
+	if _, err := checkSignature(keyring, bytes.NewBufferString("content"), bytes.NewReader(sig)); err != nil {
+		t.Errorf("unexpected error before expiry: %s", err)
+	}
+
+	signer.Revocations = append(signer.Revocations, &packet.Signature{SigType: packet.SigTypeKeyRevocation})
+	_, err = checkSignature(keyring, bytes.NewBufferString("content"), bytes.NewReader(sig))
+	if errors.Cause(err) != ErrKeyRevoked {
+		t.Errorf("expected revoked key, got %v", err)
+	}
+}
+
+func TestCheckSignatureSubkey(t *testing.T) {
+	origTime := signatureTime
+	defer func() { signatureTime = origTime }()
+
+	signer := newTestEntity(t)
+	subkey := &signer.Subkeys[0]
+	subkey.Sig.FlagSign = true
+	sig := subkeySign(t, subkey, "content")
+	keyring := openpgp.EntityList{signer}
+
+	issuer, _, err := signatureIssuer(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issuer != subkey.PublicKey.KeyId {
+		t.Fatalf("expected signature by subkey %s, got %016X", subkey.PublicKey.KeyIdString(), issuer)
+	}
+	if _, err := checkSignature(keyring, bytes.NewBufferString("content"), bytes.NewReader(sig)); err != nil {
+		t.Fatal(err)
+	}
+
+	lifetime := uint32(3600)
+	subkey.Sig.KeyLifetimeSecs = &lifetime
+	signatureTime = func() time.Time { return subkey.PublicKey.CreationTime.Add(2 * time.Hour) }
+	_, err = checkSignature(keyring, bytes.NewBufferString("content"), bytes.NewReader(sig))
+	if errors.Cause(err) != ErrKeyExpired {
+		t.Errorf("expected expired subkey, got %v", err)
+	}
+	signatureTime = origTime
+
+	subkey.Sig.FlagSign = false
+	if _, err := checkSignature(keyring, bytes.NewBufferString("content"), bytes.NewReader(sig)); err == nil {
+		t.Error("expected error for subkey not bound for signing")
+	}
+
+	subkey.Sig.SigType = packet.SigTypeSubkeyRevocation
+	_, err = checkSignature(keyring, bytes.NewBufferString("content"), bytes.NewReader(sig))
+	if errors.Cause(err) != ErrKeyRevoked {
+		t.Errorf("expected revoked subkey, got %v", err)
+	}
+}
+
+func TestPreferSignatureError(t *testing.T) {
+	expired := errors.Wrap(ErrKeyExpired, "key")
+	unknown := errors.Wrap(ErrUnknownSigner, "key")
+	if got := preferSignatureError(expired, unknown); got != expired {
+		t.Errorf("expected expiry to win over unknown signer, got %v", got)
+	}
+	if got := preferSignatureError(unknown, expired); got != expired {
+		t.Errorf("expected expiry to win over unknown signer, got %v", got)
+	}
+	if got := preferSignatureError(nil, unknown); got != unknown {
+		t.Errorf("expected unknown signer, got %v", got)
+	}
+}
+
+func TestRetiredAfter(t *testing.T) {
+	now := time.Now()
+	reason := func(r uint8) *uint8 { return &r }
+	for _, tt := range []struct {
+		rev *packet.Signature
+		exp bool
+	}{
+		{&packet.Signature{CreationTime: now.Add(time.Hour), RevocationReason: reason(revocationSuperseded)}, true},
+		{&packet.Signature{CreationTime: now.Add(time.Hour), RevocationReason: reason(revocationRetired)}, true},
+		{&packet.Signature{CreationTime: now.Add(-time.Hour), RevocationReason: reason(revocationRetired)}, false},
+		{&packet.Signature{CreationTime: now.Add(time.Hour), RevocationReason: reason(2)}, false},
+		{&packet.Signature{CreationTime: now.Add(time.Hour)}, false},
+	} {
+		if got := retiredAfter(tt.rev, now); got != tt.exp {
+			t.Errorf("%+v: expected %t, got %t", tt.rev, tt.exp, got)
+		}
+	}
+}
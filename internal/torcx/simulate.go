@@ -0,0 +1,124 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// unsquashfsBinary is the tool used to extract squashfs archives in simulation.
+var unsquashfsBinary = "unsquashfs"
+
+// fsckErofsBinary is the tool used to extract EROFS archives without
+// mounting them.
+var fsckErofsBinary = "fsck.erofs"
+
+// SimulatedMounter is a Mounter performing no mounts, for applies into a
+// target tree without privileges. Tmpfs mounts and remounts are emulated
+// by plain directories, and squashfs and EROFS archives are extracted
+// instead of being mounted.
+type SimulatedMounter struct{}
+
+// Mount implements Mounter, as a no-op.
+func (SimulatedMounter) Mount(source, target, fstype string, flags uintptr, data string) error {
+	return nil
+}
+
+// Unmount implements Mounter, as a no-op.
+func (SimulatedMounter) Unmount(target string, flags int) error {
+	return nil
+}
+
+// MountSquashfs implements Mounter, extracting the archive at `path` into `target`.
+func (SimulatedMounter) MountSquashfs(path, target string) error {
+	out, err := exec.Command(unsquashfsBinary, "-no-xattrs", "-f", "-d", target, path).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "%s failed: %s", unsquashfsBinary, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// MountLoop implements Mounter, loop devices being unavailable in simulation.
+// EROFS archives are extracted into `target` instead.
+func (SimulatedMounter) MountLoop(path, target, fstype string) error {
+	if fstype == ArchiveFormatErofs {
+		return extractErofs(path, target)
+	}
+	return errors.Errorf("can not mount %q without privileges", path)
+}
+
+// extractErofs extracts the EROFS archive at `path` into `target`.
+func extractErofs(path, target string) error {
+	out, err := exec.Command(fsckErofsBinary, "--extract="+target, "--overwrite", path).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "%s failed: %s", fsckErofsBinary, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// SimulateApply applies and seals the configured profile into the `target`
+// tree instead of the live system, without mounts nor privileges, so that
+// profile and image combinations can be tested in CI pipelines. The runtime
+// directory, seal metadata and propagated assets are written below `target`.
+func SimulateApply(applyCfg *ApplyConfig, target string) error {
+	if applyCfg == nil {
+		return errors.New("missing apply configuration")
+	}
+	if target == "" {
+		return errors.New("missing simulation target")
+	}
+	root, err := filepath.Abs(target)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+
+	applyCfg.TargetRoot = root
+	applyCfg.RunDir = filepath.Join(root, applyCfg.RunDir)
+	applyCfg.Mounter = SimulatedMounter{}
+	// Unpack cgroups require privileges.
+	applyCfg.UnpackLimits = nil
+
+	if err := ApplyProfile(applyCfg); err != nil {
+		return errors.Wrap(err, "simulated apply failed")
+	}
+	if err := SealSystemState(applyCfg); err != nil {
+		return errors.Wrap(err, "simulated seal failed")
+	}
+	logrus.WithFields(logrus.Fields{
+		"target": root,
+		"images": len(applyCfg.AppliedImages),
+	}).Debug("apply simulated")
+	return nil
+}
+
+// simulated returns whether the apply is simulated into a target tree.
+func (applyCfg *ApplyConfig) simulated() bool {
+	return applyCfg.TargetRoot != ""
+}
+
+// systemPath returns where the system path `path` is written to at apply
+// time, below the root prefix and the target tree when simulating.
+func (applyCfg *ApplyConfig) systemPath(path string) string {
+	return filepath.Join(applyCfg.TargetRoot, RootPath(path))
+}
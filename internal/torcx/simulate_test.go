@@ -0,0 +1,133 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSimulateApply(t *testing.T) {
+	dir := t.TempDir()
+	storeDir := filepath.Join(dir, "store")
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTgz(t, filepath.Join(storeDir, "foo:1.torcx.tgz"), map[string]string{
+		".torcx/manifest.json":           `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/foo"], "units": ["/lib/systemd/system/foo.service"]}}`,
+		"bin/foo":                        "foo",
+		"lib/systemd/system/foo.service": "[Service]\nExecStart=@TORCX_BINDIR@/foo\n",
+	})
+
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			BaseDir:    filepath.Join(dir, "base"),
+			RunDir:     DefaultRunDir,
+			ConfDir:    filepath.Join(dir, "conf"),
+			UsrDir:     filepath.Join(dir, "usr"),
+			StorePaths: []string{storeDir},
+			Mounter:    &fakeMounter{},
+		},
+		UpperProfile: "user",
+	}
+	profileDir := applyCfg.UserProfileDir()
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	profile := `{"kind": "profile-manifest-v1", "value": {"images": [{"name": "foo", "reference": "1"}]}}`
+	if err := ioutil.WriteFile(filepath.Join(profileDir, "user.json"), []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir, "target")
+	if err := SimulateApply(applyCfg, target); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := applyCfg.Mounter.(SimulatedMounter); !ok {
+		t.Errorf("unexpected mounter %T", applyCfg.Mounter)
+	}
+
+	bin, err := os.Readlink(filepath.Join(target, DefaultRunDir, "bin", "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bin != filepath.Join(target, DefaultRunDir, "unpack", "foo", "bin", "foo") {
+		t.Errorf("unexpected binary symlink %s", bin)
+	}
+	unit, err := ioutil.ReadFile(filepath.Join(target, systemdDir, "system", "foo.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(unit) != "[Service]\nExecStart="+filepath.Join(target, DefaultRunDir, "bin")+"/foo\n" {
+		t.Errorf("unexpected unit content %q", unit)
+	}
+	for _, path := range []string{SealPath, filepath.Join(DefaultRunDir, "profile.json")} {
+		if !IsExistingPath(filepath.Join(target, path)) {
+			t.Errorf("missing %s in target", path)
+		}
+	}
+}
+
+func TestSimulateApplyRootPrefix(t *testing.T) {
+	dir := t.TempDir()
+	storeDir := filepath.Join(dir, "store")
+	if err := os.MkdirAll(storeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTgz(t, filepath.Join(storeDir, "foo:1.torcx.tgz"), map[string]string{
+		".torcx/manifest.json":           `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/foo"], "units": ["/lib/systemd/system/foo.service"]}}`,
+		"bin/foo":                        "foo",
+		"lib/systemd/system/foo.service": "[Service]\nExecStart=/bin/foo\n",
+	})
+
+	origRootPrefix := RootPrefix
+	defer func() { RootPrefix = origRootPrefix }()
+	RootPrefix = "/instance"
+
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			BaseDir:    filepath.Join(dir, "base"),
+			RunDir:     RootPath(DefaultRunDir),
+			ConfDir:    filepath.Join(dir, "conf"),
+			UsrDir:     filepath.Join(dir, "usr"),
+			StorePaths: []string{storeDir},
+			Mounter:    &fakeMounter{},
+		},
+		UpperProfile: "user",
+	}
+	profileDir := applyCfg.UserProfileDir()
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	profile := `{"kind": "profile-manifest-v1", "value": {"images": [{"name": "foo", "reference": "1"}]}}`
+	if err := ioutil.WriteFile(filepath.Join(profileDir, "user.json"), []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir, "target")
+	if err := SimulateApply(applyCfg, target); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{SealPath, filepath.Join(DefaultRunDir, "profile.json"), filepath.Join(systemdDir, "system", "foo.service")} {
+		if !IsExistingPath(filepath.Join(target, "instance", path)) {
+			t.Errorf("missing %s below the root prefix", path)
+		}
+		if IsExistingPath(filepath.Join(target, path)) {
+			t.Errorf("unexpected %s outside of the root prefix", path)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// SquashfsVerifyFull verifies squashfs archives against their whole hash.
+	SquashfsVerifyFull = "full"
+	// SquashfsVerifySampled only verifies the superblock, the tables and
+	// a random sample of chunks of squashfs archives previously verified
+	// in full. It requires sha512tree hashes.
+	SquashfsVerifySampled = "sampled"
+
+	// defaultVerifySamples is the default number of random chunks sampled.
+	defaultVerifySamples = 8
+)
+
+// SquashfsVerification is the policy for verifying squashfs archives.
+type SquashfsVerification struct {
+	// Apply is the verification mode at apply time.
+	Apply string `json:"apply,omitempty"`
+	// VerifyState is the verification mode of state verification re-checks.
+	VerifyState string `json:"verify_state,omitempty"`
+	// Samples is the number of random chunks verified in sampled mode.
+	Samples int `json:"samples,omitempty"`
+}
+
+// squashfsCheck is how squashfs archive hashes are verified.
+type squashfsCheck struct {
+	// treeDir caches the chunk hashes of archives verified in full.
+	treeDir string
+	// samples is the number of random chunks to verify, or zero for
+	// full verifications.
+	samples int
+}
+
+// squashfsCheck returns how squashfs archives are verified at apply time,
+// or for state verification re-checks if `recheck` is set.
+func (cc *CommonConfig) squashfsCheck(recheck bool) *squashfsCheck {
+	check := &squashfsCheck{treeDir: cc.HashTreeCacheDir()}
+	policy := cc.SquashfsVerification
+	if policy == nil {
+		return check
+	}
+	mode := policy.Apply
+	if recheck {
+		mode = policy.VerifyState
+	}
+	if mode == SquashfsVerifySampled {
+		check.samples = policy.Samples
+		if check.samples <= 0 {
+			check.samples = defaultVerifySamples
+		}
+	}
+	return check
+}
+
+// validateArchiveHash validates the archive at `path` against `hash`.
+// Squashfs archives are hashed through a memory mapping, and sampled
+// if `check` allows it and the chunk hashes of a previous full
+// verification are cached.
+func validateArchiveHash(path string, format ArchiveFormat, hash string, check *squashfsCheck) (bool, error) {
+	if format != ArchiveFormatSquashfs {
+		return validateHash(path, hash)
+	}
+	treeDir := ""
+	if check != nil {
+		treeDir = check.treeDir
+		if check.samples > 0 {
+			valid, sampled, err := sampleSquashfsHash(path, hash, treeDir, check.samples)
+			if sampled || err != nil {
+				return valid, err
+			}
+		}
+	}
+	return validateSquashfsHash(path, hash, treeDir)
+}
+
+// mapFile maps the file at `path` read-only, advising sequential access.
+// The returned function unmaps it.
+func mapFile(path string) ([]byte, func(), error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.Size() == 0 {
+		return []byte{}, func() {}, nil
+	}
+	data, err := unix.Mmap(int(fp.Fd()), 0, int(fi.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "mapping %q", path)
+	}
+	_ = unix.Madvise(data, unix.MADV_SEQUENTIAL)
+	return data, func() { _ = unix.Munmap(data) }, nil
+}
+
+// validateSquashfsHash validates the squashfs archive at `path` against
+// sha512 or sha512tree `hash`, through a memory mapping. For sha512tree
+// hashes, the chunk hashes are cached in `treeDir` (if set) for later
+// sampled verifications.
+func validateSquashfsHash(path string, hash string, treeDir string) (bool, error) {
+	alg := hashAlgorithmOf(hash)
+	if !IsHashAlgorithm(alg) {
+		return validateHash(path, hash)
+	}
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return false, err
+	}
+	defer unmap()
+
+	var sum []byte
+	var leaves [][]byte
+	switch alg {
+	case HashSHA512:
+		s := sha512.Sum512(data)
+		sum = s[:]
+	case HashSHA512Tree:
+		leaves, err = sha512TreeLeaves(int64(len(data)), func(i int, _ []byte) ([]byte, error) {
+			return mappedChunk(data, i), nil
+		})
+		if err != nil {
+			return false, err
+		}
+		sum = sha512TreeRoot(leaves)
+	}
+	if alg+"-"+hex.EncodeToString(sum) != hash {
+		return false, nil
+	}
+	if leaves != nil && treeDir != "" {
+		if err := writeHashTree(treeDir, hash, leaves); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"path":  path,
+				"error": err,
+			}).Debug("unable to cache chunk hashes")
+		}
+	}
+	return true, nil
+}
+
+// sampleSquashfsHash validates the first and last chunks (holding the
+// superblock and the tables) and `samples` random chunks of the squashfs
+// archive at `path` against the cached chunk hashes of `hash`. `sampled`
+// is false if there is no usable cache, e.g. for sha512 hashes.
+func sampleSquashfsHash(path string, hash string, treeDir string, samples int) (valid bool, sampled bool, err error) {
+	if hashAlgorithmOf(hash) != HashSHA512Tree {
+		return false, false, nil
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		return false, false, err
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return false, false, err
+	}
+	chunks := int((fi.Size() + hashTreeChunkSize - 1) / hashTreeChunkSize)
+	if chunks == 0 {
+		chunks = 1
+	}
+	leaves := readHashTree(treeDir, hash, chunks)
+	if leaves == nil {
+		return false, false, nil
+	}
+
+	indexes := []int{0}
+	if chunks > 1 {
+		indexes = append(indexes, chunks-1)
+	}
+	for _, i := range rand.Perm(chunks) {
+		if len(indexes) >= samples+2 {
+			break
+		}
+		if i != 0 && i != chunks-1 {
+			indexes = append(indexes, i)
+		}
+	}
+	buf := make([]byte, hashTreeChunkSize)
+	for _, i := range indexes {
+		n, err := fp.ReadAt(buf, int64(i)*hashTreeChunkSize)
+		if err != nil && err != io.EOF {
+			return false, true, errors.Wrapf(err, "reading %q", path)
+		}
+		sum := sha512.Sum512(buf[:n])
+		if !bytes.Equal(sum[:], leaves[i]) {
+			return false, true, nil
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"path":    path,
+		"sampled": len(indexes),
+		"chunks":  chunks,
+	}).Debug("squashfs archive verified by sampling")
+	return true, true, nil
+}
+
+// mappedChunk returns chunk `i` of the mapped `data`.
+func mappedChunk(data []byte, i int) []byte {
+	start := i * hashTreeChunkSize
+	end := start + hashTreeChunkSize
+	if end > len(data) {
+		end = len(data)
+	}
+	return data[start:end]
+}
+
+// writeHashTree caches the chunk hashes `leaves` of sha512tree `hash`.
+func writeHashTree(treeDir string, hash string, leaves [][]byte) error {
+	if err := os.MkdirAll(treeDir, 0755); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(treeDir, ".tree")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(bytes.Join(leaves, nil)); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filepath.Join(treeDir, hash))
+}
+
+// readHashTree returns the `chunks` cached chunk hashes of sha512tree
+// `hash`, or nil if they are missing or do not match the hash.
+func readHashTree(treeDir string, hash string, chunks int) [][]byte {
+	if treeDir == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(treeDir, hash))
+	if err != nil || len(b) != chunks*sha512.Size {
+		return nil
+	}
+	leaves := make([][]byte, chunks)
+	for i := range leaves {
+		leaves[i] = b[i*sha512.Size : (i+1)*sha512.Size]
+	}
+	// The cache is authenticated by the recorded hash itself.
+	if HashSHA512Tree+"-"+hex.EncodeToString(sha512TreeRoot(leaves)) != hash {
+		return nil
+	}
+	return leaves
+}
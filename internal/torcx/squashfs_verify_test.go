@@ -0,0 +1,87 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSquashfsVerification(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo:1.torcx.squashfs")
+	content := bytes.Repeat([]byte("hsqs"), (3*hashTreeChunkSize+100)/4)
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	treeHash, err := hashFile(path, HashSHA512Tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainHash, err := hashFile(path, HashSHA512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc := &CommonConfig{
+		BaseDir:              dir,
+		SquashfsVerification: &SquashfsVerification{VerifyState: SquashfsVerifySampled, Samples: 1},
+	}
+	sampled := cc.squashfsCheck(true)
+	if sampled.samples != 1 {
+		t.Fatalf("unexpected check %+v", sampled)
+	}
+
+	// Without cached chunk hashes, sampled checks verify in full.
+	if _, ok, _ := sampleSquashfsHash(path, treeHash, sampled.treeDir, sampled.samples); ok {
+		t.Error("sampled without cached chunk hashes")
+	}
+	for _, hash := range []string{plainHash, treeHash} {
+		valid, err := validateArchiveHash(path, ArchiveFormatSquashfs, hash, cc.squashfsCheck(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !valid {
+			t.Errorf("hash %s not validated", hash)
+		}
+	}
+	if valid, ok, err := sampleSquashfsHash(path, treeHash, sampled.treeDir, sampled.samples); err != nil || !ok || !valid {
+		t.Errorf("sampled verification failed: %v, %v, %v", valid, ok, err)
+	}
+
+	// Corrupt the superblock, which is always sampled.
+	fp, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt([]byte("xxxx"), 0); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	if valid, err := validateArchiveHash(path, ArchiveFormatSquashfs, treeHash, sampled); err != nil || valid {
+		t.Errorf("corruption not detected: %v", err)
+	}
+
+	// A tampered cache is ignored.
+	if err := ioutil.WriteFile(filepath.Join(sampled.treeDir, treeHash), bytes.Repeat([]byte{0}, 4*64), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if readHashTree(sampled.treeDir, treeHash, 4) != nil {
+		t.Error("tampered chunk hashes accepted")
+	}
+}
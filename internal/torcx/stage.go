@@ -0,0 +1,296 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// StagedApplyV0K - staged apply record kind, v0
+const StagedApplyV0K = "torcx-staged-apply-v0"
+
+// ErrStagedOutdated is returned when committing a staged apply which no
+// longer matches the configuration or the stores.
+var ErrStagedOutdated = errors.New("staged apply is outdated")
+
+// StagedImage is an image unpacked by StageProfile.
+type StagedImage struct {
+	Name      string `json:"name"`
+	Reference string `json:"reference"`
+	// Archive is the path of the unpacked archive.
+	Archive string `json:"archive"`
+	// Size and ModTime identify the archive, to detect later changes.
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// StagedApply records the images unpacked by StageProfile, for the
+// profiles selected at staging time.
+type StagedApply struct {
+	LowerProfiles []string      `json:"lower_profiles"`
+	UpperProfile  string        `json:"upper_profile"`
+	Images        []StagedImage `json:"images"`
+	Time          time.Time     `json:"time"`
+}
+
+// StagedApplyV0JSON holds a staged apply record (version 0).
+type StagedApplyV0JSON struct {
+	Kind  string      `json:"kind"`
+	Value StagedApply `json:"value"`
+}
+
+// StageProfile runs the expensive phase of an apply ahead of time: images
+// of the configured profiles are verified and unpacked (or mounted) below a
+// private staging directory, without propagating any asset. Images are
+// then moved in place by CommitProfile. Staging is all-or-nothing: if any
+// image fails, nothing is staged.
+func StageProfile(applyCfg *ApplyConfig) (*StagedApply, error) {
+	if applyCfg == nil {
+		return nil, errors.New("missing apply configuration")
+	}
+	if applyCfg.simulated() {
+		return nil, errors.New("staging is not supported for simulated applies")
+	}
+	if IsExistingPath(applyCfg.RunDir) {
+		return nil, errors.Errorf("torcx already run, %s exists", applyCfg.RunDir)
+	}
+	if err := DiscardStaged(&applyCfg.CommonConfig); err != nil {
+		return nil, errors.Wrap(err, "discarding previous staging")
+	}
+
+	// Images are unpacked with the staging directory as runtime directory.
+	stagingCfg := *applyCfg
+	stagingCfg.RunDir = applyCfg.RunStagingDir()
+	if err := setupStaging(&stagingCfg); err != nil {
+		return nil, errors.Wrap(err, "staging setup")
+	}
+
+	staged, err := stageImages(&stagingCfg)
+	if err == nil {
+		err = writeStagedApply(applyCfg.StagedApplyPath(), staged)
+	}
+	if err != nil {
+		if discardErr := DiscardStaged(&applyCfg.CommonConfig); discardErr != nil {
+			logrus.WithField("error", discardErr).Warn("unable to discard failed staging")
+		}
+		return nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"upper profile": applyCfg.UpperProfile,
+		"images":        len(staged.Images),
+	}).Debug("apply staged")
+	return staged, nil
+}
+
+// setupStaging creates the staging directory as a private mount, so that
+// image mounts below it are not propagated until moved in place, and mounts
+// a tmpfs on its unpack directory.
+func setupStaging(stagingCfg *ApplyConfig) error {
+	dir := stagingCfg.RunDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	mounter := stagingCfg.mounter()
+	if err := mounter.Mount(dir, dir, "", unix.MS_BIND, ""); err != nil {
+		return errors.Wrap(err, "failed to bind-mount staging dir")
+	}
+	if err := mounter.Mount("", dir, "", unix.MS_PRIVATE, ""); err != nil {
+		return errors.Wrap(err, "failed to make staging dir private")
+	}
+	if err := os.MkdirAll(stagingCfg.RunUnpackDir(), 0755); err != nil {
+		return err
+	}
+	if err := mounter.Mount("none", stagingCfg.RunUnpackDir(), "tmpfs", 0, "size=450M"); err != nil {
+		return errors.Wrap(err, "failed to mount staging unpack dir")
+	}
+	return os.Chmod(stagingCfg.RunUnpackDir(), 0755)
+}
+
+// stageImages unpacks all images of the merged profiles, resolving
+// profile fragments, and returns the staged apply record.
+func stageImages(stagingCfg *ApplyConfig) (*StagedApply, error) {
+	images, err := mergeProfiles(stagingCfg)
+	if err != nil {
+		return nil, err
+	}
+	storeCache, err := NewStoreCache(stagingCfg.StorePaths)
+	if err != nil {
+		return nil, err
+	}
+
+	staged := &StagedApply{
+		LowerProfiles: stagingCfg.LowerProfiles,
+		UpperProfile:  stagingCfg.UpperProfile,
+		Images:        []StagedImage{},
+		Time:          time.Now().UTC(),
+	}
+	_, err = resolveImages(images, func(im Image) (Image, []Image, error) {
+		resolved, err := resolveImageVersion(&storeCache, im)
+		if err != nil {
+			return im, nil, err
+		}
+		located, archive, err := locateImage(stagingCfg, &storeCache, resolved)
+		if err != nil {
+			return resolved, nil, err
+		}
+		archive, imageRoot, err := unpackImage(stagingCfg, located, archive, time.Time{})
+		if err != nil {
+			return resolved, nil, err
+		}
+		fi, err := os.Stat(archive.Filepath)
+		if err != nil {
+			return resolved, nil, err
+		}
+		staged.Images = append(staged.Images, StagedImage{
+			Name:      located.Name,
+			Reference: located.Reference,
+			Archive:   archive.Filepath,
+			Size:      fi.Size(),
+			ModTime:   fi.ModTime().UTC(),
+		})
+
+		assets, err := retrieveAssets(stagingCfg, imageRoot)
+		if err != nil {
+			return resolved, nil, err
+		}
+		resolved.Provides = strings.Join(assets.Provides, " ")
+		fragment, err := readImageFragment(imageRoot)
+		return resolved, stagingCfg.FilterRecommends(fragment), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return staged, nil
+}
+
+// CommitProfile runs the visible phase of a staged apply: staged images
+// are moved in place at once, then their assets are propagated as by
+// ApplyProfile. It fails with ErrStagedOutdated, before touching the
+// system, if the staged apply does not match the configured profiles or
+// if a staged archive changed since.
+func CommitProfile(applyCfg *ApplyConfig) error {
+	if applyCfg == nil {
+		return errors.New("missing apply configuration")
+	}
+	staged, err := ReadStagedApply(applyCfg.StagedApplyPath())
+	if err != nil {
+		return err
+	}
+	if strings.Join(staged.LowerProfiles, ":") != strings.Join(applyCfg.LowerProfiles, ":") || staged.UpperProfile != applyCfg.UpperProfile {
+		return errors.Wrap(ErrStagedOutdated, "profiles changed since staging")
+	}
+	images := make(map[string]StagedImage, len(staged.Images))
+	for _, si := range staged.Images {
+		fi, err := os.Stat(si.Archive)
+		if err != nil || fi.Size() != si.Size || !fi.ModTime().Equal(si.ModTime) {
+			return errors.Wrapf(ErrStagedOutdated, "archive %s changed since staging", si.Archive)
+		}
+		images[si.Name] = si
+	}
+
+	applyCfg.staged = images
+	defer func() { applyCfg.staged = nil }()
+	if err := ApplyProfile(applyCfg); err != nil {
+		return err
+	}
+	if err := DiscardStaged(&applyCfg.CommonConfig); err != nil {
+		logrus.WithField("error", err).Warn("unable to clean staging dir")
+	}
+	return nil
+}
+
+// stagedUnpackDir is where images have been unpacked by StageProfile.
+func (applyCfg *ApplyConfig) stagedUnpackDir() string {
+	return filepath.Join(applyCfg.RunStagingDir(), "unpack")
+}
+
+// stagedRoot returns where the staged image `im` has been moved, when
+// committing a staged apply. Images not staged from `archive` are refused,
+// as committing must not unpack anything.
+func (applyCfg *ApplyConfig) stagedRoot(im Image, archive Archive) (string, bool, error) {
+	if applyCfg.staged == nil {
+		return "", false, nil
+	}
+	si, ok := applyCfg.staged[im.Name]
+	if !ok || si.Archive != archive.Filepath {
+		return "", false, errors.Wrapf(ErrStagedOutdated, "image %s:%s not staged", im.Name, im.Reference)
+	}
+	return filepath.Join(applyCfg.RunUnpackDir(), imagePathName(im.Name)), true, nil
+}
+
+// DiscardStaged unmounts and removes the staging directory, if any.
+func DiscardStaged(cc *CommonConfig) error {
+	dir := cc.RunStagingDir()
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	mounter := cc.mounter()
+	// The unpack dir is not mounted anymore once committed.
+	for _, target := range []string{filepath.Join(dir, "unpack"), dir} {
+		if err := mounter.Unmount(target, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+			logrus.WithFields(logrus.Fields{
+				"path":  target,
+				"error": err,
+			}).Debug("failed to unmount staging dir")
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+// writeStagedApply writes the staged apply record at `path`.
+func writeStagedApply(path string, staged *StagedApply) error {
+	fp, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	bufwr := bufio.NewWriter(fp)
+	enc := json.NewEncoder(bufwr)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(StagedApplyV0JSON{StagedApplyV0K, *staged}); err != nil {
+		return errors.Wrapf(err, "writing %q", path)
+	}
+	if err := bufwr.Flush(); err != nil {
+		return errors.Wrapf(err, "writing %q", path)
+	}
+	return fp.Close()
+}
+
+// ReadStagedApply reads the staged apply record at `path`.
+func ReadStagedApply(path string) (*StagedApply, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var record StagedApplyV0JSON
+	if err := json.NewDecoder(bufio.NewReader(fp)).Decode(&record); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s", path)
+	}
+	if record.Kind != StagedApplyV0K {
+		return nil, errors.Errorf("invalid staged apply kind: %s", record.Kind)
+	}
+	return &record.Value, nil
+}
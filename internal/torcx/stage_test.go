@@ -0,0 +1,114 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestCommitProfileOutdated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_stage_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			BaseDir: filepath.Join(dir, "base"),
+			RunDir:  filepath.Join(dir, "run"),
+			ConfDir: filepath.Join(dir, "conf"),
+			Mounter: &fakeMounter{},
+		},
+		UpperProfile: "user",
+	}
+	if err := os.MkdirAll(applyCfg.RunStagingDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "foo:1.torcx.tgz")
+	if err := ioutil.WriteFile(archive, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged := &StagedApply{
+		UpperProfile: "user",
+		Images: []StagedImage{
+			{Name: "foo", Reference: "1", Archive: archive, Size: fi.Size(), ModTime: fi.ModTime()},
+		},
+	}
+
+	staged.UpperProfile = "other"
+	if err := writeStagedApply(applyCfg.StagedApplyPath(), staged); err != nil {
+		t.Fatal(err)
+	}
+	if err := CommitProfile(applyCfg); errors.Cause(err) != ErrStagedOutdated {
+		t.Errorf("expected %s for another profile, got %v", ErrStagedOutdated, err)
+	}
+
+	staged.UpperProfile = "user"
+	if err := writeStagedApply(applyCfg.StagedApplyPath(), staged); err != nil {
+		t.Fatal(err)
+	}
+	later := fi.ModTime().Add(time.Minute)
+	if err := os.Chtimes(archive, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := CommitProfile(applyCfg); errors.Cause(err) != ErrStagedOutdated {
+		t.Errorf("expected %s for a changed archive, got %v", ErrStagedOutdated, err)
+	}
+	if IsExistingPath(applyCfg.RunDir) {
+		t.Error("outdated commit touched the system")
+	}
+
+	if err := DiscardStaged(&applyCfg.CommonConfig); err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	if IsExistingPath(applyCfg.RunStagingDir()) {
+		t.Error("staging dir not removed")
+	}
+}
+
+func TestStagedRoot(t *testing.T) {
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{RunDir: "/run/torcx"},
+	}
+	archive := Archive{Image: Image{Name: "foo", Reference: "1"}, Filepath: "/store/foo:1.torcx.tgz"}
+
+	if _, staged, err := applyCfg.stagedRoot(archive.Image, archive); staged || err != nil {
+		t.Errorf("unexpected staged image outside of a commit: %t, %v", staged, err)
+	}
+
+	applyCfg.staged = map[string]StagedImage{
+		"foo": {Name: "foo", Reference: "1", Archive: archive.Filepath},
+	}
+	root, staged, err := applyCfg.stagedRoot(archive.Image, archive)
+	if err != nil || !staged || root != "/run/torcx/unpack/foo" {
+		t.Errorf("unexpected staged root %q (%t), %v", root, staged, err)
+	}
+
+	other := Archive{Image: Image{Name: "foo", Reference: "2"}, Filepath: "/store/foo:2.torcx.tgz"}
+	if _, _, err := applyCfg.stagedRoot(other.Image, other); errors.Cause(err) != ErrStagedOutdated {
+		t.Errorf("expected %s for another archive, got %v", ErrStagedOutdated, err)
+	}
+}
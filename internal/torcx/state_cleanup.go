@@ -0,0 +1,240 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ImageEnvStateDirs is the cleanup hook variable listing state directories.
+	ImageEnvStateDirs = "TORCX_STATE_DIRS"
+	// cleanupHookTimeout bounds the execution of cleanup hooks.
+	cleanupHookTimeout = 5 * time.Minute
+)
+
+// stateRootDir is where image state directories are looked up.
+var stateRootDir = "/"
+
+// ImageState is the persistent state declared by the manifest of an image,
+// cleaned up once the image leaves all profiles.
+type ImageState struct {
+	Image Image
+	// Dirs are the state directories of the image.
+	Dirs []string
+	// Cleanup is the path of the cleanup hook in the image, if any.
+	Cleanup string
+	// hook is the content of the cleanup hook, read from the archive.
+	hook []byte
+}
+
+// ReadImageState reads the state declared by the local archive of `im`.
+// It must be read before removing the image, as the cleanup hook is
+// shipped by the archive itself.
+func ReadImageState(cc *CommonConfig, im Image) (*ImageState, error) {
+	if cc == nil {
+		return nil, errors.New("nil CommonConfig")
+	}
+	state := &ImageState{Image: im}
+	reader, err := cc.OpenImage(im)
+	if err != nil {
+		return nil, err
+	}
+	b, err := reader.ReadFile(manifestPath)
+	if os.IsNotExist(errors.Cause(err)) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	assets, err := decodeImageManifest(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding image manifest")
+	}
+
+	for _, dir := range assets.StateDirs {
+		if err := validateStateDir(dir); err != nil {
+			return nil, err
+		}
+	}
+	state.Dirs = assets.StateDirs
+	if assets.Cleanup != "" {
+		if !filepath.IsAbs(assets.Cleanup) || filepath.Clean(assets.Cleanup) != assets.Cleanup {
+			return nil, errors.Errorf("invalid cleanup hook path %q, must be absolute and clean", assets.Cleanup)
+		}
+		if state.hook, err = reader.ReadFile(assets.Cleanup); err != nil {
+			return nil, errors.Wrap(err, "reading cleanup hook")
+		}
+		state.Cleanup = assets.Cleanup
+	}
+	return state, nil
+}
+
+// validateStateDir ensures `dir` is a dedicated directory below /var.
+func validateStateDir(dir string) error {
+	if !filepath.IsAbs(dir) || filepath.Clean(dir) != dir {
+		return errors.Errorf("invalid state directory %q, must be absolute and clean", dir)
+	}
+	if !strings.HasPrefix(dir, "/var/") || strings.Count(dir, "/") < 3 {
+		return errors.Errorf("invalid state directory %q, must be below /var/<category>/", dir)
+	}
+	return nil
+}
+
+// CleanupImageState runs the cleanup hook of an image and removes its state
+// directories, along with the writable layers of its overlays, unless the
+// image (in any version) is still referenced by a profile. It returns
+// whether the state has been cleaned up.
+func CleanupImageState(cc *CommonConfig, state *ImageState) (bool, error) {
+	if cc == nil {
+		return false, errors.New("nil CommonConfig")
+	}
+	if state == nil {
+		return false, nil
+	}
+	overlaysDir := cc.imageOverlaysDir(state.Image.Name)
+	if len(state.Dirs) == 0 && state.Cleanup == "" && !IsExistingPath(overlaysDir) {
+		return false, nil
+	}
+	logFields := logrus.Fields{
+		"image":     state.Image.Name,
+		"reference": state.Image.Reference,
+	}
+
+	users, err := imageNameUsers(cc, state.Image.Name)
+	if err != nil {
+		return false, err
+	}
+	if len(users) > 0 {
+		logrus.WithFields(logFields).WithField("users", users).Info("image still referenced, state kept")
+		return false, nil
+	}
+
+	dirs := make([]string, 0, len(state.Dirs))
+	for _, dir := range state.Dirs {
+		dirs = append(dirs, filepath.Join(stateRootDir, dir))
+	}
+	if state.Cleanup != "" {
+		if err := runCleanupHook(state, dirs); err != nil {
+			return false, errors.Wrap(err, "cleanup hook failed, state kept")
+		}
+		logrus.WithFields(logFields).WithField("hook", state.Cleanup).Debug("cleanup hook run")
+	}
+	for _, dir := range dirs {
+		logrus.WithFields(logFields).WithField("path", dir).Info("removing image state directory")
+		if err := os.RemoveAll(dir); err != nil {
+			return false, err
+		}
+	}
+	if IsExistingPath(overlaysDir) {
+		logrus.WithFields(logFields).WithField("path", overlaysDir).Info("removing image writable layers")
+		if err := os.RemoveAll(overlaysDir); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// imageNameUsers returns a description of all profiles referencing any
+// version of image `name`, including the currently running one.
+func imageNameUsers(cc *CommonConfig, name string) ([]string, error) {
+	profiles, err := ListProfiles(cc.ProfileDirs())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list profiles")
+	}
+	names := make([]string, 0, len(profiles))
+	for profileName := range profiles {
+		names = append(names, profileName)
+	}
+	sort.Strings(names)
+	users := []string{}
+	for _, profileName := range names {
+		// Unreadable profiles may reference the image, thus keep the state.
+		images, err := ReadProfilePath(profiles[profileName])
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading profile %q", profiles[profileName])
+		}
+		if profileContainsName(images, name) {
+			users = append(users, fmt.Sprintf("profile %q", profileName))
+		}
+	}
+	if current, err := ReadCurrentProfile(); err == nil && profileContainsName(current, name) {
+		users = append(users, "current sealed profile")
+	}
+	if good, err := ReadProfilePath(cc.GoodProfile()); err == nil && profileContainsName(good, name) {
+		users = append(users, "last good profile")
+	}
+	return users, nil
+}
+
+// profileContainsName returns whether `images` references image `name`.
+func profileContainsName(images []Image, name string) bool {
+	for _, entry := range images {
+		if entry.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runCleanupHook executes the cleanup hook of an image from a temporary
+// copy, as the image is no longer unpacked. Hooks should thus not depend
+// on other files of the image.
+func runCleanupHook(state *ImageState, dirs []string) error {
+	fp, err := ioutil.TempFile("", "torcx-cleanup-")
+	if err != nil {
+		return err
+	}
+	hookPath := fp.Name()
+	defer os.Remove(hookPath)
+	if _, err := fp.Write(state.hook); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(hookPath, 0700); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, hookPath)
+	cmd.Env = append(os.Environ(),
+		ImageEnvName+"="+state.Image.Name,
+		ImageEnvVersion+"="+state.Image.Reference,
+		ImageEnvStateDirs+"="+strings.Join(dirs, " "),
+	)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.Errorf("timed out after %s", cleanupHookTimeout)
+	}
+	if err != nil {
+		return errors.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
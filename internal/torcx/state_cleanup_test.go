@@ -0,0 +1,111 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleanupImageState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_state_cleanup_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldStateRoot := stateRootDir
+	stateRootDir = filepath.Join(dir, "root")
+	defer func() { stateRootDir = oldStateRoot }()
+
+	cc := &CommonConfig{
+		BaseDir: filepath.Join(dir, "base"),
+		RunDir:  filepath.Join(dir, "run"),
+		ConfDir: filepath.Join(dir, "conf"),
+		UsrDir:  filepath.Join(dir, "usr"),
+	}
+	userStore := cc.UserStorePath("")
+	cc.StorePaths = []string{userStore}
+	stateDir := filepath.Join(stateRootDir, "var", "lib", "foo")
+	for _, d := range []string{userStore, cc.UserProfileDir(), stateDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	marker := filepath.Join(dir, "hook-run")
+	writeTestTgz(t, filepath.Join(userStore, "foo:1.torcx.tgz"), map[string]string{
+		".torcx/manifest.json": `{"kind": "image-manifest-v0", "value": {"state_dirs": ["/var/lib/foo"], "cleanup": "/bin/cleanup"}}`,
+		"bin/cleanup":          "#!/bin/sh\necho \"$TORCX_IMAGE_NAME $TORCX_STATE_DIRS\" > " + marker + "\n",
+	})
+	profilePath := filepath.Join(cc.UserProfileDir(), "p.json")
+	profile := `{"kind": "profile-manifest-v0", "value": {"images": [{"name": "foo", "reference": "2"}]}}`
+	if err := ioutil.WriteFile(profilePath, []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := ReadImageState(cc, Image{Name: "foo", Reference: "1"})
+	if err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	if len(state.Dirs) != 1 || state.Dirs[0] != "/var/lib/foo" || state.Cleanup != "/bin/cleanup" {
+		t.Fatalf("unexpected state %+v", state)
+	}
+
+	// Another version of the image is still referenced.
+	cleaned, err := CleanupImageState(cc, state)
+	if err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	if cleaned || !IsExistingPath(stateDir) || IsExistingPath(marker) {
+		t.Fatal("state of a referenced image cleaned up")
+	}
+
+	if err := os.Remove(profilePath); err != nil {
+		t.Fatal(err)
+	}
+	cleaned, err = CleanupImageState(cc, state)
+	if err != nil {
+		t.Fatalf("got unexpected error: %s", err)
+	}
+	if !cleaned || IsExistingPath(stateDir) {
+		t.Fatal("state directory not removed")
+	}
+	b, err := ioutil.ReadFile(marker)
+	if err != nil {
+		t.Fatalf("cleanup hook not run: %s", err)
+	}
+	if got := strings.TrimSpace(string(b)); got != "foo "+stateDir {
+		t.Errorf("unexpected hook environment %q", got)
+	}
+}
+
+func TestValidateStateDir(t *testing.T) {
+	for dir, valid := range map[string]bool{
+		"/var/lib/docker":  true,
+		"/var/cache/foo/x": true,
+		"/var/lib":         false,
+		"/var/lib/":        false,
+		"/etc/docker":      false,
+		"var/lib/docker":   false,
+		"/var/lib/../../x": false,
+	} {
+		if err := validateStateDir(dir); valid != (err == nil) {
+			t.Errorf("state directory %q: expected valid %t, got %v", dir, valid, err)
+		}
+	}
+}
@@ -16,7 +16,6 @@ package torcx
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -30,107 +29,123 @@ type StoreCache struct {
 
 	// The mapping of name + reference to image archive
 	Images map[Image]Archive
+	// Shadowed are duplicate archives hidden by the cached ones
+	Shadowed []Archive
 }
 
 // NewStoreCache constructs a new StoreCache using `paths` as lookup directories
 func NewStoreCache(paths []string) (StoreCache, error) {
-	sc := StoreCache{
-		Paths:  paths,
-		Images: map[Image]Archive{},
+	stores := make([]Store, 0, len(paths))
+	for _, dir := range paths {
+		stores = append(stores, DirStore(dir))
 	}
+	return NewStoreCacheFrom(stores)
+}
 
-	walkFn := func(dir string, inInfo os.FileInfo) error {
-		path := filepath.Clean(filepath.Join(dir, inInfo.Name()))
-		name := filepath.Base(path)
-
-		// Ensure a symlink points to a regular file
-		if inInfo.Mode()&os.ModeSymlink != 0 {
-			if lpath, err := filepath.EvalSymlinks(path); err != nil {
-				return nil
-			} else if inInfo, err = os.Lstat(lpath); err != nil {
-				return nil
-			}
-		}
-
-		if !inInfo.Mode().IsRegular() {
-			return nil
-		}
-		var arFormat ArchiveFormat
-		for _, format := range []ArchiveFormat{ArchiveFormatTgz, ArchiveFormatSquashfs} {
-			if strings.HasSuffix(name, format.FileSuffix()) {
-				arFormat = format
-				break
-			}
-		}
-		if arFormat == ArchiveFormatUnknown {
-			return nil
-		}
-		baseName := strings.TrimSuffix(name, arFormat.FileSuffix())
-		imageName := baseName
-		imageRef := DefaultTagRef
-		if strings.ContainsRune(baseName, ':') {
-			subs := strings.Split(baseName, ":")
-			imageRef = subs[len(subs)-1]
-			imageName = strings.Join(subs[:len(subs)-1], "")
-		}
-
-		image := Image{
-			Name:      imageName,
-			Reference: imageRef,
-		}
-		archive := Archive{image, path, arFormat}
-
-		// The first squashfs archive to define a reference wins, followed by the
-		// first tgz.  Any collisions will result in a warning.
-		ar, ok := sc.Images[image]
-		if ok && archive.Format == ArchiveFormatSquashfs && ar.Format != ArchiveFormatSquashfs {
-			logrus.WithFields(logrus.Fields{
-				"name":      image.Name,
-				"reference": image.Reference,
-				"original":  ar.Filepath,
-				"format":    ar.Format,
-				"duplicate": path,
-			}).Warn("prefering squashfs for duplicate image")
-		} else if ok {
-			// Duplicate, but not squashfs overriding tgz
-			logrus.WithFields(logrus.Fields{
-				"name":      image.Name,
-				"reference": image.Reference,
-				"original":  ar.Filepath,
-				"format":    ar.Format,
-				"duplicate": path,
-			}).Warn("skipped duplicate image")
-			return nil
-		} else {
-			logrus.WithFields(logrus.Fields{
-				"name":      image.Name,
-				"reference": image.Reference,
-				"format":    arFormat,
-				"path":      path,
-			}).Debug("new archive/reference added to cache")
-		}
-		sc.Images[image] = archive
-
-		return nil
+// NewStoreCacheFrom constructs a new StoreCache from `stores`, in lookup order.
+func NewStoreCacheFrom(stores []Store) (StoreCache, error) {
+	sc := StoreCache{
+		Paths:  make([]string, 0, len(stores)),
+		Images: map[Image]Archive{},
 	}
 
-	for _, dir := range paths {
-		files, err := ioutil.ReadDir(dir)
+	for _, store := range stores {
+		sc.Paths = append(sc.Paths, store.Name())
+		archives, err := store.Archives()
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
-				"path": dir,
+				"path": store.Name(),
 				"err":  err,
 			}).Info("store skipped")
 			continue
 		}
-		for _, fi := range files {
-			_ = walkFn(dir, fi)
+		for _, archive := range archives {
+			sc.addArchive(archive)
 		}
 	}
 
 	return sc, nil
 }
 
+// scanStoreEntry returns the image archive for the store entry `inInfo`
+// in directory `dir`, if it is one.
+func scanStoreEntry(dir string, inInfo os.FileInfo) (Archive, bool) {
+	path := filepath.Clean(filepath.Join(dir, inInfo.Name()))
+	name := filepath.Base(path)
+
+	// Ensure a symlink points to a regular file
+	if inInfo.Mode()&os.ModeSymlink != 0 {
+		if lpath, err := filepath.EvalSymlinks(path); err != nil {
+			return Archive{}, false
+		} else if inInfo, err = os.Lstat(lpath); err != nil {
+			return Archive{}, false
+		}
+	}
+
+	if !inInfo.Mode().IsRegular() {
+		return Archive{}, false
+	}
+	arFormat := archiveFormatOf(name)
+	if arFormat == ArchiveFormatUnknown {
+		return Archive{}, false
+	}
+	baseName := strings.TrimSuffix(name, arFormat.FileSuffix())
+	imageName := baseName
+	imageRef := DefaultTagRef
+	if strings.ContainsRune(baseName, ':') {
+		subs := strings.Split(baseName, ":")
+		imageRef = subs[len(subs)-1]
+		imageName = strings.Join(subs[:len(subs)-1], "")
+	}
+
+	image := Image{
+		Name:      imageName,
+		Reference: imageRef,
+	}
+	return Archive{image, path, arFormat}, true
+}
+
+// addArchive adds an archive to the cache, resolving duplicates.
+func (sc *StoreCache) addArchive(archive Archive) {
+	image := archive.Image
+	path := archive.Filepath
+	arFormat := archive.Format
+
+	// The first filesystem image (squashfs or erofs) to define a reference
+	// wins, followed by the first tarball (tgz, zst or txz).  Any collisions
+	// will result in a warning.
+	ar, ok := sc.Images[image]
+	if ok && archive.Format.isFilesystemImage() && !ar.Format.isFilesystemImage() {
+		logrus.WithFields(logrus.Fields{
+			"name":      image.Name,
+			"reference": image.Reference,
+			"original":  ar.Filepath,
+			"format":    ar.Format,
+			"duplicate": path,
+		}).Warn("prefering filesystem image for duplicate image")
+		sc.Shadowed = append(sc.Shadowed, ar)
+	} else if ok {
+		// Duplicate, but not a filesystem image overriding a tarball
+		logrus.WithFields(logrus.Fields{
+			"name":      image.Name,
+			"reference": image.Reference,
+			"original":  ar.Filepath,
+			"format":    ar.Format,
+			"duplicate": path,
+		}).Warn("skipped duplicate image")
+		sc.Shadowed = append(sc.Shadowed, archive)
+		return
+	} else {
+		logrus.WithFields(logrus.Fields{
+			"name":      image.Name,
+			"reference": image.Reference,
+			"format":    arFormat,
+			"path":      path,
+		}).Debug("new archive/reference added to cache")
+	}
+	sc.Images[image] = archive
+}
+
 // ArchiveFor looks for a reference in the store, returning the path
 // to the archive containing it
 func (sc *StoreCache) ArchiveFor(im Image) (Archive, error) {
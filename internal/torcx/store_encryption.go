@@ -0,0 +1,314 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// storeKeySize is the size of raw store keys, as required by the
+	// AES-256-XTS contents encryption mode.
+	storeKeySize = unix.FSCRYPT_MAX_KEY_SIZE
+)
+
+var (
+	// ErrStoreNotEncrypted is returned when unlocking a plain user store.
+	ErrStoreNotEncrypted = errors.New("user store is not encrypted")
+	// ErrStoreKeyMismatch is returned when the configured key is not the
+	// one the user store is encrypted with.
+	ErrStoreKeyMismatch = errors.New("key does not match the user store encryption key")
+)
+
+// StoreEncryption configures encryption at rest of the user store, with
+// native filesystem encryption (fscrypt, v2 policies).
+type StoreEncryption struct {
+	// KeyFile is the file holding the raw key (e.g. unsealed from the TPM
+	// by the initramfs into /run).
+	KeyFile string `json:"key_file,omitempty"`
+	// Credential is the name of the systemd credential holding the raw key,
+	// for torcx running in a unit with LoadCredential(Encrypted)=.
+	Credential string `json:"credential,omitempty"`
+}
+
+// StoreEncryptionState describes the encryption of the user store.
+type StoreEncryptionState struct {
+	Path      string `json:"path"`
+	Encrypted bool   `json:"encrypted"`
+	Unlocked  bool   `json:"unlocked"`
+	// KeyIdentifier is the fscrypt identifier of the store key, in hex.
+	KeyIdentifier string `json:"key_identifier,omitempty"`
+}
+
+// validate checks the store encryption settings.
+func (se *StoreEncryption) validate() error {
+	if (se.KeyFile == "") == (se.Credential == "") {
+		return errors.New("store encryption requires exactly one of key_file or credential")
+	}
+	if se.Credential != "" {
+		return validateCredentialName(se.Credential)
+	}
+	return nil
+}
+
+// readKey reads the raw store key, from its file or systemd credential.
+func (se *StoreEncryption) readKey() ([]byte, error) {
+	if err := se.validate(); err != nil {
+		return nil, err
+	}
+	path := se.KeyFile
+	if se.Credential != "" {
+		var err error
+		if path, err = systemdCredentialPath(se.Credential); err != nil {
+			return nil, err
+		}
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading store key")
+	}
+	if len(key) != storeKeySize {
+		return nil, errors.Errorf("store key %s must be %d bytes, got %d", path, storeKeySize, len(key))
+	}
+	return key, nil
+}
+
+// EncryptUserStore sets up encryption of the (empty) user store with the
+// configured key, leaving it unlocked. Existing archives can not be
+// encrypted in place: they must be moved out first, and back in after.
+func EncryptUserStore(cc *CommonConfig) (StoreEncryptionState, error) {
+	if cc.StoreEncryption == nil {
+		return StoreEncryptionState{}, errors.New("store encryption not configured")
+	}
+	key, err := cc.StoreEncryption.readKey()
+	if err != nil {
+		return StoreEncryptionState{}, err
+	}
+	dir := cc.UserStorePath("")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return StoreEncryptionState{}, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return StoreEncryptionState{}, err
+	}
+	if len(entries) > 0 {
+		return StoreEncryptionState{}, errors.Errorf("user store %s must be empty to be encrypted", dir)
+	}
+	if _, err := storePolicyIdentifier(dir); err == nil {
+		return StoreEncryptionState{}, errors.Errorf("user store %s is already encrypted", dir)
+	} else if errors.Cause(err) != ErrStoreNotEncrypted {
+		return StoreEncryptionState{}, err
+	}
+
+	id, err := addEncryptionKey(dir, key)
+	if err != nil {
+		return StoreEncryptionState{}, errors.Wrap(err, "adding store key")
+	}
+	if err := setEncryptionPolicy(dir, id); err != nil {
+		return StoreEncryptionState{}, errors.Wrap(err, "setting store encryption policy")
+	}
+	logrus.WithFields(logrus.Fields{
+		"path": dir,
+	}).Info("user store encrypted")
+	return UserStoreEncryption(cc)
+}
+
+// UnlockUserStore adds the configured key for the encrypted user store,
+// making its archives readable. Unlocking an unlocked store is a no-op.
+func UnlockUserStore(cc *CommonConfig) (StoreEncryptionState, error) {
+	if cc.StoreEncryption == nil {
+		return StoreEncryptionState{}, errors.New("store encryption not configured")
+	}
+	dir := cc.UserStorePath("")
+	policyID, err := storePolicyIdentifier(dir)
+	if err != nil {
+		return StoreEncryptionState{}, err
+	}
+	key, err := cc.StoreEncryption.readKey()
+	if err != nil {
+		return StoreEncryptionState{}, err
+	}
+	id, err := addEncryptionKey(dir, key)
+	if err != nil {
+		return StoreEncryptionState{}, errors.Wrap(err, "adding store key")
+	}
+	if id != policyID {
+		_ = removeEncryptionKey(dir, id)
+		return StoreEncryptionState{}, ErrStoreKeyMismatch
+	}
+	logrus.WithFields(logrus.Fields{
+		"path": dir,
+	}).Debug("user store unlocked")
+	return UserStoreEncryption(cc)
+}
+
+// LockUserStore removes the key of the encrypted user store. Archives
+// still open (e.g. mounted squashfs images) stay readable until closed.
+func LockUserStore(cc *CommonConfig) (StoreEncryptionState, error) {
+	dir := cc.UserStorePath("")
+	id, err := storePolicyIdentifier(dir)
+	if err != nil {
+		return StoreEncryptionState{}, err
+	}
+	if err := removeEncryptionKey(dir, id); err != nil {
+		return StoreEncryptionState{}, errors.Wrap(err, "removing store key")
+	}
+	return UserStoreEncryption(cc)
+}
+
+// UserStoreEncryption returns the encryption state of the user store.
+func UserStoreEncryption(cc *CommonConfig) (StoreEncryptionState, error) {
+	dir := cc.UserStorePath("")
+	state := StoreEncryptionState{Path: dir}
+	id, err := storePolicyIdentifier(dir)
+	if errors.Cause(err) == ErrStoreNotEncrypted {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	state.Encrypted = true
+	state.KeyIdentifier = hex.EncodeToString(id[:])
+	present, err := encryptionKeyPresent(dir, id)
+	if err != nil {
+		return state, err
+	}
+	state.Unlocked = present
+	return state, nil
+}
+
+// unlockUserStore unlocks the encrypted user store before images are
+// looked up, on a best-effort basis: a locked store only holds unreadable
+// entries, and is thus skipped like an empty one.
+func unlockUserStore(applyCfg *ApplyConfig) {
+	if applyCfg.StoreEncryption == nil {
+		return
+	}
+	if _, err := UnlockUserStore(&applyCfg.CommonConfig); err != nil {
+		path := applyCfg.UserStorePath("")
+		logrus.WithFields(logrus.Fields{
+			"path":  path,
+			"error": err,
+		}).Warn("unable to unlock user store")
+		applyCfg.warn(Warning{
+			Kind:    WarningLockedStore,
+			Message: err.Error(),
+			Path:    path,
+		})
+	}
+}
+
+// storePolicyIdentifier returns the key identifier of the fscrypt v2
+// policy of `dir`, or ErrStoreNotEncrypted (also for missing stores).
+// Filesystems without encryption support only hold plain directories.
+func storePolicyIdentifier(dir string) ([unix.FSCRYPT_KEY_IDENTIFIER_SIZE]byte, error) {
+	var id [unix.FSCRYPT_KEY_IDENTIFIER_SIZE]byte
+	arg := unix.FscryptGetPolicyExArg{Size: uint64(unsafe.Sizeof(unix.FscryptPolicyV2{}))}
+	if err := dirIoctl(dir, unix.FS_IOC_GET_ENCRYPTION_POLICY_EX, unsafe.Pointer(&arg)); err != nil {
+		switch err {
+		case unix.ENOENT, unix.ENODATA, unix.ENOTTY, unix.EOPNOTSUPP:
+			return id, ErrStoreNotEncrypted
+		}
+		return id, errors.Wrapf(err, "reading encryption policy of %s", dir)
+	}
+	policy := (*unix.FscryptPolicyV2)(unsafe.Pointer(&arg.Policy[0]))
+	if policy.Version != unix.FSCRYPT_POLICY_V2 {
+		return id, errors.Errorf("unsupported encryption policy version %d for %s", policy.Version, dir)
+	}
+	id = policy.Master_key_identifier
+	return id, nil
+}
+
+// addEncryptionKey adds `key` to the filesystem of `dir`, returning its identifier.
+func addEncryptionKey(dir string, key []byte) ([unix.FSCRYPT_KEY_IDENTIFIER_SIZE]byte, error) {
+	var id [unix.FSCRYPT_KEY_IDENTIFIER_SIZE]byte
+	argSize := unsafe.Sizeof(unix.FscryptAddKeyArg{})
+	// The raw key follows the argument, as a flexible array member.
+	buf := make([]byte, int(argSize)+len(key))
+	defer func() {
+		for i := range buf {
+			buf[i] = 0
+		}
+	}()
+	arg := (*unix.FscryptAddKeyArg)(unsafe.Pointer(&buf[0]))
+	arg.Key_spec.Type = unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER
+	arg.Raw_size = uint32(len(key))
+	copy(buf[argSize:], key)
+	if err := dirIoctl(dir, unix.FS_IOC_ADD_ENCRYPTION_KEY, unsafe.Pointer(&buf[0])); err != nil {
+		return id, err
+	}
+	copy(id[:], arg.Key_spec.U[:])
+	return id, nil
+}
+
+// removeEncryptionKey removes the key identified by `id` from the filesystem of `dir`.
+func removeEncryptionKey(dir string, id [unix.FSCRYPT_KEY_IDENTIFIER_SIZE]byte) error {
+	arg := unix.FscryptRemoveKeyArg{}
+	arg.Key_spec.Type = unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER
+	copy(arg.Key_spec.U[:], id[:])
+	if err := dirIoctl(dir, unix.FS_IOC_REMOVE_ENCRYPTION_KEY, unsafe.Pointer(&arg)); err != nil {
+		return err
+	}
+	if arg.Removal_status_flags&unix.FSCRYPT_KEY_REMOVAL_STATUS_FLAG_FILES_BUSY != 0 {
+		logrus.WithFields(logrus.Fields{
+			"path": dir,
+		}).Warn("store key removed, but some files are still in use")
+	}
+	return nil
+}
+
+// encryptionKeyPresent returns whether the key identified by `id` is added.
+func encryptionKeyPresent(dir string, id [unix.FSCRYPT_KEY_IDENTIFIER_SIZE]byte) (bool, error) {
+	arg := unix.FscryptGetKeyStatusArg{}
+	arg.Key_spec.Type = unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER
+	copy(arg.Key_spec.U[:], id[:])
+	if err := dirIoctl(dir, unix.FS_IOC_GET_ENCRYPTION_KEY_STATUS, unsafe.Pointer(&arg)); err != nil {
+		return false, errors.Wrapf(err, "reading store key status of %s", dir)
+	}
+	return arg.Status == unix.FSCRYPT_KEY_STATUS_PRESENT, nil
+}
+
+// setEncryptionPolicy sets a v2 policy for the key `id` on the empty `dir`.
+func setEncryptionPolicy(dir string, id [unix.FSCRYPT_KEY_IDENTIFIER_SIZE]byte) error {
+	policy := unix.FscryptPolicyV2{
+		Version:                   unix.FSCRYPT_POLICY_V2,
+		Contents_encryption_mode:  unix.FSCRYPT_MODE_AES_256_XTS,
+		Filenames_encryption_mode: unix.FSCRYPT_MODE_AES_256_CTS,
+		Flags:                     unix.FSCRYPT_POLICY_FLAGS_PAD_32,
+		Master_key_identifier:     id,
+	}
+	return dirIoctl(dir, unix.FS_IOC_SET_ENCRYPTION_POLICY, unsafe.Pointer(&policy))
+}
+
+// dirIoctl performs the ioctl `req` on the directory `dir`.
+func dirIoctl(dir string, req uintptr, arg unsafe.Pointer) error {
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStoreEncryptionKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_store_encryption_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte{0x42}, storeKeySize)
+	if err := ioutil.WriteFile(filepath.Join(dir, "torcx-store"), key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "short"), key[:32], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []StoreEncryption{
+		{},
+		{KeyFile: "/run/key", Credential: "torcx-store"},
+		{Credential: "../torcx-store"},
+	}
+	for _, se := range invalid {
+		if err := se.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", se)
+		}
+	}
+
+	se := StoreEncryption{KeyFile: filepath.Join(dir, "short")}
+	if _, err := se.readKey(); err == nil {
+		t.Fatal("expected error for short key")
+	}
+
+	os.Setenv(credentialsDirEnv, dir)
+	defer os.Unsetenv(credentialsDirEnv)
+	se = StoreEncryption{Credential: "torcx-store"}
+	read, err := se.readKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, key) {
+		t.Fatal("unexpected key read from credential")
+	}
+
+	// Only empty stores can be encrypted.
+	cc := &CommonConfig{BaseDir: filepath.Join(dir, "base"), StoreEncryption: &se}
+	state, err := UserStoreEncryption(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Encrypted {
+		t.Fatalf("unexpected encrypted state: %+v", state)
+	}
+	if err := os.MkdirAll(cc.UserStorePath(""), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cc.UserStorePath(""), "foo:1.torcx.tgz"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EncryptUserStore(cc); err == nil || !strings.Contains(err.Error(), "must be empty") {
+		t.Fatalf("expected error for non-empty store, got %v", err)
+	}
+}
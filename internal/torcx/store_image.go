@@ -0,0 +1,115 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// storeImageFstypes maps store image suffixes to the filesystem types
+// tried, in order, when mounting them.
+var storeImageFstypes = map[string][]string{
+	".iso": {"iso9660"},
+	".img": {"squashfs", "ext4", "iso9660", "vfat"},
+}
+
+// StoreImage is a read-only store backed by a filesystem image file
+// (e.g. an ISO9660 addon bundle), loop-mounted at apply time.
+type StoreImage struct {
+	// Path is the filesystem image configured as a store path.
+	Path string `json:"path"`
+	// Mountpoint is where the image is mounted, and used as a store.
+	Mountpoint string `json:"mountpoint"`
+}
+
+// isStoreImage returns whether the store path `p` is a filesystem image.
+func isStoreImage(p string) bool {
+	if _, ok := storeImageFstypes[filepath.Ext(p)]; !ok {
+		return false
+	}
+	fi, err := os.Stat(p)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// storeImageMountpoint returns where the store image at `p` is mounted.
+func (cc *CommonConfig) storeImageMountpoint(p string) string {
+	name := strings.Replace(strings.TrimPrefix(filepath.Clean(p), "/"), "/", "-", -1)
+	return filepath.Join(cc.RunStoresDir(), name)
+}
+
+// ResolveStoreImages replaces store paths pointing to filesystem images
+// with their mountpoints, recording them in StoreImages. Images are only
+// mounted when applying a profile; until then, their stores are empty.
+func ResolveStoreImages(cc *CommonConfig) {
+	for i, p := range cc.StorePaths {
+		if !isStoreImage(p) {
+			continue
+		}
+		si := StoreImage{
+			Path:       p,
+			Mountpoint: cc.storeImageMountpoint(p),
+		}
+		cc.StoreImages = append(cc.StoreImages, si)
+		cc.StorePaths[i] = si.Mountpoint
+	}
+}
+
+// mountStoreImages mounts all store images read-only, on a best-effort
+// basis: stores which fail to mount are skipped like missing ones.
+func mountStoreImages(applyCfg *ApplyConfig) {
+	if len(applyCfg.StoreImages) == 0 {
+		return
+	}
+	mounts, err := readMountPoints(mountInfoPath)
+	if err != nil {
+		mounts = map[string]bool{}
+	}
+	for _, si := range applyCfg.StoreImages {
+		if mounts[si.Mountpoint] {
+			continue
+		}
+		if err := mountStoreImage(applyCfg.mounter(), si); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"path":  si.Path,
+				"error": err,
+			}).Warn("unable to mount store image")
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"path":       si.Path,
+			"mountpoint": si.Mountpoint,
+		}).Debug("store image mounted")
+	}
+}
+
+// mountStoreImage loop-mounts a single store image, trying all filesystem
+// types for its suffix.
+func mountStoreImage(m Mounter, si StoreImage) error {
+	if err := os.MkdirAll(si.Mountpoint, 0755); err != nil {
+		return err
+	}
+	err := errors.Errorf("unsupported store image %s", si.Path)
+	for _, fstype := range storeImageFstypes[filepath.Ext(si.Path)] {
+		if err = m.MountLoop(si.Path, si.Mountpoint, fstype); err == nil {
+			return nil
+		}
+	}
+	return err
+}
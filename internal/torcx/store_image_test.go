@@ -0,0 +1,88 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveStoreImages(t *testing.T) {
+	dir := t.TempDir()
+	iso := filepath.Join(dir, "addons.iso")
+	if err := ioutil.WriteFile(iso, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	storeDir := filepath.Join(dir, "store")
+	if err := os.Mkdir(storeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.img")
+
+	cc := &CommonConfig{
+		RunDir:     "/run/torcx",
+		StorePaths: []string{storeDir, iso, missing},
+	}
+	ResolveStoreImages(cc)
+
+	mountpoint := filepath.Join("/run/torcx/stores", strings.Replace(strings.TrimPrefix(iso, "/"), "/", "-", -1))
+	expected := []string{storeDir, mountpoint, missing}
+	if !reflect.DeepEqual(cc.StorePaths, expected) {
+		t.Errorf("expected store paths %v, got %v", expected, cc.StorePaths)
+	}
+	if len(cc.StoreImages) != 1 || cc.StoreImages[0].Path != iso || cc.StoreImages[0].Mountpoint != mountpoint {
+		t.Errorf("unexpected store images %v", cc.StoreImages)
+	}
+	for _, p := range cc.WritableStorePaths() {
+		if p == mountpoint {
+			t.Errorf("image-backed store %s reported as writable", p)
+		}
+	}
+}
+
+func TestMountStoreImages(t *testing.T) {
+	origMountInfo := mountInfoPath
+	defer func() { mountInfoPath = origMountInfo }()
+	mountInfoPath = filepath.Join(t.TempDir(), "mountinfo")
+
+	runDir := t.TempDir()
+	m := &fakeMounter{}
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			RunDir:  runDir,
+			Mounter: m,
+			StoreImages: []StoreImage{
+				{Path: "/srv/addons.iso", Mountpoint: filepath.Join(runDir, "stores", "srv-addons.iso")},
+				{Path: "/srv/addons.img", Mountpoint: filepath.Join(runDir, "stores", "srv-addons.img")},
+			},
+		},
+	}
+	mountStoreImages(applyCfg)
+
+	expected := []string{
+		"iso9660:" + filepath.Join(runDir, "stores", "srv-addons.iso"),
+		"squashfs:" + filepath.Join(runDir, "stores", "srv-addons.img"),
+	}
+	if !reflect.DeepEqual(m.mounts, expected) {
+		t.Errorf("expected mounts %v, got %v", expected, m.mounts)
+	}
+	if !IsExistingPath(filepath.Join(runDir, "stores", "srv-addons.iso")) {
+		t.Error("mountpoint not created")
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// storeIndexName is the name of the index file in each store directory.
+	storeIndexName = ".torcx-index.json"
+	// StoreIndexV0K - store index kind, v0
+	StoreIndexV0K = "torcx-store-index-v0"
+)
+
+// StoreIndexV0JSON holds a JSON store index (version 0).
+type StoreIndexV0JSON struct {
+	Kind  string            `json:"kind"`
+	Value []StoreIndexEntry `json:"value"`
+}
+
+// StoreIndexEntry describes an archive in a store directory.
+type StoreIndexEntry struct {
+	Name      string        `json:"name"`
+	Reference string        `json:"reference"`
+	File      string        `json:"file"`
+	Format    ArchiveFormat `json:"format"`
+	Hash      string        `json:"hash,omitempty"`
+}
+
+// storeArchives returns all archives in the store directory `dir`,
+// including the ones of its namespaces.
+func storeArchives(dir string) ([]Archive, error) {
+	archives, err := indexedStoreArchives(dir)
+	if err != nil {
+		return nil, err
+	}
+	return append(archives, namespaceArchives(dir)...), nil
+}
+
+// indexedStoreArchives returns the archives directly in `dir`.
+// The store index is used if up-to-date, otherwise the directory is walked
+// and the index refreshed (if the store is writable).
+func indexedStoreArchives(dir string) ([]Archive, error) {
+	if archives, ok := readStoreIndex(dir); ok {
+		return archives, nil
+	}
+
+	archives, err := scanStoreDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	writeStoreIndex(dir, archives)
+	return archives, nil
+}
+
+// scanStoreDir walks the store directory `dir`, returning all archives.
+func scanStoreDir(dir string) ([]Archive, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	archives := []Archive{}
+	for _, fi := range files {
+		if archive, ok := scanStoreEntry(dir, fi); ok {
+			archives = append(archives, archive)
+		}
+	}
+	return archives, nil
+}
+
+// updateStoreIndex refreshes the index of store directory `dir`, after
+// it has been modified.
+func updateStoreIndex(dir string) {
+	archives, err := scanStoreDir(dir)
+	if err != nil {
+		return
+	}
+	writeStoreIndex(dir, archives)
+}
+
+// readStoreIndex reads the index of store directory `dir`, returning false
+// if it is missing or stale. An index is up-to-date if its mtime matches
+// the one of the directory, which changes on any entry addition, removal
+// or rename.
+func readStoreIndex(dir string) ([]Archive, bool) {
+	indexPath := filepath.Join(dir, storeIndexName)
+	dirInfo, err := os.Stat(dir)
+	if err != nil {
+		return nil, false
+	}
+	fp, err := os.Open(indexPath)
+	if err != nil {
+		return nil, false
+	}
+	defer fp.Close()
+	indexInfo, err := fp.Stat()
+	if err != nil || !indexInfo.ModTime().Equal(dirInfo.ModTime()) {
+		logrus.WithField("path", indexPath).Debug("stale store index")
+		return nil, false
+	}
+
+	var index StoreIndexV0JSON
+	if err := json.NewDecoder(bufio.NewReader(fp)).Decode(&index); err != nil {
+		return nil, false
+	}
+	if index.Kind != StoreIndexV0K {
+		return nil, false
+	}
+
+	archives := make([]Archive, 0, len(index.Value))
+	for _, entry := range index.Value {
+		if entry.File != filepath.Base(entry.File) {
+			return nil, false
+		}
+		im := Image{
+			Name:      entry.Name,
+			Reference: entry.Reference,
+		}
+		archives = append(archives, Archive{im, filepath.Join(dir, entry.File), entry.Format})
+	}
+	return archives, true
+}
+
+// writeStoreIndex writes the index of store directory `dir`, on a
+// best-effort basis (e.g. vendor stores are read-only).
+func writeStoreIndex(dir string, archives []Archive) {
+	index := StoreIndexV0JSON{
+		Kind:  StoreIndexV0K,
+		Value: make([]StoreIndexEntry, 0, len(archives)),
+	}
+	for _, ar := range archives {
+		hash, _ := readHashSidecar(ar.Filepath)
+		index.Value = append(index.Value, StoreIndexEntry{
+			Name:      ar.Name,
+			Reference: ar.Reference,
+			File:      filepath.Base(ar.Filepath),
+			Format:    ar.Format,
+			Hash:      hash,
+		})
+	}
+
+	indexPath := filepath.Join(dir, storeIndexName)
+	if err := writeStoreIndexFile(dir, indexPath, &index); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"path":  indexPath,
+			"error": err,
+		}).Debug("store index not written")
+		return
+	}
+
+	// The directory may have changed while the index was being written:
+	// in that case, drop the index and let the next reader walk the store.
+	current, err := scanStoreDir(dir)
+	if err != nil || !reflect.DeepEqual(current, archives) {
+		os.Remove(indexPath)
+	}
+}
+
+// writeStoreIndexFile atomically writes `index` to `indexPath`, then aligns
+// its mtime to the one of the store directory.
+func writeStoreIndexFile(dir string, indexPath string, index *StoreIndexV0JSON) error {
+	tmpFile, err := ioutil.TempFile(dir, ".torcx-index")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName)
+
+	if err := json.NewEncoder(tmpFile).Encode(index); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, indexPath); err != nil {
+		return err
+	}
+
+	dirInfo, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(indexPath, dirInfo.ModTime(), dirInfo.ModTime())
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// namespaceSeparator separates the namespace from the name in
+	// namespaced image names, e.g. "platform/docker".
+	namespaceSeparator = "/"
+	// namespacePathSeparator replaces namespaceSeparator in per-image
+	// paths (e.g. unpack roots), which must stay single path components.
+	namespacePathSeparator = "@"
+	// namespaceMarker is the file marking a store subdirectory as a
+	// namespace, so that it is not mistaken for a versioned store.
+	namespaceMarker = ".torcx-namespace"
+)
+
+// namespaceRegexp matches valid namespace names.
+var namespaceRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// SplitNamespace splits an image name into its namespace (empty for
+// images outside namespaces) and its name within the namespace.
+func SplitNamespace(name string) (string, string) {
+	if i := strings.Index(name, namespaceSeparator); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// ValidateNamespace checks that `ns` is a valid namespace name.
+func ValidateNamespace(ns string) error {
+	if !namespaceRegexp.MatchString(ns) {
+		return errors.Errorf("invalid namespace %q", ns)
+	}
+	return nil
+}
+
+// imagePathName returns the form of image `name` used as path component.
+func imagePathName(name string) string {
+	return strings.Replace(name, namespaceSeparator, namespacePathSeparator, 1)
+}
+
+// storeNamespaces returns the namespaces of store directory `dir`.
+func storeNamespaces(dir string) []string {
+	markers, err := filepath.Glob(filepath.Join(dir, "*", namespaceMarker))
+	if err != nil {
+		return nil
+	}
+	namespaces := []string{}
+	for _, marker := range markers {
+		ns := filepath.Base(filepath.Dir(marker))
+		if ValidateNamespace(ns) == nil {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces
+}
+
+// CreateNamespace creates namespace `ns` in store directory `dir`,
+// returning the namespace directory. Existing namespaces are kept.
+func CreateNamespace(dir string, ns string) (string, error) {
+	if err := ValidateNamespace(ns); err != nil {
+		return "", err
+	}
+	nsDir := filepath.Join(dir, ns)
+	if err := os.MkdirAll(nsDir, 0755); err != nil {
+		return "", err
+	}
+	marker := filepath.Join(nsDir, namespaceMarker)
+	if !IsExistingPath(marker) {
+		if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+			return "", errors.Wrapf(err, "creating namespace %s", ns)
+		}
+		logrus.WithFields(logrus.Fields{
+			"path": nsDir,
+		}).Debug("store namespace created")
+	}
+	return nsDir, nil
+}
+
+// namespaceArchives returns the archives of all namespaces of store
+// directory `dir`, named after their namespace. Each namespace has its
+// own store index.
+func namespaceArchives(dir string) []Archive {
+	archives := []Archive{}
+	for _, ns := range storeNamespaces(dir) {
+		nsArchives, err := indexedStoreArchives(filepath.Join(dir, ns))
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"path": filepath.Join(dir, ns),
+				"err":  err,
+			}).Info("store namespace skipped")
+			continue
+		}
+		for _, ar := range nsArchives {
+			ar.Name = ns + namespaceSeparator + ar.Name
+			archives = append(archives, ar)
+		}
+	}
+	return archives
+}
+
+// archiveDir returns the directory of store `dir` holding archives of `im`.
+func archiveDir(dir string, im Image) string {
+	if ns, _ := SplitNamespace(im.Name); ns != "" {
+		return filepath.Join(dir, ns)
+	}
+	return dir
+}
+
+// archiveFileName returns the store file name of `im` in `format`.
+func archiveFileName(im Image, format ArchiveFormat) string {
+	_, name := SplitNamespace(im.Name)
+	return name + ":" + im.Reference + format.FileSuffix()
+}
+
+// NamespaceKeysDirs are the trust store directories holding the keys of
+// namespace `ns`, as subdirectories of TrustedKeysDirs.
+func (cc *CommonConfig) NamespaceKeysDirs(ns string) []string {
+	dirs := []string{}
+	for _, dir := range cc.TrustedKeysDirs() {
+		dirs = append(dirs, filepath.Join(dir, ns))
+	}
+	return dirs
+}
+
+// LoadNamespaceKeys loads all armored keys trusted for namespace `ns`.
+// Missing directories are skipped.
+func (cc *CommonConfig) LoadNamespaceKeys(ns string) (openpgp.EntityList, error) {
+	return loadArmoredKeysFrom(cc.NamespaceKeysDirs(ns))
+}
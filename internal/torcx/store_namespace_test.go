@@ -0,0 +1,135 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestStoreNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_namespace_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := filepath.Join(dir, "store")
+	nsDir, err := CreateNamespace(store, "platform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateNamespace(store, "Bad.NS"); err == nil {
+		t.Fatal("expected error for invalid namespace")
+	}
+	// Unmarked subdirectories (e.g. versioned stores) are not namespaces.
+	if err := os.MkdirAll(filepath.Join(store, "1688.5.3"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{
+		filepath.Join(store, "docker:1.torcx.tgz"),
+		filepath.Join(nsDir, "docker:2.torcx.tgz"),
+		filepath.Join(store, "1688.5.3", "docker:3.torcx.tgz"),
+	} {
+		if err := ioutil.WriteFile(p, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sc, err := NewStoreCache([]string{store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for im := range sc.Images {
+		names = append(names, im.Name+":"+im.Reference)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "docker:1" || names[1] != "platform/docker:2" {
+		t.Fatalf("unexpected images: %v", names)
+	}
+	ar, err := sc.ArchiveFor(Image{Name: "platform/docker", Reference: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ar.Filepath != filepath.Join(nsDir, "docker:2.torcx.tgz") {
+		t.Fatalf("unexpected archive path %s", ar.Filepath)
+	}
+	if name := imagePathName("platform/docker"); name != "platform@docker" {
+		t.Fatalf("unexpected path name %s", name)
+	}
+
+	// Namespaced images are removed from their namespace directory.
+	cc := &CommonConfig{
+		BaseDir:    dir,
+		RunDir:     filepath.Join(dir, "run"),
+		ConfDir:    filepath.Join(dir, "conf"),
+		UsrDir:     filepath.Join(dir, "usr"),
+		StorePaths: []string{store},
+	}
+	removed, err := RemoveImage(cc, Image{Name: "platform/docker", Reference: "2"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || IsExistingPath(ar.Filepath) || !IsExistingPath(filepath.Join(store, "docker:1.torcx.tgz")) {
+		t.Fatalf("unexpected removal: %v", removed)
+	}
+}
+
+func TestNamespaceSignaturePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_namespace_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origLockdown := LockdownPath
+	defer func() { LockdownPath = origLockdown }()
+	LockdownPath = filepath.Join(dir, "lockdown")
+
+	cc := &CommonConfig{
+		ConfDir: filepath.Join(dir, "conf"),
+		UsrDir:  filepath.Join(dir, "usr"),
+	}
+	ar := Archive{Image: Image{Name: "apps/foo", Reference: "1"}, Filepath: filepath.Join(dir, "foo:1.torcx.tgz")}
+	if err := ioutil.WriteFile(ar.Filepath, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := enforceSignaturePolicy(cc, ar); err != nil {
+		t.Fatalf("unexpected error without namespace keys: %s", err)
+	}
+
+	// Namespace keys require signatures, and machine-wide keys are not accepted.
+	nsKey := writeTrustedKey(t, filepath.Join(cc.ConfDir, "trusted-keys.d", "apps", "apps.asc"))
+	global := writeTrustedKey(t, filepath.Join(cc.ConfDir, "trusted-keys.d", "global.asc"))
+	if err := enforceSignaturePolicy(cc, ar); err == nil {
+		t.Fatal("expected error for unsigned namespaced archive")
+	}
+	signTestArchive(t, ar, global)
+	if err := enforceSignaturePolicy(cc, ar); err == nil {
+		t.Fatal("expected error for archive signed by a machine-wide key")
+	}
+	signTestArchive(t, ar, nsKey)
+	if err := enforceSignaturePolicy(cc, ar); err != nil {
+		t.Fatalf("unexpected error for archive signed by a namespace key: %s", err)
+	}
+	other := Archive{Image: Image{Name: "foo", Reference: "1"}, Filepath: ar.Filepath}
+	if err := enforceSignaturePolicy(cc, other); err != nil {
+		t.Fatalf("unexpected error outside namespace: %s", err)
+	}
+}
@@ -15,6 +15,9 @@
 package torcx
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -68,3 +71,66 @@ func TestFilterStoreVersion(t *testing.T) {
 
 	}
 }
+
+func TestStoreIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_index_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"foo:1.torcx.tgz", "bar:2.torcx.squashfs", "unrelated.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// First lookup walks the store and writes the index.
+	first, err := storeArchives(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 {
+		t.Fatalf("expected 2 archives, got %v", first)
+	}
+	indexed, ok := readStoreIndex(dir)
+	if !ok {
+		t.Fatal("store index not written or stale")
+	}
+	if !reflect.DeepEqual(first, indexed) {
+		t.Fatalf("index mismatch: expected %v, got %v", first, indexed)
+	}
+
+	// Mutations make the index stale.
+	if err := os.Remove(filepath.Join(dir, "bar:2.torcx.squashfs")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readStoreIndex(dir); ok {
+		t.Fatal("expected stale store index")
+	}
+	second, err := storeArchives(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second) != 1 || second[0].Name != "foo" {
+		t.Fatalf("unexpected archives %v", second)
+	}
+}
+
+func TestFilesystemImagePrecedence(t *testing.T) {
+	tgz := Archive{Image: Image{Name: "foo", Reference: "1"}, Filepath: "/a/foo:1.torcx.tgz", Format: ArchiveFormatTgz}
+	erofs := Archive{Image: Image{Name: "foo", Reference: "1"}, Filepath: "/b/foo:1.torcx.erofs", Format: ArchiveFormatErofs}
+	sc, err := NewStoreCacheFrom([]Store{memStore{tgz}, memStore{erofs}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar, err := sc.ArchiveFor(Image{Name: "foo", Reference: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ar.Filepath != erofs.Filepath {
+		t.Errorf("expected %s, got %s", erofs.Filepath, ar.Filepath)
+	}
+	if len(sc.Shadowed) != 1 || sc.Shadowed[0].Filepath != tgz.Filepath {
+		t.Errorf("unexpected shadowed archives %v", sc.Shadowed)
+	}
+}
@@ -0,0 +1,516 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/northbright/ctx/ctxcopy"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// SyncCopied is the status of archives copied by a sync.
+	SyncCopied = "copied"
+	// SyncPresent is the status of archives already in the destination.
+	SyncPresent = "present"
+	// SyncUnverified is the status of archives skipped for lack of a
+	// known hash at the source.
+	SyncUnverified = "unverified"
+	// SyncConflict is the status of archives skipped because the
+	// destination holds a different archive with the same name.
+	SyncConflict = "conflict"
+)
+
+// syncSidecarSuffixes are the archive sidecars copied along archives.
+var syncSidecarSuffixes = []string{signatureSidecarSuffix, timestampSidecarSuffix, metaSidecarSuffix}
+
+// errSyncMissing is returned by sync sources for missing files.
+var errSyncMissing = errors.New("not found at sync source")
+
+// SyncEntry is an archive available at a sync source.
+type SyncEntry struct {
+	// Name is the archive file name.
+	Name string `json:"name"`
+	// Hash is the archive hash, if known.
+	Hash string `json:"hash,omitempty"`
+	// Size is the archive size, if known.
+	Size int64 `json:"size,omitempty"`
+
+	// sidecars lists the suffixes of sidecars to copy alongside.
+	sidecars []string
+}
+
+// SyncedArchive is the outcome of a sync for a single archive.
+type SyncedArchive struct {
+	SyncEntry
+	// Path is the archive path in the destination store.
+	Path string `json:"path"`
+	// Status is one of the Sync* statuses.
+	Status string `json:"status"`
+}
+
+// syncSource is a store to sync archives from.
+type syncSource interface {
+	// list returns the archives available at the source.
+	list(ctx context.Context) ([]SyncEntry, error)
+	// fetch transfers the file `name` to `dest`, resuming a partial
+	// transfer if `dest` exists.
+	fetch(ctx context.Context, name string, dest string) error
+}
+
+// SyncStore copies to the local store directory `dst` all archives from
+// `src` which are missing there, along with their sidecars. `src` is a
+// local store directory, an SSH location (ssh://[user@]host[:port]/path,
+// transferred with rsync) or the base URL of an HTTP remote, whose
+// contents manifest is verified against `keyrings`.
+// Copied archives are verified against their hash at the source, thus
+// archives without a known hash are skipped. Interrupted transfers are
+// resumed by re-running the sync.
+func SyncStore(ctx context.Context, cc *CommonConfig, src string, dst string, keyrings []openpgp.KeyRing) ([]SyncedArchive, error) {
+	if u, err := url.Parse(dst); err == nil && u.Scheme != "" {
+		return nil, errors.Errorf("destination %s must be a local store directory", dst)
+	}
+	source, err := newSyncSource(cc, src, keyrings)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := source.list(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %s", src)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return nil, err
+	}
+	results := []SyncedArchive{}
+	for _, entry := range entries {
+		result := SyncedArchive{
+			SyncEntry: entry,
+			Path:      filepath.Join(dst, entry.Name),
+		}
+		result.Status, err = syncArchive(ctx, source, entry, result.Path)
+		if err != nil {
+			return results, errors.Wrapf(err, "syncing %s", entry.Name)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// syncArchive copies a single archive (and its sidecars) to `targetPath`,
+// returning its sync status.
+func syncArchive(ctx context.Context, source syncSource, entry SyncEntry, targetPath string) (string, error) {
+	if entry.Hash == "" {
+		logrus.WithFields(logrus.Fields{
+			"name": entry.Name,
+		}).Warn("skipping archive without known hash")
+		return SyncUnverified, nil
+	}
+	if IsExistingPath(targetPath) {
+		if hash, err := readHashSidecar(targetPath); err == nil && hash == entry.Hash {
+			return SyncPresent, nil
+		}
+		valid, err := validateHash(targetPath, entry.Hash)
+		if err != nil {
+			return "", err
+		}
+		if !valid {
+			return SyncConflict, nil
+		}
+		return SyncPresent, writeHashSidecar(targetPath, entry.Hash)
+	}
+
+	dir := filepath.Dir(targetPath)
+	if entry.Size > 0 {
+		if err := checkFreeSpace(dir, entry.Size); err != nil {
+			return "", err
+		}
+	}
+	lock, fetched, err := lockArchive(ctx, targetPath, entry.Hash)
+	if err != nil {
+		return "", err
+	}
+	if fetched {
+		return SyncPresent, nil
+	}
+	defer unlockFile(lock)
+
+	// Partial transfers are kept on failure, to be resumed on the next
+	// sync, unless they fail verification once complete.
+	tmpName := partialPath(dir, entry.Name, entry.Hash)
+	logrus.WithFields(logrus.Fields{
+		"name": entry.Name,
+	}).Info("syncing image archive")
+	if err := source.fetch(ctx, entry.Name, tmpName); err != nil {
+		return "", err
+	}
+	if err := installArchive(tmpName, targetPath, entry.Hash, entry.Size); err != nil {
+		os.Remove(tmpName)
+		return "", err
+	}
+
+	for _, suffix := range entry.sidecars {
+		tmpSidecar := partialPath(dir, entry.Name+suffix, "")
+		os.Remove(tmpSidecar)
+		err := source.fetch(ctx, entry.Name+suffix, tmpSidecar)
+		if errors.Cause(err) == errSyncMissing {
+			continue
+		}
+		if err == nil {
+			err = os.Rename(tmpSidecar, targetPath+suffix)
+		}
+		if err != nil {
+			os.Remove(tmpSidecar)
+			return "", errors.Wrapf(err, "copying %s sidecar", suffix)
+		}
+	}
+	return SyncCopied, nil
+}
+
+// newSyncSource returns the sync source for `src`.
+func newSyncSource(cc *CommonConfig, src string, keyrings []openpgp.KeyRing) (syncSource, error) {
+	u, err := url.Parse(src)
+	if err != nil || u.Scheme == "" {
+		fi, err := os.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, errors.Errorf("%s is not a store directory", src)
+		}
+		return &localSyncSource{dir: src}, nil
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		base := *u
+		if !strings.HasSuffix(base.Path, "/") {
+			base.Path += "/"
+		}
+		return &httpSyncSource{
+			base:      &base,
+			client:    cc.httpClient(),
+			keyrings:  keyrings,
+			locations: map[string]*url.URL{},
+		}, nil
+	case "ssh":
+		if u.Host == "" || u.Path == "" {
+			return nil, errors.Errorf("invalid SSH location %s", src)
+		}
+		host := u.Hostname()
+		if u.User != nil {
+			host = u.User.Username() + "@" + host
+		}
+		shell := "ssh"
+		if u.Port() != "" {
+			shell += " -p " + u.Port()
+		}
+		return &sshSyncSource{host: host, dir: u.Path, shell: shell}, nil
+	default:
+		return nil, errors.Errorf("unsupported sync source scheme %q", u.Scheme)
+	}
+}
+
+// localSyncSource syncs from a local store directory.
+type localSyncSource struct {
+	dir string
+}
+
+func (ls *localSyncSource) list(ctx context.Context) ([]SyncEntry, error) {
+	files, err := ioutil.ReadDir(ls.dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := []SyncEntry{}
+	for _, fi := range files {
+		ar, ok := scanStoreEntry(ls.dir, fi)
+		if !ok {
+			continue
+		}
+		entry := SyncEntry{
+			Name: filepath.Base(ar.Filepath),
+			Size: fi.Size(),
+		}
+		if hash, err := readHashSidecar(ar.Filepath); err == nil {
+			entry.Hash = hash
+		} else if meta, err := ReadArchiveMeta(ar.Filepath); err == nil {
+			entry.Hash = meta.Hash
+		}
+		for _, suffix := range syncSidecarSuffixes {
+			if IsExistingPath(ar.Filepath + suffix) {
+				entry.sidecars = append(entry.sidecars, suffix)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (ls *localSyncSource) fetch(ctx context.Context, name string, dest string) error {
+	src, err := os.Open(filepath.Join(ls.dir, name))
+	if os.IsNotExist(err) {
+		return errSyncMissing
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	fp, offset, err := openResumable(dest)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if offset > fi.Size() {
+		if err := truncateResumable(fp); err != nil {
+			return err
+		}
+		offset = 0
+	}
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	if err := ctxcopy.Copy(ctx, fp, src, buf); err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
+// httpSyncSource syncs from the archives listed by an HTTP remote.
+type httpSyncSource struct {
+	base     *url.URL
+	client   *http.Client
+	keyrings []openpgp.KeyRing
+	// locations maps archive file names to their URL.
+	locations map[string]*url.URL
+}
+
+func (hs *httpSyncSource) list(ctx context.Context) ([]SyncEntry, error) {
+	contentsURL := hs.base.ResolveReference(&url.URL{Path: remoteContentsName})
+	manifest, err := fetchManifest(ctx, hs.client, contentsURL.String())
+	if err != nil {
+		return nil, err
+	}
+	manifest, err = verifyManifest(contentsURL.String(), manifest, hs.keyrings)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := decodeContents(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []SyncEntry{}
+	for _, im := range contents.Images {
+		for _, v := range im.versions {
+			location, err := parseLocation(v.location)
+			if err != nil {
+				return nil, err
+			}
+			archiveURL := hs.base.ResolveReference(location)
+			name := path.Base(archiveURL.Path)
+			hs.locations[name] = archiveURL
+			entries = append(entries, SyncEntry{
+				Name:     name,
+				Hash:     v.hash,
+				Size:     v.size,
+				sidecars: syncSidecarSuffixes,
+			})
+		}
+	}
+	return entries, nil
+}
+
+func (hs *httpSyncSource) fetch(ctx context.Context, name string, dest string) error {
+	target := hs.base.ResolveReference(&url.URL{Path: name})
+	for archive, archiveURL := range hs.locations {
+		if strings.HasPrefix(name, archive) {
+			sidecarURL := *archiveURL
+			sidecarURL.Path += strings.TrimPrefix(name, archive)
+			target = &sidecarURL
+			break
+		}
+	}
+
+	fp, offset, err := openResumable(dest)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	req, err := http.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	req.Header.Set("Accept-Encoding", "identity")
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := hs.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return errSyncMissing
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is complete (or bogus, as verification tells).
+		return fp.Close()
+	case http.StatusPartialContent:
+	default:
+		if err := checkHTTPStatus(resp); err != nil {
+			return err
+		}
+		if err := truncateResumable(fp); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, 32*1024)
+	if err := ctxcopy.Copy(ctx, fp, resp.Body, buf); err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
+// sshSyncSource syncs from a store directory on another machine, with
+// rsync over SSH.
+type sshSyncSource struct {
+	// host is the [user@]host to connect to.
+	host string
+	// dir is the store directory on the host.
+	dir string
+	// shell is the rsync remote shell command.
+	shell string
+}
+
+func (ss *sshSyncSource) location(name string) string {
+	return ss.host + ":" + path.Join(ss.dir, name)
+}
+
+func (ss *sshSyncSource) list(ctx context.Context) ([]SyncEntry, error) {
+	cmd := exec.CommandContext(ctx, rsyncBinary, "--list-only", "--copy-links", "--no-motd", "--timeout="+rsyncIOTimeout, "-e", ss.shell, "--", ss.location("")+"/")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %s", ss.location(""))
+	}
+	files := parseRsyncListing(string(out))
+
+	tmpDir, err := ioutil.TempDir("", "torcx-sync")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	entries := []SyncEntry{}
+	for name, size := range files {
+		if !isArchiveName(name) {
+			continue
+		}
+		entry := SyncEntry{Name: name, Size: size}
+		if _, ok := files[name+hashSidecarSuffix]; ok {
+			tmpPath := filepath.Join(tmpDir, name)
+			if err := ss.fetch(ctx, name+hashSidecarSuffix, tmpPath+hashSidecarSuffix); err != nil {
+				return nil, err
+			}
+			if entry.Hash, err = readHashSidecar(tmpPath); err != nil {
+				return nil, err
+			}
+		}
+		for _, suffix := range syncSidecarSuffixes {
+			if _, ok := files[name+suffix]; ok {
+				entry.sidecars = append(entry.sidecars, suffix)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (ss *sshSyncSource) fetch(ctx context.Context, name string, dest string) error {
+	return rsync(ctx, ss.location(name), dest, "--copy-links", "-e", ss.shell)
+}
+
+// parseRsyncListing parses the output of `rsync --list-only`, returning
+// the size of regular files by name.
+func parseRsyncListing(out string) map[string]int64 {
+	files := map[string]int64{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "-") {
+			continue
+		}
+		size, err := strconv.ParseInt(strings.NewReplacer(",", "", ".", "").Replace(fields[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		files[strings.Join(fields[4:], " ")] = size
+	}
+	return files
+}
+
+// isArchiveName returns whether `name` is the file name of an image archive.
+func isArchiveName(name string) bool {
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(name, format.FileSuffix()) {
+			return true
+		}
+	}
+	return false
+}
+
+// openResumable opens `path` for appending, returning the offset to
+// resume a transfer at.
+func openResumable(path string) (*os.File, int64, error) {
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, 0, err
+	}
+	return fp, fi.Size(), nil
+}
+
+// truncateResumable discards the content of a resumable file.
+func truncateResumable(fp *os.File) error {
+	if err := fp.Truncate(0); err != nil {
+		return err
+	}
+	_, err := fp.Seek(0, io.SeekStart)
+	return err
+}
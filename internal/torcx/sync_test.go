@@ -0,0 +1,154 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestSyncStoreLocal(t *testing.T) {
+	dir := t.TempDir()
+	srcDir := filepath.Join(dir, "src")
+	dstDir := filepath.Join(dir, "dst")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	foo := filepath.Join(srcDir, "foo:1.torcx.tgz")
+	writeTestTgz(t, foo, map[string]string{"bin/foo": "foo"})
+	hash, err := computeHash(foo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeHashSidecar(foo, hash); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(foo+signatureSidecarSuffix, []byte("signature"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTgz(t, filepath.Join(srcDir, "bar:1.torcx.tgz"), map[string]string{"bin/bar": "bar"})
+
+	// Resume from a partial transfer.
+	content, err := ioutil.ReadFile(foo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(partialPath(dstDir, "foo:1.torcx.tgz", hash), content[:len(content)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := &CommonConfig{}
+	synced, err := SyncStore(context.Background(), cc, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]string{}
+	for _, s := range synced {
+		statuses[s.Name] = s.Status
+	}
+	if statuses["foo:1.torcx.tgz"] != SyncCopied || statuses["bar:1.torcx.tgz"] != SyncUnverified {
+		t.Fatalf("unexpected sync statuses %v", statuses)
+	}
+	target := filepath.Join(dstDir, "foo:1.torcx.tgz")
+	if valid, err := validateHash(target, hash); err != nil || !valid {
+		t.Fatalf("synced archive does not match: %v", err)
+	}
+	if b, err := ioutil.ReadFile(target + signatureSidecarSuffix); err != nil || string(b) != "signature" {
+		t.Errorf("signature sidecar not synced: %v", err)
+	}
+	if IsExistingPath(filepath.Join(dstDir, "bar:1.torcx.tgz")) {
+		t.Error("unverified archive was synced")
+	}
+
+	synced, err = SyncStore(context.Background(), cc, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range synced {
+		if s.Name == "foo:1.torcx.tgz" && s.Status != SyncPresent {
+			t.Errorf("expected present archive on second sync, got %s", s.Status)
+		}
+	}
+
+	// Archives with the same name but different content are not replaced.
+	if err := os.Remove(target + hashSidecarSuffix); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTgz(t, target, map[string]string{"bin/foo": "other"})
+	synced, err = SyncStore(context.Background(), cc, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range synced {
+		if s.Name == "foo:1.torcx.tgz" && s.Status != SyncConflict {
+			t.Errorf("expected conflict, got %s", s.Status)
+		}
+	}
+
+	if _, err := SyncStore(context.Background(), cc, srcDir, "ssh://host/store", nil); err == nil {
+		t.Error("expected error for non-local destination")
+	}
+}
+
+func TestSyncStoreHTTP(t *testing.T) {
+	dir := t.TempDir()
+	srcDir := filepath.Join(dir, "src")
+	dstDir := filepath.Join(dir, "dst")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestTgz(t, filepath.Join(srcDir, "foo:1.torcx.tgz"), map[string]string{"bin/foo": "foo"})
+	signer := writeTrustedKey(t, filepath.Join(dir, "key.asc"))
+	server := httptest.NewServer(NewStoreServer([]string{srcDir}, signer))
+	defer server.Close()
+
+	cc := &CommonConfig{}
+	other := writeTrustedKey(t, filepath.Join(dir, "other.asc"))
+	if _, err := SyncStore(context.Background(), cc, server.URL, dstDir, []openpgp.KeyRing{openpgp.EntityList{other}}); err == nil {
+		t.Fatal("expected error for contents manifest signed by an untrusted key")
+	}
+
+	synced, err := SyncStore(context.Background(), cc, server.URL, dstDir, []openpgp.KeyRing{openpgp.EntityList{signer}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(synced) != 1 || synced[0].Status != SyncCopied {
+		t.Fatalf("unexpected sync result %+v", synced)
+	}
+	if valid, err := validateHash(synced[0].Path, synced[0].Hash); err != nil || !valid {
+		t.Errorf("synced archive does not match: %v", err)
+	}
+}
+
+func TestParseRsyncListing(t *testing.T) {
+	out := `drwxr-xr-x          4,096 2018/06/01 10:00:00 .
+-rw-r--r--          5,120 2018/06/01 10:00:00 foo:1.torcx.tgz
+-rw-r--r--            136 2018/06/01 10:00:00 foo:1.torcx.tgz.hash
+lrwxrwxrwx             15 2018/06/01 10:00:00 bar:1.torcx.tgz
+`
+	files := parseRsyncListing(out)
+	if len(files) != 2 || files["foo:1.torcx.tgz"] != 5120 || files["foo:1.torcx.tgz.hash"] != 136 {
+		t.Errorf("unexpected listing %v", files)
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// timestampSuffix is appended to detached signature paths for RFC3161
+	// timestamp tokens countersigning them.
+	timestampSuffix = ".tsr"
+	// timestampSidecarSuffix is appended to archive paths for the
+	// timestamp token of their detached signature.
+	timestampSidecarSuffix = signatureSidecarSuffix + timestampSuffix
+	// authorityCertSuffix is the suffix of PEM timestamping authority
+	// certificates in the trust store.
+	authorityCertSuffix = ".pem"
+)
+
+var (
+	oidSignedData     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidContentType    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidDigestSHA256   = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidDigestSHA384   = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidDigestSHA512   = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	timestampDigests  = map[string]crypto.Hash{oidDigestSHA256.String(): crypto.SHA256, oidDigestSHA384.String(): crypto.SHA384, oidDigestSHA512.String(): crypto.SHA512}
+	timestampRSAAlgos = map[crypto.Hash]x509.SignatureAlgorithm{crypto.SHA256: x509.SHA256WithRSA, crypto.SHA384: x509.SHA384WithRSA, crypto.SHA512: x509.SHA512WithRSA}
+	timestampECAlgos  = map[crypto.Hash]x509.SignatureAlgorithm{crypto.SHA256: x509.ECDSAWithSHA256, crypto.SHA384: x509.ECDSAWithSHA384, crypto.SHA512: x509.ECDSAWithSHA512}
+)
+
+// signatureTimestamp is a verified countersignature, proving a signature
+// existed at Time.
+type signatureTimestamp struct {
+	// Time is the time asserted by the timestamping authority.
+	Time time.Time
+	// Authority is the subject of the timestamping authority certificate.
+	Authority string
+}
+
+// RFC3161 and CMS (RFC5652) structures, restricted to what is needed to
+// verify timestamp tokens.
+type tsResponse struct {
+	Status tsStatusInfo
+	Token  asn1.RawValue `asn1:"optional"`
+}
+
+type tsStatusInfo struct {
+	Status int
+}
+
+type tsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type tsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo tsEncapContentInfo
+	Certificates     tsRawSet       `asn1:"optional,tag:0"`
+	CRLs             tsRawSet       `asn1:"optional,tag:1"`
+	SignerInfos      []tsSignerInfo `asn1:"set"`
+}
+
+type tsRawSet struct {
+	Raw asn1.RawContent
+}
+
+type tsEncapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type tsSignerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type tsIssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type tsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type tsInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint tsMessageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+}
+
+type tsMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+// LoadTimestampAuthorities loads all PEM certificates of timestamping
+// authorities from the machine trust store. It returns nil if there are
+// none, in which case timestamp tokens are ignored.
+func (cc *CommonConfig) LoadTimestampAuthorities() (*x509.CertPool, error) {
+	var pool *x509.CertPool
+	for _, dir := range cc.TrustedKeysDirs() {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, fi := range files {
+			if !fi.Mode().IsRegular() || !strings.HasSuffix(fi.Name(), authorityCertSuffix) {
+				continue
+			}
+			path := filepath.Join(dir, fi.Name())
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			if pool == nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(b) {
+				return nil, errors.Errorf("no certificates in %s", path)
+			}
+		}
+	}
+	return pool, nil
+}
+
+// readSignatureTimestamp verifies the timestamp token next to the
+// detached signature at `sigPath`, if any, against `authorities`. It
+// returns nil if there is no token or no authorities.
+func readSignatureTimestamp(sigPath string, authorities *x509.CertPool) (*signatureTimestamp, error) {
+	if authorities == nil {
+		return nil, nil
+	}
+	token, err := ioutil.ReadFile(sigPath + timestampSuffix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sig, err := ioutil.ReadFile(sigPath)
+	if err != nil {
+		return nil, err
+	}
+	stamp, err := verifyTimestamp(token, sig, authorities)
+	if err != nil {
+		return nil, errors.Wrapf(err, "verifying timestamp of %s", sigPath)
+	}
+	return stamp, nil
+}
+
+// verifyTimestamp checks the RFC3161 timestamp token (or response)
+// `token` countersigning `signed`, against `authorities`.
+func verifyTimestamp(token []byte, signed []byte, authorities *x509.CertPool) (*signatureTimestamp, error) {
+	var ci tsContentInfo
+	if _, err := asn1.Unmarshal(token, &ci); err != nil {
+		var resp tsResponse
+		if _, err := asn1.Unmarshal(token, &resp); err != nil {
+			return nil, errors.Wrap(err, "decoding timestamp token")
+		}
+		if resp.Status.Status > 1 {
+			return nil, errors.Errorf("timestamp request not granted (status %d)", resp.Status.Status)
+		}
+		if _, err := asn1.Unmarshal(resp.Token.FullBytes, &ci); err != nil {
+			return nil, errors.Wrap(err, "decoding timestamp token")
+		}
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, errors.Errorf("unexpected timestamp content type %s", ci.ContentType)
+	}
+	var sd tsSignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, errors.Wrap(err, "decoding timestamp signed data")
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return nil, errors.Errorf("unexpected timestamp encapsulated type %s", sd.EncapContentInfo.EContentType)
+	}
+	var content []byte
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent.Bytes, &content); err != nil {
+		return nil, errors.Wrap(err, "decoding timestamp content")
+	}
+	var info tsInfo
+	if _, err := asn1.Unmarshal(content, &info); err != nil {
+		return nil, errors.Wrap(err, "decoding timestamp info")
+	}
+	hash, ok := timestampDigests[info.MessageImprint.HashAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, errors.Errorf("unsupported timestamp imprint algorithm %s", info.MessageImprint.HashAlgorithm.Algorithm)
+	}
+	h := hash.New()
+	h.Write(signed)
+	if !bytes.Equal(h.Sum(nil), info.MessageImprint.HashedMessage) {
+		return nil, errors.New("timestamp does not countersign the signature")
+	}
+
+	certs, err := timestampCertificates(sd.Certificates)
+	if err != nil {
+		return nil, err
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, errors.Errorf("expected a single timestamp signer, got %d", len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+	cert, err := timestampSigner(si, certs)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTimestampSignature(si, cert, content); err != nil {
+		return nil, err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs {
+		intermediates.AddCert(c)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         authorities,
+		Intermediates: intermediates,
+		CurrentTime:   info.GenTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "untrusted timestamping authority")
+	}
+	return &signatureTimestamp{
+		Time:      info.GenTime,
+		Authority: cert.Subject.String(),
+	}, nil
+}
+
+// timestampCertificates parses the certificates bundled in a token.
+func timestampCertificates(set tsRawSet) ([]*x509.Certificate, error) {
+	if len(set.Raw) == 0 {
+		return nil, nil
+	}
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(set.Raw, &raw); err != nil {
+		return nil, errors.Wrap(err, "decoding timestamp certificates")
+	}
+	certs, err := x509.ParseCertificates(raw.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding timestamp certificates")
+	}
+	return certs, nil
+}
+
+// timestampSigner returns the certificate identified by `si`.
+func timestampSigner(si tsSignerInfo, certs []*x509.Certificate) (*x509.Certificate, error) {
+	if si.SID.Class == asn1.ClassContextSpecific && si.SID.Tag == 0 {
+		for _, c := range certs {
+			if bytes.Equal(c.SubjectKeyId, si.SID.Bytes) {
+				return c, nil
+			}
+		}
+		return nil, errors.New("timestamp signer certificate not found")
+	}
+	var ias tsIssuerAndSerial
+	if _, err := asn1.Unmarshal(si.SID.FullBytes, &ias); err != nil {
+		return nil, errors.Wrap(err, "decoding timestamp signer")
+	}
+	for _, c := range certs {
+		if bytes.Equal(c.RawIssuer, ias.Issuer.FullBytes) && c.SerialNumber.Cmp(ias.Serial) == 0 {
+			return c, nil
+		}
+	}
+	return nil, errors.New("timestamp signer certificate not found")
+}
+
+// checkTimestampSignature checks the signed attributes of `si` bind
+// `content`, and are signed by `cert`.
+func checkTimestampSignature(si tsSignerInfo, cert *x509.Certificate, content []byte) error {
+	hash, ok := timestampDigests[si.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return errors.Errorf("unsupported timestamp digest algorithm %s", si.DigestAlgorithm.Algorithm)
+	}
+	if si.SignedAttrs.Class != asn1.ClassContextSpecific || si.SignedAttrs.Tag != 0 {
+		return errors.New("timestamp signer has no signed attributes")
+	}
+	// Signed attributes are signed with their universal SET tag.
+	attrsDER := append([]byte{}, si.SignedAttrs.FullBytes...)
+	attrsDER[0] = 0x31
+	var attrs []tsAttribute
+	if _, err := asn1.UnmarshalWithParams(attrsDER, &attrs, "set"); err != nil {
+		return errors.Wrap(err, "decoding timestamp signed attributes")
+	}
+	var digest []byte
+	for _, attr := range attrs {
+		if attr.Type.Equal(oidMessageDigest) {
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &digest); err != nil {
+				return errors.Wrap(err, "decoding timestamp message digest")
+			}
+		}
+	}
+	h := hash.New()
+	h.Write(content)
+	if digest == nil || !bytes.Equal(h.Sum(nil), digest) {
+		return errors.New("timestamp message digest mismatch")
+	}
+
+	var algo x509.SignatureAlgorithm
+	switch cert.PublicKeyAlgorithm {
+	case x509.RSA:
+		algo = timestampRSAAlgos[hash]
+	case x509.ECDSA:
+		algo = timestampECAlgos[hash]
+	default:
+		return errors.Errorf("unsupported timestamp signer key %s", cert.PublicKeyAlgorithm)
+	}
+	if err := cert.CheckSignature(algo, attrsDER, si.Signature); err != nil {
+		return errors.Wrap(err, "bad timestamp signature")
+	}
+	return nil
+}
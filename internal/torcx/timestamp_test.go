@@ -0,0 +1,276 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+)
+
+// testAuthority is a timestamping authority issuing RFC3161 tokens.
+type testAuthority struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+func newTestAuthority(t *testing.T) *testAuthority {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "torcx test TSA"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthority{cert, key}
+}
+
+func (tsa *testAuthority) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(tsa.cert)
+	return pool
+}
+
+// stamp returns a timestamp token countersigning `signed` at `genTime`.
+func (tsa *testAuthority) stamp(t *testing.T, signed []byte, genTime time.Time) []byte {
+	mustMarshal := func(v interface{}, params string) []byte {
+		b, err := asn1.MarshalWithParams(v, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	explicit := func(der []byte) asn1.RawValue {
+		return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+	}
+	sha256 := pkix.AlgorithmIdentifier{Algorithm: oidDigestSHA256}
+
+	imprint := crypto.SHA256.New()
+	imprint.Write(signed)
+	info := mustMarshal(tsInfo{
+		Version:        1,
+		Policy:         asn1.ObjectIdentifier{1, 2, 3},
+		MessageImprint: tsMessageImprint{sha256, imprint.Sum(nil)},
+		SerialNumber:   big.NewInt(42),
+		GenTime:        genTime.UTC(),
+	}, "")
+
+	digest := crypto.SHA256.New()
+	digest.Write(info)
+	attrs := []tsAttribute{
+		{oidContentType, asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: mustMarshal(oidTSTInfo, "")}},
+		{oidMessageDigest, asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: mustMarshal(digest.Sum(nil), "")}},
+	}
+	attrsDER := mustMarshal(attrs, "set")
+	attrsHash := crypto.SHA256.New()
+	attrsHash.Write(attrsDER)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, tsa.key, crypto.SHA256, attrsHash.Sum(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attrsRaw asn1.RawValue
+	if _, err := asn1.Unmarshal(attrsDER, &attrsRaw); err != nil {
+		t.Fatal(err)
+	}
+
+	type signerInfo struct {
+		Version            int
+		SID                tsIssuerAndSerial
+		DigestAlgorithm    pkix.AlgorithmIdentifier
+		SignedAttrs        asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Signature          []byte
+	}
+	type encapContentInfo struct {
+		EContentType asn1.ObjectIdentifier
+		EContent     asn1.RawValue
+	}
+	type signedData struct {
+		Version          int
+		DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+		EncapContentInfo encapContentInfo
+		Certificates     asn1.RawValue
+		SignerInfos      []signerInfo `asn1:"set"`
+	}
+	type contentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}
+	sd := mustMarshal(signedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256},
+		EncapContentInfo: encapContentInfo{oidTSTInfo, explicit(mustMarshal(info, ""))},
+		Certificates:     explicit(tsa.cert.Raw),
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                tsIssuerAndSerial{asn1.RawValue{FullBytes: tsa.cert.RawIssuer}, tsa.cert.SerialNumber},
+			DigestAlgorithm:    sha256,
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrsRaw.Bytes},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}},
+			Signature:          sig,
+		}},
+	}, "")
+	return mustMarshal(contentInfo{oidSignedData, explicit(sd)}, "")
+}
+
+func TestVerifyTimestamp(t *testing.T) {
+	tsa := newTestAuthority(t)
+	signed := []byte("signature")
+	genTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	token := tsa.stamp(t, signed, genTime)
+
+	stamp, err := verifyTimestamp(token, signed, tsa.pool())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stamp.Time.Equal(genTime) {
+		t.Errorf("expected time %s, got %s", genTime, stamp.Time)
+	}
+	if stamp.Authority != "CN=torcx test TSA" {
+		t.Errorf("unexpected authority %q", stamp.Authority)
+	}
+
+	resp, err := asn1.Marshal(tsResponse{tsStatusInfo{0}, asn1.RawValue{FullBytes: token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyTimestamp(resp, signed, tsa.pool()); err != nil {
+		t.Errorf("unexpected error for timestamp response: %s", err)
+	}
+	rejected, err := asn1.Marshal(tsResponse{Status: tsStatusInfo{2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyTimestamp(rejected, signed, tsa.pool()); err == nil {
+		t.Error("expected error for rejected timestamp request")
+	}
+
+	if _, err := verifyTimestamp(token, []byte("other"), tsa.pool()); err == nil {
+		t.Error("expected error for token countersigning other data")
+	}
+	if _, err := verifyTimestamp(token, signed, newTestAuthority(t).pool()); err == nil {
+		t.Error("expected error for untrusted authority")
+	}
+	tampered := bytes.Replace(token, []byte("torcx test TSA"), []byte("torcx fake TSA"), 1)
+	if _, err := verifyTimestamp(tampered, signed, tsa.pool()); err == nil {
+		t.Error("expected error for tampered token")
+	}
+}
+
+func TestTimestampedSignature(t *testing.T) {
+	origTime := signatureTime
+	defer func() { signatureTime = origTime }()
+
+	dir, err := ioutil.TempDir("", "torcx_timestamp_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cc := &CommonConfig{
+		ConfDir: filepath.Join(dir, "conf"),
+		UsrDir:  filepath.Join(dir, "usr"),
+	}
+	tsa := newTestAuthority(t)
+	keysDir := filepath.Join(cc.ConfDir, "trusted-keys.d")
+	if err := os.MkdirAll(keysDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tsa.cert.Raw})
+	if err := ioutil.WriteFile(filepath.Join(keysDir, "tsa.pem"), certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	authorities, err := cc.LoadTimestampAuthorities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorities == nil {
+		t.Fatal("expected timestamping authorities")
+	}
+
+	signer := writeTrustedKey(t, filepath.Join(keysDir, "test.asc"))
+	ar := Archive{Filepath: filepath.Join(dir, "foo:1.torcx.tgz")}
+	if err := ioutil.WriteFile(ar.Filepath, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	signTestArchive(t, ar, signer)
+	keyrings := []openpgp.KeyRing{openpgp.EntityList{signer}}
+
+	// The key expires after the signature was made.
+	lifetime := uint32(2 * 3600)
+	for _, ident := range signer.Identities {
+		ident.SelfSignature.KeyLifetimeSecs = &lifetime
+	}
+	signatureTime = func() time.Time { return signer.PrimaryKey.CreationTime.Add(3 * time.Hour) }
+	_, err = VerifyDetachedSignature(ar.Filepath, ar.Filepath+signatureSidecarSuffix, keyrings, authorities)
+	if errors.Cause(err) != ErrKeyExpired {
+		t.Fatalf("expected expired key without timestamp, got %v", err)
+	}
+
+	sig, err := ioutil.ReadFile(ar.Filepath + signatureSidecarSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := tsa.stamp(t, sig, time.Now().Add(time.Minute))
+	if err := ioutil.WriteFile(ar.Filepath+timestampSidecarSuffix, token, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyDetachedSignature(ar.Filepath, ar.Filepath+signatureSidecarSuffix, keyrings, authorities); err != nil {
+		t.Fatalf("unexpected error for timestamped signature: %s", err)
+	}
+	// Without trusted authorities, tokens are ignored.
+	if _, err := VerifyDetachedSignature(ar.Filepath, ar.Filepath+signatureSidecarSuffix, keyrings, nil); err == nil {
+		t.Error("expected error for expired key without authorities")
+	}
+
+	// Timestamps after the key expired do not help.
+	token = tsa.stamp(t, sig, signer.PrimaryKey.CreationTime.Add(150*time.Minute))
+	if err := ioutil.WriteFile(ar.Filepath+timestampSidecarSuffix, token, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = VerifyDetachedSignature(ar.Filepath, ar.Filepath+signatureSidecarSuffix, keyrings, authorities)
+	if errors.Cause(err) != ErrKeyExpired {
+		t.Errorf("expected expired key at timestamp, got %v", err)
+	}
+}
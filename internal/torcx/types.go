@@ -17,6 +17,9 @@ package torcx
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"strings"
+	"time"
 )
 
 const (
@@ -30,6 +33,14 @@ const (
 	SealBindir = "TORCX_BINDIR"
 	// SealUnpackdir is the key label for seal unpackdir
 	SealUnpackdir = "TORCX_UNPACKDIR"
+	// SealImageAliases is the key label for alias references resolved at apply
+	SealImageAliases = "TORCX_IMAGE_ALIASES"
+	// SealOsVersionID is the key label for the OS version the state was sealed on
+	SealOsVersionID = "TORCX_OS_VERSION_ID"
+	// SealPreviousOsVersionID is the key label for the OS version replaced by a reseal
+	SealPreviousOsVersionID = "TORCX_PREVIOUS_OS_VERSION_ID"
+	// SealHotAdded is the key label for images hot-added after the seal
+	SealHotAdded = "TORCX_HOT_ADDED"
 	// ImageManifestV0K - image manifest kind, v0
 	ImageManifestV0K = "image-manifest-v0"
 	// CommonConfigV0K - common torcx config kind, v0
@@ -50,6 +61,56 @@ type CommonConfig struct {
 	UsrDir     string   `json:"usr_dir,omitempty"`
 	ConfDir    string   `json:"conf_dir,omitempty"`
 	StorePaths []string `json:"store_paths,omitempty"`
+	// RequireIMASignatures refuses images with unsigned binaries, when
+	// the host enforces IMA appraisal
+	RequireIMASignatures bool `json:"require_ima_signatures,omitempty"`
+	// RequireSignedImages refuses images not signed by a key in the
+	// machine trust store (implied by kernel lockdown)
+	RequireSignedImages bool `json:"require_signed_images,omitempty"`
+	// BootCriticalTarget is the systemd target gated on boot-critical
+	// images, defaulting to DefaultBootCriticalTarget
+	BootCriticalTarget string `json:"boot_critical_target,omitempty"`
+	// VerifyInterval enables a timer periodically verifying the sealed
+	// state, e.g. "1h"
+	VerifyInterval string `json:"verify_interval,omitempty"`
+	// ErrorReportInterval is the minimum interval between journal entries
+	// for an identical error repeated by periodic runs, e.g. "6h"
+	ErrorReportInterval string `json:"error_report_interval,omitempty"`
+	// FetchPolicy restricts which images may be fetched from remotes
+	FetchPolicy *FetchPolicy `json:"fetch_policy,omitempty"`
+	// RemotePins are the expected digests of the contents manifests of
+	// remotes, by name, see ManifestDigest
+	RemotePins map[string]string `json:"remote_pins,omitempty"`
+	// FetchAudit records archives fetched from remotes, see FetchAudit
+	FetchAudit *FetchAudit `json:"fetch_audit,omitempty"`
+	// Notify POSTs a summary of the applied profile after boot, see Notify
+	Notify *Notify `json:"notify,omitempty"`
+	// StoreEncryption enables encryption at rest of the user store
+	StoreEncryption *StoreEncryption `json:"store_encryption,omitempty"`
+	// UnpackLimits are resource limits applied while unpacking each image
+	UnpackLimits *UnpackLimits `json:"unpack_limits,omitempty"`
+	// HashAlgorithm is the algorithm of the hashes computed by torcx,
+	// defaulting to HashSHA512
+	HashAlgorithm string `json:"hash_algorithm,omitempty"`
+	// HashWorkers is the number of archive chunks hashed concurrently
+	HashWorkers int `json:"hash_workers,omitempty"`
+	// SquashfsVerification is the policy for verifying squashfs archives
+	SquashfsVerification *SquashfsVerification `json:"squashfs_verification,omitempty"`
+	// ApplyBudget bounds the time spent applying optional images
+	ApplyBudget *ApplyBudget `json:"apply_budget,omitempty"`
+	// InstallRecommends is whether images recommended by profiles are
+	// applied (if available), defaulting to true
+	InstallRecommends *bool `json:"install_recommends,omitempty"`
+	// EventStream is where apply events are written as NDJSON, either
+	// a file path or an inherited file descriptor ("fd:N")
+	EventStream string `json:"event_stream,omitempty"`
+	// StoreImages are the store paths backed by filesystem images, whose
+	// entries in StorePaths are replaced by their mountpoints
+	StoreImages []StoreImage `json:"-"`
+	// Mounter performs mount operations, defaulting to DefaultMounter
+	Mounter Mounter `json:"-"`
+	// Transport is used for all remote HTTP requests, if set
+	Transport http.RoundTripper `json:"-"`
 }
 
 // ApplyConfig contains runtime configuration items specific to
@@ -58,6 +119,42 @@ type ApplyConfig struct {
 	CommonConfig
 	LowerProfiles []string
 	UpperProfile  string
+	// ResolvedAliases are filled at apply time, and recorded in the seal
+	ResolvedAliases []ImageAlias
+	// BootCritical are the boot-critical images requested at apply time
+	BootCritical []Image
+	// AppliedImages are filled at apply time, and exported at seal time
+	AppliedImages []AppliedImage
+	// Observer receives apply lifecycle events, if set
+	Observer ApplyObserver
+	// PolicyEvaluators are evaluated along with policy manifests before
+	// apply, e.g. embedding a Rego or CEL engine
+	PolicyEvaluators []PolicyEvaluator
+	// Warnings are non-fatal issues collected at apply time
+	Warnings []Warning
+	// Timings record the resources consumed to unpack each image
+	Timings []ImageTiming
+	// TargetRoot, if set, is the tree system paths are written into by a
+	// simulated apply, performed without mounts nor privileges
+	TargetRoot string
+
+	// deadline and imageTimeout are armed from ApplyBudget at apply time
+	deadline     time.Time
+	imageTimeout time.Duration
+	// staged are the images unpacked by StageProfile, set when committing
+	staged map[string]StagedImage
+	// previewUpper, if set, replaces the upper profile content when merging
+	previewUpper []byte
+}
+
+// UserConfig contains runtime configuration items specific to
+// the user-mode `apply` subcommand
+type UserConfig struct {
+	ApplyConfig
+	// BinDir is where binaries are symlinked (e.g. `~/.local/bin`)
+	BinDir string
+	// UnitsDir is where user units are propagated (e.g. `$XDG_RUNTIME_DIR/systemd/user`)
+	UnitsDir string
 }
 
 // ProfileConfig contains runtime configuration items specific to
@@ -70,7 +167,7 @@ type ProfileConfig struct {
 	NextProfile        string
 }
 
-// Archive represents a .torcx.squashfs or .torcx.tgz on disk
+// Archive represents a .torcx.squashfs, .torcx.erofs, .torcx.tgz, .torcx.zst or .torcx.txz on disk
 type Archive struct {
 	Image
 	Filepath string        `json:"filepath"`
@@ -82,9 +179,37 @@ type Image struct {
 	Name      string `json:"name"`
 	Reference string `json:"reference"`
 	Remote    string `json:"remote"`
+	// BootCritical images gate the boot on their successful application
+	BootCritical bool `json:"boot_critical,omitempty"`
+	// Enable are the space-separated units of the image to enable on apply
+	// (as a string, so that images stay comparable)
+	Enable string `json:"-"`
+	// Conditions restrict the environments the image is applied in
+	Conditions ImageConditions `json:"-"`
+	// Propagation is how assets are propagated, PropagationFull by default
+	Propagation string `json:"-"`
+	// Capability is the capability requested by a profile fragment entry,
+	// the named image (if any) being only applied when no other provides it
+	Capability string `json:"-"`
+	// Provides are the space-separated capabilities declared by the image
+	// manifest, known once the image has been applied or inspected
+	Provides string `json:"-"`
+	// Recommended is set for weak dependencies, listed as `recommends`:
+	// they are only applied if available, see CommonConfig.InstallRecommends
+	Recommended bool `json:"-"`
+}
+
+// EnabledUnits returns the units of the image to enable on apply.
+func (im Image) EnabledUnits() []string {
+	return strings.Fields(im.Enable)
 }
 
-// ArchiveFormat is a torcx archive format, either 'tgz' or 'squashfs'
+// ProvidedCapabilities returns the capabilities provided by the image.
+func (im Image) ProvidedCapabilities() []string {
+	return strings.Fields(im.Provides)
+}
+
+// ArchiveFormat is a torcx archive format, either 'tgz', 'zst', 'txz', 'squashfs' or 'erofs'
 type ArchiveFormat string
 
 const (
@@ -94,8 +219,22 @@ const (
 	ArchiveFormatTgz = "tgz"
 	// ArchiveFormatSquashfs indicates a squashfs image archive
 	ArchiveFormatSquashfs = "squashfs"
+	// ArchiveFormatZst indicates a tar-zstd image
+	ArchiveFormatZst = "zst"
+	// ArchiveFormatTxz indicates a tar-xz image
+	ArchiveFormatTxz = "txz"
+	// ArchiveFormatErofs indicates an EROFS image archive
+	ArchiveFormatErofs = "erofs"
 )
 
+// archiveFormats are the archive formats torcx can apply.
+var archiveFormats = []ArchiveFormat{ArchiveFormatTgz, ArchiveFormatSquashfs, ArchiveFormatZst, ArchiveFormatTxz, ArchiveFormatErofs}
+
+// ArchiveFormats returns the archive formats torcx can apply.
+func ArchiveFormats() []ArchiveFormat {
+	return append([]ArchiveFormat{}, archiveFormats...)
+}
+
 // UnmarshalJSON unmarshals an ArchiveFormat
 func (arf *ArchiveFormat) UnmarshalJSON(b []byte) error {
 	s := ""
@@ -107,8 +246,14 @@ func (arf *ArchiveFormat) UnmarshalJSON(b []byte) error {
 		*arf = ArchiveFormatTgz
 	case ArchiveFormatSquashfs:
 		*arf = ArchiveFormatSquashfs
+	case ArchiveFormatZst:
+		*arf = ArchiveFormatZst
+	case ArchiveFormatTxz:
+		*arf = ArchiveFormatTxz
+	case ArchiveFormatErofs:
+		*arf = ArchiveFormatErofs
 	default:
-		return fmt.Errorf("could not unmarshal into ArchiveFormat: must be one of %q, %q", ArchiveFormatTgz, ArchiveFormatSquashfs)
+		return fmt.Errorf("could not unmarshal into ArchiveFormat: must be one of %q, %q, %q, %q, %q", ArchiveFormatTgz, ArchiveFormatSquashfs, ArchiveFormatZst, ArchiveFormatTxz, ArchiveFormatErofs)
 	}
 	return nil
 }
@@ -134,6 +279,29 @@ func (arf ArchiveFormat) FileSuffix() string {
 	return fmt.Sprintf(".torcx.%s", arf)
 }
 
+// isTarball returns whether archives of this format are compressed
+// tarballs, unpacked (instead of mounted) at apply time.
+func (arf ArchiveFormat) isTarball() bool {
+	return arf == ArchiveFormatTgz || arf == ArchiveFormatZst || arf == ArchiveFormatTxz
+}
+
+// isFilesystemImage returns whether archives of this format are
+// filesystem images, mounted read-only (instead of unpacked) at apply time.
+func (arf ArchiveFormat) isFilesystemImage() bool {
+	return arf == ArchiveFormatSquashfs || arf == ArchiveFormatErofs
+}
+
+// archiveFormatOf returns the format of the archive at `path`, based on
+// its file extension, or ArchiveFormatUnknown.
+func archiveFormatOf(path string) ArchiveFormat {
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(path, format.FileSuffix()) {
+			return format
+		}
+	}
+	return ArchiveFormatUnknown
+}
+
 // ToJSONV0 converts an internal Image into ImageV0.
 func (im Image) ToJSONV0() ImageV0 {
 	return ImageV0{
@@ -154,18 +322,30 @@ func ImageFromJSONV0(j ImageV0) Image {
 // ToJSONV1 converts an internal Image into ImageV1.
 func (im Image) ToJSONV1() ImageV1 {
 	return ImageV1{
-		Name:      im.Name,
-		Reference: im.Reference,
-		Remote:    "",
+		Name:         im.Name,
+		Reference:    im.Reference,
+		Remote:       "",
+		BootCritical: im.BootCritical,
+		Enable:       im.EnabledUnits(),
+		Conditions:   im.Conditions.toJSON(),
+		Propagation:  im.Propagation,
+		Capability:   im.Capability,
 	}
 }
 
 // ImageFromJSONV1 converts an ImageV1 into an internal Image.
 func ImageFromJSONV1(j ImageV1) Image {
 	entry := Image{
-		Name:      j.Name,
-		Reference: j.Reference,
-		Remote:    j.Remote,
+		Name:         j.Name,
+		Reference:    j.Reference,
+		Remote:       j.Remote,
+		BootCritical: j.BootCritical,
+		Enable:       strings.Join(j.Enable, " "),
+		Propagation:  j.Propagation,
+		Capability:   j.Capability,
+	}
+	if j.Conditions != nil {
+		entry.Conditions = *j.Conditions
 	}
 	return entry
 }
@@ -195,6 +375,10 @@ func ImagesToJSONV1(ims []Image) ImagesV1 {
 	j := ImagesV1{}
 	for _, im := range ims {
 		entry := im.ToJSONV1()
+		if im.Recommended {
+			j.Recommends = append(j.Recommends, entry)
+			continue
+		}
 		j.Images = append(j.Images, entry)
 	}
 	return j
@@ -207,6 +391,11 @@ func ImagesFromJSONV1(j ImagesV1) []Image {
 		entry := ImageFromJSONV1(im)
 		result = append(result, entry)
 	}
+	for _, im := range j.Recommends {
+		entry := ImageFromJSONV1(im)
+		entry.Recommended = true
+		result = append(result, entry)
+	}
 	return result
 }
 
@@ -224,17 +413,66 @@ type Assets struct {
 	Sysusers  []string `json:"sysusers,omitempty"`
 	Tmpfiles  []string `json:"tmpfiles,omitempty"`
 	UdevRules []string `json:"udev_rules,omitempty"`
+	// FileContexts are SELinux labels applied to unpacked image paths
+	FileContexts []FileContext `json:"file_contexts,omitempty"`
+	// Checks are health-check executables, run once the system is up
+	Checks []string `json:"checks,omitempty"`
+	// Notes and NotesURL describe the changes in this image version
+	Notes    string `json:"notes,omitempty"`
+	NotesURL string `json:"notes_url,omitempty"`
+	// Provides are the virtual capabilities implemented by this image
+	// (e.g. "container-runtime"), which dependencies can request
+	Provides []string `json:"provides,omitempty"`
+	// StateDirs are directories below /var holding the image state,
+	// removed once the image leaves all profiles
+	StateDirs []string `json:"state_dirs,omitempty"`
+	// Cleanup is a hook executable, run before state directories are removed
+	Cleanup string `json:"cleanup,omitempty"`
+	// TmpfsSize caps the memory used by the unpacked image (e.g. "256M"),
+	// bounded by the configured default
+	TmpfsSize string `json:"tmpfs_size,omitempty"`
+	// HotSafe marks the image as safe to be hot-added to a running system
+	HotSafe bool `json:"hot_safe,omitempty"`
+	// Writable are image directories made writable by an overlay, whose
+	// writable layer is kept below the base directory
+	Writable []WritableOverlay `json:"writable,omitempty"`
 }
 
 type Remote struct {
 	TemplateURL string
 	ArmoredKeys []string
+	// DNSServers overrides system resolvers, as "host:port" entries.
+	DNSServers []string
+	// Hosts statically maps hostnames to IP addresses.
+	Hosts map[string][]string
+	// DiscoveryDomain is the domain where to discover the base URL.
+	DiscoveryDomain string
+	// Peers are base URLs of LAN peers serving verified archives.
+	Peers []string
+	// ArchiveProxy is the URL of a caching proxy for archive downloads.
+	ArchiveProxy string
+	// CredentialHelper is the executable providing credentials for
+	// this remote, see credentialTransport.
+	CredentialHelper string
+	// Credential is the systemd credential holding the credentials for
+	// this remote, taking precedence over CredentialHelper.
+	Credential string
+	// Transport overrides the HTTP transport for this remote, if set.
+	// DNS, hosts and proxy settings are then left to the transport.
+	Transport http.RoundTripper
 }
 
 // RemoteFromJSONV0 translates a RemoteKeyV0 to an internal Remote.
 func RemoteFromJSONV0(j RemoteV0) Remote {
 	res := Remote{
-		TemplateURL: j.BaseURL,
+		TemplateURL:      j.BaseURL,
+		DNSServers:       j.DNSServers,
+		Hosts:            j.Hosts,
+		DiscoveryDomain:  j.DiscoveryDomain,
+		Peers:            j.Peers,
+		ArchiveProxy:     j.ArchiveProxy,
+		CredentialHelper: j.CredentialHelper,
+		Credential:       j.Credential,
 	}
 	for _, key := range j.Keys {
 		res.ArmoredKeys = append(res.ArmoredKeys, key.ArmoredKeyring)
@@ -281,25 +519,40 @@ type RemoteImage struct {
 
 // RemoteVersion describes a remote image archive.
 type RemoteVersion struct {
-	format   string
-	version  string
-	hash     string
-	location string
+	format           string
+	version          string
+	hash             string
+	location         string
+	digestLocation   string
+	notes            string
+	notesURL         string
+	size             int64
+	manifestLocation string
+	fragmentLocation string
 }
 
 // RemoteVersionFromJSONV1 translates a RemoteVersionV1 to an internal RemoteVersion.
 func RemoteVersionFromJSONV1(j RemoteVersionV1) RemoteVersion {
 	remoteVer := RemoteVersion{
-		format:   j.Format,
-		hash:     j.Hash,
-		location: j.Location,
-		version:  j.Version,
+		format:           j.Format,
+		hash:             j.Hash,
+		location:         j.Location,
+		digestLocation:   j.DigestLocation,
+		version:          j.Version,
+		notes:            j.Notes,
+		notesURL:         j.NotesURL,
+		size:             j.Size,
+		manifestLocation: j.ManifestLocation,
+		fragmentLocation: j.FragmentLocation,
 	}
 	return remoteVer
 }
 
 // kindValueJSON holds a generic, typed, kind-value JSON manifest.
+// Manifests may declare the minimum torcx version able to parse them,
+// which is reported if their kind is not supported.
 type kindValueJSON struct {
-	Kind  string          `json:"kind"`
-	Value json.RawMessage `json:"value"`
+	Kind            string          `json:"kind"`
+	MinTorcxVersion string          `json:"min_torcx_version,omitempty"`
+	Value           json.RawMessage `json:"value"`
 }
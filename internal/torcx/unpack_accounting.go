@@ -0,0 +1,272 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// TimingV0K - unpack timing report kind, v0
+	TimingV0K = "torcx-timing-v0"
+	// unpackCgroup is the cgroup (under the unified hierarchy root)
+	// holding the transient per-image unpack cgroups.
+	unpackCgroup = "torcx-unpack"
+)
+
+var (
+	// cgroupRoot is the mountpoint of the unified cgroup hierarchy.
+	cgroupRoot = "/sys/fs/cgroup"
+	// selfCgroupPath is where the cgroup of the current process is read from.
+	selfCgroupPath = "/proc/self/cgroup"
+)
+
+// UnpackLimits are resource limits applied while unpacking each image,
+// so that a single image can not starve early boot.
+type UnpackLimits struct {
+	// IOWeight is the cgroup IO weight (1-10000, default 100).
+	IOWeight uint `json:"io_weight,omitempty"`
+	// MemoryMax is the cgroup memory limit, in bytes or with a K, M or G
+	// suffix (e.g. "256M"). Pages of unpacked tgz images are accounted.
+	MemoryMax string `json:"memory_max,omitempty"`
+	// TmpfsSize is the default size of the tmpfs each tgz image is
+	// unpacked in, also bounding sizes requested by image manifests.
+	TmpfsSize string `json:"tmpfs_size,omitempty"`
+	// TmpfsSizes override the tmpfs size of images, by name.
+	TmpfsSizes map[string]string `json:"tmpfs_sizes,omitempty"`
+}
+
+// ImageTiming records the resources consumed to unpack an image.
+type ImageTiming struct {
+	Name      string        `json:"name"`
+	Reference string        `json:"reference"`
+	Format    ArchiveFormat `json:"format"`
+	// DurationUsec is the wall-clock unpack time.
+	DurationUsec int64 `json:"duration_usec"`
+	// CPUUserUsec and CPUSystemUsec are the CPU time consumed by torcx.
+	CPUUserUsec   int64 `json:"cpu_user_usec"`
+	CPUSystemUsec int64 `json:"cpu_system_usec"`
+	// ReadBytes and WriteBytes are the block IO performed by torcx.
+	ReadBytes  int64 `json:"read_bytes"`
+	WriteBytes int64 `json:"write_bytes"`
+	// Cgroup is the transient cgroup the image was unpacked in, if limited.
+	Cgroup string `json:"cgroup,omitempty"`
+	// TmpfsSize and TmpfsUsedBytes are the size cap and usage of the
+	// tmpfs the image was unpacked in, if capped.
+	TmpfsSize      int64 `json:"tmpfs_size,omitempty"`
+	TmpfsUsedBytes int64 `json:"tmpfs_used_bytes,omitempty"`
+}
+
+// TimingV0JSON is the JSON record of the unpack timing report.
+type TimingV0JSON struct {
+	Kind  string        `json:"kind"`
+	Value []ImageTiming `json:"value"`
+}
+
+// accountUnpack runs `unpack` for `im` under the configured unpack limits,
+// recording its resource consumption in the timing report.
+func (applyCfg *ApplyConfig) accountUnpack(im Image, format ArchiveFormat, unpack func() error) error {
+	timing := ImageTiming{
+		Name:      im.Name,
+		Reference: im.Reference,
+		Format:    format,
+	}
+	leave := func() {}
+	if applyCfg.UnpackLimits.cgroupLimited() {
+		cgroup, leaveFn, err := enterUnpackCgroup(applyCfg.UnpackLimits, imagePathName(im.Name))
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"image": im.Name,
+				"error": err,
+			}).Warn("unable to apply unpack limits")
+		} else {
+			timing.Cgroup = cgroup
+			leave = leaveFn
+		}
+	}
+
+	var before, after unix.Rusage
+	_ = unix.Getrusage(unix.RUSAGE_SELF, &before)
+	start := time.Now()
+	err := unpack()
+	timing.DurationUsec = time.Since(start).Microseconds()
+	_ = unix.Getrusage(unix.RUSAGE_SELF, &after)
+	leave()
+
+	timing.CPUUserUsec = tvUsec(after.Utime) - tvUsec(before.Utime)
+	timing.CPUSystemUsec = tvUsec(after.Stime) - tvUsec(before.Stime)
+	// Block IO is accounted in 512-byte units.
+	timing.ReadBytes = (after.Inblock - before.Inblock) * 512
+	timing.WriteBytes = (after.Oublock - before.Oublock) * 512
+	applyCfg.Timings = append(applyCfg.Timings, timing)
+	return err
+}
+
+// cgroupLimited returns whether unpacks run in a transient cgroup.
+func (limits *UnpackLimits) cgroupLimited() bool {
+	return limits != nil && (limits.IOWeight > 0 || limits.MemoryMax != "")
+}
+
+// tvUsec converts a timeval to microseconds.
+func tvUsec(tv unix.Timeval) int64 {
+	return int64(tv.Sec)*1e6 + int64(tv.Usec)
+}
+
+// enterUnpackCgroup moves the current process to a transient cgroup with
+// the given limits, returning its path and a function moving the process
+// back and removing the cgroup. Only the unified hierarchy is supported.
+func enterUnpackCgroup(limits *UnpackLimits, name string) (string, func(), error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", nil, errors.New("unified cgroup hierarchy not available")
+	}
+	orig, err := readSelfCgroup()
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Controllers must be delegated down to the per-image cgroup.
+	parent := filepath.Join(cgroupRoot, unpackCgroup)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", nil, err
+	}
+	for _, dir := range []string{cgroupRoot, parent} {
+		for _, controller := range []string{"+io", "+memory"} {
+			_ = ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(controller), 0644)
+		}
+	}
+	dir := filepath.Join(parent, name)
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return "", nil, err
+	}
+	settings := map[string]string{}
+	if limits.IOWeight > 0 {
+		settings["io.weight"] = fmt.Sprintf("default %d", limits.IOWeight)
+	}
+	if limits.MemoryMax != "" {
+		max, err := parseMemorySize(limits.MemoryMax)
+		if err != nil {
+			os.Remove(dir)
+			return "", nil, err
+		}
+		settings["memory.max"] = strconv.FormatInt(max, 10)
+	}
+	for file, value := range settings {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+			os.Remove(dir)
+			return "", nil, errors.Wrapf(err, "setting %s", file)
+		}
+	}
+
+	pid := []byte(strconv.Itoa(os.Getpid()))
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), pid, 0644); err != nil {
+		os.Remove(dir)
+		return "", nil, errors.Wrap(err, "entering unpack cgroup")
+	}
+	leave := func() {
+		if err := ioutil.WriteFile(filepath.Join(cgroupRoot, orig, "cgroup.procs"), pid, 0644); err != nil {
+			logrus.WithField("error", err).Warn("unable to leave unpack cgroup")
+			return
+		}
+		os.Remove(dir)
+	}
+	return strings.TrimPrefix(dir, cgroupRoot), leave, nil
+}
+
+// readSelfCgroup returns the unified hierarchy cgroup of the current process.
+func readSelfCgroup() (string, error) {
+	fp, err := os.Open(selfCgroupPath)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	sc := bufio.NewScanner(fp)
+	for sc.Scan() {
+		if strings.HasPrefix(sc.Text(), "0::") {
+			return strings.TrimPrefix(sc.Text(), "0::"), nil
+		}
+	}
+	return "", errors.Errorf("no unified cgroup in %s", selfCgroupPath)
+}
+
+// parseMemorySize parses a size in bytes, with an optional K, M or G suffix.
+func parseMemorySize(s string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.Errorf("invalid memory size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// saveTimings writes the unpack timing report, on a best-effort basis.
+func (applyCfg *ApplyConfig) saveTimings() {
+	path := applyCfg.RunTiming()
+	timings := applyCfg.Timings
+	if timings == nil {
+		timings = []ImageTiming{}
+	}
+	b, err := json.MarshalIndent(TimingV0JSON{TimingV0K, timings}, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(path+".tmp", append(b, '\n'), 0644)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"path":  path,
+			"error": err,
+		}).Warn("unable to write timing report")
+	}
+}
+
+// ReadTimings reads the unpack timing report at `path`.
+func ReadTimings(path string) ([]ImageTiming, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var record TimingV0JSON
+	if err := json.Unmarshal(b, &record); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s", path)
+	}
+	if record.Kind != TimingV0K {
+		return nil, errors.Errorf("invalid timing kind: %s", record.Kind)
+	}
+	return record.Value, nil
+}
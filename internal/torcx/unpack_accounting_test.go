@@ -0,0 +1,103 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParseMemorySize(t *testing.T) {
+	valid := map[string]int64{
+		"4096": 4096,
+		"64K":  64 << 10,
+		"256M": 256 << 20,
+		"1G":   1 << 30,
+	}
+	for s, expected := range valid {
+		if n, err := parseMemorySize(s); err != nil || n != expected {
+			t.Errorf("%s: expected %d, got %d (%v)", s, expected, n, err)
+		}
+	}
+	for _, s := range []string{"", "M", "-1", "1T"} {
+		if _, err := parseMemorySize(s); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestAccountUnpack(t *testing.T) {
+	origRoot, origSelf := cgroupRoot, selfCgroupPath
+	defer func() { cgroupRoot, selfCgroupPath = origRoot, origSelf }()
+	cgroupRoot = t.TempDir()
+	selfCgroupPath = filepath.Join(t.TempDir(), "cgroup")
+	if err := ioutil.WriteFile(selfCgroupPath, []byte("0::/init.scope\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"cgroup.controllers", "init.scope/cgroup.procs"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(cgroupRoot, f)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(cgroupRoot, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runDir := t.TempDir()
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			RunDir:       runDir,
+			UnpackLimits: &UnpackLimits{IOWeight: 50, MemoryMax: "256M"},
+		},
+	}
+	im := Image{Name: "foo", Reference: "1"}
+	var weight, max []byte
+	err := applyCfg.accountUnpack(im, ArchiveFormatTgz, func() error {
+		dir := filepath.Join(cgroupRoot, unpackCgroup, "foo")
+		weight, _ = ioutil.ReadFile(filepath.Join(dir, "io.weight"))
+		max, _ = ioutil.ReadFile(filepath.Join(dir, "memory.max"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(weight) != "default 50" || string(max) != strconv.Itoa(256<<20) {
+		t.Errorf("unexpected limits %q, %q", weight, max)
+	}
+	procs, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "init.scope", "cgroup.procs"))
+	if err != nil || string(procs) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("process not moved back to its cgroup: %q (%v)", procs, err)
+	}
+
+	if len(applyCfg.Timings) != 1 {
+		t.Fatalf("expected one timing, got %v", applyCfg.Timings)
+	}
+	timing := applyCfg.Timings[0]
+	if timing.Name != "foo" || timing.Cgroup != "/torcx-unpack/foo" {
+		t.Errorf("unexpected timing %+v", timing)
+	}
+
+	applyCfg.saveTimings()
+	timings, err := ReadTimings(applyCfg.RunTiming())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timings) != 1 || timings[0] != timing {
+		t.Errorf("unexpected timing report %v", timings)
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// unpackIndexSuffix is appended to the hidden index file recording
+	// the entries of an unpacked tgz image, next to its top directory.
+	unpackIndexSuffix = ".index"
+	// unpackPrevSuffix is appended to the hidden directory the previous
+	// unpack of an image is moved to while unpacking a new one.
+	unpackPrevSuffix = ".prev"
+)
+
+// errUnpackMismatch aborts an incremental unpack, when an entry matching
+// the previous unpack by header differs in content.
+var errUnpackMismatch = errors.New("entry changed without header change")
+
+// unpackIndexEntry records a regular file of an unpacked image.
+type unpackIndexEntry struct {
+	// Header fingerprints the tar header of the entry.
+	Header string `json:"header"`
+	// Size is the size of the entry content.
+	Size int64 `json:"size"`
+	// Digest is the SHA-256 digest of the entry content.
+	Digest string `json:"digest"`
+}
+
+// unpackIndex records the regular files of an unpacked image, by path.
+type unpackIndex map[string]unpackIndexEntry
+
+// deferredLink is a hardlink created once changed entries are extracted.
+type deferredLink struct {
+	// Path is the entry path in the image.
+	Path string
+	// Target is the entry path linked to, in the previous unpack if
+	// Reused or else in the new one.
+	Target string
+	Reused bool
+}
+
+// unpackSidePath returns the hidden path next to `topDir` with `suffix`.
+func unpackSidePath(topDir, suffix string) string {
+	dir, name := filepath.Split(filepath.Clean(topDir))
+	return filepath.Join(dir, "."+name+suffix)
+}
+
+// readUnpackIndex reads the index of the image unpacked at `topDir`,
+// returning nil if there is none.
+func readUnpackIndex(topDir string) unpackIndex {
+	b, err := ioutil.ReadFile(unpackSidePath(topDir, unpackIndexSuffix))
+	if err != nil {
+		return nil
+	}
+	index := unpackIndex{}
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil
+	}
+	return index
+}
+
+// headerFingerprint summarizes the metadata of a tar entry, so that
+// entries with the same fingerprint are unchanged when their content is.
+func headerFingerprint(hdr *tar.Header) string {
+	records := []string{}
+	for k, v := range hdr.PAXRecords {
+		records = append(records, k+"="+v)
+	}
+	sort.Strings(records)
+	return fmt.Sprintf("%c:%d:%o:%d:%d:%d:%s", hdr.Typeflag, hdr.Size, hdr.Mode, hdr.Uid, hdr.Gid,
+		hdr.ModTime.UnixNano(), strings.Join(records, ","))
+}
+
+// extractTgz extracts the tarball (tgz, zst or txz) at `tgzPath` into `topDir` with
+// `extract`. If the same image was previously unpacked at `topDir`, only
+// changed entries are extracted, unchanged regular files being hardlinked
+// from the previous tree instead. Unpacking is aborted, and the partial
+// tree removed, once `deadline` (if set) has passed.
+func extractTgz(tgzPath, topDir string, deadline time.Time, extract func(*tar.Reader) error) error {
+	prevDir := ""
+	prev := readUnpackIndex(topDir)
+	if prev != nil {
+		prevDir = unpackSidePath(topDir, unpackPrevSuffix)
+		_ = os.RemoveAll(prevDir)
+		if err := os.Rename(topDir, prevDir); err != nil {
+			prev, prevDir = nil, ""
+		} else {
+			defer os.RemoveAll(prevDir)
+		}
+	}
+	err := extractTgzFrom(tgzPath, topDir, deadline, prev, prevDir, extract)
+	if prev != nil && errors.Cause(err) == errUnpackMismatch {
+		logrus.WithField("path", tgzPath).Debug("previous unpack not reusable: ", err)
+		_ = os.RemoveAll(topDir)
+		err = extractTgzFrom(tgzPath, topDir, deadline, nil, "", extract)
+	}
+	return err
+}
+
+// extractTgzFrom extracts `tgzPath` into `topDir`, hardlinking files
+// unchanged since `prev` from `prevDir`, then records its index.
+func extractTgzFrom(tgzPath, topDir string, deadline time.Time, prev unpackIndex, prevDir string, extract func(*tar.Reader) error) error {
+	indexPath := unpackSidePath(topDir, unpackIndexSuffix)
+	if err := os.Remove(indexPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(topDir, 0755); err != nil {
+		return err
+	}
+
+	fp, err := os.Open(tgzPath)
+	if err != nil {
+		return errors.Wrapf(err, "opening %q", tgzPath)
+	}
+	defer fp.Close()
+
+	r := newDeadlineReader(fp, deadline)
+	dr, err := decompressTarball(tgzPath, r)
+	if err != nil {
+		return unpackError(r, topDir, tgzPath, err)
+	}
+	defer dr.Close()
+
+	// Changed entries are streamed to the extractor, the others are
+	// linked once it is done.
+	index := unpackIndex{}
+	links := []deferredLink{}
+	pr, pw := io.Pipe()
+	filtered := make(chan error, 1)
+	go func() {
+		err := filterTar(tar.NewReader(dr), tar.NewWriter(pw), prev, index, &links)
+		pw.CloseWithError(err)
+		filtered <- err
+	}()
+	err = extract(tar.NewReader(pr))
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, pr)
+	}
+	pr.CloseWithError(err)
+	if ferr := <-filtered; ferr != nil && ferr != io.ErrClosedPipe {
+		err = ferr
+	}
+	if err != nil {
+		if errors.Cause(err) == errUnpackMismatch {
+			return err
+		}
+		return unpackError(r, topDir, tgzPath, err)
+	}
+
+	// Links are only created now, as the extractor may have chrooted.
+	reused := 0
+	for _, link := range links {
+		source := filepath.Join(topDir, link.Target)
+		if link.Reused {
+			source = filepath.Join(prevDir, link.Target)
+			if !isRegularFile(source, prev[link.Target].Size) {
+				return errors.Wrap(errUnpackMismatch, link.Path)
+			}
+			reused++
+		}
+		target := filepath.Join(topDir, link.Path)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Link(source, target); err != nil {
+			if link.Reused {
+				return errors.Wrap(errUnpackMismatch, err.Error())
+			}
+			return errors.Wrapf(err, "unpacking %q", tgzPath)
+		}
+	}
+	if reused > 0 {
+		logrus.WithFields(logrus.Fields{
+			"path":      tgzPath,
+			"reused":    reused,
+			"extracted": len(index) - reused,
+		}).Debug("previous unpack reused")
+	}
+
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(indexPath, b, 0644)
+}
+
+// filterTar copies the entries of `tr` to `tw`, except for regular files
+// unchanged since `prev` (by header and digest), which are deferred to
+// `links`. As those are only created after extraction, hardlink entries
+// are deferred as well when reusing a previous unpack. All regular files
+// are indexed.
+func filterTar(tr *tar.Reader, tw *tar.Writer, prev unpackIndex, index unpackIndex, links *[]deferredLink) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+		path := filepath.Clean("/" + hdr.Name)
+		if hdr.Typeflag == tar.TypeLink && prev != nil {
+			*links = append(*links, deferredLink{Path: path, Target: filepath.Clean("/" + hdr.Linkname)})
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+			continue
+		}
+
+		entry := unpackIndexEntry{Header: headerFingerprint(hdr), Size: hdr.Size}
+		digest := sha256.New()
+		if old, ok := prev[path]; ok && old.Header == entry.Header {
+			if _, err := io.Copy(digest, tr); err != nil {
+				return err
+			}
+			entry.Digest = digestString(digest)
+			if entry.Digest != old.Digest {
+				return errors.Wrap(errUnpackMismatch, path)
+			}
+			index[path] = entry
+			*links = append(*links, deferredLink{Path: path, Target: path, Reused: true})
+			continue
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, io.TeeReader(tr, digest)); err != nil {
+			return err
+		}
+		entry.Digest = digestString(digest)
+		index[path] = entry
+	}
+}
+
+// isRegularFile returns whether `path` is a regular file of `size` bytes.
+func isRegularFile(path string, size int64) bool {
+	fi, err := os.Lstat(path)
+	return err == nil && fi.Mode().IsRegular() && fi.Size() == size
+}
+
+// digestString returns the hex encoding of the sum of `h`.
+func digestString(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIncrementalUnpack(t *testing.T) {
+	dir := t.TempDir()
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			BaseDir: filepath.Join(dir, "base"),
+			RunDir:  filepath.Join(dir, "run"),
+		},
+	}
+	v1 := filepath.Join(dir, "foo:1.torcx.tgz")
+	writeTestTgz(t, v1, map[string]string{
+		"bin/foo":    "foo",
+		"lib/libfoo": "libfoo-1",
+		"lib/old":    "old",
+	})
+	v2 := filepath.Join(dir, "foo:2.torcx.tgz")
+	writeTestTgz(t, v2, map[string]string{
+		"bin/foo":    "foo",
+		"lib/libfoo": "libfoo-22",
+	})
+
+	root, err := unpackTgzUser(applyCfg, v1, "foo", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(filepath.Join(root, "bin", "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err = unpackTgzUser(applyCfg, v2, "foo", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(filepath.Join(root, "bin", "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("unchanged file not reused from the previous unpack")
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "lib", "libfoo")); err != nil || string(b) != "libfoo-22" {
+		t.Errorf("changed file not extracted: %q, %v", b, err)
+	}
+	if IsExistingPath(filepath.Join(root, "lib", "old")) {
+		t.Error("file removed from the archive still present")
+	}
+	if IsExistingPath(unpackSidePath(root, unpackPrevSuffix)) {
+		t.Error("previous unpack not cleaned up")
+	}
+
+	// Same headers but different content: the previous unpack is not reused.
+	v3 := filepath.Join(dir, "foo:3.torcx.tgz")
+	writeTestTgz(t, v3, map[string]string{
+		"bin/foo":    "bar",
+		"lib/libfoo": "libfoo-22",
+	})
+	root, err = unpackTgzUser(applyCfg, v3, "foo", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "bin", "foo")); err != nil || string(b) != "bar" {
+		t.Errorf("changed file not extracted: %q, %v", b, err)
+	}
+	if index := readUnpackIndex(root); len(index) != 2 {
+		t.Errorf("unexpected unpack index %+v", index)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// imageTmpfsSize returns the size (in bytes) of the tmpfs instance `im`
+// is unpacked in, or 0 if it shares the unpack directory tmpfs. Per-image
+// overrides in the configuration come first; otherwise the size requested
+// by the image manifest (as recorded in the archive metadata sidecar) is
+// used, bounded by the configured default size.
+func imageTmpfsSize(applyCfg *ApplyConfig, im Image, archive Archive) (int64, error) {
+	var size int64
+	if limits := applyCfg.UnpackLimits; limits != nil {
+		if override, ok := limits.TmpfsSizes[im.Name]; ok {
+			return parseMemorySize(override)
+		}
+		if limits.TmpfsSize != "" {
+			var err error
+			if size, err = parseMemorySize(limits.TmpfsSize); err != nil {
+				return 0, errors.Wrap(err, "invalid default tmpfs size")
+			}
+		}
+	}
+
+	meta, err := ReadArchiveMeta(archive.Filepath)
+	if err != nil || meta.Manifest == nil || meta.Manifest.TmpfsSize == "" {
+		return size, nil
+	}
+	requested, err := parseMemorySize(meta.Manifest.TmpfsSize)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"image": im.Name,
+			"error": err,
+		}).Warn("ignoring tmpfs size requested by manifest")
+		return size, nil
+	}
+	if size == 0 || requested < size {
+		size = requested
+	}
+	return size, nil
+}
+
+// mountImageTmpfs mounts a fresh tmpfs instance of `size` bytes on
+// `topDir`, so that the image unpacked there can not exhaust the memory
+// reserved for other images. A previous unpack is discarded, as it can
+// not be reused across tmpfs instances.
+func mountImageTmpfs(applyCfg *ApplyConfig, topDir string, size int64) error {
+	unmountImageTmpfs(applyCfg, topDir)
+	if err := os.RemoveAll(topDir); err != nil {
+		return err
+	}
+	if err := os.Remove(unpackSidePath(topDir, unpackIndexSuffix)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(topDir, 0755); err != nil {
+		return err
+	}
+	opts := fmt.Sprintf("size=%d,mode=0755", size)
+	if err := applyCfg.mounter().Mount("none", topDir, "tmpfs", 0, opts); err != nil {
+		return errors.Wrapf(err, "failed to mount tmpfs on %s", topDir)
+	}
+	return nil
+}
+
+// unmountImageTmpfs unmounts the tmpfs instance of the image unpacked at
+// `topDir`, if any.
+func unmountImageTmpfs(applyCfg *ApplyConfig, topDir string) {
+	mounts, err := readMountInfo(mountInfoPath)
+	if err != nil {
+		return
+	}
+	if entry, ok := mounts[filepath.Clean(topDir)]; !ok || entry.fstype != "tmpfs" {
+		return
+	}
+	if err := applyCfg.mounter().Unmount(topDir, unix.MNT_DETACH); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"path":  topDir,
+			"error": err,
+		}).Warn("failed to unmount image tmpfs")
+	}
+}
+
+// tmpfsUsage returns the bytes used and available in the filesystem at `path`.
+func tmpfsUsage(path string) (int64, int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	bsize := int64(st.Bsize)
+	return int64(st.Blocks-st.Bfree) * bsize, int64(st.Bavail) * bsize, nil
+}
+
+// unpackTgzCapped unpacks a tgz image in its own tmpfs instance of
+// `size` bytes, telling apart images exceeding their size cap.
+func unpackTgzCapped(applyCfg *ApplyConfig, tgzPath, imageName string, size int64, deadline time.Time) (string, error) {
+	topDir := filepath.Join(applyCfg.RunUnpackDir(), imageName)
+	if err := mountImageTmpfs(applyCfg, topDir, size); err != nil {
+		return "", err
+	}
+	imageRoot, err := unpackTgz(applyCfg, tgzPath, imageName, deadline)
+	if err != nil {
+		if _, avail, serr := tmpfsUsage(topDir); serr == nil && avail == 0 && errors.Cause(err) != ErrBudgetExceeded {
+			err = errors.Errorf("image exceeds its tmpfs size cap of %d bytes: %s", size, err)
+		}
+		unmountImageTmpfs(applyCfg, topDir)
+		return "", err
+	}
+	return imageRoot, nil
+}
+
+// recordTmpfsUsage records the size cap and usage of the tmpfs instance
+// of `im` in its unpack timing.
+func (applyCfg *ApplyConfig) recordTmpfsUsage(im Image, imageRoot string, size int64) {
+	used, _, err := tmpfsUsage(imageRoot)
+	if err != nil {
+		return
+	}
+	for i := len(applyCfg.Timings) - 1; i >= 0; i-- {
+		if applyCfg.Timings[i].Name == im.Name {
+			applyCfg.Timings[i].TmpfsSize = size
+			applyCfg.Timings[i].TmpfsUsedBytes = used
+			return
+		}
+	}
+}
+
+// remountImageTmpfs remounts read-only the tmpfs instances of applied
+// images, which are not covered by remounting the unpack directory.
+func remountImageTmpfs(applyCfg *ApplyConfig) error {
+	mounts, err := readMountInfo(mountInfoPath)
+	if err != nil {
+		return nil
+	}
+	for _, applied := range applyCfg.AppliedImages {
+		root := filepath.Clean(applied.Root)
+		if filepath.Dir(root) != filepath.Clean(applyCfg.RunUnpackDir()) {
+			continue
+		}
+		if entry, ok := mounts[root]; !ok || entry.fstype != "tmpfs" {
+			continue
+		}
+		if err := applyCfg.mounter().Mount(root, root, "", unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+			return errors.Wrapf(err, "failed to remount %s read-only", root)
+		}
+	}
+	return nil
+}
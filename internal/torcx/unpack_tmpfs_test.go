@@ -0,0 +1,93 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestImageTmpfsSize(t *testing.T) {
+	dir := t.TempDir()
+	archive := Archive{Filepath: filepath.Join(dir, "foo:1.torcx.tgz"), Format: ArchiveFormatTgz}
+	im := Image{Name: "foo", Reference: "1"}
+	applyCfg := &ApplyConfig{}
+
+	// Without a configured or requested size, the image is not capped.
+	if size, err := imageTmpfsSize(applyCfg, im, archive); err != nil || size != 0 {
+		t.Errorf("expected no cap, got %d (%v)", size, err)
+	}
+
+	applyCfg.UnpackLimits = &UnpackLimits{TmpfsSize: "128M"}
+	if size, err := imageTmpfsSize(applyCfg, im, archive); err != nil || size != 128<<20 {
+		t.Errorf("expected default cap, got %d (%v)", size, err)
+	}
+
+	// Manifests can lower the cap, but not raise it.
+	for requested, expected := range map[string]int64{"64M": 64 << 20, "1G": 128 << 20} {
+		meta := &ArchiveMeta{Hash: "sha512-00", Manifest: &Assets{TmpfsSize: requested}}
+		if err := WriteArchiveMeta(archive.Filepath, meta); err != nil {
+			t.Fatal(err)
+		}
+		if size, err := imageTmpfsSize(applyCfg, im, archive); err != nil || size != expected {
+			t.Errorf("%s: expected %d, got %d (%v)", requested, expected, size, err)
+		}
+	}
+
+	applyCfg.UnpackLimits.TmpfsSizes = map[string]string{"foo": "1G"}
+	if size, err := imageTmpfsSize(applyCfg, im, archive); err != nil || size != 1<<30 {
+		t.Errorf("expected override, got %d (%v)", size, err)
+	}
+	applyCfg.UnpackLimits.TmpfsSizes["foo"] = "lots"
+	if _, err := imageTmpfsSize(applyCfg, im, archive); err == nil {
+		t.Error("expected error for invalid override")
+	}
+}
+
+func TestRemountImageTmpfs(t *testing.T) {
+	dir := t.TempDir()
+	mounter := &fakeMounter{}
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			RunDir:  filepath.Join(dir, "run"),
+			Mounter: mounter,
+		},
+	}
+	foo := filepath.Join(applyCfg.RunUnpackDir(), "foo")
+	bar := filepath.Join(applyCfg.RunUnpackDir(), "bar")
+	applyCfg.AppliedImages = []AppliedImage{
+		{Image: Image{Name: "foo", Reference: "1"}, Root: foo},
+		{Image: Image{Name: "bar", Reference: "2"}, Root: bar},
+	}
+
+	origMountInfoPath := mountInfoPath
+	defer func() { mountInfoPath = origMountInfoPath }()
+	mountInfoPath = filepath.Join(dir, "mountinfo")
+	mountInfo := "36 35 0:32 / " + applyCfg.RunUnpackDir() + " rw,relatime shared:12 - tmpfs none rw\n" +
+		"37 36 0:33 / " + foo + " rw,relatime shared:13 - tmpfs none rw,size=65536k\n" +
+		"38 36 7:0 / " + bar + " ro master:3 - squashfs /dev/loop0 ro\n"
+	if err := ioutil.WriteFile(mountInfoPath, []byte(mountInfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := remountImageTmpfs(applyCfg); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{":" + foo}; !reflect.DeepEqual(mounter.mounts, expected) {
+		t.Errorf("expected %v remounted, got %v", expected, mounter.mounts)
+	}
+}
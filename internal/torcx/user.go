@@ -0,0 +1,176 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	pkgtar "github.com/flatcar-linux/torcx/pkg/tar"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ApplyUserProfile applies the configured profile for an unprivileged user.
+// Differently from ApplyProfile, no mounts are performed: images are
+// unpacked into the user runtime directory, binaries are symlinked into
+// BinDir and systemd units are propagated as user units into UnitsDir.
+// System-wide assets (networkd units, sysusers, tmpfiles, udev rules)
+// are skipped.
+func ApplyUserProfile(userCfg *UserConfig) error {
+	if userCfg == nil {
+		return errors.New("missing user configuration")
+	}
+	applyCfg := &userCfg.ApplyConfig
+
+	paths := []string{
+		applyCfg.RunDir,
+		applyCfg.RunUnpackDir(),
+		applyCfg.UserProfileDir(),
+		userCfg.BinDir,
+		userCfg.UnitsDir,
+	}
+	for _, d := range paths {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return errors.Wrap(err, "user profile setup")
+		}
+	}
+
+	images, err := mergeProfiles(applyCfg)
+	if err != nil {
+		return err
+	}
+
+	storeCache, err := NewStoreCache(applyCfg.StorePaths)
+	if err != nil {
+		return err
+	}
+
+	images, err = resolveImages(images, func(im Image) (Image, []Image, error) {
+		resolved, err := resolveImageVersion(&storeCache, im)
+		if err != nil {
+			return im, nil, err
+		}
+		imageRoot, provides, err := applyUserImage(userCfg, &storeCache, resolved)
+		if err != nil {
+			return resolved, nil, err
+		}
+		resolved.Provides = strings.Join(provides, " ")
+		fragment, err := readImageFragment(imageRoot)
+		return resolved, applyCfg.FilterRecommends(fragment), err
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeRunProfile(applyCfg.RunProfile(), images)
+}
+
+// applyUserImage unpacks and propagates assets from a single image in user mode,
+// returning the path where it has been unpacked and the capabilities it provides.
+func applyUserImage(userCfg *UserConfig, storeCache *StoreCache, im Image) (string, []string, error) {
+	applyCfg := &userCfg.ApplyConfig
+	logFields := logrus.Fields{
+		"image":     im.Name,
+		"reference": im.Reference,
+	}
+
+	archive, err := storeCache.ArchiveFor(im)
+	if err != nil {
+		logrus.WithFields(logFields).Error(err)
+		return "", nil, err
+	}
+	if !archive.Format.isTarball() {
+		err := fmt.Errorf("unsupported format %q in user mode", archive.Format)
+		logrus.WithFields(logFields).Error(err)
+		return "", nil, err
+	}
+
+	imageRoot, err := unpackTgzUser(applyCfg, archive.Filepath, im.Name, time.Time{})
+	if err != nil {
+		logrus.WithFields(logFields).Error("failed to unpack: ", err)
+		return "", nil, err
+	}
+	logFields["path"] = imageRoot
+
+	assets, err := retrieveAssets(applyCfg, imageRoot)
+	if err != nil {
+		logrus.WithFields(logFields).Error("failed retrieving assets from image: ", err)
+		return "", nil, err
+	}
+	if assets, err = propagatedAssets(im, assets); err != nil {
+		logrus.WithFields(logFields).Error("refusing image: ", err)
+		return "", nil, err
+	}
+
+	if err := propagateUserAssets(userCfg, imageRoot, assets); err != nil {
+		logrus.WithFields(logFields).Error("failed to propagate assets: ", err)
+		return "", nil, err
+	}
+	logrus.WithFields(logFields).Debug("image applied in user mode")
+	return imageRoot, assets.Provides, nil
+}
+
+// propagateUserAssets propagates binaries and user units from an unpacked image.
+func propagateUserAssets(userCfg *UserConfig, imageRoot string, assets *Assets) error {
+	applyCfg := &userCfg.ApplyConfig
+
+	for _, binEntry := range assets.Binaries {
+		if binEntry == "" {
+			continue
+		}
+		path := filepath.Join(imageRoot, binEntry)
+		if err := symlinkBinAsset(applyCfg, userCfg.BinDir, path); err != nil {
+			return err
+		}
+	}
+	if err := propagateUnits(applyCfg, imageRoot, assets.Units, userCfg.UnitsDir); err != nil {
+		return err
+	}
+
+	skipped := len(assets.Network) + len(assets.Sysusers) + len(assets.Tmpfiles) + len(assets.UdevRules) + len(assets.FileContexts)
+	if skipped > 0 {
+		logrus.WithFields(logrus.Fields{
+			"path":    imageRoot,
+			"skipped": skipped,
+		}).Warn("system-wide assets are not propagated in user mode")
+	}
+	return nil
+}
+
+// unpackTgzUser renders a tarball (tgz, zst or txz) rootfs without privileges, returning the target top directory.
+// Files unchanged since a previous unpack of the image are reused.
+// Unpacking is aborted, and the partial tree removed, once `deadline` (if set) has passed.
+func unpackTgzUser(applyCfg *ApplyConfig, tgzPath, imageName string, deadline time.Time) (string, error) {
+	if tgzPath == "" || imageName == "" {
+		return "", errors.New("missing unpack source")
+	}
+
+	topDir := filepath.Join(applyCfg.RunUnpackDir(), imageName)
+	untarCfg := pkgtar.ExtractCfg{}.Default()
+	untarCfg.Chown = false
+	err := extractTgz(tgzPath, topDir, deadline, func(tr *tar.Reader) error {
+		return pkgtar.ExtractDir(tr, topDir, untarCfg)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return topDir, nil
+}
@@ -0,0 +1,216 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// LatestRef is the image reference resolving to the highest stored version.
+const LatestRef = "latest"
+
+// semverRegexp matches semantic versions, with optional leading "v" and
+// optional minor/patch components.
+var semverRegexp = regexp.MustCompile(`^[vV]?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// IsVersionQuery returns whether `ref` is resolved to a concrete version
+// at apply time, i.e. it is `latest` or a glob pattern (with `*`, `?` or
+// `[...]`, which are not valid in concrete references).
+func IsVersionQuery(ref string) bool {
+	return ref == LatestRef || strings.ContainsAny(ref, "*?[")
+}
+
+// CompareVersions orders two image references, returning -1, 0 or +1.
+// If both are semantic versions, they are compared as such: numeric
+// components first (missing ones count as 0), then pre-releases sort
+// before releases, build metadata is ignored. Otherwise, references are
+// compared component-wise, with digit runs compared numerically and
+// other runs lexically. Ties are broken lexically on the full reference,
+// so that the ordering is total.
+func CompareVersions(a, b string) int {
+	if a == b {
+		return 0
+	}
+	ma, mb := semverRegexp.FindStringSubmatch(a), semverRegexp.FindStringSubmatch(b)
+	res := 0
+	if ma != nil && mb != nil {
+		res = compareSemver(ma, mb)
+	} else {
+		res = compareNatural(a, b)
+	}
+	if res != 0 {
+		return res
+	}
+	return strings.Compare(a, b)
+}
+
+// compareSemver compares two semverRegexp submatches.
+func compareSemver(a, b []string) int {
+	for i := 1; i <= 3; i++ {
+		if res := compareNumeric(a[i], b[i]); res != 0 {
+			return res
+		}
+	}
+	preA, preB := a[4], b[4]
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+	idsA, idsB := strings.Split(preA, "."), strings.Split(preB, ".")
+	for i := 0; i < len(idsA) && i < len(idsB); i++ {
+		_, errA := strconv.ParseUint(idsA[i], 10, 64)
+		_, errB := strconv.ParseUint(idsB[i], 10, 64)
+		res := 0
+		switch {
+		case errA == nil && errB == nil:
+			res = compareNumeric(idsA[i], idsB[i])
+		case errA == nil:
+			// Numeric identifiers have lower precedence.
+			res = -1
+		case errB == nil:
+			res = 1
+		default:
+			res = strings.Compare(idsA[i], idsB[i])
+		}
+		if res != 0 {
+			return res
+		}
+	}
+	return compareInts(len(idsA), len(idsB))
+}
+
+// compareNatural compares strings by runs of digits and non-digits.
+func compareNatural(a, b string) int {
+	runsA, runsB := splitRuns(a), splitRuns(b)
+	for i := 0; i < len(runsA) && i < len(runsB); i++ {
+		ra, rb := runsA[i], runsB[i]
+		res := 0
+		if isDigit(ra[0]) && isDigit(rb[0]) {
+			res = compareNumeric(ra, rb)
+		} else {
+			res = strings.Compare(ra, rb)
+		}
+		if res != 0 {
+			return res
+		}
+	}
+	return compareInts(len(runsA), len(runsB))
+}
+
+// compareNumeric compares two non-negative decimal strings of arbitrary length.
+func compareNumeric(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if res := compareInts(len(a), len(b)); res != 0 {
+		return res
+	}
+	return strings.Compare(a, b)
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// splitRuns splits `s` into maximal runs of digits and non-digits.
+func splitRuns(s string) []string {
+	runs := []string{}
+	start := 0
+	for i := 1; i <= len(s); i++ {
+		if i == len(s) || isDigit(s[i]) != isDigit(s[i-1]) {
+			runs = append(runs, s[start:i])
+			start = i
+		}
+	}
+	return runs
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// ResolveVersion resolves a version query (`latest` or a glob such as
+// `20.10.*`) to the highest matching reference of `im` in the store.
+// Aliases and the default reference are not candidates. Images with
+// a concrete reference are returned unchanged.
+func (sc *StoreCache) ResolveVersion(im Image) (Image, error) {
+	if !IsVersionQuery(im.Reference) {
+		return im, nil
+	}
+
+	candidates := []string{}
+	for entry, archive := range sc.Images {
+		if entry.Name != im.Name || entry.Reference == DefaultTagRef || IsVersionQuery(entry.Reference) {
+			continue
+		}
+		if _, ok := resolveAlias(archive); ok {
+			continue
+		}
+		if im.Reference != LatestRef {
+			if ok, err := path.Match(im.Reference, entry.Reference); err != nil {
+				return Image{}, errors.Wrapf(err, "invalid reference pattern %q", im.Reference)
+			} else if !ok {
+				continue
+			}
+		}
+		candidates = append(candidates, entry.Reference)
+	}
+	if len(candidates) == 0 {
+		return Image{}, errors.Errorf("no version of image %s matches %q", im.Name, im.Reference)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return CompareVersions(candidates[i], candidates[j]) < 0
+	})
+
+	resolved := im
+	resolved.Reference = candidates[len(candidates)-1]
+	return resolved, nil
+}
+
+// resolveImageVersion resolves the reference of `im` via ResolveVersion,
+// logging the chosen version.
+func resolveImageVersion(sc *StoreCache, im Image) (Image, error) {
+	resolved, err := sc.ResolveVersion(im)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"image":     im.Name,
+			"reference": im.Reference,
+		}).Error(err)
+		return im, err
+	}
+	if resolved.Reference != im.Reference {
+		logrus.WithFields(logrus.Fields{
+			"image":     im.Name,
+			"query":     im.Reference,
+			"reference": resolved.Reference,
+		}).Info("image version resolved")
+	}
+	return resolved, nil
+}
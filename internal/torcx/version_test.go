@@ -0,0 +1,84 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a   string
+		b   string
+		exp int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"1.2.3", "1.10.0", -1},
+		{"v2.0.0", "1.99.99", 1},
+		{"1.2", "1.2.1", -1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.beta", "1.0.0-alpha.1", 1},
+		{"1.0.0-rc.2", "1.0.0-rc.10", -1},
+		{"17.03.2", "17.3.2", -1},
+		{"20.10.12-ce", "20.10.2-ce", 1},
+		{"2018.04", "2017.12", 1},
+		{"1.12.3.4", "1.12.3.10", -1},
+		{"abc", "abd", -1},
+	}
+
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.exp {
+			t.Errorf("CompareVersions(%q, %q): expected %d, got %d", tt.a, tt.b, tt.exp, got)
+		}
+		if got := CompareVersions(tt.b, tt.a); got != -tt.exp {
+			t.Errorf("CompareVersions(%q, %q): expected %d, got %d", tt.b, tt.a, -tt.exp, got)
+		}
+	}
+}
+
+func TestResolveVersion(t *testing.T) {
+	sc := StoreCache{Images: map[Image]Archive{}}
+	for _, ref := range []string{"1.12.6", "17.03.2", "17.09.1", "18.06.0-rc.1", DefaultTagRef} {
+		im := Image{Name: "docker", Reference: ref}
+		sc.Images[im] = Archive{im, "/nonexistent/docker:" + ref + ".torcx.tgz", ArchiveFormatTgz}
+	}
+
+	tests := []struct {
+		ref    string
+		exp    string
+		expErr bool
+	}{
+		{"17.03.2", "17.03.2", false},
+		{LatestRef, "18.06.0-rc.1", false},
+		{"17.*", "17.09.1", false},
+		{"1.*", "1.12.6", false},
+		{"17.0?.*", "17.09.1", false},
+		{"17.0[0-3].*", "17.03.2", false},
+		{"19.*", "", true},
+		{"17.[*", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := sc.ResolveVersion(Image{Name: "docker", Reference: tt.ref})
+		if tt.expErr != (err != nil) {
+			t.Errorf("reference %q: expected error %t, got %v", tt.ref, tt.expErr, err)
+			continue
+		}
+		if err == nil && got.Reference != tt.exp {
+			t.Errorf("reference %q: expected %q, got %q", tt.ref, tt.exp, got.Reference)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// WarningsV0K - apply warnings record kind, v0
+	WarningsV0K = "torcx-warnings-v0"
+
+	// WarningSkippedImage is recorded for images which failed to apply.
+	WarningSkippedImage = "skipped-image"
+	// WarningSkippedRecommendation is recorded for recommended images
+	// which could not be applied, e.g. as missing from the store.
+	WarningSkippedRecommendation = "skipped-recommendation"
+	// WarningDroppedImage is recorded for optional images dropped as they
+	// ran out of apply time budget.
+	WarningDroppedImage = "dropped-image"
+	// WarningShadowedArchive is recorded for archives hidden by another
+	// archive for the same image in an earlier store.
+	WarningShadowedArchive = "shadowed-archive"
+	// WarningDeprecatedSchema is recorded for manifests using a deprecated kind.
+	WarningDeprecatedSchema = "deprecated-schema"
+	// WarningQuarantinedArchive is recorded for archives rejected by policy.
+	WarningQuarantinedArchive = "quarantined-archive"
+	// WarningPolicyViolation is recorded for each apply policy rule
+	// violated by the profile, enforced or not.
+	WarningPolicyViolation = "policy-violation"
+	// WarningLockedStore is recorded when the encrypted user store could
+	// not be unlocked.
+	WarningLockedStore = "locked-store"
+)
+
+// deprecatedKinds maps deprecated manifest kinds to their replacement.
+var deprecatedKinds = map[string]string{
+	ProfileManifestV0K: ProfileManifestV1K,
+}
+
+// Warning is a machine-readable record of a non-fatal issue met while
+// applying a profile.
+type Warning struct {
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+	Image   *Image    `json:"image,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// WarningsV0JSON holds the warnings recorded by the last apply.
+type WarningsV0JSON struct {
+	Kind  string    `json:"kind"`
+	Value []Warning `json:"value"`
+}
+
+// warn records a non-fatal issue for the warnings file.
+func (applyCfg *ApplyConfig) warn(w Warning) {
+	if w.Time.IsZero() {
+		w.Time = time.Now().UTC()
+	}
+	applyCfg.Warnings = append(applyCfg.Warnings, w)
+}
+
+// warnSkipped records a warning for an image which failed to apply.
+func (applyCfg *ApplyConfig) warnSkipped(im Image, err error) {
+	kind := WarningSkippedImage
+	if im.Recommended {
+		kind = WarningSkippedRecommendation
+	}
+	applyCfg.warn(Warning{
+		Kind:    kind,
+		Message: err.Error(),
+		Image:   &im,
+	})
+}
+
+// warnDropped records a warning for an image dropped by the apply budget.
+func (applyCfg *ApplyConfig) warnDropped(im Image, err error) {
+	applyCfg.warn(Warning{
+		Kind:    WarningDroppedImage,
+		Message: err.Error(),
+		Image:   &im,
+	})
+}
+
+// warnDeprecatedKind records a warning if `kind` (read from `path`) is deprecated.
+func (applyCfg *ApplyConfig) warnDeprecatedKind(kind string, path string) {
+	replacement, ok := deprecatedKinds[kind]
+	if !ok {
+		return
+	}
+	applyCfg.warn(Warning{
+		Kind:    WarningDeprecatedSchema,
+		Message: "manifest kind " + kind + " is deprecated, use " + replacement,
+		Path:    path,
+	})
+}
+
+// writeWarnings atomically writes `warnings` as a JSON record at `path`.
+func writeWarnings(path string, warnings []Warning) error {
+	if warnings == nil {
+		warnings = []Warning{}
+	}
+	tmpPath := path + ".tmp"
+	fp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer fp.Close()
+	bufwr := bufio.NewWriter(fp)
+	enc := json.NewEncoder(bufwr)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(WarningsV0JSON{WarningsV0K, warnings}); err != nil {
+		return errors.Wrapf(err, "writing %q", path)
+	}
+	if err := bufwr.Flush(); err != nil {
+		return errors.Wrapf(err, "writing %q", path)
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// saveWarnings writes the warnings recorded so far, on a best-effort basis.
+func (applyCfg *ApplyConfig) saveWarnings() {
+	path := applyCfg.RunWarnings()
+	if err := writeWarnings(path, applyCfg.Warnings); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"path":  path,
+			"error": err,
+		}).Warn("unable to write warnings")
+		return
+	}
+	if len(applyCfg.Warnings) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"path":     path,
+			"warnings": len(applyCfg.Warnings),
+		}).Info("apply warnings recorded")
+	}
+}
+
+// ReadWarnings reads the warnings record at `path`.
+func ReadWarnings(path string) ([]Warning, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var record WarningsV0JSON
+	if err := json.NewDecoder(bufio.NewReader(fp)).Decode(&record); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s", path)
+	}
+	if record.Kind != WarningsV0K {
+		return nil, errors.Errorf("invalid warnings kind: %s", record.Kind)
+	}
+	return record.Value, nil
+}
+
+// CountWarnings returns the number of warnings for each kind.
+func CountWarnings(warnings []Warning) map[string]int {
+	counts := map[string]int{}
+	for _, w := range warnings {
+		counts[w.Kind]++
+	}
+	return counts
+}
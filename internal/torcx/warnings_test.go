@@ -0,0 +1,75 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWarnings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_warnings_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			RunDir:  dir,
+			ConfDir: filepath.Join(dir, "conf"),
+			UsrDir:  filepath.Join(dir, "usr"),
+		},
+		UpperProfile: "user",
+	}
+	profileDir := applyCfg.UserProfileDir()
+	if err := os.MkdirAll(profileDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	profile := `{"kind": "profile-manifest-v0", "value": {"images": [{"name": "foo", "reference": "1"}]}}`
+	if err := ioutil.WriteFile(filepath.Join(profileDir, "user.json"), []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mergeProfiles(applyCfg); err != nil {
+		t.Fatal(err)
+	}
+
+	sc, err := NewStoreCacheFrom([]Store{
+		memStore{{Image: Image{Name: "foo", Reference: "1"}, Filepath: "/a/foo:1.torcx.tgz", Format: ArchiveFormatTgz}},
+		memStore{{Image: Image{Name: "foo", Reference: "1"}, Filepath: "/b/foo:1.torcx.tgz", Format: ArchiveFormatTgz}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sc.Shadowed) != 1 || sc.Shadowed[0].Filepath != "/b/foo:1.torcx.tgz" {
+		t.Errorf("unexpected shadowed archives %v", sc.Shadowed)
+	}
+	applyCfg.warnSkipped(Image{Name: "bar", Reference: "2"}, os.ErrNotExist)
+
+	applyCfg.saveWarnings()
+	warnings, err := ReadWarnings(applyCfg.RunWarnings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := CountWarnings(warnings)
+	if len(warnings) != 2 || counts[WarningDeprecatedSchema] != 1 || counts[WarningSkippedImage] != 1 {
+		t.Errorf("unexpected warnings %+v", warnings)
+	}
+	if warnings[1].Image == nil || warnings[1].Image.Name != "bar" || warnings[1].Time.IsZero() {
+		t.Errorf("unexpected skipped image warning %+v", warnings[1])
+	}
+}
@@ -21,6 +21,9 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
 )
 
 func Create(w io.Writer, root string) error {
@@ -54,6 +57,9 @@ func Create(w io.Writer, root string) error {
 			if tarHeader.Name == "." {
 				return nil
 			}
+			if err := addXattrs(tarHeader, path); err != nil {
+				return err
+			}
 
 			if err := tw.WriteHeader(tarHeader); err != nil {
 				return err
@@ -84,3 +90,42 @@ func Create(w io.Writer, root string) error {
 
 	return tw.Close()
 }
+
+// addXattrs records the extended attributes of `path` (e.g. IMA/EVM
+// signatures and security labels) in `hdr`, as PAX records.
+func addXattrs(hdr *tar.Header, path string) error {
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return err
+	}
+	for _, key := range strings.Split(string(buf[:size]), "\x00") {
+		if key == "" {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(path, key, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, vsize)
+		vsize, err = unix.Lgetxattr(path, key, value)
+		if err != nil {
+			return err
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords["SCHILY.xattr."+key] = string(value[:vsize])
+	}
+	return nil
+}
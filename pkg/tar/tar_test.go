@@ -0,0 +1,55 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestAddXattrs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := &tar.Header{}
+	if err := addXattrs(hdr, path); err != nil {
+		t.Fatal(err)
+	}
+	if len(hdr.PAXRecords) != 0 {
+		t.Errorf("unexpected records %v", hdr.PAXRecords)
+	}
+
+	// Failures to read attributes are not silently dropped.
+	if err := addXattrs(&tar.Header{}, filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected error for missing file")
+	}
+
+	if err := unix.Lsetxattr(path, "user.torcx", []byte("value"), 0); err != nil {
+		t.Skipf("user xattrs not supported: %s", err)
+	}
+	if err := addXattrs(hdr, path); err != nil {
+		t.Fatal(err)
+	}
+	if v := hdr.PAXRecords["SCHILY.xattr.user.torcx"]; v != "value" {
+		t.Errorf("xattr not recorded, got %q", v)
+	}
+}
@@ -102,6 +102,76 @@ func ExtractRoot(tr *tar.Reader, cfg ExtractCfg) error {
 	return nil
 }
 
+// ExtractDir reads tar entries from r until EOF and creates
+// filesystem entries rooted in targetDir, without chroot-ing into it.
+// It is meant for unprivileged extraction, thus entries which would
+// be created through a symlink (or hardlinked from outside of
+// targetDir) are rejected.
+func ExtractDir(tr *tar.Reader, targetDir string, cfg ExtractCfg) error {
+	if tr == nil {
+		return fmt.Errorf("invalid tar reader")
+	}
+	if targetDir == "" {
+		return fmt.Errorf("empty target directory")
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = filepath.Clean("/" + hdr.Name)
+		if err := checkNoSymlinks(targetDir, hdr.Name); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			if err := checkNoSymlinks(targetDir, hdr.Linkname); err != nil {
+				return err
+			}
+			hdr.Linkname = filepath.Join(targetDir, filepath.Clean("/"+hdr.Linkname))
+		}
+		// Archives may omit entries for parent directories.
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(targetDir, hdr.Name)), 0755); err != nil {
+			return err
+		}
+
+		err = extractOne(hdr, tr, targetDir, cfg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNoSymlinks ensures that no path component of `name` below
+// `targetDir` is a symlink, so that extraction cannot escape `targetDir`.
+func checkNoSymlinks(targetDir string, name string) error {
+	rel := filepath.Clean("/" + name)
+	components := strings.Split(rel, string(filepath.Separator))
+	cur := targetDir
+	for _, p := range components {
+		if p == "" {
+			continue
+		}
+		cur = filepath.Join(cur, p)
+		fi, err := os.Lstat(cur)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("extract: %q would be created through symlink %q", name, cur)
+		}
+	}
+	return nil
+}
+
 func extractOne(hdr *tar.Header, r io.Reader, targetDir string, cfg ExtractCfg) error {
 	// Clean before joining to remove all .. elements
 	path := filepath.Join(targetDir, filepath.Clean(hdr.Name))
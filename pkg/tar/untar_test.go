@@ -0,0 +1,187 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// testEntry is a tar entry, with the content of regular files.
+type testEntry struct {
+	hdr     tar.Header
+	content string
+}
+
+// testArchive returns a reader over a tar archive holding `entries`.
+func testArchive(t *testing.T, entries []testEntry) *tar.Reader {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		hdr.Size = int64(len(e.content))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tar.NewReader(&buf)
+}
+
+func TestExtractDir(t *testing.T) {
+	tests := []struct {
+		desc string
+		// entries may refer to @OUTSIDE@, a directory next to targetDir.
+		entries []testEntry
+
+		expErr bool
+		// expFiles maps paths below targetDir to their expected content.
+		expFiles map[string]string
+	}{
+		{
+			"regular archive",
+			[]testEntry{
+				{tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+				{tar.Header{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0755}, "tool"},
+				{tar.Header{Name: "bin/alias", Typeflag: tar.TypeSymlink, Linkname: "tool"}, ""},
+				{tar.Header{Name: "bin/hard", Typeflag: tar.TypeLink, Linkname: "bin/tool"}, ""},
+				// Parent directories may be omitted.
+				{tar.Header{Name: "./lib/deep/file", Typeflag: tar.TypeReg}, "file"},
+			},
+
+			false,
+			map[string]string{
+				"bin/tool":      "tool",
+				"bin/alias":     "tool",
+				"bin/hard":      "tool",
+				"lib/deep/file": "file",
+			},
+		},
+		{
+			"entry under symlinked dir",
+			[]testEntry{
+				{tar.Header{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "@OUTSIDE@"}, ""},
+				{tar.Header{Name: "dir/evil", Typeflag: tar.TypeReg}, "evil"},
+			},
+
+			true,
+			nil,
+		},
+		{
+			"entry under relative symlinked dir",
+			[]testEntry{
+				{tar.Header{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "../outside"}, ""},
+				{tar.Header{Name: "dir/sub/evil", Typeflag: tar.TypeReg}, "evil"},
+			},
+
+			true,
+			nil,
+		},
+		{
+			"hardlink through symlink",
+			[]testEntry{
+				{tar.Header{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "@OUTSIDE@"}, ""},
+				{tar.Header{Name: "stolen", Typeflag: tar.TypeLink, Linkname: "dir/secret"}, ""},
+			},
+
+			true,
+			nil,
+		},
+		{
+			"dotdot entry",
+			[]testEntry{
+				{tar.Header{Name: "../outside/evil", Typeflag: tar.TypeReg}, "evil"},
+				{tar.Header{Name: "a/../../../b", Typeflag: tar.TypeReg}, "b"},
+			},
+
+			false,
+			map[string]string{
+				"outside/evil": "evil",
+				"b":            "b",
+			},
+		},
+		{
+			"dotdot hardlink",
+			[]testEntry{
+				{tar.Header{Name: "stolen", Typeflag: tar.TypeLink, Linkname: "../outside/secret"}, ""},
+			},
+
+			true,
+			nil,
+		},
+	}
+
+	cfg := ExtractCfg{}.Default()
+	cfg.Chown = false
+	for _, tt := range tests {
+		tmpDir := t.TempDir()
+		targetDir := filepath.Join(tmpDir, "root")
+		outsideDir := filepath.Join(tmpDir, "outside")
+		for _, dir := range []string{targetDir, outsideDir} {
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		secret := filepath.Join(outsideDir, "secret")
+		if err := ioutil.WriteFile(secret, []byte("secret"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		for i := range tt.entries {
+			if tt.entries[i].hdr.Linkname == "@OUTSIDE@" {
+				tt.entries[i].hdr.Linkname = outsideDir
+			}
+		}
+
+		err := ExtractDir(testArchive(t, tt.entries), targetDir, cfg)
+		if tt.expErr != (err != nil) {
+			t.Errorf("testcase %q failed, expected error %t, got %v", tt.desc, tt.expErr, err)
+		}
+		for name, content := range tt.expFiles {
+			b, err := ioutil.ReadFile(filepath.Join(targetDir, name))
+			if err != nil {
+				t.Errorf("testcase %q failed: %s", tt.desc, err)
+				continue
+			}
+			if string(b) != content {
+				t.Errorf("testcase %q failed, %s: got %q, expected %q", tt.desc, name, b, content)
+			}
+		}
+
+		// Nothing may escape targetDir.
+		outside, err := ioutil.ReadDir(outsideDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(outside) != 1 {
+			t.Errorf("testcase %q failed, %d entries written outside of target", tt.desc, len(outside)-1)
+		}
+		if fi, err := os.Stat(secret); err != nil || fi.Sys().(*syscall.Stat_t).Nlink != 1 {
+			t.Errorf("testcase %q failed, outside file linked into target", tt.desc)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcxtest
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+)
+
+// Applier is a scripted stand-in for torcx.ApplyProfile: it reports
+// canned results for a list of images, without unpacking anything.
+type Applier struct {
+	// Images are the images of the merged profile, in apply order.
+	Images []torcx.Image
+	// Results are the errors images fail with, by image name. Images
+	// failing with torcx.ErrBudgetExceeded are dropped, as optional images
+	// running out of apply time budget.
+	Results map[string]error
+	// Err, if set, fails the apply before any image is applied (e.g. as
+	// profiles could not be merged).
+	Err error
+
+	mu    sync.Mutex
+	calls int
+}
+
+// ApplyProfile reports the scripted results through the observer of
+// `applyCfg`, recording applied images and warnings as a real apply would.
+// Failed images are skipped, failing the apply once all images have been
+// processed.
+func (a *Applier) ApplyProfile(applyCfg *torcx.ApplyConfig) error {
+	if applyCfg == nil {
+		return errors.New("missing apply configuration")
+	}
+	a.mu.Lock()
+	a.calls++
+	a.mu.Unlock()
+
+	var observer torcx.ApplyObserver = torcx.NopApplyObserver{}
+	if applyCfg.Observer != nil {
+		observer = applyCfg.Observer
+	}
+	if a.Err != nil {
+		observer.ApplyFinished(nil, a.Err)
+		return a.Err
+	}
+
+	observer.ApplyStarted(a.Images)
+	applied := []torcx.Image{}
+	failed := 0
+	for _, im := range a.Images {
+		observer.ImageStarted(im)
+		archive := torcx.Archive{
+			Image:    im,
+			Filepath: filepath.Join("/torcxtest", im.Name+":"+im.Reference+".torcx.tgz"),
+			Format:   torcx.ArchiveFormatTgz,
+		}
+		if err := a.Results[im.Name]; err != nil {
+			observer.ImageFailed(im, err)
+			kind := torcx.WarningSkippedImage
+			switch {
+			case errors.Cause(err) == torcx.ErrBudgetExceeded:
+				kind = torcx.WarningDroppedImage
+			case im.Recommended:
+				kind = torcx.WarningSkippedRecommendation
+			default:
+				failed++
+			}
+			failedImage := im
+			applyCfg.Warnings = append(applyCfg.Warnings, torcx.Warning{
+				Kind:    kind,
+				Message: err.Error(),
+				Image:   &failedImage,
+				Time:    time.Now().UTC(),
+			})
+			continue
+		}
+		root := filepath.Join(applyCfg.RunUnpackDir(), im.Name)
+		observer.ImageLocated(im, archive)
+		observer.ImageVerified(im, archive)
+		observer.ImageUnpacked(im, root)
+		observer.ImageApplied(im, torcx.Assets{})
+		applyCfg.AppliedImages = append(applyCfg.AppliedImages, torcx.AppliedImage{
+			Image:     im,
+			Requested: im.Reference,
+			Archive:   archive.Filepath,
+			Root:      root,
+		})
+		applied = append(applied, im)
+	}
+
+	var err error
+	if failed > 0 {
+		err = fmt.Errorf("failed to install %d images", failed)
+	}
+	observer.ApplyFinished(applied, err)
+	return err
+}
+
+// Calls returns how many times ApplyProfile has been called.
+func (a *Applier) Calls() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.calls
+}
+
+// Event is an observer event recorded by a Recorder.
+type Event struct {
+	// Kind is the name of the observer method, e.g. "ImageApplied".
+	Kind string
+	// Image is the image the event is about, if any.
+	Image torcx.Image
+	// Path is the URL, rootfs or path reported by the event, if any.
+	Path string
+	// Err is the reported error, if any.
+	Err error
+}
+
+// Recorder is a torcx.ApplyObserver and torcx.FetchObserver recording all
+// events, for later assertions. Progress events are not recorded.
+type Recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// Events returns the events recorded so far, in order.
+func (r *Recorder) Events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+// Kinds returns the kinds of the events recorded so far for image `name`,
+// in order.
+func (r *Recorder) Kinds(name string) []string {
+	kinds := []string{}
+	for _, ev := range r.Events() {
+		if ev.Image.Name == name {
+			kinds = append(kinds, ev.Kind)
+		}
+	}
+	return kinds
+}
+
+func (r *Recorder) record(ev Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+// FetchStarted implements torcx.FetchObserver.
+func (r *Recorder) FetchStarted(im torcx.Image, url string) {
+	r.record(Event{Kind: "FetchStarted", Image: im, Path: url})
+}
+
+// FetchProgress implements torcx.FetchObserver.
+func (r *Recorder) FetchProgress(im torcx.Image, written int64, total int64) {}
+
+// FetchFinished implements torcx.FetchObserver.
+func (r *Recorder) FetchFinished(im torcx.Image, path string, err error) {
+	r.record(Event{Kind: "FetchFinished", Image: im, Path: path, Err: err})
+}
+
+// ApplyStarted implements torcx.ApplyObserver.
+func (r *Recorder) ApplyStarted(images []torcx.Image) {
+	r.record(Event{Kind: "ApplyStarted"})
+}
+
+// ImageStarted implements torcx.ApplyObserver.
+func (r *Recorder) ImageStarted(im torcx.Image) {
+	r.record(Event{Kind: "ImageStarted", Image: im})
+}
+
+// ImageLocated implements torcx.ApplyObserver.
+func (r *Recorder) ImageLocated(im torcx.Image, archive torcx.Archive) {
+	r.record(Event{Kind: "ImageLocated", Image: im, Path: archive.Filepath})
+}
+
+// ImageVerified implements torcx.ApplyObserver.
+func (r *Recorder) ImageVerified(im torcx.Image, archive torcx.Archive) {
+	r.record(Event{Kind: "ImageVerified", Image: im, Path: archive.Filepath})
+}
+
+// ImageUnpacked implements torcx.ApplyObserver.
+func (r *Recorder) ImageUnpacked(im torcx.Image, rootfs string) {
+	r.record(Event{Kind: "ImageUnpacked", Image: im, Path: rootfs})
+}
+
+// ImageApplied implements torcx.ApplyObserver.
+func (r *Recorder) ImageApplied(im torcx.Image, assets torcx.Assets) {
+	r.record(Event{Kind: "ImageApplied", Image: im})
+}
+
+// ImageFailed implements torcx.ApplyObserver.
+func (r *Recorder) ImageFailed(im torcx.Image, err error) {
+	r.record(Event{Kind: "ImageFailed", Image: im, Err: err})
+}
+
+// ApplyFinished implements torcx.ApplyObserver.
+func (r *Recorder) ApplyFinished(applied []torcx.Image, err error) {
+	r.record(Event{Kind: "ApplyFinished", Err: err})
+}
+
+// SystemSealed implements torcx.ApplyObserver.
+func (r *Recorder) SystemSealed(path string, err error) {
+	r.record(Event{Kind: "SystemSealed", Path: path, Err: err})
+}
@@ -0,0 +1,182 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcxtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// remoteKeyName is the keyring file installed alongside remote manifests.
+const remoteKeyName = "torcxtest.asc"
+
+// Remote is a fake torcx remote, serving the images of its Store over
+// HTTP. Its contents manifest is (re)published, clearsigned by a key
+// generated for the remote, whenever images have been added.
+type Remote struct {
+	// Name is the remote name, as referenced by profile images.
+	Name string
+	// Store holds the images served by the remote.
+	Store *Store
+
+	server *httptest.Server
+	signer *openpgp.Entity
+
+	mu       sync.Mutex
+	requests []string
+	failures map[string]int
+	// published is the store generation of the contents manifest
+	published int
+}
+
+// NewRemote starts a remote named `name`, serving archives from `dir`.
+// It must be closed once done.
+func NewRemote(name string, dir string) (*Remote, error) {
+	signer, err := openpgp.NewEntity("torcxtest "+name, "", name+"@torcxtest.invalid", nil)
+	if err != nil {
+		return nil, err
+	}
+	r := &Remote{
+		Name:     name,
+		Store:    NewStore(dir),
+		signer:   signer,
+		failures: map[string]int{},
+		// Publish on first request, even if empty.
+		published: -1,
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	return r, nil
+}
+
+// URL returns the base URL of the remote.
+func (r *Remote) URL() string {
+	return r.server.URL + "/"
+}
+
+// Close stops the remote server.
+func (r *Remote) Close() {
+	r.server.Close()
+}
+
+// Fail makes requests for `path` (relative to the remote base URL, e.g.
+// an archive file name) fail with HTTP `status`, until reset with a zero
+// status.
+func (r *Remote) Fail(path string, status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if status == 0 {
+		delete(r.failures, path)
+		return
+	}
+	r.failures[path] = status
+}
+
+// Requests returns the paths requested so far, in order.
+func (r *Remote) Requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.requests...)
+}
+
+// Install writes a remote manifest for this remote, trusting its signing
+// key, in the configuration directory of `cc`.
+func (r *Remote) Install(cc *torcx.CommonConfig) error {
+	if cc == nil {
+		return errors.New("nil CommonConfig")
+	}
+	buf := &bytes.Buffer{}
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+	if err := r.signer.Serialize(w); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	remoteDir := filepath.Join(cc.ConfDir, "remotes", r.Name)
+	if err := os.MkdirAll(remoteDir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(remoteDir, remoteKeyName), buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	manifest := torcx.RemoteManifestV0JSON{
+		Kind: torcx.RemoteManifestV0K,
+		Value: torcx.RemoteV0{
+			BaseURL: r.URL(),
+			Keys:    []torcx.RemoteKeyV0{{ArmoredKeyring: remoteKeyName}},
+		},
+	}
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(remoteDir, "remote.json"), b, 0644)
+}
+
+// serveHTTP serves the published remote, honouring scripted failures.
+func (r *Remote) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	if len(path) > 0 && path[0] == '/' {
+		path = path[1:]
+	}
+	r.mu.Lock()
+	r.requests = append(r.requests, path)
+	status := r.failures[path]
+	r.mu.Unlock()
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if err := r.publish(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.FileServer(http.Dir(r.Store.dir)).ServeHTTP(w, req)
+}
+
+// publish writes pending archives and a new contents manifest, if needed.
+func (r *Remote) publish() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	generation := r.Store.currentGeneration()
+	if generation == r.published {
+		return nil
+	}
+	dir, err := r.Store.Path()
+	if err != nil {
+		return err
+	}
+	if _, err := torcx.PublishRemote(dir, r.signer); err != nil {
+		return err
+	}
+	r.published = generation
+	return nil
+}
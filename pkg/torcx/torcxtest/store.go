@@ -0,0 +1,263 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package torcxtest provides test doubles for code embedding torcx: an
+// in-memory image store, a fake remote server and a scripted applier, so
+// that embedders (e.g. operators and node agents) can be tested without
+// root privileges nor real archives.
+package torcxtest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+)
+
+// stubBinary is the content of binaries listed in a manifest, but not
+// provided by the caller.
+const stubBinary = "#!/bin/sh\nexit 0\n"
+
+// Store is an in-memory torcx.Store. Archives are built in memory, and
+// only written to its directory when listed (e.g. by a StoreCache), so
+// that it can also be used as a plain store path.
+type Store struct {
+	dir string
+
+	mu      sync.Mutex
+	images  map[torcx.Image][]byte
+	pending map[torcx.Image]bool
+	// generation is bumped on each change to the store contents
+	generation int
+}
+
+// NewStore returns an empty store, backed by `dir` once listed.
+func NewStore(dir string) *Store {
+	return &Store{
+		dir:     dir,
+		images:  map[torcx.Image][]byte{},
+		pending: map[torcx.Image]bool{},
+	}
+}
+
+// Add builds a tgz archive for `im`, shipping an image manifest for
+// `assets` and the given `files` (by path, relative to the image root).
+// Binaries listed in `assets` but missing from `files` are stubbed.
+// An existing archive for the same image is replaced. Images of store
+// namespaces are not supported.
+func (s *Store) Add(im torcx.Image, assets torcx.Assets, files map[string]string) error {
+	if im.Name == "" || im.Reference == "" {
+		return errors.New("missing image name or reference")
+	}
+	if strings.Contains(im.Name, "/") {
+		return errors.Errorf("namespaced image %s not supported", im.Name)
+	}
+	manifest, err := json.Marshal(torcx.ImageManifestV0{
+		Kind:  torcx.ImageManifestV0K,
+		Value: assets,
+	})
+	if err != nil {
+		return err
+	}
+	entries := map[string]string{
+		".torcx/manifest.json": string(manifest),
+	}
+	for _, bin := range assets.Binaries {
+		entries[strings.TrimPrefix(bin, "/")] = stubBinary
+	}
+	for path, content := range files {
+		entries[strings.TrimPrefix(path, "/")] = content
+	}
+	b, err := buildTgz(entries)
+	if err != nil {
+		return errors.Wrapf(err, "building archive for %s:%s", im.Name, im.Reference)
+	}
+
+	key := torcx.Image{Name: im.Name, Reference: im.Reference}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images[key] = b
+	s.pending[key] = true
+	s.generation++
+	return nil
+}
+
+// Remove drops the archive for `im`, also from the store directory.
+func (s *Store) Remove(im torcx.Image) error {
+	key := torcx.Image{Name: im.Name, Reference: im.Reference}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[key]; !ok {
+		return errors.Errorf("image %s:%s not in store", im.Name, im.Reference)
+	}
+	delete(s.images, key)
+	delete(s.pending, key)
+	s.generation++
+	err := os.Remove(s.archivePath(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Bytes returns the content of the archive for `im`, if any.
+func (s *Store) Bytes(im torcx.Image) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.images[torcx.Image{Name: im.Name, Reference: im.Reference}]
+	return b, ok
+}
+
+// Images returns all images in the store, sorted by name and reference.
+func (s *Store) Images() []torcx.Image {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	images := make([]torcx.Image, 0, len(s.images))
+	for im := range s.images {
+		images = append(images, im)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Name != images[j].Name {
+			return images[i].Name < images[j].Name
+		}
+		return torcx.CompareVersions(images[i].Reference, images[j].Reference) < 0
+	})
+	return images
+}
+
+// Path writes pending archives, and returns the store directory (e.g. to
+// be used in torcx.CommonConfig.StorePaths).
+func (s *Store) Path() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		return "", err
+	}
+	return s.dir, nil
+}
+
+// Name implements torcx.Store.
+func (s *Store) Name() string {
+	return s.dir
+}
+
+// Archives implements torcx.Store, writing pending archives first.
+func (s *Store) Archives() ([]torcx.Archive, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		return nil, err
+	}
+	archives := make([]torcx.Archive, 0, len(s.images))
+	for im := range s.images {
+		archives = append(archives, torcx.Archive{
+			Image:    im,
+			Filepath: s.archivePath(im),
+			Format:   torcx.ArchiveFormatTgz,
+		})
+	}
+	return archives, nil
+}
+
+// currentGeneration returns the generation of the store contents.
+func (s *Store) currentGeneration() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.generation
+}
+
+// flush writes pending archives to the store directory. It must be
+// called with the lock held.
+func (s *Store) flush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	for im := range s.pending {
+		if err := ioutil.WriteFile(s.archivePath(im), s.images[im], 0644); err != nil {
+			return err
+		}
+		delete(s.pending, im)
+	}
+	return nil
+}
+
+// archivePath returns the path of the archive for `im` in the store directory.
+func (s *Store) archivePath(im torcx.Image) string {
+	return filepath.Join(s.dir, im.Name+":"+im.Reference+".torcx.tgz")
+}
+
+// buildTgz returns a gzipped tarball of `entries`, with parent directories.
+func buildTgz(entries map[string]string) ([]byte, error) {
+	paths := make([]string, 0, len(entries))
+	for path := range entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	buf := &bytes.Buffer{}
+	gzw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gzw)
+	now := time.Now()
+	dirs := map[string]bool{}
+	for _, path := range paths {
+		for dir := filepath.Dir(path); dir != "." && !dirs[dir]; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	sortedDirs := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sortedDirs = append(sortedDirs, dir)
+	}
+	sort.Strings(sortedDirs)
+	for _, dir := range sortedDirs {
+		hdr := &tar.Header{Name: dir + "/", Mode: 0755, Typeflag: tar.TypeDir, ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range paths {
+		content := entries[path]
+		mode := int64(0644)
+		if strings.HasPrefix(content, "#!") {
+			mode = 0755
+		}
+		hdr := &tar.Header{Name: path, Mode: mode, Size: int64(len(content)), Typeflag: tar.TypeReg, ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
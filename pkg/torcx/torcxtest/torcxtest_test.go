@@ -0,0 +1,182 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcxtest
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/flatcar-linux/torcx/internal/torcx"
+	"github.com/pkg/errors"
+)
+
+func TestStoreSimulateApply(t *testing.T) {
+	dir := t.TempDir()
+	store := NewStore(filepath.Join(dir, "store"))
+	foo := torcx.Image{Name: "foo", Reference: "1"}
+	if err := store.Add(foo, torcx.Assets{Binaries: []string{"/bin/foo"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sc, err := torcx.NewStoreCacheFrom([]torcx.Store{store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sc.ArchiveFor(foo); err != nil {
+		t.Fatal(err)
+	}
+
+	storePath, err := store.Path()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyCfg := &torcx.ApplyConfig{
+		CommonConfig: torcx.CommonConfig{
+			BaseDir:    filepath.Join(dir, "base"),
+			RunDir:     torcx.DefaultRunDir,
+			ConfDir:    filepath.Join(dir, "conf"),
+			UsrDir:     filepath.Join(dir, "usr"),
+			StorePaths: []string{storePath},
+		},
+		UpperProfile: "user",
+	}
+	if err := os.MkdirAll(applyCfg.UserProfileDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	profile := `{"kind": "profile-manifest-v1", "value": {"images": [{"name": "foo", "reference": "1"}]}}`
+	if err := ioutil.WriteFile(filepath.Join(applyCfg.UserProfileDir(), "user.json"), []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &Recorder{}
+	applyCfg.Observer = recorder
+	target := filepath.Join(dir, "target")
+	if err := torcx.SimulateApply(applyCfg, target); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(target, torcx.DefaultRunDir, "bin", "foo")); err != nil {
+		t.Errorf("binary not propagated: %s", err)
+	}
+	kinds := recorder.Kinds("foo")
+	if len(kinds) == 0 || kinds[len(kinds)-1] != "ImageApplied" {
+		t.Errorf("unexpected events %v", kinds)
+	}
+
+	if err := store.Remove(foo); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Images()) != 0 {
+		t.Errorf("unexpected images %v", store.Images())
+	}
+}
+
+func TestRemoteFetch(t *testing.T) {
+	dir := t.TempDir()
+	remote, err := NewRemote("test", filepath.Join(dir, "served"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	foo := torcx.Image{Name: "foo", Reference: "1", Remote: "test"}
+	if err := remote.Store.Add(foo, torcx.Assets{Binaries: []string{"/bin/foo"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := &torcx.CommonConfig{
+		BaseDir: filepath.Join(dir, "base"),
+		ConfDir: filepath.Join(dir, "conf"),
+		UsrDir:  filepath.Join(dir, "usr"),
+	}
+	if err := remote.Install(cc); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	rc, err := cc.LoadRemotes(ctx, []string{"test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &Recorder{}
+	rc.Observer = recorder
+
+	storePath := filepath.Join(dir, "user-store")
+	if err := os.MkdirAll(storePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	remote.Fail("foo:1.torcx.tgz", http.StatusNotFound)
+	if err := rc.FetchImage(ctx, foo, storePath); err == nil {
+		t.Fatal("expected scripted fetch failure")
+	}
+	remote.Fail("foo:1.torcx.tgz", 0)
+	if err := rc.FetchImage(ctx, foo, storePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(storePath, "foo:1.torcx.tgz")); err != nil {
+		t.Errorf("archive not fetched: %s", err)
+	}
+	events := recorder.Events()
+	if last := events[len(events)-1]; last.Kind != "FetchFinished" || last.Err != nil {
+		t.Errorf("unexpected last event %+v", last)
+	}
+	if len(remote.Requests()) == 0 {
+		t.Error("no requests recorded")
+	}
+}
+
+func TestApplier(t *testing.T) {
+	errBroken := errors.New("broken archive")
+	applier := &Applier{
+		Images: []torcx.Image{
+			{Name: "foo", Reference: "1"},
+			{Name: "bar", Reference: "2"},
+			{Name: "baz", Reference: "3"},
+		},
+		Results: map[string]error{
+			"bar": errBroken,
+			"baz": torcx.ErrBudgetExceeded,
+		},
+	}
+	recorder := &Recorder{}
+	applyCfg := &torcx.ApplyConfig{
+		CommonConfig: torcx.CommonConfig{RunDir: torcx.DefaultRunDir},
+		Observer:     recorder,
+	}
+
+	if err := applier.ApplyProfile(applyCfg); err == nil {
+		t.Fatal("expected apply failure")
+	}
+	if applier.Calls() != 1 {
+		t.Errorf("unexpected calls %d", applier.Calls())
+	}
+	if len(applyCfg.AppliedImages) != 1 || applyCfg.AppliedImages[0].Name != "foo" {
+		t.Errorf("unexpected applied images %v", applyCfg.AppliedImages)
+	}
+	counts := torcx.CountWarnings(applyCfg.Warnings)
+	if counts[torcx.WarningSkippedImage] != 1 || counts[torcx.WarningDroppedImage] != 1 {
+		t.Errorf("unexpected warnings %v", counts)
+	}
+	if kinds := recorder.Kinds("bar"); !reflect.DeepEqual(kinds, []string{"ImageStarted", "ImageFailed"}) {
+		t.Errorf("unexpected events %v", kinds)
+	}
+
+	applier.Results = nil
+	if err := applier.ApplyProfile(applyCfg); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}